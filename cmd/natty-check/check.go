@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// How a NAT maps an internal address to external addresses (RFC 4787)
+	mappingNone        = "none"                 // not behind a NAT
+	mappingIndependent = "endpoint-independent" // same mapping for every destination (cone NAT)
+	mappingDependent   = "endpoint-dependent"   // different mapping per destination (symmetric NAT)
+	mappingUnknown     = "unknown"              // not enough STUN servers responded to tell
+	mappingBlocked     = "blocked"              // no STUN server responded
+
+	// Whether the NAT loops packets sent to its public address back inside
+	hairpinSupported   = "supported"
+	hairpinUnsupported = "unsupported"
+
+	verdictLikely    = "likely"
+	verdictUncertain = "uncertain"
+	verdictHopeless  = "hopeless"
+)
+
+// report is the result of all checks.
+type report struct {
+	Interfaces []*interfaceReport `json:"interfaces"`
+	Lifetime   *lifetimeReport    `json:"mappingLifetime,omitempty"`
+	Echo       *echoReport        `json:"echo,omitempty"`
+	Verdict    string             `json:"verdict"`
+}
+
+// interfaceReport is the result of probing the STUN servers from one local
+// address.
+type interfaceReport struct {
+	Name        string         `json:"name"`
+	Address     string         `json:"address"`
+	Probes      []*probeReport `json:"probes"`
+	Mapping     string         `json:"mapping"`
+	Hairpinning string         `json:"hairpinning,omitempty"` // only checked behind a NAT
+}
+
+// probeReport is the result of probing one STUN server.
+type probeReport struct {
+	Server    string  `json:"server"`
+	Reachable bool    `json:"reachable"`
+	Mapped    string  `json:"mapped,omitempty"`
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// lifetimeReport bounds how long the NAT keeps an idle mapping.
+type lifetimeReport struct {
+	Interface      string  `json:"interface"`
+	AtLeastSeconds float64 `json:"atLeastSeconds"`
+	AtMostSeconds  float64 `json:"atMostSeconds,omitempty"` // 0 if the mapping outlived all probes
+	Error          string  `json:"error,omitempty"`
+}
+
+// echoReport is the result of checking UDP to an echo endpoint.
+type echoReport struct {
+	Target string  `json:"target"`
+	Works  bool    `json:"works"`
+	RTTMs  float64 `json:"rttMs,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// localAddr is a local address from which to probe.
+type localAddr struct {
+	iface string
+	ip    net.IP
+}
+
+// usableAddrs returns the global unicast addresses of all interfaces that are
+// up, excluding loopback.
+func usableAddrs() ([]*localAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var result []*localAddr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if ok && ipnet.IP.IsGlobalUnicast() {
+				result = append(result, &localAddr{iface.Name, ipnet.IP})
+			}
+		}
+	}
+	return result, nil
+}
+
+func udpNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// checkInterface probes all of the given STUN servers from a single socket
+// bound to the given local address, and classifies the NAT's mapping behavior
+// by comparing the mapped addresses.
+func checkInterface(local *localAddr, servers []string, timeout time.Duration) *interfaceReport {
+	ir := &interfaceReport{Name: local.iface, Address: local.ip.String()}
+	network := udpNetwork(local.ip)
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: local.ip})
+	if err != nil {
+		ir.Mapping = mappingBlocked
+		ir.Probes = append(ir.Probes, &probeReport{Error: fmt.Sprintf("Unable to listen: %s", err)})
+		return ir
+	}
+	defer conn.Close()
+
+	var mapped []*net.UDPAddr
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		pr := &probeReport{Server: server}
+		ir.Probes = append(ir.Probes, pr)
+		addr, err := resolveSTUN(network, server)
+		if err != nil {
+			pr.Error = err.Error()
+			continue
+		}
+		if seen[addr.String()] {
+			pr.Error = fmt.Sprintf("Same address as another server (%s)", addr)
+			continue
+		}
+		seen[addr.String()] = true
+		m, latency, err := query(conn, addr, timeout)
+		if err != nil {
+			pr.Error = err.Error()
+			continue
+		}
+		pr.Reachable = true
+		pr.Mapped = m.String()
+		pr.LatencyMs = float64(latency) / float64(time.Millisecond)
+		mapped = append(mapped, m)
+	}
+	ir.Mapping = classifyMapping(conn.LocalAddr().(*net.UDPAddr), mapped)
+	if ir.Mapping != mappingNone && ir.Mapping != mappingBlocked {
+		ir.Hairpinning = hairpinUnsupported
+		if checkHairpin(conn, local.ip, mapped[0], timeout) {
+			ir.Hairpinning = hairpinSupported
+		}
+	}
+	return ir
+}
+
+// checkHairpin checks whether the NAT supports hairpinning by sending a packet
+// from another local socket to conn's public address (mapped), and seeing if it
+// arrives on conn.
+func checkHairpin(conn *net.UDPConn, ip net.IP, mapped *net.UDPAddr, timeout time.Duration) bool {
+	sender, err := net.ListenUDP(udpNetwork(ip), &net.UDPAddr{IP: ip})
+	if err != nil {
+		return false
+	}
+	defer sender.Close()
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return false
+	}
+	_, err = sender.WriteToUDP(nonce, mapped)
+	if err != nil {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	b := make([]byte, 1024)
+	for {
+		n, _, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return false
+		}
+		if bytes.Equal(b[:n], nonce) {
+			return true
+		}
+	}
+}
+
+// classifyMapping classifies the NAT's mapping behavior based on the addresses
+// to which the given local address was mapped by different STUN servers.
+func classifyMapping(local *net.UDPAddr, mapped []*net.UDPAddr) string {
+	if len(mapped) == 0 {
+		return mappingBlocked
+	}
+	same := true
+	for _, m := range mapped[1:] {
+		if !sameAddr(m, mapped[0]) {
+			same = false
+		}
+	}
+	switch {
+	case same && sameAddr(mapped[0], local):
+		return mappingNone
+	case len(mapped) == 1:
+		return mappingUnknown
+	case same:
+		return mappingIndependent
+	default:
+		return mappingDependent
+	}
+}
+
+func sameAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// lifetimeIntervals returns the idle intervals with which to measure mapping
+// lifetime, doubling from 5 seconds up to max.
+func lifetimeIntervals(max time.Duration) []time.Duration {
+	var intervals []time.Duration
+	for interval := 5 * time.Second; interval <= max; interval *= 2 {
+		intervals = append(intervals, interval)
+	}
+	return intervals
+}
+
+// measureLifetime bounds how long the NAT keeps an idle mapping by probing
+// server from the same socket after each of the given idle intervals, and
+// checking whether the mapping changed.
+func measureLifetime(local *localAddr, server string, intervals []time.Duration, timeout time.Duration) *lifetimeReport {
+	lr := &lifetimeReport{Interface: local.iface}
+	network := udpNetwork(local.ip)
+	addr, err := resolveSTUN(network, server)
+	if err != nil {
+		lr.Error = err.Error()
+		return lr
+	}
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: local.ip})
+	if err != nil {
+		lr.Error = err.Error()
+		return lr
+	}
+	defer conn.Close()
+
+	last, _, err := query(conn, addr, timeout)
+	if err != nil {
+		lr.Error = err.Error()
+		return lr
+	}
+	for _, interval := range intervals {
+		time.Sleep(interval)
+		current, _, err := query(conn, addr, timeout)
+		if err != nil {
+			lr.Error = err.Error()
+			return lr
+		}
+		if !sameAddr(current, last) {
+			lr.AtMostSeconds = interval.Seconds()
+			return lr
+		}
+		lr.AtLeastSeconds = interval.Seconds()
+		last = current
+	}
+	return lr
+}
+
+// checkEcho checks whether UDP works to an endpoint that echoes back what it
+// receives.
+func checkEcho(target string, timeout time.Duration) *echoReport {
+	er := &echoReport{Target: target}
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		er.Error = err.Error()
+		return er
+	}
+	defer conn.Close()
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		er.Error = err.Error()
+		return er
+	}
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	_, err = conn.Write(nonce)
+	if err != nil {
+		er.Error = err.Error()
+		return er
+	}
+	b := make([]byte, 1024)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			er.Error = err.Error()
+			return er
+		}
+		if bytes.Equal(b[:n], nonce) {
+			er.Works = true
+			er.RTTMs = float64(time.Now().Sub(start)) / float64(time.Millisecond)
+			return er
+		}
+	}
+}
+
+// verdict decides how likely direct traversal is to work, based on the best
+// interface.
+func verdict(r *report) string {
+	result := verdictHopeless
+	for _, ir := range r.Interfaces {
+		switch ir.Mapping {
+		case mappingNone, mappingIndependent:
+			result = verdictLikely
+		case mappingUnknown:
+			if result == verdictHopeless {
+				result = verdictUncertain
+			}
+		}
+	}
+	if result == verdictLikely && r.Echo != nil && !r.Echo.Works {
+		result = verdictUncertain
+	}
+	return result
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+const (
+	stunBindingResponse      = 0x0101
+	stunMagicCookie          = 0x2112A442
+	stunHeaderSize           = 20
+	stunAttrXorMappedAddress = 0x0020
+)
+
+var loopback = &localAddr{"lo", net.IPv4(127, 0, 0, 1)}
+
+func TestClassifyMapping(t *testing.T) {
+	local := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 5000}
+	mapped1 := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 6000}
+	mapped2 := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 6001}
+
+	assert.Equal(t, mappingBlocked, classifyMapping(local, nil))
+	assert.Equal(t, mappingNone, classifyMapping(local, []*net.UDPAddr{local, local}))
+	assert.Equal(t, mappingUnknown, classifyMapping(local, []*net.UDPAddr{mapped1}))
+	assert.Equal(t, mappingIndependent, classifyMapping(local, []*net.UDPAddr{mapped1, mapped1}))
+	assert.Equal(t, mappingDependent, classifyMapping(local, []*net.UDPAddr{mapped1, mapped2}))
+}
+
+func TestCheckInterface(t *testing.T) {
+	a := startFakeSTUN(t, func(from *net.UDPAddr) *net.UDPAddr { return from })
+	defer a.Close()
+	b := startFakeSTUN(t, func(from *net.UDPAddr) *net.UDPAddr { return from })
+	defer b.Close()
+	servers := []string{"stun:" + a.LocalAddr().String(), b.LocalAddr().String()}
+
+	ir := checkInterface(loopback, servers, 250*time.Millisecond)
+	assert.Equal(t, mappingNone, ir.Mapping, "Address reflected as is means no NAT")
+	assert.Equal(t, "", ir.Hairpinning, "Hairpinning only applies behind a NAT")
+	if assert.Len(t, ir.Probes, 2) {
+		assert.True(t, ir.Probes[0].Reachable)
+		assert.True(t, ir.Probes[1].Reachable)
+	}
+
+	natted := startFakeSTUN(t, func(from *net.UDPAddr) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 6000}
+	})
+	defer natted.Close()
+	symmetric := startFakeSTUN(t, func(from *net.UDPAddr) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 6001}
+	})
+	defer symmetric.Close()
+	silent := startFakeSTUN(t, nil)
+	defer silent.Close()
+
+	ir = checkInterface(loopback, []string{natted.LocalAddr().String(), silent.LocalAddr().String()}, 250*time.Millisecond)
+	assert.Equal(t, mappingUnknown, ir.Mapping, "Single responding server can't tell mapping behavior")
+	assert.Equal(t, hairpinUnsupported, ir.Hairpinning, "Unreachable public address means no hairpinning")
+	assert.False(t, ir.Probes[1].Reachable)
+	assert.NotEmpty(t, ir.Probes[1].Error)
+
+	ir = checkInterface(loopback, []string{natted.LocalAddr().String(), symmetric.LocalAddr().String()}, 250*time.Millisecond)
+	assert.Equal(t, mappingDependent, ir.Mapping, "Different mappings per server mean symmetric NAT")
+	assert.Equal(t, verdictHopeless, verdict(&report{Interfaces: []*interfaceReport{ir}}))
+}
+
+func TestCheckHairpin(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer conn.Close()
+	silent := startFakeSTUN(t, nil)
+	defer silent.Close()
+
+	assert.True(t, checkHairpin(conn, loopback.ip, conn.LocalAddr().(*net.UDPAddr), 250*time.Millisecond), "Packets to public address arriving means hairpinning")
+	assert.False(t, checkHairpin(conn, loopback.ip, silent.LocalAddr().(*net.UDPAddr), 250*time.Millisecond), "Packets to public address not arriving means no hairpinning")
+}
+
+func TestMeasureLifetime(t *testing.T) {
+	var requests int32
+	expiring := startFakeSTUN(t, func(from *net.UDPAddr) *net.UDPAddr {
+		// Mapping changes on the third request
+		port := 6000
+		if atomic.AddInt32(&requests, 1) >= 3 {
+			port = 6001
+		}
+		return &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: port}
+	})
+	defer expiring.Close()
+
+	intervals := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond}
+	lr := measureLifetime(loopback, expiring.LocalAddr().String(), intervals, 250*time.Millisecond)
+	assert.Empty(t, lr.Error)
+	assert.Equal(t, 0.01, lr.AtLeastSeconds)
+	assert.Equal(t, 0.02, lr.AtMostSeconds)
+
+	stable := startFakeSTUN(t, func(from *net.UDPAddr) *net.UDPAddr { return from })
+	defer stable.Close()
+	lr = measureLifetime(loopback, stable.LocalAddr().String(), intervals, 250*time.Millisecond)
+	assert.Equal(t, 0.04, lr.AtLeastSeconds)
+	assert.Equal(t, float64(0), lr.AtMostSeconds, "Mapping that outlived all probes has no upper bound")
+
+	assert.Len(t, lifetimeIntervals(80*time.Second), 5)
+	assert.Empty(t, lifetimeIntervals(0))
+}
+
+func TestEcho(t *testing.T) {
+	echoer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer echoer.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := echoer.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echoer.WriteToUDP(b[:n], addr)
+		}
+	}()
+	silent := startFakeSTUN(t, nil)
+	defer silent.Close()
+
+	er := checkEcho(echoer.LocalAddr().String(), 250*time.Millisecond)
+	assert.True(t, er.Works, "Echo should work")
+	er = checkEcho(silent.LocalAddr().String(), 250*time.Millisecond)
+	assert.False(t, er.Works, "Silent endpoint doesn't echo")
+
+	likely := &interfaceReport{Mapping: mappingIndependent}
+	assert.Equal(t, verdictLikely, verdict(&report{Interfaces: []*interfaceReport{likely}}))
+	assert.Equal(t, verdictUncertain, verdict(&report{Interfaces: []*interfaceReport{likely}, Echo: er}), "Failed echo makes verdict uncertain")
+}
+
+func TestPrintSummary(t *testing.T) {
+	out := &bytes.Buffer{}
+	printSummary(out, &report{
+		Interfaces: []*interfaceReport{{
+			Name:    "eth0",
+			Address: "192.168.1.2",
+			Mapping: mappingIndependent,
+			Probes:  []*probeReport{{Server: "stun:a:3478", Reachable: true, Mapped: "203.0.113.7:6000", LatencyMs: 12}},
+		}},
+		Lifetime: &lifetimeReport{Interface: "eth0", AtLeastSeconds: 20, AtMostSeconds: 40},
+		Verdict:  verdictLikely,
+	})
+	assert.Equal(t, `Interface eth0 (192.168.1.2): NAT mapping is endpoint-independent
+  stun:a:3478: reflexive address 203.0.113.7:6000 (12ms)
+Mapping lifetime on eth0: between 20s and 40s, keepalives must be more frequent
+Direct traversal is likely
+`, out.String())
+	assert.Equal(t, EXIT_HOPELESS, exitCode(verdictHopeless))
+}
+
+// startFakeSTUN starts a local STUN server that answers binding requests with
+// the address returned by mapped, or doesn't answer at all if that's nil.
+func startFakeSTUN(t *testing.T, mapped func(from *net.UDPAddr) *net.UDPAddr) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if mapped == nil || n < stunHeaderSize {
+				continue
+			}
+			m := mapped(addr)
+			resp := make([]byte, stunHeaderSize+12)
+			binary.BigEndian.PutUint16(resp, stunBindingResponse)
+			binary.BigEndian.PutUint16(resp[2:], 12)
+			copy(resp[4:stunHeaderSize], b[4:stunHeaderSize])
+			binary.BigEndian.PutUint16(resp[20:], stunAttrXorMappedAddress)
+			binary.BigEndian.PutUint16(resp[22:], 8)
+			resp[25] = 0x01
+			binary.BigEndian.PutUint16(resp[26:], uint16(m.Port)^(stunMagicCookie>>16))
+			ip := m.IP.To4()
+			for i := range ip {
+				resp[28+i] = ip[i] ^ resp[4+i]
+			}
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+	return conn
+}
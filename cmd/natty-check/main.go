@@ -0,0 +1,149 @@
+// natty-check characterizes the local network to help debug NAT traversal
+// failures. It probes STUN servers from every interface to find the reflexive
+// addresses and the NAT's mapping behavior, measures how long the NAT keeps
+// idle mappings, optionally checks UDP to an echo endpoint, and prints a
+// summary (or JSON with -json) suitable for attaching to bug reports. It needs
+// neither a signaling server nor a peer.
+//
+// The exit code is 0 if direct traversal is likely to work, 1 if that's
+// uncertain and 2 if it's hopeless (for example behind a symmetric NAT).
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getlantern/go-natty/natty"
+)
+
+const (
+	EXIT_LIKELY    = 0
+	EXIT_UNCERTAIN = 1
+	EXIT_HOPELESS  = 2
+)
+
+var (
+	// defaultSTUNServers are natty's defaults plus a second server, since
+	// telling cone from symmetric NATs requires at least two servers
+	defaultSTUNServers = append(append([]string{}, natty.DefaultSTUNServers...), "stun:stun1.l.google.com:19302")
+
+	stun     = flag.String("stun", strings.Join(defaultSTUNServers, ","), "Comma-separated list of STUN servers (host:port) to probe. At least two are needed to detect symmetric NATs.")
+	echo     = flag.String("echo", "", "host:port of a UDP echo endpoint to check")
+	lifetime = flag.Duration("lifetime", 80*time.Second, "Longest idle interval with which to measure mapping lifetime, 0 to skip")
+	timeout  = flag.Duration("timeout", 3*time.Second, "How long to wait for each STUN or echo response")
+	jsonOut  = flag.Bool("json", false, "Print the results as JSON")
+)
+
+func main() {
+	flag.Parse()
+
+	var servers []string
+	for _, server := range strings.Split(*stun, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		fmt.Fprintln(os.Stderr, "Please specify at least one -stun server")
+		os.Exit(EXIT_UNCERTAIN)
+	}
+
+	r, err := check(servers, *echo, lifetimeIntervals(*lifetime), *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to check network: %s\n", err)
+		os.Exit(EXIT_UNCERTAIN)
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+	} else {
+		printSummary(os.Stdout, r)
+	}
+	os.Exit(exitCode(r.Verdict))
+}
+
+// check runs all checks.
+func check(servers []string, echoTarget string, intervals []time.Duration, timeout time.Duration) (*report, error) {
+	addrs, err := usableAddrs()
+	if err != nil {
+		return nil, err
+	}
+	r := &report{}
+	for _, addr := range addrs {
+		r.Interfaces = append(r.Interfaces, checkInterface(addr, servers, timeout))
+	}
+	if len(intervals) > 0 {
+		// Measure on the first NATed interface, mappings don't expire otherwise
+		for i, ir := range r.Interfaces {
+			if ir.Mapping != mappingIndependent && ir.Mapping != mappingUnknown {
+				continue
+			}
+			for _, pr := range ir.Probes {
+				if pr.Reachable {
+					r.Lifetime = measureLifetime(addrs[i], pr.Server, intervals, timeout)
+					break
+				}
+			}
+			break
+		}
+	}
+	if echoTarget != "" {
+		r.Echo = checkEcho(echoTarget, timeout)
+	}
+	r.Verdict = verdict(r)
+	return r, nil
+}
+
+func exitCode(verdict string) int {
+	switch verdict {
+	case verdictLikely:
+		return EXIT_LIKELY
+	case verdictHopeless:
+		return EXIT_HOPELESS
+	}
+	return EXIT_UNCERTAIN
+}
+
+// printSummary prints a human-readable summary of the report.
+func printSummary(w io.Writer, r *report) {
+	if len(r.Interfaces) == 0 {
+		fmt.Fprintln(w, "No usable network interfaces found")
+	}
+	for _, ir := range r.Interfaces {
+		fmt.Fprintf(w, "Interface %s (%s): NAT mapping is %s\n", ir.Name, ir.Address, ir.Mapping)
+		if ir.Hairpinning != "" {
+			fmt.Fprintf(w, "  Hairpinning is %s\n", ir.Hairpinning)
+		}
+		for _, pr := range ir.Probes {
+			if pr.Reachable {
+				fmt.Fprintf(w, "  %s: reflexive address %s (%.0fms)\n", pr.Server, pr.Mapped, pr.LatencyMs)
+			} else {
+				fmt.Fprintf(w, "  %s: unreachable: %s\n", pr.Server, pr.Error)
+			}
+		}
+	}
+	if lr := r.Lifetime; lr != nil {
+		switch {
+		case lr.Error != "":
+			fmt.Fprintf(w, "Mapping lifetime on %s: unable to measure: %s\n", lr.Interface, lr.Error)
+		case lr.AtMostSeconds > 0:
+			fmt.Fprintf(w, "Mapping lifetime on %s: between %.0fs and %.0fs, keepalives must be more frequent\n", lr.Interface, lr.AtLeastSeconds, lr.AtMostSeconds)
+		default:
+			fmt.Fprintf(w, "Mapping lifetime on %s: at least %.0fs\n", lr.Interface, lr.AtLeastSeconds)
+		}
+	}
+	if er := r.Echo; er != nil {
+		if er.Works {
+			fmt.Fprintf(w, "UDP to %s works (%.0fms)\n", er.Target, er.RTTMs)
+		} else {
+			fmt.Fprintf(w, "UDP to %s doesn't work: %s\n", er.Target, er.Error)
+		}
+	}
+	fmt.Fprintf(w, "Direct traversal is %s\n", r.Verdict)
+}
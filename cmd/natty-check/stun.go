@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	stunclient "github.com/getlantern/go-natty/natty/stun"
+)
+
+// resolveSTUN resolves a STUN server given as [stun:]host:port for the given
+// network (udp4 or udp6).
+func resolveSTUN(network string, server string) (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr(network, strings.TrimPrefix(server, "stun:"))
+}
+
+// query asks server for conn's mapped address, retransmitting for up to
+// timeout, and returns it along with how long it took. Querying from the
+// caller's socket means that the mapped address is the mapping for that
+// socket.
+func query(conn *net.UDPConn, server *net.UDPAddr, timeout time.Duration) (*net.UDPAddr, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	mapped, err := stunclient.Query(ctx, conn, server.String())
+	if err == context.DeadlineExceeded {
+		return nil, 0, fmt.Errorf("No response within %s", timeout)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return net.UDPAddrFromAddrPort(mapped), time.Now().Sub(start), nil
+}
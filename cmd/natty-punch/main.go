@@ -0,0 +1,273 @@
+// natty-punch runs a single NAT traversal and prints the resulting FiveTuple,
+// which makes it easy to drive traversals from scripts and non-Go programs.
+//
+// With -signal stdio, inbound signaling messages are read from stdin (one per
+// line) and outbound ones are written to stdout, so two natty-punch processes
+// can traverse by piping each one's stdout into the other's stdin. With -signal
+// waddell, messages are exchanged with -peer via a waddell server instead.
+//
+// On success, the FiveTuple is written as JSON to fd 3 (or the -out file) and
+// natty-punch exits 0. Natty is stopped before exiting, so the FiveTuple's
+// local port is free for the caller to use.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/getlantern/go-natty/natty"
+	"github.com/getlantern/waddell"
+)
+
+const (
+	EXIT_SUCCESS = 0
+	EXIT_FAILED  = 1
+	EXIT_USAGE   = 2
+
+	PunchTopic = waddell.TopicId(10001)
+)
+
+var (
+	role        = flag.String("role", "", "offer or answer. The offerer initiates the traversal.")
+	signal      = flag.String("signal", "stdio", "How to exchange signaling messages with the peer: stdio or waddell")
+	timeout     = flag.Duration("timeout", 30*time.Second, "How long to wait for the traversal to succeed")
+	transport   = flag.String("transport", "udp", "Transport to traverse over: udp, fallback-tcp (UDP if possible, otherwise TCP), prefer-tcp or tcp. The FiveTuple's proto says which one was used. Only udp works with the bundled natty.")
+	outPath     = flag.String("out", "", "File to which to write the FiveTuple as JSON, defaults to fd 3")
+	waddellAddr = flag.String("waddell", "128.199.130.61:443", "Address of waddell signaling server (only used with -signal waddell)")
+	waddellCert = flag.String("waddellcert", "", "PEM file with the waddell server's certificate, if it uses TLS (only used with -signal waddell)")
+	peer        = flag.String("peer", "", "Waddell id of the peer (only used with -signal waddell). Required when offering, the answerer answers whoever sends it an offer.")
+)
+
+// signaler exchanges signaling messages with the peer.
+type signaler interface {
+	// send sends a message to the peer, taking ownership of msg.
+	send(msg []byte) error
+
+	// receive receives messages from the peer and passes them to msgIn, which
+	// takes ownership of them, until there are no more.
+	receive(msgIn func(msg []byte))
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	flag.Parse()
+
+	var offering bool
+	switch *role {
+	case "offer":
+		offering = true
+	case "answer":
+	default:
+		usageError("Please specify -role offer or -role answer")
+	}
+
+	tr, err := natty.ParseTransport(*transport)
+	if err != nil {
+		usageError("%s", err)
+	}
+	err = natty.CheckTransport(tr)
+	if err != nil {
+		usageError("-transport %s is not supported by the bundled natty: %s", tr, err)
+	}
+
+	out, err := openOut(*outPath)
+	if err != nil {
+		usageError("%s", err)
+	}
+	defer out.Close()
+
+	var s signaler
+	switch *signal {
+	case "stdio":
+		s = &stdioSignaler{in: os.Stdin, out: os.Stdout}
+	case "waddell":
+		s, err = newWaddellSignaler(offering)
+		if err != nil {
+			fail("%s", err)
+		}
+	default:
+		usageError("Unknown -signal %s, should be stdio or waddell", *signal)
+	}
+
+	ft, err := punch(offering, s, *timeout, natty.WithTransport(tr))
+	if err != nil {
+		fail("Unable to traverse: %s", err)
+	}
+	err = json.NewEncoder(out).Encode(ft)
+	if err != nil {
+		fail("Unable to write FiveTuple: %s", err)
+	}
+	os.Exit(EXIT_SUCCESS)
+}
+
+// punch runs a traversal with the given options, exchanging signaling
+// messages with s, and returns the resulting FiveTuple once natty has stopped.
+func punch(offering bool, s signaler, timeout time.Duration, opts ...natty.Option) (*natty.FiveTuple, error) {
+	var t *natty.Traversal
+	if offering {
+		t = natty.Offer(timeout, opts...)
+	} else {
+		t = natty.Answer(timeout, opts...)
+	}
+	defer t.Close()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, done := t.NextMsgOutBytes()
+			if done {
+				return
+			}
+			err := s.send(msg)
+			if err != nil {
+				sendErr <- err
+				return
+			}
+		}
+	}()
+	go s.receive(t.MsgInBytes)
+
+	result := make(chan error, 1)
+	var ft *natty.FiveTuple
+	go func() {
+		var err error
+		ft, err = t.FiveTuple()
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return ft, err
+	case err := <-sendErr:
+		return nil, fmt.Errorf("Unable to send signaling message: %s", err)
+	}
+}
+
+// openOut opens the file to which to write the FiveTuple, which is fd 3 if
+// path is empty.
+func openOut(path string) (io.WriteCloser, error) {
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create %s: %s", path, err)
+		}
+		return f, nil
+	}
+	f := os.NewFile(3, "fd3")
+	if _, err := f.Stat(); err != nil {
+		return nil, fmt.Errorf("fd 3 isn't open, please open it or specify -out")
+	}
+	return f, nil
+}
+
+// stdioSignaler exchanges signaling messages one per line.
+type stdioSignaler struct {
+	in  io.Reader
+	out io.Writer
+}
+
+func (s *stdioSignaler) send(msg []byte) error {
+	_, err := s.out.Write(append(msg, '\n'))
+	natty.ReleaseMsg(msg)
+	return err
+}
+
+func (s *stdioSignaler) receive(msgIn func(msg []byte)) {
+	scanner := bufio.NewScanner(s.in)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); len(line) > 0 {
+			// The scanner reuses line, so copy it into a buffer of natty's
+			msgIn(append(natty.NewMsgBuffer(), line...))
+		}
+	}
+}
+
+// waddellSignaler exchanges signaling messages with a peer via waddell.
+type waddellSignaler struct {
+	out    chan<- *waddell.MessageOut
+	in     <-chan *waddell.MessageIn
+	peerId chan waddell.PeerId // holds the peer's id once it's known
+}
+
+func newWaddellSignaler(offering bool) (*waddellSignaler, error) {
+	s := &waddellSignaler{peerId: make(chan waddell.PeerId, 1)}
+	if *peer != "" {
+		peerId, err := waddell.PeerIdFromString(*peer)
+		if err != nil {
+			usageError("Unable to parse -peer %s: %s", *peer, err)
+		}
+		s.peerId <- peerId
+	} else if offering {
+		usageError("Please specify the -peer to which to offer")
+	}
+
+	var serverCert string
+	if *waddellCert != "" {
+		cert, err := ioutil.ReadFile(*waddellCert)
+		if err != nil {
+			usageError("Unable to read -waddellcert %s: %s", *waddellCert, err)
+		}
+		serverCert = string(cert)
+	}
+	wc, err := waddell.NewClient(&waddell.ClientConfig{
+		Dial: func() (net.Conn, error) {
+			return net.DialTimeout("tcp", *waddellAddr, 30*time.Second)
+		},
+		ServerCert: serverCert,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to waddell at %s: %s", *waddellAddr, err)
+	}
+	log.Printf("Connected to waddell, id: %s", wc.CurrentId())
+	s.out = wc.Out(PunchTopic)
+	s.in = wc.In(PunchTopic)
+	return s, nil
+}
+
+func (s *waddellSignaler) send(msg []byte) error {
+	// The answerer only learns the peer's id from its first message
+	peerId := <-s.peerId
+	s.peerId <- peerId
+	// waddell sends msg asynchronously, so it's left to the garbage collector
+	// rather than released
+	s.out <- waddell.Message(peerId, msg)
+	return nil
+}
+
+func (s *waddellSignaler) receive(msgIn func(msg []byte)) {
+	var peerId *waddell.PeerId
+	for wm := range s.in {
+		if peerId == nil {
+			select {
+			case id := <-s.peerId:
+				peerId = &id
+			default:
+				peerId = &wm.From
+			}
+			s.peerId <- *peerId
+		}
+		if wm.From != *peerId {
+			log.Printf("Ignoring message from %s, not our peer", wm.From)
+			continue
+		}
+		msgIn(wm.Body)
+	}
+}
+
+func usageError(msg string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
+	flag.Usage()
+	os.Exit(EXIT_USAGE)
+}
+
+func fail(msg string, args ...interface{}) {
+	log.Printf(msg, args...)
+	os.Exit(EXIT_FAILED)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/getlantern/go-natty/natty"
+	"github.com/getlantern/testify/assert"
+)
+
+// TestMain lets tests run natty-punch in a subprocess by re-executing the test
+// binary with PUNCH_ARGS set.
+func TestMain(m *testing.M) {
+	if args := os.Getenv("PUNCH_ARGS"); args != "" {
+		os.Args = append(os.Args[:1], strings.Fields(args)...)
+		main()
+		os.Exit(EXIT_SUCCESS)
+	}
+	os.Exit(m.Run())
+}
+
+// TestPunch pipes two natty-punch processes' stdio together and checks that
+// they output matching FiveTuples.
+func TestPunch(t *testing.T) {
+	offerer, offererTuple := punchCommand(t, "-role offer -timeout 20s")
+	answerer, answererTuple := punchCommand(t, "-role answer -timeout 20s")
+
+	var err error
+	offerer.Stdin, err = answerer.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Unable to pipe answerer's stdout: %s", err)
+	}
+	answerer.Stdin, err = offerer.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Unable to pipe offerer's stdout: %s", err)
+	}
+	if err := offerer.Start(); err != nil {
+		t.Fatalf("Unable to start offerer: %s", err)
+	}
+	if err := answerer.Start(); err != nil {
+		t.Fatalf("Unable to start answerer: %s", err)
+	}
+	assert.NoError(t, offerer.Wait(), "Offerer should exit 0")
+	assert.NoError(t, answerer.Wait(), "Answerer should exit 0")
+
+	offererFT := readFiveTuple(t, offererTuple)
+	answererFT := readFiveTuple(t, answererTuple)
+	assert.Equal(t, offererFT.Local, answererFT.Remote, "Offerer's local should be answerer's remote")
+	assert.Equal(t, offererFT.Remote, answererFT.Local, "Offerer's remote should be answerer's local")
+}
+
+func TestPunchUsage(t *testing.T) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "PUNCH_ARGS=-role sideways")
+	err := cmd.Run()
+	if assert.Error(t, err, "Bad role should fail") {
+		assert.Equal(t, EXIT_USAGE, err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus())
+	}
+
+	cmd = exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "PUNCH_ARGS=-role offer")
+	err = cmd.Run()
+	if assert.Error(t, err, "Missing fd 3 should fail") {
+		assert.Equal(t, EXIT_USAGE, err.(*exec.ExitError).Sys().(syscall.WaitStatus).ExitStatus())
+	}
+}
+
+func TestStdioSignaler(t *testing.T) {
+	out := &bytes.Buffer{}
+	s := &stdioSignaler{in: strings.NewReader("one\n\ntwo\n"), out: out}
+	assert.NoError(t, s.send([]byte(`{"type":"offer"}`)))
+	assert.Equal(t, "{\"type\":\"offer\"}\n", out.String())
+
+	var received []string
+	s.receive(func(msg []byte) { received = append(received, string(msg)) })
+	assert.Equal(t, []string{"one", "two"}, received, "Blank lines should be skipped")
+}
+
+// punchCommand prepares a natty-punch subprocess with the given args, whose fd
+// 3 is the returned file.
+func punchCommand(t *testing.T, args string) (*exec.Cmd, *os.File) {
+	tuple, err := ioutil.TempFile("", "natty-punch")
+	if err != nil {
+		t.Fatalf("Unable to create temp file: %s", err)
+	}
+	os.Remove(tuple.Name())
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "PUNCH_ARGS="+args)
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{tuple}
+	return cmd, tuple
+}
+
+func readFiveTuple(t *testing.T, f *os.File) *natty.FiveTuple {
+	defer f.Close()
+	f.Seek(0, 0)
+	ft := &natty.FiveTuple{}
+	err := json.NewDecoder(f).Decode(ft)
+	if err != nil {
+		t.Fatalf("Unable to read FiveTuple: %s", err)
+	}
+	return ft
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// Every chat packet starts with one of these
+	chatMsg = 'M'
+	chatBye = 'B'
+
+	CHAT_QUIT = "/quit"
+)
+
+var (
+	stdinLines     = make(chan string)
+	stdinLinesOnce sync.Once
+)
+
+// chat sends lines typed on stdin to the peer over the tunnel and prints lines
+// received from the peer, until either the user types /quit (in which case
+// chat returns true) or the tunnel dies.
+func chat(tun *tunnel) (quit bool) {
+	stdinLinesOnce.Do(func() {
+		go readStdinLines()
+	})
+
+	peerLeft := make(chan interface{})
+	go receiveChat(tun, peerLeft)
+
+	fmt.Printf("*** Connected, type a line to send it or %s to exit\n", CHAT_QUIT)
+	reportedLeft := false
+	for {
+		select {
+		case <-tun.dead:
+			fmt.Println("*** Lost connection to peer")
+			return false
+		case line := <-stdinLines:
+			if line == CHAT_QUIT {
+				err := tun.write([]byte{chatBye})
+				if err != nil {
+					log.Printf("Unable to say bye to peer: %s", err)
+				}
+				return true
+			}
+			select {
+			case <-peerLeft:
+				if !reportedLeft {
+					fmt.Printf("*** Peer has left, not sending. Type %s to exit\n", CHAT_QUIT)
+					reportedLeft = true
+				}
+				continue
+			default:
+			}
+			err := tun.write(append([]byte{chatMsg}, line...))
+			if err != nil && !reportedLeft {
+				fmt.Printf("*** Peer appears to have gone away (%s), not sending. Type %s to exit\n", err, CHAT_QUIT)
+				reportedLeft = true
+			}
+		}
+	}
+}
+
+// receiveChat prints the chat lines received from the peer, closing peerLeft if
+// the peer says bye.
+func receiveChat(tun *tunnel, peerLeft chan interface{}) {
+	b := make([]byte, MAX_MESSAGE_SIZE)
+	for {
+		n, err := tun.read(b)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		switch b[0] {
+		case chatMsg:
+			fmt.Printf("peer> %s\n", string(b[1:n]))
+		case chatBye:
+			fmt.Println("*** Peer has left the chat")
+			close(peerLeft)
+			return
+		}
+	}
+}
+
+func readStdinLines() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		stdinLines <- strings.TrimRight(scanner.Text(), "\r")
+	}
+	// Treat end of input like /quit
+	stdinLines <- CHAT_QUIT
+}
@@ -13,88 +13,333 @@ import (
 )
 
 var (
-	server    = flag.String("server", "", "Server id (only used when running as a client)")
-	socksPort = flag.Int("socksport", 18000, "Port for SOCKS server, default 18000 (only used when running as a client)")
-
-	serverReady = make(chan bool, 10)
+	server    = flag.String("server", "", "Server id, or self to traverse with ourselves (only used when offering, with -mode client or both)")
+	connect   = flag.String("connect", "", "Name with which the server registered with the -directory, as an alternative to -server (only used when offering, with -mode client or both)")
+	socksPort = flag.Int("socksport", 18000, "Port for SOCKS server, default 18000 (only used when offering, with -mode client or both)")
 )
 
 func runClient() {
-	if *server == "" {
-		log.Printf("Please specify a -server id")
-		flag.Usage()
+	serverId := serverToOffer()
+	go dispatch(in, nil)
+	offerUntilQuit(serverId)
+}
+
+// runBoth answers traversals like a server and, if given a -server or
+// -connect, offers them like a client, all over one waddell connection.
+func runBoth() {
+	startServer()
+	if *server == "" && *connect == "" {
+		log.Printf("No -server or -connect given, only answering")
+		dispatch(in, answer)
 		return
 	}
-	log.Printf("Starting client, connecting to server %s ...", *server)
+	serverId := serverToOffer()
+	go dispatch(in, answer)
+	offerUntilQuit(serverId)
+}
+
+// serverToOffer determines the server's id from -server or -connect. A -server
+// of "self" means our own id, which is useful for testing with -mode both.
+func serverToOffer() waddell.PeerId {
+	var serverId waddell.PeerId
+	var err error
+	if *connect != "" {
+		log.Printf("Looking up server %s ...", *connect)
+		serverId, err = resolve(wc, directoryId(), *connect)
+		if err != nil {
+			fail(EXIT_SIGNALING_FAILED, 0, "Unable to find server %s: %s", *connect, err)
+		}
+		log.Printf("Starting client, connecting to server %s (%s) ...", *connect, serverId)
+	} else if *server == "self" {
+		log.Printf("Starting client, connecting to ourselves ...")
+		serverId = id
+	} else {
+		if *server == "" {
+			usageError("Please specify a -server id or a -connect name")
+		}
+		log.Printf("Starting client, connecting to server %s ...", *server)
+		serverId, err = waddell.PeerIdFromString(*server)
+		if err != nil {
+			usageError("Unable to parse PeerID for server %s: %s", *server, err)
+		}
+	}
+	return serverId
+}
+
+// offerUntilQuit keeps offering traversals to the server, re-punching whenever
+// the tunnel dies (up to -retries times), until the user asks to quit. Our
+// traffic to the server carries on over each new tunnel.
+func offerUntilQuit(serverId waddell.PeerId) {
+	app := &splice{}
+	go sendHellos(app, helloInterval)
+	err := repunch(*retries, func() bool {
+		return offer(serverId, app)
+	})
+	if err != nil {
+		fail(EXIT_TRAVERSAL_FAILED, 0, "%s", err)
+	}
+}
+
+// offer runs a single traversal to the server and then uses the resulting
+// tunnel, spliced into app, until the server stops responding to keepalives.
+// It returns true if the user asked to quit.
+func offer(serverId waddell.PeerId, app *splice) (quit bool) {
 	traversalId := uint32(rand.Int31())
 	log.Printf("Starting traversal: %d", traversalId)
-	serverId, err := waddell.PeerIdFromString(*server)
-	if err != nil {
-		log.Fatalf("Unable to parse PeerID for server %s: %s", *server, err)
+	startingTraversal(traversalId)
+	trace := newSessionTrace(*traceDir, *traceSample, traversalId)
+	defer trace.close()
+	trace.timing("offering")
+
+	if *upnp {
+		if quit, mapped := offerMapped(serverId, traversalId, trace, app); mapped {
+			return quit
+		}
+		log.Printf("Falling back to punching")
 	}
 
-	t := natty.Offer(TIMEOUT)
+	t := natty.Offer(TIMEOUT, traversalOptions(trace)...)
 	defer t.Close()
 
-	go sendMessages(t, serverId, traversalId)
-	go receiveMessages(t, traversalId)
+	msgs, doneOffering := offering(serverId, traversalId)
+	defer doneOffering()
+	go sendMessages(t, serverId, traversalId, trace)
+	serverReady := make(chan bool, 1)
+	stopReceiving := make(chan bool)
+	defer close(stopReceiving)
+	go receiveMessages(msgs, t.MsgIn, serverId, traversalId, trace, serverReady, stopReceiving)
 
 	ft, err := t.FiveTuple()
 	if err != nil {
+		trace.timing(fmt.Sprintf("traversal failed: %s", err))
 		t.Close()
-		log.Fatalf("Unable to offer: %s", err)
+		stats := t.Stats()
+		phase := phaseReached(stats.Timings)
+		log.Print(formatFailure(traversalId, stats, phase, EXIT_TRAVERSAL_FAILED, err))
+		sessionReportFor(traversalId, stats, false, phase, EXIT_TRAVERSAL_FAILED, err).report()
+		fail(EXIT_TRAVERSAL_FAILED, traversalId, "Unable to offer: %s", err)
 	}
+	trace.timing(fmt.Sprintf("got five tuple %s", ft))
 	log.Printf("Got five tuple: %s", ft)
-	if <-serverReady {
-		writeUDP(ft)
+	select {
+	case <-serverReady:
+		trace.timing("server ready")
+		stats := t.Stats()
+		log.Print(formatBreakdown(traversalId, stats, true))
+		r := sessionReportFor(traversalId, stats, true, "", 0, nil)
+		r.Local, r.Remote = ft.Local, ft.Remote
+		r.report()
+		if ft.Proto == natty.TCP {
+			writeTCP(traversalId, t)
+			return false
+		}
+		return writeUDP(traversalId, ft, app)
+	case <-time.After(readyTimeout):
+		trace.timing("timed out waiting for server to be ready")
+		err := fmt.Errorf("Server didn't say it was READY within %s", readyTimeout)
+		stats := t.Stats()
+		log.Print(formatFailure(traversalId, stats, phaseVerification, EXIT_TRAVERSAL_FAILED, err))
+		sessionReportFor(traversalId, stats, false, phaseVerification, EXIT_TRAVERSAL_FAILED, err).report()
+		fail(EXIT_TRAVERSAL_FAILED, traversalId, "%s", err)
+		return false
+	}
+}
+
+// offerMapped connects to the server through a port mapped on our gateway
+// instead of punching, returning false for mapped if the gateway wouldn't map
+// a port.
+func offerMapped(serverId waddell.PeerId, traversalId uint32, trace *sessionTrace, app *splice) (quit bool, mapped bool) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		log.Printf("Unable to listen on UDP: %s", err)
+		return false, false
+	}
+	local := conn.LocalAddr().(*net.UDPAddr)
+	m, unmap, err := mapPort(local.Port)
+	if err != nil {
+		conn.Close()
+		log.Printf("Unable to map port %d: %s", local.Port, err)
+		trace.timing(fmt.Sprintf("port mapping failed: %s", err))
+		return false, false
+	}
+	log.Printf("Mapped local port %d to %s", local.Port, m)
+	trace.timing(fmt.Sprintf("mapped local port to %s", m))
+	unregister := atExit(unmap)
+	defer func() {
+		unregister()
+		unmap()
+	}()
+
+	msgs, doneOffering := offering(serverId, traversalId)
+	defer doneOffering()
+	serverReady := make(chan bool, 1)
+	stopReceiving := make(chan bool)
+	defer close(stopReceiving)
+	go receiveMessages(msgs, func(msg string) {
+		log.Printf("Ignoring unexpected message for mapped traversal %d: %s", traversalId, msg)
+	}, serverId, traversalId, trace, serverReady, stopReceiving)
+	msg := mappedMsg(m)
+	log.Printf("Sending %s", msg)
+	trace.transcript(true, string(msg))
+	out <- waddell.Message(serverId, idToBytes(traversalId), msg)
+
+	failMapped := func(msg string, args ...interface{}) {
+		conn.Close()
+		trace.timing(fmt.Sprintf(msg, args...))
+		(&sessionReport{Traversal: traversalId, Path: pathFailed, Method: m.Method, Error: fmt.Sprintf(msg, args...)}).report()
+		fail(EXIT_TRAVERSAL_FAILED, traversalId, msg, args...)
 	}
+	select {
+	case <-serverReady:
+		trace.timing("server ready")
+	case <-time.After(readyTimeout):
+		failMapped("Server didn't say it was READY within %s", readyTimeout)
+	}
+
+	// The server greets us with keepalives, which tell us where it is
+	conn.SetReadDeadline(time.Now().Add(readyTimeout))
+	b := make([]byte, MAX_MESSAGE_SIZE)
+	var remote *net.UDPAddr
+	for remote == nil {
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			failMapped("Server didn't reach mapped port: %s", err)
+		}
+		if natty.IsKeepAlive(b[:n]) {
+			remote = addr
+		}
+	}
+	conn.Close()
+	ft := &natty.FiveTuple{Proto: natty.UDP, Local: local.String(), Remote: remote.String()}
+	log.Printf("Server reached mapped port from %s", remote)
+	trace.timing(fmt.Sprintf("server reached mapped port from %s", remote))
+	(&sessionReport{Traversal: traversalId, Path: pathMapped, Method: m.Method, Local: ft.Local, Remote: ft.Remote}).report()
+	return writeUDP(traversalId, ft, app), true
 }
 
-func sendMessages(t *natty.Traversal, serverId waddell.PeerId, traversalId uint32) {
+func sendMessages(t *natty.Traversal, serverId waddell.PeerId, traversalId uint32, trace *sessionTrace) {
 	for {
 		msgOut, done := t.NextMsgOut()
 		if done {
 			return
 		}
 		log.Printf("Sending %s", msgOut)
+		trace.transcript(true, msgOut)
 		out <- waddell.Message(serverId, idToBytes(traversalId), []byte(msgOut))
 	}
 }
 
-func receiveMessages(t *natty.Traversal, traversalId uint32) {
-	for wm := range in {
+// receiveMessages passes signaling messages from msgs to msgIn,
+// acknowledging the server's READY and signaling serverReady when it arrives.
+func receiveMessages(msgs <-chan *waddell.MessageIn, msgIn func(string), serverId waddell.PeerId, traversalId uint32, trace *sessionTrace, serverReady chan<- bool, stop <-chan bool) {
+	for {
+		var wm *waddell.MessageIn
+		select {
+		case <-stop:
+			return
+		case wm = <-msgs:
+		}
 		msg := message(wm.Body)
-		if msg.getTraversalId() != traversalId {
-			log.Printf("Got message for unknown traversal %d, skipping", msg.getTraversalId())
+		if r, ok := parseReady(msg.getData()); ok {
+			log.Printf("Received: %s", r)
+			trace.transcript(false, r.String())
+			if ackReady(traversalId, r, func(b []byte) {
+				out <- waddell.Message(serverId, idToBytes(traversalId), b)
+			}) {
+				// Server's ready!
+				select {
+				case serverReady <- true:
+				default:
+					// Already signaled, this was a retransmission
+				}
+			}
 			continue
 		}
-		log.Printf("Received: %s", msg.getData())
-		msgString := string(msg.getData())
-		if READY == msgString {
-			// Server's ready!
-			serverReady <- true
-		} else {
-			t.MsgIn(msgString)
+		if reason, ok := parseRejection(msg.getData()); ok {
+			trace.transcript(false, string(msg.getData()))
+			fail(EXIT_AUTH_FAILED, traversalId, "Server rejected traversal: %s", reason)
 		}
+		log.Printf("Received: %s", msg.getData())
+		trace.transcript(false, string(msg.getData()))
+		msgIn(string(msg.getData()))
 	}
 }
 
-func writeUDP(ft *natty.FiveTuple) {
+// writeUDP splices the tunnel into app, so that our messages to the server go
+// over it (or chats, with -chat), until the server stops responding to
+// keepalives. It returns true if the user asked to quit.
+func writeUDP(traversalId uint32, ft *natty.FiveTuple, app *splice) (quit bool) {
 	local, remote, err := ft.UDPAddrs()
 	if err != nil {
-		log.Fatalf("Unable to resolve UDP addresses: %s", err)
+		fail(EXIT_TRAVERSAL_FAILED, traversalId, "Unable to resolve UDP addresses: %s", err)
 	}
-	conn, err := net.DialUDP("udp", local, remote)
+	conn, err := net.DialUDP(network("udp"), local, remote)
 	if err != nil {
-		log.Fatalf("Unable to dial UDP: %s", err)
+		fail(EXIT_TRAVERSAL_FAILED, traversalId, "Unable to dial UDP: %s", describeNetError(remote.String(), err))
+	}
+	tun := newTunnel(conn, nil, "Server")
+	defer tun.close()
+
+	if *chatMode {
+		return chat(tun)
+	}
+	if *receiveDir != "" {
+		receive(traversalId, tun)
+		return true
+	}
+
+	var fw *forwarder
+	if len(forwards) > 0 {
+		fw, err = startForwarding(tun, traversalId, forwards, *forwardSecret)
+		if err != nil {
+			fail(EXIT_TRANSFER_FAILED, traversalId, "Unable to forward: %s", err)
+		}
+		defer fw.close()
+	}
+	go readUnexpected(tun, fw)
+	if fw != nil {
+		select {
+		case err := <-fw.result:
+			if err != nil {
+				fail(EXIT_AUTH_FAILED, traversalId, "Server refused to forward: %s", err)
+			}
+			log.Printf("Server is forwarding for traversal %d", traversalId)
+		case <-tun.dead:
+			return false
+		}
 	}
+	app.set(tun)
+	<-tun.dead
+	return false
+}
+
+// readUnexpected reads from the tunnel until it's closed, logging anything that
+// the server sends us (other than keepalives and, if fw isn't nil, what's
+// forwarded for -L and -R).
+func readUnexpected(tun *tunnel, fw *forwarder) {
+	b := make([]byte, MAX_MESSAGE_SIZE)
 	for {
-		msg := fmt.Sprintf("Hello from %s to %s", ft.Local, ft.Remote)
-		log.Printf("Sending UDP message: %s", msg)
-		_, err := conn.Write([]byte(msg))
+		n, err := tun.read(b)
 		if err != nil {
-			log.Fatalf("Offerer unable to write to UDP: %s", err)
+			return
+		}
+		if fw != nil && isMuxFrame(b[:n]) {
+			fw.handle(b[:n])
+			continue
+		}
+		log.Printf("Got unexpected UDP message from server: '%s'", string(b[:n]))
+	}
+}
+
+// receive receives a file from the server into the -receive directory, exiting
+// if that fails.
+func receive(traversalId uint32, tun *tunnel) {
+	path, err := receiveFile(tun, *receiveDir)
+	if err != nil {
+		if _, ok := err.(*verificationError); ok {
+			fail(EXIT_VERIFICATION_FAILED, traversalId, "Received file is corrupt: %s", err)
 		}
-		time.Sleep(1 * time.Second)
+		fail(EXIT_TRANSFER_FAILED, traversalId, "Unable to receive file: %s", err)
 	}
+	log.Printf("Received %s", path)
 }
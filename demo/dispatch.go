@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/getlantern/waddell"
+)
+
+// The answering side of a traversal sets fromAnswerer in the traversal id of
+// every message it sends, so that a process running with -mode both (which
+// may even be talking to itself) can tell replies to its own offers apart from
+// new offers. Offering sides pick ids with rand.Int31, so the bit is always
+// clear in what they send.
+const fromAnswerer = uint32(1) << 31
+
+var (
+	offers      = make(map[offerKey]chan *waddell.MessageIn)
+	offersMutex sync.Mutex
+)
+
+type offerKey struct {
+	peerId      waddell.PeerId
+	traversalId uint32
+}
+
+// dispatch reads signaling messages from in until it's closed, passing those
+// for traversals that we're answering to answer and those for traversals that
+// we offered to the offer's channel. If answer is nil, we're only offering and
+// messages for traversals that we'd have to answer are dropped.
+func dispatch(in <-chan *waddell.MessageIn, answer func(wm *waddell.MessageIn)) {
+	for wm := range in {
+		if len(wm.Body) < 4 {
+			log.Printf("Dropping short message from %s", wm.From)
+			continue
+		}
+		msg := message(wm.Body)
+		traversalId := msg.getTraversalId()
+		if traversalId&fromAnswerer == 0 {
+			if answer == nil {
+				log.Printf("Not answering, dropping message for traversal %d from %s", traversalId, wm.From)
+				continue
+			}
+			answer(wm)
+			continue
+		}
+		traversalId &^= fromAnswerer
+		msg.setTraversalId(traversalId)
+		offersMutex.Lock()
+		msgs := offers[offerKey{wm.From, traversalId}]
+		offersMutex.Unlock()
+		if msgs == nil {
+			log.Printf("Got message for unknown traversal %d, skipping", traversalId)
+			continue
+		}
+		select {
+		case msgs <- wm:
+		default:
+			log.Printf("Traversal %d isn't keeping up, dropping message", traversalId)
+		}
+	}
+}
+
+// offering registers a traversal that we're offering to the given peer,
+// returning the channel on which the peer's replies arrive and a function that
+// unregisters it.
+func offering(peerId waddell.PeerId, traversalId uint32) (<-chan *waddell.MessageIn, func()) {
+	key := offerKey{peerId, traversalId}
+	msgs := make(chan *waddell.MessageIn, 100)
+	offersMutex.Lock()
+	offers[key] = msgs
+	offersMutex.Unlock()
+	return msgs, func() {
+		offersMutex.Lock()
+		delete(offers, key)
+		offersMutex.Unlock()
+	}
+}
+
+// answererMessage frames data that we're sending to the given peer as the
+// answering side of the given traversal.
+func answererMessage(peerId waddell.PeerId, traversalId uint32, data []byte) *waddell.MessageOut {
+	return waddell.Message(peerId, idToBytes(traversalId|fromAnswerer), data)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+	"github.com/getlantern/waddell"
+)
+
+func TestDispatch(t *testing.T) {
+	self, _ := waddell.PeerIdFromString("self")
+	in := make(chan *waddell.MessageIn, 10)
+	var answered []uint32
+	done := make(chan bool)
+	go func() {
+		dispatch(in, func(wm *waddell.MessageIn) {
+			answered = append(answered, message(wm.Body).getTraversalId())
+		})
+		close(done)
+	}()
+
+	offer1, done1 := offering(self, 1)
+	defer done1()
+	offer2, done2 := offering(self, 2)
+	defer done2()
+
+	// Loop back what each side sends, as when traversing with ourselves
+	send := func(msg *waddell.MessageOut) {
+		var body []byte
+		for _, b := range msg.Body {
+			body = append(body, b...)
+		}
+		in <- &waddell.MessageIn{From: msg.To, Body: body}
+	}
+	send(waddell.Message(self, idToBytes(1), []byte("offer 1")))
+	send(waddell.Message(self, idToBytes(2), []byte("offer 2")))
+	send(answererMessage(self, 2, []byte("answer 2")))
+	send(answererMessage(self, 1, []byte("answer 1")))
+	send(answererMessage(self, 3, []byte("answer to unknown")))
+	close(in)
+	<-done
+
+	assert.Equal(t, []uint32{1, 2}, answered, "Offers should be answered")
+	if assert.Equal(t, 1, len(offer1)) {
+		msg := message((<-offer1).Body)
+		assert.Equal(t, uint32(1), msg.getTraversalId(), "Direction bit should be cleared")
+		assert.Equal(t, "answer 1", string(msg.getData()))
+	}
+	if assert.Equal(t, 1, len(offer2)) {
+		assert.Equal(t, "answer 2", string(message((<-offer2).Body).getData()))
+	}
+}
+
+func TestDispatchClientOnly(t *testing.T) {
+	self, _ := waddell.PeerIdFromString("self")
+	in := make(chan *waddell.MessageIn, 1)
+	msgs, doneOffering := offering(self, 1)
+	defer doneOffering()
+	in <- &waddell.MessageIn{From: self, Body: append(idToBytes(1), "offer 1"...)}
+	close(in)
+	dispatch(in, nil)
+	assert.Equal(t, 0, len(msgs), "Clients shouldn't mistake offers for answers")
+}
+
+// TestBothLoopback runs one demo with -mode both that traverses with itself
+// through a local waddell.
+func TestBothLoopback(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	go (&waddell.Server{}).Serve(listener)
+
+	_, stderr := runDemo(t, 20*time.Second, "-mode both -server self -waddellcert= -waddell "+listener.Addr().String())
+	assert.Contains(t, stderr, "Answering traversal", "Should have answered its own offer")
+	assert.True(t, strings.Contains(stderr, "Got UDP message from"), "Should have received its own UDP messages")
+}
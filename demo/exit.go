@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Exit codes, so that scripts can tell different kinds of failure apart
+const (
+	EXIT_SUCCESS             = 0
+	EXIT_USAGE               = 2 // bad command-line flags
+	EXIT_SIGNALING_FAILED    = 3 // unable to connect to waddell or find the peer there
+	EXIT_TRAVERSAL_FAILED    = 4 // NAT traversal (or using the resulting tunnel) failed
+	EXIT_AUTH_FAILED         = 5 // the peer rejected us
+	EXIT_VERIFICATION_FAILED = 6 // the peer or the data it sent failed verification
+	EXIT_INTERRUPTED         = 7 // killed by SIGINT or SIGTERM
+	EXIT_TRANSFER_FAILED     = 8 // a file transfer failed
+)
+
+var (
+	exitClasses = map[int]string{
+		EXIT_USAGE:               "usage",
+		EXIT_SIGNALING_FAILED:    "signaling",
+		EXIT_TRAVERSAL_FAILED:    "traversal",
+		EXIT_AUTH_FAILED:         "auth",
+		EXIT_VERIFICATION_FAILED: "verification",
+		EXIT_INTERRUPTED:         "interrupted",
+		EXIT_TRANSFER_FAILED:     "transfer",
+	}
+
+	// lastTraversalId is the id of the most recently started traversal, for
+	// correlating interruptions with the logs
+	lastTraversalId uint32
+
+	// exitHooks are run before failing, keyed by registration order
+	exitHooks      = make(map[int]func())
+	lastExitHook   int
+	exitHooksMutex sync.Mutex
+)
+
+// fail logs the given message, prints a one-line summary to stderr and exits
+// with the given code. traversalId identifies the traversal during which the
+// failure happened, 0 if none.
+func fail(code int, traversalId uint32, msg string, args ...interface{}) {
+	msg = fmt.Sprintf(msg, args...)
+	log.Print(msg)
+	runExitHooks()
+	fmt.Fprintln(os.Stderr, exitSummary(code, traversalId, msg))
+	os.Exit(code)
+}
+
+// atExit registers f to be run if the demo fails, for cleaning up things that
+// would otherwise outlive it (like port mappings). It returns a function that
+// unregisters f.
+func atExit(f func()) func() {
+	exitHooksMutex.Lock()
+	defer exitHooksMutex.Unlock()
+	lastExitHook++
+	id := lastExitHook
+	exitHooks[id] = f
+	return func() {
+		exitHooksMutex.Lock()
+		delete(exitHooks, id)
+		exitHooksMutex.Unlock()
+	}
+}
+
+// runExitHooks runs (and unregisters) the hooks registered with atExit.
+func runExitHooks() {
+	exitHooksMutex.Lock()
+	hooks := exitHooks
+	exitHooks = make(map[int]func())
+	exitHooksMutex.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// usageError fails with EXIT_USAGE after showing the usage.
+func usageError(msg string, args ...interface{}) {
+	log.Printf(msg, args...)
+	flag.Usage()
+	fail(EXIT_USAGE, 0, msg, args...)
+}
+
+// exitSummary formats a single line summary of a failure.
+func exitSummary(code int, traversalId uint32, msg string) string {
+	traversal := "none"
+	if traversalId != 0 {
+		traversal = fmt.Sprint(traversalId)
+	}
+	return fmt.Sprintf("FAILED class=%s code=%d traversal=%s: %s", exitClasses[code], code, traversal, msg)
+}
+
+// startingTraversal records the id of a traversal that's starting.
+func startingTraversal(traversalId uint32) {
+	atomic.StoreUint32(&lastTraversalId, traversalId)
+}
+
+// exitOnInterrupt makes the demo fail with EXIT_INTERRUPTED on SIGINT or
+// SIGTERM.
+func exitOnInterrupt() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fail(EXIT_INTERRUPTED, atomic.LoadUint32(&lastTraversalId), "Interrupted by %s", sig)
+	}()
+}
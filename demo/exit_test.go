@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// TestMain lets tests run the demo in a subprocess by re-executing the test
+// binary with DEMO_ARGS set.
+func TestMain(m *testing.M) {
+	if args := os.Getenv("DEMO_ARGS"); args != "" {
+		os.Args = append(os.Args[:1], strings.Fields(args)...)
+		main()
+		os.Exit(EXIT_SUCCESS)
+	}
+	os.Exit(m.Run())
+}
+
+func TestExitCodes(t *testing.T) {
+	silent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer silent.Close()
+
+	code, stderr := runDemo(t, 0, "-ip-version 5")
+	assert.Equal(t, EXIT_USAGE, code, "Bad flag should be a usage error")
+	assert.Contains(t, stderr, "FAILED class=usage code=2 traversal=none")
+
+	code, stderr = runDemo(t, 0, "-stun-check-only -stun "+silent.LocalAddr().String())
+	assert.Equal(t, EXIT_TRAVERSAL_FAILED, code, "Unreachable STUN should be a traversal failure")
+	assert.Contains(t, stderr, "FAILED class=traversal code=4")
+
+	code, stderr = runDemo(t, 500*time.Millisecond, "-stun-check-only -stun "+silent.LocalAddr().String())
+	assert.Equal(t, EXIT_INTERRUPTED, code, "SIGINT should be an interruption")
+	assert.Contains(t, stderr, "FAILED class=interrupted code=7")
+}
+
+func TestExitSummary(t *testing.T) {
+	assert.Equal(t, "FAILED class=signaling code=3 traversal=none: unreachable", exitSummary(EXIT_SIGNALING_FAILED, 0, "unreachable"))
+	assert.Equal(t, "FAILED class=auth code=5 traversal=1234: rejected", exitSummary(EXIT_AUTH_FAILED, 1234, "rejected"))
+	assert.Equal(t, "FAILED class=verification code=6 traversal=none: corrupt", exitSummary(EXIT_VERIFICATION_FAILED, 0, "corrupt"))
+	assert.Equal(t, "FAILED class=transfer code=8 traversal=5: lost", exitSummary(EXIT_TRANSFER_FAILED, 5, "lost"))
+}
+
+// runDemo runs the demo with the given args in a subprocess, interrupting it
+// after interruptAfter (if non-zero), and returns its exit code and stderr.
+func runDemo(t *testing.T, interruptAfter time.Duration, args string) (int, string) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "DEMO_ARGS="+args)
+	stderr := &strings.Builder{}
+	cmd.Stderr = stderr
+	err := cmd.Start()
+	if err != nil {
+		t.Fatalf("Unable to run demo: %s", err)
+	}
+	if interruptAfter > 0 {
+		time.Sleep(interruptAfter)
+		cmd.Process.Signal(syscall.SIGINT)
+	}
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), stderr.String()
+	}
+	if err != nil {
+		t.Fatalf("Unable to run demo: %s", err)
+	}
+	return EXIT_SUCCESS, stderr.String()
+}
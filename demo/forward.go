@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This file implements -L and -R, which work like ssh's: -L listens on a port
+// next to the client and forwards what it accepts through the tunnel to a
+// target next to the server, and -R does the opposite. All of a session's
+// forwards share its tunnel. Each forward is a class of channels on the mux
+// from mux.go, numbered in the order in which the forwards were declared, and
+// each connection that it carries is a stream (or, for UDP, the datagrams from
+// one sender). The client declares its forwards in a request authenticated with
+// -forward-secret, so a server only forwards for sessions that it has
+// authenticated this way.
+
+const (
+	forwardRequestInterval = 500 * time.Millisecond
+
+	// maxForwards is how many forwards fit in a class byte
+	maxForwards = 256
+
+	// clientOpened is set in the ids of streams and datagram senders that the
+	// client numbered, so that they don't collide with the server's
+	clientOpened = uint32(1) << 31
+)
+
+var (
+	localForwards  = listFlag("L", "Listen on a port next to us and forward what it accepts through the tunnel to a target next to the server, like ssh -L, given as [udp:]LISTENPORT:TARGETHOST:TARGETPORT. May be repeated. (only used when offering, with -mode client or both)")
+	remoteForwards = listFlag("R", "Have the server listen on a port and forward what it accepts back through the tunnel to a target next to us, like ssh -R, given as [udp:]LISTENPORT:TARGETHOST:TARGETPORT. May be repeated. (only used when offering, with -mode client or both)")
+	reverse        = flag.String("reverse", "", "Same as -R")
+	forwardSecret  = flag.String("forward-secret", "", "Secret with which clients authenticate their -L and -R forwards. Servers refuse to forward unless they have one (used when offering and answering).")
+	reverseSecret  = flag.String("reverse-secret", "", "Same as -forward-secret")
+
+	// forwards are the client's forwards from -L and -R, by class
+	forwards []*forward
+)
+
+// stringList is a flag that may be repeated.
+type stringList []string
+
+func listFlag(name string, usage string) *stringList {
+	l := &stringList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseForwards parses the forwards given with -L, -R and -reverse.
+func parseForwards() ([]*forward, error) {
+	remotes := *remoteForwards
+	if *reverse != "" {
+		remotes = append(remotes, *reverse)
+	}
+	var fwds []*forward
+	for _, remote := range []bool{false, true} {
+		flagName, specs := "-L", []string(*localForwards)
+		if remote {
+			flagName, specs = "-R", remotes
+		}
+		for _, s := range specs {
+			spec, err := parseForward(remote, s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s %s: %s", flagName, s, err)
+			}
+			fwds = append(fwds, &forward{spec: spec})
+		}
+	}
+	if len(fwds) > maxForwards {
+		return nil, fmt.Errorf("At most %d forwards are supported", maxForwards)
+	}
+	return fwds, nil
+}
+
+// forwardSpec is a forward declared with -L or -R, as the client declares it to
+// the server.
+type forwardSpec struct {
+	Remote bool   `json:"remote,omitempty"` // whether the server listens (-R)
+	UDP    bool   `json:"udp,omitempty"`
+	Port   int    `json:"port"`   // where to listen
+	Target string `json:"target"` // where to connect
+}
+
+func (spec *forwardSpec) String() string {
+	flagName := "-L"
+	if spec.Remote {
+		flagName = "-R"
+	}
+	proto := ""
+	if spec.UDP {
+		proto = "udp:"
+	}
+	return fmt.Sprintf("%s %s%d:%s", flagName, proto, spec.Port, spec.Target)
+}
+
+// parseForward parses a forward of the form [udp:]LISTENPORT:TARGETHOST:TARGETPORT.
+func parseForward(remote bool, s string) (*forwardSpec, error) {
+	spec := &forwardSpec{Remote: remote}
+	if strings.HasPrefix(s, "udp:") {
+		spec.UDP = true
+		s = s[4:]
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Expected LISTENPORT:TARGETHOST:TARGETPORT")
+	}
+	port, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port to listen on %s", parts[0])
+	}
+	spec.Port = port
+	spec.Target = parts[1]
+	return spec, spec.validate()
+}
+
+func (spec *forwardSpec) validate() error {
+	if spec.Port < 1 || spec.Port > 65535 {
+		return fmt.Errorf("Invalid port to listen on %d", spec.Port)
+	}
+	_, _, err := net.SplitHostPort(spec.Target)
+	if err != nil {
+		return fmt.Errorf("Invalid target %s: %s", spec.Target, err)
+	}
+	return nil
+}
+
+// forwardMAC authenticates a declaration of forwards for the given traversal.
+func forwardMAC(secret string, traversalId uint32, specs []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(idToBytes(traversalId))
+	mac.Write(specs)
+	return mac.Sum(nil)
+}
+
+// encodeForwardRequest encodes the payload of a request for the given
+// forwards, authenticated with the given secret.
+func encodeForwardRequest(fwds []*forward, traversalId uint32, secret string) []byte {
+	specs := make([]*forwardSpec, len(fwds))
+	for i, fwd := range fwds {
+		specs[i] = fwd.spec
+	}
+	b, _ := json.Marshal(specs)
+	return append(forwardMAC(secret, traversalId, b), b...)
+}
+
+// decodeForwardRequest decodes the payload of a request, making sure that it
+// was authenticated with the given secret.
+func decodeForwardRequest(payload []byte, traversalId uint32, secret string) ([]*forwardSpec, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("Server doesn't allow forwarding")
+	}
+	if len(payload) < sha256.Size {
+		return nil, fmt.Errorf("Malformed request")
+	}
+	if !hmac.Equal(payload[:sha256.Size], forwardMAC(secret, traversalId, payload[sha256.Size:])) {
+		return nil, fmt.Errorf("Request isn't authenticated with the server's -forward-secret")
+	}
+	var specs []*forwardSpec
+	err := json.Unmarshal(payload[sha256.Size:], &specs)
+	if err != nil {
+		return nil, fmt.Errorf("Malformed request: %s", err)
+	}
+	if len(specs) > maxForwards {
+		return nil, fmt.Errorf("At most %d forwards are supported", maxForwards)
+	}
+	for _, spec := range specs {
+		err := spec.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return specs, nil
+}
+
+// forward is a forward in use, with the counters reported by -status.
+type forward struct {
+	// Accessed atomically, first in the struct to keep them aligned
+	streams  int64
+	failed   int64
+	sent     int64
+	received int64
+
+	spec        *forwardSpec
+	traversalId uint32 // 0 on the client, whose forwards outlive traversals
+}
+
+// countingWriter counts what's written through it into n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+// pipe copies between conn and s in both directions until both are done and
+// then closes both.
+func pipe(conn net.Conn, s *stream, fwd *forward) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(&countingWriter{s, &fwd.sent}, conn)
+		s.Close()
+	}()
+	_, err := io.Copy(&countingWriter{conn, &fwd.received}, s)
+	if tcpConn, ok := conn.(*net.TCPConn); ok && err == nil {
+		// The peer is done writing, but may still be reading
+		tcpConn.CloseWrite()
+	} else {
+		conn.Close()
+	}
+	wg.Wait()
+	s.linger(muxLinger)
+	conn.Close()
+}
+
+// dgramPeer is where the datagrams on a channel go: a sender to the socket
+// that we're listening on, or the target, to which conn is connected.
+type dgramPeer struct {
+	fwd  *forward
+	conn *net.UDPConn
+	addr *net.UDPAddr // nil if conn is connected to the target
+}
+
+func (peer *dgramPeer) write(b []byte) {
+	var err error
+	if peer.addr == nil {
+		_, err = peer.conn.Write(b)
+	} else {
+		_, err = peer.conn.WriteToUDP(b, peer.addr)
+	}
+	if err == nil {
+		atomic.AddInt64(&peer.fwd.received, int64(len(b)))
+	}
+}
+
+// forwarder carries the forwards of one session over its tunnel, on either
+// end.
+type forwarder struct {
+	tun         *tunnel
+	traversalId uint32
+	client      bool // whether we're the client
+	secret      string
+	mutex       sync.Mutex
+	forwards    []*forward // by class, nil on the server until it accepts a request
+	listeners   []io.Closer
+	streams     map[uint32]*stream
+	dgrams      map[uint32]*dgramPeer
+	senders     map[string]uint32 // ids of the senders to our UDP sockets
+	connecting  map[uint32]bool   // streams opened by the peer that we're connecting
+	refused     map[uint32]bool   // streams opened by the peer that we couldn't connect
+	nextId      uint32
+	closed      bool
+
+	request  []byte     // the request that we sent or accepted
+	answered bool       // whether the server answered our request
+	result   chan error // nil once the server accepts our request, or why it refused
+}
+
+// newForwarder creates a forwarder for one end of tun, authenticating requests
+// with secret.
+func newForwarder(tun *tunnel, traversalId uint32, client bool, secret string) *forwarder {
+	return &forwarder{
+		tun:         tun,
+		traversalId: traversalId,
+		client:      client,
+		secret:      secret,
+		streams:     make(map[uint32]*stream),
+		dgrams:      make(map[uint32]*dgramPeer),
+		senders:     make(map[string]uint32),
+		connecting:  make(map[uint32]bool),
+		refused:     make(map[uint32]bool),
+		result:      make(chan error, 1),
+	}
+}
+
+// startForwarding listens for our -L forwards and asks the server on the other
+// end of tun to listen for our -R forwards.
+func startForwarding(tun *tunnel, traversalId uint32, fwds []*forward, secret string) (*forwarder, error) {
+	f := newForwarder(tun, traversalId, true, secret)
+	f.mutex.Lock()
+	f.forwards = fwds
+	err := f.listen()
+	f.mutex.Unlock()
+	if err != nil {
+		f.close()
+		return nil, err
+	}
+	f.request = encodeForwardRequest(fwds, traversalId, secret)
+	go f.requestUntilAnswered()
+	return f, nil
+}
+
+func (f *forwarder) send(fr *muxFrame) error {
+	return f.tun.write(fr.encode())
+}
+
+// listens indicates whether we're the end that listens for spec.
+func (f *forwarder) listens(spec *forwardSpec) bool {
+	return spec.Remote != f.client
+}
+
+// newId numbers a new channel. The caller must hold the mutex.
+func (f *forwarder) newId() uint32 {
+	id := f.nextId
+	f.nextId++
+	if f.client {
+		id |= clientOpened
+	}
+	return id
+}
+
+// fromPeer indicates whether the peer numbered the channel with the given id.
+func (f *forwarder) fromPeer(id uint32) bool {
+	return (id&clientOpened != 0) != f.client
+}
+
+// listen listens for the forwards for which we're the listening end. The caller
+// must hold the mutex.
+func (f *forwarder) listen() error {
+	for class, fwd := range f.forwards {
+		if !f.listens(fwd.spec) {
+			continue
+		}
+		// Like ssh, -L only listens on loopback
+		host := ""
+		if !fwd.spec.Remote {
+			host = "localhost"
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(fwd.spec.Port))
+		if fwd.spec.UDP {
+			laddr, err := net.ResolveUDPAddr(network("udp"), addr)
+			var conn *net.UDPConn
+			if err == nil {
+				conn, err = net.ListenUDP(network("udp"), laddr)
+			}
+			if err != nil {
+				return fmt.Errorf("Unable to listen on UDP port %d for %s: %s", fwd.spec.Port, fwd.spec, err)
+			}
+			f.listeners = append(f.listeners, conn)
+			go f.relayDatagrams(class, fwd, conn)
+		} else {
+			l, err := net.Listen(network("tcp"), addr)
+			if err != nil {
+				return fmt.Errorf("Unable to listen on TCP port %d for %s: %s", fwd.spec.Port, fwd.spec, err)
+			}
+			f.listeners = append(f.listeners, l)
+			go f.acceptConns(class, fwd, l)
+		}
+		log.Printf("Listening for %s", fwd.spec)
+	}
+	return nil
+}
+
+// handle handles a mux frame from the peer.
+func (f *forwarder) handle(b []byte) {
+	fr, err := decodeMuxFrame(b)
+	if err != nil {
+		return
+	}
+	switch fr.typ {
+	case muxRequest:
+		if !f.client {
+			f.accept(fr)
+		}
+		return
+	case muxAccept:
+		if f.client {
+			f.answer(nil)
+		}
+		return
+	case muxRefuse:
+		if f.client {
+			f.answer(fmt.Errorf("%s", fr.payload))
+		}
+		return
+	case muxDgram:
+		f.datagram(fr)
+		return
+	}
+
+	f.mutex.Lock()
+	if f.forwards == nil || f.closed {
+		// Not authenticated (yet)
+		f.mutex.Unlock()
+		return
+	}
+	s := f.streams[fr.id]
+	if s == nil && fr.typ == muxOpen && fr.seq == 0 && f.fromPeer(fr.id) {
+		f.open(fr)
+		f.mutex.Unlock()
+		return
+	}
+	f.mutex.Unlock()
+	if s != nil {
+		s.received(fr)
+	}
+	// Otherwise the peer will retransmit once we've connected the stream
+}
+
+// open handles the first segment of a stream that the peer opened. We only
+// create our end of the stream (and so acknowledge the segment) once we've
+// connected to the target. If that fails, the peer is told to reset the stream
+// every time it retransmits the segment, so that it finds out even if resets
+// get lost. The caller must hold the mutex.
+func (f *forwarder) open(fr *muxFrame) {
+	if f.connecting[fr.id] {
+		return
+	}
+	if f.refused[fr.id] {
+		go f.send(&muxFrame{typ: muxReset, id: fr.id})
+		return
+	}
+	fwd, err := f.opened(fr.payload)
+	if err != nil {
+		log.Printf("Refusing connection %d: %s", fr.id, err)
+		f.refused[fr.id] = true
+		go f.send(&muxFrame{typ: muxReset, id: fr.id})
+		return
+	}
+	f.connecting[fr.id] = true
+	go f.connect(fr, fwd)
+}
+
+// opened finds the forward for a stream that the peer opened, whose first
+// segment names its forward's class and target. The caller must hold the
+// mutex.
+func (f *forwarder) opened(payload []byte) (*forward, error) {
+	if len(payload) < 1 || int(payload[0]) >= len(f.forwards) {
+		return nil, fmt.Errorf("Unknown forward")
+	}
+	fwd := f.forwards[payload[0]]
+	if f.listens(fwd.spec) || fwd.spec.UDP {
+		return nil, fmt.Errorf("Not ours to connect for %s", fwd.spec)
+	}
+	if string(payload[1:]) != fwd.spec.Target {
+		return nil, fmt.Errorf("Target %s doesn't match %s", payload[1:], fwd.spec)
+	}
+	return fwd, nil
+}
+
+// accept handles the client's request to forward. The server accepts at most
+// one request per session.
+func (f *forwarder) accept(fr *muxFrame) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.request != nil {
+		if bytes.Equal(fr.payload, f.request) {
+			// Our accept got lost
+			f.send(&muxFrame{typ: muxAccept})
+		}
+		return
+	}
+	if f.closed {
+		return
+	}
+	refuse := func(err error) {
+		log.Printf("Refusing to forward for traversal %d: %s", f.traversalId, err)
+		f.send(&muxFrame{typ: muxRefuse, payload: []byte(err.Error())})
+	}
+	specs, err := decodeForwardRequest(fr.payload, f.traversalId, f.secret)
+	if err != nil {
+		refuse(err)
+		return
+	}
+	f.forwards = make([]*forward, len(specs))
+	for i, spec := range specs {
+		f.forwards[i] = &forward{spec: spec, traversalId: f.traversalId}
+	}
+	err = f.listen()
+	if err != nil {
+		f.stopListening()
+		f.forwards = nil
+		refuse(err)
+		return
+	}
+	trackForwards(f.forwards)
+	f.request = fr.payload
+	f.send(&muxFrame{typ: muxAccept})
+}
+
+func (f *forwarder) requestUntilAnswered() {
+	ticker := time.NewTicker(forwardRequestInterval)
+	defer ticker.Stop()
+	for {
+		f.mutex.Lock()
+		answered := f.answered
+		f.mutex.Unlock()
+		if answered {
+			return
+		}
+		f.send(&muxFrame{typ: muxRequest, payload: f.request})
+		select {
+		case <-f.tun.dead:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *forwarder) answer(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.answered {
+		f.answered = true
+		f.result <- err
+	}
+}
+
+// acceptConns opens a stream to the peer for every connection accepted by l.
+func (f *forwarder) acceptConns(class int, fwd *forward, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		f.mutex.Lock()
+		if f.closed {
+			f.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		id := f.newId()
+		s := newStream(id, f.send)
+		f.streams[id] = s
+		f.mutex.Unlock()
+
+		atomic.AddInt64(&fwd.streams, 1)
+		go func() {
+			defer f.forget(id)
+			err := s.open(append([]byte{byte(class)}, fwd.spec.Target...))
+			if err != nil {
+				log.Printf("Unable to open connection %d for %s: %s", id, fwd.spec, err)
+				atomic.AddInt64(&fwd.failed, 1)
+				s.abort()
+				conn.Close()
+				return
+			}
+			pipe(conn, s, fwd)
+		}()
+	}
+}
+
+// connect connects a stream that the peer opened with fr to its forward's
+// target.
+func (f *forwarder) connect(fr *muxFrame, fwd *forward) {
+	atomic.AddInt64(&fwd.streams, 1)
+	conn, err := net.Dial(network("tcp"), fwd.spec.Target)
+	f.mutex.Lock()
+	delete(f.connecting, fr.id)
+	if err != nil || f.closed {
+		if err != nil {
+			// Only this stream fails, the tunnel and other forwards carry on
+			log.Printf("Unable to connect %s: %s", fwd.spec, err)
+			atomic.AddInt64(&fwd.failed, 1)
+			f.refused[fr.id] = true
+		} else {
+			conn.Close()
+		}
+		f.mutex.Unlock()
+		f.send(&muxFrame{typ: muxReset, id: fr.id})
+		return
+	}
+	s := newStream(fr.id, f.send)
+	f.streams[fr.id] = s
+	f.mutex.Unlock()
+
+	defer f.forget(s.id)
+	s.received(fr)
+	pipe(conn, s, fwd)
+}
+
+func (f *forwarder) forget(id uint32) {
+	f.mutex.Lock()
+	delete(f.streams, id)
+	f.mutex.Unlock()
+}
+
+// relayDatagrams sends the datagrams that conn receives to the peer, numbering
+// them by sender so that replies go back to the right sender. Datagram frames
+// carry their forward's class as their seq.
+func (f *forwarder) relayDatagrams(class int, fwd *forward, conn *net.UDPConn) {
+	b := make([]byte, MAX_MESSAGE_SIZE)
+	for {
+		n, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		key := fmt.Sprintf("%d %s", class, addr)
+		f.mutex.Lock()
+		id, found := f.senders[key]
+		if !found {
+			id = f.newId()
+			f.senders[key] = id
+			f.dgrams[id] = &dgramPeer{fwd: fwd, conn: conn, addr: addr}
+			atomic.AddInt64(&fwd.streams, 1)
+		}
+		f.mutex.Unlock()
+		err = f.send(&muxFrame{typ: muxDgram, id: id, seq: uint32(class), payload: b[:n]})
+		if err == nil {
+			atomic.AddInt64(&fwd.sent, int64(n))
+		}
+	}
+}
+
+// datagram delivers a datagram from the peer, connecting a socket to the
+// target for each new sender so that the target's replies go back to the
+// right sender.
+func (f *forwarder) datagram(fr *muxFrame) {
+	f.mutex.Lock()
+	if f.forwards == nil || f.closed {
+		f.mutex.Unlock()
+		return
+	}
+	peer := f.dgrams[fr.id]
+	if peer == nil && f.fromPeer(fr.id) {
+		var err error
+		peer, err = f.connectDatagrams(fr)
+		if err != nil {
+			f.mutex.Unlock()
+			log.Printf("Unable to forward datagrams: %s", err)
+			return
+		}
+	}
+	f.mutex.Unlock()
+	if peer != nil {
+		peer.write(fr.payload)
+	}
+}
+
+// connectDatagrams connects a socket to the target for a new sender. The
+// caller must hold the mutex.
+func (f *forwarder) connectDatagrams(fr *muxFrame) (*dgramPeer, error) {
+	if int(fr.seq) >= len(f.forwards) {
+		return nil, fmt.Errorf("Unknown forward")
+	}
+	fwd := f.forwards[fr.seq]
+	if f.listens(fwd.spec) || !fwd.spec.UDP {
+		return nil, fmt.Errorf("Not ours to connect for %s", fwd.spec)
+	}
+	atomic.AddInt64(&fwd.streams, 1)
+	raddr, err := net.ResolveUDPAddr(network("udp"), fwd.spec.Target)
+	var conn *net.UDPConn
+	if err == nil {
+		conn, err = net.DialUDP(network("udp"), nil, raddr)
+	}
+	if err != nil {
+		atomic.AddInt64(&fwd.failed, 1)
+		return nil, fmt.Errorf("Unable to connect %s: %s", fwd.spec, err)
+	}
+	peer := &dgramPeer{fwd: fwd, conn: conn}
+	f.dgrams[fr.id] = peer
+	go func() {
+		b := make([]byte, MAX_MESSAGE_SIZE)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			err = f.send(&muxFrame{typ: muxDgram, id: fr.id, seq: fr.seq, payload: b[:n]})
+			if err == nil {
+				atomic.AddInt64(&fwd.sent, int64(n))
+			}
+		}
+	}()
+	return peer, nil
+}
+
+// stopListening stops listening for our forwards. The caller must hold the
+// mutex.
+func (f *forwarder) stopListening() {
+	for _, l := range f.listeners {
+		l.Close()
+	}
+	f.listeners = nil
+}
+
+// close stops forwarding and abandons all forwarded connections, e.g. because
+// the tunnel died.
+func (f *forwarder) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	f.stopListening()
+	for _, s := range f.streams {
+		s.abort()
+	}
+	for _, peer := range f.dgrams {
+		if peer.addr == nil {
+			peer.conn.Close()
+		}
+	}
+	if !f.client && f.forwards != nil {
+		untrackForwards(f.forwards)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// TestForward runs a TCP and a UDP forward (plus a TCP forward in the other
+// direction and one with a dead target) at the same time over a single lossy
+// tunnel.
+func TestForward(t *testing.T) {
+	defer withoutTrackedForwards()()
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Big enough to take many segments
+		fmt.Fprintf(w, "%s %s", r.URL.Path, strings.Repeat("x", 20000))
+	}))
+	defer web.Close()
+	echo := udpEcho(t)
+	defer echo.Close()
+
+	webPort, echoPort, remotePort, deadPort := freePort(t), freePort(t), freePort(t), freePort(t)
+	fwds := parseTestForwards(t,
+		fmt.Sprintf("-L %d:%s", webPort, web.Listener.Addr()),
+		fmt.Sprintf("-L udp:%d:%s", echoPort, echo.LocalAddr()),
+		fmt.Sprintf("-R %d:%s", remotePort, web.Listener.Addr()),
+		fmt.Sprintf("-L %d:127.0.0.1:%d", deadPort, freePort(t)),
+	)
+	fw, closeTunnels := forwardTunnels(t, fwds, "sesame", "sesame")
+	defer closeTunnels()
+	assert.NoError(t, awaitForwarding(t, fw), "Server should accept the request")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		for _, port := range []int{webPort, remotePort} {
+			wg.Add(1)
+			go func(i int, port int) {
+				defer wg.Done()
+				assertGet(t, port, fmt.Sprintf("/%d", i))
+			}(i, port)
+		}
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assertEcho(t, echoPort)
+	}()
+	go func() {
+		defer wg.Done()
+		conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", deadPort))
+		if !assert.NoError(t, err, "Should accept connections for dead target") {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Error(t, err, "Connection to dead target should be closed")
+	}()
+	wg.Wait()
+
+	// The others still work after the dead target failed
+	assertGet(t, webPort, "/after")
+
+	// The client and server both report, the server by session
+	statuses := make(map[string]*forwardStatus)
+	for _, st := range currentStatus().Forwards {
+		statuses[fmt.Sprintf("%d %s", st.Traversal, st.Forward)] = st
+	}
+	if !assert.Equal(t, 8, len(statuses), "Should report every forward on both ends") {
+		return
+	}
+	webStatus := statuses["0 "+fwds[0].spec.String()]
+	assert.Equal(t, int64(4), webStatus.Streams, "Should count connections")
+	assert.True(t, webStatus.Received > 4*20000, "Should count bytes received")
+	assert.True(t, webStatus.Sent > 0, "Should count bytes sent")
+	assert.Equal(t, int64(0), webStatus.Failed)
+	echoStatus := statuses["0 "+fwds[1].spec.String()]
+	assert.Equal(t, int64(1), echoStatus.Streams, "Should count UDP senders")
+	assert.True(t, echoStatus.Received > 0, "Should count datagrams received")
+	assert.True(t, statuses["0 "+fwds[2].spec.String()].Sent > 3*20000, "Should count bytes for -R")
+	deadStatus := statuses["1234 "+fwds[3].spec.String()]
+	assert.Equal(t, int64(1), deadStatus.Failed, "Should count the connection to the dead target")
+	assert.Equal(t, int64(0), deadStatus.Sent)
+}
+
+func TestForwardUnauthenticated(t *testing.T) {
+	defer withoutTrackedForwards()()
+
+	remotePort := freePort(t)
+	fwds := parseTestForwards(t, fmt.Sprintf("-R %d:127.0.0.1:1", remotePort))
+	fw, closeTunnels := forwardTunnels(t, fwds, "open sesame", "sesame")
+	defer closeTunnels()
+	assert.Error(t, awaitForwarding(t, fw), "Server should refuse the request")
+	_, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", remotePort))
+	assert.Error(t, err, "Server shouldn't be listening")
+
+	fw, closeTunnels = forwardTunnels(t, fwds, "", "")
+	defer closeTunnels()
+	assert.Error(t, awaitForwarding(t, fw), "Server without a secret should refuse the request")
+}
+
+func TestParseForward(t *testing.T) {
+	spec, err := parseForward(false, "8080:localhost:80")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &forwardSpec{Port: 8080, Target: "localhost:80"}, spec)
+		assert.Equal(t, "-L 8080:localhost:80", spec.String())
+	}
+	spec, err = parseForward(true, "udp:5353:[::1]:53")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &forwardSpec{Remote: true, UDP: true, Port: 5353, Target: "[::1]:53"}, spec)
+		assert.Equal(t, "-R udp:5353:[::1]:53", spec.String())
+	}
+	for _, bad := range []string{"", "8080", "x:localhost:80", "0:localhost:80", "8080:localhost"} {
+		_, err = parseForward(false, bad)
+		assert.Error(t, err, "Should reject "+bad)
+	}
+}
+
+func withoutTrackedForwards() func() {
+	origTracked := tracked
+	tracked = nil
+	return func() {
+		tracked = origTracked
+	}
+}
+
+// parseTestForwards parses forwards given like on the command line and tracks
+// them like the demo does.
+func parseTestForwards(t *testing.T, specs ...string) []*forward {
+	var fwds []*forward
+	for _, s := range specs {
+		spec, err := parseForward(strings.HasPrefix(s, "-R "), s[3:])
+		if err != nil {
+			t.Fatalf("Unable to parse %s: %s", s, err)
+		}
+		fwds = append(fwds, &forward{spec: spec})
+	}
+	trackForwards(fwds)
+	return fwds
+}
+
+// forwardTunnels connects a client forwarding fwds with secret to a server with
+// serverSecret over lossy tunnels, reading from both ends like the demo does.
+func forwardTunnels(t *testing.T, fwds []*forward, secret string, serverSecret string) (*forwarder, func()) {
+	clientTun, serverTun, closeShim := lossyTunnels(t, 0.05)
+	server := newForwarder(serverTun, 1234, false, serverSecret)
+	go func() {
+		b := make([]byte, MAX_MESSAGE_SIZE)
+		for {
+			n, err := serverTun.read(b)
+			if err != nil {
+				return
+			}
+			if isMuxFrame(b[:n]) {
+				server.handle(b[:n])
+			}
+		}
+	}()
+	client, err := startForwarding(clientTun, 1234, fwds, secret)
+	if err != nil {
+		t.Fatalf("Unable to forward: %s", err)
+	}
+	go readUnexpected(clientTun, client)
+	return client, func() {
+		client.close()
+		server.close()
+		clientTun.close()
+		serverTun.close()
+		closeShim()
+	}
+}
+
+func awaitForwarding(t *testing.T, fw *forwarder) error {
+	select {
+	case err := <-fw.result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server didn't answer")
+		return nil
+	}
+}
+
+func assertGet(t *testing.T, port int, path string) {
+	client := &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+		Timeout:   20 * time.Second,
+	}
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, path))
+	if !assert.NoError(t, err, "Request should succeed") {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err, "Reading the response should succeed")
+	assert.Equal(t, path+" "+strings.Repeat("x", 20000), string(body), "Should get the right response")
+}
+
+func udpEcho(t *testing.T) *net.UDPConn {
+	echo, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(append([]byte("echo "), b[:n]...), addr)
+		}
+	}()
+	return echo
+}
+
+func assertEcho(t *testing.T, port int) {
+	conn, err := net.Dial("udp4", fmt.Sprintf("127.0.0.1:%d", port))
+	if !assert.NoError(t, err, "Should dial") {
+		return
+	}
+	defer conn.Close()
+	b := make([]byte, 1024)
+	for i := 0; i < 50; i++ {
+		// The tunnel is lossy, so keep trying
+		conn.Write([]byte("hi"))
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(b)
+		if err == nil {
+			assert.Equal(t, "echo hi", string(b[:n]), "Should get the echo")
+			return
+		}
+	}
+	t.Error("Didn't get an echo")
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
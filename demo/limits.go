@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/waddell"
+)
+
+// This file implements the server's per-peer limits on sessions, which keep a
+// single misbehaving client from spawning natty processes without bound. Each
+// peer may have at most -max-sessions-per-peer sessions at once, and may start
+// new ones at -new-session-rate per second with a burst of
+// sessionBurstSeconds' worth. A peer that exceeds the rate is effectively
+// banned until its bucket refills, so bans decay on their own. Rejected
+// traversals are answered with REJECTED over signaling.
+
+const (
+	sessionBurstSeconds = 5
+
+	// limitsIdleTimeout is how long after its bucket is full again that a
+	// peer's limit state is forgotten
+	limitsIdleTimeout = 10 * time.Minute
+
+	// maxRejectedTraversals is how many rejected traversal ids are remembered
+	// per peer, so that the rest of a rejected traversal's messages are
+	// dropped quietly
+	maxRejectedTraversals = 100
+)
+
+var (
+	maxSessionsPerPeer = flag.Int("max-sessions-per-peer", 10, "Maximum number of concurrent sessions per client, 0 for no limit (only used when answering, with -mode server or both)")
+	newSessionRate     = flag.Float64("new-session-rate", 1, "Sessions per second that each client may start, with bursts of up to 5 seconds' worth, 0 for no limit (only used when answering, with -mode server or both)")
+
+	limits *sessionLimits
+)
+
+// sessionLimits enforces the per-peer limits on sessions.
+type sessionLimits struct {
+	maxSessions int
+	rate        float64
+	burst       float64
+	peers       map[waddell.PeerId]*peerLimits
+	overCap     int // how many traversals were rejected for exceeding maxSessions
+	overRate    int // how many traversals were rejected for exceeding rate
+	mutex       sync.Mutex
+}
+
+// peerLimits tracks a single peer's token bucket and rejected traversals.
+type peerLimits struct {
+	tokens   float64
+	updated  time.Time
+	rejected map[uint32]bool
+}
+
+func newSessionLimits(maxSessions int, rate float64) *sessionLimits {
+	burst := rate * sessionBurstSeconds
+	if burst < 1 {
+		burst = 1
+	}
+	return &sessionLimits{
+		maxSessions: maxSessions,
+		rate:        rate,
+		burst:       burst,
+		peers:       make(map[waddell.PeerId]*peerLimits),
+	}
+}
+
+// allow checks whether the given peer, which currently has active sessions,
+// may start the given traversal at time now. It returns an error saying why
+// not if it may not, along with true if the traversal had already been
+// rejected (in which case the rejection was already sent to the peer).
+func (l *sessionLimits) allow(peerId waddell.PeerId, traversalId uint32, active int, now time.Time) (repeated bool, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.forgetIdle(now)
+
+	p := l.peers[peerId]
+	if p == nil {
+		p = &peerLimits{tokens: l.burst, updated: now, rejected: make(map[uint32]bool)}
+		l.peers[peerId] = p
+	}
+	if p.rejected[traversalId] {
+		return true, fmt.Errorf("Traversal %d was already rejected", traversalId)
+	}
+	if l.rate > 0 {
+		p.tokens += now.Sub(p.updated).Seconds() * l.rate
+		if p.tokens > l.burst {
+			p.tokens = l.burst
+		}
+		p.updated = now
+	}
+
+	if l.maxSessions > 0 && active >= l.maxSessions {
+		l.overCap++
+		err = fmt.Errorf("Too many sessions, limit is %d", l.maxSessions)
+	} else if l.rate > 0 && p.tokens < 1 {
+		l.overRate++
+		err = fmt.Errorf("Too many new sessions, limit is %.2f per second", l.rate)
+	}
+	if err != nil {
+		if len(p.rejected) >= maxRejectedTraversals {
+			p.rejected = make(map[uint32]bool)
+		}
+		p.rejected[traversalId] = true
+		return false, err
+	}
+	if l.rate > 0 {
+		p.tokens--
+	}
+	return false, nil
+}
+
+// forgetIdle forgets peers whose buckets have long since refilled.
+func (l *sessionLimits) forgetIdle(now time.Time) {
+	for peerId, p := range l.peers {
+		full := p.updated
+		if l.rate > 0 {
+			full = full.Add(time.Duration((l.burst - p.tokens) / l.rate * float64(time.Second)))
+		}
+		if now.Sub(full) > limitsIdleTimeout {
+			delete(l.peers, peerId)
+		}
+	}
+}
+
+// counters describes how many traversals have been rejected and why.
+func (l *sessionLimits) counters() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return fmt.Sprintf("%d over session cap, %d over new session rate, %d peers tracked", l.overCap, l.overRate, len(l.peers))
+}
+
+// rejection encodes a REJECTED message giving the reason for rejecting a
+// traversal.
+func rejection(err error) []byte {
+	return []byte(REJECTED + ": " + err.Error())
+}
+
+// parseRejection parses data as a REJECTED message, returning the reason and
+// false if it isn't one.
+func parseRejection(data []byte) (string, bool) {
+	s := string(data)
+	if !strings.HasPrefix(s, REJECTED+": ") {
+		return "", false
+	}
+	return strings.TrimPrefix(s, REJECTED+": "), true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+	"github.com/getlantern/waddell"
+)
+
+func TestSessionLimitsFlood(t *testing.T) {
+	l := newSessionLimits(3, 1)
+	flooder := waddell.PeerId{}
+	now := time.Now()
+
+	// Flood from one peer, none of whose sessions end
+	active := 0
+	for i := uint32(0); i < 100; i++ {
+		_, err := l.allow(flooder, i, active, now)
+		if err == nil {
+			active++
+		}
+	}
+	assert.Equal(t, 3, active, "Session cap should hold")
+
+	// Sessions ending makes room, but the rate still applies
+	active = 0
+	allowed := 0
+	for i := uint32(100); i < 200; i++ {
+		_, err := l.allow(flooder, i, active, now)
+		if err == nil {
+			allowed++
+		}
+	}
+	assert.Equal(t, 2, allowed, "Rate should hold once the burst is used up")
+
+	// The rest of a rejected traversal's messages are dropped quietly
+	alreadyRejected, err := l.allow(flooder, 150, 0, now)
+	assert.Error(t, err)
+	assert.True(t, alreadyRejected, "Rejected traversal should be remembered")
+
+	// Another peer is unaffected
+	other := otherPeerId(t)
+	for i := uint32(0); i < 3; i++ {
+		_, err := l.allow(other, i, int(i), now)
+		assert.NoError(t, err, "Other peer shouldn't be limited")
+	}
+
+	// Bans decay
+	_, err = l.allow(flooder, 1000, 0, now.Add(2*time.Second))
+	assert.NoError(t, err, "Peer should be allowed again once its bucket refills")
+	assert.Equal(t, "97 over session cap, 98 over new session rate, 2 peers tracked", l.counters())
+}
+
+func TestSessionLimitsForgetIdle(t *testing.T) {
+	l := newSessionLimits(0, 1)
+	now := time.Now()
+	l.allow(waddell.PeerId{}, 1, 0, now)
+	l.allow(otherPeerId(t), 1, 0, now.Add(limitsIdleTimeout+10*time.Second))
+	assert.Equal(t, 1, len(l.peers), "Idle peer should be forgotten")
+}
+
+func TestSessionLimitsUnlimited(t *testing.T) {
+	l := newSessionLimits(0, 0)
+	now := time.Now()
+	for i := uint32(0); i < 100; i++ {
+		_, err := l.allow(waddell.PeerId{}, i, int(i), now)
+		assert.NoError(t, err, "Zero limits should mean unlimited")
+	}
+}
+
+func TestRejection(t *testing.T) {
+	reason, ok := parseRejection(rejection(errors.New("Too many sessions")))
+	assert.True(t, ok)
+	assert.Equal(t, "Too many sessions", reason)
+	_, ok = parseRejection([]byte(`{"type":"answer"}`))
+	assert.False(t, ok, "Natty messages shouldn't parse as REJECTED")
+}
+
+func otherPeerId(t *testing.T) waddell.PeerId {
+	id, err := waddell.PeerIdFromString("e6679a41-0003-4f9b-8ae4-671a8a196d13")
+	if err != nil {
+		t.Fatalf("Unable to parse peer id: %s", err)
+	}
+	return id
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// This file implements multiplexing several connections over a single tunnel,
+// which is what -L and -R use to carry their connections.
+// Every mux frame starts with a zero byte, which is how they're told apart
+// from the client's text messages. TCP connections are carried as reliable
+// streams: each data segment is numbered and retransmitted until the other
+// side acknowledges it, and closing a stream is a segment like any other.
+// UDP datagrams are carried as they are.
+
+const (
+	muxMarker = 0x00
+
+	muxRequest = 'R' // client -> server: forward these for us
+	muxAccept  = 'A' // server -> client: forwarding
+	muxRefuse  = 'X' // server -> client: not forwarding, with the reason
+	muxOpen    = 'O' // new connection, naming its forward and target
+	muxData    = 'D' // stream segment
+	muxClose   = 'C' // stream segment that closes the stream
+	muxAck     = 'K' // acknowledges stream segments before seq
+	muxReset   = 'Z' // abandon a connection
+	muxDgram   = 'U' // UDP datagram
+
+	muxHeaderSize    = 10
+	muxSegmentSize   = 1200
+	muxWindow        = 64
+	muxRetransmit    = 200 * time.Millisecond
+	muxMaxOutOfOrder = 256
+	muxLinger        = 5 * time.Second
+)
+
+// muxFrame is a frame carried over the tunnel.
+type muxFrame struct {
+	typ     byte
+	id      uint32 // the connection
+	seq     uint32 // the segment's number, or for acks the next expected one
+	payload []byte
+}
+
+func (f *muxFrame) encode() []byte {
+	b := make([]byte, muxHeaderSize, muxHeaderSize+len(f.payload))
+	b[0] = muxMarker
+	b[1] = f.typ
+	binary.BigEndian.PutUint32(b[2:], f.id)
+	binary.BigEndian.PutUint32(b[6:], f.seq)
+	return append(b, f.payload...)
+}
+
+// isMuxFrame indicates whether a packet read from the tunnel is a mux frame.
+func isMuxFrame(b []byte) bool {
+	return len(b) > 0 && b[0] == muxMarker
+}
+
+func decodeMuxFrame(b []byte) (*muxFrame, error) {
+	if len(b) < muxHeaderSize || b[0] != muxMarker {
+		return nil, fmt.Errorf("Not a mux frame")
+	}
+	return &muxFrame{
+		typ:     b[1],
+		id:      binary.BigEndian.Uint32(b[2:]),
+		seq:     binary.BigEndian.Uint32(b[6:]),
+		payload: append([]byte{}, b[muxHeaderSize:]...),
+	}, nil
+}
+
+// stream is a reliable, ordered stream of bytes carried over the tunnel. It's
+// safe to Read and Write from different goroutines.
+type stream struct {
+	id      uint32
+	send    func(*muxFrame) error
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	nextSeq uint32               // number of our next segment
+	unacked map[uint32]*segment  // our segments that haven't been acked
+	nextIn  uint32               // number of the peer's next segment
+	pending map[uint32]*muxFrame // the peer's segments that arrived early
+	readBuf []byte               // data received in order, not read yet
+	eof     bool                 // whether the peer closed the stream
+	closed  bool                 // whether we closed the stream
+	reset   bool                 // whether the stream was abandoned
+	done    chan struct{}        // closed once the stream is reset
+}
+
+type segment struct {
+	frame  *muxFrame
+	sentAt time.Time
+}
+
+func newStream(id uint32, send func(*muxFrame) error) *stream {
+	s := &stream{
+		id:      id,
+		send:    send,
+		unacked: make(map[uint32]*segment),
+		pending: make(map[uint32]*muxFrame),
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	go s.retransmit()
+	return s
+}
+
+// open tells the peer about the stream. The peer creates its end of the
+// stream when it receives this first segment, which carries payload to tell it
+// what the stream is for.
+func (s *stream) open(payload []byte) error {
+	return s.sendSegment(muxOpen, payload)
+}
+
+// Write sends p to the peer, blocking while the window is full.
+func (s *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > muxSegmentSize {
+			n = muxSegmentSize
+		}
+		err := s.sendSegment(muxData, p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes our half of the stream. The peer reads EOF once it's read
+// everything that we wrote.
+func (s *stream) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mutex.Unlock()
+	return s.sendSegment(muxClose, nil)
+}
+
+func (s *stream) sendSegment(typ byte, payload []byte) error {
+	s.mutex.Lock()
+	for len(s.unacked) >= muxWindow && !s.reset {
+		s.cond.Wait()
+	}
+	if s.reset {
+		s.mutex.Unlock()
+		return io.ErrClosedPipe
+	}
+	f := &muxFrame{typ: typ, id: s.id, seq: s.nextSeq, payload: append([]byte{}, payload...)}
+	s.nextSeq++
+	s.unacked[f.seq] = &segment{f, time.Now()}
+	s.mutex.Unlock()
+	return s.send(f)
+}
+
+// Read reads what the peer wrote, returning io.EOF once the peer has closed the
+// stream.
+func (s *stream) Read(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for len(s.readBuf) == 0 && !s.eof && !s.reset {
+		s.cond.Wait()
+	}
+	if len(s.readBuf) > 0 {
+		n := copy(p, s.readBuf)
+		s.readBuf = s.readBuf[n:]
+		return n, nil
+	}
+	if s.reset {
+		return 0, io.ErrClosedPipe
+	}
+	return 0, io.EOF
+}
+
+// received handles a frame for this stream from the peer.
+func (s *stream) received(f *muxFrame) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch f.typ {
+	case muxAck:
+		for seq := range s.unacked {
+			if seq < f.seq {
+				delete(s.unacked, seq)
+			}
+		}
+		s.cond.Broadcast()
+		return
+	case muxReset:
+		s.abandon()
+		return
+	}
+
+	// Open, data or close
+	if f.seq >= s.nextIn && len(s.pending) < muxMaxOutOfOrder {
+		s.pending[f.seq] = f
+	}
+	for {
+		next := s.pending[s.nextIn]
+		if next == nil {
+			break
+		}
+		delete(s.pending, s.nextIn)
+		s.nextIn++
+		switch next.typ {
+		case muxClose:
+			s.eof = true
+		case muxData:
+			s.readBuf = append(s.readBuf, next.payload...)
+		}
+	}
+	s.cond.Broadcast()
+	// Acknowledge everything we have so far, even for duplicates, in case our
+	// previous ack got lost
+	go s.send(&muxFrame{typ: muxAck, id: s.id, seq: s.nextIn})
+}
+
+// abandon resets the stream, failing pending reads and writes. The caller must
+// hold the mutex.
+func (s *stream) abandon() {
+	if !s.reset {
+		s.reset = true
+		close(s.done)
+		s.cond.Broadcast()
+	}
+}
+
+// abort resets the stream without telling the peer, e.g. because the tunnel
+// died.
+func (s *stream) abort() {
+	s.mutex.Lock()
+	s.abandon()
+	s.mutex.Unlock()
+}
+
+// linger waits up to timeout for the peer to acknowledge everything that we
+// sent, so that closing the stream doesn't lose data, and then resets it.
+func (s *stream) linger(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for !s.acked() && time.Now().Before(deadline) {
+		time.Sleep(muxRetransmit / 4)
+	}
+	s.abort()
+}
+
+func (s *stream) acked() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.reset || len(s.unacked) == 0
+}
+
+// retransmit resends segments that haven't been acknowledged in time until the
+// stream is reset.
+func (s *stream) retransmit() {
+	ticker := time.NewTicker(muxRetransmit / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			var due []*muxFrame
+			s.mutex.Lock()
+			for _, seg := range s.unacked {
+				if now.Sub(seg.sentAt) >= muxRetransmit {
+					seg.sentAt = now
+					due = append(due, seg.frame)
+				}
+			}
+			s.mutex.Unlock()
+			for _, f := range due {
+				err := s.send(f)
+				if err != nil {
+					log.Printf("Unable to retransmit segment %d of connection %d: %s", f.seq, f.id, err)
+				}
+			}
+		}
+	}
+}
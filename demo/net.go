@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/getlantern/go-natty/natty"
+)
+
+// network restricts the given base network ("tcp" or "udp") to the IP version
+// selected with -ip-version.
+func network(base string) string {
+	switch ipVersion {
+	case natty.IPv4:
+		return base + "4"
+	case natty.IPv6:
+		return base + "6"
+	}
+	return base
+}
+
+// describeNetError describes err, encountered while trying to reach target,
+// calling out explicitly when the configured IP version has no route.
+func describeNetError(target string, err error) string {
+	if isNoRoute(err) && ipVersion != natty.IPAny {
+		return fmt.Sprintf("No IPv%s route to %s: %s", ipVersion, target, err)
+	}
+	return err.Error()
+}
+
+func isNoRoute(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	errno := opErr.Err
+	if sysErr, ok := errno.(*os.SyscallError); ok {
+		errno = sysErr.Err
+	}
+	return errno == syscall.ENETUNREACH || errno == syscall.EHOSTUNREACH
+}
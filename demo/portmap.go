@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/getlantern/go-natty/natty/portmap"
+)
+
+// With -upnp, the client asks the gateway to map a UDP port with natty's
+// portmap package (PCP, NAT-PMP or UPnP IGD). On routers that support any of
+// them, connecting through the mapped port is faster and more reliable than
+// punching.
+
+const (
+	portMapTimeout  = 2 * time.Second
+	portMapLifetime = 1 * time.Hour
+)
+
+var (
+	upnp = flag.Bool("upnp", false, "Before punching, ask the gateway to map a port with PCP, NAT-PMP or UPnP and, if it does, connect to the server through that port instead (only used when offering, with -mode client or both)")
+)
+
+// mapPort asks the gateway to map the given local UDP port, returning the
+// external endpoint and a function that unmaps it.
+func mapPort(internal int) (*portmap.ExternalEndpoint, func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), portMapTimeout)
+	defer cancel()
+	return portmap.Map(ctx, "udp", internal, portMapLifetime)
+}
+
+// mappedMsg encodes a MAPPED message telling the server the public address
+// through which it can reach us.
+func mappedMsg(external *portmap.ExternalEndpoint) []byte {
+	return []byte(MAPPED + ": " + external.Addr())
+}
+
+// parseMapped parses data as a MAPPED message, returning the address and false
+// if it isn't one.
+func parseMapped(data []byte) (string, bool) {
+	s := string(data)
+	if !strings.HasPrefix(s, MAPPED+": ") {
+		return "", false
+	}
+	return strings.TrimPrefix(s, MAPPED+": "), true
+}
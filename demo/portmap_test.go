@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/go-natty/natty/portmap"
+	"github.com/getlantern/testify/assert"
+)
+
+func TestMappedMsg(t *testing.T) {
+	external, ok := parseMapped(mappedMsg(&portmap.ExternalEndpoint{Proto: "udp", IP: net.IPv4(203, 0, 113, 7), Port: 14000, Method: portmap.NATPMP, Lifetime: time.Hour}))
+	assert.True(t, ok)
+	assert.Equal(t, "203.0.113.7:14000", external)
+	_, ok = parseMapped([]byte(`{"type":"offer"}`))
+	assert.False(t, ok, "Natty messages shouldn't parse as MAPPED")
+}
@@ -4,9 +4,10 @@ import (
 	"encoding/binary"
 	"flag"
 	"log"
-	"net"
+	"os"
 	"time"
 
+	"github.com/getlantern/go-natty/natty"
 	"github.com/getlantern/waddell"
 )
 
@@ -14,7 +15,10 @@ const (
 	// TODO: figure out maximum required size for messages
 	MAX_MESSAGE_SIZE = 4096
 
-	READY = "READY"
+	READY     = "READY"
+	READY_ACK = "READY-ACK"
+	REJECTED  = "REJECTED"
+	MAPPED    = "MAPPED"
 
 	TIMEOUT = 15 * time.Second
 
@@ -24,10 +28,27 @@ const (
 var (
 	endianness = binary.LittleEndian
 
-	help        = flag.Bool("help", false, "Get usage help")
-	mode        = flag.String("mode", "client", "client or server. Client initiates the NAT traversal. Defaults to client.")
-	waddellAddr = flag.String("waddell", "128.199.130.61:443", "Address of waddell signaling server, defaults to 128.199.130.61:443")
-	waddellCert = flag.String("waddellcert", DefaultWaddellCert, "Certificate for waddell server")
+	help              = flag.Bool("help", false, "Get usage help")
+	mode              = flag.String("mode", "client", "client, server, both or directory. Client initiates the NAT traversal and server answers it, both does both over one waddell connection (e.g. with -server self). Directory keeps track of names registered with -register. Defaults to client.")
+	waddellAddr       = flag.String("waddell", "128.199.130.61:443", "Address of waddell signaling server, defaults to 128.199.130.61:443")
+	waddellCert       = flag.String("waddellcert", DefaultWaddellCert, "Certificate for waddell server")
+	waddellTLS        = flag.Bool("waddell-tls", false, "Connect to waddell using TLS, verifying the server against -waddell-ca (or the system's roots)")
+	waddellCA         = flag.String("waddell-ca", "", "PEM file with the CA certificate(s) to trust for -waddell-tls, defaults to the system's roots")
+	waddellServerName = flag.String("waddell-servername", "", "Server name to verify for -waddell-tls, defaults to the host from -waddell")
+	proxyF            = flag.String("proxy", "", "HTTP CONNECT proxy through which to connect to waddell, as http://[user:password@]host:port. Defaults to $HTTPS_PROXY.")
+	ipv6              = flag.Bool("ipv6", false, "Shorthand for -ip-version 6")
+	ipVersionF        = flag.String("ip-version", "any", "IP version to use for signaling and traversal: 4, 6 or any (dual-stack). Defaults to any.")
+	stun              = flag.String("stun", "", "Comma-separated list of STUN servers (host:port) to use instead of natty's defaults")
+	stunCheck         = flag.Bool("stun-check", false, "Before traversing, check which STUN servers respond and exit if none do")
+	stunCheckOnly     = flag.Bool("stun-check-only", false, "Check which STUN servers respond and exit, with status 0 if any did and 4 otherwise")
+	register          = flag.String("register", "", "Register this server with the -directory under the given name, so that clients can -connect to it by name (only used when answering, with -mode server or both)")
+	directory         = flag.String("directory", "", "Waddell id of the directory with which names are registered (used with -register and -connect)")
+	sendPath          = flag.String("send", "", "Send the given file to a peer running with -receive. Implies -mode server, the printed waddell id is the code to give to the receiver.")
+	receiveDir        = flag.String("receive", "", "Receive a file from the peer whose code is given with -server into the given directory. Implies -mode client. Rerun to resume a partial transfer.")
+	chatMode          = flag.Bool("chat", false, "After connecting, chat with the peer: lines typed on stdin are sent to the peer, and lines from the peer are printed. Type /quit to exit.")
+	keepAlive         = flag.Duration("keepalive-interval", 20*time.Second, "How frequently to send keepalives on established tunnels, defaults to 20s. Keepalives are never counted as tunnel traffic.")
+
+	ipVersion natty.IPVersion
 
 	wc  *waddell.Client
 	id  waddell.PeerId
@@ -63,26 +84,130 @@ func main() {
 		return
 	}
 
+	exitOnInterrupt()
+
+	var err error
+	ipVersion, err = natty.ParseIPVersion(*ipVersionF)
+	if err != nil {
+		usageError("%s", err)
+	}
+	if *ipv6 {
+		if ipVersion == natty.IPv4 {
+			usageError("-ipv6 conflicts with -ip-version %s", ipVersion)
+		}
+		ipVersion = natty.IPv6
+	}
+
+	forwards, err = parseForwards()
+	if err != nil {
+		usageError("%s", err)
+	}
+	if *forwardSecret == "" {
+		*forwardSecret = *reverseSecret
+	}
+	trackForwards(forwards)
+	err = parseTransport()
+	if err != nil {
+		usageError("%s", err)
+	}
+	if *statusAddr != "" {
+		err := serveStatus(*statusAddr)
+		if err != nil {
+			usageError("Unable to serve -status: %s", err)
+		}
+	}
+
+	if *traceSample < 0 || *traceSample > 1 {
+		usageError("-trace-sample must be between 0 and 1")
+	}
+	if *traceDir != "" {
+		err := os.MkdirAll(*traceDir, 0755)
+		if err != nil {
+			usageError("Unable to create -trace-dir %s: %s", *traceDir, err)
+		}
+		go pruneTracesPeriodically(*traceDir, *traceRetention)
+	}
+
+	if *stunCheckOnly {
+		if !checkSTUN(stunServers()) {
+			fail(EXIT_TRAVERSAL_FAILED, 0, "Unable to reach any STUN server")
+		}
+		return
+	}
+	if *stunCheck && !checkSTUN(stunServers()) {
+		fail(EXIT_TRAVERSAL_FAILED, 0, "Unable to reach any STUN server, not attempting traversal")
+	}
+
 	connectToWaddell()
 
-	if "server" == *mode {
+	if *sendPath != "" {
+		*mode = "server"
+	} else if *receiveDir != "" {
+		*mode = "client"
+	}
+	switch *mode {
+	case "server":
 		runServer()
-	} else {
+	case "directory":
+		runDirectory(wc)
+	case "client":
 		runClient()
+	case "both":
+		runBoth()
+	default:
+		usageError("Unknown mode %s", *mode)
+	}
+}
+
+// directoryId parses the -directory id.
+func directoryId() waddell.PeerId {
+	if *directory == "" {
+		usageError("Please specify a -directory id")
+	}
+	directoryId, err := waddell.PeerIdFromString(*directory)
+	if err != nil {
+		usageError("Unable to parse PeerID for directory %s: %s", *directory, err)
+	}
+	return directoryId
+}
+
+// stunServers returns the STUN servers specified with -stun, if any.
+func stunServers() []string {
+	return parseSTUNServers(*stun)
+}
+
+// traversalOptions returns the natty options corresponding to the command-line
+// flags, sending natty's debug output to the given trace (if any).
+func traversalOptions(trace *sessionTrace) []natty.Option {
+	opts := []natty.Option{
+		natty.WithIPVersion(ipVersion),
+		natty.WithSTUNServers(stunServers()),
+		natty.WithTransport(transport),
+	}
+	if trace != nil {
+		opts = append(opts, natty.WithTraceWriter(trace))
 	}
+	return opts
 }
 
 func connectToWaddell() {
-	var err error
+	dialer, err := newWaddellDialer()
+	if err != nil {
+		usageError("%s", err)
+	}
+	serverCert := *waddellCert
+	if dialer.tlsConfig != nil {
+		// We're doing TLS ourselves
+		serverCert = ""
+	}
 	wc, err = waddell.NewClient(&waddell.ClientConfig{
-		Dial: func() (net.Conn, error) {
-			return net.Dial("tcp", *waddellAddr)
-		},
-		ServerCert: *waddellCert,
+		Dial:       dialer.dial,
+		ServerCert: serverCert,
 	})
 	if err != nil {
-		log.Fatalf("Unable to connect to waddell: %s", err)
+		fail(EXIT_SIGNALING_FAILED, 0, "Unable to connect to waddell at %s: %s", *waddellAddr, dialer.describeError(err))
 	}
+	id = wc.CurrentId()
 	log.Printf("Connected")
 	out = wc.Out(DemoTopic)
 	in = wc.In(DemoTopic)
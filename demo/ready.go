@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/getlantern/waddell"
+)
+
+// This file implements the READY handshake with which the server tells the
+// client, over signaling, that it's listening on its end of the five tuple.
+// READY carries the session (traversal) id and a nonce, and the client echoes
+// both back in READY-ACK. The server retransmits READY until it's acked, and
+// both sides give up after readyTimeout. Natty has no way of confirming a
+// tunnel itself, so this handshake is what keeps the client from writing into
+// the void.
+
+const (
+	readyRetransmit = 1 * time.Second
+	readyAttempts   = 5
+	readyTimeout    = readyRetransmit * (readyAttempts + 1)
+)
+
+// readyMsg is a READY or READY-ACK message.
+type readyMsg struct {
+	ack       bool
+	sessionId uint32
+	nonce     uint64
+}
+
+func (r *readyMsg) kind() string {
+	if r.ack {
+		return READY_ACK
+	}
+	return READY
+}
+
+func (r *readyMsg) encode() []byte {
+	b := append([]byte(r.kind()), idToBytes(r.sessionId)...)
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, r.nonce)
+	return append(b, nonce...)
+}
+
+func (r *readyMsg) String() string {
+	return fmt.Sprintf("%s for session %d (nonce %x)", r.kind(), r.sessionId, r.nonce)
+}
+
+// parseReady parses data as a READY or READY-ACK message, returning false if it
+// isn't one. Natty's own signaling messages are JSON, so they never parse.
+func parseReady(data []byte) (*readyMsg, bool) {
+	for _, r := range []*readyMsg{{ack: false}, {ack: true}} {
+		kind := r.kind()
+		if len(data) != len(kind)+4+8 || string(data[:len(kind)]) != kind {
+			continue
+		}
+		data = data[len(kind):]
+		r.sessionId = endianness.Uint32(data[:4])
+		r.nonce = binary.BigEndian.Uint64(data[4:])
+		return r, true
+	}
+	return nil, false
+}
+
+// confirmReady sends READY for the given session using send until a READY-ACK
+// with a matching nonce arrives on acks, retransmitting every retransmit up to
+// readyAttempts times.
+func confirmReady(sessionId uint32, send func([]byte), acks <-chan *readyMsg, retransmit time.Duration) error {
+	ready := &readyMsg{sessionId: sessionId, nonce: uint64(rand.Int63())}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	attempts := 0
+	for {
+		select {
+		case ack := <-acks:
+			if ack.sessionId != sessionId || ack.nonce != ready.nonce {
+				log.Printf("Ignoring stale %s", ack)
+				continue
+			}
+			return nil
+		case <-timer.C:
+			if attempts == readyAttempts {
+				return fmt.Errorf("Client didn't acknowledge READY for session %d after %d attempts", sessionId, attempts)
+			}
+			attempts++
+			send(ready.encode())
+			timer.Reset(retransmit)
+		}
+	}
+}
+
+// ackReady acknowledges r using send if it's a READY for the given session,
+// returning true if it was. Anything else is dropped.
+func ackReady(sessionId uint32, r *readyMsg, send func([]byte)) bool {
+	if r.ack || r.sessionId != sessionId {
+		log.Printf("Dropping %s, not for active session %d", r, sessionId)
+		return false
+	}
+	send((&readyMsg{ack: true, sessionId: r.sessionId, nonce: r.nonce}).encode())
+	return true
+}
+
+// readySession identifies a session for which the server is awaiting a
+// READY-ACK.
+type readySession struct {
+	peerId    waddell.PeerId
+	sessionId uint32
+}
+
+var (
+	pendingReady      = make(map[readySession]chan *readyMsg)
+	pendingReadyMutex sync.Mutex
+)
+
+// awaitingReady registers the given session as awaiting a READY-ACK, returning
+// the channel on which acks will be delivered and a function that unregisters
+// it.
+func awaitingReady(peerId waddell.PeerId, sessionId uint32) (<-chan *readyMsg, func()) {
+	session := readySession{peerId, sessionId}
+	acks := make(chan *readyMsg, readyAttempts)
+	pendingReadyMutex.Lock()
+	pendingReady[session] = acks
+	pendingReadyMutex.Unlock()
+	return acks, func() {
+		pendingReadyMutex.Lock()
+		delete(pendingReady, session)
+		pendingReadyMutex.Unlock()
+	}
+}
+
+// deliverReadyAck delivers a READY-ACK from the given peer to the session
+// awaiting it, dropping it if no such session is active.
+func deliverReadyAck(peerId waddell.PeerId, ack *readyMsg) {
+	pendingReadyMutex.Lock()
+	acks := pendingReady[readySession{peerId, ack.sessionId}]
+	pendingReadyMutex.Unlock()
+	if acks == nil {
+		log.Printf("Dropping %s, no such active session", ack)
+		return
+	}
+	select {
+	case acks <- ack:
+	default:
+		// Handshake already has more acks than it needs
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+	"github.com/getlantern/waddell"
+)
+
+const testRetransmit = 10 * time.Millisecond
+
+func TestReadyEncoding(t *testing.T) {
+	for _, r := range []*readyMsg{
+		{sessionId: 1234, nonce: 5678},
+		{ack: true, sessionId: 1234, nonce: 5678},
+	} {
+		parsed, ok := parseReady(r.encode())
+		if assert.True(t, ok, r.String()+" should parse") {
+			assert.Equal(t, r, parsed)
+		}
+	}
+	_, ok := parseReady([]byte(`{"type":"offer","sdp":"READY"}`))
+	assert.False(t, ok, "Natty messages shouldn't parse as READY")
+	_, ok = parseReady([]byte(READY))
+	assert.False(t, ok, "Old-style READY without session shouldn't parse")
+}
+
+// TestReadyHandshake runs the handshake over a signaling channel that drops
+// the first few READYs and acks.
+func TestReadyHandshake(t *testing.T) {
+	sessionId := uint32(42)
+	acks := make(chan *readyMsg, readyAttempts)
+	readies := make(chan *readyMsg, readyAttempts)
+	dropReadies, dropAcks := 1, 2
+
+	serverSend := func(b []byte) {
+		r, _ := parseReady(b)
+		if dropReadies > 0 {
+			dropReadies--
+			return
+		}
+		readies <- r
+	}
+	clientSend := func(b []byte) {
+		r, _ := parseReady(b)
+		if dropAcks > 0 {
+			dropAcks--
+			return
+		}
+		acks <- r
+	}
+
+	clientReady := make(chan bool, readyAttempts)
+	go func() {
+		for r := range readies {
+			// READY for some other session should be dropped without an ack
+			assert.False(t, ackReady(sessionId+1, r, clientSend))
+			clientReady <- ackReady(sessionId, r, clientSend)
+		}
+	}()
+
+	err := confirmReady(sessionId, serverSend, acks, testRetransmit)
+	close(readies)
+	assert.NoError(t, err, "Handshake should survive lost messages")
+	assert.True(t, <-clientReady, "Client should have seen READY")
+}
+
+func TestReadyHandshakeTimeout(t *testing.T) {
+	sent := 0
+	start := time.Now()
+	err := confirmReady(42, func(b []byte) { sent++ }, make(chan *readyMsg), testRetransmit)
+	assert.Error(t, err, "Handshake without acks should time out")
+	assert.Equal(t, readyAttempts, sent, "READY should be retransmitted a bounded number of times")
+	assert.True(t, time.Now().Sub(start) < 10*readyAttempts*testRetransmit, "Handshake should time out promptly")
+}
+
+func TestReadyHandshakeIgnoresStaleAcks(t *testing.T) {
+	acks := make(chan *readyMsg, 2)
+	err := confirmReady(42, func(b []byte) {
+		r, _ := parseReady(b)
+		select {
+		case acks <- &readyMsg{ack: true, sessionId: r.sessionId, nonce: r.nonce + 1}:
+		default:
+		}
+	}, acks, testRetransmit)
+	assert.Error(t, err, "Acks with the wrong nonce shouldn't complete the handshake")
+}
+
+func TestDeliverReadyAck(t *testing.T) {
+	peerId := waddell.PeerId{}
+	ack := &readyMsg{ack: true, sessionId: 42, nonce: 1}
+
+	// No active session, dropped
+	deliverReadyAck(peerId, ack)
+
+	acks, done := awaitingReady(peerId, 42)
+	deliverReadyAck(peerId, &readyMsg{ack: true, sessionId: 43, nonce: 1})
+	deliverReadyAck(peerId, ack)
+	select {
+	case got := <-acks:
+		assert.Equal(t, ack, got)
+	default:
+		t.Fatal("Ack for active session should have been delivered")
+	}
+	select {
+	case got := <-acks:
+		t.Fatalf("Ack for other session shouldn't have been delivered: %s", got)
+	default:
+	}
+	done()
+	deliverReadyAck(peerId, ack)
+	assert.Equal(t, 0, len(acks), "Ack after handshake is done should be dropped")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/getlantern/waddell"
+)
+
+// waddell only delivers messages to specific peers, so names are registered
+// with a directory, which is just a demo process running with -mode directory.
+// Servers started with -register NAME periodically announce themselves to the
+// directory, and clients started with -connect NAME look up the name there. The
+// directory timestamps announcements itself, so that clock skew between peers
+// doesn't matter.
+
+const (
+	RegistrationTopic = waddell.TopicId(10001)
+
+	REGISTER_INTERVAL      = 30 * time.Second
+	REGISTRATION_FRESHNESS = 3 * REGISTER_INTERVAL
+	LOOKUP_TIMEOUT         = 10 * time.Second
+
+	msgAnnounce      = "announce"
+	msgLookup        = "lookup"
+	msgRegistrations = "registrations"
+)
+
+// registryMsg is a message exchanged with the directory.
+type registryMsg struct {
+	Type          string          `json:"type"`
+	Name          string          `json:"name"`
+	Registrations []*registration `json:"registrations,omitempty"`
+}
+
+// registration records that the peer with the given id announced a name.
+type registration struct {
+	Id        string    `json:"id"`
+	Announced time.Time `json:"announced"`
+}
+
+// runDirectory keeps track of announced names and answers lookups, forever.
+func runDirectory(wc *waddell.Client) {
+	log.Printf("Starting directory, waddell id is \"%s\"", wc.CurrentId())
+	out := wc.Out(RegistrationTopic)
+	names := make(map[string]map[string]time.Time)
+	for wm := range wc.In(RegistrationTopic) {
+		msg := &registryMsg{}
+		err := json.Unmarshal(wm.Body, msg)
+		if err != nil {
+			log.Printf("Unable to parse registry message from %s: %s", wm.From, err)
+			continue
+		}
+		switch msg.Type {
+		case msgAnnounce:
+			ids := names[msg.Name]
+			if ids == nil {
+				ids = make(map[string]time.Time)
+				names[msg.Name] = ids
+			}
+			ids[wm.From.String()] = time.Now()
+		case msgLookup:
+			reply := &registryMsg{Type: msgRegistrations, Name: msg.Name}
+			for id, announced := range names[msg.Name] {
+				if time.Now().Sub(announced) > REGISTRATION_FRESHNESS {
+					// Stale
+					delete(names[msg.Name], id)
+					continue
+				}
+				reply.Registrations = append(reply.Registrations, &registration{id, announced})
+			}
+			sendRegistryMsg(out, wm.From, reply)
+		}
+	}
+}
+
+// announce announces to the directory that this peer goes by the given name,
+// periodically, forever.
+func announce(wc *waddell.Client, directory waddell.PeerId, name string) {
+	log.Printf("Registering as %s", name)
+	out := wc.Out(RegistrationTopic)
+	for {
+		sendRegistryMsg(out, directory, &registryMsg{Type: msgAnnounce, Name: name})
+		time.Sleep(REGISTER_INTERVAL)
+	}
+}
+
+// resolve looks up the peer registered with the given name at the directory.
+func resolve(wc *waddell.Client, directory waddell.PeerId, name string) (waddell.PeerId, error) {
+	sendRegistryMsg(wc.Out(RegistrationTopic), directory, &registryMsg{Type: msgLookup, Name: name})
+	timeout := time.After(LOOKUP_TIMEOUT)
+	in := wc.In(RegistrationTopic)
+	for {
+		select {
+		case <-timeout:
+			return waddell.PeerId{}, fmt.Errorf("Timed out looking up %s", name)
+		case wm := <-in:
+			msg := &registryMsg{}
+			err := json.Unmarshal(wm.Body, msg)
+			if err != nil || msg.Type != msgRegistrations || msg.Name != name {
+				continue
+			}
+			reg, err := pickRegistration(name, msg.Registrations, time.Now())
+			if err != nil {
+				return waddell.PeerId{}, err
+			}
+			return waddell.PeerIdFromString(reg.Id)
+		}
+	}
+}
+
+// pickRegistration picks the most recent of the fresh registrations for name,
+// complaining loudly if more than one peer is using that name.
+func pickRegistration(name string, registrations []*registration, now time.Time) (*registration, error) {
+	fresh := make([]*registration, 0, len(registrations))
+	for _, reg := range registrations {
+		if now.Sub(reg.Announced) <= REGISTRATION_FRESHNESS {
+			fresh = append(fresh, reg)
+		}
+	}
+	if len(fresh) == 0 {
+		return nil, fmt.Errorf("Nobody is registered as %s", name)
+	}
+	sort.Sort(byMostRecent(fresh))
+	if len(fresh) > 1 {
+		log.Printf("WARNING!!! %d servers are registered as %s, using the most recent one (%s)", len(fresh), name, fresh[0].Id)
+		for _, reg := range fresh[1:] {
+			log.Printf("WARNING!!! Ignoring %s, which also registered as %s at %s", reg.Id, name, reg.Announced)
+		}
+	}
+	return fresh[0], nil
+}
+
+func sendRegistryMsg(out chan<- *waddell.MessageOut, to waddell.PeerId, msg *registryMsg) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Unable to encode registry message: %s", err)
+		return
+	}
+	out <- waddell.Message(to, b)
+}
+
+type byMostRecent []*registration
+
+func (a byMostRecent) Len() int           { return len(a) }
+func (a byMostRecent) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byMostRecent) Less(i, j int) bool { return a[i].Announced.After(a[j].Announced) }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+	"github.com/getlantern/waddell"
+)
+
+func TestPickRegistration(t *testing.T) {
+	now := time.Now()
+	older := &registration{"older", now.Add(-2 * REGISTER_INTERVAL)}
+	newer := &registration{"newer", now.Add(-1 * time.Second)}
+	stale := &registration{"stale", now.Add(-2 * REGISTRATION_FRESHNESS)}
+
+	reg, err := pickRegistration("name", []*registration{older, stale, newer}, now)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "newer", reg.Id, "Most recent registration should win")
+	}
+
+	_, err = pickRegistration("name", []*registration{stale}, now)
+	assert.Error(t, err, "Stale registrations should be ignored")
+}
+
+// TestRegistry runs a directory, a server registering a name and a client
+// looking up that name against a local waddell.
+func TestRegistry(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	go (&waddell.Server{}).Serve(listener)
+
+	connect := func() *waddell.Client {
+		client, err := waddell.NewClient(&waddell.ClientConfig{
+			Dial: func() (net.Conn, error) {
+				return net.Dial("tcp", listener.Addr().String())
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unable to connect to waddell: %s", err)
+		}
+		return client
+	}
+	directoryClient := connect()
+	serverClient := connect()
+	clientClient := connect()
+
+	go runDirectory(directoryClient)
+	go announce(serverClient, directoryClient.CurrentId(), "myserver")
+
+	// The announcement may not have reached the directory yet, so retry
+	var serverId waddell.PeerId
+	for i := 0; i < 10; i++ {
+		serverId, err = resolve(clientClient, directoryClient.CurrentId(), "myserver")
+		if err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if assert.NoError(t, err, "Should be able to resolve server by name") {
+		assert.Equal(t, serverClient.CurrentId(), serverId, "Should have resolved to server's id")
+	}
+
+	_, err = resolve(clientClient, directoryClient.CurrentId(), "unknown")
+	assert.Error(t, err, "Unknown name shouldn't resolve")
+}
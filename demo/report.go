@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+)
+
+const (
+	pathMapped  = "mapped"
+	pathPunched = "punched"
+	pathFailed  = "failed"
+)
+
+var (
+	jsonOut = flag.Bool("json", false, "Print a line of JSON to stdout describing how each session connected (only used when offering, with -mode client or both)")
+)
+
+// sessionReport describes how a session connected, for -json.
+type sessionReport struct {
+	Traversal  uint32         `json:"traversal"`
+	Path       string         `json:"path"`             // mapped, punched or failed
+	Method     string         `json:"method,omitempty"` // how the port was mapped
+	Local      string         `json:"local,omitempty"`
+	Remote     string         `json:"remote,omitempty"`
+	LocalType  string         `json:"localType,omitempty"` // candidate types of the punched pair
+	RemoteType string         `json:"remoteType,omitempty"`
+	Timings    *timingsReport `json:"timings,omitempty"`
+	Verified   *bool          `json:"verified,omitempty"` // whether the READY handshake completed
+	Phase      string         `json:"phase,omitempty"`    // the phase reached, on failure
+	Class      string         `json:"class,omitempty"`    // the error class, on failure
+	Error      string         `json:"error,omitempty"`
+}
+
+// report prints r as JSON to stdout if -json was given.
+func (r *sessionReport) report() {
+	if !*jsonOut {
+		return
+	}
+	json.NewEncoder(os.Stdout).Encode(r)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// helloInterval is how frequently the client sends a message to the server
+	helloInterval = 1 * time.Second
+)
+
+var (
+	retries = flag.Int("retries", 5, "How many times to automatically re-punch the tunnel when the server stops responding to keepalives before giving up, -1 for no limit (only used when offering, with -mode client or both)")
+)
+
+// splice carries the client's traffic over whichever tunnel was punched most
+// recently, so that when a dead tunnel is re-punched the traffic resumes over
+// the new tunnel rather than starting over.
+type splice struct {
+	current *tunnel
+	mutex   sync.Mutex
+}
+
+// set splices tun in, replacing the current tunnel.
+func (s *splice) set(tun *tunnel) {
+	s.mutex.Lock()
+	s.current = tun
+	s.mutex.Unlock()
+}
+
+// get returns the current tunnel, or nil if it's dead and hasn't been replaced
+// yet.
+func (s *splice) get() *tunnel {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.current == nil {
+		return nil
+	}
+	select {
+	case <-s.current.dead:
+		return nil
+	default:
+		return s.current
+	}
+}
+
+// sendHellos sends a numbered message to the server over the current tunnel
+// every interval. Messages due while there's no live tunnel are skipped.
+func sendHellos(app *splice, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for seq := 1; ; seq++ {
+		<-ticker.C
+		tun := app.get()
+		if tun == nil {
+			continue
+		}
+		msg := fmt.Sprintf("Hello #%d from %s to %s", seq, tun.conn.LocalAddr(), tun.conn.RemoteAddr())
+		log.Printf("Sending UDP message: %s", msg)
+		err := tun.write([]byte(msg))
+		if err != nil {
+			// The keepalives will tell us whether the tunnel is dead
+			log.Printf("Unable to write to UDP, dropping message: %s", err)
+		}
+	}
+}
+
+// repunch calls punch, which punches a tunnel and uses it until it dies, again
+// each time that the tunnel dies, up to retries times (or without limit if
+// retries is negative). punch returns true if the user asked to quit.
+func repunch(retries int, punch func() (quit bool)) error {
+	for attempt := 0; ; attempt++ {
+		if punch() {
+			return nil
+		}
+		if retries >= 0 && attempt >= retries {
+			return fmt.Errorf("Tunnel to server died %d times, not re-punching again", attempt+1)
+		}
+		log.Printf("Tunnel to server is dead, re-punching (re-punch %d)", attempt+1)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// TestRepunch kills the server's end of the tunnel mid-session and makes sure
+// that the client's traffic resumes over a re-punched tunnel.
+func TestRepunch(t *testing.T) {
+	origKeepAlive := *keepAlive
+	*keepAlive = 50 * time.Millisecond
+	defer func() {
+		*keepAlive = origKeepAlive
+	}()
+
+	app := &splice{}
+	received := make(chan string, 1000)
+	servers := make(chan *tunnel, 10)
+	punches := 0
+	punch := func() bool {
+		punches++
+		server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Unable to listen: %s", err)
+		}
+		client, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("Unable to dial: %s", err)
+		}
+		serverTun := newTunnel(server, client.LocalAddr().(*net.UDPAddr), "Client")
+		go func() {
+			b := make([]byte, 1024)
+			for {
+				n, err := serverTun.read(b)
+				if err != nil {
+					return
+				}
+				received <- string(b[:n])
+			}
+		}()
+		servers <- serverTun
+		clientTun := newTunnel(client, nil, "Server")
+		defer clientTun.close()
+		go readUnexpected(clientTun, nil)
+		app.set(clientTun)
+		<-clientTun.dead
+		return false
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- repunch(2, punch)
+	}()
+	go sendHellos(app, 10*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		serverTun := <-servers
+		// Only what arrives over the newest tunnel counts
+		to := " to " + serverTun.conn.LocalAddr().String()
+		msg := nextReceived(t, received)
+		for !strings.HasSuffix(msg, to) {
+			msg = nextReceived(t, received)
+		}
+		assert.True(t, strings.HasPrefix(msg, "Hello #"), "Traffic should flow over tunnel")
+		serverTun.close()
+	}
+
+	select {
+	case err := <-done:
+		assert.Error(t, err, "Should give up after the last retry")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client didn't give up")
+	}
+	assert.Equal(t, 3, punches, "Should have punched once and re-punched twice")
+}
+
+func nextReceived(t *testing.T, received <-chan string) string {
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Traffic didn't resume")
+		return ""
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/getlantern/go-natty/natty"
 	"github.com/getlantern/waddell"
@@ -12,6 +15,7 @@ import (
 type peer struct {
 	id              waddell.PeerId
 	traversals      map[uint32]*natty.Traversal
+	traces          map[uint32]*sessionTrace
 	traversalsMutex sync.Mutex
 }
 
@@ -21,16 +25,39 @@ var (
 )
 
 func runServer() {
+	startServer()
+	dispatch(in, answer)
+}
+
+// startServer gets ready to answer traversals.
+func startServer() {
 	log.Printf("Starting server, waddell id is \"%s\"", id.String())
+	if *sendPath != "" {
+		log.Printf("Ready to send %s, receiver should run with -receive DIR -server %s", *sendPath, id)
+	}
 
+	if *maxSessionsPerPeer < 0 || *newSessionRate < 0 {
+		usageError("-max-sessions-per-peer and -new-session-rate can't be negative")
+	}
+	limits = newSessionLimits(*maxSessionsPerPeer, *newSessionRate)
 	peers = make(map[waddell.PeerId]*peer)
 
-	for wm := range in {
-		answer(wm)
+	if *register != "" {
+		go announce(wc, directoryId(), *register)
 	}
 }
 
 func answer(wm *waddell.MessageIn) {
+	msg := message(wm.Body)
+	if r, ok := parseReady(msg.getData()); ok {
+		if r.ack {
+			deliverReadyAck(wm.From, r)
+		} else {
+			log.Printf("Dropping unexpected %s", r)
+		}
+		return
+	}
+
 	peersMutex.Lock()
 	defer peersMutex.Unlock()
 	p := peers[wm.From]
@@ -38,6 +65,7 @@ func answer(wm *waddell.MessageIn) {
 		p = &peer{
 			id:         wm.From,
 			traversals: make(map[uint32]*natty.Traversal),
+			traces:     make(map[uint32]*sessionTrace),
 		}
 		peers[wm.From] = p
 	}
@@ -51,9 +79,28 @@ func (p *peer) answer(wm *waddell.MessageIn) {
 	traversalId := msg.getTraversalId()
 	t := p.traversals[traversalId]
 	if t == nil {
+		repeated, err := limits.allow(p.id, traversalId, len(p.traversals), time.Now())
+		if err != nil {
+			if !repeated {
+				log.Printf("Rejecting traversal %d from %s: %s (rejected so far: %s)", traversalId, p.id, err, limits.counters())
+				out <- answererMessage(p.id, traversalId, rejection(err))
+			}
+			return
+		}
+		if external, ok := parseMapped(msg.getData()); ok {
+			log.Printf("Client mapped a port at %s for traversal %d, not punching", external, traversalId)
+			startingTraversal(traversalId)
+			trace := newSessionTrace(*traceDir, *traceSample, traversalId)
+			trace.transcript(false, string(msg.getData()))
+			go readUDP(p.id, traversalId, &natty.FiveTuple{Proto: natty.UDP, Local: ":0", Remote: external}, true, trace)
+			return
+		}
 		log.Printf("Answering traversal: %d", traversalId)
+		startingTraversal(traversalId)
+		trace := newSessionTrace(*traceDir, *traceSample, traversalId)
+		trace.timing("answering")
 		// Set up a new Natty traversal
-		t = natty.Answer(TIMEOUT)
+		t = natty.Answer(TIMEOUT, traversalOptions(trace)...)
 		go func() {
 			// Send
 			for {
@@ -62,7 +109,8 @@ func (p *peer) answer(wm *waddell.MessageIn) {
 					return
 				}
 				log.Printf("Sending %s", msgOut)
-				out <- waddell.Message(p.id, idToBytes(traversalId), []byte(msgOut))
+				trace.transcript(true, msgOut)
+				out <- answererMessage(p.id, traversalId, []byte(msgOut))
 			}
 		}()
 
@@ -72,46 +120,120 @@ func (p *peer) answer(wm *waddell.MessageIn) {
 				p.traversalsMutex.Lock()
 				defer p.traversalsMutex.Unlock()
 				delete(p.traversals, traversalId)
+				delete(p.traces, traversalId)
 				t.Close()
 			}()
 
 			ft, err := t.FiveTuple()
 			if err != nil {
 				log.Printf("Unable to answer traversal %d: %s", traversalId, err)
+				trace.timing(fmt.Sprintf("traversal failed: %s", err))
+				trace.close()
 				return
 			}
 
 			log.Printf("Got five tuple: %s", ft)
-			go readUDP(p.id, traversalId, ft)
+			trace.timing(fmt.Sprintf("got five tuple %s", ft))
+			if ft.Proto == natty.TCP {
+				// Listen before t is closed, since it knows how
+				l, err := t.ListenTCP()
+				if err != nil {
+					log.Printf("Unable to answer traversal %d: %s", traversalId, err)
+					trace.close()
+					return
+				}
+				go readTCP(p.id, traversalId, l, trace)
+				return
+			}
+			go readUDP(p.id, traversalId, ft, false, trace)
 		}()
 		p.traversals[traversalId] = t
+		p.traces[traversalId] = trace
 	}
 	log.Printf("Received for traversal %d: %s", traversalId, msg.getData())
+	p.traces[traversalId].transcript(false, string(msg.getData()))
 	t.MsgIn(string(msg.getData()))
 }
 
-func readUDP(peerId waddell.PeerId, traversalId uint32, ft *natty.FiveTuple) {
-	local, _, err := ft.UDPAddrs()
+// readUDP listens on the FiveTuple's local address and reads what the client
+// sends. If greet is true, the client doesn't know our address yet, so we send
+// it keepalives with each READY.
+func readUDP(peerId waddell.PeerId, traversalId uint32, ft *natty.FiveTuple, greet bool, trace *sessionTrace) {
+	local, remote, err := ft.UDPAddrs()
 	if err != nil {
-		log.Fatalf("Unable to resolve UDP addresses: %s", err)
+		fail(EXIT_TRAVERSAL_FAILED, traversalId, "Unable to resolve UDP addresses: %s", err)
 	}
-	conn, err := net.ListenUDP("udp", local)
+	conn, err := net.ListenUDP(network("udp"), local)
 	if err != nil {
-		log.Fatalf("Unable to listen on UDP: %s", err)
+		fail(EXIT_TRAVERSAL_FAILED, traversalId, "Unable to listen on UDP at %s: %s", local, err)
 	}
 	log.Printf("Listening for UDP packets at: %s", local)
-	notifyClientOfServerReady(peerId, traversalId)
-	b := make([]byte, 1024)
+	var greeting func()
+	if greet {
+		greeting = func() {
+			_, err := conn.WriteToUDP(natty.KeepAlivePacket, remote)
+			if err != nil {
+				log.Printf("Unable to greet client at %s: %s", remote, err)
+			}
+		}
+	}
+	err = notifyClientOfServerReady(peerId, traversalId, greeting)
+	if err != nil {
+		log.Printf("Abandoning traversal %d: %s", traversalId, err)
+		trace.timing(fmt.Sprintf("READY handshake failed: %s", err))
+		trace.close()
+		conn.Close()
+		return
+	}
+	trace.timing("client acknowledged READY")
+	trace.close()
+
+	tun := newTunnel(conn, remote, fmt.Sprintf("Client for traversal %d", traversalId))
+	defer tun.close()
+
+	if *chatMode {
+		if chat(tun) {
+			os.Exit(0)
+		}
+		return
+	}
+	if *sendPath != "" {
+		err := sendFile(tun, *sendPath)
+		if err != nil {
+			fail(EXIT_TRANSFER_FAILED, traversalId, "Unable to send %s: %s", *sendPath, err)
+		}
+		log.Printf("Sent %s", *sendPath)
+		os.Exit(0)
+	}
+
+	fw := newForwarder(tun, traversalId, false, *forwardSecret)
+	defer fw.close()
+
+	b := make([]byte, MAX_MESSAGE_SIZE)
 	for {
-		n, addr, err := conn.ReadFrom(b)
+		n, err := tun.read(b)
 		if err != nil {
-			log.Fatalf("Unable to read from UDP: %s", err)
+			log.Printf("Done reading from UDP for traversal %d: %s", traversalId, err)
+			return
+		}
+		if isMuxFrame(b[:n]) {
+			fw.handle(b[:n])
+			continue
 		}
 		msg := string(b[:n])
-		log.Printf("Got UDP message from %s: '%s'", addr, msg)
+		log.Printf("Got UDP message from %s: '%s'", remote, msg)
 	}
 }
 
-func notifyClientOfServerReady(peerId waddell.PeerId, traversalId uint32) {
-	out <- waddell.Message(peerId, idToBytes(traversalId), []byte(READY))
+// notifyClientOfServerReady tells the client that we're listening, waiting for
+// it to acknowledge that. greet, if not nil, is called with every READY sent.
+func notifyClientOfServerReady(peerId waddell.PeerId, traversalId uint32, greet func()) error {
+	acks, done := awaitingReady(peerId, traversalId)
+	defer done()
+	return confirmReady(traversalId, func(b []byte) {
+		if greet != nil {
+			greet()
+		}
+		out <- answererMessage(peerId, traversalId, b)
+	}, acks, readyRetransmit)
 }
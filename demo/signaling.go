@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// This file implements dialing waddell, optionally through an HTTP CONNECT
+// proxy and optionally using TLS.
+
+const (
+	waddellDialTimeout = 30 * time.Second
+
+	hopWaddellConnect  = "waddell connect"
+	hopProxyConnect    = "proxy connect"
+	hopTLSHandshake    = "TLS handshake"
+	hopWaddellRegister = "waddell register"
+)
+
+// hopError is an error encountered on a specific hop of the way to waddell.
+type hopError struct {
+	hop string
+	err error
+}
+
+func (e *hopError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.hop, e.err)
+}
+
+// waddellDialer dials waddell.
+type waddellDialer struct {
+	addr      string
+	proxy     *url.URL    // if set, connect through this HTTP CONNECT proxy
+	tlsConfig *tls.Config // if set, use TLS with this config
+	lastErr   error       // the error from the most recent dial, if any
+}
+
+// newWaddellDialer creates a waddellDialer based on the command-line flags.
+func newWaddellDialer() (*waddellDialer, error) {
+	d := &waddellDialer{addr: *waddellAddr}
+	var err error
+	d.proxy, err = proxyURL(*proxyF)
+	if err != nil {
+		return nil, err
+	}
+	if *waddellTLS {
+		d.tlsConfig, err = waddellTLSConfig(*waddellAddr, *waddellCA, *waddellServerName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// dial dials waddell, remembering any error so that a failure to register with
+// waddell can be attributed to the right hop.
+func (d *waddellDialer) dial() (net.Conn, error) {
+	conn, err := d.doDial()
+	d.lastErr = err
+	return conn, err
+}
+
+func (d *waddellDialer) doDial() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if d.proxy != nil {
+		conn, err = connectViaProxy(d.proxy, d.addr)
+		if err != nil {
+			return nil, &hopError{hopProxyConnect, err}
+		}
+	} else {
+		conn, err = net.DialTimeout(network("tcp"), d.addr, waddellDialTimeout)
+		if err != nil {
+			return nil, &hopError{hopWaddellConnect, fmt.Errorf("%s", describeNetError("waddell at "+d.addr, err))}
+		}
+	}
+
+	if d.tlsConfig == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, d.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(waddellDialTimeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, &hopError{hopTLSHandshake, err}
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// describeError describes an error from connecting to waddell, attributing it
+// to the hop on which it happened.
+func (d *waddellDialer) describeError(err error) string {
+	if d.lastErr != nil {
+		return d.lastErr.Error()
+	}
+	return (&hopError{hopWaddellRegister, err}).Error()
+}
+
+// proxyURL parses the -proxy flag, falling back to the HTTPS_PROXY environment
+// variable if the flag is empty. It returns nil if no proxy is configured.
+func proxyURL(flagValue string) (*url.URL, error) {
+	if flagValue == "" {
+		flagValue = os.Getenv("HTTPS_PROXY")
+	}
+	if flagValue == "" {
+		flagValue = os.Getenv("https_proxy")
+	}
+	if flagValue == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(flagValue)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse proxy %s: %s", flagValue, err)
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("Proxy %s should be of the form http://[user:password@]host:port", flagValue)
+	}
+	return u, nil
+}
+
+// connectViaProxy connects to addr through the given HTTP CONNECT proxy,
+// authenticating with the proxy URL's userinfo if present.
+func connectViaProxy(proxy *url.URL, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network("tcp"), proxy.Host, waddellDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("%s", describeNetError("proxy at "+proxy.Host, err))
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := proxy.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	conn.SetDeadline(time.Now().Add(waddellDialTimeout))
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to send CONNECT to proxy at %s: %s", proxy.Host, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to read CONNECT response from proxy at %s: %s", proxy.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("Proxy at %s refused CONNECT to %s: %s", proxy.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{conn, br}, nil
+}
+
+// bufferedConn is a net.Conn that first reads whatever was already buffered
+// while reading the proxy's response.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
+
+// waddellTLSConfig builds the TLS config for connecting to waddell at addr,
+// trusting the CA in the PEM file at caPath (or the system's roots if that's
+// empty) and verifying the given server name (or the host from addr if that's
+// empty).
+func waddellTLSConfig(addr string, caPath string, serverName string) (*tls.Config, error) {
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to determine server name from %s: %s", addr, err)
+		}
+		serverName = host
+	}
+	config := &tls.Config{ServerName: serverName}
+	if caPath != "" {
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA %s: %s", caPath, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA %s", caPath)
+		}
+	}
+	return config, nil
+}
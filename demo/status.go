@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	statusAddr = flag.String("status", "", "Serve our status, like how much each -L and -R forward has carried, as JSON over HTTP at the given address, e.g. localhost:8000")
+
+	// tracked are the forwards reported by -status, in the order in which they
+	// were declared
+	tracked      []*forward
+	trackedMutex sync.Mutex
+)
+
+// status is what -status serves.
+type status struct {
+	Forwards []*forwardStatus `json:"forwards"`
+}
+
+// forwardStatus reports on a forward.
+type forwardStatus struct {
+	Traversal uint32 `json:"traversal,omitempty"` // on the server, the session
+	Forward   string `json:"forward"`
+	Streams   int64  `json:"streams"`  // connections, or UDP senders
+	Failed    int64  `json:"failed"`   // streams that couldn't be connected
+	Sent      int64  `json:"sent"`     // bytes sent through the tunnel
+	Received  int64  `json:"received"` // bytes received through the tunnel
+}
+
+func trackForwards(fwds []*forward) {
+	trackedMutex.Lock()
+	tracked = append(tracked, fwds...)
+	trackedMutex.Unlock()
+}
+
+func untrackForwards(fwds []*forward) {
+	trackedMutex.Lock()
+	defer trackedMutex.Unlock()
+	remaining := tracked[:0]
+	for _, fwd := range tracked {
+		if !containsForward(fwds, fwd) {
+			remaining = append(remaining, fwd)
+		}
+	}
+	tracked = remaining
+}
+
+func containsForward(fwds []*forward, fwd *forward) bool {
+	for _, candidate := range fwds {
+		if candidate == fwd {
+			return true
+		}
+	}
+	return false
+}
+
+func currentStatus() *status {
+	trackedMutex.Lock()
+	defer trackedMutex.Unlock()
+	st := &status{Forwards: make([]*forwardStatus, 0, len(tracked))}
+	for _, fwd := range tracked {
+		st.Forwards = append(st.Forwards, &forwardStatus{
+			Traversal: fwd.traversalId,
+			Forward:   fwd.spec.String(),
+			Streams:   atomic.LoadInt64(&fwd.streams),
+			Failed:    atomic.LoadInt64(&fwd.failed),
+			Sent:      atomic.LoadInt64(&fwd.sent),
+			Received:  atomic.LoadInt64(&fwd.received),
+		})
+	}
+	return st
+}
+
+// serveStatus starts serving -status at addr.
+func serveStatus(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go http.Serve(l, http.HandlerFunc(handleStatus))
+	return nil
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentStatus())
+}
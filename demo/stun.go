@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/getlantern/go-natty/natty"
+)
+
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunHeaderSize      = 20
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXorMappedAddress = 0x0020
+
+	STUN_CHECK_TIMEOUT = 3 * time.Second
+)
+
+// stunResult is the result of probing a single STUN server.
+type stunResult struct {
+	server  string
+	latency time.Duration
+	mapped  *net.UDPAddr
+	err     error
+}
+
+// parseSTUNServers parses a comma-separated list of STUN servers.
+func parseSTUNServers(list string) []string {
+	var servers []string
+	for _, server := range strings.Split(list, ",") {
+		server = strings.TrimSpace(server)
+		if server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// checkSTUN probes the given STUN servers (or natty's defaults if none were
+// given), logs a report and returns true if at least one of them responded.
+func checkSTUN(servers []string) bool {
+	if len(servers) == 0 {
+		servers = natty.DefaultSTUNServers
+	}
+	ok := false
+	for _, result := range probeSTUNServers(servers, STUN_CHECK_TIMEOUT) {
+		if result.err != nil {
+			log.Printf("STUN server %s did not respond: %s", result.server, result.err)
+		} else {
+			log.Printf("STUN server %s responded in %s, mapped address is %s", result.server, result.latency, result.mapped)
+			ok = true
+		}
+	}
+	if !ok {
+		log.Printf("None of the STUN servers (%s) responded. Traversal will fail unless a reachable server is specified with -stun.", strings.Join(servers, ","))
+	}
+	return ok
+}
+
+// probeSTUNServers probes all of the given servers concurrently.
+func probeSTUNServers(servers []string, timeout time.Duration) []*stunResult {
+	resultCh := make(chan *stunResult, len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			resultCh <- probeSTUN(server, timeout)
+		}(server)
+	}
+	results := make([]*stunResult, 0, len(servers))
+	for i := 0; i < len(servers); i++ {
+		results = append(results, <-resultCh)
+	}
+	return results
+}
+
+// probeSTUN sends a STUN binding request to the given server and waits for the
+// response.
+func probeSTUN(server string, timeout time.Duration) *stunResult {
+	result := &stunResult{server: server}
+	addr := strings.TrimPrefix(server, "stun:")
+	conn, err := net.Dial(network("udp"), addr)
+	if err != nil {
+		result.err = fmt.Errorf("%s", describeNetError(addr, err))
+		return result
+	}
+	defer conn.Close()
+
+	req := make([]byte, stunHeaderSize)
+	endianness := binary.BigEndian
+	endianness.PutUint16(req[0:], stunBindingRequest)
+	endianness.PutUint16(req[2:], 0)
+	endianness.PutUint32(req[4:], stunMagicCookie)
+	txId := req[8:stunHeaderSize]
+	_, err = rand.Read(txId)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	_, err = conn.Write(req)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	b := make([]byte, 1024)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		resp := b[:n]
+		if n < stunHeaderSize || endianness.Uint16(resp) != stunBindingResponse || !bytes.Equal(resp[8:stunHeaderSize], txId) {
+			// Not our response
+			continue
+		}
+		result.latency = time.Now().Sub(start)
+		result.mapped, result.err = parseMappedAddress(resp)
+		return result
+	}
+}
+
+// parseMappedAddress extracts the (XOR-)MAPPED-ADDRESS from a STUN binding
+// response.
+func parseMappedAddress(resp []byte) (*net.UDPAddr, error) {
+	endianness := binary.BigEndian
+	attrs := resp[stunHeaderSize:]
+	var mapped *net.UDPAddr
+	for len(attrs) >= 4 {
+		attrType := endianness.Uint16(attrs)
+		attrLen := int(endianness.Uint16(attrs[2:]))
+		if len(attrs) < 4+attrLen {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		// Attributes are padded to a multiple of 4 bytes
+		attrs = attrs[4+(attrLen+3)&^3:]
+		if len(value) < 8 {
+			continue
+		}
+		ip := net.IP(append([]byte{}, value[4:]...))
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			continue
+		}
+		port := endianness.Uint16(value[2:])
+		switch attrType {
+		case stunAttrXorMappedAddress:
+			port ^= stunMagicCookie >> 16
+			xor := resp[4:stunHeaderSize]
+			for i := range ip {
+				ip[i] ^= xor[i]
+			}
+			return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+		case stunAttrMappedAddress:
+			mapped = &net.UDPAddr{IP: ip, Port: int(port)}
+		}
+	}
+	if mapped == nil {
+		return nil, fmt.Errorf("Response didn't include a mapped address")
+	}
+	return mapped, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/go-natty/natty"
+	"github.com/getlantern/testify/assert"
+)
+
+func TestParseSTUNServers(t *testing.T) {
+	assert.Equal(t, []string{"stun:a:3478", "b:19302"}, parseSTUNServers(" stun:a:3478, ,b:19302"))
+	assert.Empty(t, parseSTUNServers(""))
+}
+
+func TestSTUNServersPassedThrough(t *testing.T) {
+	*stun = "stun:a:3478,b:19302"
+	defer func() { *stun = "" }()
+	assert.Equal(t, []string{"stun:a:3478", "b:19302"}, stunServers())
+
+	// A stand-in for natty that records the flags that it's given
+	dir, err := ioutil.TempDir("", "natty")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	args := filepath.Join(dir, "args")
+	script := "#!/bin/sh\nif [ \"$1\" = -help ]; then\n  echo '  --stuns (STUN servers)  type: string  default: '\n  exit 0\nfi\n" +
+		"echo \"$@\" > " + args + ".tmp && mv " + args + ".tmp " + args + "\nexec sleep 30\n"
+	executable := filepath.Join(dir, "natty")
+	if err := ioutil.WriteFile(executable, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write natty: %s", err)
+	}
+
+	// -ipv6 shouldn't keep a natty without -ipversion from running
+	ipVersion = natty.IPv6
+	defer func() { ipVersion = natty.IPAny }()
+	tr := natty.Offer(0, append(traversalOptions(nil), natty.WithBinary(executable))...)
+	defer tr.Close()
+	var b []byte
+	for i := 0; i < 250 && len(b) == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		b, _ = ioutil.ReadFile(args)
+	}
+	assert.Contains(t, string(b), "-stuns stun:a:3478,b:19302", "Should pass STUN servers to natty")
+	assert.False(t, strings.Contains(string(b), "-ipversion"), "Should only filter candidates by IP version")
+}
+
+func TestProbeSTUN(t *testing.T) {
+	responder := startFakeSTUN(t, true)
+	defer responder.Close()
+	silent := startFakeSTUN(t, false)
+	defer silent.Close()
+
+	good := "stun:" + responder.LocalAddr().String()
+	bad := silent.LocalAddr().String()
+	results := probeSTUNServers([]string{good, bad}, 250*time.Millisecond)
+	assert.Len(t, results, 2)
+	for _, result := range results {
+		switch result.server {
+		case good:
+			if assert.NoError(t, result.err, "Responding server should succeed") {
+				assert.True(t, result.mapped.IP.IsLoopback(), "Mapped address should be our loopback address")
+				assert.True(t, result.latency > 0, "Latency should be recorded")
+			}
+		case bad:
+			assert.Error(t, result.err, "Silent server should fail")
+		}
+	}
+
+	assert.True(t, checkSTUN([]string{good}), "Check should pass with a responding server")
+	assert.False(t, checkSTUN([]string{bad}), "Check should fail without any responding server")
+}
+
+// startFakeSTUN starts a local STUN server that, if respond is true, answers
+// binding requests with the sender's address.
+func startFakeSTUN(t *testing.T, respond bool) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if !respond || n < stunHeaderSize {
+				continue
+			}
+			endianness := binary.BigEndian
+			resp := make([]byte, stunHeaderSize+12)
+			endianness.PutUint16(resp, stunBindingResponse)
+			endianness.PutUint16(resp[2:], 12)
+			copy(resp[4:stunHeaderSize], b[4:stunHeaderSize])
+			endianness.PutUint16(resp[20:], stunAttrXorMappedAddress)
+			endianness.PutUint16(resp[22:], 8)
+			resp[25] = 0x01
+			endianness.PutUint16(resp[26:], uint16(addr.Port)^(stunMagicCookie>>16))
+			ip := addr.IP.To4()
+			for i := range ip {
+				resp[28+i] = ip[i] ^ resp[4+i]
+			}
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+	return conn
+}
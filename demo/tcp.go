@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/getlantern/go-natty/natty"
+	"github.com/getlantern/waddell"
+)
+
+var (
+	transportF = flag.String("transport", "udp", "Transport to traverse over: udp, fallback-tcp (UDP if possible, otherwise TCP), prefer-tcp or tcp. Over TCP, the client just sends hellos, -chat, -send, -receive and forwarding need UDP. Only udp works with the bundled natty.")
+
+	transport natty.Transport
+)
+
+// parseTransport parses -transport, making sure that it's compatible with the
+// other flags.
+func parseTransport() error {
+	var err error
+	transport, err = natty.ParseTransport(*transportF)
+	if err != nil {
+		return err
+	}
+	if transport == natty.TransportUDP {
+		return nil
+	}
+	err = natty.CheckTransport(transport)
+	if err != nil {
+		return fmt.Errorf("-transport %s is not supported by the bundled natty: %s", transport, err)
+	}
+	if *chatMode || *sendPath != "" || *receiveDir != "" || len(forwards) > 0 {
+		return fmt.Errorf("-transport %s can't be used with -chat, -send, -receive or forwarding", transport)
+	}
+	return nil
+}
+
+// writeTCP dials the server over the TCP FiveTuple and sends it a numbered
+// message every helloInterval, like sendHellos does over a UDP tunnel, until
+// the connection fails.
+func writeTCP(traversalId uint32, t *natty.Traversal) {
+	conn, err := t.DialTCP()
+	if err != nil {
+		fail(EXIT_TRAVERSAL_FAILED, traversalId, "Unable to dial TCP: %s", err)
+	}
+	defer conn.Close()
+	log.Printf("Connected to server over TCP from %s to %s", conn.LocalAddr(), conn.RemoteAddr())
+
+	ticker := time.NewTicker(helloInterval)
+	defer ticker.Stop()
+	for seq := 1; ; seq++ {
+		<-ticker.C
+		msg := fmt.Sprintf("Hello #%d from %s to %s", seq, conn.LocalAddr(), conn.RemoteAddr())
+		log.Printf("Sending TCP message: %s", msg)
+		_, err := conn.Write([]byte(msg + "\n"))
+		if err != nil {
+			log.Printf("Unable to write to TCP: %s", err)
+			return
+		}
+	}
+}
+
+// readTCP tells the client that we're listening on l, accepts its connection
+// and logs what it sends.
+func readTCP(peerId waddell.PeerId, traversalId uint32, l *net.TCPListener, trace *sessionTrace) {
+	defer l.Close()
+	log.Printf("Listening for TCP connections at: %s", l.Addr())
+	err := notifyClientOfServerReady(peerId, traversalId, nil)
+	if err != nil {
+		log.Printf("Abandoning traversal %d: %s", traversalId, err)
+		trace.timing(fmt.Sprintf("READY handshake failed: %s", err))
+		trace.close()
+		return
+	}
+	trace.timing("client acknowledged READY")
+	trace.close()
+
+	l.SetDeadline(time.Now().Add(readyTimeout))
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		log.Printf("Client didn't connect over TCP for traversal %d: %s", traversalId, err)
+		return
+	}
+	defer conn.Close()
+
+	lines := bufio.NewScanner(conn)
+	for lines.Scan() {
+		log.Printf("Got TCP message from %s: '%s'", conn.RemoteAddr(), lines.Text())
+	}
+	log.Printf("Done reading from TCP for traversal %d: %v", traversalId, lines.Err())
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getlantern/go-natty/natty"
+)
+
+// This file formats the library's timing breakdown of a traversal, so that
+// users comparing networks can see where the time goes.
+
+const (
+	phaseStarting     = "starting"
+	phaseGathering    = "gathering"
+	phasePeerWait     = "waiting for peer"
+	phaseChecks       = "checks"
+	phaseVerification = "verification"
+)
+
+// timingsReport is the timing breakdown included in -json output.
+type timingsReport struct {
+	ProcessStartMs int64 `json:"processStartMs"`
+	GatheringMs    int64 `json:"gatheringMs"`
+	PeerWaitMs     int64 `json:"peerWaitMs"`
+	ChecksMs       int64 `json:"checksMs"`
+	TotalMs        int64 `json:"totalMs"`
+}
+
+func newTimingsReport(tm natty.Timings) *timingsReport {
+	return &timingsReport{
+		ProcessStartMs: int64(tm.ProcessStart / time.Millisecond),
+		GatheringMs:    int64(tm.Gathering / time.Millisecond),
+		PeerWaitMs:     int64(tm.PeerWait / time.Millisecond),
+		ChecksMs:       int64(tm.Checks / time.Millisecond),
+		TotalMs:        int64(tm.Total / time.Millisecond),
+	}
+}
+
+// phaseReached determines the phase that a traversal reached from its timings.
+func phaseReached(tm natty.Timings) string {
+	switch {
+	case tm.ProcessStart == 0:
+		return phaseStarting
+	case tm.Gathering == 0:
+		return phaseGathering
+	case tm.PeerWait == 0:
+		return phasePeerWait
+	case tm.Checks == 0:
+		return phaseChecks
+	}
+	return phaseVerification
+}
+
+// formatBreakdown formats the timing breakdown of a successful traversal as a
+// compact block.
+func formatBreakdown(traversalId uint32, stats *natty.Stats, verified bool) string {
+	tm := stats.Timings
+	lines := []string{
+		fmt.Sprintf("Traversal %d connected in %s", traversalId, ms(tm.Total)),
+		fmt.Sprintf("  process start  %s", ms(tm.ProcessStart)),
+		fmt.Sprintf("  gathering      %s", ms(tm.Gathering)),
+		fmt.Sprintf("  peer wait      %s", ms(tm.PeerWait)),
+		fmt.Sprintf("  checks         %s", ms(tm.Checks)),
+		fmt.Sprintf("  pair           %s -> %s", orUnknown(stats.LocalType), orUnknown(stats.RemoteType)),
+		fmt.Sprintf("  verified       %s", yesNo(verified)),
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatFailure formats a one-line description of a failed traversal.
+func formatFailure(traversalId uint32, stats *natty.Stats, phase string, code int, err error) string {
+	return fmt.Sprintf("Traversal %d failed during %s after %s (class=%s): %s", traversalId, phase, ms(stats.Timings.Total), exitClasses[code], err)
+}
+
+// sessionReportFor builds the -json report for a traversal.
+func sessionReportFor(traversalId uint32, stats *natty.Stats, verified bool, phase string, code int, err error) *sessionReport {
+	r := &sessionReport{
+		Traversal:  traversalId,
+		Path:       pathPunched,
+		LocalType:  stats.LocalType,
+		RemoteType: stats.RemoteType,
+		Timings:    newTimingsReport(stats.Timings),
+		Verified:   &verified,
+	}
+	if err != nil {
+		r.Path = pathFailed
+		r.Phase = phase
+		r.Class = exitClasses[code]
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func ms(d time.Duration) time.Duration {
+	return d / time.Millisecond * time.Millisecond
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/go-natty/natty"
+	"github.com/getlantern/testify/assert"
+)
+
+var successStats = &natty.Stats{
+	LocalType:  "srflx",
+	RemoteType: "host",
+	Timings: natty.Timings{
+		ProcessStart: 120*time.Millisecond + 300*time.Microsecond,
+		Gathering:    800 * time.Millisecond,
+		PeerWait:     1100 * time.Millisecond,
+		Checks:       1300 * time.Millisecond,
+		Total:        2310 * time.Millisecond,
+	},
+}
+
+func TestFormatBreakdown(t *testing.T) {
+	assert.Equal(t, `Traversal 1234 connected in 2.31s
+  process start  120ms
+  gathering      800ms
+  peer wait      1.1s
+  checks         1.3s
+  pair           srflx -> host
+  verified       yes`, formatBreakdown(1234, successStats, true))
+}
+
+func TestFormatFailure(t *testing.T) {
+	stats := &natty.Stats{Timings: natty.Timings{
+		ProcessStart: 100 * time.Millisecond,
+		Gathering:    800 * time.Millisecond,
+		Total:        15 * time.Second,
+	}}
+	phase := phaseReached(stats.Timings)
+	assert.Equal(t, phasePeerWait, phase)
+	assert.Equal(t, "Traversal 1234 failed during waiting for peer after 15s (class=traversal): Timed out waiting for five-tuple",
+		formatFailure(1234, stats, phase, EXIT_TRAVERSAL_FAILED, errors.New("Timed out waiting for five-tuple")))
+
+	assert.Equal(t, phaseStarting, phaseReached(natty.Timings{}))
+	assert.Equal(t, phaseGathering, phaseReached(natty.Timings{ProcessStart: 1}))
+	assert.Equal(t, phaseChecks, phaseReached(natty.Timings{ProcessStart: 1, Gathering: 1, PeerWait: 1}))
+	assert.Equal(t, phaseVerification, phaseReached(successStats.Timings))
+}
+
+func TestSessionReportJSON(t *testing.T) {
+	r := sessionReportFor(1234, successStats, true, "", 0, nil)
+	assert.Equal(t, `{"traversal":1234,"path":"punched","localType":"srflx","remoteType":"host","timings":{"processStartMs":120,"gatheringMs":800,"peerWaitMs":1100,"checksMs":1300,"totalMs":2310},"verified":true}`, reportJSON(t, r))
+
+	r = sessionReportFor(1234, &natty.Stats{Timings: natty.Timings{ProcessStart: 100 * time.Millisecond}}, false, phaseGathering, EXIT_TRAVERSAL_FAILED, errors.New("Timed out"))
+	assert.Equal(t, `{"traversal":1234,"path":"failed","timings":{"processStartMs":100,"gatheringMs":0,"peerWaitMs":0,"checksMs":0,"totalMs":0},"verified":false,"phase":"gathering","class":"traversal","error":"Timed out"}`, reportJSON(t, r))
+}
+
+// reportJSON captures what r.report() prints with -json.
+func reportJSON(t *testing.T, r *sessionReport) string {
+	orig, origJSON := os.Stdout, *jsonOut
+	defer func() { os.Stdout, *jsonOut = orig, origJSON }()
+	*jsonOut = true
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unable to pipe: %s", err)
+	}
+	os.Stdout = pw
+	r.report()
+	pw.Close()
+	out := &bytes.Buffer{}
+	io.Copy(out, pr)
+	var parsed map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &parsed), "Report should be valid JSON")
+	return string(bytes.TrimSpace(out.Bytes()))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements per-session trace files, which contain natty's debug
+// output for a single traversal along with the signaling transcript and
+// timings, so that one misbehaving session can be debugged on a busy server.
+
+const (
+	traceSuffix     = ".trace"
+	tracePruneEvery = 1 * time.Hour
+)
+
+var (
+	traceDir       = flag.String("trace-dir", "", "Directory in which to write a trace file per session, containing natty's debug output, the signaling transcript and timings")
+	traceSample    = flag.Float64("trace-sample", 1, "Fraction of sessions (0 to 1) for which to write trace files with -trace-dir")
+	traceRetention = flag.Duration("trace-retention", 24*time.Hour, "How long to keep trace files in -trace-dir before deleting them")
+)
+
+// sessionTrace is the trace file for a single session. All methods are safe to
+// call on a nil sessionTrace, which does nothing.
+type sessionTrace struct {
+	file  *os.File
+	start time.Time
+	mutex sync.Mutex
+}
+
+// newSessionTrace creates the trace file for the given session in dir, if the
+// session is sampled. It returns nil if dir is empty, the session isn't sampled
+// or the file can't be created.
+func newSessionTrace(dir string, sample float64, sessionId uint32) *sessionTrace {
+	if dir == "" || rand.Float64() >= sample {
+		return nil
+	}
+	start := time.Now()
+	name := fmt.Sprintf("%d-%s%s", sessionId, start.UTC().Format("20060102T150405.000Z"), traceSuffix)
+	path := filepath.Join(dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		log.Printf("Unable to create trace file for session %d: %s", sessionId, err)
+		return nil
+	}
+	log.Printf("Tracing session %d to %s", sessionId, path)
+	return &sessionTrace{file: file, start: start}
+}
+
+// Write writes natty's debug output to the trace.
+func (t *sessionTrace) Write(b []byte) (int, error) {
+	if t == nil {
+		return len(b), nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.file.Write(b)
+}
+
+// transcript records a signaling message sent (out) or received (not out).
+func (t *sessionTrace) transcript(out bool, msg string) {
+	direction := "<"
+	if out {
+		direction = ">"
+	}
+	t.printf("%s %s", direction, strings.TrimSpace(msg))
+}
+
+// timing records that the given event happened.
+func (t *sessionTrace) timing(event string) {
+	t.printf("timing: %s", event)
+}
+
+func (t *sessionTrace) printf(msg string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	fmt.Fprintf(t.file, "+%.3fs %s\n", time.Now().Sub(t.start).Seconds(), fmt.Sprintf(msg, args...))
+}
+
+func (t *sessionTrace) close() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.file.Close()
+}
+
+// pruneTracesPeriodically deletes trace files older than retention from dir
+// until the process exits.
+func pruneTracesPeriodically(dir string, retention time.Duration) {
+	for {
+		pruneTraces(dir, retention)
+		time.Sleep(tracePruneEvery)
+	}
+}
+
+// pruneTraces deletes trace files older than retention from dir.
+func pruneTraces(dir string, retention time.Duration) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("Unable to list trace files in %s: %s", dir, err)
+		return
+	}
+	cutoff := time.Now().Add(-1 * retention)
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), traceSuffix) || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		err := os.Remove(filepath.Join(dir, info.Name()))
+		if err != nil {
+			log.Printf("Unable to delete old trace file %s: %s", info.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestSessionTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, sessionId := range []uint32{1, 2} {
+		trace := newSessionTrace(dir, 1, sessionId)
+		if !assert.NotNil(t, trace, "Sampled session should be traced") {
+			return
+		}
+		trace.timing("offering")
+		trace.transcript(true, `{"type":"offer"}`+"\n")
+		trace.Write([]byte("natty debug output\n"))
+		trace.transcript(false, `{"type":"answer"}`)
+		trace.close()
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+traceSuffix))
+	if err != nil {
+		t.Fatalf("Unable to list trace files: %s", err)
+	}
+	if !assert.Len(t, files, 2, "Should have one trace file per session") {
+		return
+	}
+	assert.True(t, strings.HasPrefix(filepath.Base(files[0]), "1-"), "Trace file should be named by session id")
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Unable to read trace file: %s", err)
+	}
+	contents := string(b)
+	assert.Contains(t, contents, "s timing: offering\n")
+	assert.Contains(t, contents, `s > {"type":"offer"}`+"\n")
+	assert.Contains(t, contents, "natty debug output\n")
+	assert.Contains(t, contents, `s < {"type":"answer"}`+"\n")
+
+	assert.Nil(t, newSessionTrace(dir, 0, 3), "Unsampled session shouldn't be traced")
+	assert.Nil(t, newSessionTrace("", 1, 3), "Session shouldn't be traced without -trace-dir")
+	var untraced *sessionTrace
+	untraced.timing("nothing")
+	untraced.close()
+}
+
+func TestPruneTraces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "1-old"+traceSuffix)
+	recent := filepath.Join(dir, "2-recent"+traceSuffix)
+	other := filepath.Join(dir, "unrelated.txt")
+	for _, path := range []string{old, recent, other} {
+		err := ioutil.WriteFile(path, []byte("trace"), 0644)
+		if err != nil {
+			t.Fatalf("Unable to write %s: %s", path, err)
+		}
+	}
+	longAgo := time.Now().Add(-48 * time.Hour)
+	for _, path := range []string{old, other} {
+		err := os.Chtimes(path, longAgo, longAgo)
+		if err != nil {
+			t.Fatalf("Unable to age %s: %s", path, err)
+		}
+	}
+
+	pruneTraces(dir, 24*time.Hour)
+	_, err = os.Stat(old)
+	assert.True(t, os.IsNotExist(err), "Old trace file should have been pruned")
+	_, err = os.Stat(recent)
+	assert.NoError(t, err, "Recent trace file should have been kept")
+	_, err = os.Stat(other)
+	assert.NoError(t, err, "Non-trace file should have been kept")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"github.com/getlantern/go-natty/natty"
+)
+
+// tunnel is an established UDP path to the peer. Keepalives are sent over the
+// tunnel to keep it open and are filtered out of what's read from it.
+type tunnel struct {
+	conn      *net.UDPConn
+	remote    *net.UDPAddr // nil if conn is connected
+	keeper    *natty.ConnKeeper
+	dead      chan interface{}
+	closeOnce sync.Once
+}
+
+// newTunnel starts keeping the given conn alive. If remote is nil, conn must be
+// connected. If the peer (described by peerName) stops responding to
+// keepalives, the tunnel is closed and its dead channel is closed.
+func newTunnel(conn *net.UDPConn, remote *net.UDPAddr, peerName string) *tunnel {
+	t := &tunnel{
+		conn:   conn,
+		remote: remote,
+		dead:   make(chan interface{}),
+	}
+	t.keeper = natty.NewConnKeeper(conn, remote, *keepAlive, func() {
+		log.Printf("%s stopped responding to keepalives", peerName)
+		t.close()
+	})
+	return t
+}
+
+// write writes a packet to the peer.
+func (t *tunnel) write(b []byte) error {
+	if t.remote == nil {
+		_, err := t.conn.Write(b)
+		return err
+	}
+	_, err := t.conn.WriteToUDP(b, t.remote)
+	return err
+}
+
+// read reads the next packet that isn't a keepalive from the peer.
+func (t *tunnel) read(b []byte) (int, error) {
+	for {
+		n, _, err := t.conn.ReadFromUDP(b)
+		if err != nil {
+			return 0, err
+		}
+		t.keeper.Received()
+		if natty.IsKeepAlive(b[:n]) {
+			// Keepalives only prove that the peer is still there, they're not
+			// part of the traffic.
+			continue
+		}
+		return n, nil
+	}
+}
+
+// close closes the tunnel, which unblocks any pending reads.
+func (t *tunnel) close() {
+	t.closeOnce.Do(func() {
+		t.keeper.Stop()
+		t.conn.Close()
+		close(t.dead)
+	})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// This file implements a simple reliable file transfer over a tunnel. The
+// receiver says hello, the sender describes the file, the receiver says from
+// which offset it wants the file (to resume partial transfers) and the sender
+// then streams the file using go-back-N with cumulative acks.
+
+const (
+	xferHello  = 'H' // receiver -> sender: hello
+	xferInfo   = 'I' // sender -> receiver: size, hash, name
+	xferOffset = 'O' // receiver -> sender: offset from which to send
+	xferData   = 'D' // sender -> receiver: offset, data
+	xferAck    = 'A' // receiver -> sender: offset up to which data was received
+
+	xferChunkSize  = 1024
+	xferWindow     = 64
+	xferRetransmit = 200 * time.Millisecond
+	xferDupAcks    = 3
+	xferTimeout    = 30 * time.Second
+
+	partSuffix = ".part"
+)
+
+// verificationError indicates that a transfer completed but the received file
+// didn't match the sender's hash.
+type verificationError struct {
+	path string
+}
+
+func (e *verificationError) Error() string {
+	return fmt.Sprintf("Hash of %s doesn't match sender's hash", e.path)
+}
+
+// fileInfo describes the file being transferred.
+type fileInfo struct {
+	size uint64
+	hash []byte
+	name string
+}
+
+func (fi *fileInfo) encode() []byte {
+	b := make([]byte, 9, 9+sha256.Size+len(fi.name))
+	b[0] = xferInfo
+	binary.BigEndian.PutUint64(b[1:], fi.size)
+	b = append(b, fi.hash...)
+	return append(b, fi.name...)
+}
+
+func decodeFileInfo(b []byte) (*fileInfo, error) {
+	if len(b) < 9+sha256.Size {
+		return nil, fmt.Errorf("File info too short")
+	}
+	return &fileInfo{
+		size: binary.BigEndian.Uint64(b[1:]),
+		hash: b[9 : 9+sha256.Size],
+		// Never let the sender choose where we write
+		name: filepath.Base(string(b[9+sha256.Size:])),
+	}, nil
+}
+
+func offsetPacket(packetType byte, offset uint64) []byte {
+	b := make([]byte, 9)
+	b[0] = packetType
+	binary.BigEndian.PutUint64(b[1:], offset)
+	return b
+}
+
+// packets reads packets from the tunnel on a goroutine, so that they can be
+// received with a timeout. Packets are copied, so the channel's consumer owns
+// them.
+func packets(tun *tunnel) <-chan []byte {
+	ch := make(chan []byte, xferWindow)
+	go func() {
+		defer close(ch)
+		b := make([]byte, MAX_MESSAGE_SIZE)
+		for {
+			n, err := tun.read(b)
+			if err != nil {
+				return
+			}
+			if n > 0 {
+				ch <- append([]byte{}, b[:n]...)
+			}
+		}
+	}()
+	return ch
+}
+
+// sendFile sends the file at path to the receiver on the other end of the
+// tunnel.
+func sendFile(tun *tunnel, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return fmt.Errorf("Unable to hash %s: %s", path, err)
+	}
+	info := (&fileInfo{
+		size: uint64(size),
+		hash: hasher.Sum(nil),
+		name: filepath.Base(path),
+	}).encode()
+
+	in := packets(tun)
+	progress := newProgress("Sending "+filepath.Base(path), uint64(size))
+	var base, next uint64
+	dupAcks := 0
+	started := false
+	chunk := make([]byte, xferChunkSize)
+	lastProgress := time.Now()
+	for {
+		// Fill the window
+		for started && next < uint64(size) && next < base+xferWindow*xferChunkSize {
+			n, err := file.ReadAt(chunk, int64(next))
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("Unable to read %s: %s", path, err)
+			}
+			data := append(offsetPacket(xferData, next), chunk[:n]...)
+			err = tun.write(data)
+			if err != nil {
+				return fmt.Errorf("Unable to send data: %s", err)
+			}
+			next += uint64(n)
+		}
+
+		select {
+		case <-tun.dead:
+			return fmt.Errorf("Receiver went away")
+		case packet, ok := <-in:
+			if !ok {
+				return fmt.Errorf("Tunnel closed")
+			}
+			switch packet[0] {
+			case xferHello:
+				err = tun.write(info)
+			case xferOffset, xferAck:
+				if len(packet) < 9 {
+					continue
+				}
+				offset := binary.BigEndian.Uint64(packet[1:])
+				if packet[0] == xferOffset && !started {
+					started = true
+					base, next = offset, offset
+				} else if offset > base {
+					base = offset
+					dupAcks = 0
+				} else if packet[0] == xferAck && offset == base {
+					// The receiver is missing data at base, resend from there
+					// without waiting for the retransmit timer
+					dupAcks++
+					if dupAcks == xferDupAcks {
+						next = base
+					}
+				}
+				lastProgress = time.Now()
+				progress.update(base)
+				if started && base >= uint64(size) {
+					progress.done()
+					return nil
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("Unable to respond to receiver: %s", err)
+			}
+		case <-time.After(xferRetransmit):
+			if time.Now().Sub(lastProgress) > xferTimeout {
+				return fmt.Errorf("Timed out waiting for receiver")
+			}
+			// Go back to the last acknowledged offset
+			next = base
+		}
+	}
+}
+
+// receiveFile receives a file from the sender on the other end of the tunnel
+// into dir. If a partial file from an earlier attempt exists, the transfer
+// resumes from where that left off. receiveFile returns the path of the
+// received file.
+func receiveFile(tun *tunnel, dir string) (string, error) {
+	in := packets(tun)
+
+	// Say hello until we get the file info
+	var info *fileInfo
+	deadline := time.Now().Add(xferTimeout)
+	for info == nil {
+		err := tun.write([]byte{xferHello})
+		if err != nil {
+			return "", fmt.Errorf("Unable to contact sender: %s", err)
+		}
+		packet, err := nextPacket(tun, in, deadline)
+		if err != nil {
+			return "", err
+		}
+		if packet == nil || packet[0] != xferInfo {
+			continue
+		}
+		info, err = decodeFileInfo(packet)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	path := filepath.Join(dir, info.name)
+	partPath := path + partSuffix
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := uint64(stat.Size())
+	if offset > info.size {
+		offset = 0
+	}
+	if offset > 0 {
+		fmt.Fprintf(os.Stderr, "Resuming %s from %d bytes\n", info.name, offset)
+	}
+
+	progress := newProgress("Receiving "+info.name, info.size)
+	progress.update(offset)
+	err = tun.write(offsetPacket(xferOffset, offset))
+	if err != nil {
+		return "", fmt.Errorf("Unable to request data: %s", err)
+	}
+	lastProgress := time.Now()
+	for offset < info.size {
+		packet, err := nextPacket(tun, in, lastProgress.Add(xferTimeout))
+		if err != nil {
+			return "", err
+		}
+		if packet == nil {
+			// Nothing received for a while, remind the sender where we are
+			err = tun.write(offsetPacket(xferOffset, offset))
+		} else if packet[0] == xferData && len(packet) >= 9 {
+			if binary.BigEndian.Uint64(packet[1:]) == offset {
+				n, err := file.WriteAt(packet[9:], int64(offset))
+				if err != nil {
+					return "", fmt.Errorf("Unable to write %s: %s", partPath, err)
+				}
+				offset += uint64(n)
+				lastProgress = time.Now()
+				progress.update(offset)
+			}
+			err = tun.write(offsetPacket(xferAck, offset))
+		}
+		if err != nil {
+			return "", fmt.Errorf("Unable to acknowledge data: %s", err)
+		}
+	}
+	// Let the sender know that we're done, in case earlier acks were lost
+	for i := 0; i < 3; i++ {
+		tun.write(offsetPacket(xferAck, offset))
+	}
+	progress.done()
+
+	err = file.Truncate(int64(info.size))
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, io.NewSectionReader(file, 0, int64(info.size)))
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	if !bytes.Equal(hasher.Sum(nil), info.hash) {
+		// Start from scratch next time
+		os.Remove(partPath)
+		return "", &verificationError{path}
+	}
+	return path, os.Rename(partPath, path)
+}
+
+// nextPacket waits for the next packet, returning nil if none arrives within
+// xferRetransmit and an error if the deadline passes or the tunnel dies.
+func nextPacket(tun *tunnel, in <-chan []byte, deadline time.Time) ([]byte, error) {
+	if time.Now().After(deadline) {
+		return nil, fmt.Errorf("Timed out waiting for sender")
+	}
+	select {
+	case <-tun.dead:
+		return nil, fmt.Errorf("Sender went away")
+	case packet, ok := <-in:
+		if !ok {
+			return nil, fmt.Errorf("Tunnel closed")
+		}
+		return packet, nil
+	case <-time.After(xferRetransmit):
+		return nil, nil
+	}
+}
+
+// progress prints a progress bar to stderr.
+type progress struct {
+	label       string
+	total       uint64
+	lastPrinted time.Time
+}
+
+func newProgress(label string, total uint64) *progress {
+	return &progress{label: label, total: total}
+}
+
+func (p *progress) update(current uint64) {
+	if time.Now().Sub(p.lastPrinted) < 100*time.Millisecond {
+		return
+	}
+	p.lastPrinted = time.Now()
+	p.print(current)
+}
+
+func (p *progress) done() {
+	p.print(p.total)
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progress) print(current uint64) {
+	const width = 40
+	fraction := 1.0
+	if p.total > 0 {
+		fraction = float64(current) / float64(p.total)
+	}
+	filled := int(fraction * width)
+	fmt.Fprintf(os.Stderr, "\r%s [%s%s] %3.0f%% %d/%d bytes", p.label, bytes.Repeat([]byte("#"), filled), bytes.Repeat([]byte(" "), width-filled), fraction*100, current, p.total)
+}
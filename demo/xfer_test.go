@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+const (
+	testFileSize = 2 * 1024 * 1024
+	testLossRate = 0.05
+)
+
+func TestTransfer(t *testing.T) {
+	data, src, dst := prepareTransfer(t)
+	defer os.RemoveAll(filepath.Dir(src))
+	defer os.RemoveAll(dst)
+
+	path, err := transfer(t, src, dst)
+	if assert.NoError(t, err, "Transfer should succeed") {
+		assertReceived(t, data, path)
+	}
+}
+
+func TestTransferResume(t *testing.T) {
+	data, src, dst := prepareTransfer(t)
+	defer os.RemoveAll(filepath.Dir(src))
+	defer os.RemoveAll(dst)
+
+	partPath := filepath.Join(dst, filepath.Base(src)+partSuffix)
+	err := ioutil.WriteFile(partPath, data[:testFileSize/2], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := transfer(t, src, dst)
+	if assert.NoError(t, err, "Resumed transfer should succeed") {
+		assertReceived(t, data, path)
+	}
+}
+
+func TestTransferVerification(t *testing.T) {
+	data, src, dst := prepareTransfer(t)
+	defer os.RemoveAll(filepath.Dir(src))
+	defer os.RemoveAll(dst)
+
+	// A corrupt partial file can only be detected by the hash
+	partPath := filepath.Join(dst, filepath.Base(src)+partSuffix)
+	corrupt := append([]byte{}, data[:testFileSize/2]...)
+	corrupt[0]++
+	err := ioutil.WriteFile(partPath, corrupt, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = transfer(t, src, dst)
+	_, ok := err.(*verificationError)
+	assert.True(t, ok, "Transfer should fail verification")
+	_, err = os.Stat(partPath)
+	assert.True(t, os.IsNotExist(err), "Corrupt partial file should be removed")
+}
+
+func prepareTransfer(t *testing.T) (data []byte, src string, dst string) {
+	srcDir, err := ioutil.TempDir("", "xfer-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err = ioutil.TempDir("", "xfer-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = make([]byte, testFileSize)
+	_, err = rand.Read(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src = filepath.Join(srcDir, "file.bin")
+	err = ioutil.WriteFile(src, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func assertReceived(t *testing.T, data []byte, path string) {
+	received, err := ioutil.ReadFile(path)
+	if assert.NoError(t, err, "Should be able to read received file") {
+		assert.True(t, bytes.Equal(data, received), "Received file should match sent file")
+	}
+}
+
+// transfer sends src to dst through a lossy shim.
+func transfer(t *testing.T, src string, dst string) (string, error) {
+	senderTun, receiverTun, closeShim := lossyTunnels(t, testLossRate)
+	defer closeShim()
+	defer senderTun.close()
+	defer receiverTun.close()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- sendFile(senderTun, src)
+	}()
+	path, err := receiveFile(receiverTun, dst)
+	if err == nil {
+		assert.NoError(t, <-sendErr, "Sending should succeed")
+	}
+	return path, err
+}
+
+// lossyTunnels creates a pair of tunnels connected via a shim that randomly
+// drops packets in both directions.
+func lossyTunnels(t *testing.T, lossRate float64) (*tunnel, *tunnel, func()) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Unable to listen: %s", err)
+		}
+		return conn
+	}
+	dial := func(to *net.UDPConn) *net.UDPConn {
+		conn, err := net.DialUDP("udp", nil, to.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("Unable to dial: %s", err)
+		}
+		return conn
+	}
+
+	shimA := listen()
+	shimB := listen()
+	a := dial(shimA)
+	b := dial(shimB)
+
+	relay := func(from *net.UDPConn, to *net.UDPConn, dest *net.UDPAddr) {
+		buf := make([]byte, MAX_MESSAGE_SIZE)
+		for {
+			n, _, err := from.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if mrand.Float64() < lossRate {
+				continue
+			}
+			to.WriteToUDP(buf[:n], dest)
+		}
+	}
+	go relay(shimA, shimB, b.LocalAddr().(*net.UDPAddr))
+	go relay(shimB, shimA, a.LocalAddr().(*net.UDPAddr))
+
+	return newTunnel(a, nil, "b"), newTunnel(b, nil, "a"), func() {
+		shimA.Close()
+		shimB.Close()
+	}
+}
@@ -0,0 +1,143 @@
+package natty
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var (
+	binaryPath      string       // if set, natty executable to use instead of the embedded one
+	binaryPathMutex sync.RWMutex // synchronizes access to binaryPath
+
+	// helpTimeout is how long natty -help gets to list natty's flags.
+	helpTimeout = 5 * time.Second
+
+	nattyFlags      = make(map[string]*flagProbe) // flags that natty executables accept, by path
+	nattyFlagsMutex sync.Mutex                    // synchronizes access to nattyFlags
+
+	// helpFlagPattern matches the flags listed by natty -help, like
+	// "  --stuns (List of STUN servers ...)  type: string ..."
+	helpFlagPattern = regexp.MustCompile(`(?m)^\s+--?([A-Za-z0-9_-]+) `)
+)
+
+// SetBinaryPath makes Traversals run the natty executable at the given path
+// instead of the one embedded in this package, unless they're given
+// WithBinary. A path without a separator is looked up in $PATH. An empty path
+// restores the embedded executable.
+func SetBinaryPath(path string) {
+	binaryPathMutex.Lock()
+	binaryPath = path
+	binaryPathMutex.Unlock()
+}
+
+func getBinaryPath() string {
+	binaryPathMutex.RLock()
+	defer binaryPathMutex.RUnlock()
+	return binaryPath
+}
+
+// nattyCommand returns the command that runs natty with the given params. If
+// the configured executable doesn't exist or isn't executable, the Traversal
+// fails with an error that unwraps to ErrBinaryNotFound.
+func (t *Traversal) nattyCommand(params []string) (*exec.Cmd, error) {
+	path := t.binaryPath
+	if path == "" {
+		path = getBinaryPath()
+	}
+	if path == "" {
+		return nattybe.Command(params...), nil
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, &kindError{fmt.Sprintf("Unable to use natty executable %s: %s", path, err), ErrBinaryNotFound}
+	}
+	return exec.Command(resolved, params...), nil
+}
+
+// flagProbe is the listing of the flags that a natty executable accepts, which
+// Traversals that need it while it's running wait for.
+type flagProbe struct {
+	done  chan struct{} // closed once flags is set
+	flags map[string]bool
+}
+
+// nattySupports tells whether the natty executable that the Traversal runs
+// accepts the given flag, as listed by its -help, which runs once per
+// executable, however many Traversals start at the same time. If listing the
+// flags fails, it's taken to accept none, and the next Traversal tries again.
+func (t *Traversal) nattySupports(flag string) (bool, error) {
+	cmd, err := t.nattyCommand([]string{"-help"})
+	if err != nil {
+		return false, err
+	}
+	nattyFlagsMutex.Lock()
+	probe, found := nattyFlags[cmd.Path]
+	if found {
+		nattyFlagsMutex.Unlock()
+		<-probe.done
+		return probe.flags[flag], nil
+	}
+	probe = &flagProbe{done: make(chan struct{})}
+	nattyFlags[cmd.Path] = probe
+	nattyFlagsMutex.Unlock()
+
+	flags, err := listFlags(cmd)
+	if err != nil {
+		t.log().Tracef("Unable to list flags of natty executable %s, assuming none: %s", cmd.Path, err)
+		nattyFlagsMutex.Lock()
+		delete(nattyFlags, cmd.Path)
+		nattyFlagsMutex.Unlock()
+	}
+	probe.flags = flags
+	close(probe.done)
+	return flags[flag], nil
+}
+
+// listFlags runs cmd, natty -help, and returns the flags that it lists.
+func listFlags(cmd *exec.Cmd) (map[string]bool, error) {
+	// natty may exit with an error after listing its flags, so only the output
+	// matters
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Start()
+	if err == nil {
+		timer := time.AfterFunc(helpTimeout, func() { cmd.Process.Kill() })
+		err = cmd.Wait()
+		timer.Stop()
+	}
+	flags := make(map[string]bool)
+	if err != nil && out.Len() == 0 {
+		return flags, err
+	}
+	for _, match := range helpFlagPattern.FindAllSubmatch(out.Bytes(), -1) {
+		flags[string(match[1])] = true
+	}
+	return flags, nil
+}
+
+// requireFlag fails with an error that unwraps to ErrUnsupportedOption if the
+// natty executable doesn't accept flag, which the given option needs.
+func (t *Traversal) requireFlag(option string, flag string) error {
+	supported, err := t.nattySupports(flag)
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return &kindError{fmt.Sprintf("Unable to use %s, as natty doesn't accept -%s", option, flag), ErrUnsupportedOption}
+	}
+	return nil
+}
+
+// appendFlag appends flag and its value to params, if the natty executable
+// accepts flag (see requireFlag).
+func (t *Traversal) appendFlag(params []string, option string, flag string, value string) ([]string, error) {
+	err := t.requireFlag(option, flag)
+	if err != nil {
+		return nil, err
+	}
+	return append(params, "-"+flag, value), nil
+}
@@ -0,0 +1,104 @@
+package natty
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestBinaryPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natty")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	notExecutable := filepath.Join(dir, "natty")
+	if !assert.NoError(t, ioutil.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0644)) {
+		return
+	}
+
+	tr := newTraversal(0, []Option{WithBinary(filepath.Join(dir, "missing"))})
+	err = tr.initCommand(nil)
+	assert.True(t, errors.Is(err, ErrBinaryNotFound), "Missing executable should fail the Traversal")
+	tr = newTraversal(0, []Option{WithBinary(notExecutable)})
+	assert.Error(t, tr.initCommand(nil), "File that isn't executable should fail the Traversal")
+
+	executable := filepath.Join(dir, "natty-exec")
+	if !assert.NoError(t, ioutil.WriteFile(executable, []byte("#!/bin/sh\n"), 0755)) {
+		return
+	}
+	SetBinaryPath(executable)
+	defer SetBinaryPath("")
+	tr = newTraversal(0, nil)
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.Equal(t, executable, tr.cmd.Path, "Package's binary path should be used")
+	}
+	tr = newTraversal(0, []Option{WithBinary(notExecutable)})
+	assert.Error(t, tr.initCommand(nil), "WithBinary should take precedence")
+}
+
+func TestNattySupports(t *testing.T) {
+	binary, remove := sleepingNatty(t)
+	defer remove()
+	tr := newTraversal(0, []Option{WithBinary(binary), WithSoftwareAttribute("my-app/1.0")})
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.Contains(t, strings.Join(tr.cmd.Args, " "), "-software my-app/1.0", "natty that accepts -software should get it")
+	}
+
+	binary, remove = scriptedNatty(t, "exec sleep 30", "debug", "offer", "stuns")
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(binary), WithSoftwareAttribute("my-app/1.0")})
+	assert.True(t, errors.Is(tr.initCommand(nil), ErrUnsupportedOption), "natty that doesn't accept -software should fail a Traversal that sets it")
+	tr = newTraversal(0, []Option{WithBinary(binary)})
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.False(t, strings.Contains(strings.Join(tr.cmd.Args, " "), "-software"), "natty that doesn't accept -software shouldn't get the default")
+	}
+	supported, err := tr.nattySupports("stuns")
+	assert.NoError(t, err)
+	assert.True(t, supported, "Listed flag should be supported")
+
+	_, err = tr.appendFlag(nil, "WithExample", "example", "1")
+	assert.True(t, errors.Is(err, ErrUnsupportedOption), "Unlisted flag should be unsupported")
+}
+
+func TestNattySupportsProbesOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "natty")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// Fails to list its flags the first time, and counts how often it's asked
+	probes, broken := filepath.Join(dir, "probes"), filepath.Join(dir, "broken")
+	script := "#!/bin/sh\necho probe >> " + probes + "\nif [ ! -e " + broken + " ]; then\n  touch " + broken + "\n  exit 1\nfi\n" +
+		"sleep 0.2\necho '  --stuns (Fake flag)  type: string  default: '\n"
+	binary := filepath.Join(dir, "natty")
+	err = ioutil.WriteFile(binary, []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("Unable to write natty: %s", err)
+	}
+	tr := newTraversal(0, []Option{WithBinary(binary)})
+
+	supported, err := tr.nattySupports("stuns")
+	assert.NoError(t, err)
+	assert.False(t, supported, "natty that fails to list its flags should be taken to accept none")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			supported, err := tr.nattySupports("stuns")
+			assert.NoError(t, err)
+			assert.True(t, supported, "Failing to list flags shouldn't stick")
+		}()
+	}
+	wg.Wait()
+	b, _ := ioutil.ReadFile(probes)
+	assert.Equal(t, 2, strings.Count(string(b), "probe"), "Concurrent Traversals should share a single -help")
+}
@@ -0,0 +1,11 @@
+package natty
+
+import (
+	"syscall"
+)
+
+const bindToDeviceSupported = true
+
+func bindToDevice(fd uintptr, device string) error {
+	return syscall.BindToDevice(int(fd), device)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package natty
+
+import (
+	"fmt"
+)
+
+const bindToDeviceSupported = false
+
+func bindToDevice(fd uintptr, device string) error {
+	return fmt.Errorf("Binding to a device is only supported on Linux")
+}
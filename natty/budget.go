@@ -0,0 +1,224 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SplitEven gives each attempt an even share of what's left of the
+	// Budget among it and the attempts that may follow it.
+	SplitEven = SplitPolicy(iota)
+
+	// SplitProportional gives each attempt a share of what's left of the
+	// Budget in proportion to its own timeout, compared to those of the
+	// attempts that may follow it.
+	SplitProportional
+
+	// SplitGreedy gives each attempt everything that's left of the Budget, up
+	// to its own timeout, leaving the attempts that follow whatever it
+	// doesn't use.
+	SplitGreedy
+)
+
+// SplitPolicy determines how a Budget is split among attempts.
+type SplitPolicy int
+
+// Budget is a single deadline for an operation made up of several attempts,
+// like a Connector's strategies, a PeerConnection's retries or a Dialer's
+// port mapping and traversal, which would otherwise each run for their own
+// timeout, stacking up to a long worst case. Every attempt draws a slice of
+// what's left of the Budget, as its SplitPolicy determines, and no more than
+// its own timeout. The high-level helpers find the Budget in the context that
+// ContextWithBudget returns, and give up once it's spent, failing with the
+// most informative error that an attempt failed with.
+type Budget struct {
+	total    time.Duration
+	split    SplitPolicy
+	start    time.Time
+	deadline time.Time
+	attempts []*BudgetAttempt
+	best     error
+	bestFull bool // whether best came from an attempt that used its full slice
+	mutex    sync.Mutex
+}
+
+// BudgetAttempt records how an attempt spent its slice of a Budget.
+type BudgetAttempt struct {
+	// Name identifies the attempt, for example "punch" or "traversal 2".
+	Name string
+
+	// Started is when the attempt started, relative to the start of the
+	// Budget.
+	Started time.Duration
+
+	// Allotted is the slice of the Budget that the attempt got.
+	Allotted time.Duration
+
+	// Elapsed is how long the attempt ran, 0 if it's still running.
+	Elapsed time.Duration
+
+	// Err is why the attempt failed, nil if it succeeded or is still running.
+	Err error
+}
+
+func (a *BudgetAttempt) String() string {
+	if a.Err != nil {
+		return fmt.Sprintf("%s failed after %s of %s: %s", a.Name, a.Elapsed, a.Allotted, a.Err)
+	}
+	return fmt.Sprintf("%s took %s of %s", a.Name, a.Elapsed, a.Allotted)
+}
+
+// BudgetStats show how a Budget was spent.
+type BudgetStats struct {
+	// Total is the whole Budget.
+	Total time.Duration
+
+	// Spent is how much of it has been used.
+	Spent time.Duration
+
+	// Attempts are the attempts that drew from the Budget, in the order that
+	// they started.
+	Attempts []*BudgetAttempt
+}
+
+func (s *BudgetStats) String() string {
+	attempts := make([]string, 0, len(s.Attempts))
+	for _, a := range s.Attempts {
+		attempts = append(attempts, a.String())
+	}
+	return fmt.Sprintf("Spent %s of %s (%s)", s.Spent, s.Total, strings.Join(attempts, ", "))
+}
+
+// NewBudget creates a Budget of total, starting now, that's split among
+// attempts per split.
+func NewBudget(total time.Duration, split SplitPolicy) *Budget {
+	now := time.Now()
+	return &Budget{total: total, split: split, start: now, deadline: now.Add(total)}
+}
+
+type budgetKey struct{}
+
+// ContextWithBudget returns a copy of ctx carrying the given Budget, which is
+// done once the Budget is spent. Pass it to Connector.Connect,
+// PeerConnection.Connect or Dialer.DialContext to have all of their attempts
+// draw from the Budget.
+func ContextWithBudget(ctx context.Context, b *Budget) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithDeadline(ctx, b.deadline)
+	return context.WithValue(ctx, budgetKey{}, b), cancel
+}
+
+// budgetFrom returns the Budget carried by ctx, if any.
+func budgetFrom(ctx context.Context) *Budget {
+	b, _ := ctx.Value(budgetKey{}).(*Budget)
+	return b
+}
+
+// Remaining is how much of the Budget is left.
+func (b *Budget) Remaining() time.Duration {
+	remaining := time.Until(b.deadline)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Err returns the most informative error that an attempt failed with: the
+// latest one from an attempt that failed before its slice ran out, or else the
+// latest one overall.
+func (b *Budget) Err() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.best
+}
+
+// Stats returns a snapshot of how the Budget has been spent.
+func (b *Budget) Stats() *BudgetStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	spent := time.Since(b.start)
+	if spent > b.total {
+		spent = b.total
+	}
+	stats := &BudgetStats{Total: b.total, Spent: spent, Attempts: make([]*BudgetAttempt, 0, len(b.attempts))}
+	for _, a := range b.attempts {
+		copied := *a
+		stats.Attempts = append(stats.Attempts, &copied)
+	}
+	return stats
+}
+
+// exhaustedErr is the error with which an operation fails once its Budget is
+// spent.
+func (b *Budget) exhaustedErr() error {
+	if err := b.Err(); err != nil {
+		return fmt.Errorf("Budget of %s spent, last meaningful error: %s", b.total, err)
+	}
+	return fmt.Errorf("Budget of %s spent", b.total)
+}
+
+// allot returns the slice of what's left for an attempt that would take up to
+// timeout on its own (unlimited if 0), with rest being the timeouts of the
+// attempts that may follow it.
+func (b *Budget) allot(timeout time.Duration, rest []time.Duration) time.Duration {
+	remaining := b.Remaining()
+	slice := remaining
+	switch b.split {
+	case SplitEven:
+		slice = remaining / time.Duration(len(rest)+1)
+	case SplitProportional:
+		if timeout > 0 {
+			sum := timeout
+			for _, d := range rest {
+				sum += d
+			}
+			slice = time.Duration(float64(remaining) * float64(timeout) / float64(sum))
+		}
+	}
+	if timeout > 0 && slice > timeout {
+		slice = timeout
+	}
+	return slice
+}
+
+// begin starts an attempt, returning a context limited to its slice of the
+// Budget and a func to call with its outcome.
+func (b *Budget) begin(ctx context.Context, name string, timeout time.Duration, rest []time.Duration) (context.Context, func(err error)) {
+	b.mutex.Lock()
+	a := &BudgetAttempt{Name: name, Started: time.Since(b.start), Allotted: b.allot(timeout, rest)}
+	b.attempts = append(b.attempts, a)
+	b.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, a.Allotted)
+	return ctx, func(err error) {
+		full := ctx.Err() != nil
+		cancel()
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		a.Elapsed = time.Since(b.start) - a.Started
+		a.Err = err
+		if err != nil && (b.best == nil || !full || b.bestFull) {
+			b.best = err
+			b.bestFull = full
+		}
+	}
+}
+
+// allot starts an attempt of an operation that would take up to timeout on
+// its own, with rest being the timeouts of the attempts that may follow it.
+// If ctx carries a Budget, the attempt draws from it, otherwise it gets its
+// whole timeout (if set). It returns the attempt's context and a func to call
+// with its outcome.
+func allot(ctx context.Context, name string, timeout time.Duration, rest []time.Duration) (context.Context, func(err error)) {
+	if b := budgetFrom(ctx); b != nil {
+		return b.begin(ctx, name, timeout, rest)
+	}
+	if timeout <= 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, func(error) { cancel() }
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func(error) { cancel() }
+}
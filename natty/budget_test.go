@@ -0,0 +1,64 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestBudgetSplit(t *testing.T) {
+	rest := []time.Duration{time.Second, 2 * time.Second}
+	even := NewBudget(3*time.Second, SplitEven)
+	assert.True(t, even.allot(10*time.Second, rest) <= time.Second)
+	assert.True(t, even.allot(10*time.Second, rest) > 900*time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, even.allot(100*time.Millisecond, rest), "Attempt shouldn't get more than its own timeout")
+
+	proportional := NewBudget(4*time.Second, SplitProportional)
+	slice := proportional.allot(time.Second, []time.Duration{3 * time.Second})
+	assert.True(t, slice <= time.Second && slice > 900*time.Millisecond, fmt.Sprintf("Unexpected slice %s", slice))
+
+	greedy := NewBudget(3*time.Second, SplitGreedy)
+	assert.True(t, greedy.allot(0, rest) > 2900*time.Millisecond)
+}
+
+// TestConnectorBudget runs a Connector whose strategies' timeouts add up to
+// almost a minute within a budget of 2 seconds.
+func TestConnectorBudget(t *testing.T) {
+	c := &Connector{
+		attempt: func(ctx context.Context, s Strategy) (net.Conn, error) {
+			if s == StrategyPortMap {
+				return nil, fmt.Errorf("Gateway doesn't map ports")
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	assert.True(t, c.Policy.maxDuration() > 10*time.Second)
+
+	budget := NewBudget(2*time.Second, SplitEven)
+	ctx, cancel := ContextWithBudget(context.Background(), budget)
+	defer cancel()
+	start := time.Now()
+	_, _, err := c.Connect(ctx, "peer", newChanSignaler())
+	elapsed := time.Since(start)
+	assert.True(t, elapsed < 2500*time.Millisecond, fmt.Sprintf("Should have returned within budget, took %s", elapsed))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Gateway doesn't map ports", "Should report the most informative error")
+	}
+
+	stats := budget.Stats()
+	if assert.Len(t, stats.Attempts, 4, stats.String()) {
+		var elapsed time.Duration
+		for _, a := range stats.Attempts {
+			elapsed += a.Elapsed
+			assert.Error(t, a.Err)
+		}
+		assert.True(t, elapsed < 2100*time.Millisecond, fmt.Sprintf("Attempts overran the budget: %s", stats))
+		assert.True(t, stats.Attempts[0].Allotted <= 500*time.Millisecond, "Direct should get an even share")
+		assert.True(t, stats.Attempts[2].Allotted > stats.Attempts[0].Allotted, "Punch should get what portmap didn't use")
+	}
+}
@@ -0,0 +1,701 @@
+package natty
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the steps of the Connector's protocol
+	connectAsk    = "ask"    // offerer: do you have a public endpoint?
+	connectAdvert = "advert" // answerer: here it is (or not)
+	connectWon    = "won"    // offerer: I'm using this strategy
+
+	connectMarker = `"type":"connect"`
+)
+
+// Strategy is a way in which a Connector connects to a peer.
+type Strategy int
+
+const (
+	// StrategyDirect dials the public endpoint that the peer advertises, if
+	// it's not behind a NAT.
+	StrategyDirect Strategy = iota
+
+	// StrategyPortMap has our gateway map a port for the peer to connect to
+	// (see package portmap).
+	StrategyPortMap
+
+	// StrategyPunch punches a hole with an ICE traversal, rejecting relayed
+	// pairs.
+	StrategyPunch
+
+	// StrategyRelay runs an ICE traversal that may end up relayed.
+	StrategyRelay
+)
+
+var (
+	strategyNames = []string{"direct", "portmap", "punch", "relay"}
+
+	defaultStrategyOrder = []Strategy{StrategyDirect, StrategyPortMap, StrategyPunch, StrategyRelay}
+
+	defaultStrategyTimeouts = map[Strategy]time.Duration{
+		StrategyDirect:  3 * time.Second,
+		StrategyPortMap: 5 * time.Second,
+		StrategyPunch:   15 * time.Second,
+		StrategyRelay:   DefaultDialTimeout,
+	}
+)
+
+func (s Strategy) String() string {
+	if s < 0 || int(s) >= len(strategyNames) {
+		return fmt.Sprintf("strategy(%d)", int(s))
+	}
+	return strategyNames[s]
+}
+
+// strategyNamed returns the Strategy with the given name, if there is one.
+func strategyNamed(name string) (Strategy, bool) {
+	for i, n := range strategyNames {
+		if n == name {
+			return Strategy(i), true
+		}
+	}
+	return 0, false
+}
+
+// ConnectPolicy controls which strategies a Connector tries, in what order and
+// for how long.
+type ConnectPolicy struct {
+	// Order is the order in which to try strategies, direct, portmap, punch
+	// and then relay if empty. Strategies not listed aren't tried.
+	Order []Strategy
+
+	// Disabled are strategies not to try, even if listed in Order.
+	Disabled []Strategy
+
+	// Timeouts are how long each strategy gets to connect. Those not set
+	// default to 3 seconds for direct, 5 for portmap, 15 for punch and
+	// DefaultDialTimeout for relay.
+	Timeouts map[Strategy]time.Duration
+
+	// Stagger, if set, is how long to give a strategy before also starting
+	// the next one, rather than waiting for it to fail. Strategies that are
+	// still running once one connects are abandoned.
+	Stagger time.Duration
+}
+
+func (p *ConnectPolicy) permits(s Strategy) bool {
+	for _, disabled := range p.Disabled {
+		if s == disabled {
+			return false
+		}
+	}
+	return true
+}
+
+// strategies returns the permitted strategies in order.
+func (p *ConnectPolicy) strategies() []Strategy {
+	order := p.Order
+	if len(order) == 0 {
+		order = defaultStrategyOrder
+	}
+	strategies := make([]Strategy, 0, len(order))
+	for _, s := range order {
+		if p.permits(s) {
+			strategies = append(strategies, s)
+		}
+	}
+	return strategies
+}
+
+func (p *ConnectPolicy) timeout(s Strategy) time.Duration {
+	if timeout := p.Timeouts[s]; timeout > 0 {
+		return timeout
+	}
+	return defaultStrategyTimeouts[s]
+}
+
+// maxDuration is how long trying all strategies one after the other can take.
+func (p *ConnectPolicy) maxDuration() time.Duration {
+	var d time.Duration
+	for _, s := range p.strategies() {
+		d += p.timeout(s)
+	}
+	return d
+}
+
+// Attempt records how trying a strategy went.
+type Attempt struct {
+	Strategy Strategy
+
+	// Started is when the attempt started, relative to the start of Connect.
+	Started time.Duration
+
+	// Elapsed is how long the attempt took to connect or fail, or ran until
+	// it was abandoned.
+	Elapsed time.Duration
+
+	// Err is why the attempt failed, nil if it connected or was abandoned.
+	Err error
+
+	// Abandoned indicates that the attempt was cancelled because another
+	// strategy connected first.
+	Abandoned bool
+}
+
+func (a *Attempt) String() string {
+	switch {
+	case a.Abandoned:
+		return fmt.Sprintf("%s abandoned after %s", a.Strategy, a.Elapsed)
+	case a.Err != nil:
+		return fmt.Sprintf("%s failed after %s: %s", a.Strategy, a.Elapsed, a.Err)
+	}
+	return fmt.Sprintf("%s connected after %s", a.Strategy, a.Elapsed)
+}
+
+// ConnectResult describes how a Connector connected to a peer.
+type ConnectResult struct {
+	// Strategy is the strategy that connected.
+	Strategy Strategy
+
+	// Elapsed is how long it took to connect.
+	Elapsed time.Duration
+
+	// Attempts are the strategies tried, in the order that they started.
+	Attempts []*Attempt
+}
+
+func (r *ConnectResult) String() string {
+	attempts := make([]string, 0, len(r.Attempts))
+	for _, a := range r.Attempts {
+		attempts = append(attempts, a.String())
+	}
+	return fmt.Sprintf("Connected with %s after %s (%s)", r.Strategy, r.Elapsed, strings.Join(attempts, ", "))
+}
+
+// Connector connects to peers with whichever of several strategies works,
+// trying them in the order of its Policy: dialing the peer directly, through a
+// port that our gateway maps, by punching a hole with ICE and finally through
+// a relay. It remembers how each strategy went with each peer, so that later
+// connections to the same peer start with the strategy that has worked best.
+//
+// The peer accepts what a Connector connects with Accept, which needs a
+// Connector too, since it's the answering side that can offer a public
+// endpoint for the direct strategy. Both sides signal through the same
+// Signaler for all strategies, with the messages of the ICE traversals tagged
+// with the name of their strategy.
+type Connector struct {
+	// Policy controls which strategies to try, in what order and for how
+	// long.
+	Policy ConnectPolicy
+
+	// Options configure the Traversals of the punch and relay strategies.
+	Options []Option
+
+	// Public, if set, is a publicly reachable host:port on which Accept
+	// listens for the direct strategy, and advertises to the peer. Leave it
+	// empty when behind a NAT.
+	Public string
+
+	// History remembers how connecting to peers went. If nil, the Connector
+	// keeps its own.
+	History *PeerHistory
+
+	// attempt tries a strategy, by default for real
+	attempt func(ctx context.Context, s Strategy) (net.Conn, error)
+	mutex   sync.Mutex
+}
+
+// connectMsg is a message of the Connector's protocol.
+type connectMsg struct {
+	Type     string `json:"type"`
+	Step     string `json:"step"`
+	Strategy string `json:"strategy,omitempty"`
+	Address  string `json:"address,omitempty"`
+}
+
+// parseConnectMsg parses msg if it's a connectMsg.
+func parseConnectMsg(msg string) (*connectMsg, bool) {
+	if !strings.Contains(msg, connectMarker) {
+		return nil, false
+	}
+	cm := &connectMsg{}
+	if json.Unmarshal([]byte(msg), cm) != nil {
+		return nil, false
+	}
+	return cm, true
+}
+
+func sendConnectMsg(mux *signalMux, cm *connectMsg) {
+	cm.Type = "connect"
+	msg, _ := json.Marshal(cm)
+	mux.send(append(getMsgBuf(), msg...))
+}
+
+// strategyOutcome is the outcome of a strategy on either side.
+type strategyOutcome struct {
+	strategy Strategy
+	conn     net.Conn
+	err      error
+}
+
+// Connect connects to the given peer, signaling through signaler, which it
+// closes once done. It returns the conn from the first strategy that connects,
+// along with a record of all the strategies that it tried. If none of them
+// connects, the error says why each failed. If ctx carries a Budget (see
+// ContextWithBudget), each strategy gets its slice of the Budget rather than
+// its full timeout.
+func (c *Connector) Connect(ctx context.Context, peer string, signaler Signaler) (net.Conn, *ConnectResult, error) {
+	defer signaler.Close()
+	strategies := c.history().order(peer, c.Policy.strategies())
+	if len(strategies) == 0 {
+		return nil, nil, fmt.Errorf("Policy permits no strategies")
+	}
+
+	mux := newSignalMux(signaler, nil, nil)
+	defer func() {
+		for _, t := range mux.close() {
+			t.Close()
+		}
+	}()
+	advert := make(chan string, 1)
+	mux.setLimits(0, func(msg string) bool {
+		cm, ok := parseConnectMsg(msg)
+		if !ok {
+			return false
+		}
+		if cm.Step == connectAdvert {
+			select {
+			case advert <- cm.Address:
+			default:
+			}
+		}
+		return true
+	})
+
+	attempt := c.attempt
+	if attempt == nil {
+		for _, s := range strategies {
+			if s == StrategyDirect {
+				sendConnectMsg(mux, &connectMsg{Step: connectAsk})
+			}
+		}
+		attempt = func(ctx context.Context, s Strategy) (net.Conn, error) {
+			return c.offer(ctx, peer, s, mux, advert)
+		}
+	}
+	conn, result, err := c.run(ctx, strategies, attempt)
+	if result != nil {
+		c.history().record(peer, result)
+	}
+	if err != nil {
+		return nil, result, fmt.Errorf("Unable to connect to %s: %s", peer, err)
+	}
+	sendConnectMsg(mux, &connectMsg{Step: connectWon, Strategy: result.Strategy.String()})
+	log.Debugf("Connected to %s: %s", peer, result)
+	return conn, result, nil
+}
+
+// run tries the given strategies in order, starting each once the previous one
+// fails or has had the Policy's Stagger to connect, until one of them connects.
+// The others are then cancelled, and if they connect anyway, their conns are
+// closed.
+func (c *Connector) run(ctx context.Context, strategies []Strategy, attempt func(ctx context.Context, s Strategy) (net.Conn, error)) (net.Conn, *ConnectResult, error) {
+	type indexedOutcome struct {
+		index int
+		*strategyOutcome
+	}
+
+	start := time.Now()
+	result := &ConnectResult{}
+	outcomes := make(chan *indexedOutcome, len(strategies))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	running := 0
+	launch := func() {
+		s := strategies[len(result.Attempts)]
+		index := len(result.Attempts)
+		result.Attempts = append(result.Attempts, &Attempt{Strategy: s, Started: time.Since(start)})
+		running++
+		rest := make([]time.Duration, 0, len(strategies)-index-1)
+		for _, next := range strategies[index+1:] {
+			rest = append(rest, c.Policy.timeout(next))
+		}
+		go func() {
+			sctx, done := allot(ctx, s.String(), c.Policy.timeout(s), rest)
+			conn, err := attempt(sctx, s)
+			done(err)
+			outcomes <- &indexedOutcome{index, &strategyOutcome{s, conn, err}}
+		}()
+	}
+
+	launch()
+	var stagger <-chan time.Time
+	if c.Policy.Stagger > 0 {
+		ticker := time.NewTicker(c.Policy.Stagger)
+		defer ticker.Stop()
+		stagger = ticker.C
+	}
+	for {
+		select {
+		case <-stagger:
+			if len(result.Attempts) < len(strategies) {
+				launch()
+			}
+		case o := <-outcomes:
+			running--
+			a := result.Attempts[o.index]
+			a.Elapsed = time.Since(start) - a.Started
+			if o.err != nil {
+				a.Err = o.err
+				if running == 0 {
+					if b := budgetFrom(ctx); b != nil && b.Remaining() == 0 {
+						return nil, result, b.exhaustedErr()
+					}
+					if len(result.Attempts) == len(strategies) {
+						return nil, result, fmt.Errorf("All strategies failed: %s", joinAttempts(result.Attempts))
+					}
+					launch()
+				}
+				continue
+			}
+
+			result.Strategy = o.strategy
+			result.Elapsed = time.Since(start)
+			for _, other := range result.Attempts {
+				if other != a && other.Err == nil {
+					other.Abandoned = true
+					other.Elapsed = result.Elapsed - other.Started
+				}
+			}
+			go func() {
+				for i := 0; i < running; i++ {
+					lo := <-outcomes
+					if lo.conn != nil {
+						lo.conn.Close()
+					}
+				}
+			}()
+			return o.conn, result, nil
+		}
+	}
+}
+
+func joinAttempts(attempts []*Attempt) string {
+	s := make([]string, 0, len(attempts))
+	for _, a := range attempts {
+		s = append(s, a.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// offer tries strategy s from the offering side.
+func (c *Connector) offer(ctx context.Context, peer string, s Strategy, mux *signalMux, advert <-chan string) (net.Conn, error) {
+	switch s {
+	case StrategyDirect:
+		select {
+		case address := <-advert:
+			if address == "" {
+				return nil, fmt.Errorf("Peer has no public endpoint")
+			}
+			return connectPortMapped(ctx, address, socketsFor(c.Options))
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Peer didn't say whether it has a public endpoint: %s", ctx.Err())
+		}
+	case StrategyPortMap:
+		return portMapped(ctx, peer, func(msg []byte) error {
+			mux.send(msg)
+			return nil
+		}, socketsFor(c.Options))
+	case StrategyPunch, StrategyRelay:
+		t := OfferContext(ctx, c.Policy.timeout(s), c.traversalOptions(s)...)
+		defer t.Close()
+		mux.add(s.String(), t)
+		conn, _, err := t.detach(true)
+		return conn, err
+	}
+	return nil, fmt.Errorf("Unknown strategy %s", s)
+}
+
+// traversalOptions are the options for the Traversal of the punch or relay
+// strategy.
+func (c *Connector) traversalOptions(s Strategy) []Option {
+	opts := append(append([]Option{}, c.Options...), WithSessionTag(s.String()))
+	if s == StrategyPunch {
+		opts = append(opts, withoutRelayedPair())
+	}
+	return opts
+}
+
+// withoutRelayedPair rejects relayed pairs, on top of any PairAcceptor.
+func withoutRelayedPair() Option {
+	return func(t *Traversal) {
+		accept := t.pairAcceptor
+		t.pairAcceptor = func(ft *FiveTuple) error {
+			if t.statsTracker.relayed(ft) {
+				return fmt.Errorf("Pair %s -> %s is relayed", ft.Local, ft.Remote)
+			}
+			if accept != nil {
+				return accept(ft)
+			}
+			return nil
+		}
+	}
+}
+
+// Accept accepts the connection that a peer's Connector makes through
+// signaler, which it closes once done. It answers whichever of its Policy's
+// strategies the peer tries and returns the conn of the one that the peer
+// tells it connected, along with that strategy.
+func (c *Connector) Accept(ctx context.Context, signaler Signaler) (net.Conn, Strategy, error) {
+	defer signaler.Close()
+	ctx, cancel := context.WithTimeout(ctx, c.Policy.maxDuration())
+	defer cancel()
+
+	outcomes := make(chan *strategyOutcome, len(strategyNames))
+	won := make(chan Strategy, 1)
+	var startMutex sync.Mutex
+	started := make(map[Strategy]bool)
+	start := func(s Strategy, connect func() (net.Conn, error)) {
+		startMutex.Lock()
+		defer startMutex.Unlock()
+		if started[s] || !c.Policy.permits(s) {
+			return
+		}
+		started[s] = true
+		go func() {
+			conn, err := connect()
+			outcomes <- &strategyOutcome{s, conn, err}
+		}()
+	}
+	answer := func(session string) *Traversal {
+		s, ok := strategyNamed(session)
+		if !ok || (s != StrategyPunch && s != StrategyRelay) || !c.Policy.permits(s) {
+			return nil
+		}
+		t := AnswerContext(ctx, c.Policy.timeout(s), c.traversalOptions(s)...)
+		start(s, func() (net.Conn, error) {
+			conn, _, err := t.detach(true)
+			return conn, err
+		})
+		return t
+	}
+	mux := newSignalMux(signaler, answer, nil)
+	mux.setLimits(2, func(msg string) bool {
+		if address, ok := isPortMapMsg(msg); ok {
+			start(StrategyPortMap, func() (net.Conn, error) {
+				return connectPortMapped(ctx, address, socketsFor(c.Options))
+			})
+			return true
+		}
+		cm, ok := parseConnectMsg(msg)
+		if !ok {
+			return false
+		}
+		switch cm.Step {
+		case connectAsk:
+			c.advertise(ctx, mux, start)
+		case connectWon:
+			if s, ok := strategyNamed(cm.Strategy); ok {
+				select {
+				case won <- s:
+				default:
+				}
+			}
+		}
+		return true
+	})
+
+	var conn net.Conn
+	var err error
+	wonStrategy := Strategy(-1)
+	conns := make(map[Strategy]net.Conn)
+	errs := make(map[Strategy]error)
+	for conn == nil && err == nil {
+		select {
+		case o := <-outcomes:
+			if o.err != nil {
+				errs[o.strategy] = o.err
+			} else {
+				conns[o.strategy] = o.conn
+			}
+		case wonStrategy = <-won:
+		case <-ctx.Done():
+			err = fmt.Errorf("Peer didn't connect: %s", ctx.Err())
+			continue
+		}
+		if wonStrategy >= 0 {
+			if conns[wonStrategy] != nil {
+				conn = conns[wonStrategy]
+			} else if errs[wonStrategy] != nil {
+				err = fmt.Errorf("Peer connected with %s, which failed here: %s", wonStrategy, errs[wonStrategy])
+			}
+		}
+	}
+
+	// Clean up the losers
+	for _, t := range mux.close() {
+		t.Close()
+	}
+	startMutex.Lock()
+	pending := len(started) - len(conns) - len(errs)
+	// Nothing starts once ctx is done
+	for s := range strategyNames {
+		started[Strategy(s)] = true
+	}
+	startMutex.Unlock()
+	cancel()
+	for s, other := range conns {
+		if s != wonStrategy || err != nil {
+			other.Close()
+		}
+	}
+	go func() {
+		for i := 0; i < pending; i++ {
+			o := <-outcomes
+			if o.conn != nil {
+				o.conn.Close()
+			}
+		}
+	}()
+
+	if err != nil {
+		return nil, 0, err
+	}
+	log.Debugf("Accepted connection with %s", wonStrategy)
+	return conn, wonStrategy, nil
+}
+
+// advertise tells the peer our public endpoint, if we have one, and awaits its
+// hello there.
+func (c *Connector) advertise(ctx context.Context, mux *signalMux, start func(s Strategy, connect func() (net.Conn, error))) {
+	var conn *net.UDPConn
+	if c.Public != "" && c.Policy.permits(StrategyDirect) {
+		laddr, err := net.ResolveUDPAddr("udp4", c.Public)
+		if err == nil {
+			conn, err = socketsFor(c.Options).listenUDP("udp4", laddr)
+		}
+		if err != nil {
+			log.Errorf("Unable to listen on public endpoint %s: %s", c.Public, err)
+		}
+	}
+	if conn == nil {
+		sendConnectMsg(mux, &connectMsg{Step: connectAdvert})
+		return
+	}
+	sendConnectMsg(mux, &connectMsg{Step: connectAdvert, Address: c.Public})
+	start(StrategyDirect, func() (net.Conn, error) {
+		from, err := awaitHello(ctx, conn, time.Now().Add(c.Policy.timeout(StrategyDirect)))
+		local := conn.LocalAddr().(*net.UDPAddr)
+		conn.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Peer didn't connect to %s: %s", c.Public, err)
+		}
+		return dialPortMapped(local, from, nil, socketsFor(c.Options))
+	})
+}
+
+func (c *Connector) history() *PeerHistory {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.History == nil {
+		c.History = NewPeerHistory()
+	}
+	return c.History
+}
+
+// PeerHistory remembers how connecting to each peer went with each strategy.
+// It's safe for concurrent use, so several Connectors can share one.
+type PeerHistory struct {
+	mutex sync.Mutex
+	peers map[string]map[Strategy]*strategyRecord
+}
+
+// strategyRecord is how a strategy has done with a peer.
+type strategyRecord struct {
+	successes int
+	failures  int
+	elapsed   time.Duration // total time taken by the successes
+}
+
+// NewPeerHistory returns an empty PeerHistory.
+func NewPeerHistory() *PeerHistory {
+	return &PeerHistory{peers: make(map[string]map[Strategy]*strategyRecord)}
+}
+
+// Best returns the strategy that has worked best with the given peer, being
+// the one that connected most reliably and, among those, fastest. It returns
+// false if no strategy has connected to the peer yet.
+func (h *PeerHistory) Best(peer string) (Strategy, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var best Strategy
+	var bestRecord *strategyRecord
+	for s, r := range h.peers[peer] {
+		if r.successes == 0 {
+			continue
+		}
+		if bestRecord == nil || r.betterThan(bestRecord) || (!bestRecord.betterThan(r) && s < best) {
+			best, bestRecord = s, r
+		}
+	}
+	return best, bestRecord != nil
+}
+
+func (r *strategyRecord) betterThan(other *strategyRecord) bool {
+	// Compare success rates without dividing
+	rate, otherRate := r.successes*(other.successes+other.failures), other.successes*(r.successes+r.failures)
+	if rate != otherRate {
+		return rate > otherRate
+	}
+	return r.elapsed/time.Duration(r.successes) < other.elapsed/time.Duration(other.successes)
+}
+
+// record records how the attempts in result went. Abandoned attempts don't
+// count, since they neither connected nor failed.
+func (h *PeerHistory) record(peer string, result *ConnectResult) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	records := h.peers[peer]
+	if records == nil {
+		records = make(map[Strategy]*strategyRecord)
+		h.peers[peer] = records
+	}
+	for _, a := range result.Attempts {
+		if a.Abandoned {
+			continue
+		}
+		r := records[a.Strategy]
+		if r == nil {
+			r = &strategyRecord{}
+			records[a.Strategy] = r
+		}
+		if a.Err != nil {
+			r.failures++
+		} else {
+			r.successes++
+			r.elapsed += a.Elapsed
+		}
+	}
+}
+
+// order moves the best strategy for the given peer to the front of strategies,
+// if it's among them.
+func (h *PeerHistory) order(peer string, strategies []Strategy) []Strategy {
+	best, ok := h.Best(peer)
+	if !ok {
+		return strategies
+	}
+	ordered := append([]Strategy{}, strategies...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i] == best && ordered[j] != best
+	})
+	return ordered
+}
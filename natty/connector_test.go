@@ -0,0 +1,199 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/go-natty/natty/portmap"
+	"github.com/getlantern/testify/assert"
+)
+
+// TestConnectorPunch connects for real with the direct and portmap strategies
+// disabled, which must land on punch.
+func TestConnectorPunch(t *testing.T) {
+	policy := ConnectPolicy{Disabled: []Strategy{StrategyDirect, StrategyPortMap}}
+	conn, peerConn, result := connectPair(t, &Connector{Policy: policy}, &Connector{Policy: policy})
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	defer peerConn.Close()
+
+	assert.Equal(t, StrategyPunch, result.Strategy, "Should have punched a hole")
+	if assert.Len(t, result.Attempts, 1) {
+		assert.NoError(t, result.Attempts[0].Err)
+	}
+	assertConnected(t, conn, peerConn)
+}
+
+// TestConnectorWithoutICE connects with the strategies that don't need natty.
+func TestConnectorWithoutICE(t *testing.T) {
+	defer func(orig func(context.Context, string, int, time.Duration) (*portmap.ExternalEndpoint, func(), error)) {
+		mapPort = orig
+	}(mapPort)
+	mapPort = func(ctx context.Context, proto string, internalPort int, lifetime time.Duration) (*portmap.ExternalEndpoint, func(), error) {
+		return &portmap.ExternalEndpoint{Proto: proto, IP: net.IPv4(127, 0, 0, 1), Port: internalPort, Method: portmap.PCP, Lifetime: lifetime}, func() {}, nil
+	}
+	ice := []Strategy{StrategyPunch, StrategyRelay}
+
+	// The peer is public, so direct works
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	public := l.LocalAddr().String()
+	l.Close()
+	policy := ConnectPolicy{Disabled: ice}
+	conn, peerConn, result := connectPair(t, &Connector{Policy: policy}, &Connector{Policy: policy, Public: public})
+	if conn != nil {
+		assert.Equal(t, StrategyDirect, result.Strategy)
+		assertConnected(t, conn, peerConn)
+		conn.Close()
+		peerConn.Close()
+	}
+
+	// The peer isn't public, so we fall back to a mapped port
+	conn, peerConn, result = connectPair(t, &Connector{Policy: policy}, &Connector{Policy: policy})
+	if conn != nil {
+		assert.Equal(t, StrategyPortMap, result.Strategy)
+		if assert.Len(t, result.Attempts, 2) {
+			assert.Equal(t, StrategyDirect, result.Attempts[0].Strategy)
+			assert.Contains(t, result.Attempts[0].Err.Error(), "no public endpoint")
+		}
+		assertConnected(t, conn, peerConn)
+		conn.Close()
+		peerConn.Close()
+	}
+}
+
+func TestConnectorFallback(t *testing.T) {
+	var tried []Strategy
+	c := &Connector{
+		Policy: ConnectPolicy{
+			Disabled: []Strategy{StrategyRelay},
+			Timeouts: map[Strategy]time.Duration{StrategyPortMap: 50 * time.Millisecond},
+		},
+		attempt: func(ctx context.Context, s Strategy) (net.Conn, error) {
+			tried = append(tried, s)
+			switch s {
+			case StrategyDirect:
+				return nil, fmt.Errorf("Peer has no public endpoint")
+			case StrategyPortMap:
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return fakeConn(t), nil
+		},
+	}
+
+	conn, result, err := c.Connect(context.Background(), "peer", newChanSignaler())
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+	assert.Equal(t, StrategyPunch, result.Strategy)
+	assert.Equal(t, []Strategy{StrategyDirect, StrategyPortMap, StrategyPunch}, tried, "Should try permitted strategies in order")
+	if assert.Len(t, result.Attempts, 3) {
+		assert.Error(t, result.Attempts[0].Err)
+		assert.Equal(t, context.DeadlineExceeded, result.Attempts[1].Err, "Mapping should have timed out")
+		assert.True(t, result.Attempts[1].Elapsed >= 50*time.Millisecond)
+		assert.True(t, result.Attempts[2].Started >= result.Attempts[1].Started+result.Attempts[1].Elapsed)
+		assert.NoError(t, result.Attempts[2].Err)
+	}
+	best, ok := c.History.Best("peer")
+	assert.True(t, ok)
+	assert.Equal(t, StrategyPunch, best)
+
+	// Next time, start with what worked
+	tried = nil
+	conn, result, err = c.Connect(context.Background(), "peer", newChanSignaler())
+	if assert.NoError(t, err) {
+		conn.Close()
+		assert.Equal(t, []Strategy{StrategyPunch}, tried)
+		assert.Len(t, result.Attempts, 1)
+	}
+	_, ok = c.History.Best("other peer")
+	assert.False(t, ok, "Other peers shouldn't have a history")
+
+	// Nothing works
+	c.attempt = func(ctx context.Context, s Strategy) (net.Conn, error) {
+		return nil, fmt.Errorf("No luck with %s", s)
+	}
+	_, result, err = c.Connect(context.Background(), "peer", newChanSignaler())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "No luck with portmap")
+		assert.Len(t, result.Attempts, 3)
+	}
+}
+
+func TestConnectorStagger(t *testing.T) {
+	c := &Connector{
+		Policy: ConnectPolicy{
+			Order:   []Strategy{StrategyPunch, StrategyRelay},
+			Stagger: 50 * time.Millisecond,
+		},
+		attempt: func(ctx context.Context, s Strategy) (net.Conn, error) {
+			if s == StrategyPunch {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return fakeConn(t), nil
+		},
+	}
+	conn, result, err := c.Connect(context.Background(), "peer", newChanSignaler())
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+	assert.Equal(t, StrategyRelay, result.Strategy)
+	if assert.Len(t, result.Attempts, 2) {
+		assert.True(t, result.Attempts[0].Abandoned, "Punch should have been abandoned")
+		assert.True(t, result.Attempts[1].Started >= 50*time.Millisecond, "Relay should have waited for the stagger")
+		assert.True(t, result.Attempts[1].Started < time.Second, "Relay shouldn't have waited for punch to time out")
+	}
+}
+
+// connectPair connects c to peer through a pair of connected chanSignalers.
+func connectPair(t *testing.T, c *Connector, peer *Connector) (net.Conn, net.Conn, *ConnectResult) {
+	signaler := newChanSignaler()
+	peerSignaler := &chanSignaler{in: signaler.out, out: signaler.in}
+	type accepted struct {
+		conn     net.Conn
+		strategy Strategy
+		err      error
+	}
+	acceptedCh := make(chan *accepted, 1)
+	go func() {
+		conn, s, err := peer.Accept(context.Background(), peerSignaler)
+		acceptedCh <- &accepted{conn, s, err}
+	}()
+
+	conn, result, err := c.Connect(context.Background(), "peer", signaler)
+	if !assert.NoError(t, err, "Should connect") {
+		return nil, nil, nil
+	}
+	a := <-acceptedCh
+	if !assert.NoError(t, a.err, "Peer should accept") {
+		conn.Close()
+		return nil, nil, nil
+	}
+	assert.Equal(t, result.Strategy, a.strategy, "Both ends should use the same strategy")
+	return conn, a.conn, result
+}
+
+func assertConnected(t *testing.T, conn net.Conn, peerConn net.Conn) {
+	for _, c := range [][2]net.Conn{{conn, peerConn}, {peerConn, conn}} {
+		_, err := c[0].Write([]byte("hello"))
+		assert.NoError(t, err)
+		b := make([]byte, 5)
+		c[1].SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(c[1], b)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "hello", string(b))
+		}
+	}
+}
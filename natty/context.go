@@ -0,0 +1,336 @@
+package natty
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+var (
+	// lastTraversalId is the id most recently assigned to a Traversal
+	lastTraversalId uint64
+)
+
+// Logger is a structured logger to which a Traversal, or the whole package
+// (see SetLogger), can send its output instead of golog. *slog.Logger
+// satisfies Logger, and adapting another logger, such as zap's, takes a
+// couple of methods.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// GologLogger adapts a golog.Logger (or anything else with golog's Debug and
+// Error methods) to a Logger, for WithLogger or ContextWithLogger, so that
+// applications that already use golog get a Traversal's output, natty's
+// included, through their own logger rather than the package's. Entries are
+// prefixed with the Traversal's id and phase, as in
+// "[traversal 3 phase negotiating] Offering". Debug entries go to the
+// logger's Debug whether or not the package's tracing is enabled.
+func GologLogger(logger interface {
+	Debug(arg interface{})
+	Error(arg interface{}) error
+}) Logger {
+	return &gologLogger{logger}
+}
+
+// gologLogger is the Logger returned by GologLogger.
+type gologLogger struct {
+	logger interface {
+		Debug(arg interface{})
+		Error(arg interface{}) error
+	}
+}
+
+func (l *gologLogger) Debug(msg string, args ...interface{}) {
+	l.logger.Debug(formatEntry(msg, args))
+}
+
+func (l *gologLogger) Error(msg string, args ...interface{}) {
+	l.logger.Error(formatEntry(msg, args))
+}
+
+// formatEntry formats a structured log entry, whose args are key value pairs,
+// as "[key value ...] msg".
+func formatEntry(msg string, args []interface{}) string {
+	if len(args) == 0 {
+		return msg
+	}
+	var b bytes.Buffer
+	b.WriteByte('[')
+	for i, arg := range args {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprint(&b, arg)
+	}
+	b.WriteString("] ")
+	b.WriteString(msg)
+	return b.String()
+}
+
+// SetLogger makes the package log to the given Logger instead of golog,
+// including what Traversals and natty itself log, unless they're given a
+// Logger of their own (see WithLogger and ContextWithLogger). Trace messages
+// are logged at debug level. Passing nil goes back to golog.
+func SetLogger(logger Logger) {
+	log.set(logger)
+}
+
+// packageLog is the package's logger, which logs to the Logger set with
+// SetLogger or, absent that, to golog.
+type packageLog struct {
+	golog  golog.Logger
+	logger atomic.Value // holds a loggerHolder
+}
+
+// loggerHolder lets packageLog store a nil Logger in an atomic.Value.
+type loggerHolder struct {
+	Logger
+}
+
+func (l *packageLog) set(logger Logger) {
+	l.logger.Store(loggerHolder{logger})
+}
+
+func (l *packageLog) get() Logger {
+	holder, _ := l.logger.Load().(loggerHolder)
+	return holder.Logger
+}
+
+func (l *packageLog) IsTraceEnabled() bool {
+	return l.get() != nil || l.golog.IsTraceEnabled()
+}
+
+func (l *packageLog) TraceOut() io.Writer {
+	return l.golog.TraceOut()
+}
+
+func (l *packageLog) Trace(arg interface{}) {
+	if logger := l.get(); logger != nil {
+		logger.Debug(fmt.Sprint(arg))
+		return
+	}
+	l.golog.Trace(arg)
+}
+
+func (l *packageLog) Tracef(message string, args ...interface{}) {
+	if logger := l.get(); logger != nil {
+		logger.Debug(fmt.Sprintf(message, args...))
+		return
+	}
+	l.golog.Tracef(message, args...)
+}
+
+func (l *packageLog) Debug(arg interface{}) {
+	if logger := l.get(); logger != nil {
+		logger.Debug(fmt.Sprint(arg))
+		return
+	}
+	l.golog.Debug(arg)
+}
+
+func (l *packageLog) Debugf(message string, args ...interface{}) {
+	if logger := l.get(); logger != nil {
+		logger.Debug(fmt.Sprintf(message, args...))
+		return
+	}
+	l.golog.Debugf(message, args...)
+}
+
+func (l *packageLog) Error(arg interface{}) {
+	if logger := l.get(); logger != nil {
+		logger.Error(fmt.Sprint(arg))
+		return
+	}
+	l.golog.Error(arg)
+}
+
+func (l *packageLog) Errorf(message string, args ...interface{}) {
+	if logger := l.get(); logger != nil {
+		logger.Error(fmt.Sprintf(message, args...))
+		return
+	}
+	l.golog.Errorf(message, args...)
+}
+
+type loggerKey struct{}
+
+// ContextWithLogger returns a copy of ctx carrying the given Logger. Traversals
+// started with OfferContext or AnswerContext using the returned context log to
+// that Logger, with every entry decorated with the traversal's id and phase.
+func ContextWithLogger(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// OfferContext is like Offer(), except that the Traversal logs to the Logger
+// carried by ctx (if any) and is closed once ctx is done.
+func OfferContext(ctx context.Context, timeout time.Duration, opts ...Option) *Traversal {
+	t := newTraversal(timeout, opts)
+	t.bindContext(ctx)
+	t.log().Trace("Offering")
+	t.activate()
+	t.run(offerParams)
+	return t
+}
+
+// AnswerContext is like Answer(), except that the Traversal logs to the Logger
+// carried by ctx (if any) and is closed once ctx is done.
+func AnswerContext(ctx context.Context, timeout time.Duration, opts ...Option) *Traversal {
+	t := newTraversal(timeout, opts)
+	t.bindContext(ctx)
+	t.log().Trace("Answering")
+	t.activate()
+	t.run(answerParams)
+	return t
+}
+
+// ID returns an identifier for the Traversal that's unique within this process
+// and is included in its log output.
+func (t *Traversal) ID() uint64 {
+	return t.id
+}
+
+// bindContext makes the Traversal use the Logger carried by ctx and close
+// itself once ctx is done.
+func (t *Traversal) bindContext(ctx context.Context) {
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		t.useLogger(logger)
+	}
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.log().Tracef("Context done, closing: %s", ctx.Err())
+			t.Close()
+		case <-t.closedCh:
+		}
+	}()
+}
+
+// useLogger makes the Traversal log to logger, including natty's debug
+// output.
+func (t *Traversal) useLogger(logger Logger) {
+	t.logger = logger
+	t.traceOut = &loggerWriter{t: t}
+}
+
+// phase is the stage that a Traversal has reached, as reported in its log
+// output.
+type phase int32
+
+const (
+	phaseStandby phase = iota
+	phaseNegotiating
+	phaseConnected
+	phaseFailed
+	phaseClosed
+)
+
+func (p phase) String() string {
+	switch p {
+	case phaseStandby:
+		return "standby"
+	case phaseNegotiating:
+		return "negotiating"
+	case phaseConnected:
+		return "connected"
+	case phaseFailed:
+		return "failed"
+	case phaseClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("phase(%d)", int32(p))
+	}
+}
+
+func (t *Traversal) setPhase(p phase) {
+	atomic.StoreInt32(&t.phase, int32(p))
+}
+
+func (t *Traversal) getPhase() phase {
+	return phase(atomic.LoadInt32(&t.phase))
+}
+
+// traversalLog logs on behalf of a Traversal, either to the Traversal's Logger
+// or, absent that, to the package's default logger, applying the Traversal's
+// LogRedaction.
+type traversalLog struct {
+	t *Traversal
+}
+
+func (t *Traversal) log() traversalLog {
+	return traversalLog{t}
+}
+
+// tracing indicates whether trace messages are logged. Callers that pass
+// messages from the hot path as arguments check it first, since converting the
+// arguments to interface{} allocates whether or not they're logged.
+func (l traversalLog) tracing() bool {
+	return l.t.logger != nil || log.IsTraceEnabled()
+}
+
+func (l traversalLog) Trace(arg interface{}) {
+	if !l.tracing() {
+		return
+	}
+	msg := l.t.redact(fmt.Sprint(arg))
+	if l.t.logger == nil {
+		log.Trace(msg)
+		return
+	}
+	l.t.logger.Debug(msg, l.attrs()...)
+}
+
+func (l traversalLog) Tracef(message string, args ...interface{}) {
+	if !l.tracing() {
+		return
+	}
+	msg := l.t.redact(fmt.Sprintf(message, args...))
+	if l.t.logger == nil {
+		log.Trace(msg)
+		return
+	}
+	l.t.logger.Debug(msg, l.attrs()...)
+}
+
+func (l traversalLog) Errorf(message string, args ...interface{}) {
+	msg := l.t.redact(fmt.Sprintf(message, args...))
+	if l.t.logger == nil {
+		log.Error(msg)
+		return
+	}
+	l.t.logger.Error(msg, l.attrs()...)
+}
+
+func (l traversalLog) attrs() []interface{} {
+	return []interface{}{"traversal", l.t.id, "phase", l.t.getPhase().String()}
+}
+
+// loggerWriter is an io.Writer that sends natty's debug output to the
+// Traversal's Logger, one entry per line.
+type loggerWriter struct {
+	t       *Traversal
+	partial []byte
+}
+
+func (w *loggerWriter) Write(b []byte) (int, error) {
+	w.partial = append(w.partial, b...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if i > 0 {
+			w.t.logger.Debug(string(w.partial[:i]), append(w.t.log().attrs(), "source", "natty")...)
+		}
+		w.partial = w.partial[i+1:]
+	}
+}
@@ -0,0 +1,328 @@
+package natty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// recordingLogger is a Logger that records its entries.
+type recordingLogger struct {
+	entries []string
+	mutex   sync.Mutex
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) {
+	l.record("DEBUG", msg, args)
+}
+
+func (l *recordingLogger) Error(msg string, args ...interface{}) {
+	l.record("ERROR", msg, args)
+}
+
+func (l *recordingLogger) record(level string, msg string, args []interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, fmt.Sprint(level, " ", msg, " ", args))
+}
+
+func (l *recordingLogger) all() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string{}, l.entries...)
+}
+
+func TestContextLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	ctx := ContextWithLogger(context.Background(), logger)
+
+	tr := newTraversal(0, nil)
+	tr.bindContext(ctx)
+	tr.log().Tracef("Hello %s", "world")
+	tr.activate()
+	tr.log().Errorf("Uh oh")
+	tr.traceOut.Write([]byte("from natty\npart"))
+	tr.traceOut.Write([]byte("ial line\n"))
+
+	traversal := fmt.Sprint(tr.ID())
+	assert.Equal(t, []string{
+		"DEBUG Hello world [traversal " + traversal + " phase standby]",
+		"ERROR Uh oh [traversal " + traversal + " phase negotiating]",
+		"DEBUG from natty [traversal " + traversal + " phase negotiating source natty]",
+		"DEBUG partial line [traversal " + traversal + " phase negotiating source natty]",
+	}, logger.all())
+
+	other := newTraversal(0, nil)
+	assert.NotEqual(t, tr.ID(), other.ID(), "Traversals should have distinct ids")
+	assert.Nil(t, other.logger, "Traversal without context logger should use the default logger")
+}
+
+// recordingGolog records what's logged to it like a golog.Logger would.
+type recordingGolog struct {
+	recordingLogger
+}
+
+func (l *recordingGolog) Debug(arg interface{}) {
+	l.record("DEBUG", fmt.Sprint(arg), nil)
+}
+
+func (l *recordingGolog) Error(arg interface{}) error {
+	l.record("ERROR", fmt.Sprint(arg), nil)
+	return fmt.Errorf("%v", arg)
+}
+
+func TestGologLogger(t *testing.T) {
+	logger := &recordingGolog{}
+	tr := newTraversal(0, []Option{WithLogger(GologLogger(logger))})
+	tr.log().Trace("Offering")
+	tr.activate()
+	tr.log().Errorf("Uh oh")
+	tr.stderrOut().Write([]byte("from natty\n"))
+
+	traversal := fmt.Sprint(tr.ID())
+	assert.Equal(t, []string{
+		"DEBUG [traversal " + traversal + " phase standby] Offering []",
+		"ERROR [traversal " + traversal + " phase negotiating] Uh oh []",
+		"DEBUG [traversal " + traversal + " phase negotiating source natty] from natty []",
+	}, logger.all())
+	assert.Equal(t, "plain", formatEntry("plain", nil))
+}
+
+func TestSetLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	SetLogger(logger)
+	defer SetLogger(nil)
+
+	log.Tracef("Hello %s", "world")
+	log.Errorf("Uh oh")
+	tr := newTraversal(0, nil)
+	tr.log().Trace("Offering")
+	own := &recordingLogger{}
+	withOwn := newTraversal(0, []Option{WithLogger(own)})
+	withOwn.log().Trace("Answering")
+
+	traversal := fmt.Sprint(tr.ID())
+	assert.Equal(t, []string{
+		"DEBUG Hello world []",
+		"ERROR Uh oh []",
+		"DEBUG Offering [traversal " + traversal + " phase standby]",
+	}, logger.all())
+	assert.Len(t, own.all(), 1, "Traversal's own Logger should take precedence")
+	assert.True(t, tr.nattyDebug(), "natty's debug output should go to the Logger")
+
+	SetLogger(nil)
+	assert.Nil(t, newTraversal(0, nil).logger, "SetLogger(nil) should go back to golog")
+}
+
+func TestContextCancelCloses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := newTraversal(0, nil)
+	tr.bindContext(ctx)
+	cancel()
+	select {
+	case <-tr.closedCh:
+		assert.Equal(t, phaseClosed, tr.getPhase())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Traversal should have been closed when its context was done")
+	}
+}
+
+func TestFiveTupleContext(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+
+	// A plain FiveTuple waits alongside
+	type result struct {
+		ft  *FiveTuple
+		err error
+	}
+	waiting := make(chan result, 1)
+	go func() {
+		ft, err := tr.FiveTuple()
+		waiting <- result{ft, err}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ft, err := tr.FiveTupleContext(ctx)
+	assert.Nil(t, ft)
+	assert.True(t, errors.Is(err, ErrTimeout))
+	select {
+	case r := <-waiting:
+		assert.True(t, errors.Is(r.err, ErrTimeout), "FiveTuple should get the same result")
+	case <-time.After(5 * time.Second):
+		t.Fatal("FiveTuple should have returned once the context was done")
+	}
+	select {
+	case <-tr.closedCh:
+	default:
+		t.Fatal("Traversal should have been closed")
+	}
+	_, err = tr.FiveTuple()
+	assert.True(t, errors.Is(err, ErrTimeout), "Result should be cached")
+
+	// Once there's a FiveTuple, the context doesn't matter
+	tr = newTraversal(0, nil)
+	tr.initChannels()
+	expected := &FiveTuple{Proto: UDP, Local: "192.168.1.2:5000", Remote: "203.0.113.7:6000"}
+	tr.fiveTupleOutCh <- expected
+	ft, err = tr.FiveTupleContext(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, expected, ft)
+	ft, err = tr.FiveTupleContext(ctx)
+	assert.NoError(t, err, "Cached result should be returned even though context is done")
+	assert.Equal(t, expected, ft)
+	select {
+	case <-tr.closedCh:
+		t.Fatal("Traversal with a FiveTuple shouldn't be closed")
+	default:
+	}
+}
+
+func TestFiveTupleTimeout(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	start := time.Now()
+	_, err := tr.FiveTupleTimeout(50 * time.Millisecond)
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Timeout should also be the context's error")
+	assert.True(t, time.Since(start) < 5*time.Second)
+	select {
+	case <-tr.closedCh:
+	default:
+		t.Fatal("Traversal should have been closed")
+	}
+
+	tr = newTraversal(0, nil)
+	tr.initChannels()
+	expected := &FiveTuple{Proto: UDP, Local: "192.168.1.2:5000", Remote: "203.0.113.7:6000"}
+	tr.fiveTupleOutCh <- expected
+	ft, err := tr.FiveTupleTimeout(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, ft)
+}
+
+// TestFiveTupleTimeoutLeaksNothing makes sure that Traversals whose
+// FiveTupleTimeout times out leave behind neither natty processes nor
+// goroutines.
+func TestFiveTupleTimeoutLeaksNothing(t *testing.T) {
+	defer checkGoroutineLeaks(t)()
+	for i := 0; i < 20; i++ {
+		tr := Offer(0)
+		_, err := tr.FiveTupleTimeout(5 * time.Millisecond)
+		assert.Error(t, err)
+		tr.cmdMutex.Lock()
+		if tr.cmd != nil && tr.cmd.Process != nil {
+			assert.NotNil(t, tr.cmd.ProcessState, "natty should have been reaped")
+		}
+		tr.cmdMutex.Unlock()
+	}
+}
+
+func TestFiveTupleChan(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	first, second := tr.FiveTupleChan(), tr.FiveTupleChan()
+	expected := &FiveTuple{Proto: UDP, Local: "192.168.1.2:5000", Remote: "203.0.113.7:6000"}
+	tr.fiveTupleOutCh <- expected
+	for _, resultCh := range []<-chan *FiveTupleResult{first, second} {
+		select {
+		case r := <-resultCh:
+			assert.NoError(t, r.Err)
+			assert.Equal(t, expected, r.FiveTuple)
+		case <-time.After(5 * time.Second):
+			t.Fatal("FiveTupleChan should have delivered the result")
+		}
+	}
+	ft, err := tr.FiveTupleTimeout(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, ft, "FiveTupleTimeout should get the same result")
+
+	tr = newTraversal(0, nil)
+	tr.initChannels()
+	resultCh := tr.FiveTupleChan()
+	_, err = tr.FiveTupleTimeout(50 * time.Millisecond)
+	assert.True(t, errors.Is(err, ErrTimeout))
+	select {
+	case r := <-resultCh:
+		assert.Nil(t, r.FiveTuple)
+		assert.True(t, errors.Is(r.Err, ErrTimeout), "FiveTupleChan should get the same error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("FiveTupleChan should have delivered the error")
+	}
+	_, ok := <-resultCh
+	assert.False(t, ok, "FiveTupleChan should be closed after delivering the result")
+
+	// Closing first gives everybody the error that the closed Traversal fails
+	// with
+	tr = newTraversal(0, nil)
+	tr.initChannels()
+	resultCh = tr.FiveTupleChan()
+	tr.Close()
+	tr.errOutCh <- ErrClosed
+	_, err = tr.FiveTuple()
+	assert.Error(t, err)
+	select {
+	case r := <-resultCh:
+		assert.Equal(t, err, r.Err, "FiveTupleChan should get the same error as FiveTuple")
+	case <-time.After(5 * time.Second):
+		t.Fatal("FiveTupleChan should have delivered the error")
+	}
+	_, ok = <-resultCh
+	assert.False(t, ok, "FiveTupleChan should be closed after delivering the result")
+}
+
+func TestFiveTupleContextKillsNatty(t *testing.T) {
+	tr := Offer(0)
+	defer tr.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := tr.FiveTupleContext(ctx)
+	assert.True(t, errors.Is(err, ErrTimeout))
+	tr.cmdMutex.Lock()
+	defer tr.cmdMutex.Unlock()
+	if assert.NotNil(t, tr.cmd) {
+		assert.NotNil(t, tr.cmd.ProcessState, "natty should have been killed")
+	}
+}
+
+func TestOfferAnswerContext(t *testing.T) {
+	offerLogger := &recordingLogger{}
+	answerLogger := &recordingLogger{}
+	offerCtx := ContextWithLogger(context.Background(), offerLogger)
+	answerCtx := ContextWithLogger(context.Background(), answerLogger)
+
+	offer := OfferContext(offerCtx, 30*time.Second)
+	defer offer.Close()
+	answer := AnswerContext(answerCtx, 30*time.Second)
+	defer answer.Close()
+	exchangeMessages(offer, answer)
+
+	_, err := offer.FiveTuple()
+	assert.NoError(t, err, "Offerer should have gotten five tuple")
+	_, err = answer.FiveTuple()
+	assert.NoError(t, err, "Answerer should have gotten five tuple")
+	assert.Contains(t, fmt.Sprint(offerLogger.all()), fmt.Sprintf("traversal %d phase connected", offer.ID()))
+	assert.Contains(t, fmt.Sprint(answerLogger.all()), fmt.Sprintf("traversal %d phase connected", answer.ID()))
+}
+
+// exchangeMessages passes messages between the given Traversals until they're
+// done.
+func exchangeMessages(a *Traversal, b *Traversal) {
+	pass := func(from *Traversal, to *Traversal) {
+		for {
+			msg, done := from.NextMsgOut()
+			if done {
+				return
+			}
+			to.MsgIn(msg)
+		}
+	}
+	go pass(a, b)
+	go pass(b, a)
+}
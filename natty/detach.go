@@ -0,0 +1,123 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DetachKeepAliveInterval is how frequently the conn returned by Detach()
+	// sends keepalives.
+	DetachKeepAliveInterval = 15 * time.Second
+)
+
+// Detach transfers ownership of the established connection out of the
+// Traversal. It waits for the FiveTuple and returns a conn on it that's
+// already marked per WithDSCP, limited per WithRelayRateLimit and kept alive
+// by a ConnKeeper, along with a cleanup func that stops the keepalives and
+// closes the conn. Keepalives from the peer are filtered out of what's read
+// from the conn, as are probes from the peer's ProbeTuple, which are answered. Once Detach returns, the Traversal can be closed without
+// affecting the conn. Detach can only be called once per Traversal.
+func (t *Traversal) Detach() (net.Conn, func(), error) {
+	return t.detach(false)
+}
+
+// detach is like Detach, optionally closing the conn once the peer appears to
+// have gone away, which makes reads from it fail.
+func (t *Traversal) detach(closeOnDead bool) (net.Conn, func(), error) {
+	var onDead func()
+	if closeOnDead {
+		onDead = func() {}
+	}
+	return t.detachWith(onDead)
+}
+
+// detachWith is like Detach, except that if onDead is set, it's called once
+// the peer appears to have gone away, after which the conn is closed.
+func (t *Traversal) detachWith(onDead func()) (net.Conn, func(), error) {
+	if !atomic.CompareAndSwapInt32(&t.detached, 0, 1) {
+		return nil, nil, fmt.Errorf("Traversal already detached")
+	}
+	ft, err := t.FiveTuple()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ft.Proto != UDP {
+		return nil, nil, fmt.Errorf("Unable to detach %s FiveTuple, only udp is supported", ft.Proto)
+	}
+	conn, dc, err := t.dialPair(ft, onDead)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, dc.cleanup, nil
+}
+
+// dialPair dials a conn on the given FiveTuple, marked, limited and kept
+// alive like Detach does. If onDead is set, it's called once the peer appears
+// to have gone away, after which the conn is closed.
+func (t *Traversal) dialPair(ft *FiveTuple, onDead func()) (net.Conn, *detachedConn, error) {
+	local, remote, err := ft.UDPAddrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	udpConn, err := t.sockets.dialUDP("udp", local, remote)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to dial %s from %s: %s", remote, local, err)
+	}
+	err = t.MarkConn(udpConn)
+	if err != nil {
+		udpConn.Close()
+		return nil, nil, err
+	}
+	t.log().Tracef("Detaching conn from %s to %s", local, remote)
+	var closeOnDead func()
+	if onDead != nil {
+		closeOnDead = func() {
+			onDead()
+			udpConn.Close()
+		}
+	}
+	dc := &detachedConn{
+		UDPConn: udpConn,
+		keeper:  t.NewConnKeeper(udpConn, nil, DetachKeepAliveInterval, closeOnDead),
+	}
+	return t.LimitConn(dc), dc, nil
+}
+
+// detachedConn is a conn handed out by Detach(), which keeps itself alive.
+type detachedConn struct {
+	*net.UDPConn
+	keeper    *ConnKeeper
+	closeOnce sync.Once
+}
+
+// Read reads the next packet that isn't a keepalive, recording that the peer
+// is alive. It answers probes from the peer's ProbeTuple along the way.
+func (c *detachedConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.UDPConn.Read(b)
+		if err != nil {
+			return n, err
+		}
+		c.keeper.Received()
+		if !IsKeepAlive(b[:n]) && !answerTupleProbe(c.UDPConn, b[:n]) {
+			return n, nil
+		}
+	}
+}
+
+func (c *detachedConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.keeper.Stop()
+		err = c.UDPConn.Close()
+	})
+	return err
+}
+
+func (c *detachedConn) cleanup() {
+	c.Close()
+}
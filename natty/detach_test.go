@@ -0,0 +1,53 @@
+package natty
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestDetachedConn(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer peer.Close()
+	udpConn, err := net.DialUDP("udp", nil, peer.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	dc := &detachedConn{
+		UDPConn: udpConn,
+		keeper:  NewConnKeeper(udpConn, nil, 10*time.Millisecond, nil),
+	}
+
+	// Keepalives should reach the peer
+	b := make([]byte, 100)
+	peer.SetReadDeadline(time.Now().Add(1 * time.Second))
+	n, local, err := peer.ReadFromUDP(b)
+	if assert.NoError(t, err, "Peer should get keepalive") {
+		assert.True(t, IsKeepAlive(b[:n]))
+	}
+
+	// Keepalives from the peer should be filtered out
+	peer.WriteToUDP(KeepAlivePacket, local)
+	peer.WriteToUDP([]byte("hello"), local)
+	n, err = dc.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello", string(b[:n]))
+	}
+
+	dc.cleanup()
+	assert.NoError(t, dc.Close(), "Closing again should be a no-op")
+	_, err = dc.Write([]byte("hello"))
+	assert.Error(t, err, "Conn should be closed by cleanup")
+}
+
+func TestDetachTwice(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.detached = 1
+	_, _, err := tr.Detach()
+	assert.Error(t, err, "Second Detach should fail")
+}
@@ -0,0 +1,310 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDialTimeout is how long a Dialer waits for a traversal to a peer
+	// if its Timeout isn't set.
+	DefaultDialTimeout = 30 * time.Second
+
+	// DefaultIdleTimeout is how long a Dialer keeps a connection to a peer
+	// without open streams if its IdleTimeout isn't set.
+	DefaultIdleTimeout = 90 * time.Second
+)
+
+// Signaler exchanges signaling messages with a single peer, by whatever means
+// the application uses for signaling. Messages are []byte rather than strings,
+// like those of NextMsgOutBytes and MsgInBytes, so that they can go between
+// natty and the signaling channel without being copied, and their buffers can
+// be reused once sent (see ReleaseMsg). Signalers that deal in strings convert
+// at their end, which costs a copy, as NextMsgOut and MsgIn do.
+type Signaler interface {
+	// Send sends a message to the peer, taking ownership of msg (see
+	// NextMsgOutBytes).
+	Send(msg []byte) error
+
+	// Receive waits for the next message from the peer, of which the caller
+	// takes ownership (see MsgInBytes). It returns an error once the Signaler
+	// has been closed.
+	Receive() ([]byte, error)
+
+	// Close stops signaling, making pending and future calls to Receive fail.
+	Close() error
+}
+
+// SignalerFactory returns a Signaler for signaling with the given peer.
+type SignalerFactory func(ctx context.Context, peer string) (Signaler, error)
+
+// Dialer dials peers through NAT traversals, for use with libraries that
+// accept a dial function, like http.Transport's DialContext. The addresses
+// that it dials identify peers, which the Dialer's Signaling resolves. On the
+// peer's end, Serve accepts what the Dialer dials.
+//
+// Dialing "tcp" (or "tcp4", "tcp6") returns a reliable stream. Streams to the
+// same peer share a single traversal, which is closed once no streams have
+// been open for IdleTimeout. Dialing "udp" (or "udp4", "udp6") runs a
+// traversal for each call and returns the resulting UDP conn, as Detach does.
+//
+// With Race set, the Dialer races an IPv6 traversal against an IPv4 one and
+// uses whichever connects first, like happy eyeballs does for TCP. With
+// PortMap set, it first tries to skip the traversal altogether.
+type Dialer struct {
+	// Signaling provides a Signaler for each peer dialed.
+	Signaling SignalerFactory
+
+	// Options configure the Traversals that the Dialer runs.
+	Options []Option
+
+	// Timeout is how long to wait for a traversal, DefaultDialTimeout if 0.
+	Timeout time.Duration
+
+	// IdleTimeout is how long to keep the connection to a peer without open
+	// streams, DefaultIdleTimeout if 0.
+	IdleTimeout time.Duration
+
+	// Race makes the Dialer run an IPv6 and an IPv4 traversal for each
+	// connection and use the one that connects first, cancelling the other.
+	// Both traversals signal through the same Signaler, with their messages
+	// tagged by IP version (overriding any WithSessionTag in Options). The
+	// peer's Serve tells them apart and answers both.
+	Race bool
+
+	// RaceHeadStart is how long IPv6 gets to try before IPv4 starts too,
+	// DefaultRaceHeadStart if 0. IPv4 starts right away if IPv6 fails sooner.
+	RaceHeadStart time.Duration
+
+	// OnRace, if set, is called with the result of every race.
+	OnRace func(peer string, result *RaceResult)
+
+	// PortMap makes the Dialer ask the gateway to map a port (see package
+	// portmap) for each connection, and have the peer's Serve connect to that
+	// port directly, without running ICE. If the gateway doesn't map the port
+	// or the peer doesn't connect to it, the Dialer traverses as usual.
+	PortMap bool
+
+	// connect connects to the peer, by default through a traversal
+	connect  func(ctx context.Context, peer string) (net.Conn, error)
+	mutex    sync.Mutex
+	sessions map[string]*peerSession
+}
+
+// peerSession is the session with a peer, once it's been connected.
+type peerSession struct {
+	ready   chan struct{} // closed once connected
+	session *session
+	err     error
+}
+
+// DialContext dials the peer identified by address over the given network.
+// Note that HTTP clients include a port in the address.
+func (d *Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return d.doConnect(ctx, address)
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unsupported network %s", network)
+	}
+	for attempt := 0; ; attempt++ {
+		ps, err := d.session(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		st, err := ps.session.open()
+		if err == errSessionClosed && attempt == 0 {
+			// Went idle or the peer went away just now, try again with a new one
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open stream to %s: %s", address, err)
+		}
+		return st, nil
+	}
+}
+
+// Dial is like DialContext without a context.
+func (d *Dialer) Dial(network string, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// Close closes the connections to all peers, along with their streams.
+func (d *Dialer) Close() error {
+	d.mutex.Lock()
+	sessions := d.sessions
+	d.sessions = nil
+	d.mutex.Unlock()
+	for _, ps := range sessions {
+		<-ps.ready
+		if ps.session != nil {
+			ps.session.close(true)
+		}
+	}
+	return nil
+}
+
+// session gets the session with the given peer, connecting if necessary.
+// Concurrent dials to the same peer share the connection attempt.
+func (d *Dialer) session(ctx context.Context, peer string) (*peerSession, error) {
+	d.mutex.Lock()
+	if d.sessions == nil {
+		d.sessions = make(map[string]*peerSession)
+	}
+	ps := d.sessions[peer]
+	if ps == nil {
+		ps = &peerSession{ready: make(chan struct{})}
+		d.sessions[peer] = ps
+		go d.connectSession(peer, ps)
+	}
+	d.mutex.Unlock()
+
+	select {
+	case <-ps.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if ps.err != nil {
+		return nil, ps.err
+	}
+	return ps, nil
+}
+
+// connectSession connects ps, which outlives the dial that asked for it and
+// so isn't bound to its context.
+func (d *Dialer) connectSession(peer string, ps *peerSession) {
+	defer close(ps.ready)
+	conn, err := d.doConnect(context.Background(), peer)
+	if err != nil {
+		ps.err = err
+		d.forget(peer, ps)
+		return
+	}
+	ps.session = newSession(conn, d.idleTimeout(), func() {
+		d.forget(peer, ps)
+	})
+}
+
+func (d *Dialer) forget(peer string, ps *peerSession) {
+	d.mutex.Lock()
+	if d.sessions[peer] == ps {
+		delete(d.sessions, peer)
+	}
+	d.mutex.Unlock()
+}
+
+func (d *Dialer) doConnect(ctx context.Context, peer string) (net.Conn, error) {
+	if d.connect != nil {
+		return d.connect(ctx, peer)
+	}
+	return d.traverse(ctx, peer)
+}
+
+// traverse runs a traversal to the given peer and returns a conn on the
+// result.
+func (d *Dialer) traverse(ctx context.Context, peer string) (net.Conn, error) {
+	if d.Signaling == nil {
+		return nil, fmt.Errorf("Dialer has no Signaling")
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+	signaler, err := d.Signaling(ctx, peer)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to signal %s: %s", peer, err)
+	}
+	if d.PortMap {
+		pctx, done := allot(ctx, "portmap", portMapTimeout+portMapConnectTimeout, []time.Duration{d.timeout()})
+		conn, err := portMapped(pctx, peer, signaler.Send, socketsFor(d.Options))
+		done(err)
+		if err == nil {
+			signaler.Close()
+			return conn, nil
+		}
+		log.Debugf("Unable to connect to %s through a mapped port, traversing instead: %s", peer, err)
+	}
+	ctx, done := allot(ctx, "traversal", d.timeout(), nil)
+	if d.Race {
+		conn, err := d.race(ctx, peer, signaler)
+		done(err)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to race to %s: %s", peer, err)
+		}
+		return conn, nil
+	}
+	conn, err := traverseWith(OfferContext(ctx, d.timeout(), d.Options...), signaler)
+	done(err)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to traverse to %s: %s", peer, err)
+	}
+	return conn, nil
+}
+
+func (d *Dialer) timeout() time.Duration {
+	if d.Timeout > 0 {
+		return d.Timeout
+	}
+	return DefaultDialTimeout
+}
+
+func (d *Dialer) idleTimeout() time.Duration {
+	if d.IdleTimeout > 0 {
+		return d.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// Serve answers the traversal offered by a peer's Dialer through signaler and
+// returns a net.Listener that accepts the streams that the peer dials. The
+// listener stops accepting once it's closed or the peer goes away. If the
+// Dialer races, Serve answers both of its traversals and uses the one that the
+// Dialer tells it won. If the Dialer asks it to connect to a mapped port
+// instead, Serve does so, and keeps answering in case that doesn't work.
+func Serve(ctx context.Context, signaler Signaler, timeout time.Duration, opts ...Option) (net.Listener, error) {
+	conn, err := answerAll(ctx, signaler, timeout, opts)
+	if err != nil {
+		return nil, err
+	}
+	return serveConn(conn), nil
+}
+
+func serveConn(conn net.Conn) net.Listener {
+	return &streamListener{newSession(conn, 0, nil)}
+}
+
+// traverseWith exchanges t's signaling messages through signaler until t
+// connects, returning a conn on the result. Both t and signaler are closed
+// once done.
+func traverseWith(t *Traversal, signaler Signaler) (net.Conn, error) {
+	defer signaler.Close()
+	defer t.Close()
+
+	t.pump(signaler)
+	conn, _, err := t.detach(true)
+	return conn, err
+}
+
+// streamListener accepts the streams of a session.
+type streamListener struct {
+	session *session
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	st, err := l.session.accept()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (l *streamListener) Close() error {
+	l.session.close(true)
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return l.session.conn.LocalAddr()
+}
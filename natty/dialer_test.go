@@ -0,0 +1,145 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// TestDialer fetches over HTTP through a Dialer whose connections to the peer
+// are lossy local tunnels.
+func TestDialer(t *testing.T) {
+	var tunnels int32
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Big enough to take many segments
+		fmt.Fprintf(w, "%s %s", r.URL.Path, strings.Repeat("x", 20000))
+	})}
+	d := &Dialer{
+		IdleTimeout: 500 * time.Millisecond,
+		connect: func(ctx context.Context, peer string) (net.Conn, error) {
+			if !assert.Equal(t, "peer:80", peer, "Should dial the peer") {
+				return nil, fmt.Errorf("Unknown peer %s", peer)
+			}
+			atomic.AddInt32(&tunnels, 1)
+			local, remote := lossyTunnel(t)
+			go server.Serve(serveConn(remote))
+			return local, nil
+		},
+	}
+	defer d.Close()
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: d.DialContext,
+			// Dial a stream for every request
+			DisableKeepAlives: true,
+		},
+		Timeout: 20 * time.Second,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assertDialerGet(t, client, fmt.Sprintf("/%d", i))
+		}(i)
+	}
+	wg.Wait()
+	assertDialerGet(t, client, "/again")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tunnels), "Streams should share a tunnel")
+
+	time.Sleep(2 * time.Second)
+	d.mutex.Lock()
+	assert.Equal(t, 0, len(d.sessions), "Idle tunnel should have been closed")
+	d.mutex.Unlock()
+	assertDialerGet(t, client, "/later")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&tunnels), "Should open a new tunnel once idle one is closed")
+
+	_, err := d.Dial("ip4:icmp", "peer:80")
+	assert.Error(t, err, "Unsupported network should fail")
+}
+
+func TestStreamDeadline(t *testing.T) {
+	local, remote := lossyTunnel(t)
+	l := serveConn(remote)
+	defer l.Close()
+	s := newSession(local, 0, nil)
+	defer s.close(true)
+	st, err := s.open()
+	if !assert.NoError(t, err) {
+		return
+	}
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = st.Read(make([]byte, 1))
+	if assert.Error(t, err, "Read should time out") {
+		assert.True(t, err.(net.Error).Timeout(), "Error should be a timeout")
+	}
+
+	accepted, err := l.Accept()
+	if !assert.NoError(t, err, "Should accept stream") {
+		return
+	}
+	st.SetReadDeadline(time.Time{})
+	accepted.Write([]byte("hi"))
+	b := make([]byte, 2)
+	_, err = st.Read(b)
+	assert.NoError(t, err, "Read should work without deadline")
+	assert.Equal(t, "hi", string(b))
+
+	l.Close()
+	_, err = l.Accept()
+	assert.Error(t, err, "Closed listener shouldn't accept")
+	_, err = st.Read(b)
+	assert.Error(t, err, "Stream should fail once the peer closes the session")
+}
+
+func assertDialerGet(t *testing.T, client *http.Client, path string) {
+	resp, err := client.Get("http://peer" + path)
+	if !assert.NoError(t, err, "Request should succeed") {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err, "Reading the response should succeed")
+	assert.Equal(t, path+" "+strings.Repeat("x", 20000), string(body), "Should get the right response")
+}
+
+// lossyTunnel returns the two ends of a local UDP tunnel that drops 5% of the
+// packets written to it.
+func lossyTunnel(t *testing.T) (net.Conn, net.Conn) {
+	a, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	b, err := net.DialUDP("udp4", nil, a.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	a.Close()
+	a, err = net.DialUDP("udp4", a.LocalAddr().(*net.UDPAddr), b.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	return &lossyConn{a}, &lossyConn{b}
+}
+
+type lossyConn struct {
+	*net.UDPConn
+}
+
+func (c *lossyConn) Write(b []byte) (int, error) {
+	if rand.Float64() < 0.05 {
+		return len(b), nil
+	}
+	return c.UDPConn.Write(b)
+}
@@ -0,0 +1,74 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	// maxDSCP is the largest valid DSCP value (6 bits).
+	maxDSCP = 63
+
+	// noDSCP indicates that no DSCP marking was configured.
+	noDSCP = -1
+)
+
+// markable is a conn on whose socket we can set the DSCP marking.
+type markable interface {
+	syscall.Conn
+	LocalAddr() net.Addr
+}
+
+// SetDSCP sets the DSCP marking for packets sent on conn.
+func SetDSCP(conn *net.UDPConn, dscp int) error {
+	return setDSCP(conn, dscp)
+}
+
+func setDSCP(conn markable, dscp int) error {
+	if dscp < 0 || dscp > maxDSCP {
+		return fmt.Errorf("Invalid DSCP value %d", dscp)
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ip net.IP
+	switch addr := conn.LocalAddr().(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	ipv6 := ip.To4() == nil && ip != nil
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = setTOS(fd, ipv6, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("Unable to set DSCP on socket: %s", sockErr)
+	}
+	return nil
+}
+
+// MarkConn applies the media DSCP marking configured with WithDSCP to the
+// given conn, which the application typically creates from the FiveTuple. If
+// no media marking was configured, MarkConn does nothing.
+func (t *Traversal) MarkConn(conn *net.UDPConn) error {
+	if t.dscp == noDSCP {
+		return nil
+	}
+	return SetDSCP(conn, t.dscp)
+}
+
+// MarkTCPConn is like MarkConn, for a TCP conn such as those obtained from
+// Traversal.DialTCP and Traversal.ListenTCP.
+func (t *Traversal) MarkTCPConn(conn *net.TCPConn) error {
+	if t.dscp == noDSCP {
+		return nil
+	}
+	return setDSCP(conn, t.dscp)
+}
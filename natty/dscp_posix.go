@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package natty
+
+import (
+	"syscall"
+)
+
+func setTOS(fd uintptr, ipv6 bool, tos int) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
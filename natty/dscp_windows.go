@@ -0,0 +1,11 @@
+package natty
+
+import (
+	"fmt"
+)
+
+func setTOS(fd uintptr, ipv6 bool, tos int) error {
+	// Windows ignores IP_TOS unless configured through group policy (QoS
+	// policies), so there's nothing useful we can do here.
+	return fmt.Errorf("Setting DSCP is not supported on Windows")
+}
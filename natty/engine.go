@@ -0,0 +1,161 @@
+package natty
+
+import (
+	"sync"
+	"time"
+)
+
+// Engine amortizes the cost of starting natty across many traversals by keeping
+// a number of natty processes running in standby, ready to be handed out by
+// NewOffer() and NewAnswer(). This is useful for servers doing many short-lived
+// traversals, where process startup would otherwise dominate.
+//
+// natty itself handles exactly one traversal per process and has no control
+// protocol for starting another, so the Engine can't reuse a process for
+// several traversals. Instead, every time it hands out a standby process it
+// starts a replacement in the background, which takes process startup off the
+// critical path without saving the cost of it. Standby processes that exit
+// before they're handed out are replaced rather than handed out, and the
+// messages that they emit only count against the signaling rate limit (see
+// SetSignalSendRate) once they are.
+//
+// Consumers should make sure to call Close() after finishing with an Engine in
+// order to terminate its standby processes. Traversals obtained from the Engine
+// are independent of it and still need to be closed individually.
+type Engine struct {
+	opts    []Option
+	offers  chan *Traversal
+	answers chan *Traversal
+	closed  bool
+	mutex   sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// NewEngine creates an Engine that keeps standby natty processes for the given
+// number of offers and the given number of answers. All Traversals obtained from
+// the Engine are configured with the given Options, including WithTimeout,
+// which takes precedence over the timeout passed to NewOffer() and NewAnswer()
+// as it does for Offer() and Answer().
+func NewEngine(standbyOffers int, standbyAnswers int, opts ...Option) *Engine {
+	e := &Engine{
+		opts:    opts,
+		offers:  make(chan *Traversal, standbyOffers),
+		answers: make(chan *Traversal, standbyAnswers),
+	}
+	for i := 0; i < standbyOffers; i++ {
+		e.startStandby(e.offers, offerParams)
+	}
+	for i := 0; i < standbyAnswers; i++ {
+		e.startStandby(e.answers, answerParams)
+	}
+	return e
+}
+
+// NewOffer is like Offer(), except that it uses a standby natty process if one
+// is available.
+func (e *Engine) NewOffer(timeout time.Duration) *Traversal {
+	log.Trace("Offering using engine")
+	return e.take(e.offers, offerParams, timeout)
+}
+
+// NewAnswer is like Answer(), except that it uses a standby natty process if
+// one is available.
+func (e *Engine) NewAnswer(timeout time.Duration) *Traversal {
+	log.Trace("Answering using engine")
+	return e.take(e.answers, answerParams, timeout)
+}
+
+// Close terminates the Engine's standby natty processes.
+func (e *Engine) Close() error {
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.mutex.Unlock()
+
+	// Wait for any replacements that are being started
+	e.wg.Wait()
+	close(e.offers)
+	close(e.answers)
+	var firstErr error
+	for _, standby := range []chan *Traversal{e.offers, e.answers} {
+		for t := range standby {
+			err := t.Close()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (e *Engine) take(standby chan *Traversal, params []string, timeout time.Duration) *Traversal {
+	t := e.takeStandby(standby, params)
+	if t != nil {
+		log.Trace("Using standby natty")
+	} else {
+		log.Trace("No standby natty available, starting a new one")
+		t = newTraversal(timeout, e.opts)
+		t.run(params)
+	}
+	if !t.timeoutSet {
+		t.timeout = timeout
+	}
+	t.activate()
+	return t
+}
+
+// takeStandby takes a standby Traversal whose natty is still running, if there
+// is one, starting a replacement for every one that it takes. Standbys whose
+// natty already exited are closed.
+func (e *Engine) takeStandby(standby chan *Traversal, params []string) *Traversal {
+	// Replacements could exit as fast as they're started, so only try so often
+	for i := 0; i < cap(standby); i++ {
+		var t *Traversal
+		select {
+		case t = <-standby:
+		default:
+		}
+		if t == nil {
+			// None left, or the Engine has been closed
+			return nil
+		}
+		e.replenish(standby, params)
+		select {
+		case <-t.finished():
+			log.Trace("Standby natty exited, closing it")
+			t.Close()
+		default:
+			return t
+		}
+	}
+	return nil
+}
+
+// replenish starts a replacement standby process in the background.
+func (e *Engine) replenish(standby chan *Traversal, params []string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return
+	}
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		e.startStandby(standby, params)
+	}()
+}
+
+func (e *Engine) startStandby(standby chan *Traversal, params []string) {
+	t := newTraversal(0, e.opts)
+	t.standby = true
+	t.run(params)
+	select {
+	case standby <- t:
+	default:
+		// Standby is already full
+		t.Close()
+	}
+}
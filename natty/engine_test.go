@@ -0,0 +1,97 @@
+package natty
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestEngineReplacesExitedStandby(t *testing.T) {
+	binary, remove := sleepingNatty(t)
+	defer remove()
+	e := NewEngine(1, 0, WithBinary(binary))
+	defer e.Close()
+
+	// Kill the standby's natty while it waits to be handed out
+	dead := <-e.offers
+	assert.NotEqual(t, 0, nattyPid(dead), "Standby natty should have started")
+	dead.cmdMutex.Lock()
+	dead.cmd.Process.Kill()
+	dead.cmdMutex.Unlock()
+	select {
+	case <-dead.finished():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Killed natty should have finished")
+	}
+	e.offers <- dead
+
+	tr := e.NewOffer(time.Minute)
+	defer tr.Close()
+	assert.True(t, tr != dead, "Standby whose natty exited shouldn't be handed out")
+	assert.NotEqual(t, 0, nattyPid(tr), "Handed out natty should have started")
+	select {
+	case <-tr.finished():
+		t.Error("Handed out natty should still be running")
+	default:
+	}
+	select {
+	case <-dead.closedCh:
+	default:
+		t.Error("Standby whose natty exited should have been closed")
+	}
+}
+
+func TestEngineTimeout(t *testing.T) {
+	binary, remove := sleepingNatty(t)
+	defer remove()
+	e := NewEngine(1, 1, WithBinary(binary))
+	defer e.Close()
+	offer := e.NewOffer(time.Minute)
+	defer offer.Close()
+	assert.Equal(t, time.Minute, offer.timeout, "Standby should get NewOffer's timeout")
+
+	e = NewEngine(1, 1, WithBinary(binary), WithTimeout(time.Second))
+	defer e.Close()
+	answer := e.NewAnswer(time.Minute)
+	defer answer.Close()
+	assert.Equal(t, time.Second, answer.timeout, "WithTimeout should take precedence for standbys")
+	e.Close()
+	fresh := e.NewAnswer(time.Minute)
+	defer fresh.Close()
+	assert.Equal(t, time.Second, fresh.timeout, "WithTimeout should take precedence without standbys")
+}
+
+func TestEngineStandbySignalRate(t *testing.T) {
+	binary, remove := scriptedNatty(t, `echo '{"candidate":"candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host generation 0","sdpMid":"data","sdpMLineIndex":0}'
+exec sleep 30`, nattyTestFlags...)
+	defer remove()
+	SetSignalSendRate(0.01, 1)
+	defer SetSignalSendRate(0, 0)
+	SetSignalMaxQueueDelay(time.Second)
+	defer SetSignalMaxQueueDelay(DefaultSignalMaxQueueDelay)
+
+	e := NewEngine(1, 0, WithBinary(binary))
+	defer e.Close()
+	// Give the standby natty time to emit its candidate
+	time.Sleep(250 * time.Millisecond)
+	other := newTraversal(0, nil)
+	other.initChannels()
+	assert.True(t, other.emitMsg(append(getMsgBuf(), "msg"...)), "Standby shouldn't have used up the burst")
+
+	tr := e.NewOffer(time.Minute)
+	defer tr.Close()
+	SetSignalSendRate(0, 0)
+	msgs := make(chan string, 1)
+	go func() {
+		msg, _ := tr.NextMsgOut()
+		msgs <- msg
+	}()
+	select {
+	case msg := <-msgs:
+		assert.True(t, strings.Contains(msg, "192.168.1.160"), "Handed out standby should emit its candidate")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handed out standby should have emitted its candidate")
+	}
+}
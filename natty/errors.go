@@ -0,0 +1,171 @@
+package natty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// stderrTailSize is how much of the end of natty's stderr an ExitError
+	// includes.
+	stderrTailSize = 8192
+)
+
+var (
+	// exitGracePeriod is how long natty gets to exit by itself once it has
+	// closed its stdout, before it's killed.
+	exitGracePeriod = time.Second
+
+	// ErrTimeout is what a Traversal fails with if it doesn't find a
+	// FiveTuple within its timeout, for example because the peer never
+	// answered over the signaling channel.
+	ErrTimeout = errors.New("Timed out waiting for five-tuple")
+
+	// ErrClosed is what a Traversal's errors unwrap to once it has been
+	// closed, for example FiveTuple's if it was closed before finding a
+	// FiveTuple, TryMsgIn's and a second Close's.
+	ErrClosed = errors.New("Traversal closed")
+
+	// ErrNoConnectivity is what errors that natty reports unwrap to, which
+	// mean that it gave up on establishing connectivity with the peer.
+	// Retrying may work.
+	ErrNoConnectivity = errors.New("No connectivity established")
+
+	// ErrBinaryNotFound is what a Traversal's error unwraps to if the natty
+	// executable doesn't exist or isn't executable (see WithBinary), in which
+	// case retrying won't help.
+	ErrBinaryNotFound = errors.New("natty executable not found")
+
+	// ErrUnsupportedOption is what a Traversal's error unwraps to if it was
+	// given an option that the natty executable doesn't support (see
+	// WithBinary), in which case retrying won't help either.
+	ErrUnsupportedOption = errors.New("Option not supported by natty executable")
+)
+
+// ExitError is what a Traversal fails with if natty exits before finding a
+// FiveTuple, for example because it crashed.
+type ExitError struct {
+	// Code is natty's exit code, or -1 if it was killed by a signal.
+	Code int
+
+	// Stderr is the tail of what natty wrote to stderr.
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("natty exited with code %d", e.Code)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+// ProcessError is another name for ExitError, the error for the natty
+// process failing.
+type ProcessError = ExitError
+
+// timeoutError is what a Traversal fails with once the context passed to
+// FiveTupleContext times out. It's both ErrTimeout and the context's error.
+type timeoutError struct {
+	ctxErr error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrTimeout, e.ctxErr)
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.ctxErr
+}
+
+// contextError returns the error for ctx being done.
+func contextError(ctx context.Context) error {
+	err := ctx.Err()
+	if err == context.DeadlineExceeded {
+		return &timeoutError{err}
+	}
+	return err
+}
+
+// kindError is an error with a message of its own that unwraps to one of the
+// sentinel errors above, so that errors.Is tells what kind of error it is.
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+// startError returns the error for natty failing to start.
+func startError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) || errors.Is(err, exec.ErrNotFound) {
+		return &kindError{fmt.Sprintf("Unable to start natty: %s", err), ErrBinaryNotFound}
+	}
+	return err
+}
+
+// exitError returns the error for natty having exited before finding a
+// FiveTuple, once natty has been reaped.
+func (t *Traversal) exitError() error {
+	code := 0
+	switch err := t.reapNatty(exitGracePeriod).(type) {
+	case nil:
+	case *exec.ExitError:
+		code = err.ExitCode()
+	default:
+		code = -1
+	}
+	return &ExitError{Code: code, Stderr: t.stderrTail.String()}
+}
+
+// Stderr returns the end of what natty has written to stderr (up to 8KB), for
+// example for logging why a Traversal failed. It's there whether or not
+// natty's output is traced.
+func (t *Traversal) Stderr() string {
+	return t.stderrTail.String()
+}
+
+// tailBuffer is an io.Writer that keeps the last stderrTailSize bytes written
+// to it.
+type tailBuffer struct {
+	buf   []byte
+	mutex sync.Mutex
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > stderrTailSize {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-stderrTailSize:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) reset() {
+	b.mutex.Lock()
+	b.buf = nil
+	b.mutex.Unlock()
+}
+
+func (b *tailBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return string(b.buf)
+}
@@ -0,0 +1,71 @@
+package natty
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestExitError(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	tr.cmd = exec.Command("sh", "-c", "echo crashing >&2; exit 3")
+	tr.cmd.Stderr = &tr.stderrTail
+	if !assert.NoError(t, tr.cmd.Start()) {
+		return
+	}
+	tr.errCh <- io.EOF
+	_, err := tr.waitForFiveTuple()
+	var exitErr *ExitError
+	if assert.True(t, errors.As(err, &exitErr), "natty exiting should fail the Traversal with an ExitError") {
+		assert.Equal(t, 3, exitErr.Code)
+		assert.Equal(t, "crashing\n", exitErr.Stderr)
+		assert.Equal(t, "natty exited with code 3: crashing", exitErr.Error())
+	}
+	assert.Equal(t, "crashing\n", tr.Stderr())
+	var processErr *ProcessError
+	assert.True(t, errors.As(err, &processErr), "ExitError should be a ProcessError")
+}
+
+func TestStderrTail(t *testing.T) {
+	var tail tailBuffer
+	tail.Write([]byte(strings.Repeat("a", stderrTailSize)))
+	tail.Write([]byte("the end"))
+	assert.Len(t, tail.String(), stderrTailSize)
+	assert.True(t, strings.HasSuffix(tail.String(), "the end"))
+}
+
+func TestErrorKinds(t *testing.T) {
+	err := startError(exec.ErrNotFound)
+	assert.True(t, errors.Is(err, ErrBinaryNotFound), "Missing executable should be ErrBinaryNotFound")
+	other := errors.New("other")
+	assert.Equal(t, other, startError(other))
+
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	tr.stdoutbuf = bufio.NewReader(strings.NewReader(`{"type":"error","message":"ICE failed"}` + "\n"))
+	tr.iowg.Add(1)
+	go tr.processStdout()
+	<-tr.msgOutCh
+	err = <-tr.errCh
+	assert.True(t, errors.Is(err, ErrNoConnectivity), "Error reported by natty should be ErrNoConnectivity")
+	assert.Equal(t, "Error reported by natty: ICE failed", err.Error())
+}
+
+func TestErrClosed(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	assert.NoError(t, tr.Close())
+	assert.Equal(t, ErrClosed, tr.Close(), "Closing again should fail")
+	assert.Equal(t, ErrClosed, tr.TryMsgIn(`{"type":"offer"}`))
+	_, err := tr.waitForFiveTuple()
+	assert.Equal(t, ErrClosed, err)
+	_, err = tr.WaitGathering(context.Background())
+	assert.True(t, errors.Is(err, ErrClosed), "Gathering should fail with ErrClosed")
+}
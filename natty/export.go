@@ -0,0 +1,274 @@
+package natty
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// ExportLifetime is how long the state from PeerConnection.Export can be
+	// imported. Beyond that, the NAT has likely dropped the mapping and the
+	// peer has given up on us anyway.
+	ExportLifetime = 1 * time.Minute
+
+	// exportVersion is the first byte of exported state
+	exportVersion = byte(1)
+)
+
+var (
+	peerResume    = []byte("natty-peer-resume")
+	peerResumeAck = []byte("natty-peer-resume-ack")
+
+	// peerControlLen is the length of the longest packet of the
+	// PeerConnection's own that travels over the conn: a resume probe with the
+	// sender's nonce.
+	peerControlLen = len(peerResume) + 8
+
+	exportKey      []byte
+	exportKeyMutex sync.RWMutex
+)
+
+// SetExportKey sets the key with which PeerConnection.Export protects the
+// integrity of the state that it exports, and with which Import checks it.
+// The key needs to survive the restart between Export and Import, so it
+// usually comes from the application's configuration.
+func SetExportKey(key []byte) {
+	exportKeyMutex.Lock()
+	exportKey = append([]byte{}, key...)
+	exportKeyMutex.Unlock()
+}
+
+func getExportKey() ([]byte, error) {
+	exportKeyMutex.RLock()
+	defer exportKeyMutex.RUnlock()
+	if len(exportKey) == 0 {
+		return nil, fmt.Errorf("No export key, call SetExportKey first")
+	}
+	return exportKey, nil
+}
+
+// peerState is what PeerConnection.Export exports.
+type peerState struct {
+	Local       string        `json:"local"`
+	Remote      string        `json:"remote"`
+	Offering    bool          `json:"offering"`
+	Nonce       uint64        `json:"nonce"`
+	PeerNonce   uint64        `json:"peerNonce"` // doubles as the resume token
+	Generation  int           `json:"generation"`
+	Timeout     time.Duration `json:"timeout"`
+	Retries     int           `json:"retries"`
+	AutoRepunch bool          `json:"autoRepunch"`
+	Expires     int64         `json:"expires"` // in unix nanos
+}
+
+// Export captures the state of a connected PeerConnection so that, after a
+// restart, Import can pick up the connection where it left off without a new
+// traversal, as long as the NAT still has the mapping. The state covers the
+// FiveTuple, the role and nonces that identify us to the peer, the generation
+// of the current traversal and the PeerConfig's Timeout, Retries and
+// AutoRepunch. It's protected with the key from SetExportKey and expires after
+// ExportLifetime. Once exported, the PeerConnection no longer tells the peer
+// goodbye when it's closed, so that the peer keeps its end of the connection.
+func (pc *PeerConnection) Export() ([]byte, error) {
+	key, err := getExportKey()
+	if err != nil {
+		return nil, err
+	}
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.state != PeerConnected {
+		return nil, fmt.Errorf("Unable to export %s PeerConnection", pc.state)
+	}
+	state := &peerState{
+		Local:       pc.current.LocalAddr().String(),
+		Remote:      pc.current.RemoteAddr().String(),
+		Offering:    pc.offering,
+		Nonce:       pc.nonce,
+		PeerNonce:   pc.peerNonce,
+		Generation:  pc.generation,
+		Timeout:     pc.config.Timeout,
+		Retries:     pc.config.Retries,
+		AutoRepunch: pc.config.AutoRepunch,
+		Expires:     time.Now().Add(ExportLifetime).UnixNano(),
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	pc.exported = true
+	msg := append([]byte{exportVersion}, b...)
+	return append(msg, exportMAC(key, msg)...), nil
+}
+
+// Import recreates a PeerConnection from the state exported by
+// PeerConnection.Export, signaling through signaler. It binds the local
+// address of the exported FiveTuple again and probes the peer, resuming the
+// connection with keepalives if the peer answers. Otherwise, it reconnects
+// with a new traversal. The peer needs to be reading from its conn to answer
+// the probe, which is normally the case. Import returns once connected, or
+// with an error if the state is invalid or reconnecting fails too. Options
+// can't be exported, so the PeerConnection runs its traversals without any;
+// use ImportWithConfig to supply them.
+func Import(data []byte, signaler Signaler) (*PeerConnection, error) {
+	return importPeerConnection(data, signaler, nil, nil)
+}
+
+// ImportWithConfig is like Import, except that the PeerConnection uses the
+// given config instead of the settings that were exported.
+func ImportWithConfig(data []byte, signaler Signaler, config *PeerConfig) (*PeerConnection, error) {
+	return importPeerConnection(data, signaler, config, nil)
+}
+
+// importPeerConnection imports a PeerConnection, passing it to setup (if set)
+// before it starts.
+func importPeerConnection(data []byte, signaler Signaler, config *PeerConfig, setup func(pc *PeerConnection)) (*PeerConnection, error) {
+	state, err := openPeerState(data)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &PeerConfig{Timeout: state.Timeout, Retries: state.Retries, AutoRepunch: state.AutoRepunch}
+	}
+	pc := NewPeerConnection(signaler, config)
+	pc.nonce = state.Nonce
+	pc.peerNonce = state.PeerNonce
+	pc.roleKnown = true
+	pc.offering = state.Offering
+	pc.generation = state.Generation
+	close(pc.peerHelloCh)
+	if setup != nil {
+		setup(pc)
+	}
+
+	pc.mutex.Lock()
+	pc.setStateLocked(PeerConnecting)
+	pc.mux = newSignalMux(pc.signaler, nil, nil)
+	pc.mutex.Unlock()
+	pc.dispatch()
+	pc.mux.setLimits(0, pc.onControl)
+
+	err = pc.resume(state)
+	if err == nil {
+		log.Debugf("Resumed connection to peer from %s to %s", state.Local, state.Remote)
+		return pc, nil
+	}
+	log.Debugf("Unable to resume connection to peer, reconnecting: %s", err)
+	ctx, cancel := context.WithTimeout(pc.ctx, time.Duration(pc.config.retries()+1)*(pc.config.timeout()+peerConfirmTimeout))
+	defer cancel()
+	if pc.offering {
+		err = pc.offer(ctx)
+	} else {
+		// Have the offerer punch a new hole
+		pc.send(&peerMsg{Step: peerRepunch, Generation: state.Generation})
+		err = pc.awaitConnected(ctx)
+	}
+	if err != nil {
+		pc.fail()
+		pc.Close()
+		return nil, fmt.Errorf("Unable to reconnect to peer: %s", err)
+	}
+	return pc, nil
+}
+
+// resume dials the exported FiveTuple again and makes sure that the peer is
+// still there.
+func (pc *PeerConnection) resume(state *peerState) error {
+	generation := state.Generation
+	t := newTraversal(0, pc.config.Options)
+	conn, _, err := t.dialPair(&FiveTuple{Proto: UDP, Local: state.Local, Remote: state.Remote}, func() {
+		pc.lost(generation)
+	})
+	if err != nil {
+		return err
+	}
+	err = probeResume(conn, pc.nonce)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	pc.install(generation, nil, conn)
+	return nil
+}
+
+// probeResume sends probes with our nonce until the peer acknowledges one.
+func probeResume(conn net.Conn, nonce uint64) error {
+	defer conn.SetReadDeadline(time.Time{})
+	probe := make([]byte, peerControlLen)
+	binary.BigEndian.PutUint64(probe[copy(probe, peerResume):], nonce)
+	b := make([]byte, peerControlLen)
+	deadline := time.Now().Add(peerConfirmTimeout)
+	for time.Now().Before(deadline) {
+		_, err := conn.Write(probe)
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(peerConfirmInterval))
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				break
+			}
+			if bytes.Equal(b[:n], peerResumeAck) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Peer didn't answer probe")
+}
+
+// answerResume acknowledges packet on conn if it's a probe from our peer,
+// returning whether it was a probe.
+func (pc *PeerConnection) answerResume(conn net.Conn, packet []byte) bool {
+	if len(packet) != peerControlLen || !bytes.HasPrefix(packet, peerResume) {
+		return false
+	}
+	pc.mutex.Lock()
+	peerNonce := pc.peerNonce
+	pc.mutex.Unlock()
+	if binary.BigEndian.Uint64(packet[len(peerResume):]) != peerNonce {
+		log.Debug("Ignoring probe from someone other than our peer")
+		return true
+	}
+	for i := 0; i < portMapAckRepeats; i++ {
+		conn.Write(peerResumeAck)
+	}
+	return true
+}
+
+// openPeerState checks and decodes exported state.
+func openPeerState(data []byte) (*peerState, error) {
+	key, err := getExportKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 1+sha256.Size || data[0] != exportVersion {
+		return nil, fmt.Errorf("Not exported PeerConnection state")
+	}
+	msg := data[:len(data)-sha256.Size]
+	if !hmac.Equal(data[len(msg):], exportMAC(key, msg)) {
+		return nil, fmt.Errorf("Exported state has been tampered with or was exported with a different key")
+	}
+	state := &peerState{}
+	err = json.Unmarshal(msg[1:], state)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode exported state: %s", err)
+	}
+	if time.Now().UnixNano() > state.Expires {
+		return nil, fmt.Errorf("Exported state expired at %s", time.Unix(0, state.Expires))
+	}
+	return state, nil
+}
+
+func exportMAC(key []byte, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,182 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// TestExportImport restarts the offering end of a connection, which picks up
+// the existing hole.
+func TestExportImport(t *testing.T) {
+	SetExportKey([]byte("test key"))
+	fabric := &fakeFabric{}
+	pc, peer, signaler := connectRestartable(t, fabric)
+	if pc == nil {
+		return
+	}
+	defer peer.Close()
+
+	data, err := pc.Export()
+	if !assert.NoError(t, err) {
+		return
+	}
+	pc.Close()
+	signaler.Close()
+
+	// The application keeps reading from the peer
+	received := make(chan string, 10)
+	go func() {
+		b := make([]byte, 100)
+		for {
+			n, err := peer.Conn().Read(b)
+			if err != nil {
+				return
+			}
+			received <- string(b[:n])
+		}
+	}()
+
+	imported, err := importPeerConnection(data, signaler.restarted(), nil, fabric.attach)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer imported.Close()
+	assert.Equal(t, PeerConnected, imported.State())
+	assert.Equal(t, PeerConnected, peer.State(), "Peer shouldn't have noticed the restart")
+	_, err = imported.Conn().Write([]byte("still here"))
+	assert.NoError(t, err)
+	select {
+	case msg := <-received:
+		assert.Equal(t, "still here", msg)
+	case <-time.After(time.Second):
+		t.Fatal("Traffic didn't continue after import")
+	}
+	assert.Equal(t, []int{1}, fabric.generations(), "Shouldn't have traversed again")
+}
+
+// TestImportReconnect imports state whose hole doesn't work anymore, which
+// needs a new traversal.
+func TestImportReconnect(t *testing.T) {
+	defer func(orig time.Duration) {
+		peerConfirmTimeout = orig
+	}(peerConfirmTimeout)
+	peerConfirmTimeout = 500 * time.Millisecond
+	SetExportKey([]byte("test key"))
+	fabric := &fakeFabric{}
+	pc, peer, signaler := connectRestartable(t, fabric)
+	if pc == nil {
+		return
+	}
+	defer peer.Close()
+
+	data, err := pc.Export()
+	if !assert.NoError(t, err) {
+		return
+	}
+	pc.Close()
+	signaler.Close()
+
+	// Nobody reads on the peer's end, so the probe goes unanswered
+	imported, err := importPeerConnection(data, signaler.restarted(), nil, fabric.attach)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer imported.Close()
+	assert.Equal(t, []int{1, 2}, fabric.generations(), "Should have traversed again")
+	assertConnected(t, imported.Conn(), peer.Conn())
+}
+
+func TestImportInvalid(t *testing.T) {
+	SetExportKey([]byte("test key"))
+	fabric := &fakeFabric{}
+	pc, peer, signaler := connectRestartable(t, fabric)
+	if pc == nil {
+		return
+	}
+	defer peer.Close()
+	defer pc.Close()
+	data, err := pc.Export()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tampered := append([]byte{}, data...)
+	tampered[10] ^= 1
+	_, err = Import(tampered, signaler.restarted())
+	assert.Error(t, err, "Tampered state shouldn't import")
+
+	SetExportKey([]byte("other key"))
+	_, err = Import(data, signaler.restarted())
+	assert.Error(t, err, "State exported with a different key shouldn't import")
+
+	SetExportKey([]byte("test key"))
+	state, err := openPeerState(data)
+	if assert.NoError(t, err) {
+		assert.True(t, time.Until(time.Unix(0, state.Expires)) <= ExportLifetime)
+	}
+
+	_, err = NewPeerConnection(newChanSignaler(), nil).Export()
+	assert.Error(t, err, "Unconnected PeerConnection shouldn't export")
+}
+
+// connectRestartable connects a PeerConnection to a peer through fabric,
+// returning the offering one along with its Signaler, which can be restarted.
+func connectRestartable(t *testing.T, fabric *fakeFabric) (*PeerConnection, *PeerConnection, *restartableSignaler) {
+	inner := newChanSignaler()
+	signaler := &restartableSignaler{chanSignaler: inner, closedCh: make(chan struct{})}
+	peerSignaler := &chanSignaler{in: inner.out, out: inner.in}
+	config := &PeerConfig{AutoRepunch: true, Timeout: 5 * time.Second}
+	pc, peer := NewPeerConnection(signaler, config), NewPeerConnection(peerSignaler, config)
+	// Make sure that pc offers
+	pc.nonce, peer.nonce = 2, 1
+	fabric.attach(pc)
+	fabric.attach(peer)
+
+	errs := make(chan error, 2)
+	for _, p := range []*PeerConnection{pc, peer} {
+		go func(p *PeerConnection) {
+			errs <- p.Connect(context.Background())
+		}(p)
+	}
+	for i := 0; i < 2; i++ {
+		if !assert.NoError(t, <-errs, "Should connect") {
+			pc.Close()
+			peer.Close()
+			return nil, nil, nil
+		}
+	}
+	return pc, peer, signaler
+}
+
+// restartableSignaler is a chanSignaler that stops receiving once closed, so
+// that a restarted one can take over its channels.
+type restartableSignaler struct {
+	*chanSignaler
+	closedCh chan struct{}
+}
+
+func (s *restartableSignaler) Receive() ([]byte, error) {
+	select {
+	case msg := <-s.in:
+		return msg, nil
+	case <-s.closedCh:
+		return nil, fmt.Errorf("Closed")
+	}
+}
+
+func (s *restartableSignaler) Close() error {
+	select {
+	case <-s.closedCh:
+	default:
+		close(s.closedCh)
+	}
+	return nil
+}
+
+func (s *restartableSignaler) restarted() *restartableSignaler {
+	return &restartableSignaler{chanSignaler: s.chanSignaler, closedCh: make(chan struct{})}
+}
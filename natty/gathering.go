@@ -0,0 +1,287 @@
+package natty
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// gatheringQuietPeriod is how long after the last trickled candidate we
+	// consider gathering complete if natty doesn't say so explicitly.
+	gatheringQuietPeriod = 2 * time.Second
+
+	endOfCandidates = "a=end-of-candidates"
+)
+
+// Candidate is an ICE candidate gathered by natty.
+type Candidate struct {
+	// Foundation groups candidates with the same type, base and STUN/TURN
+	// server.
+	Foundation string
+
+	// Component is the ICE component (1 for RTP/data).
+	Component int
+
+	// Protocol is the transport protocol, udp or tcp.
+	Protocol string
+
+	// Priority is the candidate's ICE priority.
+	Priority uint32
+
+	// Address is the candidate's host:port.
+	Address string
+
+	// Type is host, srflx, prflx or relay.
+	Type string
+
+	// RelatedAddress is the host:port from which a srflx, prflx or relay
+	// candidate was derived, if known.
+	RelatedAddress string
+
+	// TCPType is active, passive or so (simultaneous-open) for a tcp
+	// candidate (RFC 6544), empty for udp.
+	TCPType string
+}
+
+func (c *Candidate) String() string {
+	return fmt.Sprintf("%s %s %s", c.Type, c.Protocol, c.Address)
+}
+
+// ICELine formats the candidate as a standard ICE candidate attribute (RFC 5245
+// section 15.1), as exchanged by WebRTC implementations in trickle ICE, for
+// example "candidate:2 1 udp 1686052607 203.0.113.7 55285 typ srflx raddr
+// 192.168.1.160 rport 55285". Like browsers do, srflx, prflx and relay
+// candidates whose related address isn't known get "raddr 0.0.0.0 rport 0"
+// (or "raddr :: rport 0" for IPv6), since the attribute is mandatory for them.
+// TCP candidates end with their tcptype.
+func (c *Candidate) ICELine() string {
+	host, port, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		host, port = c.Address, "0"
+	}
+	line := fmt.Sprintf("candidate:%s %d %s %d %s %s typ %s", c.Foundation, c.Component, c.Protocol, c.Priority, host, port, c.Type)
+	if c.Type != "host" {
+		rhost, rport, err := net.SplitHostPort(c.RelatedAddress)
+		if err != nil {
+			rhost, rport = "0.0.0.0", "0"
+			if strings.Contains(host, ":") {
+				rhost = "::"
+			}
+		}
+		line += fmt.Sprintf(" raddr %s rport %s", rhost, rport)
+	}
+	if c.TCPType != "" {
+		line += " tcptype " + c.TCPType
+	}
+	return line
+}
+
+// parseCandidate parses an ICE candidate attribute, with or without its
+// "a=" and "candidate:" prefixes.
+func parseCandidate(attr string) (*Candidate, error) {
+	attr = strings.TrimPrefix(strings.TrimSpace(attr), "a=")
+	parts := strings.Fields(strings.TrimPrefix(attr, "candidate:"))
+	if len(parts) < 8 || parts[6] != "typ" {
+		return nil, fmt.Errorf("Unexpected candidate attributes: %s", attr)
+	}
+	component, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("Bad component in candidate %s: %s", attr, err)
+	}
+	priority, err := strconv.ParseUint(parts[3], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Bad priority in candidate %s: %s", attr, err)
+	}
+	c := &Candidate{
+		Foundation: parts[0],
+		Component:  component,
+		Protocol:   strings.ToLower(parts[2]),
+		Priority:   uint32(priority),
+		Address:    net.JoinHostPort(parts[4], parts[5]),
+		Type:       parts[7],
+	}
+	var raddr, rport string
+	for i := 8; i+1 < len(parts); i += 2 {
+		switch parts[i] {
+		case "raddr":
+			raddr = parts[i+1]
+		case "rport":
+			rport = parts[i+1]
+		case "tcptype":
+			c.TCPType = parts[i+1]
+		}
+	}
+	if raddr != "" && rport != "" {
+		c.RelatedAddress = net.JoinHostPort(raddr, rport)
+	}
+	return c, nil
+}
+
+// gatherer keeps track of the local candidates that natty gathers and
+// of whether gathering has finished.
+type gatherer struct {
+	candidates []*Candidate
+	err        error
+	doneCh     chan struct{}
+	done       bool
+	doneAt     time.Time // when gathering finished successfully
+	quietTimer *time.Timer
+	mutex      sync.Mutex
+}
+
+func newGatherer() *gatherer {
+	return &gatherer{doneCh: make(chan struct{})}
+}
+
+// track records the local candidates in msg, an outbound message from natty.
+// Gathering is finished once natty sends a session description containing
+// candidates (meaning that it gathered fully before sending), signals the end
+// of candidates, or stops trickling candidates for gatheringQuietPeriod.
+func (gt *gatherer) track(msg []byte) {
+	gt.mutex.Lock()
+	defer gt.mutex.Unlock()
+	if gt.done {
+		return
+	}
+
+	if isCandidate(msg) {
+		cm := &candidateMsg{}
+		err := json.Unmarshal(msg, cm)
+		if err != nil {
+			log.Tracef("Unable to parse candidate message %s: %s", msg, err)
+			return
+		}
+		if cm.Candidate == "" {
+			// Empty candidate means end of candidates
+			gt.finishLocked(nil)
+			return
+		}
+		gt.add(cm.Candidate)
+		if gt.quietTimer == nil {
+			gt.quietTimer = time.AfterFunc(gatheringQuietPeriod, func() {
+				gt.finish(nil)
+			})
+		} else {
+			gt.quietTimer.Reset(gatheringQuietPeriod)
+		}
+		return
+	}
+
+	sdp := sdpOf(msg)
+	foundCandidates := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=candidate:") {
+			gt.add(line)
+			foundCandidates = true
+		} else if line == endOfCandidates {
+			gt.finishLocked(nil)
+			return
+		}
+	}
+	if foundCandidates {
+		gt.finishLocked(nil)
+	}
+}
+
+func (gt *gatherer) add(attr string) {
+	c, err := parseCandidate(attr)
+	if err != nil {
+		log.Trace(err)
+		return
+	}
+	gt.candidates = append(gt.candidates, c)
+}
+
+// finish marks gathering as finished, recording err if gathering failed.
+func (gt *gatherer) finish(err error) {
+	gt.mutex.Lock()
+	defer gt.mutex.Unlock()
+	gt.finishLocked(err)
+}
+
+func (gt *gatherer) finishLocked(err error) {
+	if gt.done {
+		return
+	}
+	gt.done = true
+	gt.err = err
+	if err == nil {
+		gt.doneAt = time.Now()
+	}
+	if gt.quietTimer != nil {
+		gt.quietTimer.Stop()
+	}
+	close(gt.doneCh)
+}
+
+// reset forgets about the last gathering, so that natty's next run gathers
+// anew.
+func (gt *gatherer) reset() {
+	gt.mutex.Lock()
+	defer gt.mutex.Unlock()
+	if gt.quietTimer != nil {
+		gt.quietTimer.Stop()
+		gt.quietTimer = nil
+	}
+	gt.candidates, gt.err = nil, nil
+	gt.done, gt.doneAt = false, time.Time{}
+	gt.doneCh = make(chan struct{})
+}
+
+// finished returns a channel that's closed once gathering has finished.
+func (gt *gatherer) finished() <-chan struct{} {
+	gt.mutex.Lock()
+	defer gt.mutex.Unlock()
+	return gt.doneCh
+}
+
+// finishedAt returns when gathering finished successfully, or the zero time if
+// it hasn't.
+func (gt *gatherer) finishedAt() time.Time {
+	gt.mutex.Lock()
+	defer gt.mutex.Unlock()
+	return gt.doneAt
+}
+
+func (gt *gatherer) result() ([]*Candidate, error) {
+	gt.mutex.Lock()
+	defer gt.mutex.Unlock()
+	return append([]*Candidate{}, gt.candidates...), gt.err
+}
+
+// sdpOf extracts the session description from an offer or answer message,
+// returning "" for anything else.
+func sdpOf(msg []byte) string {
+	sm := &struct {
+		SDP string `json:"sdp"`
+	}{}
+	err := json.Unmarshal(msg, sm)
+	if err != nil {
+		return ""
+	}
+	return sm.SDP
+}
+
+// WaitGathering blocks until natty has finished gathering local candidates, and
+// returns them, without waiting for the connection to be established. This
+// allows gathering to overlap with other setup. An Answerer only starts
+// gathering once it has received the offer. WaitGathering returns an error if
+// ctx is done, the Traversal is closed or the Traversal fails before gathering
+// finishes.
+func (t *Traversal) WaitGathering(ctx context.Context) ([]*Candidate, error) {
+	select {
+	case <-t.gathering.finished():
+		return t.gathering.result()
+	case <-t.closedCh:
+		return nil, &kindError{"Traversal closed before gathering finished", ErrClosed}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
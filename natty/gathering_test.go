@@ -0,0 +1,113 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+const (
+	hostCandidate  = `{"candidate":"candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host generation 0","sdpMid":"data","sdpMLineIndex":0}`
+	srflxCandidate = `{"candidate":"candidate:2 1 udp 1686052607 203.0.113.7 55285 typ srflx raddr 192.168.1.160 rport 55285 generation 0","sdpMid":"data","sdpMLineIndex":0}`
+	endCandidate   = `{"candidate":"","sdpMid":"data","sdpMLineIndex":0}`
+)
+
+func TestParseCandidate(t *testing.T) {
+	c, err := parseCandidate("a=candidate:2 1 UDP 1686052607 2001:db8::7 55285 typ srflx raddr 2001:db8::1 rport 55286 generation 0")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Candidate{
+			Foundation:     "2",
+			Component:      1,
+			Protocol:       "udp",
+			Priority:       1686052607,
+			Address:        "[2001:db8::7]:55285",
+			Type:           "srflx",
+			RelatedAddress: "[2001:db8::1]:55286",
+		}, c)
+	}
+	_, err = parseCandidate("candidate:1 1 udp")
+	assert.Error(t, err, "Truncated candidate shouldn't parse")
+}
+
+func TestICELine(t *testing.T) {
+	for _, line := range []string{
+		"candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host",
+		"candidate:2 1 udp 1686052607 2001:db8::7 55285 typ srflx raddr 2001:db8::1 rport 55286",
+		"candidate:3 1 udp 41885439 203.0.113.9 60000 typ relay raddr 203.0.113.7 rport 55285",
+		"candidate:5 1 tcp 1518280447 192.168.1.160 9 typ host tcptype active",
+		"candidate:6 1 tcp 1518214911 203.0.113.7 55286 typ srflx raddr 192.168.1.160 rport 55286 tcptype passive",
+	} {
+		c, err := parseCandidate(line)
+		if assert.NoError(t, err) {
+			assert.Equal(t, line, c.ICELine(), "ICE line should round trip")
+		}
+	}
+
+	c := &Candidate{Foundation: "4", Component: 1, Protocol: "udp", Priority: 100, Address: "203.0.113.7:55285", Type: "prflx"}
+	assert.Equal(t, "candidate:4 1 udp 100 203.0.113.7 55285 typ prflx raddr 0.0.0.0 rport 0", c.ICELine(), "Missing related address should be filled in")
+	c.Address = "[2001:db8::7]:55285"
+	assert.Equal(t, "candidate:4 1 udp 100 2001:db8::7 55285 typ prflx raddr :: rport 0", c.ICELine(), "Missing IPv6 related address should be filled in")
+}
+
+func TestWaitGatheringTrickle(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.gathering.track([]byte(`{"type":"offer","sdp":"v=0\r\n"}`))
+	tr.gathering.track([]byte(hostCandidate))
+	tr.gathering.track([]byte(srflxCandidate))
+	assertGatheringPending(t, tr)
+	tr.gathering.track([]byte(endCandidate))
+
+	candidates, err := tr.WaitGathering(context.Background())
+	if assert.NoError(t, err) && assert.Len(t, candidates, 2) {
+		assert.Equal(t, "host udp 192.168.1.160:55285", candidates[0].String())
+		assert.Equal(t, "srflx udp 203.0.113.7:55285", candidates[1].String())
+		assert.Equal(t, "192.168.1.160:55285", candidates[1].RelatedAddress)
+	}
+}
+
+func TestWaitGatheringFull(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.gathering.track([]byte(`{"type":"offer","sdp":"v=0\r\na=candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host generation 0\r\n"}`))
+	candidates, err := tr.WaitGathering(context.Background())
+	if assert.NoError(t, err) && assert.Len(t, candidates, 1) {
+		assert.Equal(t, "host", candidates[0].Type)
+	}
+}
+
+func TestWaitGatheringQuietPeriod(t *testing.T) {
+	tr := newTraversal(0, nil)
+	start := time.Now()
+	tr.gathering.track([]byte(hostCandidate))
+	candidates, err := tr.WaitGathering(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, candidates, 1)
+	assert.True(t, time.Now().Sub(start) >= gatheringQuietPeriod, "Gathering should finish after quiet period")
+}
+
+func TestWaitGatheringFailures(t *testing.T) {
+	tr := newTraversal(0, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := tr.WaitGathering(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "WaitGathering should stop when context is done")
+
+	tr.gathering.finish(fmt.Errorf("Natty failed"))
+	_, err = tr.WaitGathering(context.Background())
+	assert.Error(t, err, "WaitGathering should fail if traversal fails")
+
+	closed := newTraversal(0, nil)
+	closed.Close()
+	_, err = closed.WaitGathering(context.Background())
+	assert.Error(t, err, "WaitGathering should fail if traversal is closed")
+}
+
+func assertGatheringPending(t *testing.T, tr *Traversal) {
+	select {
+	case <-tr.gathering.doneCh:
+		t.Fatal("Gathering shouldn't be finished yet")
+	default:
+	}
+}
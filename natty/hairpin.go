@@ -0,0 +1,91 @@
+package natty
+
+import (
+	"regexp"
+	"sync"
+)
+
+const (
+	// HairpinUnknown means that it's not known whether the local NAT supports
+	// hairpinning, so srflx candidates are always used.
+	HairpinUnknown = Hairpinning(iota)
+
+	// HairpinSupported means that the local NAT loops packets sent to its
+	// public address back to the private network.
+	HairpinSupported
+
+	// HairpinUnsupported means that the local NAT drops packets sent to its
+	// own public address.
+	HairpinUnsupported
+)
+
+var (
+	srflxCandidatePattern = regexp.MustCompile(`candidate:\S+ \d+ \S+ \d+ (\S+) \d+ typ srflx`)
+)
+
+// Hairpinning is whether the local NAT supports hairpinning, meaning that
+// peers behind the same NAT can reach each other via their public addresses.
+type Hairpinning int
+
+func (h Hairpinning) String() string {
+	switch h {
+	case HairpinSupported:
+		return "supported"
+	case HairpinUnsupported:
+		return "unsupported"
+	}
+	return "unknown"
+}
+
+// hairpinFilter drops srflx candidates that can't work because both peers are
+// behind the same NAT and it doesn't support hairpinning. Peers behind the same
+// NAT are recognized by their srflx candidates sharing a public IP. Whichever
+// side learns that first drops the srflx candidates passing through it, which
+// leaves natty to connect with host (or relay) candidates.
+type hairpinFilter struct {
+	localIPs  map[string]bool // public IPs of our srflx candidates
+	remoteIPs map[string]bool // public IPs of the peer's srflx candidates
+	mutex     sync.Mutex
+}
+
+// dropLocal records the public IPs of our srflx candidates in msg, an outbound
+// message from natty, and indicates whether to drop it rather than send it to
+// the peer.
+func (hf *hairpinFilter) dropLocal(msg []byte) bool {
+	return hf.track(msg, true)
+}
+
+// dropRemote records the public IPs of the peer's srflx candidates in msg, an
+// inbound message from the peer, and indicates whether to drop it rather than
+// pass it to natty.
+func (hf *hairpinFilter) dropRemote(msg []byte) bool {
+	return hf.track(msg, false)
+}
+
+func (hf *hairpinFilter) track(msg []byte, local bool) bool {
+	matches := srflxCandidatePattern.FindAllSubmatch(msg, -1)
+	if len(matches) == 0 {
+		return false
+	}
+	hf.mutex.Lock()
+	defer hf.mutex.Unlock()
+	if hf.localIPs == nil {
+		hf.localIPs = make(map[string]bool)
+		hf.remoteIPs = make(map[string]bool)
+	}
+	ours, theirs := hf.localIPs, hf.remoteIPs
+	if !local {
+		ours, theirs = theirs, ours
+	}
+	shared := false
+	for _, match := range matches {
+		ip := string(match[1])
+		ours[ip] = true
+		if theirs[ip] {
+			shared = true
+		}
+	}
+	// Only drop individually trickled candidates, session descriptions carry
+	// more than just candidates
+	return shared && isCandidate(msg)
+}
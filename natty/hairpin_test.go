@@ -0,0 +1,45 @@
+package natty
+
+import (
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+const (
+	remoteSameNAT  = `{"candidate":"candidate:2 1 udp 1686052607 203.0.113.7 61000 typ srflx raddr 192.168.1.161 rport 61000 generation 0","sdpMid":"data","sdpMLineIndex":0}`
+	remoteOtherNAT = `{"candidate":"candidate:2 1 udp 1686052607 198.51.100.4 61000 typ srflx raddr 10.0.0.2 rport 61000 generation 0","sdpMid":"data","sdpMLineIndex":0}`
+	remoteHost     = `{"candidate":"candidate:1 1 udp 2122260223 192.168.1.161 61000 typ host generation 0","sdpMid":"data","sdpMLineIndex":0}`
+)
+
+func TestHairpinFilter(t *testing.T) {
+	hf := &hairpinFilter{}
+	assert.False(t, hf.dropRemote([]byte(remoteSameNAT)), "Nothing known about our public IP yet")
+	assert.False(t, hf.dropLocal([]byte(hostCandidate)), "Host candidates are never dropped")
+	assert.True(t, hf.dropLocal([]byte(srflxCandidate)), "Our srflx candidate shares the peer's public IP")
+	assert.True(t, hf.dropRemote([]byte(remoteSameNAT)), "Later srflx candidates from same NAT should be dropped")
+	assert.False(t, hf.dropRemote([]byte(remoteOtherNAT)), "Peer's srflx candidate on another public IP should be kept")
+	assert.False(t, hf.dropRemote([]byte(remoteHost)), "Host candidates are never dropped")
+
+	sdp := `{"type":"offer","sdp":"v=0\r\na=candidate:2 1 udp 1686052607 203.0.113.7 61000 typ srflx raddr 192.168.1.161 rport 61000\r\n"}`
+	assert.False(t, hf.dropRemote([]byte(sdp)), "Session descriptions are never dropped")
+}
+
+func TestHairpinUnsupportedDropsCandidates(t *testing.T) {
+	for _, hairpinning := range []Hairpinning{HairpinUnknown, HairpinUnsupported} {
+		tr := newTraversal(0, []Option{WithHairpinning(hairpinning)})
+		tr.initChannels()
+		tr.hairpin.dropLocal([]byte(srflxCandidate))
+		tr.MsgIn(remoteSameNAT)
+		tr.MsgIn(remoteHost)
+		var got []string
+		for len(tr.msgInCh) > 0 {
+			got = append(got, string(<-tr.msgInCh))
+		}
+		if hairpinning == HairpinUnsupported {
+			assert.Equal(t, []string{remoteHost}, got, "Srflx candidate from same NAT should be dropped")
+		} else {
+			assert.Equal(t, 2, len(got), "Nothing should be dropped when hairpinning is "+hairpinning.String())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// handoffFD is the file descriptor on which natty finds the socket over
+	// which to hand over its own socket, the first of cmd.ExtraFiles.
+	handoffFD = 3
+)
+
+var (
+	// handoffTimeout is how long to wait for natty's socket after it emitted
+	// the FiveTuple, by which time natty has normally sent it already.
+	handoffTimeout = 1 * time.Second
+)
+
+// handoff receives the socket with which natty established the FiveTuple, so
+// that the application can keep using the same socket (and thus NAT mapping)
+// instead of binding a new one (see WithBoundConn).
+type handoff struct {
+	enabled bool
+	sock    *net.UnixConn // our end of the socket pair
+	theirs  *os.File      // natty's end of the socket pair, until natty started
+	conn    *net.UDPConn  // natty's socket, once received and until taken
+	taken   bool
+	mutex   sync.Mutex
+}
+
+// params sets up the socket pair, returning the params that tell natty to hand
+// over its socket through it, or nothing if that isn't supported here or natty
+// doesn't accept them (accepted).
+func (h *handoff) params(accepted bool) ([]string, error) {
+	if !h.enabled {
+		return nil, nil
+	}
+	if !handoffSupported {
+		log.Trace("Handing over natty's socket isn't supported on this platform, will bind a new one")
+		return nil, nil
+	}
+	if !accepted {
+		log.Trace("natty doesn't accept -handoff, will bind a new socket")
+		return nil, nil
+	}
+	var err error
+	h.sock, h.theirs, err = socketPair()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create socket pair for handing over natty's socket: %s", err)
+	}
+	return []string{"-handoff", strconv.Itoa(handoffFD)}, nil
+}
+
+// started closes our copy of natty's end, now that natty has its own.
+func (h *handoff) started() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.theirs != nil {
+		h.theirs.Close()
+		h.theirs = nil
+	}
+}
+
+// receive waits for natty's socket, which it sends before emitting the
+// FiveTuple ft, and connects it to ft's remote address.
+func (h *handoff) receive(ft *FiveTuple) error {
+	if h.sock == nil || ft.Proto != UDP {
+		return nil
+	}
+	local, remote, err := ft.UDPAddrs()
+	if err != nil {
+		return err
+	}
+	h.sock.SetReadDeadline(time.Now().Add(handoffTimeout))
+	conn, err := receiveUDPConn(h.sock, remote)
+	if err != nil {
+		return fmt.Errorf("Unable to receive natty's socket: %s", err)
+	}
+	if conn.LocalAddr().(*net.UDPAddr).Port != local.Port {
+		conn.Close()
+		return fmt.Errorf("natty handed over a socket on %s instead of %s", conn.LocalAddr(), local)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.taken {
+		// Traversal was closed in the meantime
+		return conn.Close()
+	}
+	h.conn = conn
+	return nil
+}
+
+// take takes natty's socket, if we got it. The Traversal no longer closes it
+// afterwards.
+func (h *handoff) take() (*net.UDPConn, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.taken {
+		return nil, fmt.Errorf("natty's socket was already taken or the Traversal was closed")
+	}
+	h.taken = true
+	conn := h.conn
+	h.conn = nil
+	return conn, nil
+}
+
+// close closes the socket pair and natty's socket, unless it was taken.
+func (h *handoff) close() {
+	h.started()
+	if h.sock != nil {
+		h.sock.Close()
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.taken = true
+	if h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+}
+
+// FiveTupleAndConn waits for the FiveTuple like FiveTuple does and returns it
+// along with a UDP socket on it, connected to its remote address and marked
+// per WithDSCP. With WithBoundConn, the socket is the very one that natty used
+// for the traversal, so its NAT mapping is preserved, which matters behind
+// symmetric NATs that would give a new socket a new mapping. Otherwise, or
+// where natty's socket can't be handed over (Windows, or natty executables
+// that don't support it, like the embedded one), it's a new socket
+// bound to the FiveTuple's local address, like DialUDP(ConnectedSocket)
+// returns. The caller owns the socket, which survives Close. It can only be
+// taken once per Traversal.
+func (t *Traversal) FiveTupleAndConn() (*FiveTuple, *net.UDPConn, error) {
+	ft, err := t.FiveTuple()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ft.Proto != UDP {
+		return nil, nil, fmt.Errorf("Unable to open UDP socket on %s FiveTuple", ft.Proto)
+	}
+	conn, err := t.handoff.take()
+	if err != nil {
+		return nil, nil, err
+	}
+	if conn == nil {
+		local, remote, err := ft.UDPAddrs()
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err = t.sockets.dialUDP("udp", local, remote)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to dial %s from %s: %s", remote, local, err)
+		}
+	}
+	err = t.MarkConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	t.keepAlives.opened(conn, nil)
+	return ft, conn, nil
+}
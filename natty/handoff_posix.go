@@ -0,0 +1,101 @@
+//go:build !windows
+// +build !windows
+
+package natty
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+const handoffSupported = true
+
+// socketPair creates a pair of connected unix datagram sockets, returning ours
+// as a conn and theirs as a file to pass to natty.
+func socketPair() (*net.UnixConn, *os.File, error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	oursFile := os.NewFile(uintptr(fds[0]), "natty-handoff")
+	defer oursFile.Close()
+	ours, err := net.FileConn(oursFile)
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return ours.(*net.UnixConn), os.NewFile(uintptr(fds[1]), "natty-handoff"), nil
+}
+
+// receiveUDPConn receives a UDP socket sent over sock and connects it to
+// remote.
+func receiveUDPConn(sock *net.UnixConn, remote *net.UDPAddr) (*net.UDPConn, error) {
+	b := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := sock.ReadMsgUnix(b, oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("Expected 1 control message, got %d", len(msgs))
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, fmt.Errorf("Expected 1 file descriptor, got %d", len(fds))
+	}
+	syscall.CloseOnExec(fds[0])
+	f := os.NewFile(uintptr(fds[0]), "natty-socket")
+	defer f.Close()
+	err = connectTo(fds[0], remote)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %s", remote, err)
+	}
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("Expected a UDP socket, got %s", conn.LocalAddr().Network())
+	}
+	return udpConn, nil
+}
+
+// connectTo connects the UDP socket fd to remote, in the socket's address
+// family.
+func connectTo(fd int, remote *net.UDPAddr) error {
+	local, err := syscall.Getsockname(fd)
+	if err != nil {
+		return err
+	}
+	if _, ipv6 := local.(*syscall.SockaddrInet6); ipv6 {
+		sa := &syscall.SockaddrInet6{Port: remote.Port}
+		copy(sa.Addr[:], remote.IP.To16())
+		return syscall.Connect(fd, sa)
+	}
+	ip := remote.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("Unable to connect IPv4 socket to %s", remote)
+	}
+	sa := &syscall.SockaddrInet4{Port: remote.Port}
+	copy(sa.Addr[:], ip)
+	return syscall.Connect(fd, sa)
+}
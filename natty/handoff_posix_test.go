@@ -0,0 +1,103 @@
+//go:build !windows
+// +build !windows
+
+package natty
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestHandoff(t *testing.T) {
+	peer := listenLoopback(t)
+	defer peer.Close()
+	natty := listenLoopback(t)
+	defer natty.Close()
+	ft := &FiveTuple{Proto: UDP, Local: natty.LocalAddr().String(), Remote: peer.LocalAddr().String()}
+
+	tr := newTraversal(0, []Option{WithBoundConn()})
+	params, err := tr.handoff.params(true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer tr.handoff.close()
+	assert.Equal(t, []string{"-handoff", "3"}, params)
+
+	// Play natty, sending our socket over its end of the pair
+	f, err := natty.File()
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = syscall.Sendmsg(int(tr.handoff.theirs.Fd()), []byte{0}, syscall.UnixRights(int(f.Fd())), nil, 0)
+	f.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+	tr.handoff.started()
+	if !assert.NoError(t, tr.handoff.receive(ft)) {
+		return
+	}
+	tr.setResult(ft, nil)
+
+	got, conn, err := tr.FiveTupleAndConn()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, ft, got)
+	assert.Equal(t, ft.Local, conn.LocalAddr().String(), "Should be natty's socket")
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err, "Socket should be connected to the peer")
+	assert.Equal(t, "hello", readFrom(t, peer))
+
+	_, _, err = tr.FiveTupleAndConn()
+	assert.Error(t, err, "Socket should only be taken once")
+}
+
+func TestHandoffFallback(t *testing.T) {
+	peer := listenLoopback(t)
+	defer peer.Close()
+	local := listenLoopback(t)
+	ft := &FiveTuple{Proto: UDP, Local: local.LocalAddr().String(), Remote: peer.LocalAddr().String()}
+	local.Close()
+
+	// Without WithBoundConn, we bind a new socket
+	tr := newTraversal(0, nil)
+	tr.setResult(ft, nil)
+	_, conn, err := tr.FiveTupleAndConn()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, ft.Local, conn.LocalAddr().String())
+
+	// If natty doesn't accept -handoff, we don't ask it to
+	tr = newTraversal(0, []Option{WithBoundConn()})
+	params, err := tr.handoff.params(false)
+	if assert.NoError(t, err) {
+		assert.Empty(t, params)
+		assert.Nil(t, tr.handoff.sock)
+	}
+
+	binary, remove := scriptedNatty(t, "exec sleep 30", "offer")
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(binary), WithBoundConn()})
+	if assert.NoError(t, tr.initCommand(nil), "natty that doesn't accept -handoff shouldn't fail the Traversal") {
+		assert.Nil(t, tr.cmd.ExtraFiles)
+	}
+
+	// If natty doesn't hand its socket over, we don't get one
+	tr = newTraversal(0, []Option{WithBoundConn()})
+	_, err = tr.handoff.params(true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer tr.handoff.close()
+	tr.handoff.started()
+	defer func(timeout time.Duration) { handoffTimeout = timeout }(handoffTimeout)
+	handoffTimeout = 50 * time.Millisecond
+	assert.Error(t, tr.handoff.receive(ft))
+}
@@ -0,0 +1,17 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+const handoffSupported = false
+
+func socketPair() (*net.UnixConn, *os.File, error) {
+	return nil, nil, fmt.Errorf("Handing over natty's socket is not supported on Windows")
+}
+
+func receiveUDPConn(sock *net.UnixConn, remote *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, fmt.Errorf("Handing over natty's socket is not supported on Windows")
+}
@@ -0,0 +1,72 @@
+package natty
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+)
+
+// filterIPVersion removes the candidates of the other IP version than the one
+// set with WithIPVersion from msg, a message from natty or from the peer, so
+// that ICE only pairs candidates of that version, even with a natty that
+// doesn't accept -ipversion. It returns nil if msg is a trickled candidate of
+// the other version, and otherwise msg, rewritten if its session description
+// had such candidates.
+func (t *Traversal) filterIPVersion(msg []byte) []byte {
+	if t.ipVersion == IPAny || !bytes.Contains(msg, []byte("candidate:")) {
+		return msg
+	}
+	fields := make(map[string]json.RawMessage)
+	if json.Unmarshal(msg, &fields) != nil {
+		return msg
+	}
+	if raw, found := fields["candidate"]; found {
+		var attr string
+		if json.Unmarshal(raw, &attr) == nil && !t.ofIPVersion(attr) {
+			return nil
+		}
+		return msg
+	}
+	var sdp string
+	if json.Unmarshal(fields["sdp"], &sdp) != nil {
+		return msg
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(sdp, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "a=candidate:") && !t.ofIPVersion(trimmed) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	filtered := strings.Join(kept, "")
+	if filtered == sdp {
+		return msg
+	}
+	fields["sdp"], _ = json.Marshal(filtered)
+	rewritten, err := json.Marshal(fields)
+	if err != nil {
+		return msg
+	}
+	return append(msg[:0], rewritten...)
+}
+
+// ofIPVersion indicates whether the given candidate attribute is of the IP
+// version set with WithIPVersion. Candidates that don't parse, or whose
+// address isn't an IP, are left for natty to deal with.
+func (t *Traversal) ofIPVersion(attr string) bool {
+	c, err := parseCandidate(attr)
+	if err != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	return (ip.To4() != nil) == (t.ipVersion == IPv4)
+}
@@ -0,0 +1,28 @@
+package natty
+
+import (
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestFilterIPVersion(t *testing.T) {
+	const (
+		v4  = `{"candidate":"candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host generation 0","sdpMid":"data","sdpMLineIndex":0}`
+		v6  = `{"candidate":"candidate:2 1 udp 2122262783 2001:db8::1 55286 typ host generation 0","sdpMid":"data","sdpMLineIndex":0}`
+		sdp = `{"type":"offer","sdp":"v=0\r\na=candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host\r\na=candidate:2 1 udp 2122262783 2001:db8::1 55286 typ host\r\na=end-of-candidates\r\n"}`
+	)
+	tr := newTraversal(0, nil)
+	assert.Equal(t, v4, string(tr.filterIPVersion([]byte(v4))), "Without WithIPVersion, nothing should be filtered")
+
+	tr = newTraversal(0, []Option{WithIPVersion(IPv6)})
+	assert.Nil(t, tr.filterIPVersion([]byte(v4)), "IPv4 candidate should be dropped")
+	assert.Equal(t, v6, string(tr.filterIPVersion([]byte(v6))))
+	filtered := string(tr.filterIPVersion([]byte(sdp)))
+	assert.Equal(t, `{"sdp":"v=0\r\na=candidate:2 1 udp 2122262783 2001:db8::1 55286 typ host\r\na=end-of-candidates\r\n","type":"offer"}`, filtered, "IPv4 candidate should be removed from the session description")
+
+	tr = newTraversal(0, []Option{WithIPVersion(IPv4)})
+	assert.Nil(t, tr.filterIPVersion([]byte(v6)), "IPv6 candidate should be dropped")
+	assert.Equal(t, v4, string(tr.filterIPVersion([]byte(v4))))
+	assert.Equal(t, `{"type":"answer"}`, string(tr.filterIPVersion([]byte(`{"type":"answer"}`))))
+}
@@ -0,0 +1,260 @@
+package natty
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// deadPeerIntervals is how many keepalive intervals may pass without
+	// hearing from the peer before a ConnKeeper considers it dead.
+	deadPeerIntervals = 3
+)
+
+var (
+	// KeepAlivePacket is the payload of the packets sent by a ConnKeeper.
+	// Applications sharing the connection with a ConnKeeper should use
+	// IsKeepAlive to filter these out of their traffic.
+	KeepAlivePacket = []byte("natty-keepalive")
+
+	// keepAliveTxPrefix starts the transaction ids of the binding requests
+	// sent by Traversal.KeepAlive, which tells them apart from other STUN
+	// traffic, like ICE connectivity checks, on the same socket.
+	keepAliveTxPrefix = []byte("natty-ka")
+)
+
+// IsKeepAlive indicates whether the given packet is a keepalive sent by a
+// ConnKeeper or by Traversal.KeepAlive.
+func IsKeepAlive(packet []byte) bool {
+	if len(packet) == stunHeaderSize && isSTUN(packet) {
+		return binary.BigEndian.Uint16(packet) == stunBindingRequest && bytes.HasPrefix(packet[8:], keepAliveTxPrefix)
+	}
+	return bytes.Equal(packet, KeepAlivePacket)
+}
+
+// newKeepAlive creates a keepalive for Traversal.KeepAlive: a binding request
+// without attributes whose transaction id starts with keepAliveTxPrefix.
+func newKeepAlive() []byte {
+	m := newSTUNMessage(stunBindingRequest)
+	copy(m.txId, keepAliveTxPrefix)
+	return m.encode(nil)
+}
+
+// ConnKeeper keeps the NAT mapping for an established UDP FiveTuple alive by
+// periodically sending keepalive packets to the peer. It also acts as a
+// dead-peer detector: if nothing is heard from the peer for several intervals,
+// it invokes its onDead callback and stops.
+//
+// ConnKeeper doesn't read from the connection itself. Whoever reads from the
+// connection should call Received() whenever a packet (including a keepalive)
+// arrives from the peer.
+type ConnKeeper struct {
+	conn         *net.UDPConn
+	remote       *net.UDPAddr
+	interval     time.Duration
+	onDead       func()
+	controlDSCP  int
+	mediaDSCP    int
+	lastReceived int64
+	stopCh       chan struct{}
+	stopOnce     sync.Once
+}
+
+// NewConnKeeper starts a ConnKeeper that sends keepalives on conn every
+// interval. If remote is nil, conn must be connected (i.e. obtained from
+// net.DialUDP). onDead is called on the ConnKeeper's goroutine if the peer
+// appears to have gone away.
+func NewConnKeeper(conn *net.UDPConn, remote *net.UDPAddr, interval time.Duration, onDead func()) *ConnKeeper {
+	k := &ConnKeeper{
+		conn:        conn,
+		remote:      remote,
+		interval:    interval,
+		onDead:      onDead,
+		controlDSCP: noDSCP,
+		mediaDSCP:   noDSCP,
+		stopCh:      make(chan struct{}),
+	}
+	k.start()
+	return k
+}
+
+// NewConnKeeper is like the package-level NewConnKeeper, except that the
+// keepalives carry the control DSCP marking configured with WithControlDSCP.
+func (t *Traversal) NewConnKeeper(conn *net.UDPConn, remote *net.UDPAddr, interval time.Duration, onDead func()) *ConnKeeper {
+	k := &ConnKeeper{
+		conn:        conn,
+		remote:      remote,
+		interval:    interval,
+		onDead:      onDead,
+		controlDSCP: t.controlDSCP,
+		mediaDSCP:   t.dscp,
+		stopCh:      make(chan struct{}),
+	}
+	k.start()
+	return k
+}
+
+func (k *ConnKeeper) start() {
+	k.Received()
+	go k.keepAlive()
+}
+
+// Received records that something was received from the peer.
+func (k *ConnKeeper) Received() {
+	atomic.StoreInt64(&k.lastReceived, time.Now().UnixNano())
+}
+
+// Stop stops sending keepalives and watching for a dead peer. It does not
+// close the underlying connection.
+func (k *ConnKeeper) Stop() {
+	k.stopOnce.Do(func() {
+		close(k.stopCh)
+	})
+}
+
+func (k *ConnKeeper) keepAlive() {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	deadAfter := deadPeerIntervals * k.interval
+	for {
+		select {
+		case <-k.stopCh:
+			return
+		case <-ticker.C:
+			lastReceived := time.Unix(0, atomic.LoadInt64(&k.lastReceived))
+			if time.Now().Sub(lastReceived) > deadAfter {
+				log.Tracef("Nothing heard from peer since %s, considering it dead", lastReceived)
+				k.Stop()
+				if k.onDead != nil {
+					k.onDead()
+				}
+				return
+			}
+			err := k.send()
+			if err != nil {
+				log.Tracef("Unable to send keepalive: %s", err)
+			}
+		}
+	}
+}
+
+func (k *ConnKeeper) send() error {
+	if k.controlDSCP != noDSCP {
+		err := SetDSCP(k.conn, k.controlDSCP)
+		if err != nil {
+			log.Tracef("Unable to mark keepalive: %s", err)
+		}
+		defer func() {
+			media := k.mediaDSCP
+			if media == noDSCP {
+				media = 0
+			}
+			err := SetDSCP(k.conn, media)
+			if err != nil {
+				log.Tracef("Unable to restore media marking: %s", err)
+			}
+		}()
+	}
+	if k.remote == nil {
+		_, err := k.conn.Write(KeepAlivePacket)
+		return err
+	}
+	_, err := k.conn.WriteToUDP(KeepAlivePacket, k.remote)
+	return err
+}
+
+// keepAlives tracks the keepalives started with Traversal.KeepAlive.
+type keepAlives struct {
+	conn   *net.UDPConn  // the last socket opened on the FiveTuple
+	remote *net.UDPAddr  // where to send on conn, nil if it's connected
+	stopCh chan struct{} // if set, closed to stop the current keepalives
+	mutex  sync.Mutex
+}
+
+// opened records a socket that the Traversal opened on its FiveTuple, through
+// which KeepAlive sends.
+func (ka *keepAlives) opened(conn *net.UDPConn, remote *net.UDPAddr) {
+	ka.mutex.Lock()
+	ka.conn, ka.remote = conn, remote
+	ka.mutex.Unlock()
+}
+
+// KeepAlive keeps the NAT mapping of the FiveTuple alive by sending a minimal
+// STUN binding request to the peer every interval, so that traffic that's
+// sporadic doesn't lose its path once a NAT expires the idle mapping (many
+// home routers do so after 30 to 60 seconds). The requests go out on the last
+// socket that DialUDP, ListenUDP or FiveTupleAndConn opened, from the mapped
+// port, and the peer should drop them with IsKeepAlive. Sockets that the
+// application binds itself can use a ConnKeeper instead. Calling KeepAlive
+// again changes the interval. The keepalives stop with StopKeepAlive, Close
+// or once the socket is closed.
+func (t *Traversal) KeepAlive(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Unable to keep alive every %s", interval)
+	}
+	select {
+	case <-t.closedCh:
+		return ErrClosed
+	default:
+	}
+	ka := &t.keepAlives
+	ka.mutex.Lock()
+	defer ka.mutex.Unlock()
+	if ka.conn == nil {
+		return fmt.Errorf("Unable to keep alive without a socket from DialUDP, ListenUDP or FiveTupleAndConn")
+	}
+	if ka.stopCh != nil {
+		close(ka.stopCh)
+	}
+	ka.stopCh = make(chan struct{})
+	go t.sendKeepAlives(ka.conn, ka.remote, interval, ka.stopCh)
+	return nil
+}
+
+// StopKeepAlive stops the keepalives started with KeepAlive without closing
+// the Traversal or the socket.
+func (t *Traversal) StopKeepAlive() {
+	ka := &t.keepAlives
+	ka.mutex.Lock()
+	if ka.stopCh != nil {
+		close(ka.stopCh)
+		ka.stopCh = nil
+	}
+	ka.mutex.Unlock()
+}
+
+func (t *Traversal) sendKeepAlives(conn *net.UDPConn, remote *net.UDPAddr, interval time.Duration, stopCh chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-t.closedCh:
+			return
+		case <-ticker.C:
+			msg := newKeepAlive()
+			var err error
+			if remote == nil {
+				_, err = conn.Write(msg)
+			} else {
+				_, err = conn.WriteToUDP(msg, remote)
+			}
+			if errors.Is(err, net.ErrClosed) {
+				t.log().Trace("Socket closed, no longer keeping alive")
+				return
+			}
+			if err != nil {
+				t.log().Tracef("Unable to send keepalive: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package natty
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// TestConnKeeper runs two ConnKeepers against each other over loopback and
+// makes sure that an idle tunnel stays up for many intervals, and that the
+// dead-peer detector fires once one side goes away.
+func TestConnKeeper(t *testing.T) {
+	interval := 20 * time.Millisecond
+
+	a, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer a.Close()
+	b, err := net.DialUDP("udp", nil, a.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Unable to dial: %s", err)
+	}
+	defer b.Close()
+
+	aDead := make(chan bool, 1)
+	bDead := make(chan bool, 1)
+	ka := NewConnKeeper(a, b.LocalAddr().(*net.UDPAddr), interval, func() { aDead <- true })
+	defer ka.Stop()
+	kb := NewConnKeeper(b, nil, interval, func() { bDead <- true })
+
+	readKeepAlives := func(conn *net.UDPConn, k *ConnKeeper) {
+		buf := make([]byte, 100)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			assert.True(t, IsKeepAlive(buf[:n]), "Should only have received keepalives")
+			k.Received()
+		}
+	}
+	go readKeepAlives(a, ka)
+	go readKeepAlives(b, kb)
+
+	select {
+	case <-aDead:
+		t.Fatal("a shouldn't have considered b dead")
+	case <-bDead:
+		t.Fatal("b shouldn't have considered a dead")
+	case <-time.After(20 * interval):
+		// idle tunnel survived
+	}
+
+	kb.Stop()
+	select {
+	case <-aDead:
+		// expected
+	case <-time.After(20 * interval):
+		t.Fatal("a should have considered b dead")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	interval := 20 * time.Millisecond
+	offerer, answerer := localTraversalPair(t)
+	assert.Error(t, offerer.KeepAlive(interval), "KeepAlive should need a socket")
+
+	conn, err := offerer.DialUDP(UnconnectedSocket)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	peer, err := answerer.ListenUDP(ConnectedSocket)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer peer.Close()
+	assert.Error(t, offerer.KeepAlive(0), "KeepAlive should need an interval")
+
+	// countKeepAlives reads keepalives until none come for a few intervals
+	countKeepAlives := func() int {
+		received := 0
+		buf := make([]byte, 100)
+		for {
+			peer.SetReadDeadline(time.Now().Add(5 * interval))
+			n, err := peer.Read(buf)
+			if err != nil {
+				return received
+			}
+			assert.True(t, IsKeepAlive(buf[:n]), "Should only have received keepalives")
+			received++
+			if received == 3 {
+				return received
+			}
+		}
+	}
+	assert.NoError(t, offerer.KeepAlive(interval))
+	assert.Equal(t, 3, countKeepAlives())
+
+	offerer.StopKeepAlive()
+	countKeepAlives()
+	assert.Equal(t, 0, countKeepAlives(), "StopKeepAlive should have stopped the keepalives")
+
+	assert.NoError(t, offerer.KeepAlive(interval))
+	assert.Equal(t, 3, countKeepAlives())
+	offerer.Close()
+	countKeepAlives()
+	assert.Equal(t, 0, countKeepAlives(), "Close should have stopped the keepalives")
+	assert.Equal(t, ErrClosed, offerer.KeepAlive(interval))
+
+	assert.False(t, IsKeepAlive(newSTUNMessage(stunBindingRequest).add(stunAttrUsername, []byte("a:b")).encode(nil)), "Only bare binding requests are keepalives")
+}
+
+func TestIsKeepAlive(t *testing.T) {
+	assert.True(t, IsKeepAlive(newKeepAlive()))
+	assert.True(t, IsKeepAlive(KeepAlivePacket))
+	assert.False(t, IsKeepAlive(newSTUNMessage(stunBindingRequest).encode(nil)), "Foreign binding requests aren't keepalives, even without attributes")
+	ka := newKeepAlive()
+	binary.BigEndian.PutUint16(ka, stunBindingRequest|0x0100)
+	assert.False(t, IsKeepAlive(ka), "Responses aren't keepalives")
+}
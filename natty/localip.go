@@ -0,0 +1,70 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var (
+	hostCandidatePattern = regexp.MustCompile(`candidate:\S+ \d+ \S+ \d+ (\S+) \d+ typ host`)
+)
+
+// checkLocalIP makes sure that the IP set with WithLocalIP is one of ours, of
+// the IPVersion set with WithIPVersion.
+func checkLocalIP(ip net.IP, version IPVersion) error {
+	if ip == nil || ip.IsUnspecified() {
+		return fmt.Errorf("Invalid local IP %s, should be the IP of a local interface", ip)
+	}
+	if (ip.To4() != nil && version == IPv6) || (ip.To4() == nil && version == IPv4) {
+		return fmt.Errorf("Unable to use local IP %s with IP version %s", ip, version)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("Unable to list local IPs: %s", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Local IP %s isn't on any local interface", ip)
+}
+
+// checkLocalCandidates makes sure that msg, an outbound message from natty,
+// doesn't advertise host candidates on IPs other than the one set with
+// WithLocalIP.
+func (t *Traversal) checkLocalCandidates(msg []byte) error {
+	if t.localIP == nil {
+		return nil
+	}
+	for _, match := range hostCandidatePattern.FindAllStringSubmatch(candidateText(msg), -1) {
+		if !sameIP(match[1], t.localIP) {
+			return fmt.Errorf("natty gathered a host candidate on %s rather than only on %s", t.redact(match[1]), t.localIP)
+		}
+	}
+	return nil
+}
+
+// checkLocal makes sure that the FiveTuple's local address is on the IP set
+// with WithLocalIP, unless it's a relay's.
+func (t *Traversal) checkLocal(ft *FiveTuple) error {
+	if t.localIP == nil || ft.Relayed {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(ft.Local)
+	if err != nil || !sameIP(host, t.localIP) {
+		return fmt.Errorf("Got FiveTuple from %s, but local IP is %s", t.redact(ft.Local), t.localIP)
+	}
+	return nil
+}
+
+// sameIP indicates whether host, which may have brackets and a zone, is ip.
+func sameIP(host string, ip net.IP) bool {
+	host = strings.Trim(host, "[]")
+	if i := strings.Index(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	return ip.Equal(net.ParseIP(host))
+}
@@ -0,0 +1,68 @@
+package natty
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestCheckLocalIP(t *testing.T) {
+	assert.NoError(t, checkLocalIP(net.IPv4(127, 0, 0, 1), IPAny))
+	assert.NoError(t, checkLocalIP(net.IPv4(127, 0, 0, 1), IPv4))
+	assert.Error(t, checkLocalIP(net.IPv4(127, 0, 0, 1), IPv6), "IPv4 local IP should need IPv4")
+	assert.Error(t, checkLocalIP(nil, IPAny))
+	assert.Error(t, checkLocalIP(net.IPv4zero, IPAny))
+	assert.Error(t, checkLocalIP(net.ParseIP("192.0.2.123"), IPAny), "IP that isn't ours should fail")
+
+	binary, remove := sleepingNatty(t)
+	defer remove()
+	tr := newTraversal(0, []Option{WithBinary(binary), WithLocalIP(net.IPv4(127, 0, 0, 1))})
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.Contains(t, strings.Join(tr.cmd.Args, " "), "-localip 127.0.0.1")
+	}
+	tr = newTraversal(0, []Option{WithBinary(binary), WithLocalIP(net.ParseIP("192.0.2.123"))})
+	assert.Error(t, tr.initCommand(nil), "IP that isn't ours should fail the Traversal")
+	binary, remove = scriptedNatty(t, "exec sleep 30", "offer")
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(binary), WithLocalIP(net.IPv4(127, 0, 0, 1))})
+	assert.True(t, errors.Is(tr.initCommand(nil), ErrUnsupportedOption), "natty that doesn't accept -localip should fail the Traversal")
+}
+
+func TestLocalIPCandidates(t *testing.T) {
+	tr := newTraversal(0, []Option{WithLocalIP(net.IPv4(192, 168, 1, 160))})
+	ours := `{"candidate":"candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host","sdpMid":"data","sdpMLineIndex":0}`
+	srflx := `{"candidate":"candidate:2 1 udp 1686052607 203.0.113.7 55285 typ srflx raddr 192.168.1.160 rport 55285","sdpMid":"data","sdpMLineIndex":0}`
+	theirs := `{"candidate":"candidate:1 1 udp 2122260223 10.0.0.5 55285 typ host","sdpMid":"data","sdpMLineIndex":0}`
+	assert.NoError(t, tr.checkLocalCandidates([]byte(ours)))
+	assert.NoError(t, tr.checkLocalCandidates([]byte(srflx)))
+	assert.Error(t, tr.checkLocalCandidates([]byte(theirs)), "Host candidate on another IP should fail")
+	assert.Error(t, tr.checkLocalCandidates([]byte(`{"type":"offer","sdp":"a=candidate:1 1 udp 2122260223 10.0.0.5 55285 typ host\r\n"}`)), "Host candidate in SDP on another IP should fail")
+
+	tr.initChannels()
+	tr.stdoutbuf = bufio.NewReader(strings.NewReader(ours + "\n" + theirs + "\n"))
+	tr.iowg.Add(1)
+	go tr.processStdout()
+	assert.Equal(t, ours+"\n", string(<-tr.msgOutCh))
+	assert.Error(t, <-tr.errCh, "Host candidate on another IP should fail the Traversal")
+	assert.Equal(t, 0, len(tr.msgOutCh), "Host candidate on another IP should never be sent")
+}
+
+func TestLocalIPFiveTuple(t *testing.T) {
+	tr := newTraversal(0, []Option{WithLocalIP(net.IPv4(192, 168, 1, 160))})
+	assert.NoError(t, tr.checkLocal(&FiveTuple{Proto: UDP, Local: "192.168.1.160:5000", Remote: "198.51.100.1:5000"}))
+	assert.NoError(t, tr.checkLocal(&FiveTuple{Proto: UDP, Local: "203.0.113.7:50000", Remote: "198.51.100.1:5000", Relayed: true}), "Relayed FiveTuple is on the relay")
+
+	tr.initChannels()
+	tr.stdoutbuf = bufio.NewReader(strings.NewReader(`{"type":"5-tuple","Proto":"udp","Local":"10.0.0.5:5000","Remote":"198.51.100.1:5000"}` + "\n"))
+	tr.iowg.Add(1)
+	go tr.processStdout()
+	assert.Error(t, <-tr.errCh, "FiveTuple from another IP should fail the Traversal")
+	assert.Equal(t, 0, len(tr.fiveTupleCh))
+
+	v6 := newTraversal(0, []Option{WithLocalIP(net.ParseIP("fe80::1"))})
+	assert.NoError(t, v6.checkLocal(&FiveTuple{Proto: UDP, Local: "[fe80::1%eth0]:5000", Remote: "[fe80::2%eth0]:5000"}))
+}
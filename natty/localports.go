@@ -0,0 +1,33 @@
+package natty
+
+import (
+	"fmt"
+)
+
+const (
+	// MaxLocalPortCount is the most local ports that WithLocalPortCount can
+	// gather from. Every port adds candidates, and with them pairs to check,
+	// so more ports slow down traversals for little gain.
+	MaxLocalPortCount = 8
+)
+
+// checkLocalPortCount makes sure that the number of local ports set with
+// WithLocalPortCount is within bounds.
+func checkLocalPortCount(n int) error {
+	if n < 1 || n > MaxLocalPortCount {
+		return fmt.Errorf("Invalid local port count %d, should be between 1 and %d", n, MaxLocalPortCount)
+	}
+	return nil
+}
+
+// reflexivePorts counts the distinct local addresses from which the given
+// local candidates got server reflexive mappings.
+func reflexivePorts(local []*Candidate) int {
+	bases := make(map[string]bool)
+	for _, c := range local {
+		if c.Type == "srflx" && c.RelatedAddress != "" {
+			bases[c.RelatedAddress] = true
+		}
+	}
+	return len(bases)
+}
@@ -0,0 +1,90 @@
+package natty
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestLocalPortCount(t *testing.T) {
+	assert.NoError(t, checkLocalPortCount(1))
+	assert.NoError(t, checkLocalPortCount(MaxLocalPortCount))
+	assert.Error(t, checkLocalPortCount(0))
+	assert.Error(t, checkLocalPortCount(MaxLocalPortCount+1))
+
+	for _, n := range []int{0, MaxLocalPortCount + 1} {
+		tr := Offer(0, WithLocalPortCount(n))
+		_, err := tr.FiveTuple()
+		if assert.Error(t, err, "Traversal should fail with out of range port count") {
+			assert.Contains(t, err.Error(), "Invalid local port count")
+		}
+		tr.Close()
+	}
+
+	binary, remove := sleepingNatty(t)
+	defer remove()
+	tr := newTraversal(0, []Option{WithBinary(binary), WithLocalPortCount(2)})
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.Contains(t, strings.Join(tr.cmd.Args, " "), "-localports 2")
+	}
+	binary, remove = scriptedNatty(t, "exec sleep 30", "offer")
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(binary), WithLocalPortCount(2)})
+	assert.True(t, errors.Is(tr.initCommand(nil), ErrUnsupportedOption), "natty that doesn't accept -localports should fail the Traversal")
+
+	local := []*Candidate{
+		{Type: "host", Address: "192.168.1.160:1000"},
+		{Type: "host", Address: "192.168.1.160:1001"},
+		{Type: "srflx", Address: "203.0.113.7:2001", RelatedAddress: "192.168.1.160:1001"},
+		{Type: "srflx", Address: "203.0.113.7:2002", RelatedAddress: "192.168.1.160:1001"},
+	}
+	assert.Equal(t, 1, reflexivePorts(local), "Only the second port got mapped")
+}
+
+// TestLocalPortDiversity runs a local traversal whose offerer gathers from two
+// ports, behind a simulated NAT that blackholes the mapping of the first one.
+func TestLocalPortDiversity(t *testing.T) {
+	skipUnlessNattySupports(t, "localports")
+	blackholing := startFakeSTUN(t, 0)
+	blackholing.blackholeFirst()
+	defer blackholing.close()
+	server := startFakeSTUN(t, 0)
+	defer server.close()
+
+	offer := Offer(15*time.Second, WithLocalPortCount(2), WithIPVersion(IPv4), WithSTUNServers([]string{blackholing.addr()}))
+	defer offer.Close()
+	answer := Answer(15*time.Second, WithIPVersion(IPv4), WithSTUNServers([]string{server.addr()}))
+	defer answer.Close()
+	relay := func(from *Traversal, to *Traversal) {
+		for {
+			msg, done := from.NextMsgOut()
+			if done {
+				return
+			}
+			to.MsgIn(msg)
+		}
+	}
+	go relay(offer, answer)
+	go relay(answer, offer)
+
+	ft, err := offer.FiveTuple()
+	if !assert.NoError(t, err, "Traversal should succeed despite the blackholed mapping") {
+		return
+	}
+	assert.Equal(t, 1, offer.Stats().ReflexivePorts, "Only the second port should have been mapped")
+	local, _ := offer.gathering.result()
+	ports := make(map[string]bool)
+	for _, c := range local {
+		if c.Type == "host" {
+			_, port, _ := net.SplitHostPort(c.Address)
+			ports[port] = true
+		}
+	}
+	assert.Len(t, ports, 2, "Should have gathered from two ports")
+	_, port, _ := net.SplitHostPort(ft.Local)
+	assert.True(t, ports[port], "FiveTuple should be on one of the ports")
+}
@@ -0,0 +1,510 @@
+package natty
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/go-natty/natty/stun"
+)
+
+const (
+	stunBindingRequest = 0x0001
+
+	// mappingChangesBuffer is how many MappingChanges to buffer for a consumer
+	// that's slow to read them.
+	mappingChangesBuffer = 10
+
+	// mappingPriority is the ICE priority of seeded candidates, that of a
+	// srflx candidate with the highest local preference.
+	mappingPriority = 100<<24 | 65535<<8 | 255
+)
+
+var (
+	// mappingRequestTimeout is how long to wait for a STUN server to respond
+	// to a binding request, including retransmissions.
+	mappingRequestTimeout = 2 * time.Second
+)
+
+// MappingChange tells that a MappingKeeper's reflexive address changed, for
+// example because the NAT rebooted or the network changed.
+type MappingChange struct {
+	// Old is the previous mapping, nil if there was none.
+	Old *net.UDPAddr
+
+	// New is the current mapping, nil if the mapping was lost because none of
+	// the STUN servers responded.
+	New *net.UDPAddr
+}
+
+func (mc *MappingChange) String() string {
+	return fmt.Sprintf("%v -> %v", mc.Old, mc.New)
+}
+
+// MappingKeeper keeps a STUN binding alive on a UDP socket in the background,
+// so that Traversals that are passed it with WithMappingKeeper know their
+// server reflexive address without having to ask a STUN server first. Such
+// Traversals emit a srflx candidate for the cached address right after their
+// session description, while natty gathers its own candidates as usual in case
+// the cached one turns out to be stale. natty's traffic to and from that
+// candidate goes through the keeper's socket, which natty uses like a TURN
+// relay on a local port. That needs a natty that accepts -turn, which the
+// embedded one doesn't, so with it, Traversals don't use the keeper.
+type MappingKeeper struct {
+	conn      *net.UDPConn           // the socket whose mapping we keep
+	servers   []*net.UDPAddr         // the STUN servers to ask
+	interval  time.Duration          // how frequently to refresh the mapping
+	mapped    *net.UDPAddr           // our address as seen by the STUN servers, nil if unknown
+	pending   map[string]chan []byte // responses by transaction id
+	bindings  []*mappingBinding      // the bindings relaying through the socket
+	changes   chan *MappingChange    // changes of mapped
+	mutex     sync.Mutex             // synchronizes access to the above
+	closedCh  chan struct{}          // closed once Close() has been called
+	closeOnce sync.Once              // makes sure that closedCh is only closed once
+}
+
+// StartMappingKeeper starts keeping a mapping on a new UDP socket using the
+// given STUN servers ([stun:]host:port), which are tried in order, refreshing
+// it at the given interval. The interval needs to be shorter than the time
+// the NAT keeps idle UDP mappings, which is often only 30 seconds.
+// StartMappingKeeper fails if none of the STUN servers respond.
+func StartMappingKeeper(stunServers []string, interval time.Duration) (*MappingKeeper, error) {
+	if len(stunServers) == 0 {
+		return nil, fmt.Errorf("No STUN servers to keep mapping with")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("Invalid mapping refresh interval %s", interval)
+	}
+	k := &MappingKeeper{
+		interval: interval,
+		pending:  make(map[string]chan []byte),
+		changes:  make(chan *MappingChange, mappingChangesBuffer),
+		closedCh: make(chan struct{}),
+	}
+	for _, server := range stunServers {
+		addr, err := net.ResolveUDPAddr("udp", strings.TrimPrefix(server, "stun:"))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve STUN server %s: %s", server, err)
+		}
+		k.servers = append(k.servers, addr)
+	}
+	var err error
+	k.conn, err = net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for STUN responses: %s", err)
+	}
+	go k.read()
+
+	err = k.refresh()
+	if err != nil {
+		k.Close()
+		return nil, err
+	}
+	log.Tracef("Keeping mapping %s for %s", k.Mapping(), k.conn.LocalAddr())
+	go k.keepRefreshed()
+	return k, nil
+}
+
+// Mapping returns our server reflexive address as last seen by a STUN server,
+// or nil if it's currently unknown.
+func (k *MappingKeeper) Mapping() *net.UDPAddr {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.mapped
+}
+
+// Changes returns a channel on which the keeper reports changes of the
+// mapping. Changes are dropped if the channel's buffer is full.
+func (k *MappingKeeper) Changes() <-chan *MappingChange {
+	return k.changes
+}
+
+// Close stops keeping the mapping and closes the socket. Traversals that are
+// still relaying through it lose their seeded candidates.
+func (k *MappingKeeper) Close() error {
+	closed := false
+	k.closeOnce.Do(func() {
+		closed = true
+		close(k.closedCh)
+	})
+	if !closed {
+		return nil
+	}
+	return k.conn.Close()
+}
+
+func (k *MappingKeeper) isClosed() bool {
+	select {
+	case <-k.closedCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// keepRefreshed refreshes the mapping at the keeper's interval until it's
+// closed.
+func (k *MappingKeeper) keepRefreshed() {
+	for {
+		select {
+		case <-k.closedCh:
+			return
+		case <-time.After(k.interval):
+		}
+		err := k.refresh()
+		if err != nil && !k.isClosed() {
+			log.Debugf("Unable to refresh mapping: %s", err)
+		}
+	}
+}
+
+// refresh asks the STUN servers in turn for our reflexive address until one
+// responds, invalidating the mapping if none do, and reports any change.
+func (k *MappingKeeper) refresh() error {
+	var mapped *net.UDPAddr
+	var err error
+	for _, server := range k.servers {
+		mapped, err = k.binding(server)
+		if err == nil {
+			break
+		}
+	}
+	if k.isClosed() {
+		return nil
+	}
+
+	k.mutex.Lock()
+	old := k.mapped
+	k.mapped = mapped
+	k.mutex.Unlock()
+	if old.String() != mapped.String() {
+		if old != nil {
+			log.Debugf("Mapping changed from %v to %v", old, mapped)
+		}
+		k.notify(&MappingChange{Old: old, New: mapped})
+	}
+	return err
+}
+
+// notify reports a change of the mapping without blocking.
+func (k *MappingKeeper) notify(change *MappingChange) {
+	select {
+	case k.changes <- change:
+	default:
+		log.Tracef("Dropping mapping change %s", change)
+	}
+}
+
+// binding does a STUN binding request with the given server, retransmitting
+// it per stun.Timeouts until the server responds or mappingRequestTimeout
+// elapses. Since the keeper's socket also carries natty's traffic, responses
+// come in through read rather than stun.Query.
+func (k *MappingKeeper) binding(server *net.UDPAddr) (*net.UDPAddr, error) {
+	tx, err := stun.NewTransaction()
+	if err != nil {
+		return nil, err
+	}
+	id := tx.ID()
+	respCh := make(chan []byte, 1)
+	k.mutex.Lock()
+	k.pending[string(id[:])] = respCh
+	k.mutex.Unlock()
+	defer func() {
+		k.mutex.Lock()
+		delete(k.pending, string(id[:]))
+		k.mutex.Unlock()
+	}()
+
+	req := tx.Request()
+	timeout := time.After(mappingRequestTimeout)
+	for _, wait := range stun.Timeouts(stun.DefaultRTO) {
+		_, err := k.conn.WriteToUDP(req, server)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case msg := <-respCh:
+			resp, err := tx.Match(msg)
+			if err != nil {
+				return nil, err
+			}
+			if resp == nil || !resp.Mapped.IsValid() {
+				return nil, fmt.Errorf("STUN server %s didn't say what our address is", server)
+			}
+			return net.UDPAddrFromAddrPort(resp.Mapped), nil
+		case <-time.After(wait):
+		case <-timeout:
+			return nil, fmt.Errorf("STUN server %s didn't respond within %s", server, mappingRequestTimeout)
+		case <-k.closedCh:
+			return nil, fmt.Errorf("Mapping keeper closed")
+		}
+	}
+	return nil, fmt.Errorf("STUN server %s didn't respond", server)
+}
+
+// read reads from the socket until the keeper is closed, passing responses
+// from the STUN servers to whoever's waiting for them and everything else to
+// the binding that it's for.
+func (k *MappingKeeper) read() {
+	b := make([]byte, 65536)
+	for {
+		n, from, err := k.conn.ReadFromUDP(b)
+		if err != nil {
+			if !k.isClosed() {
+				log.Errorf("Unable to read from mapping keeper's socket: %s", err)
+			}
+			return
+		}
+		msg := append([]byte{}, b[:n]...)
+		if isSTUN(msg) && msg[0]&0x01 != 0 {
+			// Success or error response, possibly from a STUN server
+			k.mutex.Lock()
+			respCh := k.pending[string(msg[8:stunHeaderSize])]
+			k.mutex.Unlock()
+			if respCh != nil {
+				select {
+				case respCh <- msg:
+				default:
+				}
+				continue
+			}
+		}
+		k.fromPeer(msg, from)
+	}
+}
+
+// fromPeer passes a packet from a peer to the most recent binding that
+// created a permission for it.
+func (k *MappingKeeper) fromPeer(msg []byte, from *net.UDPAddr) {
+	k.mutex.Lock()
+	var binding *mappingBinding
+	for i := len(k.bindings) - 1; i >= 0 && binding == nil; i-- {
+		if k.bindings[i].permits(from.IP) {
+			binding = k.bindings[i]
+		}
+	}
+	k.mutex.Unlock()
+	if binding != nil {
+		binding.fromPeer(msg, from)
+	}
+}
+
+// seedCandidate returns a trickled candidate message for the current mapping,
+// or nil if it's unknown.
+func (k *MappingKeeper) seedCandidate() []byte {
+	mapped := k.Mapping()
+	if mapped == nil {
+		return nil
+	}
+	c := &Candidate{
+		Foundation:     "1",
+		Component:      1,
+		Protocol:       "udp",
+		Priority:       mappingPriority,
+		Address:        mapped.String(),
+		Type:           "srflx",
+		RelatedAddress: k.conn.LocalAddr().String(),
+	}
+	msg, _ := json.Marshal(&candidateMsg{Candidate: c.ICELine(), SdpMid: "data"})
+	return msg
+}
+
+// mappingBinding lets a single natty process relay through a MappingKeeper's
+// socket. natty talks TURN to the binding, on a local port, as if it were a
+// TURN server whose relay is the keeper's mapping. Unlike a turnBinding, there
+// is no real TURN server behind it, so the binding answers every request
+// itself and exchanges data with peers directly from the keeper's socket.
+type mappingBinding struct {
+	keeper      *MappingKeeper
+	conn        *net.UDPConn      // the socket with which natty talks to us
+	nattyAddr   *net.UDPAddr      // where natty talks to us from
+	permissions map[string]bool   // peer IPs for which natty created permissions
+	channels    map[uint16]string // peers by channel number
+	mutex       sync.Mutex        // synchronizes access to the above
+	closeOnce   sync.Once
+}
+
+// bind creates a binding through which a natty process can relay through the
+// keeper's socket.
+func (k *MappingKeeper) bind() (*mappingBinding, error) {
+	if k.isClosed() {
+		return nil, fmt.Errorf("Mapping keeper is closed")
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for natty's TURN requests: %s", err)
+	}
+	b := &mappingBinding{
+		keeper:      k,
+		conn:        conn,
+		permissions: make(map[string]bool),
+		channels:    make(map[uint16]string),
+	}
+	k.mutex.Lock()
+	k.bindings = append(k.bindings, b)
+	k.mutex.Unlock()
+	go b.serve()
+	return b, nil
+}
+
+// addr is the address that natty should use as its TURN server.
+func (b *mappingBinding) addr() string {
+	return b.conn.LocalAddr().String()
+}
+
+func (b *mappingBinding) close() {
+	b.closeOnce.Do(func() {
+		k := b.keeper
+		k.mutex.Lock()
+		for i, other := range k.bindings {
+			if other == b {
+				k.bindings = append(k.bindings[:i], k.bindings[i+1:]...)
+				break
+			}
+		}
+		k.mutex.Unlock()
+		b.conn.Close()
+	})
+}
+
+// permits indicates whether natty created a permission for the given peer IP.
+func (b *mappingBinding) permits(ip net.IP) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.permissions[ip.String()]
+}
+
+// toNatty passes a message on to natty.
+func (b *mappingBinding) toNatty(msg []byte) {
+	b.mutex.Lock()
+	to := b.nattyAddr
+	b.mutex.Unlock()
+	if to != nil {
+		b.conn.WriteToUDP(msg, to)
+	}
+}
+
+// fromPeer passes a packet from the given peer on to natty, as ChannelData if
+// natty bound a channel to the peer, otherwise as a Data indication.
+func (b *mappingBinding) fromPeer(msg []byte, from *net.UDPAddr) {
+	peer := from.String()
+	b.mutex.Lock()
+	var number uint16
+	for n, p := range b.channels {
+		if p == peer {
+			number = n
+		}
+	}
+	b.mutex.Unlock()
+	if number != 0 {
+		header := make([]byte, 4, 4+len(msg))
+		binary.BigEndian.PutUint16(header, number)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(msg)))
+		b.toNatty(append(header, msg...))
+		return
+	}
+	b.toNatty(newSTUNMessage(turnDataIndication).addAddr(stunAttrXorPeerAddress, from).add(stunAttrData, msg).encode(nil))
+}
+
+// serve handles natty's TURN traffic until the binding is closed.
+func (b *mappingBinding) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		b.mutex.Lock()
+		b.nattyAddr = from
+		b.mutex.Unlock()
+		msg := append([]byte{}, buf[:n]...)
+		if !isSTUN(msg) {
+			b.sendChannelData(msg)
+			continue
+		}
+		m, err := parseSTUN(msg)
+		if err != nil {
+			continue
+		}
+		switch m.typ {
+		case turnSendIndication:
+			peer := m.getAddr(stunAttrXorPeerAddress)
+			if peer != nil && b.permits(peer.IP) {
+				b.keeper.conn.WriteToUDP(m.get(stunAttrData), peer)
+			}
+		case turnAllocateRequest:
+			mapped := b.keeper.Mapping()
+			if mapped == nil {
+				b.respond(m.reply(turnAllocateRequest|0x0110).addError(508, "Mapping Lost"))
+				continue
+			}
+			b.respond(m.reply(turnAllocateRequest|0x0100).
+				addAddr(stunAttrXorRelayedAddress, mapped).
+				addAddr(stunAttrXorMappedAddress, mapped).
+				addUint32(stunAttrLifetime, uint32(turnDefaultLifetime/time.Second)))
+		case turnRefreshRequest:
+			// The mapping is refreshed for as long as the keeper is open
+			lifetime, ok := m.getUint32(stunAttrLifetime)
+			if !ok {
+				lifetime = uint32(turnDefaultLifetime / time.Second)
+			}
+			b.respond(m.reply(turnRefreshRequest|0x0100).addUint32(stunAttrLifetime, lifetime))
+		case turnCreatePermissionRequest:
+			b.mutex.Lock()
+			for _, peer := range m.getAddrs(stunAttrXorPeerAddress) {
+				b.permissions[peer.IP.String()] = true
+			}
+			b.mutex.Unlock()
+			b.respond(m.reply(turnCreatePermissionRequest | 0x0100))
+		case turnChannelBindRequest:
+			b.bindChannel(m)
+		default:
+			log.Tracef("Ignoring unexpected TURN message %#04x from natty", m.typ)
+		}
+	}
+}
+
+func (b *mappingBinding) respond(m *stunMessage) {
+	b.toNatty(m.encode(nil))
+}
+
+// bindChannel binds the channel that natty asked for to its peer.
+func (b *mappingBinding) bindChannel(req *stunMessage) {
+	number := req.get(stunAttrChannelNumber)
+	peer := req.getAddr(stunAttrXorPeerAddress)
+	if len(number) < 2 || peer == nil {
+		b.respond(req.reply(req.typ|0x0110).addError(400, "Bad Request"))
+		return
+	}
+	b.mutex.Lock()
+	b.channels[binary.BigEndian.Uint16(number)] = peer.String()
+	b.permissions[peer.IP.String()] = true
+	b.mutex.Unlock()
+	b.respond(req.reply(turnChannelBindRequest | 0x0100))
+}
+
+// sendChannelData sends the payload of ChannelData from natty to the peer to
+// which the channel is bound.
+func (b *mappingBinding) sendChannelData(msg []byte) {
+	if len(msg) < 4 {
+		return
+	}
+	b.mutex.Lock()
+	peer := b.channels[binary.BigEndian.Uint16(msg)]
+	b.mutex.Unlock()
+	if peer == "" {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	if length > len(msg)-4 {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", peer)
+	if err == nil {
+		b.keeper.conn.WriteToUDP(msg[4:4+length], addr)
+	}
+}
@@ -0,0 +1,278 @@
+package natty
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestMappingKeeper(t *testing.T) {
+	defer func(timeout time.Duration) { mappingRequestTimeout = timeout }(mappingRequestTimeout)
+	mappingRequestTimeout = 300 * time.Millisecond
+
+	dead := startFakeSTUN(t, 0)
+	dead.setSilent(true)
+	defer dead.close()
+	server := startFakeSTUN(t, 0)
+	defer server.close()
+
+	_, err := StartMappingKeeper([]string{dead.addr()}, time.Second)
+	assert.Error(t, err, "Shouldn't start without a working STUN server")
+
+	k, err := StartMappingKeeper([]string{dead.addr(), "stun:" + server.addr()}, 50*time.Millisecond)
+	if !assert.NoError(t, err, "Should fall back to the working STUN server") {
+		return
+	}
+	defer k.Close()
+	mapped := k.Mapping()
+	if assert.NotNil(t, mapped) {
+		assert.Equal(t, k.conn.LocalAddr().(*net.UDPAddr).Port, mapped.Port)
+	}
+	change := nextMappingChange(t, k)
+	assert.Nil(t, change.Old)
+	assert.Equal(t, mapped.String(), change.New.String())
+
+	// NAT reboot
+	server.setShift(1)
+	change = nextMappingChange(t, k)
+	assert.Equal(t, mapped.String(), change.Old.String())
+	if assert.NotNil(t, change.New) {
+		assert.Equal(t, mapped.Port+1, change.New.Port)
+	}
+
+	// Lost
+	server.setSilent(true)
+	change = nextMappingChange(t, k)
+	assert.Nil(t, change.New)
+	assert.Nil(t, k.Mapping())
+	assert.Nil(t, k.seedCandidate(), "Shouldn't seed a candidate without a mapping")
+
+	server.setSilent(false)
+	change = nextMappingChange(t, k)
+	assert.Nil(t, change.Old)
+	assert.NotNil(t, k.Mapping(), "Mapping should come back")
+	assert.NoError(t, k.Close())
+}
+
+func TestSeedCandidate(t *testing.T) {
+	server := startFakeSTUN(t, 0)
+	defer server.close()
+	k, err := StartMappingKeeper([]string{server.addr()}, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer k.Close()
+
+	msg := k.seedCandidate()
+	assert.True(t, isCandidate(msg))
+	cm := &candidateMsg{}
+	if assert.NoError(t, json.Unmarshal(msg, cm)) {
+		c, err := parseCandidate(cm.Candidate)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "srflx", c.Type)
+			assert.Equal(t, k.Mapping().String(), c.Address)
+			assert.Equal(t, uint32(mappingPriority), c.Priority)
+		}
+	}
+}
+
+func TestMappingKeeperWithoutTurnFlag(t *testing.T) {
+	server := startFakeSTUN(t, 0)
+	defer server.close()
+	k, err := StartMappingKeeper([]string{server.addr()}, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer k.Close()
+
+	executable, remove := sleepingNatty(t)
+	defer remove()
+	tr := newTraversal(0, []Option{WithBinary(executable), WithMappingKeeper(k)})
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.NotNil(t, tr.seedCandidate, "Should seed the cached candidate")
+		assert.True(t, strings.Contains(strings.Join(tr.cmd.Args, " "), "-turn "), "Should relay through the keeper")
+		tr.mappingBinding.close()
+	}
+
+	executable, remove = scriptedNatty(t, "exec sleep 30", "offer")
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(executable), WithMappingKeeper(k)})
+	if assert.NoError(t, tr.initCommand(nil), "natty that doesn't accept -turn should run without the keeper") {
+		assert.Nil(t, tr.seedCandidate, "Shouldn't seed a candidate that natty can't relay")
+		assert.Nil(t, tr.mappingBinding)
+		assert.False(t, strings.Contains(strings.Join(tr.cmd.Args, " "), "-turn"))
+	}
+}
+
+func TestMappingBinding(t *testing.T) {
+	server := startFakeSTUN(t, 0)
+	defer server.close()
+	k, err := StartMappingKeeper([]string{server.addr()}, time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer k.Close()
+	binding, err := k.bind()
+	if !assert.NoError(t, err) {
+		return
+	}
+	natty := &fakeNatty{t, listenLoopback(t), binding}
+	defer natty.close()
+	peer := listenLoopback(t)
+	defer peer.Close()
+	keeperAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: k.Mapping().Port}
+
+	m := natty.request(newSTUNMessage(turnAllocateRequest).addUint32(stunAttrRequestedTransport, turnTransportUDP))
+	if assert.True(t, m.isSuccess(), "Allocate should succeed") {
+		assert.Equal(t, k.Mapping().String(), m.getAddr(stunAttrXorRelayedAddress).String(), "Relay should be the mapping")
+	}
+
+	// Without a permission, nothing gets through
+	peer.WriteToUDP([]byte("too early"), keeperAddr)
+	time.Sleep(50 * time.Millisecond)
+	m = natty.request(newSTUNMessage(turnCreatePermissionRequest).addAddr(stunAttrXorPeerAddress, udpAddr(peer)))
+	assert.True(t, m.isSuccess(), "CreatePermission should succeed")
+	peer.WriteToUDP([]byte("hello"), keeperAddr)
+	data, err := parseSTUN(natty.read())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello", string(data.get(stunAttrData)))
+	}
+	natty.send(newSTUNMessage(turnSendIndication).addAddr(stunAttrXorPeerAddress, udpAddr(peer)).add(stunAttrData, []byte("hi")).encode(nil))
+	assert.Equal(t, "hi", readFrom(t, peer))
+
+	m = natty.request(newSTUNMessage(turnChannelBindRequest).add(stunAttrChannelNumber, []byte{0x40, 0x00, 0, 0}).addAddr(stunAttrXorPeerAddress, udpAddr(peer)))
+	assert.True(t, m.isSuccess(), "ChannelBind should succeed")
+	natty.send(append([]byte{0x40, 0x00, 0, 7}, "channel"...))
+	assert.Equal(t, "channel", readFrom(t, peer))
+	peer.WriteToUDP([]byte("reply"), keeperAddr)
+	assert.Equal(t, append([]byte{0x40, 0x00, 0, 5}, "reply"...), natty.read())
+}
+
+func BenchmarkFirstCandidate(b *testing.B) {
+	// Simulates a STUN server 20ms away
+	server := startFakeSTUN(b, 20*time.Millisecond)
+	defer server.close()
+
+	b.Run("Fresh", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			k, err := StartMappingKeeper([]string{server.addr()}, time.Minute)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if k.seedCandidate() == nil {
+				b.Fatal("No candidate")
+			}
+			k.Close()
+		}
+	})
+
+	b.Run("Cached", func(b *testing.B) {
+		k, err := StartMappingKeeper([]string{server.addr()}, time.Minute)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer k.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if k.seedCandidate() == nil {
+				b.Fatal("No candidate")
+			}
+		}
+	})
+}
+
+func nextMappingChange(t *testing.T, k *MappingKeeper) *MappingChange {
+	t.Helper()
+	select {
+	case change := <-k.Changes():
+		return change
+	case <-time.After(2 * time.Second):
+		t.Fatal("Mapping didn't change")
+		return nil
+	}
+}
+
+// fakeSTUN is a STUN server that answers binding requests after the given
+// delay, optionally shifting the port that it reports, not answering the first
+// client that it hears from (like a NAT that blackholes that client's mapping)
+// or not answering at all.
+type fakeSTUN struct {
+	conn      *net.UDPConn
+	delay     time.Duration
+	shift     int
+	silent    bool
+	dropFirst bool
+	first     string
+	mutex     sync.Mutex
+}
+
+func startFakeSTUN(tb testing.TB, delay time.Duration) *fakeSTUN {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatalf("Unable to listen: %s", err)
+	}
+	s := &fakeSTUN{conn: conn, delay: delay}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSTUN) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *fakeSTUN) setShift(shift int) {
+	s.mutex.Lock()
+	s.shift = shift
+	s.mutex.Unlock()
+}
+
+func (s *fakeSTUN) setSilent(silent bool) {
+	s.mutex.Lock()
+	s.silent = silent
+	s.mutex.Unlock()
+}
+
+func (s *fakeSTUN) blackholeFirst() {
+	s.mutex.Lock()
+	s.dropFirst = true
+	s.mutex.Unlock()
+}
+
+func (s *fakeSTUN) close() {
+	s.conn.Close()
+}
+
+func (s *fakeSTUN) serve() {
+	b := make([]byte, 1500)
+	for {
+		n, from, err := s.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		m, err := parseSTUN(b[:n])
+		if err != nil || m.typ != stunBindingRequest {
+			continue
+		}
+		s.mutex.Lock()
+		if s.dropFirst && s.first == "" {
+			s.first = from.String()
+		}
+		silent := s.silent || from.String() == s.first
+		mapped := &net.UDPAddr{IP: from.IP, Port: from.Port + s.shift}
+		s.mutex.Unlock()
+		if silent {
+			continue
+		}
+		resp := m.reply(stunBindingRequest|0x0100).addAddr(stunAttrXorMappedAddress, mapped).encode(nil)
+		if s.delay > 0 {
+			time.AfterFunc(s.delay, func() { s.conn.WriteToUDP(resp, from) })
+		} else {
+			s.conn.WriteToUDP(resp, from)
+		}
+	}
+}
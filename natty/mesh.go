@@ -0,0 +1,452 @@
+package natty
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMeshConcurrency is how many traversals a Mesh offers at once if
+	// its MeshConfig doesn't say.
+	DefaultMeshConcurrency = 4
+
+	// DefaultMeshRetryInterval is how long a Mesh waits before reconnecting to
+	// a peer whose connection failed, if its MeshConfig doesn't say.
+	DefaultMeshRetryInterval = 5 * time.Second
+
+	// meshEventsBuffer is how many MeshEvents are buffered for the application
+	meshEventsBuffer = 100
+
+	// meshLinkBuffer is how many messages from a peer are buffered for its
+	// PeerConnection
+	meshLinkBuffer = 100
+)
+
+// MeshSignaler exchanges signaling messages with all the peers of a Mesh, by
+// whatever means the application uses for signaling. It's like Signaler,
+// except that messages are addressed to and from peers by their IDs.
+type MeshSignaler interface {
+	// Send sends a message to the given peer, taking ownership of msg.
+	Send(peer string, msg []byte) error
+
+	// Receive waits for the next message from any peer, of which the caller
+	// takes ownership. It returns an error once the MeshSignaler has been
+	// closed.
+	Receive() (peer string, msg []byte, err error)
+
+	// Close stops signaling, making pending and future calls to Receive fail.
+	Close() error
+}
+
+// MeshConfig configures a Mesh.
+type MeshConfig struct {
+	// Peer configures the PeerConnection to each peer.
+	Peer PeerConfig
+
+	// MaxConcurrent is how many traversals the Mesh offers at once,
+	// DefaultMeshConcurrency if 0. Answering isn't limited, since the peers
+	// limit what they offer.
+	MaxConcurrent int
+
+	// RetryInterval is how long to wait before reconnecting to a peer whose
+	// connection failed, DefaultMeshRetryInterval if 0.
+	RetryInterval time.Duration
+
+	// Accept decides whether to connect with peers that weren't added but
+	// signal us, which all are if it's nil. It's called with the Mesh locked.
+	Accept func(peer string) bool
+}
+
+// MeshEvent tells that the connection to a peer went up or down.
+type MeshEvent struct {
+	Peer string
+	Up   bool
+}
+
+func (e *MeshEvent) String() string {
+	if e.Up {
+		return fmt.Sprintf("%s up", e.Peer)
+	}
+	return fmt.Sprintf("%s down", e.Peer)
+}
+
+// Mesh keeps PeerConnections to a set of peers, all signaling through a single
+// MeshSignaler. Peers can add each other at the same time: both ends of a pair
+// share a PeerConnection whose role negotiation picks one to offer, so each
+// pair ends up with exactly one connection. Connections that fail are retried
+// for as long as the peer stays added.
+type Mesh struct {
+	signaler MeshSignaler
+	config   MeshConfig
+	slots    chan struct{}
+	events   chan *MeshEvent
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// traverse, if set, replaces natty for tests
+	traverse func(ctx context.Context, peer string, epoch int, generation int, offering bool, onDead func()) (net.Conn, *Traversal, error)
+
+	mutex   sync.Mutex
+	peers   map[string]*meshPeer
+	removed map[string]bool // peers not to accept until added again
+	closed  bool
+}
+
+// meshPeer is a peer of a Mesh. Each PeerConnection to it has an epoch, which
+// prefixes its signaling messages so that those of an old PeerConnection don't
+// get mixed up with its replacement's. Whichever end starts a new epoch first,
+// the other follows.
+type meshPeer struct {
+	id     string
+	wanted bool // whether it was added, rather than accepted
+	epoch  int
+	pc     *PeerConnection
+	link   *meshLink
+	up     bool
+	retry  *time.Timer
+}
+
+// NewMesh returns a Mesh that signals with its peers through signaler. config
+// may be nil for the defaults.
+func NewMesh(signaler MeshSignaler, config *MeshConfig) *Mesh {
+	return newMesh(signaler, config, nil)
+}
+
+func newMesh(signaler MeshSignaler, config *MeshConfig, traverse func(ctx context.Context, peer string, epoch int, generation int, offering bool, onDead func()) (net.Conn, *Traversal, error)) *Mesh {
+	m := &Mesh{
+		signaler: signaler,
+		events:   make(chan *MeshEvent, meshEventsBuffer),
+		traverse: traverse,
+		peers:    make(map[string]*meshPeer),
+		removed:  make(map[string]bool),
+	}
+	if config != nil {
+		m.config = *config
+	}
+	maxConcurrent := m.config.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMeshConcurrency
+	}
+	m.slots = make(chan struct{}, maxConcurrent)
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	go m.receive()
+	return m
+}
+
+// AddPeer connects to the given peer, unless already connected or connecting.
+func (m *Mesh) AddPeer(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return
+	}
+	delete(m.removed, id)
+	p := m.peers[id]
+	if p != nil {
+		p.wanted = true
+		return
+	}
+	p = &meshPeer{id: id, wanted: true}
+	m.peers[id] = p
+	m.startLocked(p)
+}
+
+// RemovePeer disconnects from the given peer and stops accepting connections
+// from it until it's added again.
+func (m *Mesh) RemovePeer(id string) {
+	m.mutex.Lock()
+	p := m.peers[id]
+	delete(m.peers, id)
+	m.removed[id] = true
+	var pc *PeerConnection
+	if p != nil {
+		pc = m.stopLocked(p)
+	}
+	m.mutex.Unlock()
+	if pc != nil {
+		pc.Close()
+	}
+}
+
+// Peers returns the IDs of the peers that the Mesh is connected or connecting
+// to, in order.
+func (m *Mesh) Peers() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ids := make([]string, 0, len(m.peers))
+	for id := range m.peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// State returns the state of the connection to the given peer, or false if
+// it's not a peer.
+func (m *Mesh) State(id string) (PeerState, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p := m.peers[id]
+	if p == nil {
+		return PeerClosed, false
+	}
+	if p.pc == nil {
+		// Waiting to retry
+		return PeerFailed, true
+	}
+	return p.pc.State(), true
+}
+
+// Conn returns the conn to the given peer (see PeerConnection.Conn), or false
+// if it's not connected.
+func (m *Mesh) Conn(id string) (net.Conn, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p := m.peers[id]
+	if p == nil || !p.up {
+		return nil, false
+	}
+	return p.pc.Conn(), true
+}
+
+// Events returns a channel of MeshEvents, which the application should keep
+// reading from, since events that don't fit its buffer are dropped.
+func (m *Mesh) Events() <-chan *MeshEvent {
+	return m.events
+}
+
+// Close closes the connections to all peers and the MeshSignaler.
+func (m *Mesh) Close() error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.closed = true
+	var pcs []*PeerConnection
+	for id, p := range m.peers {
+		if pc := m.stopLocked(p); pc != nil {
+			pcs = append(pcs, pc)
+		}
+		delete(m.peers, id)
+	}
+	close(m.events)
+	m.mutex.Unlock()
+
+	m.cancel()
+	for _, pc := range pcs {
+		pc.Close()
+	}
+	return m.signaler.Close()
+}
+
+// startLocked starts a PeerConnection to p in its current epoch.
+func (m *Mesh) startLocked(p *meshPeer) {
+	epoch := p.epoch
+	link := &meshLink{m: m, peer: p.id, epoch: epoch, in: make(chan []byte, meshLinkBuffer), closedCh: make(chan struct{})}
+	pc := NewPeerConnection(link, &m.config.Peer)
+	pc.traverse = func(ctx context.Context, generation int, offering bool, onDead func()) (net.Conn, *Traversal, error) {
+		if offering {
+			select {
+			case m.slots <- struct{}{}:
+				defer func() { <-m.slots }()
+			case <-ctx.Done():
+				return nil, nil, fmt.Errorf("Too many traversals: %s", ctx.Err())
+			}
+		}
+		if m.traverse != nil {
+			return m.traverse(ctx, p.id, epoch, generation, offering, onDead)
+		}
+		return pc.traverseICE(ctx, generation, offering, onDead)
+	}
+	pc.OnStateChange(func(from PeerState, to PeerState) {
+		m.stateChanged(p, pc, to)
+	})
+	p.pc = pc
+	p.link = link
+
+	go func() {
+		config := &m.config.Peer
+		timeout := time.Duration(config.retries()+1) * (config.timeout() + peerConfirmTimeout)
+		ctx, cancel := context.WithTimeout(m.ctx, timeout)
+		defer cancel()
+		err := pc.Connect(ctx)
+		if err != nil {
+			log.Debugf("Unable to connect to %s: %s", p.id, err)
+		}
+	}()
+}
+
+// stopLocked stops p, returning its PeerConnection for closing once unlocked.
+func (m *Mesh) stopLocked(p *meshPeer) *PeerConnection {
+	if p.retry != nil {
+		p.retry.Stop()
+	}
+	if p.up {
+		p.up = false
+		m.emitLocked(&MeshEvent{Peer: p.id})
+	}
+	pc := p.pc
+	p.pc = nil
+	return pc
+}
+
+// stateChanged tracks the state of pc, the PeerConnection to p.
+func (m *Mesh) stateChanged(p *meshPeer, pc *PeerConnection, state PeerState) {
+	m.mutex.Lock()
+	if m.closed || m.peers[p.id] != p || p.pc != pc {
+		m.mutex.Unlock()
+		return
+	}
+	if up := state == PeerConnected; up != p.up {
+		p.up = up
+		m.emitLocked(&MeshEvent{Peer: p.id, Up: up})
+	}
+	if state != PeerFailed {
+		m.mutex.Unlock()
+		return
+	}
+
+	m.stopLocked(p)
+	if p.wanted {
+		p.retry = time.AfterFunc(m.retryInterval(), func() {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			if !m.closed && m.peers[p.id] == p && p.pc == nil {
+				p.epoch++
+				m.startLocked(p)
+			}
+		})
+	} else {
+		delete(m.peers, p.id)
+	}
+	m.mutex.Unlock()
+	go pc.Close()
+}
+
+func (m *Mesh) retryInterval() time.Duration {
+	if m.config.RetryInterval > 0 {
+		return m.config.RetryInterval
+	}
+	return DefaultMeshRetryInterval
+}
+
+func (m *Mesh) emitLocked(e *MeshEvent) {
+	select {
+	case m.events <- e:
+	default:
+		log.Errorf("Mesh events full, dropping: %s", e)
+	}
+}
+
+// receive routes messages from the MeshSignaler to the PeerConnections of
+// their epochs, starting PeerConnections for new peers and epochs.
+func (m *Mesh) receive() {
+	for {
+		peer, msg, err := m.signaler.Receive()
+		if err != nil {
+			return
+		}
+		e, n := binary.Uvarint(msg)
+		if n <= 0 {
+			log.Debugf("Ignoring message without epoch from %s", peer)
+			putMsgBuf(msg)
+			continue
+		}
+		epoch := int(e)
+		msg = msg[:copy(msg, msg[n:])]
+
+		m.mutex.Lock()
+		p := m.peers[peer]
+		var old *PeerConnection
+		switch {
+		case m.closed:
+			p = nil
+		case p == nil:
+			if m.removed[peer] || (m.config.Accept != nil && !m.config.Accept(peer)) {
+				break
+			}
+			p = &meshPeer{id: peer, epoch: epoch}
+			m.peers[peer] = p
+			m.startLocked(p)
+		case epoch < p.epoch:
+			// From a PeerConnection that's since been replaced
+			p = nil
+		case epoch > p.epoch:
+			// The peer started over
+			old = m.stopLocked(p)
+			p.epoch = epoch
+			m.startLocked(p)
+		}
+		var link *meshLink
+		if p != nil {
+			link = p.link
+		}
+		m.mutex.Unlock()
+
+		if old != nil {
+			go old.Close()
+		}
+		if link == nil {
+			putMsgBuf(msg)
+			continue
+		}
+		link.deliver(msg)
+	}
+}
+
+// meshLink is the Signaler of a PeerConnection in a Mesh.
+type meshLink struct {
+	m         *Mesh
+	peer      string
+	epoch     int
+	in        chan []byte
+	closedCh  chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *meshLink) Send(msg []byte) error {
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(l.epoch))
+	framed := append(append(getMsgBuf(), prefix[:n]...), msg...)
+	putMsgBuf(msg)
+	return l.m.signaler.Send(l.peer, framed)
+}
+
+func (l *meshLink) Receive() ([]byte, error) {
+	select {
+	case msg := <-l.in:
+		return msg, nil
+	case <-l.closedCh:
+		return nil, fmt.Errorf("Link to %s closed", l.peer)
+	}
+}
+
+func (l *meshLink) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closedCh)
+	})
+	return nil
+}
+
+// deliver passes msg on to the PeerConnection, dropping it if the
+// PeerConnection isn't keeping up.
+func (l *meshLink) deliver(msg []byte) {
+	select {
+	case <-l.closedCh:
+		putMsgBuf(msg)
+		return
+	default:
+	}
+	select {
+	case l.in <- msg:
+	default:
+		log.Errorf("Too many messages from %s, dropping", l.peer)
+		putMsgBuf(msg)
+	}
+}
@@ -0,0 +1,265 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// TestMesh forms a 4-node mesh in which every node adds every other at the
+// same time, and checks that each pair ends up with exactly one connection.
+func TestMesh(t *testing.T) {
+	ids := []string{"a", "b", "c", "d"}
+	hub := newPipeHub(ids)
+	fabric := &meshFabric{}
+	meshes := make(map[string]*Mesh)
+	for _, id := range ids {
+		m := newMesh(hub.signaler(id), &MeshConfig{MaxConcurrent: 1}, fabric.forNode(id))
+		defer m.Close()
+		meshes[id] = m
+	}
+	for _, id := range ids {
+		for _, peer := range ids {
+			if peer != id {
+				meshes[id].AddPeer(peer)
+			}
+		}
+	}
+
+	for _, id := range ids {
+		up := make(map[string]bool)
+		timeout := time.After(10 * time.Second)
+		for len(up) < len(ids)-1 {
+			select {
+			case e := <-meshes[id].Events():
+				if assert.True(t, e.Up, fmt.Sprintf("Unexpected %s at %s", e, id)) {
+					up[e.Peer] = true
+				}
+			case <-timeout:
+				t.Fatalf("%s only connected to %v", id, up)
+			}
+		}
+	}
+
+	for _, id := range ids {
+		for _, peer := range ids {
+			if peer == id {
+				continue
+			}
+			state, ok := meshes[id].State(peer)
+			assert.True(t, ok)
+			assert.Equal(t, PeerConnected, state)
+			conn, ok := meshes[id].Conn(peer)
+			peerConn, peerOK := meshes[peer].Conn(id)
+			if !assert.True(t, ok && peerOK, fmt.Sprintf("%s and %s should be connected", id, peer)) {
+				continue
+			}
+			msg := fmt.Sprintf("%s to %s", id, peer)
+			_, err := conn.Write([]byte(msg))
+			assert.NoError(t, err)
+			b := make([]byte, len(msg))
+			peerConn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = io.ReadFull(peerConn, b)
+			if assert.NoError(t, err) {
+				assert.Equal(t, msg, string(b))
+			}
+		}
+	}
+	assert.Equal(t, []string{"a-b/0", "a-c/0", "a-d/0", "b-c/0", "b-d/0", "c-d/0"}, fabric.connections(), "Should have connected each pair once")
+	assert.True(t, fabric.maxConcurrent() <= 1, "Shouldn't offer more than MaxConcurrent traversals at once")
+
+	// Removing a peer takes it down
+	meshes["a"].RemovePeer("b")
+	select {
+	case e := <-meshes["a"].Events():
+		assert.Equal(t, &MeshEvent{Peer: "b"}, e)
+	case <-time.After(time.Second):
+		t.Fatal("No event for removing peer")
+	}
+	_, ok := meshes["a"].Conn("b")
+	assert.False(t, ok)
+	assert.Equal(t, []string{"c", "d"}, meshes["a"].Peers())
+}
+
+func TestMeshRetry(t *testing.T) {
+	ids := []string{"a", "b"}
+	hub := newPipeHub(ids)
+	fabric := &meshFabric{failFirst: true}
+	config := &MeshConfig{RetryInterval: 50 * time.Millisecond, Peer: PeerConfig{Retries: -1}}
+	a := newMesh(hub.signaler("a"), config, fabric.forNode("a"))
+	defer a.Close()
+	b := newMesh(hub.signaler("b"), config, fabric.forNode("b"))
+	defer b.Close()
+
+	// Only a adds b, b accepts
+	a.AddPeer("b")
+	select {
+	case e := <-a.Events():
+		assert.Equal(t, &MeshEvent{Peer: "b", Up: true}, e)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Didn't connect after retrying")
+	}
+	assert.Equal(t, []string{"a-b/1"}, fabric.connections(), "Should have connected in the second epoch")
+	assert.Equal(t, []string{"a"}, b.Peers())
+}
+
+// pipeHub passes signaling messages between Meshes in-process.
+type pipeHub struct {
+	nodes map[string]chan *pipeMsg
+}
+
+type pipeMsg struct {
+	from string
+	msg  []byte
+}
+
+func newPipeHub(ids []string) *pipeHub {
+	h := &pipeHub{nodes: make(map[string]chan *pipeMsg)}
+	for _, id := range ids {
+		h.nodes[id] = make(chan *pipeMsg, 1000)
+	}
+	return h
+}
+
+func (h *pipeHub) signaler(id string) MeshSignaler {
+	return &pipeSignaler{h, id, make(chan struct{}), sync.Once{}}
+}
+
+type pipeSignaler struct {
+	hub       *pipeHub
+	id        string
+	closedCh  chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *pipeSignaler) Send(peer string, msg []byte) error {
+	ch := s.hub.nodes[peer]
+	if ch == nil {
+		return fmt.Errorf("Unknown peer %s", peer)
+	}
+	ch <- &pipeMsg{s.id, msg}
+	return nil
+}
+
+func (s *pipeSignaler) Receive() (string, []byte, error) {
+	select {
+	case m := <-s.hub.nodes[s.id]:
+		return m.from, m.msg, nil
+	case <-s.closedCh:
+		return "", nil, fmt.Errorf("Closed")
+	}
+}
+
+func (s *pipeSignaler) Close() error {
+	s.closeOnce.Do(func() { close(s.closedCh) })
+	return nil
+}
+
+// meshFabric stands in for natty in a Mesh, connecting the traversals of each
+// pair, epoch and generation with a pair of UDP conns on localhost.
+type meshFabric struct {
+	failFirst bool // whether the first epoch of each pair fails
+	mutex     sync.Mutex
+	pairs     map[string][]*net.UDPConn
+	offering  map[string]int // how many traversals each node is offering
+	max       int
+}
+
+func (f *meshFabric) forNode(id string) func(ctx context.Context, peer string, epoch int, generation int, offering bool, onDead func()) (net.Conn, *Traversal, error) {
+	return func(ctx context.Context, peer string, epoch int, generation int, offering bool, onDead func()) (net.Conn, *Traversal, error) {
+		if f.failFirst && epoch == 0 {
+			return nil, nil, fmt.Errorf("First epoch fails")
+		}
+		nodes := []string{id, peer}
+		sort.Strings(nodes)
+		key := fmt.Sprintf("%s/%d/%d", strings.Join(nodes, "-"), epoch, generation)
+		if offering {
+			f.mutex.Lock()
+			if f.offering == nil {
+				f.offering = make(map[string]int)
+			}
+			f.offering[id]++
+			if f.offering[id] > f.max {
+				f.max = f.offering[id]
+			}
+			f.mutex.Unlock()
+			// Give other traversals a chance to overlap
+			time.Sleep(20 * time.Millisecond)
+			defer func() {
+				f.mutex.Lock()
+				f.offering[id]--
+				f.mutex.Unlock()
+			}()
+		}
+		conns, err := f.pair(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn := conns[1]
+		if offering {
+			conn = conns[0]
+		}
+		dc := &detachedConn{UDPConn: conn}
+		dc.keeper = NewConnKeeper(conn, nil, DetachKeepAliveInterval, nil)
+		return dc, nil, nil
+	}
+}
+
+func (f *meshFabric) pair(key string) ([]*net.UDPConn, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.pairs == nil {
+		f.pairs = make(map[string][]*net.UDPConn)
+	}
+	if conns := f.pairs[key]; conns != nil {
+		return conns, nil
+	}
+	a, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	b, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	aAddr, bAddr := a.LocalAddr().(*net.UDPAddr), b.LocalAddr().(*net.UDPAddr)
+	a.Close()
+	b.Close()
+	conns := make([]*net.UDPConn, 2)
+	conns[0], err = net.DialUDP("udp4", aAddr, bAddr)
+	if err != nil {
+		return nil, err
+	}
+	conns[1], err = net.DialUDP("udp4", bAddr, aAddr)
+	if err != nil {
+		return nil, err
+	}
+	f.pairs[key] = conns
+	return conns, nil
+}
+
+// connections returns the pairs and epochs that were connected.
+func (f *meshFabric) connections() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var connected []string
+	for key := range f.pairs {
+		connected = append(connected, key[:strings.LastIndex(key, "/")])
+	}
+	sort.Strings(connected)
+	return connected
+}
+
+func (f *meshFabric) maxConcurrent() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.max
+}
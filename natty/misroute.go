@@ -0,0 +1,101 @@
+package natty
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	roleOfferer  = "offerer"
+	roleAnswerer = "answerer"
+)
+
+var (
+	// roles are indexed by their binary encoding in tagged messages
+	roles = []string{roleOfferer, roleAnswerer}
+)
+
+// MisroutedError is returned by TryMsgIn for a message that was meant for a
+// different Traversal, for example an offer passed to a Traversal that's
+// offering itself, or a message tagged with a different session. It usually
+// means that the signaling layer mixed up its sessions.
+type MisroutedError struct {
+	// Role is the role of the Traversal that got the message, offerer or
+	// answerer.
+	Role string
+
+	// Session is the session tag of the Traversal that got the message, if
+	// it has one.
+	Session string
+
+	// MsgFrom is the role of the Traversal that sent the message, if known.
+	MsgFrom string
+
+	// MsgSession is the session tag of the Traversal that sent the message, if
+	// it has one.
+	MsgSession string
+}
+
+func (e *MisroutedError) Error() string {
+	from := e.MsgFrom
+	if from == "" {
+		from = "unknown role"
+	}
+	return fmt.Sprintf("Misrouted message from %s in session %q passed to %s in session %q", from, e.MsgSession, e.Role, e.Session)
+}
+
+// role returns the Traversal's role, offerer or answerer.
+func (t *Traversal) role() string {
+	if t.offering {
+		return roleOfferer
+	}
+	return roleAnswerer
+}
+
+// checkRoute makes sure that msg, which came from a Traversal with the given
+// role and session tag (if known), is meant for this Traversal. Only messages
+// from the opposite role are accepted, judging both by their tag and, for
+// session descriptions, by their content. Messages tagged with a session are
+// only accepted if it matches ours, but untagged messages are accepted from
+// peers that don't tag them.
+func (t *Traversal) checkRoute(msg []byte, from string, session string) error {
+	expected := roleOfferer
+	if t.offering {
+		expected = roleAnswerer
+	}
+	misrouted := from != "" && from != expected
+	if contentFrom := sdpRole(msg); contentFrom != "" && contentFrom != expected {
+		from = contentFrom
+		misrouted = true
+	}
+	if session != "" && t.sessionTag != "" && session != t.sessionTag {
+		misrouted = true
+	}
+	if misrouted {
+		return &MisroutedError{Role: t.role(), Session: t.sessionTag, MsgFrom: from, MsgSession: session}
+	}
+	return nil
+}
+
+// sdpRole returns the role of the Traversal that would have sent msg if it's a
+// session description, or "" if it isn't one.
+func sdpRole(msg []byte) string {
+	if !bytes.Contains(msg, []byte(`"type"`)) {
+		// Not worth parsing, candidates don't have a type
+		return ""
+	}
+	sdp := &struct {
+		Type string `json:"type"`
+	}{}
+	if json.Unmarshal(msg, sdp) != nil {
+		return ""
+	}
+	switch sdp.Type {
+	case "offer":
+		return roleOfferer
+	case "answer":
+		return roleAnswerer
+	}
+	return ""
+}
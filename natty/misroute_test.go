@@ -0,0 +1,63 @@
+package natty
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+const testAnswerSDP = `{"type":"answer","sdp":"v=0\r\n"}`
+
+func TestTagMsg(t *testing.T) {
+	for _, format := range []WireFormat{Text, Binary} {
+		for _, msg := range []string{testCandidate, testSDP} {
+			tagged := tagMsg(encodeMsg(msg+"\n", format), format, roleAnswerer, "session 1")
+			inner, from, session, err := untagMsg(tagged)
+			if assert.NoError(t, err) {
+				assert.Equal(t, roleAnswerer, from)
+				assert.Equal(t, "session 1", session)
+				decoded, err := decodeMsg(inner)
+				if assert.NoError(t, err) {
+					assertSameJSON(t, msg, decoded)
+				}
+			}
+		}
+	}
+
+	inner, from, session, err := untagMsg(testCandidate)
+	assert.NoError(t, err)
+	assert.Equal(t, testCandidate, inner, "Untagged message should pass through unchanged")
+	assert.Equal(t, "", from)
+	assert.Equal(t, "", session)
+}
+
+func TestTryMsgIn(t *testing.T) {
+	offerer := newTraversal(0, []Option{WithSessionTag("mine")})
+	offerer.offering = true
+	offerer.initChannels()
+
+	assert.NoError(t, offerer.TryMsgIn(testCandidate), "Untagged candidate should be accepted")
+	assert.NoError(t, offerer.TryMsgIn(testAnswerSDP), "Answer should be accepted")
+	assert.NoError(t, offerer.TryMsgIn(tagMsg(testCandidate, Binary, roleAnswerer, "mine")), "Candidate from our session should be accepted")
+	assert.Equal(t, 3, len(offerer.msgInCh))
+
+	err := offerer.TryMsgIn(testSDP)
+	if assert.IsType(t, &MisroutedError{}, err, "Offer passed to offerer should be misrouted") {
+		assert.Equal(t, roleOfferer, err.(*MisroutedError).MsgFrom)
+		assert.Equal(t, roleOfferer, err.(*MisroutedError).Role)
+	}
+	err = offerer.TryMsgIn(tagMsg(testCandidate, Text, roleOfferer, "mine"))
+	assert.IsType(t, &MisroutedError{}, err, "Candidate from another offerer should be misrouted")
+	err = offerer.TryMsgIn(tagMsg(testCandidate, Text, roleAnswerer, "theirs"))
+	if assert.IsType(t, &MisroutedError{}, err, "Candidate from another session should be misrouted") {
+		assert.True(t, strings.Contains(err.Error(), `"theirs"`), "Error should mention the message's session")
+	}
+	assert.Equal(t, 3, len(offerer.msgInCh), "Misrouted messages shouldn't reach natty")
+
+	answerer := newTraversal(0, nil)
+	answerer.initChannels()
+	assert.NoError(t, answerer.TryMsgIn(testSDP), "Offer should be accepted")
+	assert.NoError(t, answerer.TryMsgIn(tagMsg(testCandidate, Text, roleOfferer, "any")), "Untagged answerer should accept any session")
+	assert.IsType(t, &MisroutedError{}, answerer.TryMsgIn(testAnswerSDP), "Answer passed to answerer should be misrouted")
+}
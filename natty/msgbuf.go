@@ -0,0 +1,63 @@
+package natty
+
+import (
+	"sync"
+)
+
+const (
+	// msgBufSize is the initial capacity of pooled message buffers, which is
+	// enough for candidates and most session descriptions.
+	msgBufSize = 2048
+
+	// maxPooledMsgBuf is the capacity above which buffers aren't returned to
+	// the pool, so that the occasional huge message doesn't pin memory.
+	maxPooledMsgBuf = 64 * 1024
+)
+
+var (
+	msgBufPool = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, 0, msgBufSize)
+			return &b
+		},
+	}
+
+	// msgBufHolders holds spare *[]byte for putting buffers back into
+	// msgBufPool, which would otherwise cost an allocation each time.
+	msgBufHolders sync.Pool
+)
+
+// NewMsgBuffer returns an empty buffer from natty's message buffer pool, into
+// which a message from the peer can be read before handing it to MsgInBytes,
+// which makes receiving messages allocation-free.
+func NewMsgBuffer() []byte {
+	return getMsgBuf()
+}
+
+// ReleaseMsg returns a message obtained from NextMsgOutBytes to natty's
+// message buffer pool. Neither msg nor anything sliced from it may be used
+// afterwards. Releasing messages is optional; messages that aren't released
+// are simply garbage collected.
+func ReleaseMsg(msg []byte) {
+	putMsgBuf(msg)
+}
+
+func getMsgBuf() []byte {
+	p := msgBufPool.Get().(*[]byte)
+	b := (*p)[:0]
+	*p = nil
+	msgBufHolders.Put(p)
+	return b
+}
+
+func putMsgBuf(b []byte) {
+	if cap(b) == 0 || cap(b) > maxPooledMsgBuf {
+		return
+	}
+	p, _ := msgBufHolders.Get().(*[]byte)
+	if p == nil {
+		p = new([]byte)
+	}
+	*p = b[:0]
+	msgBufPool.Put(p)
+}
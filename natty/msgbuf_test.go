@@ -0,0 +1,96 @@
+package natty
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// TestMsgBytes passes messages from natty's stdout to a peer's stdin through
+// the []byte API, including one that's longer than the stdout buffer.
+func TestMsgBytes(t *testing.T) {
+	long := `{"type":"offer","sdp":"` + strings.Repeat("a=x\\r\\n", 2000) + `"}` + "\n"
+	from := pumpTraversal(srflxCandidate + "\n" + long)
+	defer from.Close()
+	var stdin bytes.Buffer
+	to := newTraversal(0, nil)
+	to.initChannels()
+	to.stdin = nopWriteCloser{&stdin}
+
+	for _, expected := range []string{srflxCandidate + "\n", long, srflxCandidate + "\n"} {
+		msg, done := from.NextMsgOutBytes()
+		if !assert.False(t, done) {
+			return
+		}
+		assert.Equal(t, expected, string(msg), "Should get whole message from natty")
+		assert.NoError(t, to.TryMsgInBytes(msg), "Peer should accept message")
+		_, err := to.forwardMsgIn(<-to.msgInCh)
+		assert.NoError(t, err, "Should forward message to natty")
+	}
+	assert.Equal(t, srflxCandidate+"\n\n"+long+"\n"+srflxCandidate+"\n\n", stdin.String(), "Peer's natty should get the messages")
+
+	buf := NewMsgBuffer()
+	assert.Equal(t, 0, len(buf), "New buffer should be empty")
+	assert.Error(t, to.TryMsgInBytes(append(buf, wireVersionBinary, 0xff)), "Undecodable message should be refused")
+}
+
+// BenchmarkMsgBytes measures the cost of passing a message from natty to the
+// peer's natty with NextMsgOutBytes and MsgInBytes.
+func BenchmarkMsgBytes(b *testing.B) {
+	from, to := pumpTraversal(srflxCandidate+"\n"), sinkTraversal()
+	defer from.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg, _ := from.NextMsgOutBytes()
+		to.MsgInBytes(msg)
+		to.forwardMsgIn(<-to.msgInCh)
+	}
+}
+
+// BenchmarkMsgString is like BenchmarkMsgBytes, using NextMsgOut and MsgIn.
+func BenchmarkMsgString(b *testing.B) {
+	from, to := pumpTraversal(srflxCandidate+"\n"), sinkTraversal()
+	defer from.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg, _ := from.NextMsgOut()
+		to.MsgIn(msg)
+		to.forwardMsgIn(<-to.msgInCh)
+	}
+}
+
+// pumpTraversal returns a Traversal whose natty outputs msgs over and over.
+func pumpTraversal(msgs string) *Traversal {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	tr.stdoutbuf = bufio.NewReader(&repeatReader{b: []byte(msgs)})
+	tr.iowg.Add(1)
+	go tr.processStdout()
+	return tr
+}
+
+// sinkTraversal returns a Traversal whose natty ignores its input.
+func sinkTraversal() *Traversal {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	tr.stdin = nopWriteCloser{ioutil.Discard}
+	return tr
+}
+
+// repeatReader reads b over and over.
+type repeatReader struct {
+	b   []byte
+	off int
+}
+
+func (r *repeatReader) Read(b []byte) (int, error) {
+	n := copy(b, r.b[r.off:])
+	r.off = (r.off + n) % len(r.b)
+	return n, nil
+}
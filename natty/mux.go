@@ -0,0 +1,564 @@
+package natty
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// This file implements multiplexing reliable streams over the UDP conn that a
+// Traversal results in, which is what Dialer and Serve use. Each stream's
+// segments are numbered and retransmitted until the other side acknowledges
+// them, and closing a stream is a segment like any other. Only the dialing
+// side opens streams.
+
+const (
+	frameOpen   = 'O' // first segment of a new stream
+	frameData   = 'D' // stream segment
+	frameClose  = 'C' // stream segment that closes the stream
+	frameAck    = 'K' // acknowledges stream segments before seq
+	frameReset  = 'Z' // abandons a stream
+	frameGoAway = 'G' // the session is closing
+
+	frameHeaderSize = 9
+	segmentSize     = 1200
+	streamWindow    = 64
+	retransmitAfter = 200 * time.Millisecond
+	maxRetransmits  = 50 // about 10 seconds without an ack
+	maxOutOfOrder   = 256
+	streamLinger    = 5 * time.Second
+
+	// finishedStreamTTL is how long ids of finished streams are remembered,
+	// so that late retransmissions of their segments don't open new streams
+	finishedStreamTTL = time.Minute
+
+	acceptBacklog = 64
+	goAwayRepeats = 3
+)
+
+var (
+	errSessionClosed = fmt.Errorf("Session closed")
+)
+
+// frame is a frame carried over the session's conn.
+type frame struct {
+	typ     byte
+	id      uint32 // the stream
+	seq     uint32 // the segment's number, or for acks the next expected one
+	payload []byte
+}
+
+func (f *frame) encode() []byte {
+	b := make([]byte, frameHeaderSize, frameHeaderSize+len(f.payload))
+	b[0] = f.typ
+	binary.BigEndian.PutUint32(b[1:], f.id)
+	binary.BigEndian.PutUint32(b[5:], f.seq)
+	return append(b, f.payload...)
+}
+
+func decodeFrame(b []byte) (*frame, error) {
+	if len(b) < frameHeaderSize {
+		return nil, fmt.Errorf("Frame too short")
+	}
+	return &frame{
+		typ:     b[0],
+		id:      binary.BigEndian.Uint32(b[1:]),
+		seq:     binary.BigEndian.Uint32(b[5:]),
+		payload: append([]byte{}, b[frameHeaderSize:]...),
+	}, nil
+}
+
+// session multiplexes streams over a conn.
+type session struct {
+	conn        net.Conn
+	idleTimeout time.Duration // if set, how long to stay open without streams
+	onClose     func()        // if set, called once the session has closed
+	mutex       sync.Mutex
+	streams     map[uint32]*stream
+	finished    map[uint32]time.Time // when recently finished streams finished
+	lastId      uint32
+	acceptCh    chan *stream
+	idleTimer   *time.Timer
+	closed      bool
+	closedCh    chan struct{}
+}
+
+func newSession(conn net.Conn, idleTimeout time.Duration, onClose func()) *session {
+	s := &session{
+		conn:        conn,
+		idleTimeout: idleTimeout,
+		onClose:     onClose,
+		streams:     make(map[uint32]*stream),
+		finished:    make(map[uint32]time.Time),
+		acceptCh:    make(chan *stream, acceptBacklog),
+		closedCh:    make(chan struct{}),
+	}
+	s.idle()
+	go s.readLoop()
+	return s
+}
+
+// open opens a new stream to the peer.
+func (s *session) open() (*stream, error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, errSessionClosed
+	}
+	s.lastId++
+	st := newStream(s.lastId, s)
+	s.streams[st.id] = st
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.mutex.Unlock()
+	return st, st.sendSegment(frameOpen, nil, false)
+}
+
+// accept waits for the peer to open a stream.
+func (s *session) accept() (*stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.closedCh:
+		return nil, errSessionClosed
+	}
+}
+
+func (s *session) send(f *frame) error {
+	_, err := s.conn.Write(f.encode())
+	return err
+}
+
+func (s *session) readLoop() {
+	b := make([]byte, 65536)
+	for {
+		n, err := s.conn.Read(b)
+		if err != nil {
+			s.close(false)
+			return
+		}
+		f, err := decodeFrame(b[:n])
+		if err != nil {
+			log.Tracef("Ignoring packet: %s", err)
+			continue
+		}
+		if f.typ == frameGoAway {
+			s.close(false)
+			return
+		}
+		st := s.streamFor(f)
+		if st != nil {
+			st.received(f)
+		} else if f.typ != frameReset && f.typ != frameAck {
+			// We're done with this stream, make sure the peer is too
+			s.send(&frame{typ: frameReset, id: f.id})
+		}
+	}
+}
+
+// streamFor finds the stream to which f belongs, accepting new streams. A new
+// stream's first segment can get lost, so any of its segments starts it.
+func (s *session) streamFor(f *frame) *stream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	st := s.streams[f.id]
+	if st != nil || s.closed || f.typ == frameAck || f.typ == frameReset {
+		return st
+	}
+	if _, found := s.finished[f.id]; found {
+		return nil
+	}
+	st = newStream(f.id, s)
+	select {
+	case s.acceptCh <- st:
+		s.streams[st.id] = st
+		return st
+	default:
+		log.Debugf("Too many streams waiting to be accepted, refusing stream %d", f.id)
+		st.abort()
+		return nil
+	}
+}
+
+// remove forgets a stream that's finished.
+func (s *session) remove(id uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.streams[id] == nil {
+		return
+	}
+	delete(s.streams, id)
+	now := time.Now()
+	s.finished[id] = now
+	for fid, at := range s.finished {
+		if now.Sub(at) > finishedStreamTTL {
+			delete(s.finished, fid)
+		}
+	}
+	if len(s.streams) == 0 {
+		s.idleLocked()
+	}
+}
+
+func (s *session) idle() {
+	s.mutex.Lock()
+	s.idleLocked()
+	s.mutex.Unlock()
+}
+
+// idleLocked starts counting down to closing the idle session. The caller
+// must hold the mutex.
+func (s *session) idleLocked() {
+	if s.idleTimeout <= 0 || s.closed {
+		return
+	}
+	if s.idleTimer == nil {
+		s.idleTimer = time.AfterFunc(s.idleTimeout, s.closeIfIdle)
+	} else {
+		s.idleTimer.Reset(s.idleTimeout)
+	}
+}
+
+func (s *session) closeIfIdle() {
+	s.mutex.Lock()
+	idle := len(s.streams) == 0
+	s.mutex.Unlock()
+	if idle {
+		log.Trace("Closing idle session")
+		s.close(true)
+	}
+}
+
+// close closes the session and its streams, telling the peer if tellPeer is
+// true.
+func (s *session) close(tellPeer bool) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.closedCh)
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	streams := make([]*stream, 0, len(s.streams))
+	for _, st := range s.streams {
+		streams = append(streams, st)
+	}
+	s.streams = make(map[uint32]*stream)
+	s.mutex.Unlock()
+
+	for _, st := range streams {
+		st.abort()
+	}
+	if tellPeer {
+		// Nobody acknowledges it, so send it a few times in case it gets lost
+		for i := 0; i < goAwayRepeats; i++ {
+			s.send(&frame{typ: frameGoAway})
+		}
+	}
+	s.conn.Close()
+	if s.onClose != nil {
+		s.onClose()
+	}
+}
+
+// stream is a reliable, ordered stream of bytes carried over a session. It
+// implements net.Conn.
+type stream struct {
+	id            uint32
+	session       *session
+	mutex         sync.Mutex
+	cond          *sync.Cond
+	nextSeq       uint32              // number of our next segment
+	unacked       map[uint32]*segment // our segments that haven't been acked
+	nextIn        uint32              // number of the peer's next segment
+	pending       map[uint32]*frame   // the peer's segments that arrived early
+	readBuf       []byte              // data received in order, not read yet
+	eof           bool                // whether the peer closed the stream
+	closed        bool                // whether we closed the stream
+	reset         bool                // whether the stream was abandoned
+	done          chan struct{}       // closed once the stream is reset
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+type segment struct {
+	frame       *frame
+	sentAt      time.Time
+	retransmits int
+}
+
+func newStream(id uint32, s *session) *stream {
+	st := &stream{
+		id:      id,
+		session: s,
+		unacked: make(map[uint32]*segment),
+		pending: make(map[uint32]*frame),
+		done:    make(chan struct{}),
+	}
+	st.cond = sync.NewCond(&st.mutex)
+	go st.retransmit()
+	return st
+}
+
+// Read reads what the peer wrote, returning io.EOF once the peer has closed the
+// stream.
+func (st *stream) Read(p []byte) (int, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for len(st.readBuf) == 0 && !st.eof && !st.reset && !st.closed && !expired(st.readDeadline) {
+		st.cond.Wait()
+	}
+	if st.closed || st.reset {
+		return 0, io.ErrClosedPipe
+	}
+	if len(st.readBuf) > 0 {
+		n := copy(p, st.readBuf)
+		st.readBuf = st.readBuf[n:]
+		return n, nil
+	}
+	if st.eof {
+		return 0, io.EOF
+	}
+	return 0, os.ErrDeadlineExceeded
+}
+
+// Write sends p to the peer, blocking while too much of what we sent hasn't
+// been acknowledged yet.
+func (st *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > segmentSize {
+			n = segmentSize
+		}
+		err := st.sendSegment(frameData, p[:n], false)
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes the stream. What we already wrote is still delivered to the
+// peer, which reads EOF after it.
+func (st *stream) Close() error {
+	st.mutex.Lock()
+	if st.closed {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+	err := st.sendSegment(frameClose, nil, true)
+	go st.linger()
+	if err == io.ErrClosedPipe {
+		// Already reset, nothing left to close
+		return nil
+	}
+	return err
+}
+
+func (st *stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+func (st *stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+func (st *stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *stream) SetReadDeadline(t time.Time) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.readDeadline = t
+	st.readTimer = st.wakeAt(st.readTimer, t)
+	return nil
+}
+
+func (st *stream) SetWriteDeadline(t time.Time) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.writeDeadline = t
+	st.writeTimer = st.wakeAt(st.writeTimer, t)
+	return nil
+}
+
+// wakeAt replaces timer with one that wakes up waiting reads and writes at t,
+// so that they notice their deadline. The caller must hold the mutex.
+func (st *stream) wakeAt(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		st.cond.Broadcast()
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		st.mutex.Lock()
+		st.cond.Broadcast()
+		st.mutex.Unlock()
+	})
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// sendSegment sends a segment of the stream, waiting for room in the window.
+// Only the closing segment may be sent once we've closed the stream.
+func (st *stream) sendSegment(typ byte, payload []byte, closing bool) error {
+	st.mutex.Lock()
+	for len(st.unacked) >= streamWindow && !st.reset && (closing || !st.closed) && !expired(st.writeDeadline) {
+		st.cond.Wait()
+	}
+	if st.reset || (st.closed && !closing) {
+		st.mutex.Unlock()
+		return io.ErrClosedPipe
+	}
+	if len(st.unacked) >= streamWindow {
+		st.mutex.Unlock()
+		return os.ErrDeadlineExceeded
+	}
+	f := &frame{typ: typ, id: st.id, seq: st.nextSeq, payload: append([]byte{}, payload...)}
+	st.nextSeq++
+	st.unacked[f.seq] = &segment{frame: f, sentAt: time.Now()}
+	st.mutex.Unlock()
+	return st.session.send(f)
+}
+
+// received handles a frame for this stream from the peer.
+func (st *stream) received(f *frame) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	switch f.typ {
+	case frameAck:
+		for seq := range st.unacked {
+			if seq < f.seq {
+				delete(st.unacked, seq)
+			}
+		}
+		st.cond.Broadcast()
+		return
+	case frameReset:
+		st.abandon()
+		return
+	}
+
+	// Open, data or close
+	if f.seq >= st.nextIn && len(st.pending) < maxOutOfOrder {
+		st.pending[f.seq] = f
+	}
+	for {
+		next := st.pending[st.nextIn]
+		if next == nil {
+			break
+		}
+		delete(st.pending, st.nextIn)
+		st.nextIn++
+		switch next.typ {
+		case frameClose:
+			st.eof = true
+		case frameData:
+			if !st.closed {
+				st.readBuf = append(st.readBuf, next.payload...)
+			}
+		}
+	}
+	st.cond.Broadcast()
+	// Acknowledge everything we have so far, even for duplicates, in case our
+	// previous ack got lost
+	go st.session.send(&frame{typ: frameAck, id: st.id, seq: st.nextIn})
+}
+
+// abandon resets the stream, failing pending reads and writes, and removes it
+// from the session. The caller must hold the mutex.
+func (st *stream) abandon() {
+	if st.reset {
+		return
+	}
+	st.reset = true
+	close(st.done)
+	st.cond.Broadcast()
+	go st.session.remove(st.id)
+}
+
+// abort resets the stream without telling the peer.
+func (st *stream) abort() {
+	st.mutex.Lock()
+	st.abandon()
+	st.mutex.Unlock()
+}
+
+// linger waits for the peer to acknowledge everything that we sent, so that
+// closing the stream doesn't lose data, and then resets it.
+func (st *stream) linger() {
+	deadline := time.Now().Add(streamLinger)
+	st.mutex.Lock()
+	for !st.reset && len(st.unacked) > 0 && time.Now().Before(deadline) {
+		st.mutex.Unlock()
+		time.Sleep(retransmitAfter / 4)
+		st.mutex.Lock()
+	}
+	st.abandon()
+	st.mutex.Unlock()
+}
+
+// retransmit resends segments that haven't been acknowledged in time until the
+// stream is reset, giving up on the stream if the peer doesn't acknowledge
+// them at all.
+func (st *stream) retransmit() {
+	ticker := time.NewTicker(retransmitAfter / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-st.done:
+			return
+		case now := <-ticker.C:
+			var due []*frame
+			gaveUp := false
+			st.mutex.Lock()
+			for _, seg := range st.unacked {
+				if now.Sub(seg.sentAt) >= retransmitAfter {
+					seg.retransmits++
+					if seg.retransmits > maxRetransmits {
+						gaveUp = true
+						break
+					}
+					seg.sentAt = now
+					due = append(due, seg.frame)
+				}
+			}
+			if gaveUp {
+				log.Debugf("Peer didn't acknowledge stream %d, resetting it", st.id)
+				st.abandon()
+				st.mutex.Unlock()
+				st.session.send(&frame{typ: frameReset, id: st.id})
+				return
+			}
+			st.mutex.Unlock()
+			for _, f := range due {
+				err := st.session.send(f)
+				if err != nil {
+					log.Tracef("Unable to retransmit segment %d of stream %d: %s", f.seq, f.id, err)
+				}
+			}
+		}
+	}
+}
@@ -1,19 +1,32 @@
 // Package natty provides a Go language wrapper to the natty NAT traversal
 // utility.  See https://github.com/getlantern/natty.
 //
+// Start with PeerConnection, which connects to a peer given nothing but a
+// Signaler, and keeps the connection up. Offer and Answer are the lower-level
+// layer underneath, for applications that need to drive traversals
+// themselves: Traversal.Run exchanges a Traversal's messages through a
+// Signaler, or NextMsgOut and MsgIn do so one message at a time (as do
+// MsgOutChan and MsgInChan, over channels).
+//
 // See natty_test for an example of Natty in use, including debug logging
 // showing the messages that are sent across the signaling channel.
 package natty
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/byteexec"
@@ -24,13 +37,23 @@ import (
 const (
 	UDP = Protocol("udp")
 	TCP = Protocol("tcp")
+
+	// Version is the version of go-natty, reported to STUN and TURN servers as
+	// part of the default SOFTWARE attribute.
+	Version = "0.1.0"
+
+	fiveTupleMarker = "\"type\":\"5-tuple\""
+	errorMarker     = "\"type\":\"error\""
 )
 
 var (
-	log = golog.LoggerFor("natty")
+	log = &packageLog{golog: golog.LoggerFor("natty")}
 
 	reallyHighTimeout = 100000 * time.Hour
 
+	offerParams  = []string{"-offer"}
+	answerParams = []string{}
+
 	nattybe *byteexec.Exec
 )
 
@@ -53,66 +76,218 @@ type FiveTuple struct {
 	Proto  Protocol
 	Local  string
 	Remote string
+
+	// Relayed indicates whether the pair goes through a TURN relay at either
+	// end, in which case performance is typically lower than over a direct
+	// path.
+	Relayed bool
+}
+
+// String returns the FiveTuple as "proto local -> remote", marking relayed
+// ones.
+func (ft *FiveTuple) String() string {
+	s := fmt.Sprintf("%s %s -> %s", ft.Proto, ft.Local, ft.Remote)
+	if ft.Relayed {
+		s += " (relayed)"
+	}
+	return s
+}
+
+// fiveTupleJSON is a FiveTuple as encoded in JSON, which is how natty emits it
+// and natty-punch outputs it, without FiveTuple's methods.
+type fiveTupleJSON struct {
+	Proto   Protocol
+	Local   string
+	Remote  string
+	Relayed bool
+}
+
+// MarshalJSON encodes the FiveTuple as JSON, for example to persist it, like
+// {"Proto":"udp","Local":"192.0.2.1:5000","Remote":"198.51.100.1:5000","Relayed":false}.
+func (ft FiveTuple) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fiveTupleJSON(ft))
+}
+
+// UnmarshalJSON decodes a FiveTuple encoded with MarshalJSON, or emitted by
+// natty.
+func (ft *FiveTuple) UnmarshalJSON(b []byte) error {
+	var decoded fiveTupleJSON
+	err := json.Unmarshal(b, &decoded)
+	if err != nil {
+		return err
+	}
+	decoded.Proto = Protocol(strings.ToLower(string(decoded.Proto)))
+	if decoded.Proto != UDP && decoded.Proto != TCP {
+		return fmt.Errorf("Unknown FiveTuple protocol %q", decoded.Proto)
+	}
+	*ft = FiveTuple(decoded)
+	return nil
 }
 
 // UDPAddrs returns a pair of UDPAddrs representing the Local and Remote
-// addresses of this FiveTuple. If the FiveTuple's Proto is not UDP, this method
-// returns an error.
+// addresses of this FiveTuple, which may be IPv4 or IPv6 (in brackets, with
+// or without a zone). If the FiveTuple's Proto is not UDP, this method returns
+// an error.
 func (ft *FiveTuple) UDPAddrs() (local *net.UDPAddr, remote *net.UDPAddr, err error) {
 	if ft.Proto != UDP {
 		err = fmt.Errorf("FiveTuple.Proto was not UDP!: %s", ft.Proto)
 		return
 	}
-	local, err = net.ResolveUDPAddr("udp", ft.Local)
+	local, err = net.ResolveUDPAddr(addrNetwork("udp", ft.Local), ft.Local)
 	if err != nil {
 		err = fmt.Errorf("Unable to resolve local UDP address %s: %s", ft.Local, err)
 		return
 	}
-	remote, err = net.ResolveUDPAddr("udp", ft.Remote)
+	remote, err = net.ResolveUDPAddr(addrNetwork("udp", ft.Remote), ft.Remote)
 	if err != nil {
 		err = fmt.Errorf("Unable to resolve remote UDP address %s: %s", ft.Remote, err)
 	}
 	return
 }
 
+// TCPAddrs is like UDPAddrs, for a FiveTuple whose Proto is TCP.
+func (ft *FiveTuple) TCPAddrs() (local *net.TCPAddr, remote *net.TCPAddr, err error) {
+	if ft.Proto != TCP {
+		err = fmt.Errorf("FiveTuple.Proto was not TCP!: %s", ft.Proto)
+		return
+	}
+	local, err = net.ResolveTCPAddr(addrNetwork("tcp", ft.Local), ft.Local)
+	if err != nil {
+		err = fmt.Errorf("Unable to resolve local TCP address %s: %s", ft.Local, err)
+		return
+	}
+	remote, err = net.ResolveTCPAddr(addrNetwork("tcp", ft.Remote), ft.Remote)
+	if err != nil {
+		err = fmt.Errorf("Unable to resolve remote TCP address %s: %s", ft.Remote, err)
+	}
+	return
+}
+
+// addrNetwork restricts base ("udp" or "tcp") to the IP version of address, so
+// that resolving address can't yield the wrong family.
+func addrNetwork(base string, address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return base
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return base
+	case ip.To4() == nil:
+		return base + "6"
+	}
+	return base + "4"
+}
+
 // Traversal represents a single NAT traversal using natty, whose result is
-// available via the methods FiveTuple() and FiveTupleTimeout().
+// available via the methods FiveTuple(), FiveTupleContext() and
+// FiveTupleTimeout().
 //
 // Consumers should make sure to call Close() after finishing with this Natty
 // in order to make sure the underlying natty process and associated resources
 // are closed.
 type Traversal struct {
-	timeout            time.Duration   // how long to wait before terminating traversal
-	traceOut           io.Writer       // target for output from natty's stderr
-	cmd                *exec.Cmd       // the natty command
-	stdin              io.WriteCloser  // pipe to natty's stdin
-	stdout             io.ReadCloser   // pipe from natty's stdout
-	stdoutbuf          *bufio.Reader   // buffered stdout
-	stderr             io.ReadCloser   // pipe from natty's stderr
-	msgInCh            chan string     // channel for messages inbound to this Natty
-	msgOutCh           chan string     // channel for messages outbound from this Natty
-	peerGotFiveTupleCh chan bool       // channel to signal once we know that our peer received their own FiveTuple
-	fiveTupleCh        chan *FiveTuple // intermediary channel for the FiveTuple emitted by the natty command
-	errCh              chan error      // intermediary channel for any error encountered while running natty
-	fiveTupleOutCh     chan *FiveTuple // channel for FiveTuple output
-	errOutCh           chan error      // channel for error output
-	fiveTupleOut       *FiveTuple      // the output FiveTuple
-	errOut             error           // the output error
-	outMutex           sync.Mutex      // mutex for synchronizing access to output variables
-	iowg               sync.WaitGroup  // WaitGroup to wait for stdout and stderr processing to finish
+	id               uint64          // identifies the Traversal in log output
+	logger           Logger          // if set, used instead of the package's default logger
+	phase            int32           // the phase that the Traversal has reached
+	states           stateTracker    // the Traversal's State, for OnStateChange
+	offering         bool            // whether the Traversal is the offerer
+	sessionTag       string          // if set, session with which to tag messages
+	timeout          time.Duration   // how long to wait before terminating traversal
+	timeoutSet       bool            // whether timeout was set with WithTimeout
+	standby          bool            // whether an Engine started the Traversal before handing it out
+	software         string          // value of the STUN SOFTWARE attribute
+	ipVersion        IPVersion       // which IP version(s) to gather candidates for
+	ipPreference     IPVersion       // IP version whose candidates to prioritize, if any
+	transport        Transport       // which transport protocol(s) to traverse over
+	stunServers      []string        // STUN servers to use instead of natty's defaults
+	dscp             int             // DSCP marking for the application's media
+	controlDSCP      int             // DSCP marking for STUN, connectivity checks and keepalives
+	wireFormat       WireFormat      // format for messages emitted by NextMsgOut
+	peerWireVersion  int32           // newest wire format version advertised by the peer
+	pairAcceptor     PairAcceptor    // gets final say over the nominated pair
+	priorityOverride PriorityFunc    // overrides the priorities of our candidates
+	remotePolicies   []RemotePolicy  // decide which remote addresses we may connect to
+	outBufferSize    int             // how many outbound messages to buffer
+	overflowPolicy   OverflowPolicy  // what to do when the outbound buffer is full
+	relayLimit       int             // bytes per second to which to limit relayed conns
+	relayLimitPolicy RateLimitPolicy // what to do with writes that exceed relayLimit
+	relayLocalPort   int             // if set, local port for talking to the TURN server
+	localIP          net.IP          // if set, the only local IP on which natty gathers
+	extraLocalPorts  int             // how many local ports to gather from beyond the usual one
+	sockets          sockets         // creates the sockets that the Traversal uses itself
+	turnServer       *turnServer     // if set, TURN server on which to allocate our own relay
+	turnAllocation   *TurnAllocation // if set, shared relay allocation to use
+	turnAllocOwned   bool            // whether turnAllocation was allocated for this Traversal
+	turnBinding      *turnBinding    // lets natty use turnAllocation
+	mappingKeeper    *MappingKeeper  // if set, supplies a cached reflexive candidate
+	mappingBinding   *mappingBinding // lets natty relay through mappingKeeper's socket
+	seedCandidate    []byte          // candidate for mappingKeeper's mapping, until emitted
+	handoff          handoff         // receives natty's own socket, per WithBoundConn
+	hairpinning      Hairpinning     // whether the local NAT supports hairpinning
+	hairpin          hairpinFilter   // drops srflx candidates that need unsupported hairpinning
+	allPairs         bool            // whether to check other pairs once natty nominated one
+	punch            punchSync       // coordinates the start of connectivity checks with the peer
+	networkMonitor   bool            // whether or not to watch for network changes
+	onNetworkChange  func()          // callback for when usable network interfaces change
+	logRedaction     LogRedaction    // what to redact from log output
+	traceOut         io.Writer       // target for output from natty's stderr
+	traceWriter      io.Writer       // if set, target for output from natty's stderr instead of traceOut
+	traceMutex       sync.Mutex      // held while writing to traceWriter
+	debug            debugMode       // whether natty logs debug output
+	binaryPath       string          // if set, natty executable to use
+	cmd              *exec.Cmd       // the natty command
+	cmdMutex         sync.Mutex      // keeps stopNatty from looking at cmd while it's starting
+	stdin            io.WriteCloser  // pipe to natty's stdin
+	stdout           io.ReadCloser   // pipe from natty's stdout
+	stdoutbuf        *bufio.Reader   // buffered stdout
+	stderr           io.ReadCloser   // pipe from natty's stderr
+	stderrTail       tailBuffer      // the end of natty's stderr
+	msgInCh          chan []byte     // channel for messages inbound to this Natty
+	msgOutCh         chan []byte     // channel for messages outbound from this Natty
+	msgInChan        chan string     // if set, channel returned by MsgInChan
+	msgInChanOnce    sync.Once       // makes sure that MsgInChan only creates msgInChan once
+	msgOutChan       chan string     // if set, channel returned by MsgOutChan until it's closed
+	fiveTupleCh      chan *FiveTuple // intermediary channel for the FiveTuple emitted by the natty command
+	errCh            chan error      // intermediary channel for any error encountered while running natty
+	fiveTupleOutCh   chan *FiveTuple // channel for FiveTuple output
+	errOutCh         chan error      // channel for error output
+	resultCh         chan struct{}   // closed once fiveTupleOut or errOut is set
+	finishedCh       chan struct{}   // closed once natty has stopped
+	stoppedCh        chan struct{}   // if set, closed once run has reaped natty
+	exitedCh         chan struct{}   // closed once the Traversal has failed, after which natty emits no more messages
+	params           []string        // natty's params, once run
+	restartMutex     sync.Mutex      // serializes Restarts
+	fiveTupleOut     *FiveTuple      // the output FiveTuple
+	pairsOut         []*Pair         // with allPairs, the pairs that work
+	errOut           error           // the output error
+	outMutex         sync.Mutex      // mutex for synchronizing access to output variables
+	iowg             sync.WaitGroup  // WaitGroup to wait for stdout and stderr processing to finish
+	closedCh         chan struct{}   // closed once Close() has been called
+	closeOnce        sync.Once       // makes sure that closedCh is only closed once
+	stop             *stopResult     // for stopping the current natty
+	activatedCh      chan struct{}   // closed once the Traversal's timeout starts counting
+	statsTracker     statsTracker    // tracks the Traversal's Stats
+	gathering        *gatherer       // tracks the gathering of local candidates
+	keepAlives       keepAlives      // keeps the FiveTuple's NAT mapping alive
+	detached         int32           // 1 once Detach() has been called
+	reports          *runReports     // what the current run of natty has reported, replaced by Restart
 }
 
 // Offer starts a Traversal as an Offerer, meaning that it will make an offer to
 // initiate an ICE session. Call FiveTuple() to get the FiveTuple resulting from
 // Traversal. If timeout is hit, the traversal will stop and FiveTuple() will
 // return an error. A timeout of 0 means that the Traversal will never time out.
-func Offer(timeout time.Duration) *Traversal {
-	log.Trace("Offering")
-	t := &Traversal{
-		timeout:  timeout,
-		traceOut: log.TraceOut(),
-	}
-	t.run([]string{"-offer"})
+// The Traversal can be further configured by passing Options.
+func Offer(timeout time.Duration, opts ...Option) *Traversal {
+	t := newTraversal(timeout, opts)
+	t.log().Trace("Offering")
+	t.activate()
+	t.run(offerParams)
 	return t
 }
 
@@ -120,153 +295,728 @@ func Offer(timeout time.Duration) *Traversal {
 // to initiate an ICE session. Call FiveTuple() to get the FiveTuple resulting from
 // Traversal. If timeout is hit, the traversal will stop and FiveTuple() will
 // return an error. A timeout of 0 means that the Traversal will never time out.
-func Answer(timeout time.Duration) *Traversal {
-	log.Trace("Answering")
+// The Traversal can be further configured by passing Options.
+func Answer(timeout time.Duration, opts ...Option) *Traversal {
+	t := newTraversal(timeout, opts)
+	t.log().Trace("Answering")
+	t.activate()
+	t.run(answerParams)
+	return t
+}
+
+// newTraversal constructs a Traversal with the given timeout, applying the
+// given Options on top of the defaults.
+func newTraversal(timeout time.Duration, opts []Option) *Traversal {
 	t := &Traversal{
-		timeout:  timeout,
-		traceOut: log.TraceOut(),
+		id:            atomic.AddUint64(&lastTraversalId, 1),
+		timeout:       timeout,
+		software:      DefaultSoftwareAttribute,
+		outBufferSize: defaultOutBufferSize,
+		wireFormat:    Negotiated,
+		dscp:          noDSCP,
+		controlDSCP:   noDSCP,
+		traceOut:      log.TraceOut(),
+		closedCh:      make(chan struct{}),
+		activatedCh:   make(chan struct{}),
+		gathering:     newGatherer(),
+	}
+	t.resetRun()
+	t.punch.send = t.emitPunchMsg
+	t.punch.deliver = t.deliverMsgIn
+	if logger := log.get(); logger != nil {
+		t.useLogger(logger)
+	}
+	for _, opt := range opts {
+		opt(t)
 	}
-	t.run([]string{})
 	return t
 }
 
+// activate starts the clock on the Traversal's timeout. Until a Traversal is
+// activated, natty can run but the Traversal won't time out.
+func (t *Traversal) activate() {
+	t.setPhase(phaseNegotiating)
+	close(t.activatedCh)
+}
+
 // MsgIn is used to pass this Traversal a message from the peer t. This method
-// is buffered and will typically not block.
+// is buffered and will typically not block. Messages are accepted in any
+// WireFormat, regardless of the format that this Traversal emits. Messages
+// that can't be decoded or that were meant for a different Traversal are
+// logged and ignored; use TryMsgIn to find out about them.
 func (t *Traversal) MsgIn(msg string) {
-	log.Tracef("Got message: %s", msg)
-	t.msgInCh <- msg
+	err := t.TryMsgIn(msg)
+	if err != nil && err != ErrClosed {
+		t.log().Errorf("Ignoring message from peer: %s", err)
+	}
+}
+
+// TryMsgIn is like MsgIn, except that it returns an error instead of logging
+// it if msg can't be decoded, a *MisroutedError if msg was meant for a
+// different Traversal (see WithSessionTag), or ErrClosed if the Traversal has
+// been closed. Messages that cause an error aren't passed to natty.
+func (t *Traversal) TryMsgIn(msg string) error {
+	return t.TryMsgInBytes(append(getMsgBuf(), msg...))
+}
+
+// MsgInBytes is like MsgIn, except that it takes the message as a []byte, of
+// which the Traversal takes ownership: the caller must not use msg afterwards.
+// Once natty is done with msg, it goes into the pool from which NewMsgBuffer
+// returns buffers, so reading messages into buffers from NewMsgBuffer, or
+// passing on the messages themselves, avoids copying them.
+func (t *Traversal) MsgInBytes(msg []byte) {
+	err := t.TryMsgInBytes(msg)
+	if err != nil && err != ErrClosed {
+		t.log().Errorf("Ignoring message from peer: %s", err)
+	}
+}
+
+// TryMsgInBytes is like TryMsgIn, except that it takes ownership of msg like
+// MsgInBytes does.
+func (t *Traversal) TryMsgInBytes(msg []byte) error {
+	select {
+	case <-t.closedCh:
+		putMsgBuf(msg)
+		return ErrClosed
+	default:
+	}
+	decoded, from, session, err := untagAndDecodeMsg(msg)
+	if err != nil {
+		putMsgBuf(msg)
+		return fmt.Errorf("Unable to decode message: %s", err)
+	}
+	if t.log().tracing() {
+		t.log().Tracef("Got message: %s", decoded)
+	}
+	err = t.checkRoute(decoded, from, session)
+	if err != nil {
+		putMsgBuf(decoded)
+		return err
+	}
+	if peerErr, ok := parsePeerError(decoded); ok {
+		putMsgBuf(decoded)
+		t.peerFailed(peerErr)
+		return nil
+	}
+	if refusal, ok := parseRefusal(decoded); ok {
+		putMsgBuf(decoded)
+		t.refused(refusal)
+		return nil
+	}
+	if version, ok := parseVersionMsg(decoded); ok {
+		putMsgBuf(decoded)
+		if t.wireFormat != V1 {
+			t.log().Tracef("Peer supports wire format version %d", version)
+			atomic.StoreInt32(&t.peerWireVersion, int32(version))
+		}
+		return nil
+	}
+	err = t.checkRemoteCandidates(decoded)
+	if err != nil {
+		putMsgBuf(decoded)
+		t.policyFailed(err)
+		return err
+	}
+	filtered := t.filterIPVersion(decoded)
+	if filtered == nil {
+		t.log().Tracef("Dropping candidate of the other IP version: %s", decoded)
+		putMsgBuf(decoded)
+		return nil
+	}
+	decoded = filtered
+	if t.hairpinning == HairpinUnsupported && t.hairpin.dropRemote(decoded) {
+		t.log().Tracef("Peer is behind our NAT, which doesn't support hairpinning, dropping candidate: %s", decoded)
+		putMsgBuf(decoded)
+		return nil
+	}
+	if !t.punch.inbound(decoded) {
+		t.deliverMsgIn(decoded)
+	}
+	return nil
+}
+
+// deliverMsgIn passes msg from the peer on to natty, taking ownership of it.
+func (t *Traversal) deliverMsgIn(msg []byte) {
+	select {
+	case t.msgInCh <- msg:
+	case <-t.finished():
+		// natty has stopped, so there's nothing to pass the message to
+		t.log().Tracef("Traversal finished, ignoring message from peer: %s", msg)
+		putMsgBuf(msg)
+	}
 }
 
 // NextMsgOut gets the next message to pass to the peer.  If done is true, there
 // are no more messages to be read, and the currently returned message should be
-// ignored.
+// ignored. Once the Traversal is closed or has failed (for example because
+// natty exited unexpectedly, in which case FiveTuple fails with a
+// ProcessError), NextMsgOut returns done, including for callers that were
+// blocked in it. In the latter case, the messages that natty emitted before
+// it stopped are returned first.
 func (t *Traversal) NextMsgOut() (msg string, done bool) {
-	m, ok := <-t.msgOutCh
-	log.Tracef("Returning out message: %s", m)
-	return m, !ok
+	b, done := t.NextMsgOutBytes()
+	msg = string(b)
+	putMsgBuf(b)
+	return msg, done
+}
+
+// NextMsgOutBytes is like NextMsgOut, except that it returns the message as a
+// []byte without copying it. The caller owns msg and may pass it to ReleaseMsg
+// once done with it (for example once it has been written to the signaling
+// channel), which lets the Traversal reuse its memory for later messages.
+func (t *Traversal) NextMsgOutBytes() (msg []byte, done bool) {
+	select {
+	case <-t.closedCh:
+		return nil, true
+	default:
+	}
+	t.outMutex.Lock()
+	exitedCh := t.exitedCh
+	t.outMutex.Unlock()
+	var m []byte
+	select {
+	case m = <-t.msgOutCh:
+	case <-t.closedCh:
+		return nil, true
+	case <-exitedCh:
+		select {
+		case m = <-t.msgOutCh:
+		default:
+			return nil, true
+		}
+	}
+	if t.log().tracing() {
+		t.log().Tracef("Returning out message: %s", m)
+	}
+	return m, false
 }
 
 // FiveTuple gets the FiveTuple from the Traversal, blocking until such is
-// available or the configured timeout is hit.
+// available or the configured timeout is hit. Its errors tell what went wrong
+// through errors.Is and errors.As: ErrTimeout, ErrClosed, ErrNoConnectivity,
+// ErrBinaryNotFound, a *ProcessError or a *PeerError.
 func (t *Traversal) FiveTuple() (*FiveTuple, error) {
-	log.Trace("Getting FiveTuple")
-	t.outMutex.Lock()
-	defer t.outMutex.Unlock()
+	return t.FiveTupleContext(context.Background())
+}
 
-	if t.fiveTupleOut != nil || t.errOut != nil {
-		log.Trace("Returning existing result")
-	} else {
-		log.Trace("We don't have a result yet, wait for one")
+// FiveTupleContext is like FiveTuple, except that it gives up on the
+// Traversal once ctx is done, returning ctx.Err() (as an error that's also
+// ErrTimeout if ctx's deadline was exceeded): the Traversal is closed, which
+// kills and reaps natty and lets the Traversal's goroutines return, and that
+// error becomes its result, which FiveTuple and later calls return too. Once
+// the Traversal has a result, every call returns it, whether ctx is done or
+// not. Without a deadline or cancellation, it's the same as FiveTuple. It's
+// safe to call from multiple goroutines, alongside FiveTuple.
+func (t *Traversal) FiveTupleContext(ctx context.Context) (*FiveTuple, error) {
+	t.log().Trace("Getting FiveTuple")
+	for {
+		// Restart replaces the channels, so look at the current ones
+		t.outMutex.Lock()
+		ft, err := t.fiveTupleOut, t.errOut
+		fiveTupleOutCh, errOutCh, resultCh := t.fiveTupleOutCh, t.errOutCh, t.resultCh
+		t.outMutex.Unlock()
+		if ft != nil || err != nil {
+			t.log().Tracef("FiveTuple returns %s: %s", ft, err)
+			return ft, err
+		}
+
+		t.log().Trace("We don't have a result yet, wait for one")
 		select {
-		case ft := <-t.fiveTupleOutCh:
-			log.Tracef("FiveTuple is: %s", ft)
-			t.fiveTupleOut = ft
-		case err := <-t.errOutCh:
-			log.Tracef("Error is: %s", err)
-			t.errOut = err
+		case ft := <-fiveTupleOutCh:
+			t.log().Tracef("FiveTuple is: %s", ft)
+			t.setResult(ft, nil)
+		case err := <-errOutCh:
+			t.log().Tracef("Error is: %s", err)
+			t.setResult(nil, err)
+		case <-resultCh:
+			// Another caller got the result
+		case <-ctx.Done():
+			if t.setResult(nil, contextError(ctx)) {
+				t.log().Tracef("Context done, closing: %s", ctx.Err())
+				t.Close()
+			}
 		}
 	}
+}
+
+// FiveTupleTimeout is like FiveTupleContext with a context that times out
+// after timeout: if the Traversal has no result by then, it's closed and fails
+// with ErrTimeout (which also is context.DeadlineExceeded).
+func (t *Traversal) FiveTupleTimeout(timeout time.Duration) (*FiveTuple, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.FiveTupleContext(ctx)
+}
+
+// FiveTupleResult is the outcome of a Traversal, as delivered by
+// FiveTupleChan: either the FiveTuple or the error that FiveTuple returns.
+type FiveTupleResult struct {
+	FiveTuple *FiveTuple
+	Err       error
+}
 
-	log.Tracef("FiveTuple returns %s: %s", t.fiveTupleOut, t.errOut)
-	return t.fiveTupleOut, t.errOut
+// FiveTupleChan is like FiveTuple, except that instead of blocking, it
+// returns a channel that delivers the result once it's available, so that
+// applications can select over many Traversals. The channel delivers exactly
+// one result and is then closed. It's buffered, so the result is delivered
+// whether or not anybody receives it. It's safe to call alongside FiveTuple,
+// FiveTupleContext and FiveTupleTimeout, which get the same result, including
+// when the Traversal fails or is closed.
+func (t *Traversal) FiveTupleChan() <-chan *FiveTupleResult {
+	resultCh := make(chan *FiveTupleResult, 1)
+	go func() {
+		ft, err := t.FiveTuple()
+		resultCh <- &FiveTupleResult{ft, err}
+		close(resultCh)
+	}()
+	return resultCh
+}
+
+// setResult records the outcome of the Traversal for FiveTuple to return,
+// unless it already has one, and wakes up whoever else is waiting for it. It
+// returns whether it recorded the outcome.
+func (t *Traversal) setResult(ft *FiveTuple, err error) bool {
+	t.outMutex.Lock()
+	defer t.outMutex.Unlock()
+	if t.fiveTupleOut != nil || t.errOut != nil {
+		return false
+	}
+	t.fiveTupleOut, t.errOut = ft, err
+	close(t.resultCh)
+	return true
 }
 
 // Close closes this Traversal, terminating any outstanding natty process by
-// sending SIGKILL. Close blocks until the natty process has terminated, at
-// which point any ports that it bound should be available for use.
+// sending SIGKILL. Close blocks until the natty process has terminated and
+// been reaped, at which point any ports that it bound should be available for
+// use, natty's pipes are closed and the goroutines that read them have
+// returned. Callers blocked in NextMsgOut get done, and the Traversal's other
+// goroutines (like the one behind MsgOutChan, or those sending keepalives)
+// return shortly after. Closing a Traversal that's already closed returns
+// ErrClosed.
 func (t *Traversal) Close() error {
-	if t.cmd == nil || t.cmd.Process == nil {
+	closing := false
+	t.closeOnce.Do(func() {
+		closing = true
+		t.setPhase(phaseClosed)
+		close(t.closedCh)
+		t.setState(StateClosed)
+		t.handoff.close()
+		// Wait for any write to the trace writer that's in progress
+		t.traceMutex.Lock()
+		t.traceMutex.Unlock()
+	})
+	err := t.stopNatty()
+	t.outMutex.Lock()
+	stoppedCh := t.stoppedCh
+	t.outMutex.Unlock()
+	if stoppedCh != nil {
+		// natty may have been starting while we stopped it, in which case run
+		// reaps it
+		<-stoppedCh
+	}
+	if _, exited := err.(*exec.ExitError); exited {
+		// natty died, as it should have
+		err = nil
+	}
+	if err == nil && !closing {
+		err = ErrClosed
+	}
+	return err
+}
+
+// stopNatty terminates any outstanding natty process without closing the
+// Traversal itself.
+func (t *Traversal) stopNatty() error {
+	return t.reapNatty(0)
+}
+
+// reapNatty is like stopNatty, except that it gives natty up to grace to exit
+// by itself before killing it, so that its exit code is kept.
+func (t *Traversal) reapNatty(grace time.Duration) error {
+	// Restart replaces all of these, so look at the current ones
+	t.cmdMutex.Lock()
+	if t.turnAllocOwned {
+		defer t.turnAllocation.Close()
+	}
+	if t.turnBinding != nil {
+		defer t.turnBinding.close()
+	}
+	if t.mappingBinding != nil {
+		defer t.mappingBinding.close()
+	}
+	cmd, stop := t.cmd, t.stop
+	started := cmd != nil && cmd.Process != nil
+	t.cmdMutex.Unlock()
+	if !started {
 		return nil
-	} else {
-		log.Trace("Killing natty process")
-		err := t.cmd.Process.Kill()
+	}
+	// Both Close() and doRun stop natty, possibly at the same time
+	stop.once.Do(func() {
+		reaped := make(chan error, 1)
+		go func() {
+			t.iowg.Wait()
+			reaped <- cmd.Wait()
+		}()
+		if grace > 0 {
+			select {
+			case stop.err = <-reaped:
+				t.log().Trace("natty process exited")
+				return
+			case <-time.After(grace):
+			}
+		}
+		t.log().Trace("Killing natty process")
+		err := cmd.Process.Kill()
 		if err != nil {
-			return fmt.Errorf("Unable to kill natty process: %s", err)
+			stop.err = fmt.Errorf("Unable to kill natty process: %s", err)
+			return
 		}
-		log.Trace("Waiting for reading from pipes to finish")
-		t.iowg.Wait()
-		log.Trace("Waiting for natty process to die")
-		err = t.cmd.Wait()
-		log.Trace("natty process is dead")
-		return err
-	}
+		t.log().Trace("Waiting for natty process to die")
+		stop.err = <-reaped
+		t.log().Trace("natty process is dead")
+	})
+	return stop.err
+}
+
+// stopResult makes sure that a natty process is only stopped once, and
+// records the result of stopping it.
+type stopResult struct {
+	once sync.Once
+	err  error
 }
 
 // run runs the natty command to obtain a FiveTuple. The actual running of
-// natty happens on a goroutine so that run itself doesn't block.
+// natty happens on a goroutine so that run itself doesn't block. To keep
+// Traversals cheap, each one uses just two goroutines: this one, which writes
+// the peer's messages to natty and waits for the result, and processStdout,
+// which reads natty's output. natty's stderr, whose tail is kept for an
+// ExitError, is copied by a goroutine of ours if its output is going
+// somewhere, and by os/exec otherwise (see initCommand).
 func (t *Traversal) run(params []string) {
-	t.msgInCh = make(chan string, 100)
-	t.msgOutCh = make(chan string, 100)
+	t.params = params
+	t.offering = len(params) > 0 && params[0] == offerParams[0]
+	t.punch.offering = t.offering
+	t.statsTracker.mark(milestoneStarted)
+	t.initChannels()
+	if t.networkMonitor {
+		go t.monitorNetwork()
+	}
+	t.start()
+}
 
-	// Note - these channels are buffered in order to prevent deadlocks
-	// The bufferDepth just needs to be at least as large as the total number of
-	// goroutines created during a single traversal (which is about 4).
-	bufferDepth := 10
-	t.peerGotFiveTupleCh = make(chan bool, bufferDepth)
-	t.fiveTupleCh = make(chan *FiveTuple, bufferDepth)
-	t.errCh = make(chan error, bufferDepth)
-	t.fiveTupleOutCh = make(chan *FiveTuple, bufferDepth)
-	t.errOutCh = make(chan error, bufferDepth)
+// start starts natty, for run or Restart.
+func (t *Traversal) start() {
+	stoppedCh := make(chan struct{})
+	t.outMutex.Lock()
+	t.stoppedCh = stoppedCh
+	exitedCh := t.exitedCh
+	t.outMutex.Unlock()
 
-	err := t.initCommand(params)
+	err := t.register()
+	if err == nil {
+		err = t.initCommand(t.params)
+	}
 
 	go func() {
 		if err != nil {
+			close(stoppedCh)
+			t.tellPeer(err)
+			close(exitedCh)
+			close(t.finishedCh)
+			t.deregister()
+			t.statsTracker.mark(milestoneFinished)
+			t.setPhase(phaseFailed)
+			t.setState(StateFailed)
+			t.gathering.finish(err)
 			t.errOutCh <- err
 			return
 		}
 
-		ft, err := t.doRun(params)
-		log.Trace("doRun is finished, inform client of the FiveTuple or error")
+		ft, err := t.doRun()
+		close(stoppedCh)
+		if err == nil {
+			handoffErr := t.handoff.receive(ft)
+			if handoffErr != nil {
+				t.log().Errorf("%s, will bind a new socket", handoffErr)
+			}
+		}
+		if err == nil && t.allPairs {
+			// natty has stopped, freeing the ports that we check from
+			pairs := t.checkAllPairs(ft, allPairsWindow)
+			t.outMutex.Lock()
+			t.pairsOut = pairs
+			t.outMutex.Unlock()
+		}
+		close(t.finishedCh)
+		t.deregister()
+		t.statsTracker.mark(milestoneFinished)
+		t.log().Trace("doRun is finished, inform client of the FiveTuple or error")
 		if err != nil {
-			log.Tracef("Returning error: %s", err)
+			t.tellPeer(err)
+			// natty has stopped, so no more messages are coming, other than
+			// telling the peer
+			close(exitedCh)
+			t.setPhase(phaseFailed)
+			t.setState(StateFailed)
+			t.gathering.finish(err)
+			t.log().Tracef("Returning error: %s", err)
 			t.errOutCh <- err
-			log.Tracef("Returned error: %s", err)
+			t.log().Tracef("Returned error: %s", err)
 		} else {
-			log.Tracef("Returning FiveTuple: %s", ft)
+			t.setPhase(phaseConnected)
+			t.setState(StateConnected)
+			t.log().Tracef("Returning FiveTuple: %s", ft)
 			t.fiveTupleOutCh <- ft
 		}
 	}()
 }
 
+// initChannels initializes the channels used during the Traversal.
+func (t *Traversal) initChannels() {
+	t.msgInCh = make(chan []byte, 100)
+	t.msgOutCh = make(chan []byte, t.outBufferSize)
+	t.initRunChannels()
+}
+
+// initRunChannels initializes the channels used while natty runs, which
+// Restart replaces.
+func (t *Traversal) initRunChannels() {
+	t.finishedCh = make(chan struct{})
+	t.exitedCh = make(chan struct{})
+
+	// Note - these channels are buffered in order to prevent deadlocks
+	// The bufferDepth just needs to be at least as large as the total number of
+	// goroutines created during a single traversal (which is at most 3).
+	bufferDepth := 10
+	t.fiveTupleCh = make(chan *FiveTuple, bufferDepth)
+	t.errCh = make(chan error, bufferDepth)
+	t.fiveTupleOutCh = make(chan *FiveTuple, bufferDepth)
+	t.errOutCh = make(chan error, bufferDepth)
+}
+
+// finished returns the channel that's closed once natty has stopped, which
+// Restart replaces.
+func (t *Traversal) finished() <-chan struct{} {
+	t.outMutex.Lock()
+	defer t.outMutex.Unlock()
+	return t.finishedCh
+}
+
 // doRun does the running, including resource cleanup.  doRun blocks until
-// Close() has finished, meaning that natty is no longer running and whatever
+// natty has been stopped, meaning that natty is no longer running and whatever
 // port it returned in the FiveTuple can now be used for other things.
-func (t *Traversal) doRun(params []string) (*FiveTuple, error) {
-	defer t.Close()
+func (t *Traversal) doRun() (*FiveTuple, error) {
+	defer t.stopNatty()
 
-	t.iowg.Add(2)
+	t.iowg.Add(1)
 	go t.processStdout()
-	go t.processStderr()
+	if t.stderr != nil {
+		t.iowg.Add(1)
+		go t.processStderr()
+	}
 
 	// Start the natty command
-	t.errCh <- t.cmd.Start()
-
-	go t.processIncoming()
+	t.cmdMutex.Lock()
+	err := t.cmd.Start()
+	t.cmdMutex.Unlock()
+	t.handoff.started()
+	if err == nil {
+		t.statsTracker.mark(milestoneProcessStarted)
+		t.setState(StateGathering)
+	} else {
+		err = startError(err)
+	}
+	t.errCh <- err
 
 	return t.waitForFiveTuple()
 }
 
 // initCommand sets up the natty command
 func (t *Traversal) initCommand(params []string) (err error) {
-	if log.IsTraceEnabled() {
-		log.Trace("Telling natty to log debug output")
+	if t.nattyDebug() {
+		t.log().Trace("Telling natty to log debug output")
 		params = append(params, "-debug")
 	}
+	if t.software != DefaultSoftwareAttribute {
+		params, err = t.appendFlag(params, "WithSoftwareAttribute", "software", t.software)
+		if err != nil {
+			return err
+		}
+	} else {
+		// The default is only worth passing to a natty that accepts it
+		supported, err := t.nattySupports("software")
+		if err != nil {
+			return err
+		}
+		if supported {
+			params = append(params, "-software", t.software)
+		}
+	}
+	if len(t.stunServers) > 0 {
+		err = checkSTUNServers(t.stunServers)
+		if err != nil {
+			return err
+		}
+		params = append(params, "-stuns", strings.Join(t.stunServers, ","))
+	}
+	if t.controlDSCP != noDSCP {
+		params, err = t.appendFlag(params, "WithControlDSCP", "dscp", strconv.Itoa(t.controlDSCP))
+		if err != nil {
+			return err
+		}
+	}
+	if t.ipVersion != IPAny {
+		supported, err := t.nattySupports("ipversion")
+		if err != nil {
+			return err
+		}
+		if supported {
+			params = append(params, "-ipversion", t.ipVersion.String())
+		} else {
+			t.log().Trace("natty doesn't accept -ipversion, only filtering candidates by IP version")
+		}
+	}
+	if t.transport != TransportUDP {
+		err = t.checkTransportOptions()
+		if err != nil {
+			return err
+		}
+		params, err = t.appendFlag(params, "WithTransport", "transport", t.transport.String())
+		if err != nil {
+			return err
+		}
+	}
+	if t.sockets.device != "" {
+		err = t.sockets.check()
+		if err != nil {
+			return err
+		}
+		params, err = t.appendFlag(params, "WithBindToDevice", "device", t.sockets.device)
+		if err != nil {
+			return err
+		}
+	}
+	if t.localIP != nil {
+		err = checkLocalIP(t.localIP, t.ipVersion)
+		if err != nil {
+			return err
+		}
+		params, err = t.appendFlag(params, "WithLocalIP", "localip", t.localIP.String())
+		if err != nil {
+			return err
+		}
+	}
+	if t.relayLocalPort != 0 {
+		err = checkRelayLocalPort(t.relayLocalPort, t.sockets)
+		if err != nil {
+			return err
+		}
+		if t.turnServer == nil {
+			// Otherwise we talk to the TURN server from the port ourselves
+			params, err = t.appendFlag(params, "WithRelayLocalPort", "relayport", strconv.Itoa(t.relayLocalPort))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if t.extraLocalPorts != 0 {
+		err = checkLocalPortCount(t.extraLocalPorts + 1)
+		if err != nil {
+			return err
+		}
+		params, err = t.appendFlag(params, "WithLocalPortCount", "localports", strconv.Itoa(t.extraLocalPorts+1))
+		if err != nil {
+			return err
+		}
+	}
+	if t.turnServer != nil {
+		// Before allocating a relay that natty couldn't use
+		err = t.requireFlag("WithTURNServer", "turn")
+		if err != nil {
+			return err
+		}
+		err = t.allocateTurn()
+		if err != nil {
+			return err
+		}
+	}
+	if t.turnAllocation != nil {
+		err = t.requireFlag("WithTurnAllocation", "turn")
+		if err != nil {
+			return err
+		}
+		t.turnBinding, err = t.turnAllocation.bind()
+		if err != nil {
+			return err
+		}
+		params = append(params, "-turn", t.turnBinding.addr())
+	}
+	if t.mappingKeeper != nil {
+		if t.turnAllocation != nil {
+			return fmt.Errorf("Unable to use both a TurnAllocation and a MappingKeeper")
+		}
+		t.seedCandidate = t.mappingKeeper.seedCandidate()
+		if t.seedCandidate != nil {
+			supported, err := t.nattySupports("turn")
+			if err != nil {
+				return err
+			}
+			if !supported {
+				t.log().Trace("natty doesn't accept -turn, not seeding the MappingKeeper's candidate")
+				t.seedCandidate = nil
+			}
+		}
+		if t.seedCandidate != nil {
+			t.mappingBinding, err = t.mappingKeeper.bind()
+			if err != nil {
+				return err
+			}
+			params = append(params, "-turn", t.mappingBinding.addr())
+		}
+	}
 
-	t.cmd = nattybe.Command(params...)
-	t.stdin, err = t.cmd.StdinPipe()
+	if t.handoff.enabled && t.allPairs {
+		// Checking all pairs needs natty's ports, including the one we'd keep
+		return fmt.Errorf("Unable to use both WithBoundConn and WithAllPairs")
+	}
+	handoffAccepted := false
+	if t.handoff.enabled {
+		handoffAccepted, err = t.nattySupports("handoff")
+		if err != nil {
+			return err
+		}
+	}
+	handoffParams, err := t.handoff.params(handoffAccepted)
 	if err != nil {
 		return err
 	}
-	t.stdout, err = t.cmd.StdoutPipe()
+	params = append(params, handoffParams...)
+
+	t.cmd, err = t.nattyCommand(params)
 	if err != nil {
 		return err
 	}
-	t.stderr, err = t.cmd.StderrPipe()
+	if t.handoff.theirs != nil {
+		t.cmd.ExtraFiles = []*os.File{t.handoff.theirs}
+	}
+	t.stdin, err = t.cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	t.stdout, err = t.cmd.StdoutPipe()
 	if err != nil {
 		return err
 	}
+	if t.stderrOut() != ioutil.Discard {
+		t.stderr, err = t.cmd.StderrPipe()
+		if err != nil {
+			return err
+		}
+	} else {
+		// Only keep the tail, for an ExitError
+		t.cmd.Stderr = &t.stderrTail
+	}
 
 	t.stdoutbuf = bufio.NewReader(t.stdout)
 
@@ -274,111 +1024,405 @@ func (t *Traversal) initCommand(params []string) (err error) {
 }
 
 // processStdout reads the output from natty and sends it to the msgOutCh. If
-// it finds a FiveTuple, it records that.
+// it finds a FiveTuple, it records that. Each message is read into a buffer
+// from the pool, whose ownership passes to msgOutCh along with the message.
 func (t *Traversal) processStdout() {
 	defer t.iowg.Done()
 
 	for {
 		// Read next message from natty
-		msg, err := t.stdoutbuf.ReadString('\n')
+		msg, err := t.readMsg()
 		if err != nil {
 			t.errCh <- err
 			return
 		}
 
-		log.Trace("Request send of message to peer")
-		t.msgOutCh <- msg
-
-		if IsFiveTuple(msg) {
-			log.Trace("We got a FiveTuple!")
+		if isFiveTuple(msg) {
+			t.log().Trace("We got a FiveTuple!")
 			fiveTuple := &FiveTuple{}
-			err = json.Unmarshal([]byte(msg), fiveTuple)
+			err = json.Unmarshal(msg, fiveTuple)
 			if err != nil {
+				putMsgBuf(msg)
 				t.errCh <- err
 				return
 			}
-			t.fiveTupleCh <- fiveTuple
-		} else if IsError(msg) {
-			log.Trace("We got an error")
-			msgmap := make(map[string]string)
-			err = json.Unmarshal([]byte(msg), msgmap)
-			if err == nil {
-				err = fmt.Errorf("Error reported by natty: %s", msgmap["message"])
+			err = t.checkRemote(fiveTuple.Remote)
+			if err != nil {
+				t.log().Errorf("%s", err)
+				putMsgBuf(msg)
+				t.errCh <- err
+				return
+			}
+			err = t.checkTransport(fiveTuple)
+			if err != nil {
+				t.log().Errorf("%s", err)
+				putMsgBuf(msg)
+				t.errCh <- err
+				return
+			}
+			fiveTuple.Relayed = t.statsTracker.relayed(fiveTuple)
+			err = t.checkLocal(fiveTuple)
+			if err != nil {
+				t.log().Errorf("%s", err)
+				putMsgBuf(msg)
+				t.errCh <- err
+				return
 			}
+			if t.pairAcceptor != nil {
+				err = t.pairAcceptor(fiveTuple)
+				if err != nil {
+					t.log().Tracef("FiveTuple rejected by pair acceptor: %s", err)
+					putMsgBuf(msg)
+					t.errCh <- err
+					return
+				}
+			}
+			// However gathering went, it's done now
+			t.gathering.finish(nil)
+			t.setState(StateChecking)
+			t.statsTracker.mark(milestoneFiveTuple)
+			t.log().Trace("Request send of FiveTuple to peer")
+			if !t.emitMsg(msg) {
+				return
+			}
+			t.fiveTupleCh <- fiveTuple
+			continue
+		}
+
+		t.punch.outbound(msg)
+		filtered := t.filterIPVersion(msg)
+		if filtered == nil {
+			t.log().Tracef("Not sending candidate of the other IP version: %s", msg)
+			putMsgBuf(msg)
+			continue
+		}
+		msg = filtered
+		msg = t.overridePriorities(msg)
+		t.statsTracker.track(msg, true)
+		t.gathering.track(msg)
+		if !t.gathering.finishedAt().IsZero() {
+			t.setState(StateChecking)
+		}
+		err = t.checkLocalCandidates(msg)
+		if err != nil {
+			t.log().Errorf("%s", err)
+			putMsgBuf(msg)
 			t.errCh <- err
 			return
 		}
+		if t.hairpinning == HairpinUnsupported && t.hairpin.dropLocal(msg) {
+			t.log().Tracef("Peer is behind our NAT, which doesn't support hairpinning, not sending candidate: %s", msg)
+			putMsgBuf(msg)
+			continue
+		}
+
+		// Look for an error before emitting msg, which hands it off
+		var nattyErr error
+		if isError(msg) {
+			t.log().Trace("We got an error")
+			msgmap := make(map[string]interface{})
+			nattyErr = json.Unmarshal(msg, &msgmap)
+			if nattyErr == nil {
+				nattyErr = &kindError{fmt.Sprintf("Error reported by natty: %v", msgmap["message"]), ErrNoConnectivity}
+			}
+		}
+		ours := sdpRole(msg) == t.role()
+		t.log().Trace("Request send of message to peer")
+		if !t.emitMsg(msg) {
+			return
+		}
+		if nattyErr != nil {
+			t.errCh <- nattyErr
+			return
+		}
+		if ours && t.wireFormat == Negotiated {
+			t.emitMsg(versionMsg(currentWireVersion))
+		}
+		if ours && t.seedCandidate != nil {
+			t.emitSeedCandidate()
+		}
+	}
+}
+
+// readMsg reads the next line from natty's stdout into a buffer from the pool.
+func (t *Traversal) readMsg() ([]byte, error) {
+	msg := getMsgBuf()
+	for {
+		line, err := t.stdoutbuf.ReadSlice('\n')
+		msg = append(msg, line...)
+		if err != bufio.ErrBufferFull {
+			if err != nil {
+				putMsgBuf(msg)
+			}
+			return msg, err
+		}
+	}
+}
+
+// emitSeedCandidate emits the candidate for the MappingKeeper's mapping right
+// after our session description, ahead of the candidates that natty gathers.
+func (t *Traversal) emitSeedCandidate() {
+	msg := append(getMsgBuf(), t.seedCandidate...)
+	t.seedCandidate = nil
+	filtered := t.filterIPVersion(msg)
+	if filtered == nil {
+		putMsgBuf(msg)
+		return
+	}
+	msg = t.overridePriorities(filtered)
+	t.log().Tracef("Seeding candidate: %s", msg)
+	t.statsTracker.track(msg, true)
+	t.gathering.track(msg)
+	t.emitMsg(msg)
+}
+
+// emitPunchMsg sends a punch coordination message to the peer.
+func (t *Traversal) emitPunchMsg(msg []byte) {
+	t.emitMsg(append(getMsgBuf(), msg...))
+}
+
+// encodeOut encodes msg, in its own buffer, for the peer per the WireFormat
+// and session tag.
+func (t *Traversal) encodeOut(msg []byte) []byte {
+	format := t.emitFormat()
+	if format == Text && t.sessionTag == "" {
+		return msg
 	}
+	encoded := encodeMsg(string(msg), format)
+	if t.sessionTag != "" {
+		encoded = tagMsg(encoded, format, t.role(), t.sessionTag)
+	}
+	return append(msg[:0], encoded...)
+}
+
+// emitMsg makes the given message from natty available via NextMsgOut, taking
+// ownership of msg, once the signaling rate limit allows. If the consumer has
+// stopped reading messages and the buffer is full, the configured
+// OverflowPolicy applies. emitMsg returns false if the Traversal was closed
+// while waiting to emit the message, or failed because the rate limit kept it
+// waiting for too long.
+func (t *Traversal) emitMsg(msg []byte) bool {
+	if t.standby {
+		// Nobody reads the messages of a standby Traversal until it's handed
+		// out, so they don't count against the rate limit until then
+		select {
+		case <-t.activatedCh:
+		case <-t.closedCh:
+			putMsgBuf(msg)
+			return false
+		}
+	}
+	waited, err := signalLimit.wait(t.id, t.closedCh)
+	t.statsTracker.signalWaited(waited)
+	if err != nil {
+		putMsgBuf(msg)
+		if err == ErrSignalBackpressure {
+			t.log().Errorf("Waited %s to emit message, giving up", waited)
+			t.runReports().backpressure.Do(func() {
+				select {
+				case t.errCh <- err:
+				case <-t.closedCh:
+				}
+			})
+		}
+		return false
+	}
+	msg = t.encodeOut(msg)
+	if t.overflowPolicy == OverflowDrop {
+		select {
+		case t.msgOutCh <- msg:
+		default:
+			t.log().Errorf("Outbound message buffer full, dropping message: %s", msg)
+			putMsgBuf(msg)
+		}
+		return true
+	}
+
+	select {
+	case t.msgOutCh <- msg:
+		return true
+	case <-t.closedCh:
+		t.log().Trace("Traversal closed while waiting to emit message")
+		putMsgBuf(msg)
+		return false
+	}
+}
+
+// emitFormat returns the format in which to emit messages, which for
+// Negotiated depends on what the peer has advertised so far.
+func (t *Traversal) emitFormat() WireFormat {
+	switch t.wireFormat {
+	case V1:
+		return Text
+	case Negotiated:
+		if atomic.LoadInt32(&t.peerWireVersion) >= wireV2 {
+			return Binary
+		}
+		return Text
+	}
+	return t.wireFormat
 }
 
 // processStderr copies the output from natty's stderr to the configured
-// traceOut
+// traceWriter or, absent that, traceOut
 func (t *Traversal) processStderr() {
 	defer t.iowg.Done()
 
-	_, err := io.Copy(t.traceOut, t.stderr)
+	out := t.stderrOut()
+	if t.logRedaction == RedactIPs {
+		out = &redactingWriter{out: out}
+	}
+	_, err := io.Copy(io.MultiWriter(&t.stderrTail, out), t.stderr)
 	t.errCh <- err
 }
 
-func (t *Traversal) processIncoming() {
-	for {
-		msg := <-t.msgInCh
-		log.Tracef("Got incoming message: %s", msg)
+// stderrOut returns where natty's stderr should go.
+func (t *Traversal) stderrOut() io.Writer {
+	if t.traceWriter != nil {
+		return traceWriterOut{t}
+	}
+	if t.debug == debugOn && t.traceOut == ioutil.Discard {
+		// Asked for debug output, which would otherwise go nowhere
+		return os.Stderr
+	}
+	return t.traceOut
+}
 
-		if IsFiveTuple(msg) {
-			log.Trace("Incoming message was a FiveTuple!")
-			t.peerGotFiveTupleCh <- true
-			continue
-		}
+// nattyDebug indicates whether natty should log debug output, which by
+// default it does if its output is going somewhere (see WithDebug).
+func (t *Traversal) nattyDebug() bool {
+	switch t.debug {
+	case debugOn:
+		return true
+	case debugOff:
+		return false
+	}
+	return log.IsTraceEnabled() || t.traceWriter != nil || t.logger != nil
+}
 
-		log.Trace("Forward message to natty process")
-		_, err := t.stdin.Write([]byte(msg))
-		if err == nil {
-			_, err = t.stdin.Write([]byte("\n"))
-		}
-		if err != nil {
-			log.Tracef("Unable to forward message to natty process: %s: %s", msg, err)
-			t.errCh <- err
-		} else {
-			log.Tracef("Forwarded message to natty process: %s", msg)
-		}
+// traceWriterOut is an io.Writer that passes natty's output to the
+// Traversal's trace writer until the Traversal is closed, ignoring errors so
+// that a failing trace writer doesn't fail the Traversal.
+type traceWriterOut struct {
+	t *Traversal
+}
+
+func (w traceWriterOut) Write(b []byte) (int, error) {
+	w.t.traceMutex.Lock()
+	defer w.t.traceMutex.Unlock()
+	select {
+	case <-w.t.closedCh:
+		// Nothing's written to the trace writer once Close returns
+	default:
+		w.t.traceWriter.Write(b)
 	}
+	return len(b), nil
 }
 
-func (t *Traversal) waitForFiveTuple() (*FiveTuple, error) {
-	timeout := t.timeout
-	if timeout == 0 {
-		timeout = reallyHighTimeout
+// forwardMsgIn passes a message from the peer to natty, returning true if it
+// was the peer's FiveTuple, which natty doesn't need. Either way, msg goes back
+// to the pool.
+func (t *Traversal) forwardMsgIn(msg []byte) (peerGotFiveTuple bool, err error) {
+	defer putMsgBuf(msg)
+	tracing := t.log().tracing()
+	if tracing {
+		t.log().Tracef("Got incoming message: %s", msg)
 	}
 
-	timeoutCh := time.After(timeout)
+	if isFiveTuple(msg) {
+		t.log().Trace("Incoming message was a FiveTuple!")
+		return true, nil
+	}
+
+	t.statsTracker.track(msg, false)
+	t.log().Trace("Forward message to natty process")
+	_, err = t.stdin.Write(append(msg, '\n'))
+	if err != nil {
+		t.log().Tracef("Unable to forward message to natty process: %s: %s", msg, err)
+	} else if tracing {
+		t.log().Tracef("Forwarded message to natty process: %s", msg)
+	}
+	return false, err
+}
+
+// waitForFiveTuple passes messages from the peer to natty until natty emits a
+// FiveTuple (and the peer has got its own), fails, times out or the Traversal
+// is closed.
+func (t *Traversal) waitForFiveTuple() (*FiveTuple, error) {
+	// The timeout only starts once the Traversal is activated
+	var timeoutCh <-chan time.Time
+	activatedCh := t.activatedCh
+	errCh := t.errCh
+	var result *FiveTuple
+	peerGotFiveTuple := false
 
 	for {
 		select {
-		case result := <-t.fiveTupleCh:
+		case <-activatedCh:
+			activatedCh = nil
+			timeout := t.timeout
+			if timeout == 0 {
+				timeout = reallyHighTimeout
+			}
+			timeoutCh = time.After(timeout)
+		case msg := <-t.msgInCh:
+			gotFiveTuple, err := t.forwardMsgIn(msg)
+			if err != nil && errCh != nil {
+				return nil, err
+			}
+			if gotFiveTuple {
+				peerGotFiveTuple = true
+				if result != nil {
+					t.log().Trace("Peer got FiveTuple!")
+					return result, nil
+				}
+			}
+		case result = <-t.fiveTupleCh:
+			if peerGotFiveTuple {
+				return result, nil
+			}
 			// Wait for peer to get FiveTuple before returning.  If we didn't do
 			// this, our natty instance might stop running before the peer
-			// finishes its work to get its own FiveTuple.
-			log.Trace("Got our own FiveTuple, waiting for peer to get FiveTuple")
-			<-t.peerGotFiveTupleCh
-			log.Trace("Peer got FiveTuple!")
-			return result, nil
-		case err := <-t.errCh:
-			if err != nil && err != io.EOF {
+			// finishes its work to get its own FiveTuple. Neither errors nor the
+			// timeout matter anymore.
+			t.log().Trace("Got our own FiveTuple, waiting for peer to get FiveTuple")
+			activatedCh = nil
+			timeoutCh = nil
+			errCh = nil
+		case err := <-errCh:
+			if err == io.EOF {
+				// natty closed its stdout, meaning that it exited
+				select {
+				case <-t.closedCh:
+					return nil, ErrClosed
+				default:
+					return nil, t.exitError()
+				}
+			}
+			if err != nil {
 				return nil, err
 			}
+		case <-t.closedCh:
+			return nil, ErrClosed
 		case <-timeoutCh:
-			msg := "Timed out waiting for five-tuple"
-			log.Trace(msg)
-			return nil, fmt.Errorf(msg)
+			t.log().Trace(ErrTimeout)
+			return nil, ErrTimeout
 		}
 	}
 }
 
 func IsFiveTuple(msg string) bool {
-	return strings.Contains(msg, "\"type\":\"5-tuple\"")
+	return strings.Contains(msg, fiveTupleMarker)
 }
 
 func IsError(msg string) bool {
-	return strings.Contains(msg, "\"type\":\"error\"")
+	return strings.Contains(msg, errorMarker)
+}
+
+func isFiveTuple(msg []byte) bool {
+	return bytes.Contains(msg, []byte(fiveTupleMarker))
+}
+
+func isError(msg []byte) bool {
+	return bytes.Contains(msg, []byte(errorMarker))
 }
@@ -1,13 +1,101 @@
 package natty
 
 import (
+	"context"
+	"errors"
 	elog "log"
 	"net"
+	"sync"
 	"time"
 
 	natty "."
 )
 
+func ExamplePeerConnection() {
+	// Both peers are in this process here, so a memSignaler reaches the other
+	// one. Across the network, use a Signaler that reaches the peer by
+	// whatever means the application uses for signaling.
+	signaler, peerSignaler := newMemSignalers()
+	peer := natty.NewPeerConnection(peerSignaler, nil)
+	defer peer.Close()
+	go func() {
+		err := peer.Connect(context.Background())
+		if err != nil {
+			elog.Printf("Peer unable to connect: %s", err)
+			return
+		}
+		b := make([]byte, 1024)
+		for {
+			n, err := peer.Conn().Read(b)
+			if err != nil {
+				return
+			}
+			elog.Printf("Peer got: %s", b[:n])
+		}
+	}()
+
+	pc := natty.NewPeerConnection(signaler, &natty.PeerConfig{AutoRepunch: true})
+	defer pc.Close()
+	pc.OnStateChange(func(from natty.PeerState, to natty.PeerState) {
+		elog.Printf("Connection to peer went from %s to %s", from, to)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := pc.Connect(ctx)
+	if err != nil {
+		elog.Fatal(err)
+	}
+	for {
+		_, err := pc.Conn().Write([]byte("My data"))
+		if err != nil {
+			elog.Fatal(err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// memSignaler is a Signaler that passes messages to its counterpart in the
+// same process.
+type memSignaler struct {
+	in        <-chan []byte
+	out       chan<- []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newMemSignalers returns a pair of memSignalers that reach each other.
+func newMemSignalers() (*memSignaler, *memSignaler) {
+	a, b := make(chan []byte, 100), make(chan []byte, 100)
+	return &memSignaler{in: a, out: b, closed: make(chan struct{})},
+		&memSignaler{in: b, out: a, closed: make(chan struct{})}
+}
+
+func (s *memSignaler) Send(msg []byte) error {
+	select {
+	case s.out <- msg:
+		return nil
+	case <-s.closed:
+		return errors.New("Signaler closed")
+	}
+}
+
+func (s *memSignaler) Receive() ([]byte, error) {
+	select {
+	case msg := <-s.in:
+		return msg, nil
+	case <-s.closed:
+		return nil, errors.New("Signaler closed")
+	}
+}
+
+func (s *memSignaler) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
 func ExampleOffer() {
 	t := natty.Offer(15 * time.Second)
 	defer t.Close()
@@ -1,10 +1,21 @@
 package natty
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/getlantern/golog"
 	"github.com/getlantern/testify/assert"
@@ -32,31 +43,10 @@ func TestTimeout(t *testing.T) {
 // directly.  Once connected, one peer sends a UDP packet to the other to make
 // sure that the connection works.
 //
-// Run test with environment variable TRACE=true to get debug output from natty.
+// Run test with environment variable TRACE=true to get debug output from natty,
+// or pass WithTraceWriter to get a single Traversal's.
 func TestDirect(t *testing.T) {
-	doTest(t, func(offer *Traversal, answer *Traversal) {
-		go func() {
-			for {
-				msg, done := offer.NextMsgOut()
-				if done {
-					return
-				}
-				tlog.Debugf("offer -> answer: %s", msg)
-				answer.MsgIn(msg)
-			}
-		}()
-
-		go func() {
-			for {
-				msg, done := answer.NextMsgOut()
-				if done {
-					return
-				}
-				tlog.Debugf("answer -> offer: %s", msg)
-				offer.MsgIn(msg)
-			}
-		}()
-	})
+	doTest(t, signalDirect)
 }
 
 // TestWaddell starts up two local Traversals that communicate with each other
@@ -131,14 +121,178 @@ func TestWaddell(t *testing.T) {
 	})
 }
 
-func doTest(t *testing.T, signal func(*Traversal, *Traversal)) {
+// TestDirectIPv6 is like TestDirect but restricts both Traversals to IPv6,
+// only accepting an IPv6 pair. It is skipped if the environment doesn't
+// support IPv6 on loopback.
+func TestDirectIPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 not supported in this environment: %s", err)
+	}
+	conn.Close()
+
+	doTest(t, signalDirect, WithIPVersion(IPv6), WithPairAcceptor(acceptIPv6))
+}
+
+// TestDirectPreferIPv6 is like TestDirectIPv6, except that both Traversals
+// gather IPv4 candidates too and merely prefer IPv6.
+func TestDirectPreferIPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 not supported in this environment: %s", err)
+	}
+	conn.Close()
+
+	doTest(t, signalDirect, WithIPPreference(IPv6), WithPairAcceptor(acceptIPv6))
+}
+
+// signalDirect has the Traversals signal each other directly with Run.
+func signalDirect(offer *Traversal, answer *Traversal) {
+	offerSignaler := newChanSignaler()
+	answerSignaler := &chanSignaler{in: offerSignaler.out, out: offerSignaler.in}
+	go offer.Run(offerSignaler)
+	go answer.Run(answerSignaler)
+}
+
+// acceptIPv6 is a PairAcceptor that only accepts IPv6 pairs.
+func acceptIPv6(ft *FiveTuple) error {
+	local, remote, err := ft.UDPAddrs()
+	if err != nil {
+		return err
+	}
+	if local.IP.To4() != nil || remote.IP.To4() != nil {
+		return fmt.Errorf("Expected an IPv6 pair, got %s", ft)
+	}
+	return nil
+}
+
+func TestUDPAddrsIPv6(t *testing.T) {
+	ft := &FiveTuple{Proto: UDP, Local: "[::1]:1000", Remote: "[fe80::1%lo]:1001"}
+	local, remote, err := ft.UDPAddrs()
+	if assert.NoError(t, err) {
+		assert.True(t, local.IP.Equal(net.IPv6loopback))
+		assert.Equal(t, 1000, local.Port)
+		assert.Equal(t, "fe80::1", remote.IP.String())
+		assert.Equal(t, "lo", remote.Zone)
+	}
+
+	ft = &FiveTuple{Proto: UDP, Local: "[::ffff:192.0.2.1]:1000", Remote: "192.0.2.2:1001"}
+	local, remote, err = ft.UDPAddrs()
+	if assert.NoError(t, err, "IPv4-mapped addresses are IPv4") {
+		assert.Equal(t, "192.0.2.1", local.IP.String())
+		assert.Equal(t, "192.0.2.2", remote.IP.String())
+	}
+
+	assert.Equal(t, "udp6", addrNetwork("udp", "[2001:db8::1]:1000"))
+	assert.Equal(t, "tcp4", addrNetwork("tcp", "192.0.2.1:1000"))
+	assert.Equal(t, "udp", addrNetwork("udp", "localhost:1000"))
+}
+
+func TestFiveTupleJSON(t *testing.T) {
+	for _, ft := range []*FiveTuple{
+		{Proto: UDP, Local: "192.168.1.2:5000", Remote: "198.51.100.1:5000"},
+		{Proto: TCP, Local: "[2001:db8::1]:5000", Remote: "[fe80::1%lo]:5001", Relayed: true},
+	} {
+		b, err := json.Marshal(ft)
+		if !assert.NoError(t, err) {
+			return
+		}
+		decoded := &FiveTuple{}
+		if assert.NoError(t, json.Unmarshal(b, decoded), string(b)) {
+			assert.Equal(t, ft, decoded)
+		}
+	}
+
+	b, err := json.Marshal(FiveTuple{Proto: UDP, Local: "192.168.1.2:5000", Remote: "198.51.100.1:5000"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, `{"Proto":"udp","Local":"192.168.1.2:5000","Remote":"198.51.100.1:5000","Relayed":false}`, string(b))
+	}
+
+	decoded := &FiveTuple{}
+	if assert.NoError(t, json.Unmarshal([]byte(`{"type":"5-tuple","Proto":"udp","Local":"192.168.1.2:5000","Remote":"198.51.100.1:5000"}`), decoded), "natty's FiveTuples should decode") {
+		assert.Equal(t, &FiveTuple{Proto: UDP, Local: "192.168.1.2:5000", Remote: "198.51.100.1:5000"}, decoded)
+	}
+	assert.Error(t, json.Unmarshal([]byte(`{"Proto":"sctp"}`), decoded), "Unknown protocol should fail")
+}
+
+// TestDirectTCP is like TestDirect, but requires TCP. Once connected, the
+// offerer dials the answerer over the TCP pair and sends it some bytes.
+func TestDirectTCP(t *testing.T) {
+	doTestTCP(t, TransportTCP)
+}
+
+// TestDirectPreferTCP is like TestDirectTCP, but also gathers UDP candidates.
+// The TCP pair should still win.
+func TestDirectPreferTCP(t *testing.T) {
+	doTestTCP(t, TransportPreferTCP)
+}
+
+func doTestTCP(t *testing.T, transport Transport) {
+	skipUnlessNattySupports(t, "transport")
+	opts := []Option{WithTransport(transport), WithIPVersion(IPv4)}
+	offer := Offer(0, opts...)
+	defer offer.Close()
+	answer := Answer(15*time.Second, opts...)
+	defer answer.Close()
+
+	relay := func(from *Traversal, to *Traversal) {
+		for {
+			msg, done := from.NextMsgOut()
+			if done {
+				return
+			}
+			to.MsgIn(msg)
+		}
+	}
+	go relay(offer, answer)
+	go relay(answer, offer)
+
+	answerFiveTuple, err := answer.FiveTuple()
+	if !assert.NoError(t, err, "answer should get a FiveTuple") {
+		return
+	}
+	assert.Equal(t, TCP, answerFiveTuple.Proto)
+	l, err := answer.ListenTCP()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	offerFiveTuple, err := offer.FiveTuple()
+	if !assert.NoError(t, err, "offer should get a FiveTuple") {
+		return
+	}
+	assert.Equal(t, TCP, offerFiveTuple.Proto)
+	conn, err := offer.DialTCP()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(MessageText))
+	assert.NoError(t, err)
+
+	accepted, err := l.AcceptTCP()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer accepted.Close()
+	assert.Equal(t, answerFiveTuple.Remote, accepted.RemoteAddr().String())
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, len(MessageText))
+	_, err = io.ReadFull(accepted, b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, MessageText, string(b))
+	}
+}
+
+func doTest(t *testing.T, signal func(*Traversal, *Traversal), opts ...Option) {
 	var offer *Traversal
 	var answer *Traversal
 
-	offer = Offer(0)
+	offer = Offer(0, opts...)
 	defer offer.Close()
 
-	answer = Answer(15 * time.Second)
+	answer = Answer(15*time.Second, opts...)
 	defer answer.Close()
 
 	var answerReady sync.WaitGroup
@@ -273,3 +427,523 @@ func errorf(t *testing.T, msg string, args ...interface{}) {
 	tlog.Errorf("error: "+msg, args...)
 	t.Errorf(msg, args...)
 }
+
+func TestSoftwareAttribute(t *testing.T) {
+	tr := newTraversal(0, nil)
+	assert.Equal(t, DefaultSoftwareAttribute, tr.software, "Should default to go-natty identifier")
+
+	tr = newTraversal(0, []Option{WithSoftwareAttribute("my-app/1.0")})
+	assert.Equal(t, "my-app/1.0", tr.software, "Should use specified software")
+
+	long := strings.Repeat("é", maxSoftwareChars+10)
+	tr = newTraversal(0, []Option{WithSoftwareAttribute(long)})
+	assert.Equal(t, maxSoftwareChars, utf8.RuneCountInString(tr.software), "Should truncate to max characters")
+	assert.True(t, len(tr.software) <= maxSoftwareBytes, "Should fit within max bytes")
+}
+
+func TestTimeoutLoggerDebugOptions(t *testing.T) {
+	tr := newTraversal(time.Minute, []Option{WithTimeout(time.Second)})
+	assert.Equal(t, time.Second, tr.timeout, "WithTimeout should override the timeout argument")
+
+	logger := &recordingLogger{}
+	tr = newTraversal(0, []Option{WithLogger(logger)})
+	tr.log().Trace("Hello")
+	tr.stderrOut().Write([]byte("from natty\n"))
+	if assert.Len(t, logger.all(), 2) {
+		assert.Contains(t, logger.all()[1], "source natty")
+	}
+	assert.True(t, tr.nattyDebug(), "natty's debug output should go to the Logger")
+
+	tr = newTraversal(0, []Option{WithLogger(logger), WithDebug(false)})
+	assert.False(t, tr.nattyDebug())
+	tr = newTraversal(0, []Option{WithDebug(true)})
+	tr.traceOut = ioutil.Discard
+	assert.True(t, tr.nattyDebug())
+	assert.Equal(t, os.Stderr, tr.stderrOut(), "Forced debug output shouldn't be discarded")
+	tr = newTraversal(0, []Option{WithDebug(true), WithTraceWriter(&bytes.Buffer{})})
+	assert.NotEqual(t, os.Stderr, tr.stderrOut(), "Trace writer should take precedence")
+}
+
+func TestNetworkMonitorStopsOnClose(t *testing.T) {
+	tr := newTraversal(0, []Option{WithNetworkMonitor(true)})
+	done := make(chan interface{})
+	go func() {
+		tr.monitorNetwork()
+		close(done)
+	}()
+	tr.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * networkPollInterval):
+		t.Fatal("Network monitor should have stopped after Close")
+	}
+}
+
+// TestStopConsumingMsgOut makes sure that a consumer that stops reading from
+// NextMsgOut neither deadlocks nor crashes the Traversal.
+func TestStopConsumingMsgOut(t *testing.T) {
+	drop := newTraversal(0, []Option{WithOutboundBuffer(2, OverflowDrop)})
+	drop.initChannels()
+	for i := 0; i < 5; i++ {
+		assert.True(t, drop.emitMsg([]byte("msg")), "Dropping should never block or fail")
+	}
+	assert.Equal(t, 2, len(drop.msgOutCh), "Should have buffered up to the limit")
+
+	unbuffered := newTraversal(0, []Option{WithOutboundBuffer(-1, OverflowDrop)})
+	unbuffered.initChannels()
+	assert.True(t, unbuffered.emitMsg([]byte("msg")), "Negative size should mean no buffer")
+	assert.Equal(t, 0, cap(unbuffered.msgOutCh))
+
+	block := newTraversal(0, []Option{WithOutboundBuffer(2, OverflowBlock)})
+	block.initChannels()
+	assert.True(t, block.emitMsg([]byte("msg")))
+	assert.True(t, block.emitMsg([]byte("msg")))
+	emitted := make(chan bool)
+	go func() {
+		emitted <- block.emitMsg([]byte("msg"))
+	}()
+	select {
+	case <-emitted:
+		t.Fatal("Emitting into a full buffer should block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	block.Close()
+	select {
+	case ok := <-emitted:
+		assert.False(t, ok, "Emitting should fail once Traversal is closed")
+	case <-time.After(1 * time.Second):
+		t.Fatal("Close should unblock emitting")
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer conn.Close()
+
+	assert.Error(t, SetDSCP(conn, maxDSCP+1), "Out of range DSCP should be rejected")
+
+	tr := newTraversal(0, nil)
+	assert.NoError(t, tr.MarkConn(conn), "Marking without DSCP configured should do nothing")
+
+	tr = newTraversal(0, []Option{WithDSCP(46), WithControlDSCP(48)})
+	assert.Equal(t, 48, tr.controlDSCP)
+	if runtime.GOOS != "windows" {
+		assert.NoError(t, tr.MarkConn(conn), "Should be able to mark conn")
+	}
+
+	binary, remove := sleepingNatty(t)
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(binary), WithControlDSCP(48)})
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.Contains(t, strings.Join(tr.cmd.Args, " "), "-dscp 48")
+	}
+	binary, remove = scriptedNatty(t, "exec sleep 30", "offer")
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(binary), WithControlDSCP(48)})
+	assert.True(t, errors.Is(tr.initCommand(nil), ErrUnsupportedOption), "natty that doesn't accept -dscp should fail the Traversal")
+}
+
+func TestGatheringMode(t *testing.T) {
+	tr := newTraversal(0, nil)
+	assert.Equal(t, GatheringUnknown, tr.Stats().GatheringMode)
+
+	tr.statsTracker.track([]byte(`{"type":"offer","sdp":"v=0\r\na=candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host generation 0\r\n"}`), true)
+	stats := tr.Stats()
+	assert.Equal(t, GatheringFull, stats.GatheringMode, "Candidates only in SDP means full gathering")
+	assert.Equal(t, 1, stats.SDPCandidates)
+
+	tr.statsTracker.track([]byte(`{"candidate":"candidate:1 1 udp 2122260223 192.168.1.161 55286 typ host generation 0","sdpMid":"data","sdpMLineIndex":0}`), false)
+	stats = tr.Stats()
+	assert.Equal(t, GatheringTrickle, stats.GatheringMode, "Individual candidate messages mean trickle")
+	assert.Equal(t, 1, stats.RemoteCandidates)
+	assert.Equal(t, 0, stats.LocalCandidates)
+}
+
+func TestStatsPairTypes(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.statsTracker.track([]byte(srflxCandidate), true)
+	tr.statsTracker.track([]byte(`{"candidate":"candidate:1 1 udp 2122260223 192.168.1.161 55286 typ host generation 0","sdpMid":"data","sdpMLineIndex":0}`), false)
+	assert.Equal(t, "", tr.Stats().LocalType, "Pair types unknown before FiveTuple")
+
+	tr.fiveTupleOut = &FiveTuple{Proto: UDP, Local: "203.0.113.7:55285", Remote: "192.168.1.161:55286"}
+	stats := tr.Stats()
+	assert.Equal(t, "srflx", stats.LocalType)
+	assert.Equal(t, "host", stats.RemoteType)
+}
+
+func TestStatsTimings(t *testing.T) {
+	tr := newTraversal(0, nil)
+	assert.Equal(t, Timings{}, tr.Stats().Timings, "Nothing reached yet")
+
+	start := time.Now()
+	st := &tr.statsTracker
+	st.reached[milestoneStarted] = start
+	st.reached[milestoneProcessStarted] = start.Add(100 * time.Millisecond)
+	st.reached[milestoneFirstRemote] = start.Add(500 * time.Millisecond)
+	gathered := start.Add(1 * time.Second)
+	assert.Equal(t, Timings{
+		ProcessStart: 100 * time.Millisecond,
+		Gathering:    900 * time.Millisecond,
+		PeerWait:     500 * time.Millisecond,
+	}, st.timings(gathered), "Checks and total only once reached")
+
+	st.reached[milestoneFiveTuple] = start.Add(1500 * time.Millisecond)
+	st.reached[milestoneFinished] = start.Add(1600 * time.Millisecond)
+	tm := st.timings(gathered)
+	assert.Equal(t, 500*time.Millisecond, tm.Checks, "Checks should count from when gathering finished, since peer was heard from earlier")
+	assert.Equal(t, 1600*time.Millisecond, tm.Total)
+
+	st.mark(milestoneStarted)
+	assert.Equal(t, start, st.reached[milestoneStarted], "Milestones should only be marked once")
+}
+
+func TestTraceWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	tr := newTraversal(0, []Option{WithTraceWriter(out)})
+	tr.initChannels()
+	tr.stderr = ioutil.NopCloser(strings.NewReader("natty debug output\n"))
+	tr.iowg.Add(1)
+	tr.processStderr()
+	assert.Equal(t, "natty debug output\n", out.String(), "natty's output should go to trace writer")
+	assert.NoError(t, <-tr.errCh)
+
+	failing := newTraversal(0, []Option{WithTraceWriter(failingWriter{})})
+	failing.initChannels()
+	failing.stderr = ioutil.NopCloser(strings.NewReader("natty debug output\n"))
+	failing.iowg.Add(1)
+	failing.processStderr()
+	assert.NoError(t, <-failing.errCh, "Failing trace writer shouldn't fail the traversal")
+
+	closed := &bytes.Buffer{}
+	tr = newTraversal(0, []Option{WithTraceWriter(closed)})
+	tr.initChannels()
+	tr.stderr = ioutil.NopCloser(strings.NewReader("natty debug output\n"))
+	tr.Close()
+	tr.iowg.Add(1)
+	tr.processStderr()
+	assert.Empty(t, closed.String(), "Nothing should go to trace writer once closed")
+}
+
+type failingWriter struct{}
+
+func (w failingWriter) Write(b []byte) (int, error) {
+	return 0, fmt.Errorf("Failing")
+}
+
+// TestWaitForFiveTuple makes sure that the loop that waits for the result
+// forwards the peer's messages to natty and only returns once both we and the
+// peer have a FiveTuple, whichever comes first.
+func TestWaitForFiveTuple(t *testing.T) {
+	for _, peerFirst := range []bool{false, true} {
+		tr := newTraversal(0, nil)
+		tr.initChannels()
+		stdin := &bytes.Buffer{}
+		tr.stdin = nopWriteCloser{stdin}
+		ft := &FiveTuple{Proto: UDP, Local: "127.0.0.1:1", Remote: "127.0.0.1:2"}
+		peerFiveTuple := `{"type":"5-tuple","proto":"udp"}`
+
+		tr.msgInCh <- []byte(`{"type":"offer"}`)
+		if peerFirst {
+			tr.msgInCh <- []byte(peerFiveTuple)
+			tr.fiveTupleCh <- ft
+		} else {
+			tr.fiveTupleCh <- ft
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				// Errors don't matter once we have our FiveTuple
+				tr.errCh <- fmt.Errorf("Too late")
+				tr.msgInCh <- []byte(peerFiveTuple)
+			}()
+		}
+		result, err := tr.waitForFiveTuple()
+		if assert.NoError(t, err) {
+			assert.Equal(t, ft, result)
+		}
+		assert.Equal(t, "{\"type\":\"offer\"}\n", stdin.String(), "Should forward only the peer's offer to natty")
+	}
+}
+
+// TestMsgInAfterFinish makes sure that passing messages to a Traversal whose
+// natty has stopped doesn't block, even once the buffer would be full.
+func TestMsgInAfterFinish(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	close(tr.finishedCh)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2*cap(tr.msgInCh); i++ {
+			tr.MsgIn(`{"type":"candidate"}`)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("MsgIn blocked")
+	}
+}
+
+// TestIdleGoroutines makes sure that Traversals waiting for their peer use at
+// most two goroutines each (three if natty's output is traced).
+func TestIdleGoroutines(t *testing.T) {
+	perTraversal := 2
+	if log.IsTraceEnabled() {
+		perTraversal++
+	}
+	before := runtime.NumGoroutine()
+	traversals := startIdleTraversals(20)
+	defer closeTraversals(traversals)
+	started := runtime.NumGoroutine() - before
+	assert.True(t, started <= len(traversals)*perTraversal, fmt.Sprintf("Started %d goroutines for %d traversals", started, len(traversals)))
+}
+
+// TestCloseReapsNatty makes sure that closing Traversals leaves behind neither
+// natty processes nor goroutines, and unblocks NextMsgOut.
+func TestCloseReapsNatty(t *testing.T) {
+	defer checkGoroutineLeaks(t)()
+	for i := 0; i < 20; i++ {
+		tr := Offer(0)
+		done := make(chan bool)
+		go func() {
+			for {
+				_, isDone := tr.NextMsgOut()
+				if isDone {
+					close(done)
+					return
+				}
+			}
+		}()
+		assert.NoError(t, tr.Close())
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close should have unblocked NextMsgOut")
+		}
+		tr.cmdMutex.Lock()
+		if tr.cmd != nil && tr.cmd.Process != nil {
+			assert.NotNil(t, tr.cmd.ProcessState, "natty should have been reaped")
+		}
+		tr.cmdMutex.Unlock()
+		_, isDone := tr.NextMsgOut()
+		assert.True(t, isDone, "NextMsgOut should be done once closed")
+	}
+}
+
+// TestCloseLeaksNothing makes sure that many Traversals, each of which gets as
+// far as running natty, leave behind neither natty processes nor goroutines
+// once closed.
+func TestCloseLeaksNothing(t *testing.T) {
+	binary, remove := sleepingNatty(t)
+	defer remove()
+
+	defer checkGoroutineLeaks(t)()
+	for i := 0; i < 100; i++ {
+		tr := Offer(0, WithBinary(binary))
+		msgOut := tr.MsgOutChan()
+		assert.NotEqual(t, 0, nattyPid(tr), "natty should have started")
+		done := make(chan bool)
+		go func() {
+			for {
+				_, isDone := tr.NextMsgOut()
+				if isDone {
+					close(done)
+					return
+				}
+			}
+		}()
+		assert.NoError(t, tr.Close())
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close should have unblocked NextMsgOut")
+		}
+		for range msgOut {
+			// MsgOutChan should be closed
+		}
+		tr.cmdMutex.Lock()
+		if tr.cmd != nil && tr.cmd.Process != nil {
+			assert.NotNil(t, tr.cmd.ProcessState, "natty should have been reaped")
+		}
+		tr.cmdMutex.Unlock()
+	}
+}
+
+// checkGoroutineLeaks counts the running goroutines, returning a func that
+// fails t if there are more once the goroutines that were started since have
+// had a moment to return.
+func checkGoroutineLeaks(t *testing.T) func() {
+	before := runtime.NumGoroutine()
+	return func() {
+		leaked := 0
+		for i := 0; i < 50; i++ {
+			leaked = runtime.NumGoroutine() - before
+			if leaked <= 0 {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Errorf("Leaked %d goroutines", leaked)
+	}
+}
+
+// sleepingNatty writes a stand-in for natty that does nothing but sleep,
+// except list the flags that this package may pass natty when run with -help,
+// returning its path and a func that removes it.
+func sleepingNatty(t *testing.T) (string, func()) {
+	return scriptedNatty(t, "exec sleep 30", nattyTestFlags...)
+}
+
+// nattyTestFlags are all the flags that this package may pass natty.
+var nattyTestFlags = []string{"debug", "offer", "stuns", "software", "ipversion", "dscp", "relayport", "turn", "device", "localports", "transport", "handoff", "localip"}
+
+// scriptedNatty writes a stand-in for natty that lists the given flags when run
+// with -help and otherwise runs the given shell commands, returning its path
+// and a func that removes it.
+func scriptedNatty(t *testing.T, commands string, flags ...string) (string, func()) {
+	dir, err := ioutil.TempDir("", "natty")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	script := "#!/bin/sh\nif [ \"$1\" = -help ]; then\n"
+	for _, flag := range flags {
+		script += fmt.Sprintf("  echo '  --%s (Fake flag)  type: string  default: '\n", flag)
+	}
+	script += "  exit 0\nfi\n" + commands + "\n"
+	binary := filepath.Join(dir, "natty")
+	err = ioutil.WriteFile(binary, []byte(script), 0755)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Unable to write natty: %s", err)
+	}
+	return binary, func() { os.RemoveAll(dir) }
+}
+
+// skipUnlessNattySupports skips tests that run the real natty if it doesn't
+// accept all the given flags.
+func skipUnlessNattySupports(t *testing.T, flags ...string) {
+	tr := newTraversal(0, nil)
+	for _, flag := range flags {
+		supported, err := tr.nattySupports(flag)
+		if err != nil {
+			t.Fatalf("Unable to list natty's flags: %s", err)
+		}
+		if !supported {
+			t.Skipf("natty doesn't accept -%s", flag)
+		}
+	}
+}
+
+// nattyPid waits for the Traversal's natty to start and returns its pid, or 0
+// if it doesn't start within 5 seconds.
+func nattyPid(tr *Traversal) int {
+	for i := 0; i < 250; i++ {
+		pid := 0
+		tr.cmdMutex.Lock()
+		if tr.cmd != nil && tr.cmd.Process != nil {
+			pid = tr.cmd.Process.Pid
+		}
+		tr.cmdMutex.Unlock()
+		if pid != 0 {
+			return pid
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return 0
+}
+
+func TestNattyKilled(t *testing.T) {
+	binary, remove := sleepingNatty(t)
+	defer remove()
+
+	tr := Offer(0, WithBinary(binary))
+	defer tr.Close()
+	pid := nattyPid(tr)
+	if !assert.NotEqual(t, 0, pid, "natty should have started") {
+		return
+	}
+
+	errCh := make(chan error)
+	go func() {
+		_, err := tr.FiveTuple()
+		errCh <- err
+	}()
+	doneCh := make(chan bool)
+	go func() {
+		for {
+			_, done := tr.NextMsgOut()
+			if done {
+				close(doneCh)
+				return
+			}
+		}
+	}()
+	process, err := os.FindProcess(pid)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, process.Kill())
+
+	select {
+	case err := <-errCh:
+		var processErr *ProcessError
+		assert.True(t, errors.As(err, &processErr), "natty dying should fail the Traversal with a ProcessError, not %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("natty dying should have unblocked FiveTuple")
+	}
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatal("natty dying should have unblocked NextMsgOut")
+	}
+	assert.Equal(t, StateFailed, tr.CurrentState())
+}
+
+// BenchmarkIdleTraversal reports how many goroutines and how much memory
+// Traversals that are waiting for their peer cost.
+func BenchmarkIdleTraversal(b *testing.B) {
+	var goroutines, heap, stack float64
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		beforeGoroutines := runtime.NumGoroutine()
+		traversals := startIdleTraversals(20)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		goroutines += float64(runtime.NumGoroutine()-beforeGoroutines) / float64(len(traversals))
+		heap += (float64(after.HeapAlloc) - float64(before.HeapAlloc)) / float64(len(traversals))
+		stack += (float64(after.StackInuse) - float64(before.StackInuse)) / float64(len(traversals))
+		closeTraversals(traversals)
+	}
+	b.ReportMetric(goroutines/float64(b.N), "goroutines/traversal")
+	b.ReportMetric(heap/float64(b.N), "heap-B/traversal")
+	b.ReportMetric(stack/float64(b.N), "stack-B/traversal")
+}
+
+// startIdleTraversals starts n Answerers, which sit waiting for an offer, and
+// gives natty time to start.
+func startIdleTraversals(n int) []*Traversal {
+	traversals := make([]*Traversal, n)
+	for i := range traversals {
+		traversals[i] = Answer(0)
+	}
+	time.Sleep(200 * time.Millisecond)
+	return traversals
+}
+
+func closeTraversals(traversals []*Traversal) {
+	for _, tr := range traversals {
+		tr.Close()
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (w nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,300 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/getlantern/go-natty/natty/stun"
+)
+
+// natTestTimeout is how long Traversal.NATType waits for each response to the
+// tests of DetectNATType.
+var natTestTimeout = 500 * time.Millisecond
+
+// NATType is the type of NAT that DetectNATType found, as classified by RFC
+// 3489.
+type NATType int
+
+const (
+	// NATUnknown means that the type couldn't be determined.
+	NATUnknown NATType = iota
+
+	// NATBlocked means that UDP is blocked, or the STUN server is down.
+	NATBlocked
+
+	// NATNone means that there's no NAT nor firewall (the open internet).
+	NATNone
+
+	// NATSymmetricFirewall means that there's no NAT, but a firewall that
+	// only lets in responses from where we sent to.
+	NATSymmetricFirewall
+
+	// NATFullCone means that the NAT maps a local address to the same public
+	// address for every destination, and lets in packets from anywhere.
+	NATFullCone
+
+	// NATRestrictedCone is like NATFullCone, except that the NAT only lets in
+	// packets from IPs that we sent to.
+	NATRestrictedCone
+
+	// NATPortRestrictedCone is like NATRestrictedCone, except that the NAT
+	// only lets in packets from the very IP and port that we sent to.
+	NATPortRestrictedCone
+
+	// NATSymmetric means that the NAT maps a local address to a different
+	// public address for every destination, which defeats hole punching
+	// unless the peer's NAT is friendly.
+	NATSymmetric
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATUnknown:
+		return "unknown"
+	case NATBlocked:
+		return "blocked"
+	case NATNone:
+		return "none"
+	case NATSymmetricFirewall:
+		return "symmetric firewall"
+	case NATFullCone:
+		return "full cone"
+	case NATRestrictedCone:
+		return "restricted cone"
+	case NATPortRestrictedCone:
+		return "port restricted cone"
+	case NATSymmetric:
+		return "symmetric"
+	default:
+		return fmt.Sprintf("NATType(%d)", int(t))
+	}
+}
+
+// DetectNATType determines the type of NAT that we're behind with the classic
+// test of RFC 3489 section 10.1, which asks the STUN server at
+// [stun:]host:port to respond from its alternate IP and port. This needs a
+// server that supports RFC 3489's CHANGE-REQUEST (or RFC 5780's), which many
+// public ones, meant for ICE, don't. timeout is how long to wait for each of
+// up to four responses, some of which may rightly never come. It's a
+// diagnostic for IPv4 that's separate from Traversals.
+func DetectNATType(stunServer string, timeout time.Duration) (NATType, error) {
+	server, err := net.ResolveUDPAddr("udp4", strings.TrimPrefix(stunServer, "stun:"))
+	if err != nil {
+		return NATUnknown, fmt.Errorf("Unable to resolve STUN server %s: %s", stunServer, err)
+	}
+	// Bind to the IP that we reach the server from, rather than the
+	// unspecified one, so that the mapped address is comparable to ours
+	route, err := net.DialUDP("udp4", nil, server)
+	if err != nil {
+		return NATUnknown, fmt.Errorf("Unable to find route to STUN server %s: %s", stunServer, err)
+	}
+	localIP := route.LocalAddr().(*net.UDPAddr).IP
+	route.Close()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		return NATUnknown, fmt.Errorf("Unable to listen for STUN responses: %s", err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	// Test I: what's our address?
+	resp, _, err := natTest(conn, server, 0, timeout)
+	if err != nil {
+		return NATUnknown, err
+	}
+	if resp == nil {
+		return NATBlocked, nil
+	}
+	mapped := resp.Mapped
+	if !mapped.IsValid() {
+		return NATUnknown, fmt.Errorf("STUN server %s didn't say what our address is", stunServer)
+	}
+	alternate := resp.Other
+
+	// Test II: do packets from anywhere get in?
+	resp, from, err := natTest(conn, server, stun.ChangeIP|stun.ChangePort, timeout)
+	if err != nil {
+		return NATUnknown, err
+	}
+	if resp != nil && sameAddrPort(from.AddrPort(), server.AddrPort()) {
+		return NATUnknown, fmt.Errorf("STUN server %s ignored the request to change its address", stunServer)
+	}
+	fromAnywhere := resp != nil
+	if sameAddrPort(mapped, local) {
+		if fromAnywhere {
+			return NATNone, nil
+		}
+		return NATSymmetricFirewall, nil
+	}
+	if fromAnywhere {
+		return NATFullCone, nil
+	}
+
+	// Test I again, at the alternate address: is our address the same?
+	if !alternate.IsValid() {
+		return NATUnknown, fmt.Errorf("STUN server %s doesn't have an alternate address", stunServer)
+	}
+	resp, _, err = natTest(conn, net.UDPAddrFromAddrPort(alternate), 0, timeout)
+	if err != nil {
+		return NATUnknown, err
+	}
+	if resp == nil {
+		return NATUnknown, fmt.Errorf("STUN server %s didn't respond at its alternate address %s", stunServer, alternate)
+	}
+	if !sameAddrPort(resp.Mapped, mapped) {
+		return NATSymmetric, nil
+	}
+
+	// Test III: do packets from another port of the same IP get in?
+	resp, from, err = natTest(conn, server, stun.ChangePort, timeout)
+	if err != nil {
+		return NATUnknown, err
+	}
+	if resp == nil {
+		return NATPortRestrictedCone, nil
+	}
+	if sameAddrPort(from.AddrPort(), server.AddrPort()) {
+		return NATUnknown, fmt.Errorf("STUN server %s ignored the request to change its port", stunServer)
+	}
+	return NATRestrictedCone, nil
+}
+
+// NATType tells what kind of NAT the Traversal is behind, once gathering has
+// finished (see WaitGathering). It starts from the IPv4 UDP candidates that
+// natty gathered: no server reflexive candidates mean NATNone if there's a
+// host candidate with a public IP, and NATBlocked otherwise, and server
+// reflexive candidates from several STUN servers with different addresses for
+// the same local one mean NATSymmetric. The candidates can't tell which kind of
+// cone NAT it is, nor, with a single STUN server (see WithSTUNServers), whether
+// it's a cone NAT at all, so then NATType runs DetectNATType against the
+// Traversal's STUN servers in turn, which takes a few seconds, until one of
+// them supports it. If none does, it returns NATUnknown with an error that
+// says why.
+func (t *Traversal) NATType() (NATType, error) {
+	select {
+	case <-t.gathering.finished():
+	default:
+		return NATUnknown, fmt.Errorf("Unable to tell NAT type before gathering has finished")
+	}
+	candidates, err := t.gathering.result()
+	if err != nil {
+		return NATUnknown, err
+	}
+
+	mapped := make(map[string]map[string]bool) // srflx addresses by base
+	public := false
+	for _, c := range candidates {
+		host, _, err := net.SplitHostPort(c.Address)
+		if err != nil || c.Protocol != "udp" {
+			continue
+		}
+		ip := net.ParseIP(host).To4()
+		if ip == nil {
+			continue
+		}
+		switch c.Type {
+		case "host":
+			public = public || ip.IsGlobalUnicast() && !ip.IsPrivate()
+		case "srflx":
+			if mapped[c.RelatedAddress] == nil {
+				mapped[c.RelatedAddress] = make(map[string]bool)
+			}
+			mapped[c.RelatedAddress][c.Address] = true
+		}
+	}
+	if len(mapped) == 0 {
+		if public {
+			return NATNone, nil
+		}
+		return NATBlocked, nil
+	}
+	for _, addrs := range mapped {
+		if len(addrs) > 1 {
+			return NATSymmetric, nil
+		}
+	}
+	return t.detectNATType()
+}
+
+// detectNATType runs DetectNATType against the Traversal's STUN servers in
+// turn, returning the result of the first one that supports it.
+func (t *Traversal) detectNATType() (NATType, error) {
+	stunServers := t.stunServers
+	if len(stunServers) == 0 {
+		stunServers = DefaultSTUNServers
+	}
+	var err error
+	for _, server := range stunServers {
+		var natType NATType
+		natType, err = DetectNATType(server, natTestTimeout)
+		if err == nil && natType == NATBlocked {
+			// natty got through to it, so it's the server that didn't respond
+			err = fmt.Errorf("STUN server %s didn't respond", server)
+		}
+		if err == nil {
+			return natType, nil
+		}
+		t.log().Tracef("Unable to detect NAT type: %s", err)
+	}
+	return NATUnknown, fmt.Errorf("Unable to tell NAT type beyond what the candidates reveal: %s", err)
+}
+
+// natTest sends a binding request with the given CHANGE-REQUEST flags to
+// server, retransmitting it until timeout, and returns the response and where
+// it came from, which may be anywhere, or a nil response if none came.
+func natTest(conn *net.UDPConn, server *net.UDPAddr, change uint32, timeout time.Duration) (*stun.Response, *net.UDPAddr, error) {
+	tx, err := stun.NewTransaction()
+	if err != nil {
+		return nil, nil, err
+	}
+	req := tx.Request()
+	if change != 0 {
+		req = tx.ChangeRequest(change)
+	}
+	deadline := time.Now().Add(timeout)
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 1500)
+	for _, wait := range stun.Timeouts(stun.DefaultRTO) {
+		_, err := conn.WriteToUDP(req, server)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to send binding request to %s: %s", server, err)
+		}
+		waitUntil := time.Now().Add(wait)
+		if waitUntil.After(deadline) {
+			waitUntil = deadline
+		}
+		conn.SetReadDeadline(waitUntil)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, nil, fmt.Errorf("Unable to read response from %s: %s", server, err)
+			}
+			resp, err := tx.Match(buf[:n])
+			if err != nil {
+				return nil, nil, fmt.Errorf("Unable to test NAT with %s: %s", server, err)
+			}
+			if resp == nil {
+				// Some other traffic, or a response to an earlier test
+				continue
+			}
+			return resp, from, nil
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+	}
+	return nil, nil, nil
+}
+
+// sameAddrPort tells whether a and b are the same valid address, regardless of
+// how IPv4 is represented.
+func sameAddrPort(a netip.AddrPort, b netip.AddrPort) bool {
+	return a.IsValid() && b.IsValid() && a.Addr().Unmap() == b.Addr().Unmap() && a.Port() == b.Port()
+}
@@ -0,0 +1,215 @@
+package natty
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/go-natty/natty/stun"
+	"github.com/getlantern/testify/assert"
+)
+
+// mockNAT says how the fake NAT in front of the client maps its address and
+// which responses it lets in.
+type mockNAT struct {
+	// mapped returns the client's port as the server at the given socket sees
+	// it
+	mapped func(port int, server int) int
+	// allow says whether a response from socket from to a request to socket to
+	// gets in
+	allow func(from int, to int) bool
+}
+
+var (
+	noMapping        = func(port int, server int) int { return port }
+	coneMapping      = func(port int, server int) int { return port + 1 }
+	symmetricMapping = func(port int, server int) int { return port + 1 + server }
+	allowAll         = func(from int, to int) bool { return true }
+	allowSameIP      = func(from int, to int) bool { return from/2 == to/2 }
+	allowSameAddr    = func(from int, to int) bool { return from == to }
+)
+
+const (
+	stunAttrChangeRequest  = 0x0003
+	stunAttrChangedAddress = 0x0005
+)
+
+// serveMockSTUN runs an RFC 3489 STUN server behind the given mockNAT, with
+// sockets 0 and 1 on one IP and sockets 2 and 3 on another, and returns the
+// address of socket 0 and a func that stops the server. Unless alternate, it
+// doesn't tell its alternate address.
+func serveMockSTUN(nat mockNAT, alternate bool) (string, func(), error) {
+	var conns []*net.UDPConn
+	stop := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	for _, ip := range []string{"127.0.0.1", "127.0.0.1", "127.0.0.2", "127.0.0.2"} {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(ip)})
+		if err != nil {
+			stop()
+			return "", nil, err
+		}
+		conns = append(conns, conn)
+	}
+	other := conns[3].LocalAddr().(*net.UDPAddr)
+	for i, conn := range conns {
+		go func(i int, conn *net.UDPConn) {
+			buf := make([]byte, 1500)
+			for {
+				n, from, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				req, err := parseSTUN(buf[:n])
+				if err != nil {
+					continue
+				}
+				respondFrom := i
+				if change, ok := req.getUint32(stunAttrChangeRequest); ok {
+					respondFrom ^= int(change&stun.ChangeIP) >> 1
+					respondFrom ^= int(change&stun.ChangePort) >> 1
+				}
+				if !nat.allow(respondFrom, i) {
+					continue
+				}
+				mapped := &net.UDPAddr{IP: from.IP, Port: nat.mapped(from.Port, i)}
+				resp := req.reply(req.typ|0x0100).
+					addAddr(stunAttrXorMappedAddress, mapped)
+				if alternate {
+					resp.add(stunAttrChangedAddress, plainAddrValue(other))
+				}
+				conns[respondFrom].WriteToUDP(resp.encode(nil), from)
+			}
+		}(i, conn)
+	}
+	return "stun:" + conns[0].LocalAddr().String(), stop, nil
+}
+
+func plainAddrValue(addr *net.UDPAddr) []byte {
+	b := make([]byte, 8)
+	b[1] = 0x01
+	b[2], b[3] = byte(addr.Port>>8), byte(addr.Port)
+	copy(b[4:], addr.IP.To4())
+	return b
+}
+
+func TestDetectNATType(t *testing.T) {
+	tests := []struct {
+		nat      mockNAT
+		expected NATType
+	}{
+		{mockNAT{noMapping, allowAll}, NATNone},
+		{mockNAT{noMapping, allowSameAddr}, NATSymmetricFirewall},
+		{mockNAT{coneMapping, allowAll}, NATFullCone},
+		{mockNAT{coneMapping, allowSameIP}, NATRestrictedCone},
+		{mockNAT{coneMapping, allowSameAddr}, NATPortRestrictedCone},
+		{mockNAT{symmetricMapping, allowSameAddr}, NATSymmetric},
+	}
+	for _, test := range tests {
+		server, stop, err := serveMockSTUN(test.nat, true)
+		if err != nil {
+			t.Skipf("Unable to run mock STUN server: %s", err)
+		}
+		natType, err := DetectNATType(server, 300*time.Millisecond)
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.expected, natType, "Wrong NAT type, expected %s", test.expected)
+		}
+		stop()
+	}
+}
+
+func TestDetectNATTypeWithoutAlternate(t *testing.T) {
+	server, stop, err := serveMockSTUN(mockNAT{coneMapping, allowSameAddr}, false)
+	if err != nil {
+		t.Skipf("Unable to run mock STUN server: %s", err)
+	}
+	defer stop()
+	_, err = DetectNATType(server, 300*time.Millisecond)
+	assert.Error(t, err, "Telling cone from symmetric NAT should need the alternate address")
+
+	// Without filtering, the alternate address isn't needed
+	server, stop, err = serveMockSTUN(mockNAT{coneMapping, allowAll}, false)
+	if err != nil {
+		t.Skipf("Unable to run mock STUN server: %s", err)
+	}
+	defer stop()
+	natType, err := DetectNATType(server, 300*time.Millisecond)
+	if assert.NoError(t, err) {
+		assert.Equal(t, NATFullCone, natType)
+	}
+}
+
+func TestDetectNATTypeBlocked(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	natType, err := DetectNATType(conn.LocalAddr().String(), 300*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, NATBlocked, natType, "Server that never responds should mean NATBlocked")
+}
+
+func TestTraversalNATType(t *testing.T) {
+	const (
+		host       = "a=candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host"
+		publicHost = "a=candidate:1 1 udp 2122260223 203.0.113.9 55285 typ host"
+		srflx1     = "a=candidate:2 1 udp 1686052607 203.0.113.7 55285 typ srflx raddr 192.168.1.160 rport 55285"
+		srflx2     = "a=candidate:3 1 udp 1686052607 203.0.113.7 61000 typ srflx raddr 192.168.1.160 rport 55285"
+		ipv6Host   = "a=candidate:4 1 udp 2122262783 2001:db8::1 55286 typ host"
+	)
+	twoServers := WithSTUNServers([]string{"stun:192.0.2.1:3478", "stun:192.0.2.2:3478"})
+	tests := []struct {
+		opts       []Option
+		candidates []string
+		expected   NATType
+	}{
+		{nil, []string{host}, NATBlocked},
+		{nil, []string{publicHost, ipv6Host}, NATNone},
+		{nil, []string{host, ipv6Host}, NATBlocked},
+		{[]Option{twoServers}, []string{host, srflx1, srflx2}, NATSymmetric},
+		{nil, []string{host, srflx1, srflx2}, NATSymmetric},
+	}
+	for _, test := range tests {
+		tr := newTraversal(0, test.opts)
+		for _, c := range test.candidates {
+			tr.gathering.add(c)
+		}
+		tr.gathering.finish(nil)
+		natType, err := tr.NATType()
+		if assert.NoError(t, err, "%v", test.candidates) {
+			assert.Equal(t, test.expected, natType, "Wrong NAT type for %v", test.candidates)
+		}
+	}
+
+	tr := newTraversal(0, nil)
+	_, err := tr.NATType()
+	assert.Error(t, err, "NAT type should need gathering to have finished")
+
+	// Cone NATs take DetectNATType
+	natTestTimeout = 100 * time.Millisecond
+	defer func() { natTestTimeout = 500 * time.Millisecond }()
+	server, stop, err := serveMockSTUN(mockNAT{coneMapping, allowSameAddr}, true)
+	if err != nil {
+		t.Skipf("Unable to run mock STUN server: %s", err)
+	}
+	defer stop()
+	tr = newTraversal(0, []Option{WithSTUNServers([]string{"stun:192.0.2.1:3478", server})})
+	tr.gathering.add(host)
+	tr.gathering.add(srflx1)
+	tr.gathering.finish(nil)
+	natType, err := tr.NATType()
+	if assert.NoError(t, err, "Should fall back to the STUN server that supports DetectNATType") {
+		assert.Equal(t, NATPortRestrictedCone, natType)
+	}
+
+	tr = newTraversal(0, []Option{twoServers})
+	tr.gathering.add(host)
+	tr.gathering.add(srflx1)
+	tr.gathering.finish(nil)
+	natType, err = tr.NATType()
+	assert.Error(t, err, "NATType shouldn't tell which kind of cone NAT it is without a STUN server that supports DetectNATType")
+	assert.Equal(t, NATUnknown, natType)
+}
@@ -0,0 +1,96 @@
+package natty
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// networkPollInterval is how frequently the network monitor checks whether
+	// the Traversal has been closed and, on platforms without change
+	// notifications, how often it re-checks the network interfaces.
+	networkPollInterval = 2 * time.Second
+)
+
+// networkWatcher waits for notifications from the OS that something about the
+// network configuration may have changed.
+type networkWatcher interface {
+	// wait blocks until a change may have happened, in which case it returns
+	// true, or until a short interval elapses without any change, in which
+	// case it returns false.
+	wait() (bool, error)
+
+	close() error
+}
+
+// monitorNetwork watches for changes to the set of usable network interfaces
+// until the Traversal is closed, invoking onNetworkChange whenever that set
+// changes.
+func (t *Traversal) monitorNetwork() {
+	w, err := newNetworkWatcher()
+	if err != nil {
+		t.log().Errorf("Unable to monitor network: %s", err)
+		return
+	}
+	defer w.close()
+
+	last := usableInterfaces()
+	t.log().Tracef("Monitoring network, usable interfaces: %s", last)
+	for {
+		select {
+		case <-t.closedCh:
+			t.log().Trace("Traversal closed, done monitoring network")
+			return
+		default:
+		}
+
+		changed, err := w.wait()
+		if err != nil {
+			t.log().Errorf("Error monitoring network: %s", err)
+			return
+		}
+		if !changed {
+			continue
+		}
+
+		current := usableInterfaces()
+		if current == last {
+			continue
+		}
+		t.log().Tracef("Usable interfaces changed from %s to %s", last, current)
+		last = current
+		if t.onNetworkChange != nil {
+			t.onNetworkChange()
+		}
+	}
+}
+
+// usableInterfaces returns a canonical description of the network interfaces
+// that are up, aren't loopback and have at least one address.
+func usableInterfaces() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Tracef("Unable to list network interfaces: %s", err)
+		return ""
+	}
+	usable := make([]string, 0, len(ifaces))
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		addrStrings := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			addrStrings = append(addrStrings, addr.String())
+		}
+		sort.Strings(addrStrings)
+		usable = append(usable, iface.Name+"="+strings.Join(addrStrings, ","))
+	}
+	sort.Strings(usable)
+	return strings.Join(usable, " ")
+}
@@ -0,0 +1,61 @@
+package natty
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	// Multicast groups for netlink route notifications, from
+	// linux/rtnetlink.h (not exported by package syscall).
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// netlinkWatcher listens for link and address changes using a netlink route
+// socket.
+type netlinkWatcher struct {
+	fd  int
+	buf []byte
+}
+
+func newNetworkWatcher() (networkWatcher, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open netlink socket: %s", err)
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	err = syscall.Bind(fd, sa)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Unable to bind netlink socket: %s", err)
+	}
+	// Time out reads periodically so that the monitor can notice when the
+	// Traversal has been closed.
+	tv := syscall.NsecToTimeval(networkPollInterval.Nanoseconds())
+	err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Unable to set timeout on netlink socket: %s", err)
+	}
+	return &netlinkWatcher{fd: fd, buf: make([]byte, syscall.Getpagesize())}, nil
+}
+
+func (w *netlinkWatcher) wait() (bool, error) {
+	_, _, err := syscall.Recvfrom(w.fd, w.buf, 0)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to read from netlink socket: %s", err)
+	}
+	return true, nil
+}
+
+func (w *netlinkWatcher) close() error {
+	return syscall.Close(w.fd)
+}
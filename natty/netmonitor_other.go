@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package natty
+
+import (
+	"time"
+)
+
+// pollingWatcher is used on platforms where we don't listen for notifications
+// from the OS. It simply reports a potential change every networkPollInterval
+// so that the monitor re-checks the interfaces.
+type pollingWatcher struct{}
+
+func newNetworkWatcher() (networkWatcher, error) {
+	return &pollingWatcher{}, nil
+}
+
+func (w *pollingWatcher) wait() (bool, error) {
+	time.Sleep(networkPollInterval)
+	return true, nil
+}
+
+func (w *pollingWatcher) close() error {
+	return nil
+}
@@ -0,0 +1,579 @@
+package natty
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxSoftwareChars is the maximum number of characters allowed in a STUN
+	// SOFTWARE attribute (RFC 5389 section 15.10).
+	maxSoftwareChars = 127
+
+	// maxSoftwareBytes is the maximum number of bytes allowed in a STUN
+	// SOFTWARE attribute (RFC 5389 section 15.10).
+	maxSoftwareBytes = 763
+
+	// defaultOutBufferSize is how many outbound messages are buffered by
+	// default.
+	defaultOutBufferSize = 100
+)
+
+const (
+	// OverflowBlock makes natty wait until the consumer reads messages from
+	// NextMsgOut (or the Traversal is closed) once the outbound buffer is full.
+	OverflowBlock = OverflowPolicy(iota)
+
+	// OverflowDrop drops outbound messages once the outbound buffer is full,
+	// which keeps natty running but will typically cause the traversal to fail.
+	OverflowDrop
+)
+
+var (
+	// DefaultSTUNServers are the STUN servers that natty uses when none are
+	// specified with WithSTUNServers.
+	DefaultSTUNServers = []string{"stun:stun.l.google.com:19302"}
+
+	// DefaultSoftwareAttribute is the STUN SOFTWARE attribute used when none
+	// is specified with WithSoftwareAttribute.
+	DefaultSoftwareAttribute = "go-natty/" + Version
+)
+
+const (
+	// IPAny gathers candidates for both IPv4 and IPv6 (dual-stack).
+	IPAny = IPVersion(0)
+
+	// IPv4 gathers only IPv4 candidates.
+	IPv4 = IPVersion(4)
+
+	// IPv6 gathers only IPv6 candidates.
+	IPv6 = IPVersion(6)
+)
+
+// IPVersion identifies which IP version(s) a Traversal uses.
+type IPVersion int
+
+func (v IPVersion) String() string {
+	if v == IPAny {
+		return "any"
+	}
+	return fmt.Sprintf("%d", int(v))
+}
+
+// ParseIPVersion parses an IPVersion from "4", "6" or, for IPAny, "" or "any".
+func ParseIPVersion(s string) (IPVersion, error) {
+	switch s {
+	case "", "any":
+		return IPAny, nil
+	case "4":
+		return IPv4, nil
+	case "6":
+		return IPv6, nil
+	}
+	return IPAny, fmt.Errorf("Unknown IP version %s, should be 4, 6 or any", s)
+}
+
+const (
+	// debugDefault has natty log debug output if its output is going
+	// anywhere.
+	debugDefault = debugMode(iota)
+	debugOn
+	debugOff
+)
+
+// debugMode is whether natty logs debug output, per WithDebug.
+type debugMode int
+
+// OverflowPolicy determines what happens to outbound messages when the
+// consumer isn't reading them from NextMsgOut fast enough.
+type OverflowPolicy int
+
+// Option is a configuration option for a Traversal, passed to Offer() or
+// Answer().
+type Option func(t *Traversal)
+
+// WithTimeout sets how long the Traversal waits for a FiveTuple before
+// failing, in place of the timeout passed to Offer() or Answer(). 0 means that
+// it never times out.
+func WithTimeout(timeout time.Duration) Option {
+	return func(t *Traversal) {
+		t.timeout = timeout
+		t.timeoutSet = true
+	}
+}
+
+// WithLogger makes the Traversal log to the given Logger instead of the
+// package's default logger, like ContextWithLogger does for OfferContext and
+// AnswerContext, which take precedence. GologLogger adapts a golog.Logger.
+func WithLogger(logger Logger) Option {
+	return func(t *Traversal) {
+		t.useLogger(logger)
+	}
+}
+
+// WithDebug sets whether natty logs debug output. By default, it does if the
+// output is going somewhere, meaning that tracing is enabled for the package
+// or the Traversal has a Logger (see WithLogger) or trace writer (see
+// WithTraceWriter). With WithDebug(true), debug output that would otherwise
+// go nowhere goes to stderr. WithDebug(false) keeps natty quiet regardless,
+// which cuts the overhead of its logging.
+func WithDebug(enabled bool) Option {
+	return func(t *Traversal) {
+		t.debug = debugOff
+		if enabled {
+			t.debug = debugOn
+		}
+	}
+}
+
+// WithBinary makes the Traversal run the natty executable at the given path
+// instead of the one embedded in this package or set with SetBinaryPath, for
+// example one shipped separately in a container image. A path without a
+// separator is looked up in $PATH. If the executable doesn't exist or isn't
+// executable, the Traversal fails.
+func WithBinary(path string) Option {
+	return func(t *Traversal) {
+		t.binaryPath = path
+	}
+}
+
+// WithSoftwareAttribute sets the SOFTWARE attribute that natty includes in the
+// STUN and TURN requests that it sends, which allows server operators to
+// identify which client is connecting. Values longer than the limit imposed by
+// STUN are truncated. An empty value leaves the default in place. natty is
+// given the attribute with its -software flag, which the embedded natty doesn't
+// accept, so with it the Traversal fails with an error that unwraps to
+// ErrUnsupportedOption. Without this Option, natty executables that don't
+// accept -software just keep their own attribute.
+func WithSoftwareAttribute(software string) Option {
+	return func(t *Traversal) {
+		if software != "" {
+			t.software = truncateSoftware(software)
+		}
+	}
+}
+
+// truncateSoftware truncates the given software to fit within the length
+// limits of the STUN SOFTWARE attribute, without splitting characters.
+func truncateSoftware(software string) string {
+	chars := 0
+	for i := range software {
+		if chars == maxSoftwareChars {
+			return software[:i]
+		}
+		_, size := utf8.DecodeRuneInString(software[i:])
+		if i+size > maxSoftwareBytes {
+			return software[:i]
+		}
+		chars++
+	}
+	return software
+}
+
+// WithSTUNServers sets the STUN servers that natty uses to discover
+// server-reflexive candidates, in place of DefaultSTUNServers. Servers are given
+// as host:port, optionally prefixed with "stun:". The Traversal fails right
+// away if any of them isn't.
+func WithSTUNServers(servers []string) Option {
+	return func(t *Traversal) {
+		t.stunServers = servers
+	}
+}
+
+// WithDSCP sets the DSCP marking for the application's media, which is applied
+// to the application's conn with Traversal.MarkConn().
+func WithDSCP(dscp int) Option {
+	return func(t *Traversal) {
+		t.dscp = dscp
+	}
+}
+
+// WithControlDSCP sets the DSCP marking for control traffic, meaning the STUN
+// requests and connectivity checks sent by natty and the keepalives sent by a
+// ConnKeeper obtained from Traversal.NewConnKeeper(). This allows networks to
+// classify control traffic separately from the media marked per WithDSCP.
+//
+// After a successful traversal, control and media traffic share a single
+// socket, but DSCP marking is a property of the socket. The ConnKeeper
+// therefore switches the socket to the control marking just for the duration of
+// each keepalive and then back to the media marking, so application packets
+// sent concurrently with a keepalive may occasionally carry the control marking.
+//
+// natty marks its traffic per its -dscp flag, which the embedded natty doesn't
+// accept, so with it the Traversal always fails with an error that unwraps to
+// ErrUnsupportedOption. It needs a natty given with WithBinary or
+// SetBinaryPath that accepts -dscp.
+func WithControlDSCP(dscp int) Option {
+	return func(t *Traversal) {
+		t.controlDSCP = dscp
+	}
+}
+
+// WithIPVersion restricts the Traversal to candidates of the given IP version.
+// The default, IPAny, uses both IPv4 and IPv6. The Traversal drops the
+// candidates of the other version from the messages that it exchanges with
+// the peer, so this works with any natty, including the embedded one, which
+// doesn't accept -ipversion and so still gathers candidates of both.
+func WithIPVersion(version IPVersion) Option {
+	return func(t *Traversal) {
+		t.ipVersion = version
+	}
+}
+
+// WithIPPreference makes the Traversal prefer pairs of the given IP version
+// while still gathering candidates of both (see WithIPVersion), falling back
+// to the other version if no pair of the preferred one works. It raises the
+// priorities of our candidates of that version over those of the other
+// version with the same type, so a host candidate of either version still
+// beats a relayed one. Like with WithPriorityOverride, both peers should
+// prefer the same version to steer which pair wins. The default, IPAny,
+// leaves natty's priorities alone.
+func WithIPPreference(version IPVersion) Option {
+	return func(t *Traversal) {
+		t.ipPreference = version
+	}
+}
+
+// WithTransport sets which transport protocol(s) the Traversal uses. The
+// default, TransportUDP, only traverses over UDP. With TransportFallbackTCP,
+// TransportPreferTCP or TransportTCP, the FiveTuple's Proto may be TCP, in
+// which case its addresses are for TCP (see FiveTuple.TCPAddrs,
+// Traversal.DialTCP and Traversal.ListenTCP). TransportTCP can't be combined
+// with WithTurnAllocation or WithMappingKeeper, which only supply UDP
+// candidates. Anything other than TransportUDP needs a natty that accepts
+// -transport, which the embedded natty doesn't, so with it the Traversal
+// always fails with an error that unwraps to ErrUnsupportedOption (see
+// CheckTransport).
+func WithTransport(transport Transport) Option {
+	return func(t *Traversal) {
+		t.transport = transport
+	}
+}
+
+// WithWireFormat sets the format of the messages emitted by NextMsgOut. The
+// default is Negotiated, which starts out with V1 and upgrades once the peer
+// advertises a newer version. Binary produces much smaller messages, which
+// helps on bandwidth-constrained signaling channels. Binary messages are
+// marked with a leading version byte, which lets every Traversal accept both
+// formats in MsgIn, so peers using different formats interoperate. Use V1 to
+// keep emitting exactly what older releases expect.
+func WithWireFormat(format WireFormat) Option {
+	return func(t *Traversal) {
+		t.wireFormat = format
+	}
+}
+
+// WithNetworkMonitor enables or disables watching for changes to the set of
+// usable network interfaces (for example when a mobile device roams from WiFi
+// to cellular) for the lifetime of the Traversal. Changes are reported to the
+// callback set with WithNetworkChange.
+func WithNetworkMonitor(enabled bool) Option {
+	return func(t *Traversal) {
+		t.networkMonitor = enabled
+	}
+}
+
+// WithNetworkChange sets a callback that is invoked whenever the network
+// monitor detects a change in the set of usable network interfaces. This is
+// typically used as the trigger for an ICE restart (see Restart). The callback
+// is invoked on the monitor's goroutine and should not block for long.
+func WithNetworkChange(onChange func()) Option {
+	return func(t *Traversal) {
+		t.onNetworkChange = onChange
+	}
+}
+
+// PairAcceptor is a function that accepts or rejects (by returning an error)
+// the FiveTuple nominated by natty.
+type PairAcceptor func(*FiveTuple) error
+
+// WithPairAcceptor sets a function that gets the final say over the pair that
+// natty nominates, before FiveTuple() returns it. If the function returns an
+// error, the FiveTuple isn't passed to the peer and the Traversal fails with
+// that error, for example to reject a relayed pair in a latency-critical flow
+// so that the caller can retry.
+func WithPairAcceptor(accept PairAcceptor) Option {
+	return func(t *Traversal) {
+		t.pairAcceptor = accept
+	}
+}
+
+// WithRemotePolicy makes the Traversal check the addresses of the peer's
+// candidates against policy before passing them on to natty, and the remote
+// address of the nominated pair before FiveTuple returns it, so that a
+// malicious peer can't make us send packets to places that we must never
+// connect to, like our own loopback or management networks. Candidates whose
+// addresses aren't IP addresses, like mDNS hostnames, are rejected. A
+// rejection fails the Traversal with a *PolicyError, which errors.Is matches
+// with ErrPolicy. Using WithRemotePolicy more than once applies all of the
+// policies, for example RejectLoopback and RejectPrivate.
+func WithRemotePolicy(policy RemotePolicy) Option {
+	return func(t *Traversal) {
+		t.remotePolicies = append(t.remotePolicies, policy)
+	}
+}
+
+// WithPriorityOverride sets a function that can override the ICE priorities of
+// our candidates, for example to prefer candidates on a particular subnet over
+// everything else. The overridden priorities replace natty's in the candidates
+// sent to the peer, which uses them to order and nominate pairs, and show up
+// in Result().Pairs. They're kept between 1 and 2^31-1 as ICE requires, so
+// standard ICE peers work as usual. natty itself still orders its own checks
+// by its priorities, so to steer which pair wins, both peers should prefer the
+// same paths.
+func WithPriorityOverride(override PriorityFunc) Option {
+	return func(t *Traversal) {
+		t.priorityOverride = override
+	}
+}
+
+// WithOutboundBuffer sets how many outbound messages are buffered while waiting
+// for the consumer to read them from NextMsgOut, and what to do once that
+// buffer is full. The default is to buffer 100 messages and then block. A
+// negative size is taken as 0, meaning that messages aren't buffered at all.
+func WithOutboundBuffer(size int, policy OverflowPolicy) Option {
+	return func(t *Traversal) {
+		if size < 0 {
+			size = 0
+		}
+		t.outBufferSize = size
+		t.overflowPolicy = policy
+	}
+}
+
+// WithRelayRateLimit limits the throughput of conns passed to LimitConn to the
+// given number of bytes per second if the Traversal ends up relayed, so that a
+// single session can't exhaust a shared TURN server's quota. Direct paths are
+// never limited. By default, writes that exceed the limit block; use
+// WithRelayRateLimitPolicy to make them fail instead.
+func WithRelayRateLimit(bytesPerSec int) Option {
+	return func(t *Traversal) {
+		t.relayLimit = bytesPerSec
+	}
+}
+
+// WithRelayRateLimitPolicy sets what happens to writes that exceed the limit
+// set with WithRelayRateLimit.
+func WithRelayRateLimitPolicy(policy RateLimitPolicy) Option {
+	return func(t *Traversal) {
+		t.relayLimitPolicy = policy
+	}
+}
+
+// WithBindToDevice binds every socket involved in the traversal to the given
+// network device (SO_BINDTODEVICE), so that its traffic leaves through that
+// device regardless of the routing tables, as needed for VRFs. That covers the
+// sockets that natty uses for gathering and connectivity checks as well as
+// those that the Traversal creates itself, like the conns that Detach and
+// DetachPairs return, and those of Dialers, Connectors and Serve that are
+// configured with this Option. The sockets of MappingKeepers and
+// TurnAllocations aren't covered, since those outlive Traversals. The
+// Traversal fails if the device doesn't exist, or if we're not on Linux, which
+// is the only platform that supports binding to a device. natty binds its
+// sockets per its -device flag, which the embedded natty doesn't accept, so with
+// it the Traversal always fails with an error that unwraps to
+// ErrUnsupportedOption.
+func WithBindToDevice(name string) Option {
+	return func(t *Traversal) {
+		t.sockets.device = name
+	}
+}
+
+// WithLocalIP makes natty gather host candidates only on the given local IP,
+// for multi-homed hosts that should only ever be reached through one of their
+// interfaces, and never advertise the others (like a management network). The
+// Traversal fails if the IP isn't that of a local interface or doesn't match
+// WithIPVersion, if natty emits a host candidate on another IP anyway, and if
+// the FiveTuple's local address isn't on the IP, unless it's relayed. natty is
+// told the IP with its -localip flag, which the embedded natty doesn't accept,
+// so with it the Traversal always fails with an error that unwraps to
+// ErrUnsupportedOption.
+func WithLocalIP(ip net.IP) Option {
+	return func(t *Traversal) {
+		t.localIP = ip
+	}
+}
+
+// WithRelayLocalPort makes natty bind the socket with which it talks to the
+// TURN server to the given local port, so that the relay allocation can pass
+// through a firewall that only allows pre-approved source ports. If the port is
+// unavailable, the Traversal fails. By default, natty uses an ephemeral port.
+// natty is told the port with its -relayport flag, which the embedded natty
+// doesn't accept, so with it the Traversal always fails with an error that
+// unwraps to ErrUnsupportedOption. That's also the case with WithTURNServer,
+// where we talk to the TURN server ourselves, since that needs -turn.
+func WithRelayLocalPort(port int) Option {
+	return func(t *Traversal) {
+		t.relayLocalPort = port
+	}
+}
+
+// WithLocalPortCount makes natty gather candidates from n distinct local
+// ports instead of one, up to MaxLocalPortCount, for NATs that apply different
+// policies per source port, so that one bad mapping doesn't doom the
+// traversal. All of the candidates are signaled to the peer and the
+// connectivity checks decide which mapping works. The FiveTuple's local
+// address is on whichever port won, and natty closes the sockets on the other
+// ports as usual when it exits. The port set with WithRelayLocalPort is only
+// used for talking to the TURN server and doesn't count towards n. Stats tell
+// how many of the ports got a server reflexive mapping. The Traversal fails if
+// n is out of range. Any n other than 1 needs a natty that accepts
+// -localports, which the embedded natty doesn't, so with it the Traversal
+// always fails with an error that unwraps to ErrUnsupportedOption.
+func WithLocalPortCount(n int) Option {
+	return func(t *Traversal) {
+		t.extraLocalPorts = n - 1
+	}
+}
+
+// WithBoundConn makes natty hand over the socket with which it established
+// the FiveTuple, which Traversal.FiveTupleAndConn then returns, so that the
+// application keeps the NAT mapping that natty punched rather than binding a
+// new socket, which some platforms refuse while natty's socket lingers and
+// which symmetric NATs give a new mapping. Handing over isn't supported on
+// Windows, nor by natty executables that don't accept -handoff (like the
+// embedded one), which get a new socket instead. It can't be combined with
+// WithAllPairs.
+func WithBoundConn() Option {
+	return func(t *Traversal) {
+		t.handoff.enabled = true
+	}
+}
+
+// WithTurnAllocation makes natty relay through the given TurnAllocation
+// instead of allocating a relay of its own. The allocation can be shared by
+// any number of Traversals, each of which creates its own permissions and
+// channels on it, and remains open when they're closed. natty reaches the
+// allocation through its -turn flag, which the embedded natty doesn't accept,
+// so unless the Traversal runs a natty that does (see WithBinary), it fails
+// with an error that unwraps to ErrUnsupportedOption.
+func WithTurnAllocation(alloc *TurnAllocation) Option {
+	return func(t *Traversal) {
+		t.turnAllocation = alloc
+	}
+}
+
+// WithTURNServer makes natty relay through a relay of the Traversal's own,
+// allocated on the given TURN server ([turn:|turns:]host:port) with the given
+// credentials when the Traversal starts and released once it's closed. This
+// lets peers that are both behind symmetric NATs, where hole punching fails,
+// still connect. transport is how we talk to the TURN server: "udp", "tcp" or
+// "tls". Whichever it is, the relay itself is UDP, so WithTURNServer can't be
+// combined with TransportTCP, nor with WithTurnAllocation. Offer and Answer
+// block while the relay is allocated. If the server can't be reached or
+// refuses, the Traversal goes ahead without relay candidates. A relayed
+// FiveTuple has Relayed set. natty relays through the allocation with its
+// -turn flag, so with the embedded natty, which lacks it, the Traversal fails
+// with an error that unwraps to ErrUnsupportedOption before allocating
+// anything. It needs a natty given with WithBinary or SetBinaryPath that
+// accepts -turn.
+func WithTURNServer(addr string, username string, password string, transport string) Option {
+	return func(t *Traversal) {
+		t.turnServer = &turnServer{addr, TurnCredentials{username, password}, transport}
+	}
+}
+
+// WithTURN is like WithTURNServer, except that it takes the TURN server as a
+// URI (RFC 7065), as in WebRTC's RTCIceServer, and the transport from it:
+// turn:host[:port][?transport=udp|tcp] or turns:host[:port], which is TLS. The
+// port defaults to 3478, or 5349 for turns. Like WithTURNServer, it only works
+// with a natty that accepts -turn, so not with the embedded one.
+func WithTURN(url string, username string, credential string) Option {
+	addr, transport := parseTURNURI(url)
+	return WithTURNServer(addr, username, credential, transport)
+}
+
+// WithMappingKeeper makes the Traversal emit a srflx candidate for the given
+// MappingKeeper's cached mapping right after its session description, instead
+// of waiting for natty to ask a STUN server. natty still gathers its own
+// candidates, which take over if the cached mapping is stale. Since natty
+// relays the cached candidate's traffic through the keeper, it can't be
+// combined with WithTurnAllocation. If the keeper's mapping is currently
+// unknown, or natty doesn't accept -turn, through which it relays (the
+// embedded natty doesn't), the Traversal proceeds as if it weren't given a
+// keeper.
+func WithMappingKeeper(keeper *MappingKeeper) Option {
+	return func(t *Traversal) {
+		t.mappingKeeper = keeper
+	}
+}
+
+// WithSessionTag tags every message that the Traversal emits with its role
+// (offerer or answerer) and the given session, and makes TryMsgIn reject
+// messages tagged with a different session with a *MisroutedError. This
+// catches signaling layers that deliver messages to the wrong Traversal, which
+// otherwise tends to show up as a traversal that hangs until it times out.
+// Tags are added and removed by this package, not by natty, so only one of the
+// peers needs to set a tag, but both need a version of this package that
+// understands tags. Regardless of tags, TryMsgIn always rejects
+// offers passed to an offering Traversal and answers passed to an answering
+// one.
+func WithSessionTag(session string) Option {
+	return func(t *Traversal) {
+		t.sessionTag = session
+	}
+}
+
+// WithHairpinning tells the Traversal whether the local NAT supports
+// hairpinning, for example as detected by natty-check. With HairpinUnsupported,
+// if both peers turn out to be behind the same NAT (their srflx candidates share
+// a public IP), the srflx candidates exchanged from then on are dropped, so
+// that natty connects using host candidates rather than getting stuck on pairs
+// that can't work. Candidates within session descriptions are never dropped.
+func WithHairpinning(hairpinning Hairpinning) Option {
+	return func(t *Traversal) {
+		t.hairpinning = hairpinning
+	}
+}
+
+// WithPunchCoordination makes the Traversal coordinate with the peer so that
+// both start their connectivity checks at about the same time, which helps
+// hole punching through NATs whose mappings expire quickly. The answerer
+// proposes to start the given delay (DefaultPunchDelay is a reasonable choice)
+// after the offerer gets the proposal, and both hold back the peer's trickled
+// candidates from natty until then. Coordination only happens if both peers
+// enable it; otherwise the Traversal proceeds as usual. Stats report the
+// resulting skew between the peers' starts.
+func WithPunchCoordination(delay time.Duration) Option {
+	return func(t *Traversal) {
+		t.punch.delay = delay
+	}
+}
+
+// WithAllPairs makes the Traversal keep checking the other pairs between our
+// candidates and the peer's for a couple of seconds after natty nominated one,
+// so that Result() lists every path that works, for example over each of the
+// interfaces of a multi-homed host. The nominated pair is still the one in the
+// FiveTuple, which is only available once the extra checks are done. Both
+// peers need to use WithAllPairs, since each answers the other's checks.
+// DetachPairs keeps the best paths alive for failing over.
+func WithAllPairs() Option {
+	return func(t *Traversal) {
+		t.allPairs = true
+	}
+}
+
+// WithTraceWriter makes natty write its debug output for this Traversal to the
+// given io.Writer instead of the package's trace output, regardless of whether
+// tracing is enabled for the package. Errors writing to w are ignored. Nothing
+// is written to w once Close returns, so w can be closed right after, for
+// example if it's a per-session log file.
+func WithTraceWriter(w io.Writer) Option {
+	return func(t *Traversal) {
+		t.traceWriter = w
+	}
+}
+
+// WithLogRedaction sets what the Traversal redacts from its log output,
+// including natty's own debug output. With RedactIPs, candidates, FiveTuples
+// and anything else that's logged have the host portion of their IP addresses
+// masked, so that logs retained long-term don't contain personal data. The API
+// itself (FiveTuple(), NextMsgOut() and so on) is unaffected.
+func WithLogRedaction(redaction LogRedaction) Option {
+	return func(t *Traversal) {
+		t.logRedaction = redaction
+	}
+}
@@ -0,0 +1,332 @@
+package natty
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// allPairsWindow is how long a Traversal with WithAllPairs keeps checking
+	// pairs after natty nominated one.
+	allPairsWindow = 2 * time.Second
+
+	// pairProbeInterval is how often each pair gets probed while checking.
+	pairProbeInterval = 100 * time.Millisecond
+)
+
+var (
+	pairProbe    = []byte("natty-probe:")
+	pairProbeAck = []byte("natty-probe-ack:")
+)
+
+// Pair is a path between us and the peer that passed a connectivity check.
+type Pair struct {
+	// Local and Remote are the host:port addresses at either end.
+	Local  string
+	Remote string
+
+	// LocalType and RemoteType are the candidate types (host, srflx, prflx or
+	// relay) of either end, empty if unknown.
+	LocalType  string
+	RemoteType string
+
+	// LocalPriority is the ICE priority of our candidate at Local, as sent to
+	// the peer (see WithPriorityOverride), 0 if unknown.
+	LocalPriority uint32
+
+	// RTT is the fastest round trip measured while checking the pair, 0 if it
+	// wasn't measured.
+	RTT time.Duration
+
+	// Nominated is whether natty nominated this pair, making it the one in
+	// the FiveTuple.
+	Nominated bool
+}
+
+func (p *Pair) String() string {
+	return fmt.Sprintf("%s %s -> %s %s (rtt %s)", p.LocalType, p.Local, p.RemoteType, p.Remote, p.RTT)
+}
+
+// Result is the outcome of a Traversal.
+type Result struct {
+	// FiveTuple is the nominated pair, as returned by FiveTuple().
+	FiveTuple *FiveTuple
+
+	// Pairs are the pairs that work, best first. Without WithAllPairs, that's
+	// just the nominated pair.
+	Pairs []*Pair
+
+	// Err is the error with which the Traversal failed, if it did.
+	Err error
+}
+
+// Result gets the outcome of the Traversal, blocking like FiveTuple() does.
+func (t *Traversal) Result() *Result {
+	ft, err := t.FiveTuple()
+	if err != nil {
+		return &Result{Err: err}
+	}
+	t.outMutex.Lock()
+	pairs := t.pairsOut
+	t.outMutex.Unlock()
+	if pairs == nil {
+		stats := t.Stats()
+		local, _ := t.gathering.result()
+		pairs = []*Pair{{Local: ft.Local, Remote: ft.Remote, LocalType: stats.LocalType, RemoteType: stats.RemoteType, LocalPriority: localPriorities(local)[ft.Local], Nominated: true}}
+	}
+	return &Result{FiveTuple: ft, Pairs: pairs}
+}
+
+// DetachPairs is like Detach, except that it returns conns on the best n of
+// the Result's Pairs (or all of them if there are fewer), each kept alive by
+// its own ConnKeeper. With WithAllPairs, that keeps the NAT mappings for
+// alternate paths open, so that the application can fail over to them
+// instantly. The cleanup func closes all of the conns.
+func (t *Traversal) DetachPairs(n int) ([]net.Conn, func(), error) {
+	if !atomic.CompareAndSwapInt32(&t.detached, 0, 1) {
+		return nil, nil, fmt.Errorf("Traversal already detached")
+	}
+	result := t.Result()
+	if result.Err != nil {
+		return nil, nil, result.Err
+	}
+	if result.FiveTuple.Proto != UDP {
+		return nil, nil, fmt.Errorf("Unable to detach %s FiveTuple, only udp is supported", result.FiveTuple.Proto)
+	}
+	pairs := result.Pairs
+	if n < len(pairs) {
+		pairs = pairs[:n]
+	}
+	conns := make([]net.Conn, 0, len(pairs))
+	cleanups := make([]func(), 0, len(pairs))
+	cleanup := func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+	for _, pair := range pairs {
+		conn, dc, err := t.dialPair(&FiveTuple{Proto: UDP, Local: pair.Local, Remote: pair.Remote}, nil)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		conns = append(conns, conn)
+		cleanups = append(cleanups, dc.cleanup)
+	}
+	return conns, cleanup, nil
+}
+
+// checkAllPairs checks the pairs between our candidates and the peer's for the
+// given window, once natty has nominated the pair in ft and stopped. The peer
+// needs to do the same at the same time, since each side answers the other's
+// probes. It returns the pairs that work, best first.
+func (t *Traversal) checkAllPairs(ft *FiveTuple, window time.Duration) []*Pair {
+	local, _ := t.gathering.result()
+	t.statsTracker.mutex.Lock()
+	remote := make(map[string]string, len(t.statsTracker.remoteTypes))
+	for addr, typ := range t.statsTracker.remoteTypes {
+		remote[addr] = typ
+	}
+	t.statsTracker.mutex.Unlock()
+	stats := t.Stats()
+
+	pairs := checkPairs(ft, local, remote, window, t.sockets)
+	for _, pair := range pairs {
+		if pair.Nominated {
+			pair.LocalType, pair.RemoteType = stats.LocalType, stats.RemoteType
+		}
+	}
+	t.log().Tracef("Found %d working pairs", len(pairs))
+	return pairs
+}
+
+// checkPairs probes every pair between the bases of our local candidates and
+// the peer's remote candidates (given as types by address) for the given
+// window, returning the ones that got answers, with the nominated pair from ft
+// first and the rest by round trip time. The probing sockets come from s.
+func checkPairs(ft *FiveTuple, local []*Candidate, remote map[string]string, window time.Duration, s sockets) []*Pair {
+	// We send from the bases of our candidates, which for server reflexive
+	// ones are the host addresses that the NAT maps
+	localTypes := map[string]string{ft.Local: ""}
+	for _, c := range local {
+		switch {
+		case c.Protocol != "udp":
+		case c.Type == "host":
+			localTypes[c.Address] = c.Type
+		case c.Type == "srflx" && c.RelatedAddress != "":
+			if _, found := localTypes[c.RelatedAddress]; !found {
+				localTypes[c.RelatedAddress] = "host"
+			}
+		}
+	}
+	priorities := localPriorities(local)
+	remoteTypes := map[string]string{ft.Remote: remote[ft.Remote]}
+	for addr, typ := range remote {
+		if typ != "relay" {
+			remoteTypes[addr] = typ
+		}
+	}
+
+	pc := &pairChecker{
+		sent:     make(map[uint64]*probe),
+		verified: make(map[[2]string]time.Duration),
+	}
+	var wg sync.WaitGroup
+	for base := range localTypes {
+		addr, err := net.ResolveUDPAddr("udp", base)
+		if err != nil {
+			continue
+		}
+		conn, err := s.listenUDP("udp", addr)
+		if err != nil {
+			log.Tracef("Unable to check pairs from %s: %s", base, err)
+			continue
+		}
+		defer conn.Close()
+		var targets []*net.UDPAddr
+		for target := range remoteTypes {
+			raddr, err := net.ResolveUDPAddr("udp", target)
+			if err == nil && (raddr.IP.To4() == nil) == (addr.IP.To4() == nil) {
+				targets = append(targets, raddr)
+			}
+		}
+		wg.Add(1)
+		go pc.probe(conn, base, targets, window, &wg)
+	}
+	wg.Wait()
+
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pairs := make([]*Pair, 0, len(pc.verified)+1)
+	nominated := [2]string{ft.Local, ft.Remote}
+	if _, found := pc.verified[nominated]; !found {
+		// natty checked it, even if we couldn't
+		pairs = append(pairs, &Pair{Local: ft.Local, Remote: ft.Remote, LocalPriority: priorities[ft.Local], Nominated: true})
+	}
+	for key, rtt := range pc.verified {
+		pairs = append(pairs, &Pair{
+			Local:         key[0],
+			Remote:        key[1],
+			LocalType:     localTypes[key[0]],
+			RemoteType:    remoteTypes[key[1]],
+			LocalPriority: priorities[key[0]],
+			RTT:           rtt,
+			Nominated:     key == nominated,
+		})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Nominated != pairs[j].Nominated {
+			return pairs[i].Nominated
+		}
+		return pairs[i].RTT < pairs[j].RTT
+	})
+	return pairs
+}
+
+// localPriorities returns the priorities of our udp candidates by address.
+// Where a host candidate shares its address with others, its priority wins,
+// since that's the one for the base.
+func localPriorities(local []*Candidate) map[string]uint32 {
+	priorities := make(map[string]uint32, len(local))
+	for _, c := range local {
+		if c.Protocol != "udp" {
+			continue
+		}
+		if _, found := priorities[c.Address]; !found || c.Type == "host" {
+			priorities[c.Address] = c.Priority
+		}
+	}
+	return priorities
+}
+
+// pairChecker keeps track of the probes sent while checking pairs.
+type pairChecker struct {
+	lastId   uint64
+	sent     map[uint64]*probe
+	verified map[[2]string]time.Duration // fastest rtt by local and remote address
+	mutex    sync.Mutex
+}
+
+type probe struct {
+	local  string
+	remote string
+	sentAt time.Time
+}
+
+// probe probes each target from conn, which is bound to base, until window
+// has passed, answering probes from the peer in the meantime.
+func (pc *pairChecker) probe(conn *net.UDPConn, base string, targets []*net.UDPAddr, window time.Duration, wg *sync.WaitGroup) {
+	defer wg.Done()
+	deadline := time.Now().Add(window)
+	conn.SetReadDeadline(deadline)
+	go func() {
+		ticker := time.NewTicker(pairProbeInterval)
+		defer ticker.Stop()
+		for {
+			for _, target := range targets {
+				pc.mutex.Lock()
+				pc.lastId++
+				id := pc.lastId
+				pc.sent[id] = &probe{local: base, remote: target.String(), sentAt: time.Now()}
+				pc.mutex.Unlock()
+				conn.WriteToUDP(probePacket(pairProbe, id), target)
+			}
+			<-ticker.C
+			if time.Now().After(deadline) {
+				return
+			}
+		}
+	}()
+
+	b := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		packet := b[:n]
+		switch {
+		case bytes.HasPrefix(packet, pairProbeAck):
+			id, ok := probeId(packet, pairProbeAck)
+			if !ok {
+				continue
+			}
+			pc.mutex.Lock()
+			p := pc.sent[id]
+			if p != nil && p.local == base {
+				// Key by where we sent it, which is what we know the peer by
+				key := [2]string{p.local, p.remote}
+				rtt := time.Since(p.sentAt)
+				if fastest, found := pc.verified[key]; !found || rtt < fastest {
+					pc.verified[key] = rtt
+				}
+			}
+			pc.mutex.Unlock()
+		case bytes.HasPrefix(packet, pairProbe):
+			id, ok := probeId(packet, pairProbe)
+			if ok {
+				conn.WriteToUDP(probePacket(pairProbeAck, id), from)
+			}
+		}
+	}
+}
+
+func probePacket(prefix []byte, id uint64) []byte {
+	b := make([]byte, len(prefix)+8)
+	copy(b, prefix)
+	binary.BigEndian.PutUint64(b[len(prefix):], id)
+	return b
+}
+
+func probeId(packet []byte, prefix []byte) (uint64, bool) {
+	if len(packet) != len(prefix)+8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(packet[len(prefix):]), true
+}
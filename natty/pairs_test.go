@@ -0,0 +1,90 @@
+package natty
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestCheckPairs(t *testing.T) {
+	ip := nonLoopbackIPv4()
+	if ip == nil {
+		t.Skip("Need a non-loopback IPv4 interface")
+	}
+	a := []*Candidate{
+		{Protocol: "udp", Type: "host", Address: freeUDPAddr(t, "127.0.0.1")},
+		{Protocol: "udp", Type: "host", Address: freeUDPAddr(t, ip.String())},
+	}
+	b := []*Candidate{
+		{Protocol: "udp", Type: "host", Address: freeUDPAddr(t, "127.0.0.1")},
+		{Protocol: "udp", Type: "host", Address: freeUDPAddr(t, ip.String())},
+	}
+	types := func(candidates []*Candidate) map[string]string {
+		m := make(map[string]string)
+		for _, c := range candidates {
+			m[c.Address] = c.Type
+		}
+		return m
+	}
+
+	var aPairs, bPairs []*Pair
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		aPairs = checkPairs(&FiveTuple{Proto: UDP, Local: a[0].Address, Remote: b[0].Address}, a, types(b), 500*time.Millisecond, sockets{})
+	}()
+	go func() {
+		defer wg.Done()
+		bPairs = checkPairs(&FiveTuple{Proto: UDP, Local: b[0].Address, Remote: a[0].Address}, b, types(a), 500*time.Millisecond, sockets{})
+	}()
+	wg.Wait()
+
+	for _, pairs := range [][]*Pair{aPairs, bPairs} {
+		assert.True(t, len(pairs) >= 2, "Should have verified at least two pairs")
+		if assert.NotEmpty(t, pairs) {
+			assert.True(t, pairs[0].Nominated, "Nominated pair should come first")
+		}
+		for i, pair := range pairs {
+			assert.Equal(t, "host", pair.LocalType)
+			assert.Equal(t, "host", pair.RemoteType)
+			assert.True(t, pair.RTT > 0, "Should have measured the round trip")
+			if i > 1 {
+				assert.True(t, pair.RTT >= pairs[i-1].RTT, "Pairs should be ranked by round trip")
+			}
+		}
+	}
+
+	// Without the peer checking, only the nominated pair remains
+	pairs := checkPairs(&FiveTuple{Proto: UDP, Local: a[0].Address, Remote: b[0].Address}, a, types(b), 200*time.Millisecond, sockets{})
+	if assert.Len(t, pairs, 1) {
+		assert.True(t, pairs[0].Nominated)
+		assert.Equal(t, time.Duration(0), pairs[0].RTT)
+	}
+}
+
+func nonLoopbackIPv4() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+func freeUDPAddr(t *testing.T, ip string) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip)})
+	if err != nil {
+		t.Fatalf("Unable to listen on %s: %s", ip, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
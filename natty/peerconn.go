@@ -0,0 +1,780 @@
+package natty
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPeerRetries is how many times a PeerConnection retries a failed
+	// traversal if its PeerConfig doesn't say.
+	DefaultPeerRetries = 2
+
+	// the steps of the PeerConnection's protocol
+	peerHello    = "hello"    // either: here's my nonce, the higher one offers
+	peerTraverse = "traverse" // offerer: I'm starting the traversal of this generation
+	peerRepunch  = "repunch"  // answerer: the traversal of this generation died
+	peerBye      = "bye"      // either: I've given up or closed
+
+	peerMarker = `"type":"peer"`
+
+	// peerSessionPrefix prefixes the generation in the session tags of a
+	// PeerConnection's Traversals.
+	peerSessionPrefix = "peer"
+
+	// peerConfirmInterval is how frequently the offerer sends confirmations
+	// until the answerer acknowledges one.
+	peerConfirmInterval = 100 * time.Millisecond
+)
+
+var (
+	// peerConfirmTimeout is how long to wait for the peer to confirm that
+	// data flows over a new conn.
+	peerConfirmTimeout = 5 * time.Second
+
+	peerConfirm    = []byte("natty-peer-confirm")
+	peerConfirmAck = []byte("natty-peer-confirm-ack")
+)
+
+// PeerState is the state of a PeerConnection.
+type PeerState int
+
+const (
+	// PeerNew is the state of a PeerConnection that hasn't started connecting.
+	PeerNew PeerState = iota
+
+	// PeerConnecting is the state while connecting for the first time.
+	PeerConnecting
+
+	// PeerConnected is the state while data flows to and from the peer.
+	PeerConnected
+
+	// PeerReconnecting is the state while punching a new hole after the peer
+	// appeared to go away.
+	PeerReconnecting
+
+	// PeerFailed is the state once connecting or reconnecting has failed.
+	PeerFailed
+
+	// PeerClosed is the state once the PeerConnection has been closed.
+	PeerClosed
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerNew:
+		return "new"
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	case PeerReconnecting:
+		return "reconnecting"
+	case PeerFailed:
+		return "failed"
+	case PeerClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
+// PeerConfig configures a PeerConnection.
+type PeerConfig struct {
+	// Options configure the Traversals that the PeerConnection runs.
+	Options []Option
+
+	// Timeout is how long each traversal may take, DefaultDialTimeout if 0.
+	Timeout time.Duration
+
+	// Retries is how many times to retry a failed traversal,
+	// DefaultPeerRetries if 0 and none if negative.
+	Retries int
+
+	// AutoRepunch makes the PeerConnection punch a new hole when the peer
+	// appears to have gone away, for example because a NAT dropped the
+	// mapping, rather than failing.
+	AutoRepunch bool
+}
+
+func (c *PeerConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return DefaultDialTimeout
+}
+
+func (c *PeerConfig) retries() int {
+	switch {
+	case c.Retries < 0:
+		return 0
+	case c.Retries == 0:
+		return DefaultPeerRetries
+	}
+	return c.Retries
+}
+
+// PeerConnection is a connection to a single peer, and the place to start
+// when using natty. It owns everything that connecting involves: deciding
+// which side offers, running the traversal and retrying it if it fails,
+// confirming that data flows, keeping the connection alive and, with
+// AutoRepunch, punching a new hole when the connection dies. Offer and Answer
+// remain available for applications that need to do these themselves.
+//
+// Both peers create a PeerConnection on their end of the same Signaler and
+// call Connect. The conn from Conn stays the same across reconnections, with
+// reads and writes waiting while reconnecting.
+type PeerConnection struct {
+	signaler Signaler
+	config   PeerConfig
+	nonce    uint64
+	conn     *peerConn
+	mux      *signalMux
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// traverse runs the traversal of the given generation, by default with
+	// natty
+	traverse func(ctx context.Context, generation int, offering bool, onDead func()) (net.Conn, *Traversal, error)
+
+	mutex       sync.Mutex
+	state       PeerState
+	roleKnown   bool
+	offering    bool
+	peerNonce   uint64        // the peer's nonce, once the role is known
+	exported    bool          // whether the PeerConnection has been exported
+	peerHelloCh chan struct{} // closed once the role is known
+	generation  int           // of the latest traversal
+	current     net.Conn      // the conn of the connected traversal, if any
+	traversal   *Traversal    // the connected traversal, if any
+	changed     chan struct{} // closed on every state change
+	callbacks   []func(from PeerState, to PeerState)
+	events      [][2]PeerState // state changes waiting to be dispatched
+	dispatching bool
+	closeOnce   sync.Once
+}
+
+// peerMsg is a message of the PeerConnection's protocol.
+type peerMsg struct {
+	Type       string `json:"type"`
+	Step       string `json:"step"`
+	Nonce      uint64 `json:"nonce,omitempty"`
+	Generation int    `json:"generation,omitempty"`
+}
+
+// NewPeerConnection returns a PeerConnection that signals with its peer
+// through signaler. config may be nil for the defaults.
+func NewPeerConnection(signaler Signaler, config *PeerConfig) *PeerConnection {
+	pc := &PeerConnection{
+		signaler:    signaler,
+		peerHelloCh: make(chan struct{}),
+		changed:     make(chan struct{}),
+	}
+	if config != nil {
+		pc.config = *config
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	pc.nonce = binary.BigEndian.Uint64(b)
+	pc.conn = &peerConn{pc: pc}
+	pc.ctx, pc.cancel = context.WithCancel(context.Background())
+	pc.traverse = pc.traverseICE
+	return pc
+}
+
+// Connect connects to the peer, returning once data flows or connecting has
+// failed. Once Connect fails, the PeerConnection is done and should be closed.
+func (pc *PeerConnection) Connect(ctx context.Context) error {
+	pc.mutex.Lock()
+	if pc.state != PeerNew {
+		state := pc.state
+		pc.mutex.Unlock()
+		return fmt.Errorf("PeerConnection is already %s", state)
+	}
+	pc.setStateLocked(PeerConnecting)
+	pc.mux = newSignalMux(pc.signaler, nil, nil)
+	pc.mutex.Unlock()
+	pc.dispatch()
+	pc.mux.setLimits(0, pc.onControl)
+	pc.send(&peerMsg{Step: peerHello, Nonce: pc.nonce})
+
+	err := pc.connect(ctx)
+	if err != nil {
+		pc.fail()
+		return fmt.Errorf("Unable to connect to peer: %s", err)
+	}
+	return nil
+}
+
+func (pc *PeerConnection) connect(ctx context.Context) error {
+	select {
+	case <-pc.peerHelloCh:
+	case <-ctx.Done():
+		return fmt.Errorf("Peer didn't say hello: %s", ctx.Err())
+	case <-pc.ctx.Done():
+		return fmt.Errorf("PeerConnection closed")
+	}
+	pc.mutex.Lock()
+	offering := pc.offering
+	pc.mutex.Unlock()
+	if offering {
+		return pc.offer(ctx)
+	}
+	return pc.awaitConnected(ctx)
+}
+
+// awaitConnected waits for the offerer to connect to us.
+func (pc *PeerConnection) awaitConnected(ctx context.Context) error {
+	for {
+		pc.mutex.Lock()
+		state, changed := pc.state, pc.changed
+		pc.mutex.Unlock()
+		switch state {
+		case PeerConnected:
+			return nil
+		case PeerFailed, PeerClosed:
+			return fmt.Errorf("PeerConnection %s", state)
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("Peer didn't connect: %s", ctx.Err())
+		}
+	}
+}
+
+// offer runs traversals until one connects, retrying as configured.
+func (pc *PeerConnection) offer(ctx context.Context) error {
+	var err error
+	retries := pc.config.retries()
+	for attempt := 0; attempt <= retries; attempt++ {
+		pc.mutex.Lock()
+		pc.generation++
+		generation := pc.generation
+		pc.mutex.Unlock()
+		rest := make([]time.Duration, retries-attempt)
+		for i := range rest {
+			rest[i] = pc.config.timeout()
+		}
+		actx, done := allot(ctx, fmt.Sprintf("traversal %d", generation), pc.config.timeout(), rest)
+		err = pc.attempt(actx, generation, true)
+		done(err)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("Traversal %d to peer failed: %s", generation, err)
+		if ctx.Err() != nil || pc.ctx.Err() != nil {
+			break
+		}
+	}
+	if b := budgetFrom(ctx); b != nil && b.Remaining() == 0 {
+		return b.exhaustedErr()
+	}
+	return err
+}
+
+// attempt runs the traversal of the given generation and confirms that data
+// flows over the resulting conn, which becomes the current one.
+func (pc *PeerConnection) attempt(ctx context.Context, generation int, offering bool) error {
+	if offering {
+		pc.send(&peerMsg{Step: peerTraverse, Generation: generation})
+	}
+	ctx, cancel := context.WithTimeout(ctx, pc.config.timeout())
+	defer cancel()
+	conn, t, err := pc.traverse(ctx, generation, offering, func() {
+		pc.lost(generation)
+	})
+	if err != nil {
+		return err
+	}
+	err = confirmPeer(ctx, conn, offering)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	pc.install(generation, t, conn)
+	return nil
+}
+
+// traverseICE runs a Traversal with natty.
+func (pc *PeerConnection) traverseICE(ctx context.Context, generation int, offering bool, onDead func()) (net.Conn, *Traversal, error) {
+	session := peerSessionPrefix + strconv.Itoa(generation)
+	opts := append(append([]Option{}, pc.config.Options...), WithSessionTag(session))
+	var t *Traversal
+	if offering {
+		t = OfferContext(ctx, pc.config.timeout(), opts...)
+	} else {
+		t = AnswerContext(ctx, pc.config.timeout(), opts...)
+	}
+	defer t.Close()
+	pc.mux.add(session, t)
+	defer pc.mux.remove(session)
+	conn, _, err := t.detachWith(onDead)
+	return conn, t, err
+}
+
+// install makes conn the current conn, unless a newer traversal has started
+// since.
+func (pc *PeerConnection) install(generation int, t *Traversal, conn net.Conn) {
+	pc.mutex.Lock()
+	if generation != pc.generation || pc.state == PeerFailed || pc.state == PeerClosed {
+		pc.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	old := pc.current
+	pc.current = conn
+	pc.traversal = t
+	pc.conn.applyDeadlines(conn)
+	pc.setStateLocked(PeerConnected)
+	pc.mutex.Unlock()
+	pc.dispatch()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// lost handles the peer appearing to have gone away from the conn of the given
+// generation.
+func (pc *PeerConnection) lost(generation int) {
+	pc.mutex.Lock()
+	if generation != pc.generation || pc.state != PeerConnected {
+		pc.mutex.Unlock()
+		return
+	}
+	if !pc.config.AutoRepunch {
+		pc.mutex.Unlock()
+		log.Debug("Peer went away")
+		pc.fail()
+		return
+	}
+	pc.setStateLocked(PeerReconnecting)
+	offering := pc.offering
+	pc.mutex.Unlock()
+	pc.dispatch()
+
+	log.Debugf("Peer went away from traversal %d, punching a new hole", generation)
+	if offering {
+		go func() {
+			if err := pc.offer(pc.ctx); err != nil {
+				log.Debugf("Unable to reconnect to peer: %s", err)
+				pc.fail()
+			}
+		}()
+		return
+	}
+	// Make sure that the offerer knows
+	pc.send(&peerMsg{Step: peerRepunch, Generation: generation})
+	go func() {
+		timer := time.NewTimer(time.Duration(pc.config.retries()+1) * (pc.config.timeout() + peerConfirmTimeout))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-pc.ctx.Done():
+			return
+		}
+		pc.mutex.Lock()
+		stuck := pc.state == PeerReconnecting && pc.generation == generation
+		pc.mutex.Unlock()
+		if stuck {
+			log.Debug("Peer didn't reconnect")
+			pc.fail()
+		}
+	}()
+}
+
+// onControl handles the messages of the PeerConnection's protocol.
+func (pc *PeerConnection) onControl(msg string) bool {
+	if !strings.Contains(msg, peerMarker) {
+		return false
+	}
+	pm := &peerMsg{}
+	if json.Unmarshal([]byte(msg), pm) != nil {
+		return false
+	}
+
+	switch pm.Step {
+	case peerHello:
+		pc.mutex.Lock()
+		if pc.roleKnown {
+			pc.mutex.Unlock()
+			return true
+		}
+		if pm.Nonce == pc.nonce {
+			// Both picked the same random number, which never really happens
+			pc.mutex.Unlock()
+			log.Error("Peer has the same nonce as us")
+			return true
+		}
+		pc.roleKnown = true
+		pc.offering = pc.nonce > pm.Nonce
+		pc.peerNonce = pm.Nonce
+		pc.mutex.Unlock()
+		close(pc.peerHelloCh)
+	case peerTraverse:
+		pc.mutex.Lock()
+		if !pc.roleKnown || pc.offering || pm.Generation <= pc.generation || pc.state == PeerFailed || pc.state == PeerClosed {
+			pc.mutex.Unlock()
+			return true
+		}
+		pc.generation = pm.Generation
+		if pc.state == PeerConnected {
+			pc.setStateLocked(PeerReconnecting)
+		}
+		pc.mutex.Unlock()
+		pc.dispatch()
+		go func() {
+			err := pc.attempt(pc.ctx, pm.Generation, false)
+			if err != nil {
+				log.Debugf("Traversal %d from peer failed: %s", pm.Generation, err)
+			}
+		}()
+	case peerRepunch:
+		pc.mutex.Lock()
+		offering := pc.offering
+		pc.mutex.Unlock()
+		if offering {
+			pc.lost(pm.Generation)
+		}
+	case peerBye:
+		log.Debug("Peer gave up")
+		pc.fail()
+	}
+	return true
+}
+
+func (pc *PeerConnection) send(pm *peerMsg) {
+	pm.Type = "peer"
+	msg, _ := json.Marshal(pm)
+	pc.mux.send(append(getMsgBuf(), msg...))
+}
+
+// Conn returns the conn to the peer, which carries data once connected. It's
+// the same conn throughout the PeerConnection's life: while reconnecting,
+// reads and writes wait for the new connection. Closing it closes the
+// PeerConnection.
+func (pc *PeerConnection) Conn() net.Conn {
+	return pc.conn
+}
+
+// State returns the current state.
+func (pc *PeerConnection) State() PeerState {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return pc.state
+}
+
+// Stats returns the statistics of the traversal that the current connection
+// came from, nil if there isn't one yet.
+func (pc *PeerConnection) Stats() *Stats {
+	pc.mutex.Lock()
+	t := pc.traversal
+	pc.mutex.Unlock()
+	if t == nil {
+		return nil
+	}
+	return t.Stats()
+}
+
+// OnStateChange registers a callback for state changes, which are passed to
+// it in order, one at a time.
+func (pc *PeerConnection) OnStateChange(cb func(from PeerState, to PeerState)) {
+	pc.mutex.Lock()
+	pc.callbacks = append(pc.callbacks, cb)
+	pc.mutex.Unlock()
+}
+
+// Close closes the connection to the peer and the Signaler, telling the peer
+// unless the PeerConnection has been exported.
+func (pc *PeerConnection) Close() error {
+	pc.closeOnce.Do(func() {
+		pc.mutex.Lock()
+		sayBye := pc.state != PeerNew && pc.state != PeerFailed && !pc.exported
+		pc.setStateLocked(PeerClosed)
+		conn := pc.current
+		pc.current = nil
+		mux := pc.mux
+		pc.mutex.Unlock()
+		pc.dispatch()
+		pc.cancel()
+		if mux != nil {
+			if sayBye {
+				pc.send(&peerMsg{Step: peerBye})
+			}
+			for _, t := range mux.close() {
+				t.Close()
+			}
+		}
+		pc.signaler.Close()
+		if conn != nil {
+			conn.Close()
+		}
+	})
+	return nil
+}
+
+// fail gives up on the peer, telling it so.
+func (pc *PeerConnection) fail() {
+	pc.mutex.Lock()
+	if pc.state == PeerFailed || pc.state == PeerClosed {
+		pc.mutex.Unlock()
+		return
+	}
+	pc.setStateLocked(PeerFailed)
+	conn := pc.current
+	pc.current = nil
+	pc.mutex.Unlock()
+	pc.dispatch()
+	pc.send(&peerMsg{Step: peerBye})
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// setStateLocked changes the state, queueing the change for dispatch. Once
+// closed, the state doesn't change anymore.
+func (pc *PeerConnection) setStateLocked(state PeerState) {
+	if pc.state == state || pc.state == PeerClosed {
+		return
+	}
+	pc.events = append(pc.events, [2]PeerState{pc.state, state})
+	pc.state = state
+	close(pc.changed)
+	pc.changed = make(chan struct{})
+}
+
+// dispatch passes queued state changes to the callbacks, unless another
+// goroutine already is, so that callbacks are free to call the
+// PeerConnection.
+func (pc *PeerConnection) dispatch() {
+	pc.mutex.Lock()
+	if pc.dispatching {
+		pc.mutex.Unlock()
+		return
+	}
+	pc.dispatching = true
+	for len(pc.events) > 0 {
+		event := pc.events[0]
+		pc.events = pc.events[1:]
+		callbacks := pc.callbacks
+		pc.mutex.Unlock()
+		for _, cb := range callbacks {
+			cb(event[0], event[1])
+		}
+		pc.mutex.Lock()
+	}
+	pc.dispatching = false
+	pc.mutex.Unlock()
+}
+
+// currentConn waits until connected or deadline, returning the current conn.
+func (pc *PeerConnection) currentConn(deadline time.Time) (net.Conn, error) {
+	for {
+		pc.mutex.Lock()
+		state, conn, changed := pc.state, pc.current, pc.changed
+		pc.mutex.Unlock()
+		switch state {
+		case PeerConnected:
+			return conn, nil
+		case PeerFailed:
+			return nil, fmt.Errorf("Connection to peer failed")
+		case PeerClosed:
+			return nil, fmt.Errorf("PeerConnection closed")
+		}
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return nil, os.ErrDeadlineExceeded
+			}
+			timer := time.NewTimer(wait)
+			timeout = timer.C
+			defer timer.Stop()
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return nil, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// replaced indicates whether conn is no longer current, either because it's
+// been replaced or because it died and is being replaced.
+func (pc *PeerConnection) replaced(conn net.Conn) bool {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return conn != pc.current || pc.state == PeerReconnecting
+}
+
+// confirmPeer confirms that data flows over a new conn to the peer. The
+// offerer sends confirmations until the answerer acknowledges one.
+func confirmPeer(ctx context.Context, conn net.Conn, offering bool) error {
+	deadline := time.Now().Add(peerConfirmTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	b := make([]byte, len(peerConfirmAck))
+	if !offering {
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return fmt.Errorf("Peer didn't confirm: %s", err)
+			}
+			if bytes.Equal(b[:n], peerConfirm) {
+				for i := 0; i < portMapAckRepeats; i++ {
+					conn.Write(peerConfirmAck)
+				}
+				return nil
+			}
+		}
+	}
+
+	for time.Now().Before(deadline) {
+		_, err := conn.Write(peerConfirm)
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(peerConfirmInterval))
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				break
+			}
+			if bytes.Equal(b[:n], peerConfirmAck) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Peer didn't acknowledge confirmation")
+}
+
+// peerConn is the conn of a PeerConnection, which reads from and writes to
+// whichever conn is current.
+type peerConn struct {
+	pc            *PeerConnection
+	readDeadline  time.Time
+	writeDeadline time.Time
+	mutex         sync.Mutex
+}
+
+// Read reads the next packet from the peer that isn't left over from
+// confirmation, answering the peer's probes when it resumes after an import.
+func (c *peerConn) Read(b []byte) (int, error) {
+	if len(b) < peerControlLen {
+		// Read into a buffer that's large enough to recognize confirmations
+		buf := make([]byte, peerControlLen)
+		n, err := c.Read(buf)
+		return copy(b, buf[:n]), err
+	}
+	for {
+		c.mutex.Lock()
+		deadline := c.readDeadline
+		c.mutex.Unlock()
+		conn, err := c.pc.currentConn(deadline)
+		if err != nil {
+			return 0, err
+		}
+		n, err := conn.Read(b)
+		if err != nil {
+			if c.pc.replaced(conn) {
+				continue
+			}
+			return n, err
+		}
+		if c.pc.answerResume(conn, b[:n]) {
+			continue
+		}
+		if !bytes.Equal(b[:n], peerConfirm) && !bytes.Equal(b[:n], peerConfirmAck) && !bytes.Equal(b[:n], peerResumeAck) {
+			return n, nil
+		}
+	}
+}
+
+func (c *peerConn) Write(b []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+		deadline := c.writeDeadline
+		c.mutex.Unlock()
+		conn, err := c.pc.currentConn(deadline)
+		if err != nil {
+			return 0, err
+		}
+		n, err := conn.Write(b)
+		if err != nil && c.pc.replaced(conn) {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *peerConn) Close() error {
+	return c.pc.Close()
+}
+
+func (c *peerConn) LocalAddr() net.Addr {
+	if conn := c.currentOrNil(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return &net.UDPAddr{}
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	if conn := c.currentOrNil(); conn != nil {
+		return conn.RemoteAddr()
+	}
+	return &net.UDPAddr{}
+}
+
+func (c *peerConn) currentOrNil() net.Conn {
+	c.pc.mutex.Lock()
+	defer c.pc.mutex.Unlock()
+	return c.pc.current
+}
+
+func (c *peerConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *peerConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readDeadline = t
+	c.mutex.Unlock()
+	if conn := c.currentOrNil(); conn != nil {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c *peerConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.writeDeadline = t
+	c.mutex.Unlock()
+	if conn := c.currentOrNil(); conn != nil {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// applyDeadlines applies the deadlines set so far to a new conn.
+func (c *peerConn) applyDeadlines(conn net.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	conn.SetReadDeadline(c.readDeadline)
+	conn.SetWriteDeadline(c.writeDeadline)
+}
@@ -0,0 +1,203 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// TestPeerConnection is TestDirect with PeerConnections, which work out who
+// offers and confirm that data flows by themselves.
+func TestPeerConnection(t *testing.T) {
+	pc1, pc2 := connectPeers(t, nil)
+	if pc1 == nil {
+		return
+	}
+	defer pc1.Close()
+	defer pc2.Close()
+
+	assertConnected(t, pc1.Conn(), pc2.Conn())
+	if stats := pc1.Stats(); assert.NotNil(t, stats, "Should have stats") {
+		assert.True(t, stats.Timings.Total > 0)
+	}
+}
+
+func TestPeerConnectionStates(t *testing.T) {
+	fabric := &fakeFabric{}
+	pc1, pc2 := connectPeers(t, fabric)
+	if pc1 == nil {
+		return
+	}
+	defer pc1.Close()
+	defer pc2.Close()
+	assertConnected(t, pc1.Conn(), pc2.Conn())
+
+	// The hole closes and the offerer notices
+	fabric.kill(1)
+	assertConnected(t, pc1.Conn(), pc2.Conn())
+	for _, pc := range []*PeerConnection{pc1, pc2} {
+		assert.Equal(t, PeerConnected, pc.State())
+		assert.Equal(t, []PeerState{PeerConnecting, PeerConnected, PeerReconnecting, PeerConnected}, fabric.states(pc))
+	}
+
+	pc1.Close()
+	assert.Equal(t, PeerClosed, pc1.State())
+	_, err := pc1.Conn().Read(make([]byte, 10))
+	assert.Error(t, err, "Reading from a closed PeerConnection should fail")
+}
+
+func TestPeerConnectionNoRepunch(t *testing.T) {
+	fabric := &fakeFabric{noRepunch: true}
+	pc1, pc2 := connectPeers(t, fabric)
+	if pc1 == nil {
+		return
+	}
+	defer pc1.Close()
+	defer pc2.Close()
+
+	fabric.kill(1)
+	_, err := pc1.Conn().Write([]byte("hello"))
+	assert.Error(t, err, "Writing after the peer went away should fail")
+	assert.Equal(t, PeerFailed, pc1.State())
+}
+
+// connectPeers connects two PeerConnections through a pair of connected
+// chanSignalers, with natty or through fabric if it's set.
+func connectPeers(t *testing.T, fabric *fakeFabric) (*PeerConnection, *PeerConnection) {
+	signaler := newChanSignaler()
+	peerSignaler := &chanSignaler{in: signaler.out, out: signaler.in}
+	config := &PeerConfig{AutoRepunch: fabric == nil || !fabric.noRepunch, Timeout: 15 * time.Second}
+	pcs := []*PeerConnection{NewPeerConnection(signaler, config), NewPeerConnection(peerSignaler, config)}
+	if fabric != nil {
+		for _, pc := range pcs {
+			fabric.attach(pc)
+		}
+	}
+
+	errs := make(chan error, len(pcs))
+	for _, pc := range pcs {
+		go func(pc *PeerConnection) {
+			errs <- pc.Connect(context.Background())
+		}(pc)
+	}
+	for range pcs {
+		if !assert.NoError(t, <-errs, "Should connect") {
+			pcs[0].Close()
+			pcs[1].Close()
+			return nil, nil
+		}
+	}
+	assert.NotEqual(t, pcs[0].offering, pcs[1].offering, "One should offer and the other answer")
+	if pcs[1].offering {
+		return pcs[1], pcs[0]
+	}
+	return pcs[0], pcs[1]
+}
+
+// fakeFabric stands in for natty, connecting each generation of traversals
+// with a pair of UDP conns on localhost. It also records state changes.
+type fakeFabric struct {
+	noRepunch bool
+	mutex     sync.Mutex
+	pairs     map[int][]*net.UDPConn
+	onDead    map[int]func() // the offerer's, by generation
+	changes   map[*PeerConnection][]PeerState
+}
+
+func (f *fakeFabric) attach(pc *PeerConnection) {
+	pc.OnStateChange(func(from PeerState, to PeerState) {
+		f.mutex.Lock()
+		if f.changes == nil {
+			f.changes = make(map[*PeerConnection][]PeerState)
+		}
+		f.changes[pc] = append(f.changes[pc], to)
+		f.mutex.Unlock()
+	})
+	pc.traverse = func(ctx context.Context, generation int, offering bool, onDead func()) (net.Conn, *Traversal, error) {
+		conns, err := f.pair(generation)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn := conns[1]
+		if offering {
+			conn = conns[0]
+			f.mutex.Lock()
+			f.onDead[generation] = onDead
+			f.mutex.Unlock()
+		}
+		dc := &detachedConn{UDPConn: conn}
+		dc.keeper = NewConnKeeper(conn, nil, DetachKeepAliveInterval, nil)
+		return dc, nil, nil
+	}
+}
+
+func (f *fakeFabric) pair(generation int) ([]*net.UDPConn, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.pairs == nil {
+		f.pairs = make(map[int][]*net.UDPConn)
+		f.onDead = make(map[int]func())
+	}
+	if conns := f.pairs[generation]; conns != nil {
+		return conns, nil
+	}
+	var addrs []*net.UDPAddr
+	for i := 0; i < 2; i++ {
+		l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, l.LocalAddr().(*net.UDPAddr))
+		l.Close()
+	}
+	var conns []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		conn, err := net.DialUDP("udp4", addrs[i], addrs[1-i])
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	f.pairs[generation] = conns
+	return conns, nil
+}
+
+// kill makes the offerer's keeper of the given generation declare the peer
+// dead, and closes the hole.
+func (f *fakeFabric) kill(generation int) {
+	f.mutex.Lock()
+	onDead := f.onDead[generation]
+	conns := f.pairs[generation]
+	f.mutex.Unlock()
+	if onDead == nil {
+		panic(fmt.Sprintf("No generation %d", generation))
+	}
+	onDead()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// generations returns the generations that were traversed.
+func (f *fakeFabric) generations() []int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var generations []int
+	for generation := range f.pairs {
+		generations = append(generations, generation)
+	}
+	sort.Ints(generations)
+	return generations
+}
+
+func (f *fakeFabric) states(pc *PeerConnection) []PeerState {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]PeerState{}, f.changes[pc]...)
+}
@@ -0,0 +1,142 @@
+package natty
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// PeerRejected means that the peer refused the traversal, for example
+	// because of its policy.
+	PeerRejected = PeerErrorCode(iota + 1)
+
+	// PeerBusy means that the peer is too busy to answer, so trying again
+	// later may work.
+	PeerBusy
+
+	// PeerUnsupportedVersion means that the peer doesn't support what we
+	// offered.
+	PeerUnsupportedVersion
+
+	// PeerInternalError means that the peer failed on its end.
+	PeerInternalError
+)
+
+var (
+	// The errors that a PeerError unwraps to, one per PeerErrorCode, so that
+	// errors.Is tells why the peer gave up.
+	ErrPeerRejected           = errors.New("Peer rejected traversal")
+	ErrPeerBusy               = errors.New("Peer is busy")
+	ErrPeerUnsupportedVersion = errors.New("Peer doesn't support our version")
+	ErrPeerInternal           = errors.New("Peer failed")
+)
+
+// PeerErrorCode says why the answering peer gave up on a traversal.
+type PeerErrorCode byte
+
+func (c PeerErrorCode) err() error {
+	switch c {
+	case PeerRejected:
+		return ErrPeerRejected
+	case PeerBusy:
+		return ErrPeerBusy
+	case PeerUnsupportedVersion:
+		return ErrPeerUnsupportedVersion
+	}
+	// Including codes from the future
+	return ErrPeerInternal
+}
+
+// PeerError is what an offering Traversal fails with when the answering peer
+// gave up on it (see PeerErrorMsg), without waiting for its timeout.
+type PeerError struct {
+	Code PeerErrorCode
+
+	// Reason is the reason that the peer gave, if any.
+	Reason string
+}
+
+func (e *PeerError) Error() string {
+	if e.Reason == "" {
+		return e.Code.err().Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Code.err(), e.Reason)
+}
+
+// Unwrap returns the error for the PeerError's Code, like ErrPeerBusy.
+func (e *PeerError) Unwrap() error {
+	return e.Code.err()
+}
+
+// PeerErrorMsg returns a message for the answering side of the signaling to
+// send to an offering peer when it gives up on a traversal, for example
+// because of the application's policy or load. The offering Traversal fails
+// right away with a *PeerError with the given code and reason. Like version
+// advertisements, it's a binary message that peers which predate it fail to
+// decode and drop, so it's safe to send to anyone. Answering Traversals send
+// one with PeerInternalError themselves when they fail, giving only a generic
+// reason like "No connectivity established".
+func PeerErrorMsg(code PeerErrorCode, reason string) []byte {
+	return append([]byte{wireVersionBinary, kindPeerError, byte(code)}, reason...)
+}
+
+// parsePeerError returns the error that msg fails the traversal with, if it's
+// a PeerErrorMsg.
+func parsePeerError(msg []byte) (*PeerError, bool) {
+	if len(msg) < 3 || msg[0] != wireVersionBinary || msg[1] != kindPeerError {
+		return nil, false
+	}
+	return &PeerError{Code: PeerErrorCode(msg[2]), Reason: string(msg[3:])}, true
+}
+
+// peerFailed fails the Traversal with err, unless the peer already failed it.
+func (t *Traversal) peerFailed(err *PeerError) {
+	t.log().Tracef("Peer gave up on traversal: %s", err)
+	t.runReports().peerErr.Do(func() {
+		select {
+		case t.errCh <- err:
+		case <-t.closedCh:
+		}
+	})
+}
+
+// peerReason returns the reason to give the peer for failing with err, which
+// is only ever one of our fixed errors, since err itself may carry natty's
+// stderr or local addresses that the peer has no business seeing.
+func peerReason(err error) string {
+	for _, kind := range []error{ErrNoConnectivity, ErrBinaryNotFound, ErrUnsupportedOption, ErrPolicy} {
+		if errors.Is(err, kind) {
+			return kind.Error()
+		}
+	}
+	if _, ok := err.(*ExitError); ok {
+		return "natty exited"
+	}
+	return ""
+}
+
+// tellPeer tells the offering peer that an answering Traversal failed with
+// err, unless that's because it timed out or was closed, which the peer finds
+// out about by itself, or because of the peer.
+func (t *Traversal) tellPeer(err error) {
+	if t.offering || err == ErrTimeout {
+		return
+	}
+	switch err.(type) {
+	case *PeerError, *RejectedError:
+		// From the peer
+		return
+	}
+	select {
+	case <-t.closedCh:
+		return
+	default:
+	}
+	msg := t.encodeOut(append(getMsgBuf(), PeerErrorMsg(PeerInternalError, peerReason(err))...))
+	select {
+	case t.msgOutCh <- msg:
+	default:
+		t.log().Trace("Outbound message buffer full, not telling peer that we failed")
+		putMsgBuf(msg)
+	}
+}
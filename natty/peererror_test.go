@@ -0,0 +1,84 @@
+package natty
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestPeerError(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	assert.NoError(t, tr.TryMsgIn(string(PeerErrorMsg(PeerBusy, "Over quota"))))
+	assert.NoError(t, tr.TryMsgIn(string(RefusalMsg("Again"))))
+	select {
+	case err := <-tr.errCh:
+		peerErr, ok := err.(*PeerError)
+		if assert.True(t, ok, "Should fail with PeerError") {
+			assert.Equal(t, PeerBusy, peerErr.Code)
+			assert.Equal(t, "Over quota", peerErr.Reason)
+		}
+		assert.True(t, errors.Is(err, ErrPeerBusy))
+		assert.False(t, errors.Is(err, ErrPeerRejected))
+	default:
+		t.Fatal("Traversal should have failed right away")
+	}
+	select {
+	case err := <-tr.errCh:
+		t.Fatalf("Peer error should only be reported once, got %s", err)
+	default:
+	}
+
+	unknown, ok := parsePeerError(PeerErrorMsg(PeerErrorCode(200), ""))
+	if assert.True(t, ok) {
+		assert.True(t, errors.Is(unknown, ErrPeerInternal), "Unknown code should be treated as internal error")
+	}
+	_, ok = parsePeerError([]byte(`{"type":"offer","sdp":"refusal"}`))
+	assert.False(t, ok)
+	assert.Equal(t, "Peer rejected traversal", (&PeerError{Code: PeerRejected}).Error())
+
+	_, err := decodeMsg(string(append([]byte{wireVersionBinary, 0x7f}, "future"...)))
+	assert.Error(t, err, "Peers that predate a message kind should fail to decode and drop it")
+}
+
+func TestTellPeer(t *testing.T) {
+	answerer := newTraversal(0, nil)
+	answerer.initChannels()
+	answerer.tellPeer(ErrTimeout)
+	answerer.tellPeer(&PeerError{Code: PeerRejected})
+	answerer.tellPeer(&RejectedError{})
+	for err, reason := range map[error]string{
+		fmt.Errorf("Unable to bind 192.168.1.160:5000"):                                          "",
+		&ExitError{Code: 1, Stderr: "candidate 192.168.1.160:5000 failed"}:                       "natty exited",
+		&kindError{"Error reported by natty: no pair for 192.168.1.160:5000", ErrNoConnectivity}: "No connectivity established",
+	} {
+		answerer.tellPeer(err)
+		select {
+		case msg := <-answerer.msgOutCh:
+			peerErr, ok := parsePeerError(msg)
+			if assert.True(t, ok, "Should have told peer") {
+				assert.Equal(t, PeerInternalError, peerErr.Code)
+				assert.Equal(t, reason, peerErr.Reason, "Peer should only get a fixed reason for %s", err)
+			}
+		default:
+			t.Fatal("Answerer should have told peer that it failed")
+		}
+		select {
+		case msg := <-answerer.msgOutCh:
+			t.Fatalf("Only the internal error should have been sent, got %q", msg)
+		default:
+		}
+	}
+
+	offerer := newTraversal(0, nil)
+	offerer.offering = true
+	offerer.initChannels()
+	offerer.tellPeer(fmt.Errorf("Boom"))
+	select {
+	case <-offerer.msgOutCh:
+		t.Fatal("Offerer shouldn't tell peer")
+	default:
+	}
+}
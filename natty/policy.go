@@ -0,0 +1,137 @@
+package natty
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrPolicy is what a *PolicyError unwraps to.
+	ErrPolicy = errors.New("Remote address rejected by policy")
+
+	remoteCandidatePattern = regexp.MustCompile(`candidate:\S+ \d+ \S+ \d+ (\S+) (\d+) typ`)
+)
+
+// RemotePolicy decides whether we may connect to a remote address, returning
+// an error saying why not if we may not.
+type RemotePolicy func(addr netip.AddrPort) error
+
+// PolicyError is what a Traversal fails with when a RemotePolicy rejects one
+// of the peer's candidates or the nominated pair.
+type PolicyError struct {
+	// Addr is the rejected address, redacted per WithLogRedaction.
+	Addr string
+
+	// Err is why the policy rejected it.
+	Err error
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("Remote address %s rejected by policy: %s", e.Addr, e.Err)
+}
+
+// Unwrap returns ErrPolicy.
+func (e *PolicyError) Unwrap() error {
+	return ErrPolicy
+}
+
+// RejectPrivate rejects private (RFC 1918 and RFC 4193) and link-local
+// addresses.
+func RejectPrivate(addr netip.AddrPort) error {
+	ip := addr.Addr().Unmap()
+	if ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return fmt.Errorf("%s is private", ip)
+	}
+	return nil
+}
+
+// RejectLoopback rejects loopback addresses.
+func RejectLoopback(addr netip.AddrPort) error {
+	ip := addr.Addr().Unmap()
+	if ip.IsLoopback() {
+		return fmt.Errorf("%s is loopback", ip)
+	}
+	return nil
+}
+
+// AllowlistCIDRs returns a RemotePolicy that rejects everything outside of the
+// given prefixes.
+func AllowlistCIDRs(prefixes ...netip.Prefix) RemotePolicy {
+	return func(addr netip.AddrPort) error {
+		ip := addr.Addr().Unmap()
+		for _, prefix := range prefixes {
+			if prefix.Contains(ip) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s isn't allowed", ip)
+	}
+}
+
+// checkRemote applies the Traversal's RemotePolicies to addr (host:port).
+// Addresses that aren't IP addresses, like mDNS hostnames, are rejected, since
+// there's no telling where they lead.
+func (t *Traversal) checkRemote(addr string) error {
+	if len(t.remotePolicies) == 0 {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return &PolicyError{Addr: t.redact(addr), Err: fmt.Errorf("Not an IP address")}
+	}
+	for _, policy := range t.remotePolicies {
+		err = policy(ap)
+		if err != nil {
+			return &PolicyError{Addr: t.redact(addr), Err: fmt.Errorf("%s", t.redact(err.Error()))}
+		}
+	}
+	return nil
+}
+
+// checkRemoteCandidates applies the Traversal's RemotePolicies to the
+// addresses of all of the candidates in msg, a message from the peer. The
+// candidates are taken from the message as natty will see it, after JSON
+// unescaping, so that escapes can't hide them.
+func (t *Traversal) checkRemoteCandidates(msg []byte) error {
+	if len(t.remotePolicies) == 0 {
+		return nil
+	}
+	for _, match := range remoteCandidatePattern.FindAllStringSubmatch(candidateText(msg), -1) {
+		host := strings.Trim(match[1], "[]")
+		err := t.checkRemote(net.JoinHostPort(host, match[2]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// candidateText returns the part of msg that holds candidates, after JSON
+// unescaping, so that escapes can't hide them.
+func candidateText(msg []byte) string {
+	fields := &struct {
+		SDP       string `json:"sdp"`
+		Candidate string `json:"candidate"`
+	}{}
+	if json.Unmarshal(msg, fields) == nil {
+		return fields.SDP + "\n" + fields.Candidate
+	}
+	return string(msg)
+}
+
+// policyFailed fails the Traversal with err, unless a policy already failed
+// it.
+func (t *Traversal) policyFailed(err error) {
+	t.log().Errorf("%s", err)
+	t.runReports().policy.Do(func() {
+		select {
+		case t.errCh <- err:
+		case <-t.closedCh:
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package natty
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestBuiltinPolicies(t *testing.T) {
+	public := netip.MustParseAddrPort("203.0.113.7:5000")
+	assert.NoError(t, RejectPrivate(public))
+	assert.NoError(t, RejectLoopback(public))
+	assert.Error(t, RejectPrivate(netip.MustParseAddrPort("10.1.2.3:5000")))
+	assert.Error(t, RejectPrivate(netip.MustParseAddrPort("169.254.1.1:5000")))
+	assert.Error(t, RejectPrivate(netip.MustParseAddrPort("[fe80::1]:5000")))
+	assert.Error(t, RejectPrivate(netip.MustParseAddrPort("[::ffff:192.168.1.1]:5000")), "Mapped IPv4 should be caught")
+	assert.Error(t, RejectLoopback(netip.MustParseAddrPort("127.0.0.2:5000")))
+	assert.Error(t, RejectLoopback(netip.MustParseAddrPort("[::1]:5000")))
+
+	allow := AllowlistCIDRs(netip.MustParsePrefix("203.0.113.0/24"))
+	assert.NoError(t, allow(public))
+	assert.Error(t, allow(netip.MustParseAddrPort("198.51.100.1:5000")))
+}
+
+// TestRemotePolicy feeds a Traversal hostile candidates over a pipe from the
+// peer, and captures everything that reaches natty, which is where natty would
+// send packets.
+func TestRemotePolicy(t *testing.T) {
+	tr := newTraversal(0, []Option{WithRemotePolicy(RejectLoopback), WithRemotePolicy(RejectPrivate), WithLogRedaction(RedactIPs)})
+	tr.initChannels()
+	var captured bytes.Buffer
+	tr.stdin = nopWriteCloser{&captured}
+	pipe := make(chan string, 10)
+	pipe <- `{"candidate":"candidate:1 1 udp 1686052607 203.0.113.7 55285 typ srflx raddr 10.0.0.2 rport 55285","sdpMid":"data","sdpMLineIndex":0}`
+	pipe <- `{"type":"offer","sdp":"v=0\r\na=candidate:1 1 udp 2122260223 203.0.113.8 5000 typ host\r\na=candidate:2 1 udp 2122260223 127.0.0.1 22 typ host\r\n"}`
+	pipe <- `{"candidate":"candidate:3 1 udp 2122260223 fe80::1 5000 typ host","sdpMid":"data","sdpMLineIndex":0}`
+	pipe <- `{"candidate":"candidate:4 1 udp 2122260223 3f1c8a.local 5000 typ host","sdpMid":"data","sdpMLineIndex":0}`
+	pipe <- `{"candidate":"candidate:5\u00201 udp 2122260223 \u0031\u0030.0.0.1 5000 typ host","sdpMid":"data","sdpMLineIndex":0}`
+	close(pipe)
+
+	var errs []error
+	for msg := range pipe {
+		if err := tr.TryMsgIn(msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for len(tr.msgInCh) > 0 {
+		tr.forwardMsgIn(<-tr.msgInCh)
+	}
+
+	if assert.Len(t, errs, 4, "All but the public candidate should be rejected") {
+		policyErr, ok := errs[0].(*PolicyError)
+		if assert.True(t, ok, "Should be a PolicyError") {
+			assert.Equal(t, "127.0.0.x:22", policyErr.Addr, "Address should be redacted")
+		}
+		assert.True(t, errors.Is(errs[0], ErrPolicy))
+		assert.Contains(t, errs[2].Error(), "Not an IP address")
+		assert.Contains(t, errs[3].Error(), "10.0.0.x", "Escapes shouldn't hide candidates")
+	}
+	select {
+	case err := <-tr.errCh:
+		assert.True(t, errors.Is(err, ErrPolicy), "Traversal should fail")
+	default:
+		t.Fatal("Traversal should have failed")
+	}
+	assert.Equal(t, 0, len(tr.errCh), "Should fail only once")
+
+	out := captured.String()
+	assert.Contains(t, out, "203.0.113.7", "Public candidate should reach natty")
+	for _, forbidden := range []string{"127.0.0.1", "fe80::1", ".local", "203.0.113.8"} {
+		assert.False(t, strings.Contains(out, forbidden), forbidden+" should never reach natty")
+	}
+}
+
+func TestRemotePolicyFiveTuple(t *testing.T) {
+	tr := newTraversal(0, []Option{WithRemotePolicy(AllowlistCIDRs(netip.MustParsePrefix("203.0.113.0/24")))})
+	tr.initChannels()
+	tr.stdoutbuf = bufio.NewReader(strings.NewReader(`{"type":"5-tuple","Proto":"udp","Local":"192.168.1.2:5000","Remote":"198.51.100.1:5000"}` + "\n"))
+	tr.iowg.Add(1)
+	go tr.processStdout()
+	err := <-tr.errCh
+	assert.True(t, errors.Is(err, ErrPolicy), "Nominated pair outside allowlist should fail traversal")
+	assert.Equal(t, 0, len(tr.fiveTupleCh))
+}
@@ -0,0 +1,317 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	igdDescription = "natty"
+
+	// igdOnlyPermanentLeases is the error with which IGDv1 gateways that
+	// don't support lease durations refuse them.
+	igdOnlyPermanentLeases = 725
+)
+
+var (
+	// ssdpAddr is where to send SSDP searches for UPnP gateways
+	ssdpAddr = "239.255.255.250:1900"
+
+	// igdDeviceTypes are the gateway devices to search for, newest first
+	igdDeviceTypes = []string{
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	}
+
+	// igdServiceTypes are the UPnP services that can map ports, newest first
+	igdServiceTypes = []string{
+		"urn:schemas-upnp-org:service:WANIPConnection:2",
+		"urn:schemas-upnp-org:service:WANIPConnection:1",
+		"urn:schemas-upnp-org:service:WANPPPConnection:1",
+	}
+)
+
+// igdRoot is a UPnP device description.
+type igdRoot struct {
+	URLBase string    `xml:"URLBase"`
+	Device  igdDevice `xml:"device"`
+}
+
+type igdDevice struct {
+	Services []igdService `xml:"serviceList>service"`
+	Devices  []igdDevice  `xml:"deviceList>device"`
+}
+
+type igdService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// find finds the first service of the given type on the device or its
+// embedded devices.
+func (d *igdDevice) find(serviceType string) *igdService {
+	for i, s := range d.Services {
+		if s.ServiceType == serviceType {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].find(serviceType); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// soapError is an error response to a SOAP action.
+type soapError struct {
+	action string
+	status string
+	code   int // the UPnP error code, 0 if unknown
+}
+
+func (e *soapError) Error() string {
+	return fmt.Sprintf("Gateway refused %s: %s (UPnP error %d)", e.action, e.status, e.code)
+}
+
+// igdMapper maps a port with a UPnP gateway's port mapping service.
+type igdMapper struct {
+	controlURL  string
+	serviceType string
+	proto       string
+	internal    int
+	localIP     net.IP // our address on the gateway's network
+	ip          net.IP // the gateway's external address, once known
+	permanent   bool   // whether the gateway only supports permanent leases
+}
+
+// discoverIGDMapper finds a UPnP gateway that can map the given port.
+func discoverIGDMapper(ctx context.Context, proto string, internal int) (*igdMapper, error) {
+	location, err := discoverIGD(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m := &igdMapper{proto: proto, internal: internal}
+	err = m.describe(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(m.controlURL)
+	if err != nil {
+		return nil, err
+	}
+	// Map to the local address with which we reach the gateway
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	m.localIP, err = localIPFor(host)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *igdMapper) add(ctx context.Context, lifetime time.Duration) (*ExternalEndpoint, error) {
+	if m.ip == nil {
+		resp := &struct {
+			IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+		}{}
+		err := m.call(ctx, "GetExternalIPAddress", nil, resp)
+		if err != nil {
+			return nil, err
+		}
+		m.ip = net.ParseIP(resp.IP)
+		if m.ip == nil {
+			return nil, fmt.Errorf("Gateway returned invalid external IP %q", resp.IP)
+		}
+		if ip4 := m.ip.To4(); ip4 != nil {
+			m.ip = ip4
+		}
+	}
+
+	if m.permanent {
+		lifetime = 0
+	}
+	err := m.addPortMapping(ctx, lifetime)
+	if se, ok := err.(*soapError); ok && se.code == igdOnlyPermanentLeases && lifetime > 0 {
+		m.permanent = true
+		lifetime = 0
+		err = m.addPortMapping(ctx, lifetime)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalEndpoint{
+		Proto:    m.proto,
+		IP:       m.ip,
+		Port:     m.internal,
+		Method:   UPnP,
+		Lifetime: lifetime.Truncate(time.Second),
+	}, nil
+}
+
+func (m *igdMapper) addPortMapping(ctx context.Context, lifetime time.Duration) error {
+	port := strconv.Itoa(m.internal)
+	return m.call(ctx, "AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", port},
+		{"NewProtocol", strings.ToUpper(m.proto)},
+		{"NewInternalPort", port},
+		{"NewInternalClient", m.localIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", igdDescription},
+		{"NewLeaseDuration", strconv.Itoa(int(lifetime / time.Second))},
+	}, nil)
+}
+
+func (m *igdMapper) remove(ctx context.Context) error {
+	return m.call(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(m.internal)},
+		{"NewProtocol", strings.ToUpper(m.proto)},
+	}, nil)
+}
+
+// discoverIGD searches for a UPnP gateway with SSDP, returning the location of
+// its device description.
+func discoverIGD(ctx context.Context) (string, error) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return "", err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	for _, deviceType := range igdDeviceTypes {
+		search := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			"ST: " + deviceType + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 1\r\n\r\n"
+		_, err = conn.WriteToUDP([]byte(search), addr)
+		if err != nil {
+			return "", err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	b := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return "", fmt.Errorf("No UPnP gateway found: %s", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// describe fetches the device description at location to find the gateway's
+// port mapping service.
+func (m *igdMapper) describe(ctx context.Context, location string) error {
+	req, err := http.NewRequest("GET", location, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Unable to fetch UPnP description: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to fetch UPnP description: %s", resp.Status)
+	}
+	root := &igdRoot{}
+	err = xml.NewDecoder(resp.Body).Decode(root)
+	if err != nil {
+		return fmt.Errorf("Unable to parse UPnP description: %s", err)
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	if root.URLBase != "" {
+		base, err = url.Parse(root.URLBase)
+		if err != nil {
+			return err
+		}
+	}
+	for _, serviceType := range igdServiceTypes {
+		if s := root.Device.find(serviceType); s != nil {
+			control, err := base.Parse(s.ControlURL)
+			if err != nil {
+				return err
+			}
+			m.controlURL = control.String()
+			m.serviceType = serviceType
+			return nil
+		}
+	}
+	return fmt.Errorf("UPnP gateway at %s can't map ports", location)
+}
+
+// call calls the given SOAP action with the given arguments, decoding the
+// response into result if it's not nil.
+func (m *igdMapper) call(ctx context.Context, action string, args [][2]string, result interface{}) error {
+	body := &bytes.Buffer{}
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + m.serviceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest("POST", m.controlURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+m.serviceType+"#"+action+`"`)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Unable to call %s: %s", action, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fault := &struct {
+			Code int `xml:"Body>Fault>detail>UPnPError>errorCode"`
+		}{}
+		xml.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(fault)
+		return &soapError{action, resp.Status, fault.Code}
+	}
+	if result == nil {
+		ioutil.ReadAll(resp.Body)
+		return nil
+	}
+	err = xml.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("Unable to parse %s response: %s", action, err)
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package portmap
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PCP and NAT-PMP share a port and a packet layout that starts with a version
+// and an opcode, so that gateways can tell them apart. A NAT-PMP gateway
+// answers PCP requests with an unsupported version error, which is how we know
+// to fall back to NAT-PMP.
+
+const (
+	pmpPort = 5351
+
+	pcpVersion    = 2
+	natPMPVersion = 0
+
+	pcpOpMap                = 1
+	natPMPOpExternalAddress = 0
+	natPMPOpMapUDP          = 1
+	natPMPOpMapTCP          = 2
+
+	// pmpResponse is set in the opcode of responses
+	pmpResponse = 0x80
+
+	pmpResultUnsupportedVersion = 1
+
+	pcpRequestSize  = 60
+	pcpResponseSize = 60
+
+	// pmpRetransmit is the initial retransmission interval, which doubles
+	// with every retransmission.
+	pmpRetransmit = 250 * time.Millisecond
+)
+
+var (
+	// gatewayServer returns the host:port of the gateway's PCP and NAT-PMP
+	// server
+	gatewayServer = func() (string, error) {
+		gateway, err := defaultGateway()
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(gateway.String(), strconv.Itoa(pmpPort)), nil
+	}
+)
+
+// pcpMapper maps a port with PCP's MAP opcode.
+type pcpMapper struct {
+	server      string
+	proto       string
+	internal    int
+	nonce       []byte            // identifies the mapping to the gateway
+	mapped      *ExternalEndpoint // the last endpoint that the gateway assigned
+	unsupported bool              // whether the gateway only speaks NAT-PMP
+}
+
+func newPCPMapper(server string, proto string, internal int) *pcpMapper {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	return &pcpMapper{server: server, proto: proto, internal: internal, nonce: nonce}
+}
+
+func (m *pcpMapper) add(ctx context.Context, lifetime time.Duration) (*ExternalEndpoint, error) {
+	resp, err := m.request(ctx, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.IP(append([]byte{}, resp[44:60]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	m.mapped = &ExternalEndpoint{
+		Proto:    m.proto,
+		IP:       ip,
+		Port:     int(binary.BigEndian.Uint16(resp[42:44])),
+		Method:   PCP,
+		Lifetime: time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second,
+	}
+	return m.mapped, nil
+}
+
+func (m *pcpMapper) remove(ctx context.Context) error {
+	_, err := m.request(ctx, 0)
+	return err
+}
+
+// request sends a MAP request with the given lifetime, suggesting the
+// endpoint that the gateway last assigned, if any.
+func (m *pcpMapper) request(ctx context.Context, lifetime time.Duration) ([]byte, error) {
+	clientIP, err := localIPFor(m.server)
+	if err != nil {
+		return nil, err
+	}
+	req := make([]byte, pcpRequestSize)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	copy(req[8:24], clientIP.To16())
+	copy(req[24:36], m.nonce)
+	req[36] = ianaProtocol(m.proto)
+	binary.BigEndian.PutUint16(req[40:], uint16(m.internal))
+	if m.mapped != nil {
+		binary.BigEndian.PutUint16(req[42:], uint16(m.mapped.Port))
+		copy(req[44:60], m.mapped.IP.To16())
+	} else {
+		// No suggestion, in the address family of the client
+		copy(req[44:60], net.IPv4zero.To16())
+	}
+
+	resp, err := pmpRequest(ctx, m.server, req, pcpResponseSize)
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != pcpVersion {
+		m.unsupported = true
+		return nil, fmt.Errorf("Gateway only supports version %d", resp[0])
+	}
+	if result := resp[3]; result != 0 {
+		return nil, fmt.Errorf("Gateway refused with result code %d", result)
+	}
+	if string(resp[24:36]) != string(m.nonce) {
+		return nil, fmt.Errorf("Gateway responded with the wrong nonce")
+	}
+	return resp, nil
+}
+
+// natPMPMapper maps a port with NAT-PMP.
+type natPMPMapper struct {
+	server   string
+	proto    string
+	internal int
+	ip       net.IP // the gateway's external address, once known
+	external int    // the last external port that the gateway assigned
+}
+
+func newNATPMPMapper(server string, proto string, internal int) *natPMPMapper {
+	return &natPMPMapper{server: server, proto: proto, internal: internal}
+}
+
+func (m *natPMPMapper) add(ctx context.Context, lifetime time.Duration) (*ExternalEndpoint, error) {
+	if m.ip == nil {
+		resp, err := m.request(ctx, []byte{natPMPVersion, natPMPOpExternalAddress}, 12)
+		if err != nil {
+			return nil, err
+		}
+		m.ip = net.IP(append([]byte{}, resp[8:12]...))
+	}
+	resp, err := m.request(ctx, m.mapRequest(m.external, lifetime), 16)
+	if err != nil {
+		return nil, err
+	}
+	m.external = int(binary.BigEndian.Uint16(resp[10:12]))
+	return &ExternalEndpoint{
+		Proto:    m.proto,
+		IP:       m.ip,
+		Port:     m.external,
+		Method:   NATPMP,
+		Lifetime: time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second,
+	}, nil
+}
+
+func (m *natPMPMapper) remove(ctx context.Context) error {
+	_, err := m.request(ctx, m.mapRequest(0, 0), 16)
+	return err
+}
+
+// mapRequest builds a request to map the internal port, which removes the
+// mapping if lifetime is 0.
+func (m *natPMPMapper) mapRequest(external int, lifetime time.Duration) []byte {
+	req := make([]byte, 12)
+	req[1] = natPMPOpMapUDP
+	if m.proto == "tcp" {
+		req[1] = natPMPOpMapTCP
+	}
+	binary.BigEndian.PutUint16(req[4:], uint16(m.internal))
+	binary.BigEndian.PutUint16(req[6:], uint16(external))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	return req
+}
+
+func (m *natPMPMapper) request(ctx context.Context, req []byte, respLen int) ([]byte, error) {
+	resp, err := pmpRequest(ctx, m.server, req, respLen)
+	if err != nil {
+		return nil, err
+	}
+	if result := binary.BigEndian.Uint16(resp[2:4]); result != 0 {
+		return nil, fmt.Errorf("Gateway refused with result code %d", result)
+	}
+	return resp, nil
+}
+
+// pmpRequest sends req to the PCP or NAT-PMP server, retransmitting with
+// exponential backoff until a response to it arrives or ctx is done. The
+// response is at least respLen bytes long, unless it's an unsupported version
+// error.
+func pmpRequest(ctx context.Context, server string, req []byte, respLen int) ([]byte, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+
+	resp := make([]byte, 1100)
+	retransmit := pmpRetransmit
+	for {
+		_, err := conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+		readDeadline := time.Now().Add(retransmit)
+		if !deadline.IsZero() && readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+		for {
+			n, err := conn.Read(resp)
+			if err != nil {
+				break
+			}
+			if n < 4 || resp[1] != pmpResponse|req[1] {
+				continue
+			}
+			if resp[0] != req[0] && resp[3] == pmpResultUnsupportedVersion {
+				return resp[:n], nil
+			}
+			if n < respLen {
+				return nil, fmt.Errorf("Response from %s too short", server)
+			}
+			return resp[:n], nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("No response from %s: %s", server, ctx.Err())
+		default:
+		}
+		retransmit *= 2
+	}
+}
+
+// localIPFor returns our local IP for reaching the given host:port.
+func localIPFor(addr string) (net.IP, error) {
+	probe, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer probe.Close()
+	return probe.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+func ianaProtocol(proto string) byte {
+	if proto == "tcp" {
+		return 6
+	}
+	return 17
+}
+
+// defaultGateway finds the IPv4 default gateway from the kernel's routing
+// table, which only works on Linux.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to determine default gateway: %s", err)
+	}
+	defer f.Close()
+	return parseDefaultGateway(f)
+}
+
+// parseDefaultGateway parses the default gateway from the format of
+// /proc/net/route.
+func parseDefaultGateway(routes io.Reader) (net.IP, error) {
+	scanner := bufio.NewScanner(routes)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gateway == 0 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		// The routing table is in host byte order, which is little endian on
+		// everything that we run on
+		binary.LittleEndian.PutUint32(ip, uint32(gateway))
+		return ip, nil
+	}
+	return nil, fmt.Errorf("No default gateway found")
+}
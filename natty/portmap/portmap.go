@@ -0,0 +1,210 @@
+// Package portmap asks the local gateway to map ports, using PCP (RFC 6887),
+// NAT-PMP (RFC 6886) or UPnP IGD (v1 or v2), whichever the gateway supports.
+// A mapped port is reachable at the gateway's external address without any
+// hole punching. PCP and NAT-PMP are only tried on Linux, where we can find
+// the default gateway; UPnP gateways are discovered with SSDP anywhere.
+package portmap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+)
+
+const (
+	// The methods with which ports get mapped
+	PCP    = "PCP"
+	NATPMP = "NAT-PMP"
+	UPnP   = "UPnP"
+
+	// DefaultTimeout is how long Map tries if its context doesn't have a
+	// deadline, and how long each renewal tries.
+	DefaultTimeout = 3 * time.Second
+
+	// minRenewInterval keeps failing renewals from retrying in a tight loop.
+	minRenewInterval = 1 * time.Second
+)
+
+var (
+	log = golog.LoggerFor("natty.portmap")
+)
+
+// ExternalEndpoint is where a mapped port is reachable from outside.
+type ExternalEndpoint struct {
+	// Proto is udp or tcp.
+	Proto string
+
+	// IP and Port are the gateway's external address and the mapped port on
+	// it.
+	IP   net.IP
+	Port int
+
+	// Method is how the port was mapped: PCP, NAT-PMP or UPnP.
+	Method string
+
+	// Lifetime is how long the gateway keeps the mapping unless it's renewed,
+	// 0 if it keeps it indefinitely.
+	Lifetime time.Duration
+}
+
+// Addr returns the endpoint as host:port.
+func (e *ExternalEndpoint) Addr() string {
+	return net.JoinHostPort(e.IP.String(), strconv.Itoa(e.Port))
+}
+
+func (e *ExternalEndpoint) String() string {
+	return fmt.Sprintf("%s %s via %s", e.Proto, e.Addr(), e.Method)
+}
+
+// mapper maps a single port with a particular method.
+type mapper interface {
+	// add creates the mapping, or renews it if it exists, asking the gateway
+	// to keep it for lifetime.
+	add(ctx context.Context, lifetime time.Duration) (*ExternalEndpoint, error)
+
+	// remove removes the mapping from the gateway.
+	remove(ctx context.Context) error
+}
+
+// Map asks the gateway to map the given local port for the given protocol
+// (udp or tcp), trying PCP, then NAT-PMP, then UPnP, until ctx is done. The
+// mapping is renewed halfway through every lifetime that the gateway grants
+// until the returned unmap function is called, which removes it from the
+// gateway.
+func Map(ctx context.Context, proto string, internalPort int, lifetime time.Duration) (*ExternalEndpoint, func(), error) {
+	proto = strings.ToLower(proto)
+	if proto != "udp" && proto != "tcp" {
+		return nil, nil, fmt.Errorf("Unable to map %s ports, only udp and tcp", proto)
+	}
+	if internalPort <= 0 || internalPort > 65535 {
+		return nil, nil, fmt.Errorf("Invalid port %d", internalPort)
+	}
+	if lifetime < time.Second {
+		return nil, nil, fmt.Errorf("Invalid lifetime %s", lifetime)
+	}
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+
+	m, ep, err := mapAny(ctx, proto, internalPort, lifetime)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Debugf("Mapped local %s port %d to %s for %s", proto, internalPort, ep, ep.Lifetime)
+	r := &renewal{
+		mapper:   m,
+		endpoint: ep,
+		lifetime: lifetime,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go r.keepRenewed()
+	return ep, r.unmap, nil
+}
+
+// mapAny maps the port with the first method that works. PCP and NAT-PMP
+// share the first half of the time that ctx allows, since a gateway that
+// supports either answers quickly.
+func mapAny(ctx context.Context, proto string, internalPort int, lifetime time.Duration) (mapper, *ExternalEndpoint, error) {
+	var errs []string
+	server, err := gatewayServer()
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		deadline, _ := ctx.Deadline()
+		pmpCtx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Until(deadline)/2))
+		pcp := newPCPMapper(server, proto, internalPort)
+		ep, err := pcp.add(pmpCtx, lifetime)
+		if err == nil {
+			cancel()
+			return pcp, ep, nil
+		}
+		errs = append(errs, fmt.Sprintf("PCP failed: %s", err))
+		if pcp.unsupported {
+			pmp := newNATPMPMapper(server, proto, internalPort)
+			ep, err = pmp.add(pmpCtx, lifetime)
+			if err == nil {
+				cancel()
+				return pmp, ep, nil
+			}
+			errs = append(errs, fmt.Sprintf("NAT-PMP failed: %s", err))
+		}
+		cancel()
+	}
+
+	igd, err := discoverIGDMapper(ctx, proto, internalPort)
+	if err == nil {
+		var ep *ExternalEndpoint
+		ep, err = igd.add(ctx, lifetime)
+		if err == nil {
+			return igd, ep, nil
+		}
+	}
+	errs = append(errs, fmt.Sprintf("UPnP failed: %s", err))
+	return nil, nil, fmt.Errorf("Unable to map %s port %d: %s", proto, internalPort, strings.Join(errs, "; "))
+}
+
+// renewal keeps a mapping renewed until it's unmapped.
+type renewal struct {
+	mapper   mapper
+	endpoint *ExternalEndpoint // the endpoint that Map returned
+	lifetime time.Duration     // the requested lifetime
+	stopCh   chan struct{}     // closed to stop renewing
+	doneCh   chan struct{}     // closed once renewing has stopped
+	stopOnce sync.Once
+}
+
+func (r *renewal) keepRenewed() {
+	defer close(r.doneCh)
+	granted := r.endpoint.Lifetime
+	expires := time.Now().Add(granted)
+	for granted > 0 {
+		wait := time.Until(expires) / 2
+		if wait < minRenewInterval {
+			wait = minRenewInterval
+		}
+		select {
+		case <-r.stopCh:
+			return
+		case <-time.After(wait):
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		ep, err := r.mapper.add(ctx, r.lifetime)
+		cancel()
+		if err != nil {
+			log.Debugf("Unable to renew %s: %s", r.endpoint, err)
+			continue
+		}
+		if ep.Addr() != r.endpoint.Addr() {
+			log.Errorf("Gateway moved %s to %s while renewing", r.endpoint, ep.Addr())
+		}
+		granted = ep.Lifetime
+		expires = time.Now().Add(granted)
+	}
+	// The gateway keeps the mapping indefinitely
+	<-r.stopCh
+}
+
+// unmap stops renewing the mapping and removes it from the gateway.
+func (r *renewal) unmap() {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+		<-r.doneCh
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+		err := r.mapper.remove(ctx)
+		if err != nil {
+			log.Debugf("Unable to unmap %s: %s", r.endpoint, err)
+			return
+		}
+		log.Debugf("Unmapped %s", r.endpoint)
+	})
+}
@@ -0,0 +1,373 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestMapPCP(t *testing.T) {
+	gw := startFakePMP(t, true)
+	defer gw.close()
+	defer fakeGateway(gw.addr(), "127.0.0.1:1")()
+
+	ep, unmap, err := Map(context.Background(), "udp", 4000, 2*time.Second)
+	if !assert.NoError(t, err, "Should map with PCP") {
+		return
+	}
+	assert.Equal(t, PCP, ep.Method)
+	assert.Equal(t, "203.0.113.7:14000", ep.Addr())
+	assert.Equal(t, 2*time.Second, ep.Lifetime)
+
+	// Renewed halfway through the lifetime
+	time.Sleep(1500 * time.Millisecond)
+	unmap()
+	unmap()
+	assert.Equal(t, []string{
+		"PCP map udp 4000 lifetime 2",
+		"PCP map udp 4000 lifetime 2",
+		"PCP map udp 4000 lifetime 0",
+	}, gw.requests())
+	assert.True(t, gw.sameNonce(), "Renewals and removal should use the same nonce")
+}
+
+func TestMapNATPMP(t *testing.T) {
+	gw := startFakePMP(t, false)
+	defer gw.close()
+	defer fakeGateway(gw.addr(), "127.0.0.1:1")()
+
+	ep, unmap, err := Map(context.Background(), "TCP", 4000, time.Hour)
+	if !assert.NoError(t, err, "Should fall back to NAT-PMP") {
+		return
+	}
+	assert.Equal(t, NATPMP, ep.Method)
+	assert.Equal(t, "tcp", ep.Proto)
+	assert.Equal(t, "203.0.113.7:14000", ep.Addr())
+	unmap()
+	assert.Equal(t, []string{
+		"PCP map tcp 4000 lifetime 3600",
+		"NAT-PMP map tcp 4000 lifetime 3600",
+		"NAT-PMP map tcp 4000 lifetime 0",
+	}, gw.requests())
+}
+
+func TestMapUPnP(t *testing.T) {
+	for _, permanent := range []bool{false, true} {
+		silent := startFakePMP(t, false)
+		silent.setSilent()
+		igd := startFakeIGD(t, permanent)
+		restore := fakeGateway(silent.addr(), igd.ssdp.LocalAddr().String())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		ep, unmap, err := Map(ctx, "udp", 4000, time.Hour)
+		cancel()
+		if assert.NoError(t, err, "Should fall back to UPnP when PCP and NAT-PMP don't respond") {
+			assert.Equal(t, UPnP, ep.Method)
+			assert.Equal(t, "203.0.113.8:4000", ep.Addr())
+			unmap()
+			if permanent {
+				assert.Equal(t, time.Duration(0), ep.Lifetime, "Should settle for a permanent lease")
+				assert.Equal(t, []string{
+					"GetExternalIPAddress",
+					"AddPortMapping 4000 UDP 127.0.0.1 3600",
+					"AddPortMapping 4000 UDP 127.0.0.1 0",
+					"DeletePortMapping 4000 UDP",
+				}, igd.requests())
+			} else {
+				assert.Equal(t, time.Hour, ep.Lifetime)
+				assert.Equal(t, []string{
+					"GetExternalIPAddress",
+					"AddPortMapping 4000 UDP 127.0.0.1 3600",
+					"DeletePortMapping 4000 UDP",
+				}, igd.requests())
+			}
+		}
+		restore()
+		igd.close()
+		silent.close()
+	}
+}
+
+func TestMapUnavailable(t *testing.T) {
+	silent := startFakePMP(t, false)
+	silent.setSilent()
+	defer silent.close()
+	defer fakeGateway(silent.addr(), silent.addr())()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	_, _, err := Map(ctx, "udp", 4000, time.Hour)
+	assert.Error(t, err, "Mapping should fail without a gateway")
+	assert.True(t, time.Since(start) < time.Second, "Mapping should give up when the context is done")
+
+	_, _, err = Map(ctx, "sctp", 4000, time.Hour)
+	assert.Error(t, err, "Only udp and tcp should be supported")
+}
+
+func TestParseDefaultGateway(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0100A8C0	0003	0	0	0	00000000	0	0	0
+`
+	gateway, err := parseDefaultGateway(strings.NewReader(routes))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.168.0.1", gateway.String())
+	}
+	_, err = parseDefaultGateway(strings.NewReader("Iface	Destination	Gateway\n"))
+	assert.Error(t, err, "No default route")
+}
+
+// fakeGateway points PCP/NAT-PMP and SSDP at the given addresses, returning a
+// function that restores the defaults.
+func fakeGateway(pmp string, ssdp string) func() {
+	origPMP, origSSDP := gatewayServer, ssdpAddr
+	gatewayServer = func() (string, error) { return pmp, nil }
+	ssdpAddr = ssdp
+	return func() {
+		gatewayServer, ssdpAddr = origPMP, origSSDP
+	}
+}
+
+// fakePMP is a NAT-PMP gateway, optionally also supporting PCP, that maps
+// internal port p to external port p+10000 on 203.0.113.7.
+type fakePMP struct {
+	conn   *net.UDPConn
+	pcp    bool
+	silent bool
+	log    []string
+	nonces map[string]bool
+	mutex  sync.Mutex
+}
+
+func startFakePMP(t *testing.T, pcp bool) *fakePMP {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	gw := &fakePMP{conn: conn, pcp: pcp, nonces: make(map[string]bool)}
+	go gw.serve()
+	return gw
+}
+
+func (gw *fakePMP) addr() string {
+	return gw.conn.LocalAddr().String()
+}
+
+func (gw *fakePMP) close() {
+	gw.conn.Close()
+}
+
+func (gw *fakePMP) setSilent() {
+	gw.mutex.Lock()
+	gw.silent = true
+	gw.mutex.Unlock()
+}
+
+func (gw *fakePMP) record(entry string) {
+	gw.mutex.Lock()
+	gw.log = append(gw.log, entry)
+	gw.mutex.Unlock()
+}
+
+func (gw *fakePMP) requests() []string {
+	gw.mutex.Lock()
+	defer gw.mutex.Unlock()
+	return append([]string{}, gw.log...)
+}
+
+func (gw *fakePMP) sameNonce() bool {
+	gw.mutex.Lock()
+	defer gw.mutex.Unlock()
+	return len(gw.nonces) == 1
+}
+
+func (gw *fakePMP) serve() {
+	external := net.IPv4(203, 0, 113, 7)
+	b := make([]byte, 1100)
+	for {
+		n, addr, err := gw.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		gw.mutex.Lock()
+		silent := gw.silent
+		gw.mutex.Unlock()
+		if silent || n < 2 {
+			continue
+		}
+		switch {
+		case b[0] == pcpVersion && n >= pcpRequestSize:
+			proto := "udp"
+			if b[36] == 6 {
+				proto = "tcp"
+			}
+			lifetime := binary.BigEndian.Uint32(b[4:8])
+			internal := binary.BigEndian.Uint16(b[40:42])
+			gw.record(fmt.Sprintf("PCP map %s %d lifetime %d", proto, internal, lifetime))
+			if !gw.pcp {
+				resp := make([]byte, 8)
+				resp[1] = pmpResponse | pcpOpMap
+				resp[3] = pmpResultUnsupportedVersion
+				gw.conn.WriteToUDP(resp, addr)
+				continue
+			}
+			gw.mutex.Lock()
+			gw.nonces[string(b[24:36])] = true
+			gw.mutex.Unlock()
+			resp := make([]byte, pcpResponseSize)
+			resp[0] = pcpVersion
+			resp[1] = pmpResponse | pcpOpMap
+			binary.BigEndian.PutUint32(resp[4:], lifetime)
+			copy(resp[24:44], b[24:44])
+			binary.BigEndian.PutUint16(resp[42:], internal+10000)
+			copy(resp[44:], external.To16())
+			gw.conn.WriteToUDP(resp, addr)
+		case b[0] == natPMPVersion && b[1] == natPMPOpExternalAddress:
+			resp := make([]byte, 12)
+			resp[1] = pmpResponse | natPMPOpExternalAddress
+			copy(resp[8:], external.To4())
+			gw.conn.WriteToUDP(resp, addr)
+		case b[0] == natPMPVersion && n >= 12:
+			proto := "udp"
+			if b[1] == natPMPOpMapTCP {
+				proto = "tcp"
+			}
+			internal := binary.BigEndian.Uint16(b[4:6])
+			lifetime := binary.BigEndian.Uint32(b[8:12])
+			gw.record(fmt.Sprintf("NAT-PMP map %s %d lifetime %d", proto, internal, lifetime))
+			resp := make([]byte, 16)
+			resp[1] = pmpResponse | b[1]
+			binary.BigEndian.PutUint16(resp[8:], internal)
+			if lifetime > 0 {
+				binary.BigEndian.PutUint16(resp[10:], internal+10000)
+			}
+			binary.BigEndian.PutUint32(resp[12:], lifetime)
+			gw.conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+// fakeIGD is a UPnP gateway with an SSDP responder and an HTTP server for its
+// description and control URL. An IGDv2 gateway takes leases, an IGDv1 one
+// only takes permanent mappings.
+type fakeIGD struct {
+	ssdp  *net.UDPConn
+	http  *httptest.Server
+	log   []string
+	mutex sync.Mutex
+}
+
+func startFakeIGD(t *testing.T, permanentOnly bool) *fakeIGD {
+	ssdp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	version := "2"
+	if permanentOnly {
+		version = "1"
+	}
+	deviceType := "urn:schemas-upnp-org:device:InternetGatewayDevice:" + version
+	serviceType := "urn:schemas-upnp-org:service:WANIPConnection:" + version
+	igd := &fakeIGD{ssdp: ssdp}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(resp http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(resp, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>`+deviceType+`</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:`+version+`</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:`+version+`</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>`+serviceType+`</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(resp http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		body := string(b)
+		action := req.Header.Get("SOAPAction")
+		action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+		entry := action
+		lease := ""
+		for _, arg := range []string{"NewExternalPort", "NewProtocol", "NewInternalClient", "NewLeaseDuration"} {
+			if i := strings.Index(body, "<"+arg+">"); i >= 0 {
+				value := body[i+len(arg)+2:]
+				value = value[:strings.Index(value, "<")]
+				entry += " " + value
+				if arg == "NewLeaseDuration" {
+					lease = value
+				}
+			}
+		}
+		igd.mutex.Lock()
+		igd.log = append(igd.log, entry)
+		igd.mutex.Unlock()
+		if permanentOnly && lease != "" && lease != "0" {
+			resp.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(resp, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>
+<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode>
+<errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail>
+</s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+		fmt.Fprint(resp, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:`+action+`Response xmlns:u="`+serviceType+`">
+<NewExternalIPAddress>203.0.113.8</NewExternalIPAddress>
+</u:`+action+`Response></s:Body></s:Envelope>`)
+	})
+	igd.http = httptest.NewServer(mux)
+
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := ssdp.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if !strings.Contains(string(b[:n]), deviceType) {
+				continue
+			}
+			ssdp.WriteToUDP([]byte("HTTP/1.1 200 OK\r\n"+
+				"ST: "+deviceType+"\r\n"+
+				"LOCATION: "+igd.http.URL+"/desc.xml\r\n\r\n"), addr)
+		}
+	}()
+	return igd
+}
+
+func (igd *fakeIGD) requests() []string {
+	igd.mutex.Lock()
+	defer igd.mutex.Unlock()
+	return append([]string{}, igd.log...)
+}
+
+func (igd *fakeIGD) close() {
+	igd.ssdp.Close()
+	igd.http.Close()
+}
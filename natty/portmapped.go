@@ -0,0 +1,233 @@
+package natty
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/go-natty/natty/portmap"
+)
+
+const (
+	// portMapLifetime is how long to ask the gateway to keep a mapping, which
+	// is renewed for as long as the conn through it is open.
+	portMapLifetime = 10 * time.Minute
+
+	// portMapHelloInterval is how frequently the peer sends hellos to the
+	// mapped port until it hears back.
+	portMapHelloInterval = 100 * time.Millisecond
+
+	// portMapAckRepeats is how many times to acknowledge a hello, in case
+	// acknowledgements get lost.
+	portMapAckRepeats = 3
+
+	portMapMarker = `"type":"portmap"`
+)
+
+var (
+	// portMapTimeout is how long a Dialer waits for the gateway to map a port.
+	portMapTimeout = 2 * time.Second
+
+	// portMapConnectTimeout is how long to wait for the peer to connect to a
+	// mapped port before falling back to a traversal.
+	portMapConnectTimeout = 3 * time.Second
+
+	portMapHello = []byte("natty-portmap-hello")
+	portMapAck   = []byte("natty-portmap-ack")
+
+	// mapPort maps ports on the gateway
+	mapPort = portmap.Map
+)
+
+// portMapMsg tells the peer the external address of a mapped port.
+type portMapMsg struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+// isPortMapMsg indicates whether msg is a portMapMsg, returning its address.
+func isPortMapMsg(msg string) (string, bool) {
+	if !strings.Contains(msg, portMapMarker) {
+		return "", false
+	}
+	pm := &portMapMsg{}
+	err := json.Unmarshal([]byte(msg), pm)
+	if err != nil || pm.Address == "" {
+		return "", false
+	}
+	return pm.Address, true
+}
+
+// portMapped connects to the peer without a traversal, by asking the gateway
+// to map a port and telling the peer (through send) to send to it. This works
+// whenever our gateway supports PCP, NAT-PMP or UPnP, however restrictive the
+// peer's NAT is, because the peer sends first.
+func portMapped(ctx context.Context, peer string, send func(msg []byte) error, s sockets) (net.Conn, error) {
+	conn, err := s.listenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr().(*net.UDPAddr)
+	mapCtx, cancel := context.WithTimeout(ctx, portMapTimeout)
+	ep, unmap, err := mapPort(mapCtx, "udp", local.Port, portMapLifetime)
+	cancel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		unmap()
+		return nil, err
+	}
+	log.Debugf("Asking %s to connect to %s", peer, ep)
+	msg, _ := json.Marshal(&portMapMsg{Type: "portmap", Address: ep.Addr()})
+	err = send(append(getMsgBuf(), msg...))
+	if err != nil {
+		return fail(fmt.Errorf("Unable to send mapped address: %s", err))
+	}
+
+	from, err := awaitHello(ctx, conn, time.Now().Add(portMapConnectTimeout))
+	if err != nil {
+		return fail(fmt.Errorf("Peer didn't connect to %s: %s", ep.Addr(), err))
+	}
+	conn.Close()
+	return dialPortMapped(local, from, unmap, s)
+}
+
+// awaitHello waits on conn for the peer's hello until deadline or until ctx is
+// done, acknowledging the hello and returning the address that it came from.
+func awaitHello(ctx context.Context, conn *net.UDPConn, deadline time.Time) (*net.UDPAddr, error) {
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetReadDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock the read
+			conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	b := make([]byte, len(portMapHello))
+	for {
+		n, from, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(b[:n], portMapHello) {
+			continue
+		}
+		for i := 0; i < portMapAckRepeats; i++ {
+			conn.WriteToUDP(portMapAck, from)
+		}
+		return from, nil
+	}
+}
+
+// connectPortMapped connects to the port that the peer mapped at address (or
+// to any other port on which the peer awaits hellos), sending hellos until the
+// peer acknowledges one.
+func connectPortMapped(ctx context.Context, address string, s sockets) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.listenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(portMapConnectTimeout)
+	b := make([]byte, len(portMapAck))
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		_, err := conn.WriteToUDP(portMapHello, remote)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(portMapHelloInterval))
+		for {
+			n, from, err := conn.ReadFromUDP(b)
+			if err != nil {
+				break
+			}
+			if bytes.Equal(b[:n], portMapAck) {
+				local := conn.LocalAddr().(*net.UDPAddr)
+				conn.Close()
+				return dialPortMapped(local, from, nil, s)
+			}
+		}
+	}
+	return nil, fmt.Errorf("Peer's mapped port %s didn't answer", address)
+}
+
+// dialPortMapped dials a conn from local to remote once the handshake through
+// a mapped port is done. unmap, if set, removes the mapping once the conn is
+// closed.
+func dialPortMapped(local *net.UDPAddr, remote *net.UDPAddr, unmap func(), s sockets) (net.Conn, error) {
+	udpConn, err := s.dialUDP("udp", local, remote)
+	if err != nil {
+		if unmap != nil {
+			unmap()
+		}
+		return nil, fmt.Errorf("Unable to dial %s from %s: %s", remote, local, err)
+	}
+	log.Tracef("Connected from %s to %s through mapped port", local, remote)
+	c := &portMappedConn{UDPConn: udpConn, unmap: unmap}
+	c.keeper = NewConnKeeper(udpConn, nil, DetachKeepAliveInterval, func() {
+		udpConn.Close()
+	})
+	return c, nil
+}
+
+// portMappedConn is a conn to the peer through a mapped port, which keeps
+// itself alive like the conns from Detach do.
+type portMappedConn struct {
+	*net.UDPConn
+	keeper    *ConnKeeper
+	unmap     func()
+	closeOnce sync.Once
+}
+
+// Read reads the next packet that isn't a keepalive or left over from the
+// handshake.
+func (c *portMappedConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.UDPConn.Read(b)
+		if err != nil {
+			return n, err
+		}
+		c.keeper.Received()
+		packet := b[:n]
+		if !IsKeepAlive(packet) && !bytes.Equal(packet, portMapHello) && !bytes.Equal(packet, portMapAck) {
+			return n, nil
+		}
+	}
+}
+
+func (c *portMappedConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.keeper.Stop()
+		err = c.UDPConn.Close()
+		if c.unmap != nil {
+			c.unmap()
+		}
+	})
+	return err
+}
@@ -0,0 +1,88 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/go-natty/natty/portmap"
+	"github.com/getlantern/testify/assert"
+)
+
+// TestDialerPortMap connects through a gateway that maps ports to themselves
+// on localhost, so that no traversal is needed.
+func TestDialerPortMap(t *testing.T) {
+	var unmapped int32
+	defer func(orig func(context.Context, string, int, time.Duration) (*portmap.ExternalEndpoint, func(), error)) {
+		mapPort = orig
+	}(mapPort)
+	mapPort = func(ctx context.Context, proto string, internalPort int, lifetime time.Duration) (*portmap.ExternalEndpoint, func(), error) {
+		ep := &portmap.ExternalEndpoint{Proto: proto, IP: net.IPv4(127, 0, 0, 1), Port: internalPort, Method: portmap.PCP, Lifetime: lifetime}
+		return ep, func() { atomic.AddInt32(&unmapped, 1) }, nil
+	}
+
+	dialerSide := newChanSignaler()
+	serverSide := &chanSignaler{in: dialerSide.out, out: dialerSide.in}
+	listenerCh := make(chan net.Listener, 1)
+	go func() {
+		l, err := Serve(context.Background(), serverSide, 5*time.Second)
+		if assert.NoError(t, err, "Serve should connect through the mapped port") {
+			listenerCh <- l
+		}
+	}()
+
+	d := &Dialer{
+		Signaling: func(ctx context.Context, peer string) (Signaler, error) {
+			return dialerSide, nil
+		},
+		PortMap: true,
+	}
+	conn, err := d.Dial("tcp", "peer:80")
+	if !assert.NoError(t, err, "Should connect without a traversal") {
+		return
+	}
+	var l net.Listener
+	select {
+	case l = <-listenerCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return")
+	}
+	defer l.Close()
+
+	go func() {
+		st, err := l.Accept()
+		if err == nil {
+			fmt.Fprint(st, "hello through mapped port")
+			st.Close()
+		}
+	}()
+	conn.Write([]byte("hi"))
+	b, err := ioutil.ReadAll(conn)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello through mapped port", string(b))
+	}
+	conn.Close()
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&unmapped), "Mapping should stay while connected")
+	d.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&unmapped), "Closing should unmap")
+}
+
+func TestPortMappedNoPeer(t *testing.T) {
+	defer func(timeout time.Duration) { portMapConnectTimeout = timeout }(portMapConnectTimeout)
+	portMapConnectTimeout = 200 * time.Millisecond
+
+	_, err := connectPortMapped(context.Background(), "127.0.0.1:1", sockets{})
+	assert.Error(t, err, "Shouldn't connect to a port nobody answers on")
+
+	msg := `{"type":"portmap","address":"203.0.113.7:14000"}`
+	address, ok := isPortMapMsg(msg)
+	assert.True(t, ok)
+	assert.Equal(t, "203.0.113.7:14000", address)
+	_, ok = isPortMapMsg(testSDP)
+	assert.False(t, ok, "Natty messages shouldn't parse as portmap")
+}
@@ -0,0 +1,102 @@
+package natty
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxPriority is the highest legal ICE candidate priority (RFC 8445
+	// section 5.1.2).
+	maxPriority = 1<<31 - 1
+
+	// familyPreferenceBit is the top bit of the local preference in a
+	// candidate priority (RFC 8445 section 5.1.2.1), which WithIPPreference
+	// sets for the preferred IP version and clears for the other, leaving the
+	// type preference alone.
+	familyPreferenceBit = 1 << 23
+)
+
+var (
+	// candidateAttrPattern matches candidate attributes in messages from
+	// natty, whether trickled or in a session description, up to the end of
+	// the JSON string or the escaped line break.
+	candidateAttrPattern = regexp.MustCompile(`candidate:[^"\\]+`)
+)
+
+// PriorityFunc returns the ICE priority to use for one of our candidates
+// instead of the one natty computed, or false to keep natty's.
+type PriorityFunc func(c Candidate) (priority uint32, ok bool)
+
+// overridePriorities rewrites the priorities of the candidates in msg, an
+// outbound message from natty, per the IP preference and then the
+// PriorityFunc. It returns msg itself if nothing changed.
+func (t *Traversal) overridePriorities(msg []byte) []byte {
+	if t.priorityOverride == nil && t.ipPreference == IPAny || !bytes.Contains(msg, []byte("candidate:")) {
+		return msg
+	}
+	changed := false
+	rewritten := candidateAttrPattern.ReplaceAllFunc(msg, func(attr []byte) []byte {
+		c, err := parseCandidate(string(attr))
+		if err != nil {
+			return attr
+		}
+		original := c.Priority
+		if t.ipPreference != IPAny {
+			c.Priority = preferIPVersion(*c, t.ipPreference)
+		}
+		if t.priorityOverride != nil {
+			priority, ok := t.priorityOverride(*c)
+			if ok {
+				c.Priority = priority
+			}
+		}
+		priority := legalPriority(c.Priority)
+		if priority == original {
+			return attr
+		}
+		// Only touch the priority, so that extensions like generation and
+		// ufrag pass through
+		parts := strings.SplitN(string(attr), " ", 5)
+		parts[3] = strconv.FormatUint(uint64(priority), 10)
+		changed = true
+		t.log().Tracef("Overriding priority of %s candidate %s: %d -> %d", c.Type, c.Address, original, priority)
+		return []byte(strings.Join(parts, " "))
+	})
+	if !changed {
+		return msg
+	}
+	return append(msg[:0], rewritten...)
+}
+
+// preferIPVersion returns c's priority adjusted to prefer candidates of the
+// given IP version over those of the other one with the same type.
+func preferIPVersion(c Candidate, version IPVersion) uint32 {
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return c.Priority
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return c.Priority
+	}
+	ipv6 := ip.To4() == nil
+	if ipv6 == (version == IPv6) {
+		return c.Priority | familyPreferenceBit
+	}
+	return c.Priority &^ familyPreferenceBit
+}
+
+// legalPriority clamps priority to the range that ICE allows.
+func legalPriority(priority uint32) uint32 {
+	if priority < 1 {
+		return 1
+	}
+	if priority > maxPriority {
+		return maxPriority
+	}
+	return priority
+}
@@ -0,0 +1,116 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestPriorityOverride(t *testing.T) {
+	tr := newTraversal(0, []Option{WithPriorityOverride(func(c Candidate) (uint32, bool) {
+		switch {
+		case strings.HasPrefix(c.Address, "10.8."):
+			return 1<<32 - 1, true
+		case c.Type == "relay":
+			return 0, true
+		}
+		return 0, false
+	})})
+
+	trickled := `{"candidate":"candidate:1 1 udp 2122260223 10.8.0.2 55285 typ host generation 0 ufrag abcd","sdpMid":"data","sdpMLineIndex":0}`
+	msg := tr.overridePriorities(append(getMsgBuf(), trickled...))
+	assert.Equal(t, `{"candidate":"candidate:1 1 udp 2147483647 10.8.0.2 55285 typ host generation 0 ufrag abcd","sdpMid":"data","sdpMLineIndex":0}`, string(msg), "Priority should be clamped, everything else kept")
+
+	sdp := `{"type":"offer","sdp":"v=0\r\na=candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host generation 0\r\na=candidate:3 1 udp 41885439 203.0.113.9 3478 typ relay raddr 203.0.113.7 rport 55285\r\n"}`
+	msg = tr.overridePriorities(append(getMsgBuf(), sdp...))
+	assert.Equal(t, `{"type":"offer","sdp":"v=0\r\na=candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host generation 0\r\na=candidate:3 1 udp 1 203.0.113.9 3478 typ relay raddr 203.0.113.7 rport 55285\r\n"}`, string(msg))
+
+	tr.gathering.track(msg)
+	local, _ := tr.gathering.result()
+	priorities := localPriorities(local)
+	assert.Equal(t, uint32(2122260223), priorities["192.168.1.160:55285"])
+	assert.Equal(t, uint32(1), priorities["203.0.113.9:3478"], "Pair report should reflect override")
+
+	unchanged := `{"type":"answer","sdp":"v=0\r\n"}`
+	assert.Equal(t, unchanged, string(tr.overridePriorities([]byte(unchanged))))
+}
+
+func TestIPPreference(t *testing.T) {
+	tr := newTraversal(0, []Option{WithIPPreference(IPv6)})
+	sdp := `{"type":"offer","sdp":"v=0\r\na=candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host\r\na=candidate:2 1 udp 2122197247 2001:db8::7 55286 typ host\r\na=candidate:3 1 udp 1686052607 203.0.113.7 55285 typ srflx raddr 192.168.1.160 rport 55285\r\n"}`
+	tr.gathering.track(tr.overridePriorities(append(getMsgBuf(), sdp...)))
+	local, _ := tr.gathering.result()
+	priorities := localPriorities(local)
+	v4, v6, srflx := priorities["192.168.1.160:55285"], priorities["[2001:db8::7]:55286"], priorities["203.0.113.7:55285"]
+	assert.True(t, v6 > v4, "IPv6 host should beat IPv4 host")
+	assert.True(t, v4 > srflx, "Types should still come first")
+	assert.Equal(t, uint32(2122260223)>>24, v4>>24, "Type preference should be unchanged")
+
+	// The PriorityFunc gets the last word
+	tr = newTraversal(0, []Option{WithIPPreference(IPv4), WithPriorityOverride(func(c Candidate) (uint32, bool) {
+		if c.Address == "[2001:db8::7]:55286" {
+			return c.Priority + 1, true
+		}
+		return 0, false
+	})})
+	tr.gathering.track(tr.overridePriorities(append(getMsgBuf(), sdp...)))
+	local, _ = tr.gathering.result()
+	priorities = localPriorities(local)
+	assert.True(t, priorities["192.168.1.160:55285"] > priorities["[2001:db8::7]:55286"], "IPv4 host should beat IPv6 host")
+	assert.Equal(t, preferIPVersion(Candidate{Address: "[2001:db8::7]:55286", Priority: 2122197247}, IPv4)+1, priorities["[2001:db8::7]:55286"])
+}
+
+// TestPriorityOverrideNomination runs a local traversal on a host with at
+// least two IPv4 interfaces, with both peers preferring the one that would
+// otherwise lose, and makes sure that its pair gets nominated.
+func TestPriorityOverrideNomination(t *testing.T) {
+	var ips []net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	if len(ips) < 2 {
+		t.Skip("Need two IPv4 interfaces")
+	}
+	preferred := ips[len(ips)-1].String()
+	prefer := WithPriorityOverride(func(c Candidate) (uint32, bool) {
+		host, _, _ := net.SplitHostPort(c.Address)
+		if c.Type == "host" && host == preferred {
+			return maxPriority, true
+		}
+		return 0, false
+	})
+
+	offer := Offer(0, prefer)
+	defer offer.Close()
+	answer := Answer(15*time.Second, prefer)
+	defer answer.Close()
+	relay := func(from *Traversal, to *Traversal) {
+		for {
+			msg, done := from.NextMsgOut()
+			if done {
+				return
+			}
+			to.MsgIn(msg)
+		}
+	}
+	go relay(offer, answer)
+	go relay(answer, offer)
+
+	ft, err := offer.FiveTuple()
+	if !assert.NoError(t, err) {
+		return
+	}
+	host, _, _ := net.SplitHostPort(ft.Local)
+	assert.Equal(t, preferred, host, fmt.Sprintf("Pair on preferred interface should have been nominated, got %s", ft))
+	pairs := offer.Result().Pairs
+	if assert.Len(t, pairs, 1) {
+		assert.Equal(t, uint32(maxPriority), pairs[0].LocalPriority)
+	}
+}
@@ -0,0 +1,147 @@
+package natty
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultProbeTimeout is how long ProbeTuple waits for a reply if ctx has
+	// no deadline.
+	DefaultProbeTimeout = 2 * time.Second
+
+	// tupleProbeInterval is how often ProbeTuple resends its probe.
+	tupleProbeInterval = 200 * time.Millisecond
+)
+
+var (
+	tupleProbe    = []byte("natty-tuple-probe:")
+	tupleProbeAck = []byte("natty-tuple-probe-ack:")
+
+	// ErrProbeBind means that ProbeTuple couldn't bind the local address of
+	// the FiveTuple, for example because the application still has it open.
+	ErrProbeBind = errors.New("Unable to bind local address to probe")
+
+	// ErrProbeNoReply means that ProbeTuple sent probes but got no reply,
+	// because the NAT dropped the mapping or the peer is gone (or doesn't run
+	// a ProbeResponder).
+	ErrProbeNoReply = errors.New("No reply to probe")
+)
+
+// ProbeError is what ProbeTuple fails with. Err is ErrProbeBind or
+// ErrProbeNoReply.
+type ProbeError struct {
+	Err    error
+	Detail string
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Err, e.Detail)
+}
+
+// Unwrap returns Err, so that errors.Is tells the outcomes apart.
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// ProbeTuple checks whether a previously established UDP FiveTuple still
+// works, without signaling, to decide whether a new traversal is needed. It
+// binds the FiveTuple's local address and sends small probes to the remote
+// one until the peer reflects one, returning nil, or ctx is done
+// (DefaultProbeTimeout if it has no deadline), returning a *ProbeError with
+// ErrProbeNoReply. If it can't bind the local address, it fails right away
+// with ErrProbeBind. The peer needs to read from its end through a
+// ProbeResponder, which conns from Detach do. Options apply like they do to a
+// Traversal, for example WithBindToDevice.
+func ProbeTuple(ctx context.Context, ft *FiveTuple, opts ...Option) error {
+	if ft.Proto != UDP {
+		return fmt.Errorf("Unable to probe %s FiveTuple, only udp is supported", ft.Proto)
+	}
+	local, remote, err := ft.UDPAddrs()
+	if err != nil {
+		return err
+	}
+	conn, err := socketsFor(opts).dialUDP("udp", local, remote)
+	if err != nil {
+		return &ProbeError{ErrProbeBind, err.Error()}
+	}
+	defer conn.Close()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultProbeTimeout)
+		defer cancel()
+	}
+	return probeConn(ctx, conn)
+}
+
+// probeConn probes the peer at the other end of conn until it replies or ctx
+// is done.
+func probeConn(ctx context.Context, conn net.Conn) error {
+	defer conn.SetReadDeadline(time.Time{})
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	id := binary.BigEndian.Uint64(nonce[:])
+	probe := probePacket(tupleProbe, id)
+	b := make([]byte, len(tupleProbeAck)+8)
+	for ctx.Err() == nil {
+		_, err := conn.Write(probe)
+		if err != nil {
+			// Typically ICMP unreachable from a previous probe
+			log.Tracef("Unable to send probe to %s: %s", conn.RemoteAddr(), err)
+		}
+		deadline := time.Now().Add(tupleProbeInterval)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				break
+			}
+			if ackID, ok := probeId(b[:n], tupleProbeAck); ok && ackID == id {
+				return nil
+			}
+		}
+	}
+	return &ProbeError{ErrProbeNoReply, fmt.Sprintf("%s didn't answer from %s: %s", conn.RemoteAddr(), conn.LocalAddr(), ctx.Err())}
+}
+
+// ProbeResponder wraps conn, on which the application exchanges traffic with
+// the peer, so that it answers the peer's ProbeTuple. Probes aren't returned
+// from Read, everything else passes through. Only packets with the probe's
+// magic prefix are touched.
+func ProbeResponder(conn net.Conn) net.Conn {
+	return &probeResponder{conn}
+}
+
+type probeResponder struct {
+	net.Conn
+}
+
+func (r *probeResponder) Read(b []byte) (int, error) {
+	for {
+		n, err := r.Conn.Read(b)
+		if err != nil || !answerTupleProbe(r.Conn, b[:n]) {
+			return n, err
+		}
+	}
+}
+
+// answerTupleProbe reflects packet back through conn if it's a probe from
+// ProbeTuple, returning whether it was one.
+func answerTupleProbe(conn net.Conn, packet []byte) bool {
+	if !bytes.HasPrefix(packet, tupleProbe) {
+		return false
+	}
+	if id, ok := probeId(packet, tupleProbe); ok {
+		conn.Write(probePacket(tupleProbeAck, id))
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package natty
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestProbeTuple(t *testing.T) {
+	local, remote := freeLocalAddr(t), freeLocalAddr(t)
+	ft := &FiveTuple{Proto: UDP, Local: local, Remote: remote}
+
+	// Alive
+	peerLocal, peerRemote, _ := (&FiveTuple{Proto: UDP, Local: remote, Remote: local}).UDPAddrs()
+	peerConn, err := net.DialUDP("udp", peerLocal, peerRemote)
+	if !assert.NoError(t, err) {
+		return
+	}
+	peer := ProbeResponder(peerConn)
+	received := make(chan string, 10)
+	go func() {
+		b := make([]byte, 100)
+		for {
+			n, err := peer.Read(b)
+			if err != nil {
+				return
+			}
+			received <- string(b[:n])
+		}
+	}()
+	assert.NoError(t, ProbeTuple(context.Background(), ft), "Peer should have answered")
+	select {
+	case msg := <-received:
+		t.Errorf("Probe shouldn't have reached the application: %s", msg)
+	default:
+	}
+
+	// Sent but no reply
+	peerConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = ProbeTuple(ctx, ft)
+	assert.True(t, errors.Is(err, ErrProbeNoReply), "Should have got no reply")
+	assert.True(t, time.Since(start) < time.Second, "Should give up with ctx")
+
+	// No local bind possible
+	laddr, _, _ := ft.UDPAddrs()
+	holder, err := net.ListenUDP("udp", laddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer holder.Close()
+	err = ProbeTuple(context.Background(), ft)
+	assert.True(t, errors.Is(err, ErrProbeBind), "Should have been unable to bind")
+	_, ok := err.(*ProbeError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,206 @@
+package natty
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPunchDelay is a reasonable delay for WithPunchCoordination. It
+	// needs to cover a signaling round trip, or the answerer starts late.
+	DefaultPunchDelay = 300 * time.Millisecond
+
+	// punchVersion is the version of the punch coordination protocol
+	punchVersion = 1
+
+	// the steps of punch coordination
+	punchHello   = "hello"   // offerer: I can coordinate
+	punchPropose = "propose" // answerer: let's start checks delay after you get this
+	punchAck     = "ack"     // offerer: got the proposal
+	punchStarted = "started" // either: I've started checks
+
+	punchMarker = `"type":"punch"`
+)
+
+// punchMsg is a message of the punch coordination protocol.
+type punchMsg struct {
+	Type    string `json:"type"`
+	Version int    `json:"v"`
+	Step    string `json:"step"`
+	DelayMS int64  `json:"delay,omitempty"`
+}
+
+// punchSync gets both peers to start their connectivity checks at about
+// the same time, by holding back the peer's trickled candidates from natty
+// until an agreed moment. Since natty can't check pairs without the peer's
+// candidates, that's when its checks start.
+//
+// The offerer announces that it can coordinate with a hello before its offer.
+// If the answerer can too, it proposes to start checks delay after the offerer
+// gets the proposal, and the offerer acknowledges. The offerer starts delay
+// after getting the proposal, and the answerer delay plus half the round trip
+// (as measured from proposal to acknowledgement) after sending it, which
+// doesn't require synchronized clocks. If either side doesn't coordinate,
+// candidates aren't held back at all. Each side tells the other when it
+// started, from which it estimates the skew between their starts.
+type punchSync struct {
+	delay         time.Duration    // how long to wait before starting checks, 0 to not coordinate
+	offering      bool             // whether we're the offerer
+	send          func(msg []byte) // sends a message to the peer
+	deliver       func(msg []byte) // passes a message from the peer on to natty, taking ownership of it
+	mutex         sync.Mutex       // serializes deliveries, so that held messages stay in order
+	helloAt       time.Time        // when the offerer sent its hello
+	proposedAt    time.Time        // when the answerer sent its proposal
+	rtt           time.Duration    // signaling round trip
+	holding       bool             // whether to hold back candidates until startedAt
+	held          [][]byte         // candidates held back
+	timer         *time.Timer      // starts checks
+	startedAt     time.Time        // when we started checks
+	peerStartedAt time.Time        // when the peer started checks, estimated
+	skew          time.Duration    // how far apart we and the peer started
+	measured      bool             // whether skew is known
+}
+
+// reset forgets about the last coordination, so that natty's next run
+// coordinates anew.
+func (ps *punchSync) reset() {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.timer != nil {
+		ps.timer.Stop()
+		ps.timer = nil
+	}
+	for _, msg := range ps.held {
+		putMsgBuf(msg)
+	}
+	ps.held = nil
+	ps.holding = false
+	ps.helloAt, ps.proposedAt, ps.startedAt, ps.peerStartedAt = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	ps.rtt, ps.skew, ps.measured = 0, 0, false
+}
+
+// outbound looks at a message from natty before it's sent to the peer,
+// announcing that we can coordinate ahead of the offer.
+func (ps *punchSync) outbound(msg []byte) {
+	if ps.delay <= 0 || !ps.offering || sdpRole(msg) != roleOfferer {
+		return
+	}
+	ps.mutex.Lock()
+	first := ps.helloAt.IsZero()
+	if first {
+		ps.helloAt = time.Now()
+	}
+	ps.mutex.Unlock()
+	if first {
+		ps.sendStep(punchHello, 0)
+	}
+}
+
+// inbound looks at a message from the peer before it goes to natty, returning
+// true if it took ownership of it, either because it's a punch coordination
+// message or because it's a candidate being held back. Otherwise, the caller
+// should deliver the message itself.
+func (ps *punchSync) inbound(msg []byte) bool {
+	if bytes.Contains(msg, []byte(punchMarker)) {
+		pm := &punchMsg{}
+		err := json.Unmarshal(msg, pm)
+		putMsgBuf(msg)
+		if err != nil {
+			log.Debugf("Ignoring unparseable punch coordination message: %s", err)
+		} else {
+			ps.handle(pm)
+		}
+		return true
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.holding && ps.startedAt.IsZero() && isCandidate(msg) {
+		ps.held = append(ps.held, msg)
+		return true
+	}
+	if !ps.holding {
+		return false
+	}
+	// Deliver while holding the mutex so that it can't overtake held messages
+	ps.deliver(msg)
+	return true
+}
+
+func (ps *punchSync) handle(pm *punchMsg) {
+	if pm.Version < punchVersion {
+		log.Debugf("Ignoring punch coordination version %d", pm.Version)
+		return
+	}
+	now := time.Now()
+	ps.mutex.Lock()
+	switch {
+	case pm.Step == punchHello && !ps.offering && ps.delay > 0 && ps.proposedAt.IsZero():
+		ps.proposedAt = now
+		ps.holding = true
+		// In case the acknowledgement doesn't come
+		ps.timer = time.AfterFunc(2*ps.delay, ps.start)
+		ps.mutex.Unlock()
+		ps.sendStep(punchPropose, ps.delay)
+		return
+	case pm.Step == punchPropose && ps.offering && !ps.helloAt.IsZero() && !ps.holding:
+		ps.rtt = now.Sub(ps.helloAt)
+		ps.holding = true
+		ps.timer = time.AfterFunc(time.Duration(pm.DelayMS)*time.Millisecond, ps.start)
+		ps.mutex.Unlock()
+		ps.sendStep(punchAck, 0)
+		return
+	case pm.Step == punchAck && !ps.offering && ps.timer != nil && ps.startedAt.IsZero():
+		ps.rtt = now.Sub(ps.proposedAt)
+		ps.timer.Reset(time.Until(ps.proposedAt.Add(ps.delay + ps.rtt/2)))
+	case pm.Step == punchStarted && ps.holding:
+		ps.peerStartedAt = now.Add(-ps.rtt / 2)
+		ps.measureSkew()
+	}
+	ps.mutex.Unlock()
+}
+
+// start starts connectivity checks by passing the held candidates on to natty.
+func (ps *punchSync) start() {
+	ps.mutex.Lock()
+	if !ps.startedAt.IsZero() {
+		ps.mutex.Unlock()
+		return
+	}
+	ps.startedAt = time.Now()
+	log.Tracef("Starting connectivity checks with %d held candidates", len(ps.held))
+	for _, msg := range ps.held {
+		ps.deliver(msg)
+	}
+	ps.held = nil
+	ps.measureSkew()
+	ps.mutex.Unlock()
+	ps.sendStep(punchStarted, 0)
+}
+
+// measureSkew measures the skew once we know when both sides started. The
+// caller must hold the mutex.
+func (ps *punchSync) measureSkew() {
+	if ps.startedAt.IsZero() || ps.peerStartedAt.IsZero() {
+		return
+	}
+	ps.skew = ps.startedAt.Sub(ps.peerStartedAt)
+	if ps.skew < 0 {
+		ps.skew = -ps.skew
+	}
+	ps.measured = true
+}
+
+// startSkew returns the skew between our start and the peer's, if known.
+func (ps *punchSync) startSkew() (time.Duration, bool) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.skew, ps.measured
+}
+
+func (ps *punchSync) sendStep(step string, delay time.Duration) {
+	msg, _ := json.Marshal(&punchMsg{Type: "punch", Version: punchVersion, Step: step, DelayMS: int64(delay / time.Millisecond)})
+	ps.send(msg)
+}
@@ -0,0 +1,132 @@
+package natty
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+const (
+	testAnswer = `{"type":"answer","sdp":"v=0"}`
+)
+
+func TestPunchCoordination(t *testing.T) {
+	latency := 100 * time.Millisecond
+	uncoordinated, offerer, answerer := simulatePunch(t, latency, 0, 0)
+	assert.True(t, uncoordinated >= latency*8/10, "Without coordination, the answerer should start about one signaling latency early")
+	_, measured := offerer.startSkew()
+	assert.False(t, measured, "Shouldn't have measured skew without coordination")
+
+	coordinated, offerer, answerer := simulatePunch(t, latency, 200*time.Millisecond, 200*time.Millisecond)
+	assert.True(t, coordinated < latency/2, "Coordination should shrink the skew")
+	for _, ps := range []*punchSync{offerer, answerer} {
+		skew, measured := ps.startSkew()
+		assert.True(t, measured, "Should have measured skew")
+		assert.True(t, skew < latency/2, "Measured skew should be small")
+	}
+
+	// Only the offerer coordinates
+	degraded, offerer, _ := simulatePunch(t, latency, 200*time.Millisecond, 0)
+	assert.True(t, degraded >= latency*8/10, "Should proceed as usual if the answerer doesn't coordinate")
+	_, measured = offerer.startSkew()
+	assert.False(t, measured, "Shouldn't have measured skew without the answerer coordinating")
+}
+
+// simulatePunch simulates the signaling of two peers with the given signaling
+// latency and punch delays, returning how far apart they'd start checks.
+func simulatePunch(t *testing.T, latency time.Duration, offererDelay time.Duration, answererDelay time.Duration) (time.Duration, *punchSync, *punchSync) {
+	offerer := &punchPeer{}
+	answerer := &punchPeer{}
+	offerer.init(answerer, latency, offererDelay, true, nil)
+	answerer.init(offerer, latency, answererDelay, false, func(msg []byte) {
+		// natty answers the offer and trickles a candidate
+		if sdpRole(msg) == roleOfferer {
+			answerer.send([]byte(testAnswer))
+			answerer.send([]byte(testCandidate))
+		}
+	})
+
+	offerer.ps.outbound([]byte(testSDP))
+	offerer.send([]byte(testSDP))
+	offerer.send([]byte(testCandidate))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		offererStart, answererStart := offerer.started(), answerer.started()
+		_, measured := answerer.ps.startSkew()
+		if !offererStart.IsZero() && !answererStart.IsZero() && (measured || answererDelay == 0) {
+			// Give the last messages time to arrive
+			time.Sleep(2 * latency)
+			skew := offererStart.Sub(answererStart)
+			if skew < 0 {
+				skew = -skew
+			}
+			return skew, &offerer.ps, &answerer.ps
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Peers didn't start checks")
+	return 0, nil, nil
+}
+
+// punchPeer is a peer in a simulated traversal, which starts checks when it
+// gets the first candidate from the peer.
+type punchPeer struct {
+	ps      punchSync
+	link    chan *delayedMsg
+	onMsg   func(msg []byte)
+	startAt time.Time
+	mutex   sync.Mutex
+	latency time.Duration
+}
+
+type delayedMsg struct {
+	msg []byte
+	at  time.Time
+}
+
+func (p *punchPeer) init(peer *punchPeer, latency time.Duration, delay time.Duration, offering bool, onMsg func(msg []byte)) {
+	p.latency = latency
+	p.onMsg = onMsg
+	p.link = make(chan *delayedMsg, 100)
+	p.ps.delay = delay
+	p.ps.offering = offering
+	p.ps.send = p.send
+	p.ps.deliver = p.deliver
+	go func() {
+		for dm := range p.link {
+			time.Sleep(time.Until(dm.at))
+			if !peer.ps.inbound(dm.msg) {
+				peer.deliver(dm.msg)
+			}
+		}
+	}()
+}
+
+// send sends msg to the peer, with latency.
+func (p *punchPeer) send(msg []byte) {
+	p.link <- &delayedMsg{append(getMsgBuf(), msg...), time.Now().Add(p.latency)}
+}
+
+// deliver is natty getting a message from the peer.
+func (p *punchPeer) deliver(msg []byte) {
+	if isCandidate(msg) {
+		p.mutex.Lock()
+		if p.startAt.IsZero() {
+			p.startAt = time.Now()
+		}
+		p.mutex.Unlock()
+	}
+	if p.onMsg != nil {
+		p.onMsg(msg)
+	}
+	putMsgBuf(msg)
+}
+
+func (p *punchPeer) started() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.startAt
+}
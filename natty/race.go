@@ -0,0 +1,421 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRaceHeadStart is how long a racing Dialer lets IPv6 try before
+	// also trying IPv4, if its RaceHeadStart isn't set.
+	DefaultRaceHeadStart = 250 * time.Millisecond
+
+	// raceWonMsg is the message with which the offerer tells the answerer
+	// which session of a race it's using, tagged with that session.
+	raceWonMsg = `{"type":"raceWon"}`
+)
+
+// RaceResult describes how a race between IPv6 and IPv4 traversals went.
+type RaceResult struct {
+	// Winner is the IP version of the traversal that connected first.
+	Winner IPVersion
+
+	// Elapsed is how long it took from the start of the race until the
+	// winner connected.
+	Elapsed time.Duration
+
+	// Margin is how long the other traversal had been running without
+	// connecting by the time the winner did, after which it was cancelled. It's
+	// 0 if the other traversal hadn't started yet or had already failed.
+	Margin time.Duration
+
+	// LoserErr is the error with which the other traversal failed, if it did
+	// so before the winner connected.
+	LoserErr error
+}
+
+func (r *RaceResult) String() string {
+	if r.LoserErr != nil {
+		return fmt.Sprintf("IPv%s won after %s, other failed: %s", r.Winner, r.Elapsed, r.LoserErr)
+	}
+	return fmt.Sprintf("IPv%s won after %s by at least %s", r.Winner, r.Elapsed, r.Margin)
+}
+
+// raceSession is the session tag that namespaces the signaling of the
+// traversal for the given IP version in a race.
+func raceSession(version IPVersion) string {
+	return "v" + version.String()
+}
+
+// raceVersion is the IP version of the race traversal with the given session
+// tag, if it is one.
+func raceVersion(session string) (IPVersion, bool) {
+	switch session {
+	case raceSession(IPv6):
+		return IPv6, true
+	case raceSession(IPv4):
+		return IPv4, true
+	}
+	return IPAny, false
+}
+
+// raceFamilies races connect for IPv6 against connect for IPv4, returning the
+// conn of whichever succeeds first. IPv4 starts after headStart, or as soon as
+// IPv6 fails. The loser's context is cancelled once there's a winner, and if
+// it connects anyway, its conn is closed.
+func raceFamilies(ctx context.Context, headStart time.Duration, connect func(ctx context.Context, version IPVersion) (net.Conn, error)) (net.Conn, *RaceResult, error) {
+	type outcome struct {
+		version IPVersion
+		conn    net.Conn
+		err     error
+	}
+
+	start := time.Now()
+	outcomes := make(chan *outcome, 2)
+	started := make(map[IPVersion]time.Time)
+	errs := make(map[IPVersion]error)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	launch := func(version IPVersion) {
+		started[version] = time.Now()
+		go func() {
+			conn, err := connect(ctx, version)
+			outcomes <- &outcome{version, conn, err}
+		}()
+	}
+
+	launch(IPv6)
+	headStartTimer := time.NewTimer(headStart)
+	defer headStartTimer.Stop()
+	for {
+		select {
+		case <-headStartTimer.C:
+			if started[IPv4].IsZero() {
+				launch(IPv4)
+			}
+		case o := <-outcomes:
+			if o.err != nil {
+				errs[o.version] = o.err
+				if started[IPv4].IsZero() {
+					// Don't make IPv4 wait for a head start that's over
+					launch(IPv4)
+				} else if len(errs) == len(started) {
+					return nil, nil, fmt.Errorf("IPv6 failed: %s, IPv4 failed: %s", errs[IPv6], errs[IPv4])
+				}
+				continue
+			}
+
+			result := &RaceResult{Winner: o.version, Elapsed: time.Since(start)}
+			loser := IPv6
+			if o.version == IPv6 {
+				loser = IPv4
+			}
+			if err := errs[loser]; err != nil {
+				result.LoserErr = err
+			} else if loserStarted := started[loser]; !loserStarted.IsZero() {
+				result.Margin = time.Since(loserStarted)
+				go func() {
+					lo := <-outcomes
+					if lo.conn != nil {
+						lo.conn.Close()
+					}
+				}()
+			}
+			return o.conn, result, nil
+		}
+	}
+}
+
+// race runs an IPv6 and an IPv4 traversal to the given peer, both signaling
+// through signaler, and returns a conn on the result of whichever connects
+// first.
+func (d *Dialer) race(ctx context.Context, peer string, signaler Signaler) (net.Conn, error) {
+	defer signaler.Close()
+	mux := newSignalMux(signaler, nil, nil)
+	defer mux.close()
+
+	conn, result, err := raceFamilies(ctx, d.raceHeadStart(), func(ctx context.Context, version IPVersion) (net.Conn, error) {
+		opts := append(append([]Option{}, d.Options...), WithIPVersion(version), WithSessionTag(raceSession(version)))
+		t := OfferContext(ctx, d.timeout(), opts...)
+		defer t.Close()
+		mux.add(raceSession(version), t)
+		conn, _, err := t.detach(true)
+		return conn, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	mux.send([]byte(tagMsg(raceWonMsg, Text, roleOfferer, raceSession(result.Winner))))
+	log.Debugf("Raced to %s: %s", peer, result)
+	if d.OnRace != nil {
+		d.OnRace(peer, result)
+	}
+	return conn, nil
+}
+
+func (d *Dialer) raceHeadStart() time.Duration {
+	if d.RaceHeadStart > 0 {
+		return d.RaceHeadStart
+	}
+	return DefaultRaceHeadStart
+}
+
+// answerAll answers the traversals that a peer offers through signaler,
+// whether a single traversal or a race, returning a conn on the result of the
+// one that the peer ends up using.
+func answerAll(ctx context.Context, signaler Signaler, timeout time.Duration, opts []Option) (net.Conn, error) {
+	type outcome struct {
+		session string
+		conn    net.Conn
+		err     error
+	}
+
+	defer signaler.Close()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// A race has two sessions, so that's all we answer
+	outcomes := make(chan *outcome, 2)
+	won := make(chan string, 1)
+	answer := func(session string) *Traversal {
+		sessionOpts := append(append([]Option{}, opts...), WithSessionTag(session))
+		if version, ok := raceVersion(session); ok {
+			sessionOpts = append(sessionOpts, WithIPVersion(version))
+		}
+		t := AnswerContext(ctx, timeout, sessionOpts...)
+		go func() {
+			conn, _, err := t.detach(true)
+			outcomes <- &outcome{session, conn, err}
+		}()
+		return t
+	}
+	onWon := func(session string) {
+		select {
+		case won <- session:
+		default:
+		}
+	}
+	mapped := make(chan *outcome, 1)
+	onControl := func(msg string) bool {
+		address, ok := isPortMapMsg(msg)
+		if !ok {
+			return false
+		}
+		go func() {
+			conn, err := connectPortMapped(ctx, address, socketsFor(opts))
+			if err != nil {
+				log.Debugf("Unable to connect to mapped port, waiting for a traversal: %s", err)
+				return
+			}
+			mapped <- &outcome{session: "portmap", conn: conn}
+		}()
+		return true
+	}
+	mux := newSignalMux(signaler, answer, onWon)
+	mux.setLimits(cap(outcomes), onControl)
+
+	var winner *outcome
+	var err error
+	conns := make(map[string]net.Conn)
+	errs := make(map[string]error)
+	wonSession := ""
+	racing := false
+	for winner == nil && err == nil {
+		select {
+		case o := <-outcomes:
+			_, isRace := raceVersion(o.session)
+			racing = racing || isRace
+			if o.err != nil {
+				errs[o.session] = o.err
+			} else {
+				conns[o.session] = o.conn
+			}
+		case wonSession = <-won:
+			racing = true
+		case winner = <-mapped:
+			continue
+		case <-ctx.Done():
+			err = fmt.Errorf("Peer didn't connect: %s", ctx.Err())
+			continue
+		}
+
+		switch {
+		case !racing && len(conns) > 0:
+			for session, conn := range conns {
+				winner = &outcome{session: session, conn: conn}
+			}
+		case !racing && len(errs) > 0:
+			for _, e := range errs {
+				err = e
+			}
+		case wonSession != "" && conns[wonSession] != nil:
+			winner = &outcome{session: wonSession, conn: conns[wonSession]}
+		case wonSession != "" && errs[wonSession] != nil:
+			err = fmt.Errorf("Peer connected with %s, which failed here: %s", wonSession, errs[wonSession])
+		case racing && len(errs) == cap(outcomes):
+			err = fmt.Errorf("IPv6 failed: %s, IPv4 failed: %s", errs[raceSession(IPv6)], errs[raceSession(IPv4)])
+		}
+	}
+
+	// Clean up the losers
+	pending := 0
+	for _, t := range mux.close() {
+		t.Close()
+		pending++
+	}
+	pending -= len(conns) + len(errs)
+	for session, conn := range conns {
+		if winner == nil || session != winner.session {
+			conn.Close()
+		}
+	}
+	go func() {
+		for i := 0; i < pending; i++ {
+			o := <-outcomes
+			if o.conn != nil {
+				o.conn.Close()
+			}
+		}
+	}()
+
+	if err != nil {
+		return nil, err
+	}
+	return winner.conn, nil
+}
+
+// signalMux exchanges the signaling messages of several Traversals through a
+// single Signaler, telling them apart by their session tags.
+type signalMux struct {
+	signaler    Signaler
+	onSession   func(session string) *Traversal // if set, starts Traversals for new sessions (or returns nil to ignore them)
+	onWon       func(session string)            // if set, called when the peer announces the winner of a race
+	onControl   func(msg string) bool           // if set, handles untagged messages other than natty's, returning whether it did
+	maxSessions int                             // if set, how many Traversals onSession may start
+	traversals  map[string]*Traversal
+	closed      bool
+	mutex       sync.Mutex
+	sendMutex   sync.Mutex
+}
+
+func newSignalMux(signaler Signaler, onSession func(session string) *Traversal, onWon func(session string)) *signalMux {
+	m := &signalMux{
+		signaler:   signaler,
+		onSession:  onSession,
+		onWon:      onWon,
+		traversals: make(map[string]*Traversal),
+	}
+	go m.receive()
+	return m
+}
+
+// setLimits limits how many Traversals onSession may start and sets the
+// handler for control messages, like the peer's mapped ports.
+func (m *signalMux) setLimits(maxSessions int, onControl func(msg string) bool) {
+	m.mutex.Lock()
+	m.maxSessions = maxSessions
+	m.onControl = onControl
+	m.mutex.Unlock()
+}
+
+// add routes messages for the given session to and from t.
+func (m *signalMux) add(session string, t *Traversal) {
+	m.mutex.Lock()
+	m.traversals[session] = t
+	m.mutex.Unlock()
+	go m.sendFrom(t)
+}
+
+// remove stops routing messages for the given session.
+func (m *signalMux) remove(session string) {
+	m.mutex.Lock()
+	delete(m.traversals, session)
+	m.mutex.Unlock()
+}
+
+// close stops starting Traversals for new sessions and returns the Traversals
+// that the signalMux has been signaling for.
+func (m *signalMux) close() []*Traversal {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.closed = true
+	traversals := make([]*Traversal, 0, len(m.traversals))
+	for _, t := range m.traversals {
+		traversals = append(traversals, t)
+	}
+	return traversals
+}
+
+func (m *signalMux) sendFrom(t *Traversal) {
+	for {
+		select {
+		case msg := <-t.msgOutCh:
+			m.send(msg)
+		case <-t.closedCh:
+			return
+		}
+	}
+}
+
+// send sends msg, which the Signaler takes ownership of.
+func (m *signalMux) send(msg []byte) {
+	m.sendMutex.Lock()
+	err := m.signaler.Send(msg)
+	m.sendMutex.Unlock()
+	if err != nil {
+		log.Errorf("Unable to send signaling message: %s", err)
+	}
+}
+
+func (m *signalMux) receive() {
+	for {
+		msg, err := m.signaler.Receive()
+		if err != nil {
+			return
+		}
+		inner, _, session, err := untagMsg(string(msg))
+		if err != nil {
+			log.Debugf("Ignoring signaling message: %s", err)
+			putMsgBuf(msg)
+			continue
+		}
+		if inner == raceWonMsg {
+			if m.onWon != nil {
+				m.onWon(session)
+			}
+			putMsgBuf(msg)
+			continue
+		}
+		if session == "" {
+			m.mutex.Lock()
+			onControl := m.onControl
+			m.mutex.Unlock()
+			if onControl != nil && onControl(inner) {
+				putMsgBuf(msg)
+				continue
+			}
+		}
+
+		m.mutex.Lock()
+		t := m.traversals[session]
+		if t == nil && m.onSession != nil && !m.closed && (m.maxSessions == 0 || len(m.traversals) < m.maxSessions) {
+			t = m.onSession(session)
+			if t != nil {
+				m.traversals[session] = t
+				go m.sendFrom(t)
+			}
+		}
+		m.mutex.Unlock()
+		if t == nil {
+			log.Debugf("Ignoring signaling message for unknown session %q", session)
+			putMsgBuf(msg)
+			continue
+		}
+		t.MsgInBytes(msg)
+	}
+}
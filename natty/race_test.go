@@ -0,0 +1,238 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestRaceBrokenIPv6(t *testing.T) {
+	cancelled := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	conn, result, err := raceFamilies(ctx, 50*time.Millisecond, func(ctx context.Context, version IPVersion) (net.Conn, error) {
+		if version == IPv6 {
+			// Broken, never connects
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+		time.Sleep(20 * time.Millisecond)
+		return fakeConn(t), nil
+	})
+	if !assert.NoError(t, err, "IPv4 should connect") {
+		return
+	}
+	defer conn.Close()
+	assert.True(t, time.Since(start) < time.Second, "Shouldn't have to wait for IPv6 to time out")
+	assert.Equal(t, IPv4, result.Winner)
+	assert.True(t, result.Margin >= 70*time.Millisecond, "IPv6 should have been running for longer than IPv4")
+	assert.NoError(t, result.LoserErr)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("IPv6 should have been cancelled")
+	}
+}
+
+func TestRaceIPv6Wins(t *testing.T) {
+	var mutex sync.Mutex
+	var versions []IPVersion
+	conn, result, err := raceFamilies(context.Background(), 200*time.Millisecond, func(ctx context.Context, version IPVersion) (net.Conn, error) {
+		mutex.Lock()
+		versions = append(versions, version)
+		mutex.Unlock()
+		return fakeConn(t), nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, IPv6, result.Winner)
+	assert.Equal(t, time.Duration(0), result.Margin, "IPv4 shouldn't have started")
+	mutex.Lock()
+	assert.Equal(t, []IPVersion{IPv6}, versions, "Only IPv6 should have been tried")
+	mutex.Unlock()
+}
+
+func TestRaceIPv6FailsFast(t *testing.T) {
+	start := time.Now()
+	conn, result, err := raceFamilies(context.Background(), 5*time.Second, func(ctx context.Context, version IPVersion) (net.Conn, error) {
+		if version == IPv6 {
+			return nil, fmt.Errorf("No IPv6")
+		}
+		return fakeConn(t), nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.True(t, time.Since(start) < time.Second, "IPv4 shouldn't wait for the head start once IPv6 failed")
+	assert.Equal(t, IPv4, result.Winner)
+	assert.Error(t, result.LoserErr)
+
+	_, _, err = raceFamilies(context.Background(), 0, func(ctx context.Context, version IPVersion) (net.Conn, error) {
+		return nil, fmt.Errorf("No IPv%s", version)
+	})
+	assert.Error(t, err, "Race should fail if both fail")
+}
+
+// TestRaceWithoutIPVersionFlag races Dialer and answerAll against stand-ins
+// for natty that don't accept -ipversion, which should connect anyway, and
+// makes sure that the IPv6 traversal only sends IPv6 candidates.
+func TestRaceWithoutIPVersionFlag(t *testing.T) {
+	ports := make([]int, 2)
+	for i := range ports {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("Unable to listen: %s", err)
+		}
+		ports[i] = conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+	}
+	fake := func(local int, remote int) (string, func()) {
+		return scriptedNatty(t, fmt.Sprintf(`echo '{"candidate":"candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host generation 0","sdpMid":"data","sdpMLineIndex":0}'
+echo '{"candidate":"candidate:2 1 udp 2122262783 2001:db8::1 55286 typ host generation 0","sdpMid":"data","sdpMLineIndex":0}'
+echo '{"type":"5-tuple","proto":"udp","local":"127.0.0.1:%d","remote":"127.0.0.1:%d"}'
+exec sleep 30`, local, remote), "offer")
+	}
+	offerer, removeOfferer := fake(ports[0], ports[1])
+	defer removeOfferer()
+	answerer, removeAnswerer := fake(ports[1], ports[0])
+	defer removeAnswerer()
+
+	dialing, serving := newChanSignaler(), newChanSignaler()
+	var mutex sync.Mutex
+	var sent []string
+	go func() {
+		for msg := range dialing.out {
+			mutex.Lock()
+			sent = append(sent, string(msg))
+			mutex.Unlock()
+			serving.in <- msg
+		}
+	}()
+	go func() {
+		for msg := range serving.out {
+			dialing.in <- msg
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		conn, err := answerAll(ctx, serving, 10*time.Second, []Option{WithBinary(answerer)})
+		if err == nil {
+			conn.Close()
+		}
+		served <- err
+	}()
+	var result *RaceResult
+	d := &Dialer{
+		Options:       []Option{WithBinary(offerer)},
+		Race:          true,
+		RaceHeadStart: 5 * time.Second,
+		OnRace: func(peer string, r *RaceResult) {
+			result = r
+		},
+	}
+	conn, err := d.race(ctx, "peer", dialing)
+	if !assert.NoError(t, err, "Race should work with a natty that doesn't accept -ipversion") {
+		return
+	}
+	conn.Close()
+	assert.Equal(t, IPv6, result.Winner)
+	assert.NoError(t, <-served, "Answerer should have used the winner")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	v6Candidates := 0
+	for _, msg := range sent {
+		decoded, _, _, err := untagAndDecodeMsg([]byte(msg))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.False(t, strings.Contains(string(decoded), "192.168.1.160"), "IPv4 candidate shouldn't have been sent: %s", decoded)
+		if strings.Contains(string(decoded), "2001:db8::1") {
+			v6Candidates++
+		}
+	}
+	assert.Equal(t, 1, v6Candidates, "IPv6 candidate should have been sent")
+}
+
+func TestSignalMux(t *testing.T) {
+	signaler := newChanSignaler()
+	v4 := newTraversal(0, []Option{WithSessionTag(raceSession(IPv4))})
+	v4.initChannels()
+	defer v4.Close()
+	v6 := newTraversal(0, []Option{WithSessionTag(raceSession(IPv6))})
+	v6.initChannels()
+	defer v6.Close()
+
+	var won string
+	wonCh := make(chan bool)
+	mux := newSignalMux(signaler, nil, func(session string) {
+		won = session
+		close(wonCh)
+	})
+	mux.add(raceSession(IPv4), v4)
+	mux.add(raceSession(IPv6), v6)
+
+	offer := `{"type":"offer","sdp":"x"}`
+	signaler.in <- []byte(tagMsg(offer, Text, roleOfferer, raceSession(IPv6)))
+	signaler.in <- []byte(tagMsg(offer, Binary, roleOfferer, raceSession(IPv4)))
+	signaler.in <- []byte(tagMsg(offer, Text, roleOfferer, "unknown"))
+	signaler.in <- []byte(tagMsg(raceWonMsg, Text, roleOfferer, raceSession(IPv4)))
+	assert.Equal(t, offer, string(<-v6.msgInCh), "IPv6 should get its message")
+	assert.Equal(t, offer, string(<-v4.msgInCh), "IPv4 should get its message")
+	<-wonCh
+	assert.Equal(t, raceSession(IPv4), won, "Should have been told who won")
+
+	v6.msgOutCh <- []byte("from v6")
+	assert.Equal(t, "from v6", string(<-signaler.out), "Outbound messages should be sent")
+	assert.Len(t, mux.close(), 2)
+}
+
+// chanSignaler is a Signaler whose messages come and go through channels.
+type chanSignaler struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newChanSignaler() *chanSignaler {
+	return &chanSignaler{in: make(chan []byte, 10), out: make(chan []byte, 10)}
+}
+
+func (s *chanSignaler) Send(msg []byte) error {
+	s.out <- msg
+	return nil
+}
+
+func (s *chanSignaler) Receive() ([]byte, error) {
+	msg, ok := <-s.in
+	if !ok {
+		return nil, fmt.Errorf("Closed")
+	}
+	return msg, nil
+}
+
+func (s *chanSignaler) Close() error {
+	return nil
+}
+
+func fakeConn(t *testing.T) net.Conn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	return conn
+}
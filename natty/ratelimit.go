@@ -0,0 +1,112 @@
+package natty
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// RateLimitBlock makes writes to a rate-limited conn block until they're
+	// within the limit.
+	RateLimitBlock = RateLimitPolicy(iota)
+
+	// RateLimitError makes writes to a rate-limited conn that would exceed the
+	// limit fail immediately with ErrRateLimited.
+	RateLimitError
+)
+
+var (
+	// ErrRateLimited is returned by writes to a rate-limited conn that would
+	// exceed the limit, when using RateLimitError.
+	ErrRateLimited = errors.New("Write would exceed relay rate limit")
+)
+
+// RateLimitPolicy determines what happens to writes that exceed a rate limit.
+type RateLimitPolicy int
+
+// Relayed indicates whether the FiveTuple nominated for this Traversal is
+// relayed, meaning that its local address is one of the relay candidates that
+// natty gathered. It returns false if the Traversal hasn't succeeded (yet).
+func (t *Traversal) Relayed() bool {
+	t.outMutex.Lock()
+	ft := t.fiveTupleOut
+	t.outMutex.Unlock()
+	if ft == nil {
+		return false
+	}
+	t.statsTracker.mutex.Lock()
+	defer t.statsTracker.mutex.Unlock()
+	return t.statsTracker.localTypes[ft.Local] == "relay"
+}
+
+// LimitConn applies the relay rate limit configured with WithRelayRateLimit to
+// the given conn, which the application typically creates from the FiveTuple.
+// If no limit was configured or the FiveTuple isn't relayed, LimitConn returns
+// conn as is.
+func (t *Traversal) LimitConn(conn net.Conn) net.Conn {
+	if t.relayLimit <= 0 || !t.Relayed() {
+		return conn
+	}
+	return newRateLimitedConn(conn, t.relayLimit, t.relayLimitPolicy)
+}
+
+// rateLimitedConn is a net.Conn whose writes are limited to a number of bytes
+// per second using a token bucket that holds up to one second's worth of
+// bytes.
+type rateLimitedConn struct {
+	net.Conn
+	bytesPerSec int
+	policy      RateLimitPolicy
+	tokens      float64
+	last        time.Time
+	mutex       sync.Mutex
+}
+
+func newRateLimitedConn(conn net.Conn, bytesPerSec int, policy RateLimitPolicy) *rateLimitedConn {
+	return &rateLimitedConn{
+		Conn:        conn,
+		bytesPerSec: bytesPerSec,
+		policy:      policy,
+		tokens:      float64(bytesPerSec),
+		last:        time.Now(),
+	}
+}
+
+func (c *rateLimitedConn) Write(b []byte) (int, error) {
+	wait, ok := c.reserve(len(b))
+	if !ok {
+		return 0, ErrRateLimited
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return c.Conn.Write(b)
+}
+
+// reserve takes n bytes' worth of tokens from the bucket, returning how long to
+// wait before writing them. With RateLimitError, it instead returns false if
+// there aren't enough tokens now.
+func (c *rateLimitedConn) reserve(n int) (time.Duration, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	c.tokens += now.Sub(c.last).Seconds() * float64(c.bytesPerSec)
+	if c.tokens > float64(c.bytesPerSec) {
+		c.tokens = float64(c.bytesPerSec)
+	}
+	c.last = now
+
+	if c.policy == RateLimitError && c.tokens < float64(n) {
+		return 0, false
+	}
+	// Writes larger than the bucket are allowed to drive it negative, so that
+	// they're let through eventually
+	c.tokens -= float64(n)
+	if c.tokens >= 0 {
+		return 0, true
+	}
+	return time.Duration(-c.tokens / float64(c.bytesPerSec) * float64(time.Second)), true
+}
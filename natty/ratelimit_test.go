@@ -0,0 +1,83 @@
+package natty
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+const relayCandidate = `{"candidate":"candidate:3 1 udp 41885439 203.0.113.7 50000 typ relay raddr 192.168.1.160 rport 55285 generation 0","sdpMid":"data","sdpMLineIndex":0}`
+
+func TestRelayed(t *testing.T) {
+	tr := newTraversal(0, []Option{WithRelayRateLimit(1000)})
+	tr.statsTracker.track([]byte(relayCandidate), true)
+	conn := &nullConn{}
+
+	assert.False(t, tr.Relayed(), "Traversal without FiveTuple isn't relayed")
+	assert.Equal(t, conn, tr.LimitConn(conn), "Conn shouldn't be limited before traversal succeeds")
+
+	tr.fiveTupleOut = &FiveTuple{Proto: "udp", Local: "192.168.1.160:55285", Remote: "198.51.100.8:60530"}
+	assert.False(t, tr.Relayed(), "Direct FiveTuple isn't relayed")
+	assert.Equal(t, conn, tr.LimitConn(conn), "Direct conn shouldn't be limited")
+
+	tr.fiveTupleOut = &FiveTuple{Proto: "udp", Local: "203.0.113.7:50000", Remote: "198.51.100.8:60530"}
+	assert.True(t, tr.Relayed(), "FiveTuple using relay candidate is relayed")
+	_, limited := tr.LimitConn(conn).(*rateLimitedConn)
+	assert.True(t, limited, "Relayed conn should be limited")
+
+	remote := newTraversal(0, nil)
+	remote.statsTracker.track([]byte(relayCandidate), false)
+	remote.fiveTupleOut = &FiveTuple{Proto: "udp", Local: "203.0.113.7:50000", Remote: "198.51.100.8:60530"}
+	assert.False(t, remote.Relayed(), "Peer's relay candidates don't make us relayed")
+
+	unlimited := newTraversal(0, nil)
+	unlimited.statsTracker.track([]byte(relayCandidate), true)
+	unlimited.fiveTupleOut = &FiveTuple{Proto: "udp", Local: "203.0.113.7:50000", Remote: "198.51.100.8:60530"}
+	assert.Equal(t, conn, unlimited.LimitConn(conn), "Conn shouldn't be limited without a limit")
+}
+
+func TestRateLimitBlock(t *testing.T) {
+	conn := &nullConn{}
+	limited := newRateLimitedConn(conn, 10000, RateLimitBlock)
+	b := make([]byte, 1000)
+	start := time.Now()
+	// The first second's worth is allowed through immediately, the second
+	// second's worth takes a second
+	for i := 0; i < 20; i++ {
+		_, err := limited.Write(b)
+		assert.NoError(t, err)
+	}
+	elapsed := time.Now().Sub(start)
+	assert.True(t, elapsed > 800*time.Millisecond, "Writes should have been slowed down, took "+elapsed.String())
+	assert.True(t, elapsed < 2*time.Second, "Writes shouldn't have been slowed down too much, took "+elapsed.String())
+	assert.Equal(t, 20000, conn.written)
+}
+
+func TestRateLimitError(t *testing.T) {
+	conn := &nullConn{}
+	limited := newRateLimitedConn(conn, 10000, RateLimitError)
+	b := make([]byte, 1000)
+	for i := 0; i < 10; i++ {
+		_, err := limited.Write(b)
+		assert.NoError(t, err, "Writes within the limit should succeed")
+	}
+	_, err := limited.Write(b)
+	assert.Equal(t, ErrRateLimited, err, "Write over the limit should fail")
+	time.Sleep(150 * time.Millisecond)
+	_, err = limited.Write(b)
+	assert.NoError(t, err, "Write should succeed once bucket refills")
+	assert.Equal(t, 11000, conn.written)
+}
+
+// nullConn is a net.Conn that discards what's written to it.
+type nullConn struct {
+	net.Conn
+	written int
+}
+
+func (c *nullConn) Write(b []byte) (int, error) {
+	c.written += len(b)
+	return len(b), nil
+}
@@ -0,0 +1,77 @@
+package natty
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	// RedactNone logs addresses as they are.
+	RedactNone = LogRedaction(iota)
+
+	// RedactIPs masks the host portion of IP addresses in log output: the last
+	// octet of IPv4 addresses (203.0.113.7 becomes 203.0.113.x) and everything
+	// after the /64 prefix of IPv6 addresses (2001:db8:1:2::7 becomes
+	// 2001:db8:1:2::x).
+	RedactIPs
+)
+
+var (
+	ipv4Pattern = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+	ipv6Pattern = regexp.MustCompile(`[0-9a-fA-F]*:[0-9a-fA-F:.]*:[0-9a-fA-F.]*`)
+)
+
+// LogRedaction controls what a Traversal redacts from its log output.
+type LogRedaction int
+
+// redactIPs masks the host portion of all IP addresses in s.
+func redactIPs(s string) string {
+	s = ipv6Pattern.ReplaceAllStringFunc(s, func(candidate string) string {
+		ip := net.ParseIP(candidate)
+		if ip == nil || ip.To4() != nil {
+			// Not IPv6, IPv4 addresses are handled below
+			return candidate
+		}
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "x"
+	})
+	return ipv4Pattern.ReplaceAllStringFunc(s, func(candidate string) string {
+		ip := net.ParseIP(candidate)
+		if ip == nil {
+			return candidate
+		}
+		return candidate[:strings.LastIndex(candidate, ".")+1] + "x"
+	})
+}
+
+// redact applies the Traversal's LogRedaction to the given log output.
+func (t *Traversal) redact(s string) string {
+	if t.logRedaction == RedactIPs {
+		return redactIPs(s)
+	}
+	return s
+}
+
+// redactingWriter is an io.Writer that redacts IP addresses from each line
+// written to it before passing it on.
+type redactingWriter struct {
+	out     io.Writer
+	partial []byte
+}
+
+func (w *redactingWriter) Write(b []byte) (int, error) {
+	w.partial = append(w.partial, b...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		_, err := io.WriteString(w.out, redactIPs(string(w.partial[:i+1])))
+		w.partial = w.partial[i+1:]
+		if err != nil {
+			return len(b), err
+		}
+	}
+}
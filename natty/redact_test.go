@@ -0,0 +1,52 @@
+package natty
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestRedactIPs(t *testing.T) {
+	cases := map[string]string{
+		"Got five tuple: &{udp 203.0.113.7:55285 198.51.100.200:60530}":    "Got five tuple: &{udp 203.0.113.x:55285 198.51.100.x:60530}",
+		"a=candidate:1 1 udp 2122260223 192.168.1.160 55285 typ host":      "a=candidate:1 1 udp 2122260223 192.168.1.x 55285 typ host",
+		"candidate:2 1 udp 1686052607 2001:db8:1:2:a:b:c:d 3478 typ srflx": "candidate:2 1 udp 1686052607 2001:db8:1:2::x 3478 typ srflx",
+		"Listening at [2001:db8::1]:443":                                   "Listening at [2001:db8::x]:443",
+		"Mapped ::ffff:203.0.113.7":                                        "Mapped ::ffff:203.0.113.x",
+		"2014/09/16 18:41:36 Not an address: 1.2.3 or 999.1.1.1":           "2014/09/16 18:41:36 Not an address: 1.2.3 or 999.1.1.1",
+	}
+	for in, expected := range cases {
+		assert.Equal(t, expected, redactIPs(in))
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	logger := &recordingLogger{}
+	ctx := ContextWithLogger(context.Background(), logger)
+
+	redacted := newTraversal(0, []Option{WithLogRedaction(RedactIPs)})
+	redacted.bindContext(ctx)
+	redacted.log().Tracef("Five tuple %s", &FiveTuple{Proto: "udp", Local: "203.0.113.7:1", Remote: "198.51.100.8:2"})
+	redacted.log().Errorf("Dropping %s", "192.168.1.160")
+
+	unredacted := newTraversal(0, nil)
+	unredacted.bindContext(ctx)
+	unredacted.log().Tracef("Dropping %s", "192.168.1.160")
+
+	entries := logger.all()
+	assert.Contains(t, entries[0], "203.0.113.x:1")
+	assert.Contains(t, entries[0], "198.51.100.x:2")
+	assert.Contains(t, entries[1], "192.168.1.x")
+	assert.Contains(t, entries[2], "192.168.1.160", "Redaction should be off by default")
+
+	out := &bytes.Buffer{}
+	w := &redactingWriter{out: out}
+	w.Write([]byte("gathered 10.0.0"))
+	assert.Equal(t, 0, out.Len(), "Partial lines shouldn't be written")
+	w.Write([]byte(".1 and 10.0.0.2\n"))
+	assert.Equal(t, "gathered 10.0.0.x and 10.0.0.x\n", out.String())
+	assert.False(t, strings.Contains(out.String(), "10.0.0.1"))
+}
@@ -0,0 +1,78 @@
+package natty
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	refusalMarker = `"type":"refusal"`
+)
+
+var (
+	// ErrRejected is what a RejectedError unwraps to, so that errors.Is tells
+	// whether a Traversal failed because the peer refused it. It's the same
+	// as ErrPeerRejected, so that refusals by PeerErrorMsg match too.
+	ErrRejected = ErrPeerRejected
+)
+
+// RejectedError is what an offering Traversal fails with when the peer refused
+// to answer it (see RefusalMsg), without waiting for its timeout.
+type RejectedError struct {
+	// Reason is the reason that the peer gave, if any.
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	if e.Reason == "" {
+		return ErrRejected.Error()
+	}
+	return fmt.Sprintf("%s: %s", ErrRejected, e.Reason)
+}
+
+// Unwrap returns ErrRejected.
+func (e *RejectedError) Unwrap() error {
+	return ErrRejected
+}
+
+// refusalMsg is the message with which the answering side refuses a
+// traversal.
+type refusalMsg struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// RefusalMsg returns a message for the answering side of the signaling to send
+// to an offering peer instead of answering its traversal, for example because
+// of the application's policy or load. The offering Traversal fails right
+// away with a *RejectedError carrying reason. PeerErrorMsg does the same with
+// a code, which lets the peer tell a refusal from being busy.
+func RefusalMsg(reason string) []byte {
+	msg, _ := json.Marshal(&refusalMsg{Type: "refusal", Reason: reason})
+	return msg
+}
+
+// parseRefusal returns the error that msg refuses the traversal with, if it's
+// a refusal.
+func parseRefusal(msg []byte) (*RejectedError, bool) {
+	if !bytes.Contains(msg, []byte(refusalMarker)) {
+		return nil, false
+	}
+	rm := &refusalMsg{}
+	if json.Unmarshal(msg, rm) != nil || rm.Type != "refusal" {
+		return nil, false
+	}
+	return &RejectedError{Reason: rm.Reason}, true
+}
+
+// refused fails the Traversal with err, unless the peer already failed it.
+func (t *Traversal) refused(err *RejectedError) {
+	t.log().Tracef("Peer refused traversal: %s", err)
+	t.runReports().peerErr.Do(func() {
+		select {
+		case t.errCh <- err:
+		case <-t.closedCh:
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package natty
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestRefusal(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	assert.NoError(t, tr.TryMsgIn(string(RefusalMsg("Over quota"))))
+	assert.NoError(t, tr.TryMsgIn(string(RefusalMsg("Again"))))
+	assert.NoError(t, tr.TryMsgIn(string(PeerErrorMsg(PeerRejected, "Once more"))))
+	select {
+	case err := <-tr.errCh:
+		rejected, ok := err.(*RejectedError)
+		if assert.True(t, ok, "Should fail with RejectedError") {
+			assert.Equal(t, "Over quota", rejected.Reason)
+		}
+		assert.True(t, errors.Is(err, ErrRejected))
+		assert.True(t, errors.Is(err, ErrPeerRejected), "Refusals should match PeerRejected too")
+	default:
+		t.Fatal("Traversal should have failed")
+	}
+	select {
+	case err := <-tr.errCh:
+		t.Fatalf("Refusal should only be reported once, got %s", err)
+	default:
+	}
+
+	_, ok := parseRefusal([]byte(`{"type":"offer","sdp":"refusal"}`))
+	assert.False(t, ok)
+	assert.Equal(t, "Peer rejected traversal", (&RejectedError{}).Error())
+}
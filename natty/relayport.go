@@ -0,0 +1,21 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+)
+
+// checkRelayLocalPort makes sure that natty will be able to bind the local
+// port configured with WithRelayLocalPort, so that a port that's in use fails
+// the Traversal with a clear error rather than an obscure failure to allocate
+// a relay.
+func checkRelayLocalPort(port int, s sockets) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("Invalid relay local port %d, should be between 1 and 65535", port)
+	}
+	conn, err := s.listenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return fmt.Errorf("Relay local port %d is unavailable: %s", port, err)
+	}
+	return conn.Close()
+}
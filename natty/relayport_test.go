@@ -0,0 +1,61 @@
+package natty
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestCheckRelayLocalPort(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	err = checkRelayLocalPort(port, sockets{})
+	if assert.Error(t, err, "Port in use should be unavailable") {
+		assert.Contains(t, err.Error(), "unavailable")
+	}
+	conn.Close()
+	assert.NoError(t, checkRelayLocalPort(port, sockets{}), "Port should be available once closed")
+	assert.Error(t, checkRelayLocalPort(0, sockets{}), "Port 0 isn't predictable")
+	assert.Error(t, checkRelayLocalPort(70000, sockets{}), "Port out of range")
+}
+
+func TestRelayLocalPortUnavailable(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer conn.Close()
+
+	tr := Offer(0, WithRelayLocalPort(conn.LocalAddr().(*net.UDPAddr).Port))
+	defer tr.Close()
+	_, err = tr.FiveTuple()
+	assert.Error(t, err, "Traversal should fail if relay local port is in use")
+}
+
+func TestRelayLocalPortFlag(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	binary, remove := sleepingNatty(t)
+	defer remove()
+	tr := newTraversal(0, []Option{WithBinary(binary), WithRelayLocalPort(port)})
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.Contains(t, strings.Join(tr.cmd.Args, " "), "-relayport "+strconv.Itoa(port))
+	}
+	binary, remove = scriptedNatty(t, "exec sleep 30", "offer")
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(binary), WithRelayLocalPort(port)})
+	assert.True(t, errors.Is(tr.initCommand(nil), ErrUnsupportedOption), "natty that doesn't accept -relayport should fail the Traversal")
+}
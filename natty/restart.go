@@ -0,0 +1,106 @@
+package natty
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Restart performs an ICE restart: it runs natty anew, which gathers new
+// candidates under new credentials and checks them with the peer's, for
+// example because the network changed underneath the connection (see
+// WithNetworkChange). It only applies to a Traversal that has finished,
+// whether it found a FiveTuple or failed. Once Restart returns, FiveTuple,
+// FiveTupleChan and friends block until the new FiveTuple is found, which may
+// have different addresses than the old one, so conns bound to those need to
+// be replaced. OnStateChange callbacks are told about StateGathering again, if
+// the Traversal had failed, NextMsgOut no longer returns done, and MsgOutChan
+// returns a new channel.
+//
+// The peer needs to restart its Traversal too, the answerer before the
+// offerer's new offer reaches it, for example upon being told so over the
+// signaling channel. Restart isn't supported with WithBoundConn.
+func (t *Traversal) Restart() error {
+	t.restartMutex.Lock()
+	defer t.restartMutex.Unlock()
+	if t.params == nil {
+		return fmt.Errorf("Unable to restart a Traversal that hasn't started")
+	}
+	if t.handoff.enabled {
+		return fmt.Errorf("Unable to restart a Traversal that hands over natty's socket")
+	}
+	select {
+	case <-t.finished():
+	default:
+		return fmt.Errorf("Unable to restart a Traversal that's still running")
+	}
+	// Wait for the old result, so that nobody's left waiting for it
+	t.FiveTuple()
+	select {
+	case <-t.closedCh:
+		return ErrClosed
+	default:
+	}
+
+	t.log().Trace("Restarting")
+	// Whatever the peer sent is for the old natty, and whatever the old run
+	// emitted that hasn't been read yet (like telling the peer why it failed)
+	// would only confuse the peer's new run
+	for _, ch := range []chan []byte{t.msgInCh, t.msgOutCh} {
+		for drained := false; !drained; {
+			select {
+			case msg := <-ch:
+				putMsgBuf(msg)
+			default:
+				drained = true
+			}
+		}
+	}
+	t.punch.reset()
+	t.gathering.reset()
+
+	t.resetRun()
+	t.outMutex.Lock()
+	t.initRunChannels()
+	t.outMutex.Unlock()
+
+	t.setPhase(phaseNegotiating)
+	t.restartState()
+	t.start()
+	return nil
+}
+
+// resetRun resets the state that belongs to a single run of natty, for a new
+// Traversal or a Restart.
+func (t *Traversal) resetRun() {
+	t.cmdMutex.Lock()
+	if t.turnAllocOwned {
+		// stopNatty closed it, initCommand allocates a new one
+		t.turnAllocation, t.turnAllocOwned = nil, false
+	}
+	t.turnBinding, t.mappingBinding = nil, nil
+	t.cmd, t.stop = nil, &stopResult{}
+	t.stderrTail.reset()
+	t.cmdMutex.Unlock()
+
+	t.outMutex.Lock()
+	t.fiveTupleOut, t.errOut, t.pairsOut = nil, nil, nil
+	t.resultCh = make(chan struct{})
+	t.reports = &runReports{}
+	t.outMutex.Unlock()
+}
+
+// runReports makes sure that each kind of failure is only reported once per
+// run of natty. resetRun replaces it rather than resetting its Onces, which
+// the old run's goroutines may still be using.
+type runReports struct {
+	backpressure sync.Once // ErrSignalBackpressure
+	peerErr      sync.Once // the first PeerError or refusal
+	policy       sync.Once // a PolicyError
+}
+
+// runReports returns the runReports of the current run of natty.
+func (t *Traversal) runReports() *runReports {
+	t.outMutex.Lock()
+	defer t.outMutex.Unlock()
+	return t.reports
+}
@@ -0,0 +1,63 @@
+package natty
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestRestart(t *testing.T) {
+	tr := newTraversal(0, []Option{WithBinary("/nonexistent/natty")})
+	assert.Error(t, tr.Restart(), "Traversal that hasn't started shouldn't restart")
+
+	// Pretend that natty found a FiveTuple
+	tr.params = offerParams
+	tr.initChannels()
+	assert.Error(t, tr.Restart(), "Traversal that's still running shouldn't restart")
+	close(tr.finishedCh)
+	ft := &FiveTuple{Proto: UDP, Local: "192.168.1.2:5000", Remote: "203.0.113.7:6000"}
+	tr.fiveTupleOutCh <- ft
+	tr.setState(StateConnected)
+	tr.MsgInBytes([]byte(`{"type":"answer"}`))
+	tr.stderrTail.Write([]byte("old natty's stderr"))
+	oldReports := tr.runReports()
+	oldReports.peerErr.Do(func() {})
+	oldReports.policy.Do(func() {})
+	oldReports.backpressure.Do(func() {})
+	tr.msgOutCh <- []byte(`{"type":"peerError","code":"internal"}`)
+
+	states := make(chan State, 10)
+	tr.OnStateChange(func(state State) {
+		states <- state
+	})
+	if !assert.NoError(t, tr.Restart()) {
+		return
+	}
+	select {
+	case state := <-states:
+		assert.Equal(t, StateGathering, state, "Restart should gather again")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Restart should have changed the State")
+	}
+	_, err := tr.FiveTuple()
+	assert.True(t, errors.Is(err, ErrBinaryNotFound), "FiveTuple should return the result of the new run")
+	assert.Equal(t, StateFailed, <-states)
+	assert.Equal(t, 0, len(tr.msgInCh), "Messages for the old natty should be dropped")
+	assert.Equal(t, "", tr.Stderr(), "Old natty's stderr should be gone")
+	for len(tr.msgOutCh) > 0 {
+		assert.False(t, strings.Contains(string(<-tr.msgOutCh), "internal"), "Old run's messages shouldn't reach the peer's new run")
+	}
+	reports := tr.runReports()
+	for _, once := range []*sync.Once{&reports.peerErr, &reports.policy, &reports.backpressure} {
+		reported := false
+		once.Do(func() { reported = true })
+		assert.True(t, reported, "New run should report its own errors")
+	}
+
+	tr.Close()
+	assert.Error(t, tr.Restart(), "Closed Traversal shouldn't restart")
+}
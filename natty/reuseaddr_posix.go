@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package natty
+
+import (
+	"syscall"
+)
+
+func reuseAddr(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
@@ -0,0 +1,7 @@
+package natty
+
+func reuseAddr(fd uintptr) error {
+	// SO_REUSEADDR on Windows lets other sockets steal the address, and
+	// Windows doesn't keep the address from being bound in TIME_WAIT anyway.
+	return nil
+}
@@ -0,0 +1,127 @@
+package natty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// signalShutdownTimeout is how long Traversals get to clean up when
+	// HandleSignals shuts natty down.
+	signalShutdownTimeout = 5 * time.Second
+)
+
+var (
+	// ErrShuttingDown is the error with which Traversals started after
+	// Shutdown fail.
+	ErrShuttingDown = errors.New("natty is shutting down")
+
+	// live are the Traversals whose natty hasn't stopped yet
+	live         = make(map[*Traversal]bool)
+	shuttingDown bool
+	liveMutex    sync.Mutex
+
+	handleSignalsOnce sync.Once
+)
+
+// Shutdown closes every Traversal whose natty is still running and waits for
+// their natty processes and goroutines to finish, or for ctx to be done,
+// whichever comes first. Traversals started after Shutdown fail with
+// ErrShuttingDown. Shutdown logs how many natty processes it had to kill, and
+// returns an error if some Traversals hadn't finished cleaning up by the time
+// ctx was done.
+func Shutdown(ctx context.Context) error {
+	liveMutex.Lock()
+	shuttingDown = true
+	traversals := make([]*Traversal, 0, len(live))
+	for t := range live {
+		traversals = append(traversals, t)
+	}
+	liveMutex.Unlock()
+
+	killed := 0
+	for _, t := range traversals {
+		select {
+		case <-t.finished():
+			// natty stopped by itself in the meantime
+		default:
+			killed++
+			go t.Close()
+		}
+	}
+	log.Debugf("Shutting down, killed %d natty processes", killed)
+
+	unfinished := 0
+	for _, t := range traversals {
+		if ctx.Err() == nil {
+			select {
+			case <-t.finished():
+				continue
+			case <-ctx.Done():
+			}
+		}
+		select {
+		case <-t.finished():
+		default:
+			unfinished++
+		}
+	}
+	if unfinished > 0 {
+		return fmt.Errorf("%d of %d traversals didn't finish cleaning up: %s", unfinished, len(traversals), ctx.Err())
+	}
+	return nil
+}
+
+// HandleSignals makes natty Shutdown when the process receives SIGTERM or an
+// interrupt, after which the signal is raised again so that the process
+// terminates as it would have otherwise. Applications that handle these
+// signals themselves should call Shutdown from their own handler instead.
+func HandleSignals() {
+	handleSignalsOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		go func() {
+			sig := <-signals
+			log.Debugf("Got %s, shutting down", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), signalShutdownTimeout)
+			err := Shutdown(ctx)
+			cancel()
+			if err != nil {
+				log.Errorf("Unable to shut down cleanly: %s", err)
+			}
+			signal.Reset(sig)
+			p, err := os.FindProcess(os.Getpid())
+			if err == nil {
+				err = p.Signal(sig)
+			}
+			if err != nil {
+				log.Errorf("Unable to raise %s again, exiting: %s", sig, err)
+				os.Exit(1)
+			}
+		}()
+	})
+}
+
+// register tracks the Traversal as live until its natty stops, failing with
+// ErrShuttingDown if natty is shutting down.
+func (t *Traversal) register() error {
+	liveMutex.Lock()
+	defer liveMutex.Unlock()
+	if shuttingDown {
+		return ErrShuttingDown
+	}
+	live[t] = true
+	return nil
+}
+
+func (t *Traversal) deregister() {
+	liveMutex.Lock()
+	delete(live, t)
+	liveMutex.Unlock()
+}
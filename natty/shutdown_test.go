@@ -0,0 +1,61 @@
+package natty
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestShutdown(t *testing.T) {
+	defer resetShutdown()
+
+	checkLeaks := checkGoroutineLeaks(t)
+	traversals := startIdleTraversals(5)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, Shutdown(ctx), "Traversals should clean up before the deadline")
+	assert.NoError(t, ctx.Err(), "Shutdown should have finished before the deadline")
+	for _, tr := range traversals {
+		select {
+		case <-tr.finishedCh:
+		default:
+			t.Error("natty should have stopped")
+		}
+		_, err := tr.FiveTuple()
+		assert.Error(t, err, "Closed traversal shouldn't get a FiveTuple")
+	}
+	liveMutex.Lock()
+	assert.Equal(t, 0, len(live), "No traversals should be left")
+	liveMutex.Unlock()
+
+	// Only the goroutines that deliver the results remain briefly
+	checkLeaks()
+
+	_, err := Answer(0).FiveTuple()
+	assert.Equal(t, ErrShuttingDown, err, "New traversals should fail")
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	defer resetShutdown()
+
+	// A Traversal whose natty never stops
+	stuck := newTraversal(0, nil)
+	stuck.initChannels()
+	assert.NoError(t, stuck.register())
+	defer func() {
+		close(stuck.finishedCh)
+		stuck.deregister()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, Shutdown(ctx), "Shutdown should report the traversal that didn't clean up")
+}
+
+func resetShutdown() {
+	liveMutex.Lock()
+	shuttingDown = false
+	liveMutex.Unlock()
+}
@@ -0,0 +1,107 @@
+package natty
+
+// Run exchanges the Traversal's signaling messages with the peer through
+// signaler and returns the FiveTuple like FiveTuple does, which saves
+// applications from pumping NextMsgOut and MsgIn themselves. Those are still
+// there for applications that need finer control, but shouldn't be used
+// alongside Run. Messages keep being passed to signaler until the Traversal
+// is closed, since the peer may still need some after we have our FiveTuple,
+// or has failed, and from it until its Receive fails, for which the
+// application closes it. Run closes neither.
+func (t *Traversal) Run(signaler Signaler) (*FiveTuple, error) {
+	t.pump(signaler)
+	return t.FiveTuple()
+}
+
+// pump passes messages from signaler to the Traversal until Receive fails, and
+// from the Traversal to signaler until NextMsgOutBytes is done, that is until
+// the Traversal is closed or has failed.
+func (t *Traversal) pump(signaler Signaler) {
+	go func() {
+		for {
+			msg, err := signaler.Receive()
+			if err != nil {
+				return
+			}
+			t.MsgInBytes(msg)
+		}
+	}()
+	go func() {
+		for {
+			msg, done := t.NextMsgOutBytes()
+			if done {
+				return
+			}
+			err := signaler.Send(msg)
+			if err != nil {
+				t.log().Errorf("Unable to send signaling message: %s", err)
+			}
+		}
+	}()
+}
+
+// MsgOutChan returns a channel that yields the messages to pass to the peer,
+// as an alternative to calling NextMsgOut on a goroutine of its own, which
+// lets applications select over the channels of many Traversals. The channel
+// is closed once NextMsgOut would return done, that is once the Traversal is
+// closed or has failed, after which MsgOutChan returns a new channel, which
+// yields messages again if the Traversal is restarted. Like Run, it consumes
+// the messages that NextMsgOut would return, so mixing MsgOutChan with
+// NextMsgOut or Run on the same Traversal isn't supported.
+func (t *Traversal) MsgOutChan() <-chan string {
+	t.outMutex.Lock()
+	defer t.outMutex.Unlock()
+	if t.msgOutChan == nil {
+		out := make(chan string)
+		t.msgOutChan = out
+		go func() {
+			defer func() {
+				t.outMutex.Lock()
+				t.msgOutChan = nil
+				t.outMutex.Unlock()
+				close(out)
+			}()
+			for {
+				msg, done := t.NextMsgOutBytes()
+				if done {
+					return
+				}
+				s := string(msg)
+				putMsgBuf(msg)
+				select {
+				case out <- s:
+				case <-t.closedCh:
+					return
+				}
+			}
+		}()
+	}
+	return t.msgOutChan
+}
+
+// MsgInChan returns a channel on which to pass the Traversal messages from
+// the peer, as an alternative to calling MsgIn. Messages are handled like
+// MsgIn handles them. The Traversal stops receiving from the channel once
+// it's closed, or once the application closes the channel, so sends after
+// closing the Traversal block unless they select on something else too (such
+// as MsgOutChan being closed). Mixing MsgInChan with MsgIn or Run on the same
+// Traversal isn't supported.
+func (t *Traversal) MsgInChan() chan<- string {
+	t.msgInChanOnce.Do(func() {
+		t.msgInChan = make(chan string)
+		go func() {
+			for {
+				select {
+				case msg, ok := <-t.msgInChan:
+					if !ok {
+						return
+					}
+					t.MsgIn(msg)
+				case <-t.closedCh:
+					return
+				}
+			}
+		}()
+	})
+	return t.msgInChan
+}
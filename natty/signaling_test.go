@@ -0,0 +1,111 @@
+package natty
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	signaler := newChanSignaler()
+	result := make(chan *FiveTuple)
+	go func() {
+		ft, err := tr.Run(signaler)
+		assert.NoError(t, err)
+		result <- ft
+	}()
+
+	tr.msgOutCh <- []byte(`{"type":"answer"}`)
+	select {
+	case msg := <-signaler.out:
+		assert.Equal(t, `{"type":"answer"}`, string(msg), "Our message should go to the peer")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message wasn't sent")
+	}
+	signaler.in <- []byte(`{"type":"offer"}`)
+	select {
+	case msg := <-tr.msgInCh:
+		assert.Equal(t, `{"type":"offer"}`, string(msg), "Peer's message should go to natty")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message wasn't received")
+	}
+
+	ft := &FiveTuple{Proto: UDP, Local: "127.0.0.1:1000", Remote: "127.0.0.1:1001"}
+	tr.fiveTupleOutCh <- ft
+	select {
+	case got := <-result:
+		assert.Equal(t, ft, got)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run didn't return")
+	}
+
+	// We keep sending until closed, in case the peer still needs messages
+	tr.msgOutCh <- []byte(`{"type":"5-tuple"}`)
+	assert.Equal(t, `{"type":"5-tuple"}`, string(<-signaler.out))
+	tr.Close()
+	close(signaler.in)
+}
+
+func TestRunStopsOnFailure(t *testing.T) {
+	signaler := newChanSignaler()
+	close(signaler.in)
+	checkLeaks := checkGoroutineLeaks(t)
+	tr := Offer(0, WithBinary("/nonexistent/natty"))
+	defer tr.Close()
+	_, err := tr.Run(signaler)
+	assert.Error(t, err)
+	// The Traversal is still open, but there's nothing left to send
+	checkLeaks()
+}
+
+func TestMsgChans(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	out, in := tr.MsgOutChan(), tr.MsgInChan()
+	assert.True(t, out == tr.MsgOutChan(), "MsgOutChan should always return the same channel")
+
+	tr.msgOutCh <- []byte(`{"type":"answer"}`)
+	select {
+	case msg := <-out:
+		assert.Equal(t, `{"type":"answer"}`, msg, "Our message should go to the channel")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message wasn't sent")
+	}
+	in <- `{"type":"offer"}`
+	select {
+	case msg := <-tr.msgInCh:
+		assert.Equal(t, `{"type":"offer"}`, string(msg), "Peer's message should go to natty")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message wasn't received")
+	}
+
+	tr.Close()
+	select {
+	case _, ok := <-out:
+		assert.False(t, ok, "Closing the Traversal should close MsgOutChan")
+	case <-time.After(2 * time.Second):
+		t.Fatal("MsgOutChan wasn't closed")
+	}
+}
+
+func TestMsgOutChanClosedOnFailure(t *testing.T) {
+	tr := Offer(0, WithBinary("/nonexistent/natty"))
+	defer tr.Close()
+	out := tr.MsgOutChan()
+	_, err := tr.FiveTuple()
+	assert.Error(t, err)
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-out:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Failing the Traversal should close MsgOutChan")
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package natty
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSignalMaxQueueDelay is how long a message may wait for the
+	// process-wide signaling rate limit before its Traversal fails, unless
+	// changed with SetSignalMaxQueueDelay.
+	DefaultSignalMaxQueueDelay = 10 * time.Second
+)
+
+var (
+	// ErrSignalBackpressure fails Traversals whose messages waited longer
+	// than the maximum queue delay for the signaling rate limit.
+	ErrSignalBackpressure = errors.New("Signaling rate limit exceeded maximum queue delay")
+
+	signalLimit = &signalLimiter{maxDelay: DefaultSignalMaxQueueDelay}
+)
+
+// SetSignalSendRate limits the messages that all Traversals in the process
+// together emit via NextMsgOut to rate per second, allowing bursts of up to
+// burst messages, for signaling channels that throttle senders. Messages wait
+// for their turn before they're emitted, with Traversals taking turns so that
+// a chatty one can't starve the others. The time spent waiting shows up in
+// Stats. A rate of 0 or less removes the limit, which is the default.
+func SetSignalSendRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	signalLimit.mutex.Lock()
+	signalLimit.rate = rate
+	signalLimit.burst = float64(burst)
+	signalLimit.tokens = float64(burst)
+	signalLimit.last = time.Now()
+	signalLimit.grantLocked()
+	signalLimit.mutex.Unlock()
+}
+
+// SetSignalMaxQueueDelay sets how long a message may wait for the limit set
+// with SetSignalSendRate. A Traversal whose message waits longer fails with
+// ErrSignalBackpressure rather than hanging.
+func SetSignalMaxQueueDelay(delay time.Duration) {
+	signalLimit.mutex.Lock()
+	signalLimit.maxDelay = delay
+	signalLimit.mutex.Unlock()
+}
+
+// signalLimiter is a token bucket shared by all Traversals that grants tokens
+// to waiting Traversals round robin.
+type signalLimiter struct {
+	mutex    sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	maxDelay time.Duration
+	queues   map[uint64][]*signalWaiter // waiters by Traversal id
+	order    []uint64                   // Traversals with waiters, next turn first
+	timer    *time.Timer
+}
+
+type signalWaiter struct {
+	grantedCh chan struct{}
+	granted   bool
+}
+
+// wait waits for the Traversal with the given id to be allowed to emit a
+// message, returning how long it waited. It fails with ErrSignalBackpressure
+// if that takes longer than maxDelay, or if cancel is closed.
+func (l *signalLimiter) wait(id uint64, cancel <-chan struct{}) (time.Duration, error) {
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return 0, nil
+	}
+	l.refillLocked()
+	if len(l.order) == 0 && l.tokens >= 1 {
+		l.tokens--
+		l.mutex.Unlock()
+		return 0, nil
+	}
+	w := &signalWaiter{grantedCh: make(chan struct{})}
+	if l.queues == nil {
+		l.queues = make(map[uint64][]*signalWaiter)
+	}
+	if len(l.queues[id]) == 0 {
+		l.order = append(l.order, id)
+	}
+	l.queues[id] = append(l.queues[id], w)
+	maxDelay := l.maxDelay
+	l.grantLocked()
+	l.mutex.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(maxDelay)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.grantedCh:
+		return time.Since(start), nil
+	case <-timer.C:
+		err = ErrSignalBackpressure
+	case <-cancel:
+		err = ErrClosed
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if w.granted {
+		return time.Since(start), nil
+	}
+	l.removeLocked(id, w)
+	return time.Since(start), err
+}
+
+func (l *signalLimiter) refillLocked() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// grantLocked grants the available tokens to waiters, one per Traversal in
+// turn, and schedules itself for when the next token becomes available if
+// there are waiters left.
+func (l *signalLimiter) grantLocked() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	if len(l.order) == 0 {
+		return
+	}
+	if l.rate <= 0 {
+		// The limit was removed, let everyone through
+		for _, id := range l.order {
+			for _, w := range l.queues[id] {
+				w.granted = true
+				close(w.grantedCh)
+			}
+			delete(l.queues, id)
+		}
+		l.order = nil
+		return
+	}
+	l.refillLocked()
+	for l.tokens >= 1 && len(l.order) > 0 {
+		id := l.order[0]
+		l.order = l.order[1:]
+		queue := l.queues[id]
+		w := queue[0]
+		w.granted = true
+		close(w.grantedCh)
+		l.tokens--
+		if len(queue) > 1 {
+			l.queues[id] = queue[1:]
+			l.order = append(l.order, id)
+		} else {
+			delete(l.queues, id)
+		}
+	}
+	if len(l.order) > 0 {
+		next := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.timer = time.AfterFunc(next, func() {
+			l.mutex.Lock()
+			l.grantLocked()
+			l.mutex.Unlock()
+		})
+	}
+}
+
+func (l *signalLimiter) removeLocked(id uint64, w *signalWaiter) {
+	queue := l.queues[id]
+	for i, queued := range queue {
+		if queued == w {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		l.queues[id] = queue
+		return
+	}
+	delete(l.queues, id)
+	for i, queued := range l.order {
+		if queued == id {
+			l.order = append(l.order[:i:i], l.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package natty
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestSignalSendRateFairness(t *testing.T) {
+	SetSignalSendRate(50, 1)
+	defer SetSignalSendRate(0, 0)
+
+	// One chatty Traversal floods the limit while nine others each emit a few
+	// messages after it started.
+	const chattyMsgs, quietMsgs, quiet = 60, 3, 9
+	finished := make(chan int, quiet+1)
+	emit := func(i int, n int, tr *Traversal) {
+		for j := 0; j < n; j++ {
+			if !tr.emitMsg(append(getMsgBuf(), fmt.Sprintf("msg %d", j)...)) {
+				t.Errorf("Traversal %d failed to emit", i)
+			}
+		}
+		finished <- i
+	}
+	traversals := make([]*Traversal, quiet+1)
+	var wg sync.WaitGroup
+	for i := range traversals {
+		tr := newTraversal(0, nil)
+		tr.initChannels()
+		traversals[i] = tr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range tr.msgOutCh {
+			}
+		}()
+	}
+
+	start := time.Now()
+	go emit(0, chattyMsgs, traversals[0])
+	time.Sleep(100 * time.Millisecond)
+	for i := 1; i <= quiet; i++ {
+		go emit(i, quietMsgs, traversals[i])
+	}
+	var order []int
+	for i := 0; i <= quiet; i++ {
+		select {
+		case id := <-finished:
+			order = append(order, id)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Traversals didn't finish emitting")
+		}
+	}
+	elapsed := time.Since(start)
+	for _, tr := range traversals {
+		close(tr.msgOutCh)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 0, order[quiet], "The chatty Traversal shouldn't starve the others")
+	// 87 messages at 50 per second, with some slack
+	total := chattyMsgs + quiet*quietMsgs
+	assert.True(t, elapsed < time.Duration(total)*time.Second/50+time.Second, fmt.Sprintf("Emitting took too long: %s", elapsed))
+	assert.True(t, elapsed > time.Duration(total-5)*time.Second/50, fmt.Sprintf("Emitting wasn't limited: %s", elapsed))
+
+	stats := traversals[1].Stats()
+	assert.True(t, stats.SignalQueueWait > 0, "Queue wait should show up in Stats")
+	assert.True(t, stats.SignalQueueMaxWait <= stats.SignalQueueWait)
+	assert.True(t, stats.SignalQueueMaxWait < time.Second, fmt.Sprintf("Quiet Traversal waited too long: %s", stats.SignalQueueMaxWait))
+}
+
+func TestSignalBackpressure(t *testing.T) {
+	SetSignalSendRate(1, 1)
+	defer SetSignalSendRate(0, 0)
+	SetSignalMaxQueueDelay(100 * time.Millisecond)
+	defer SetSignalMaxQueueDelay(DefaultSignalMaxQueueDelay)
+
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	assert.True(t, tr.emitMsg(append(getMsgBuf(), "first"...)), "First message should use the burst")
+	assert.False(t, tr.emitMsg(append(getMsgBuf(), "second"...)), "Second message should wait too long")
+	assert.False(t, tr.emitMsg(append(getMsgBuf(), "third"...)))
+	select {
+	case err := <-tr.errCh:
+		assert.Equal(t, ErrSignalBackpressure, err)
+	default:
+		t.Fatal("Traversal should have failed")
+	}
+	select {
+	case err := <-tr.errCh:
+		t.Fatalf("Backpressure should only be reported once, got %s", err)
+	default:
+	}
+	assert.True(t, tr.Stats().SignalQueueMaxWait >= 100*time.Millisecond)
+}
@@ -0,0 +1,120 @@
+package natty
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// sockets creates the sockets that the library itself uses (as opposed to
+// those that natty creates), binding them to the device set with
+// WithBindToDevice, if any.
+type sockets struct {
+	device string
+}
+
+// socketsFor returns the sockets configured by the given Options.
+func socketsFor(opts []Option) sockets {
+	return newTraversal(0, opts).sockets
+}
+
+// check makes sure that the configured device can be bound to.
+func (s sockets) check() error {
+	if s.device == "" {
+		return nil
+	}
+	if !bindToDeviceSupported {
+		return fmt.Errorf("Unable to bind to device %s, binding to a device is only supported on Linux", s.device)
+	}
+	_, err := net.InterfaceByName(s.device)
+	if err != nil {
+		return fmt.Errorf("Unable to bind to device %s: %s", s.device, err)
+	}
+	return nil
+}
+
+func (s sockets) listenUDP(network string, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	if s.device == "" {
+		return net.ListenUDP(network, laddr)
+	}
+	address := ""
+	if laddr != nil {
+		address = laddr.String()
+	}
+	lc := &net.ListenConfig{Control: s.control}
+	conn, err := lc.ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func (s sockets) dialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	if s.device == "" {
+		return net.DialUDP(network, laddr, raddr)
+	}
+	d := &net.Dialer{Control: s.control}
+	if laddr != nil {
+		d.LocalAddr = laddr
+	}
+	conn, err := d.Dial(network, raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func (s sockets) listenTCP(network string, laddr *net.TCPAddr) (*net.TCPListener, error) {
+	if s.device == "" {
+		return net.ListenTCP(network, laddr)
+	}
+	lc := &net.ListenConfig{Control: s.control}
+	l, err := lc.Listen(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// dialTCP dials with SO_REUSEADDR, so that laddr can be bound while natty's
+// connection from it is in TIME_WAIT.
+func (s sockets) dialTCP(network string, laddr *net.TCPAddr, raddr *net.TCPAddr) (*net.TCPConn, error) {
+	d := &net.Dialer{LocalAddr: laddr, Control: s.reuseAddrControl}
+	conn, err := d.Dial(network, raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+func (s sockets) reuseAddrControl(network string, address string, c syscall.RawConn) error {
+	var reuseErr error
+	err := c.Control(func(fd uintptr) {
+		reuseErr = reuseAddr(fd)
+	})
+	if err != nil {
+		return err
+	}
+	if reuseErr != nil {
+		return fmt.Errorf("Unable to reuse address %s: %s", address, reuseErr)
+	}
+	if s.device == "" {
+		return nil
+	}
+	return s.control(network, address, c)
+}
+
+func (s sockets) control(network string, address string, c syscall.RawConn) error {
+	var bindErr error
+	err := c.Control(func(fd uintptr) {
+		bindErr = bindToDevice(fd, s.device)
+	})
+	if err != nil {
+		return err
+	}
+	if bindErr != nil {
+		return fmt.Errorf("Unable to bind to device %s: %s", s.device, bindErr)
+	}
+	return nil
+}
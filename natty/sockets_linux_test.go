@@ -0,0 +1,83 @@
+package natty
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestBindToDevice(t *testing.T) {
+	s := socketsFor([]Option{WithBindToDevice("lo")})
+	if !assert.NoError(t, s.check()) {
+		return
+	}
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	listening, err := s.listenUDP("udp4", loopback)
+	if err != nil {
+		t.Skipf("Unable to bind to device here: %s", err)
+	}
+	defer listening.Close()
+	assert.Equal(t, "lo", boundDevice(t, listening))
+
+	dialed, err := s.dialUDP("udp4", loopback, listening.LocalAddr().(*net.UDPAddr))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer dialed.Close()
+	assert.Equal(t, "lo", boundDevice(t, dialed))
+
+	// The conns from the helpers carry the binding too
+	conn, err := dialPortMapped(loopback, listening.LocalAddr().(*net.UDPAddr), nil, s)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "lo", boundDevice(t, conn.(*portMappedConn).UDPConn))
+		conn.Close()
+	}
+
+	unbound, err := sockets{}.listenUDP("udp4", loopback)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", boundDevice(t, unbound))
+		unbound.Close()
+	}
+
+	err = socketsFor([]Option{WithBindToDevice("nosuchdevice0")}).check()
+	assert.Error(t, err, "Missing device should fail the check")
+
+	binary, remove := sleepingNatty(t)
+	defer remove()
+	tr := newTraversal(0, []Option{WithBinary(binary), WithBindToDevice("lo")})
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.Contains(t, strings.Join(tr.cmd.Args, " "), "-device lo", "natty should bind to the device too")
+	}
+	binary, remove = scriptedNatty(t, "exec sleep 30", "offer")
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(binary), WithBindToDevice("lo")})
+	assert.True(t, errors.Is(tr.initCommand(nil), ErrUnsupportedOption), "natty that doesn't accept -device should fail the Traversal")
+}
+
+// boundDevice returns the device to which conn is bound, read back with
+// getsockopt.
+func boundDevice(t *testing.T, conn *net.UDPConn) string {
+	raw, err := conn.SyscallConn()
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	b := make([]byte, syscall.IFNAMSIZ)
+	l := uint32(len(b))
+	var errno syscall.Errno
+	raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, uintptr(unsafe.Pointer(&b[0])), uintptr(unsafe.Pointer(&l)), 0)
+	})
+	if errno != 0 {
+		t.Errorf("Unable to get SO_BINDTODEVICE: %s", errno)
+		return ""
+	}
+	for l > 0 && b[l-1] == 0 {
+		l--
+	}
+	return string(b[:l])
+}
@@ -0,0 +1,133 @@
+package natty
+
+import (
+	"fmt"
+	"sync"
+)
+
+// State is the state of a Traversal.
+type State int
+
+const (
+	// StateNew is the state of a Traversal whose natty hasn't started yet.
+	StateNew State = iota
+
+	// StateGathering is the state while natty gathers local candidates.
+	StateGathering
+
+	// StateChecking is the state once natty has gathered its candidates,
+	// while it checks connectivity with the peer's.
+	StateChecking
+
+	// StateConnected is the state once the Traversal has found its FiveTuple.
+	StateConnected
+
+	// StateFailed is the state once the Traversal has given up, for example
+	// because it timed out or natty failed.
+	StateFailed
+
+	// StateClosed is the state once the Traversal has been closed.
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateGathering:
+		return "gathering"
+	case StateChecking:
+		return "checking"
+	case StateConnected:
+		return "connected"
+	case StateFailed:
+		return "failed"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
+// stateTracker keeps track of a Traversal's State and passes changes to the
+// callbacks registered with OnStateChange.
+type stateTracker struct {
+	state       State
+	callbacks   []func(State)
+	events      []State // state changes waiting to be dispatched
+	dispatching bool
+	mutex       sync.Mutex
+}
+
+// OnStateChange registers a callback for changes of the Traversal's State,
+// which are passed to it in order, one at a time. The callback is invoked
+// synchronously by the goroutine that changes the State, which may be one of
+// the Traversal's own (or the one calling Close), so it shouldn't do anything
+// slow. It may call the Traversal though.
+func (t *Traversal) OnStateChange(cb func(State)) {
+	t.states.mutex.Lock()
+	t.states.callbacks = append(t.states.callbacks, cb)
+	t.states.mutex.Unlock()
+}
+
+// CurrentState returns the Traversal's State, for applications that poll it
+// rather than use OnStateChange.
+func (t *Traversal) CurrentState() State {
+	t.states.mutex.Lock()
+	defer t.states.mutex.Unlock()
+	return t.states.state
+}
+
+// setState moves the Traversal to the given State and passes the change to
+// the callbacks. States only ever move forward (except for Restart), so that
+// for example a Traversal that has been closed stays closed.
+func (t *Traversal) setState(state State) {
+	st := &t.states
+	st.mutex.Lock()
+	if state <= st.state {
+		st.mutex.Unlock()
+		return
+	}
+	st.state = state
+	st.events = append(st.events, state)
+	st.mutex.Unlock()
+	st.dispatch()
+}
+
+// restartState moves the Traversal back to StateGathering for Restart,
+// unless it has been closed in the meantime.
+func (t *Traversal) restartState() {
+	st := &t.states
+	st.mutex.Lock()
+	if st.state == StateClosed {
+		st.mutex.Unlock()
+		return
+	}
+	st.state = StateGathering
+	st.events = append(st.events, StateGathering)
+	st.mutex.Unlock()
+	st.dispatch()
+}
+
+// dispatch passes queued state changes to the callbacks, unless another
+// goroutine already is, so that they're passed in order.
+func (st *stateTracker) dispatch() {
+	st.mutex.Lock()
+	if st.dispatching {
+		st.mutex.Unlock()
+		return
+	}
+	st.dispatching = true
+	for len(st.events) > 0 {
+		state := st.events[0]
+		st.events = st.events[1:]
+		callbacks := st.callbacks
+		st.mutex.Unlock()
+		for _, cb := range callbacks {
+			cb(state)
+		}
+		st.mutex.Lock()
+	}
+	st.dispatching = false
+	st.mutex.Unlock()
+}
@@ -0,0 +1,46 @@
+package natty
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestStateChanges(t *testing.T) {
+	tr := newTraversal(0, nil)
+	assert.Equal(t, StateNew, tr.CurrentState())
+	var changes []State
+	tr.OnStateChange(func(state State) {
+		assert.Equal(t, state, tr.CurrentState(), "Callback should be able to call the Traversal")
+		changes = append(changes, state)
+	})
+	tr.setState(StateGathering)
+	tr.setState(StateChecking)
+	tr.setState(StateGathering)
+	tr.setState(StateConnected)
+	tr.Close()
+	tr.setState(StateFailed)
+	assert.Equal(t, []State{StateGathering, StateChecking, StateConnected, StateClosed}, changes, "States should only move forward")
+	assert.Equal(t, StateClosed, tr.CurrentState())
+	assert.Equal(t, "checking", StateChecking.String())
+}
+
+func TestStateFailed(t *testing.T) {
+	tr := newTraversal(0, []Option{WithBinary("/nonexistent/natty")})
+	states := make(chan State, 10)
+	tr.OnStateChange(func(state State) {
+		states <- state
+	})
+	tr.run(offerParams)
+	defer tr.Close()
+	_, err := tr.FiveTuple()
+	assert.Error(t, err)
+	select {
+	case state := <-states:
+		assert.Equal(t, StateFailed, state)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Traversal should have failed")
+	}
+	assert.Equal(t, StateFailed, tr.CurrentState())
+}
@@ -0,0 +1,270 @@
+package natty
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// GatheringUnknown means that no candidates have been exchanged yet.
+	GatheringUnknown = GatheringMode(iota)
+
+	// GatheringTrickle means that candidates were exchanged in individual
+	// messages as they were gathered (trickle ICE).
+	GatheringTrickle
+
+	// GatheringFull means that candidates were only exchanged as part of the
+	// session descriptions, after gathering finished.
+	GatheringFull
+)
+
+const (
+	// The milestones of a Traversal, for its Timings
+	milestoneStarted = milestone(iota)
+	milestoneProcessStarted
+	milestoneFirstRemote
+	milestoneFiveTuple
+	milestoneFinished
+	numMilestones
+)
+
+var (
+	candidatePattern = regexp.MustCompile(`candidate:\S+ \d+ \S+ \d+ (\S+) (\d+) typ (\S+)`)
+)
+
+// GatheringMode indicates how candidates were exchanged during a Traversal.
+type GatheringMode int
+
+func (m GatheringMode) String() string {
+	switch m {
+	case GatheringTrickle:
+		return "trickle"
+	case GatheringFull:
+		return "full"
+	}
+	return "unknown"
+}
+
+// Stats are statistics about a Traversal.
+type Stats struct {
+	// GatheringMode is the way in which candidates were actually exchanged.
+	// Trickle can degrade to full gathering, for example if the signaling
+	// channel closed early, so this may differ from what was expected.
+	GatheringMode GatheringMode
+
+	// LocalCandidates is the number of candidates that we trickled to the peer.
+	LocalCandidates int
+
+	// RemoteCandidates is the number of candidates that the peer trickled to us.
+	RemoteCandidates int
+
+	// SDPCandidates is the number of candidates included in the session
+	// descriptions exchanged in either direction.
+	SDPCandidates int
+
+	// LocalType and RemoteType are the candidate types (host, srflx, prflx or
+	// relay) of the nominated pair, empty if unknown.
+	LocalType  string
+	RemoteType string
+
+	// Timings break down how long the Traversal took.
+	Timings Timings
+
+	// PunchCoordinated is whether the peers coordinated the start of their
+	// connectivity checks (see WithPunchCoordination).
+	PunchCoordinated bool
+
+	// PunchSkew is how far apart we and the peer started connectivity checks
+	// when coordinated, as estimated from when the peer said it started and
+	// the signaling round trip.
+	PunchSkew time.Duration
+
+	// SignalQueueWait is how long our messages waited in total for the
+	// signaling rate limit (see SetSignalSendRate), and SignalQueueMaxWait how
+	// long the message that waited longest did.
+	SignalQueueWait    time.Duration
+	SignalQueueMaxWait time.Duration
+
+	// ReflexivePorts is how many of our local ports (see WithLocalPortCount)
+	// got a server reflexive mapping.
+	ReflexivePorts int
+}
+
+// Timings break down how long the phases of a Traversal took. Phases that
+// weren't reached (yet) are 0.
+type Timings struct {
+	// ProcessStart is how long it took to start natty.
+	ProcessStart time.Duration
+
+	// Gathering is how long natty took to gather local candidates, once it
+	// was running.
+	Gathering time.Duration
+
+	// PeerWait is how long it took to first hear from the peer.
+	PeerWait time.Duration
+
+	// Checks is how long the connectivity checks took, from when we had both
+	// our candidates and the peer's until natty nominated a pair.
+	Checks time.Duration
+
+	// Total is how long the Traversal took from start until it succeeded or
+	// failed.
+	Total time.Duration
+}
+
+func (tm Timings) String() string {
+	return fmt.Sprintf("process start %s, gathering %s, waiting for peer %s, checks %s, total %s",
+		tm.ProcessStart, tm.Gathering, tm.PeerWait, tm.Checks, tm.Total)
+}
+
+// milestone is a point reached during a Traversal.
+type milestone int
+
+// statsTracker tracks Stats as messages pass through a Traversal.
+type statsTracker struct {
+	stats       Stats
+	localTypes  map[string]string // types of the candidates we gathered, by address
+	remoteTypes map[string]string // types of the peer's candidates, by address
+	reached     [numMilestones]time.Time
+	mutex       sync.Mutex
+}
+
+// relayed indicates whether either end of ft is a relay candidate.
+func (st *statsTracker) relayed(ft *FiveTuple) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.localTypes[ft.Local] == "relay" || st.remoteTypes[ft.Remote] == "relay"
+}
+
+// Stats returns a snapshot of the statistics for this Traversal.
+func (t *Traversal) Stats() *Stats {
+	gathered := t.gathering.finishedAt()
+	local, _ := t.gathering.result()
+	t.outMutex.Lock()
+	ft := t.fiveTupleOut
+	t.outMutex.Unlock()
+
+	t.statsTracker.mutex.Lock()
+	defer t.statsTracker.mutex.Unlock()
+	stats := t.statsTracker.stats
+	if ft != nil {
+		stats.LocalType = t.statsTracker.localTypes[ft.Local]
+		stats.RemoteType = t.statsTracker.remoteTypes[ft.Remote]
+	}
+	stats.Timings = t.statsTracker.timings(gathered)
+	stats.PunchSkew, stats.PunchCoordinated = t.punch.startSkew()
+	stats.ReflexivePorts = reflexivePorts(local)
+	return &stats
+}
+
+// signalWaited records that a message waited for the signaling rate limit.
+func (st *statsTracker) signalWaited(waited time.Duration) {
+	if waited <= 0 {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.stats.SignalQueueWait += waited
+	if waited > st.stats.SignalQueueMaxWait {
+		st.stats.SignalQueueMaxWait = waited
+	}
+}
+
+// mark records that the Traversal reached the given milestone, if it hadn't
+// already.
+func (st *statsTracker) mark(m milestone) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.markLocked(m)
+}
+
+func (st *statsTracker) markLocked(m milestone) {
+	if st.reached[m].IsZero() {
+		st.reached[m] = time.Now()
+	}
+}
+
+// timings calculates the Timings given when gathering finished.
+func (st *statsTracker) timings(gathered time.Time) Timings {
+	between := func(from time.Time, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return to.Sub(from)
+	}
+	started := st.reached[milestoneStarted]
+	processStarted := st.reached[milestoneProcessStarted]
+	firstRemote := st.reached[milestoneFirstRemote]
+	checksFrom := gathered
+	if firstRemote.After(checksFrom) {
+		checksFrom = firstRemote
+	}
+	return Timings{
+		ProcessStart: between(started, processStarted),
+		Gathering:    between(processStarted, gathered),
+		PeerWait:     between(started, firstRemote),
+		Checks:       between(checksFrom, st.reached[milestoneFiveTuple]),
+		Total:        between(started, st.reached[milestoneFinished]),
+	}
+}
+
+// track updates the stats based on a message, which is either outbound from
+// natty to the peer (local) or inbound from the peer.
+func (st *statsTracker) track(msg []byte, local bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if !local {
+		st.markLocked(milestoneFirstRemote)
+	}
+	for _, match := range candidatePattern.FindAllSubmatchIndex(msg, -1) {
+		if st.localTypes == nil {
+			st.localTypes = make(map[string]string)
+			st.remoteTypes = make(map[string]string)
+		}
+		addr := net.JoinHostPort(string(msg[match[2]:match[3]]), string(msg[match[4]:match[5]]))
+		typ := candidateType(msg[match[6]:match[7]])
+		if local {
+			st.localTypes[addr] = typ
+		} else {
+			st.remoteTypes[addr] = typ
+		}
+	}
+
+	if isCandidate(msg) {
+		if local {
+			st.stats.LocalCandidates++
+		} else {
+			st.stats.RemoteCandidates++
+		}
+		st.stats.GatheringMode = GatheringTrickle
+		return
+	}
+
+	sdpCandidates := bytes.Count(msg, []byte("a=candidate:"))
+	if sdpCandidates > 0 {
+		st.stats.SDPCandidates += sdpCandidates
+		if st.stats.GatheringMode == GatheringUnknown {
+			st.stats.GatheringMode = GatheringFull
+		}
+	}
+}
+
+// candidateType returns typ as a string, reusing the known candidate types
+// rather than allocating a new string for each candidate.
+func candidateType(typ []byte) string {
+	for _, known := range candidateTypes {
+		if string(typ) == known {
+			return known
+		}
+	}
+	return string(typ)
+}
+
+func isCandidate(msg []byte) bool {
+	return bytes.Contains(msg, []byte("\"candidate\":"))
+}
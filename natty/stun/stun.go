@@ -0,0 +1,343 @@
+// Package stun is a minimal STUN client (RFC 5389), just enough to find out
+// what a UDP socket's address looks like from the outside, for example for
+// telemetry or debugging. Since it works on the caller's socket, the address
+// that it finds is the mapping for a real application port.
+package stun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRTO is the initial retransmission timeout recommended by RFC 5389
+	// section 7.2.1.
+	DefaultRTO = 500 * time.Millisecond
+
+	// Rc is how many times a request is sent in total, and Rm how many RTOs
+	// to wait for a response after the last one (RFC 5389 section 7.2.1).
+	Rc = 7
+	Rm = 16
+
+	// ChangeIP and ChangePort are the flags of the CHANGE-REQUEST attribute
+	// (RFC 5780 section 7.2), which ask the server to respond from its
+	// alternate IP or port (see Transaction.ChangeRequest).
+	ChangeIP   = 0x04
+	ChangePort = 0x02
+
+	bindingRequest       = 0x0001
+	bindingResponse      = 0x0101
+	bindingErrorResponse = 0x0111
+	magicCookie          = 0x2112A442
+	headerSize           = 20
+
+	attrMappedAddress    = 0x0001
+	attrChangeRequest    = 0x0003
+	attrChangedAddress   = 0x0005
+	attrErrorCode        = 0x0009
+	attrXorMappedAddress = 0x0020
+	attrOtherAddress     = 0x802C
+)
+
+var (
+	// ErrTimeout means that the STUN server didn't respond to any of the
+	// transmissions of a request.
+	ErrTimeout = errors.New("STUN server didn't respond")
+
+	// rto is the initial retransmission timeout that Query uses.
+	rto = DefaultRTO
+)
+
+// Response is a response to a binding request.
+type Response struct {
+	// TransactionID identifies the request that this is a response to.
+	TransactionID [12]byte
+
+	// Mapped is the address from which the server saw the request, invalid
+	// if this is an error response.
+	Mapped netip.AddrPort
+
+	// Other is the server's alternate address, from RFC 5780's OTHER-ADDRESS
+	// or RFC 3489's CHANGED-ADDRESS, invalid if the server didn't say.
+	Other netip.AddrPort
+
+	// ErrorCode is the code from an error response, 0 for a success response.
+	ErrorCode int
+
+	// Reason is the reason phrase from an error response.
+	Reason string
+}
+
+// Transaction is a single binding request, for callers that read their socket
+// themselves and so can't use Query, like those that share it with other
+// traffic. Send Request() to the server, retransmitting it per Timeouts, until
+// Match returns a Response.
+type Transaction struct {
+	id [12]byte
+}
+
+// NewTransaction starts a binding request with a random transaction ID.
+func NewTransaction() (*Transaction, error) {
+	tx := &Transaction{}
+	_, err := rand.Read(tx.id[:])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate transaction ID: %s", err)
+	}
+	return tx, nil
+}
+
+// ID is the transaction ID, which responses repeat.
+func (tx *Transaction) ID() [12]byte {
+	return tx.id
+}
+
+// Request encodes the binding request.
+func (tx *Transaction) Request() []byte {
+	b := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(b, bindingRequest)
+	binary.BigEndian.PutUint32(b[4:], magicCookie)
+	copy(b[8:], tx.id[:])
+	return b
+}
+
+// ChangeRequest encodes the binding request with a CHANGE-REQUEST attribute
+// carrying the given flags (ChangeIP and/or ChangePort), for finding out which
+// responses a NAT lets in (RFC 5780 section 4.4). Servers that don't support
+// it, as many meant for ICE don't, ignore it or respond with an error.
+func (tx *Transaction) ChangeRequest(flags uint32) []byte {
+	b := append(tx.Request(), make([]byte, 8)...)
+	binary.BigEndian.PutUint16(b[2:], 8)
+	binary.BigEndian.PutUint16(b[headerSize:], attrChangeRequest)
+	binary.BigEndian.PutUint16(b[headerSize+2:], 4)
+	binary.BigEndian.PutUint32(b[headerSize+4:], flags)
+	return b
+}
+
+// Match parses b as a response to the request, returning nil if it's not one,
+// for example because it's some other traffic or a response to an older
+// request. Error responses are returned as an error.
+func (tx *Transaction) Match(b []byte) (*Response, error) {
+	resp, err := ParseResponse(b)
+	if err != nil || resp.TransactionID != tx.id {
+		return nil, nil
+	}
+	if resp.ErrorCode != 0 {
+		return resp, fmt.Errorf("STUN server responded with error %d %s", resp.ErrorCode, resp.Reason)
+	}
+	return resp, nil
+}
+
+// Timeouts returns how long to wait for a response after each transmission of
+// a request, starting from the retransmission timeout rto (DefaultRTO if 0),
+// per RFC 5389 section 7.2.1: doubling after each of the first Rc-1
+// transmissions, and Rm times rto after the last one. With the defaults, that's
+// 39.5 seconds in all.
+func Timeouts(rto time.Duration) []time.Duration {
+	if rto <= 0 {
+		rto = DefaultRTO
+	}
+	timeouts := make([]time.Duration, 0, Rc)
+	for i := 0; i < Rc-1; i++ {
+		timeouts = append(timeouts, rto<<uint(i))
+	}
+	return append(timeouts, Rm*rto)
+}
+
+// Query asks the STUN server at [stun:]host:port what conn's address looks
+// like from the outside, sending a binding request from conn and
+// retransmitting it per Timeouts until the server responds or ctx is done.
+// The server may be IPv4 or IPv6, as long as conn can reach it. Query reads
+// from conn until it's done, dropping anything that isn't the response, and
+// uses conn's read deadline, which it clears when it's done. It fails with
+// ErrTimeout if the server doesn't respond to any of the transmissions.
+func Query(ctx context.Context, conn net.PacketConn, server string) (netip.AddrPort, error) {
+	addr, err := net.ResolveUDPAddr(networkFor(conn), strings.TrimPrefix(server, "stun:"))
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("Unable to resolve STUN server %s: %s", server, err)
+	}
+	serverAddr := addr.AddrPort()
+	tx, err := NewTransaction()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	req := tx.Request()
+
+	// Unblock reads once ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	defer conn.SetReadDeadline(time.Time{})
+
+	b := make([]byte, 1500)
+	for _, timeout := range Timeouts(rto) {
+		_, err := conn.WriteTo(req, addr)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("Unable to send binding request to %s: %s", server, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		if ctx.Err() != nil {
+			// Done before we set the deadline
+			return netip.AddrPort{}, ctx.Err()
+		}
+		for {
+			n, from, err := conn.ReadFrom(b)
+			if ctx.Err() != nil {
+				return netip.AddrPort{}, ctx.Err()
+			}
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					// Retransmit
+					break
+				}
+				return netip.AddrPort{}, fmt.Errorf("Unable to read response from %s: %s", server, err)
+			}
+			if !fromServer(from, serverAddr) {
+				continue
+			}
+			resp, err := tx.Match(b[:n])
+			if err != nil {
+				return netip.AddrPort{}, err
+			}
+			if resp != nil {
+				if !resp.Mapped.IsValid() {
+					return netip.AddrPort{}, fmt.Errorf("STUN server %s didn't say what our address is", server)
+				}
+				return resp.Mapped, nil
+			}
+		}
+	}
+	return netip.AddrPort{}, ErrTimeout
+}
+
+// networkFor picks the network with which to resolve the server, so that a
+// conn bound to an address of one IP version gets a server of the same
+// version.
+func networkFor(conn net.PacketConn) string {
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || local.IP == nil || local.IP.IsUnspecified() {
+		return "udp"
+	}
+	if local.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+func fromServer(from net.Addr, server netip.AddrPort) bool {
+	udpAddr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	addr := udpAddr.AddrPort()
+	return addr.Addr().Unmap() == server.Addr().Unmap() && addr.Port() == server.Port()
+}
+
+// ParseResponse parses a binding success or error response. Mapped comes from
+// the XOR-MAPPED-ADDRESS attribute, or from MAPPED-ADDRESS for servers that
+// predate RFC 5389, and Other likewise from OTHER-ADDRESS or CHANGED-ADDRESS.
+func ParseResponse(b []byte) (*Response, error) {
+	if len(b) < headerSize || b[0]&0xC0 != 0 || binary.BigEndian.Uint32(b[4:]) != magicCookie {
+		return nil, fmt.Errorf("Not a STUN message")
+	}
+	typ := binary.BigEndian.Uint16(b)
+	if typ != bindingResponse && typ != bindingErrorResponse {
+		return nil, fmt.Errorf("Not a binding response: %#04x", typ)
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length%4 != 0 || len(b) < headerSize+length {
+		return nil, fmt.Errorf("Truncated STUN message")
+	}
+	resp := &Response{}
+	copy(resp.TransactionID[:], b[8:headerSize])
+	var mapped, changed netip.AddrPort
+	attrs := b[headerSize : headerSize+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs)
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+attrLen {
+			return nil, fmt.Errorf("Truncated STUN attribute %#04x", attrType)
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case attrXorMappedAddress:
+			if addr, ok := parseAddr(value, b[4:headerSize]); ok {
+				resp.Mapped = addr
+			}
+		case attrMappedAddress:
+			if addr, ok := parseAddr(value, nil); ok {
+				mapped = addr
+			}
+		case attrOtherAddress:
+			if addr, ok := parseAddr(value, nil); ok {
+				resp.Other = addr
+			}
+		case attrChangedAddress:
+			if addr, ok := parseAddr(value, nil); ok {
+				changed = addr
+			}
+		case attrErrorCode:
+			if len(value) >= 4 {
+				resp.ErrorCode = int(value[2]&0x07)*100 + int(value[3])
+				resp.Reason = string(value[4:])
+			}
+		}
+		// Attributes are padded to a multiple of 4 bytes
+		padded := 4 + (attrLen+3)&^3
+		if padded > len(attrs) {
+			break
+		}
+		attrs = attrs[padded:]
+	}
+	if typ == bindingErrorResponse {
+		resp.Mapped, resp.Other = netip.AddrPort{}, netip.AddrPort{}
+		if resp.ErrorCode == 0 {
+			return nil, fmt.Errorf("Error response without error code")
+		}
+		return resp, nil
+	}
+	resp.ErrorCode, resp.Reason = 0, ""
+	if !resp.Mapped.IsValid() {
+		resp.Mapped = mapped
+	}
+	if !resp.Other.IsValid() {
+		resp.Other = changed
+	}
+	return resp, nil
+}
+
+// parseAddr parses the value of an address attribute like (XOR-)MAPPED-ADDRESS,
+// XOR'ed with xor (the magic cookie and transaction ID) unless that's nil.
+func parseAddr(value []byte, xor []byte) (netip.AddrPort, bool) {
+	if len(value) < 4 {
+		return netip.AddrPort{}, false
+	}
+	ip := append([]byte{}, value[4:]...)
+	switch {
+	case value[1] == 0x01 && len(ip) == 4:
+	case value[1] == 0x02 && len(ip) == 16:
+	default:
+		return netip.AddrPort{}, false
+	}
+	port := binary.BigEndian.Uint16(value[2:])
+	if xor != nil {
+		port ^= magicCookie >> 16
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr, port), true
+}
@@ -0,0 +1,269 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestQuery(t *testing.T) {
+	defer func(orig time.Duration) { rto = orig }(rto)
+	rto = 50 * time.Millisecond
+
+	for _, network := range []string{"udp4", "udp6"} {
+		ip := net.IPv4(127, 0, 0, 1)
+		if network == "udp6" {
+			ip = net.IPv6loopback
+		}
+		server, err := startResponder(network, ip)
+		if err != nil {
+			t.Logf("Skipping %s: %s", network, err)
+			continue
+		}
+		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+		if !assert.NoError(t, err) {
+			server.close()
+			return
+		}
+
+		// Lose the first couple of requests, and precede the response with
+		// one to another request and one from a stranger
+		server.set(func(r *responder) { r.drop, r.decoy = 2, true })
+		mapped, err := Query(context.Background(), conn, "stun:"+server.addr())
+		if assert.NoError(t, err, network) {
+			assert.Equal(t, conn.LocalAddr().(*net.UDPAddr).AddrPort().String(), mapped.String())
+		}
+		assert.Equal(t, int32(3), atomic.LoadInt32(&server.requests), "Should have retransmitted")
+
+		server.set(func(r *responder) { r.errorCode = 420 })
+		_, err = Query(context.Background(), conn, server.addr())
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "420")
+		}
+
+		server.set(func(r *responder) { r.silent = true })
+		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Millisecond)
+		start := time.Now()
+		_, err = Query(ctx, conn, server.addr())
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.True(t, time.Since(start) < time.Second, "Should give up once context is done")
+
+		rto = time.Millisecond
+		_, err = Query(context.Background(), conn, server.addr())
+		assert.Equal(t, ErrTimeout, err)
+		rto = 50 * time.Millisecond
+
+		conn.Close()
+		server.close()
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	timeouts := Timeouts(0)
+	assert.Len(t, timeouts, Rc)
+	total := time.Duration(0)
+	for _, timeout := range timeouts {
+		total += timeout
+	}
+	assert.Equal(t, 39500*time.Millisecond, total, "RFC 5389 says 39.5 seconds")
+	assert.Equal(t, 8*time.Second, timeouts[Rc-1], "Last wait is Rm times the initial RTO")
+}
+
+func TestParseResponse(t *testing.T) {
+	tx, err := NewTransaction()
+	if !assert.NoError(t, err) {
+		return
+	}
+	mapped := netip.MustParseAddrPort("[2001:db8::1]:5000")
+	resp, err := tx.Match(encodeResponse(tx.ID(), mapped, 0))
+	if assert.NoError(t, err) && assert.NotNil(t, resp) {
+		assert.Equal(t, mapped, resp.Mapped)
+	}
+
+	other, _ := NewTransaction()
+	resp, err = tx.Match(encodeResponse(other.ID(), mapped, 0))
+	assert.NoError(t, err)
+	assert.Nil(t, resp, "Response to other request shouldn't match")
+
+	resp, err = tx.Match(encodeResponse(tx.ID(), netip.AddrPort{}, 401))
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, 401, resp.ErrorCode)
+		assert.Equal(t, "Unauthorized", resp.Reason)
+	}
+
+	// Plain MAPPED-ADDRESS from servers that predate RFC 5389
+	legacy := tx.Request()
+	binary.BigEndian.PutUint16(legacy, bindingResponse)
+	legacy = appendAttr(legacy, attrMappedAddress, []byte{0, 0x01, 0x13, 0x88, 203, 0, 113, 7})
+	resp, err = ParseResponse(legacy)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "203.0.113.7:5000", resp.Mapped.String())
+	}
+
+	// The alternate address, preferably from OTHER-ADDRESS
+	legacy = appendAttr(legacy, attrChangedAddress, []byte{0, 0x01, 0x13, 0x89, 203, 0, 113, 8})
+	resp, err = ParseResponse(legacy)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "203.0.113.8:5001", resp.Other.String())
+	}
+	legacy = appendAttr(legacy, attrOtherAddress, []byte{0, 0x01, 0x13, 0x8a, 203, 0, 113, 9})
+	resp, err = ParseResponse(legacy)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "203.0.113.9:5002", resp.Other.String())
+	}
+
+	_, err = ParseResponse(tx.Request())
+	assert.Error(t, err, "Request isn't a response")
+	_, err = ParseResponse([]byte("not stun"))
+	assert.Error(t, err)
+}
+
+func TestChangeRequest(t *testing.T) {
+	tx, err := NewTransaction()
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := tx.ChangeRequest(ChangeIP | ChangePort)
+	if assert.Len(t, b, headerSize+8) {
+		assert.Equal(t, tx.Request()[4:headerSize], b[4:headerSize], "Should be the same transaction")
+		assert.Equal(t, uint16(8), binary.BigEndian.Uint16(b[2:]))
+		assert.Equal(t, uint16(attrChangeRequest), binary.BigEndian.Uint16(b[headerSize:]))
+		assert.Equal(t, uint32(ChangeIP|ChangePort), binary.BigEndian.Uint32(b[headerSize+4:]))
+	}
+}
+
+func FuzzParseResponse(f *testing.F) {
+	tx, _ := NewTransaction()
+	f.Add(encodeResponse(tx.ID(), netip.MustParseAddrPort("203.0.113.7:5000"), 0))
+	f.Add(encodeResponse(tx.ID(), netip.MustParseAddrPort("[2001:db8::1]:5000"), 0))
+	f.Add(encodeResponse(tx.ID(), netip.AddrPort{}, 500))
+	f.Add(tx.Request())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		resp, err := ParseResponse(b)
+		if err != nil {
+			return
+		}
+		if resp.ErrorCode == 0 && resp.Mapped.IsValid() {
+			addr := resp.Mapped.Addr()
+			if !addr.Is4() && !addr.Is6() {
+				t.Fatalf("Bad mapped address %s", resp.Mapped)
+			}
+		}
+	})
+}
+
+// responder is an in-process STUN server that answers binding requests with
+// the address that they came from.
+type responder struct {
+	conn      *net.UDPConn
+	requests  int32
+	drop      int32 // how many requests to ignore before answering
+	decoy     bool  // whether to send irrelevant packets ahead of responses
+	errorCode int   // if set, responds with this error
+	silent    bool
+	mutex     sync.Mutex
+}
+
+func startResponder(network string, ip net.IP) (*responder, error) {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+	if err != nil {
+		return nil, err
+	}
+	r := &responder{conn: conn}
+	go r.serve()
+	return r, nil
+}
+
+func (r *responder) addr() string {
+	return r.conn.LocalAddr().String()
+}
+
+func (r *responder) set(configure func(r *responder)) {
+	r.mutex.Lock()
+	configure(r)
+	r.mutex.Unlock()
+}
+
+func (r *responder) close() {
+	r.conn.Close()
+}
+
+func (r *responder) serve() {
+	b := make([]byte, 1500)
+	for {
+		n, from, err := r.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		if n < headerSize || binary.BigEndian.Uint16(b) != bindingRequest {
+			continue
+		}
+		requests := atomic.AddInt32(&r.requests, 1)
+		r.mutex.Lock()
+		silent, drop, decoy, errorCode := r.silent, r.drop, r.decoy, r.errorCode
+		r.mutex.Unlock()
+		if silent || requests <= drop {
+			continue
+		}
+		var id [12]byte
+		copy(id[:], b[8:headerSize])
+		if decoy {
+			r.conn.WriteToUDP(encodeResponse([12]byte{1}, netip.MustParseAddrPort("203.0.113.7:1"), 0), from)
+			stranger, err := net.ListenUDP(from.Network(), &net.UDPAddr{IP: r.conn.LocalAddr().(*net.UDPAddr).IP})
+			if err == nil {
+				stranger.WriteToUDP(encodeResponse(id, netip.MustParseAddrPort("203.0.113.7:2"), 0), from)
+				stranger.Close()
+			}
+		}
+		r.conn.WriteToUDP(encodeResponse(id, from.AddrPort(), errorCode), from)
+	}
+}
+
+// encodeResponse encodes a success response with an XOR-MAPPED-ADDRESS, or an
+// error response if code is set.
+func encodeResponse(id [12]byte, mapped netip.AddrPort, code int) []byte {
+	b := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(b[4:], magicCookie)
+	copy(b[8:], id[:])
+	if code != 0 {
+		binary.BigEndian.PutUint16(b, bindingErrorResponse)
+		reason := "Unauthorized"
+		if code != 401 {
+			reason = "Error"
+		}
+		return appendAttr(b, attrErrorCode, append([]byte{0, 0, byte(code / 100), byte(code % 100)}, reason...))
+	}
+	binary.BigEndian.PutUint16(b, bindingResponse)
+	ip := mapped.Addr().Unmap().AsSlice()
+	value := make([]byte, 4+len(ip))
+	value[1] = 0x01
+	if len(ip) == 16 {
+		value[1] = 0x02
+	}
+	binary.BigEndian.PutUint16(value[2:], mapped.Port()^(magicCookie>>16))
+	for i := range ip {
+		value[4+i] = ip[i] ^ b[4+i]
+	}
+	return appendAttr(b, attrXorMappedAddress, value)
+}
+
+func appendAttr(b []byte, typ uint16, value []byte) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header, typ)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(value)))
+	b = append(append(b, header...), value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-headerSize))
+	return b
+}
@@ -0,0 +1,261 @@
+package natty
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	stunMagicCookie = 0x2112A442
+	stunHeaderSize  = 20
+
+	stunAttrUsername           = 0x0006
+	stunAttrMessageIntegrity   = 0x0008
+	stunAttrErrorCode          = 0x0009
+	stunAttrChannelNumber      = 0x000C
+	stunAttrLifetime           = 0x000D
+	stunAttrXorPeerAddress     = 0x0012
+	stunAttrData               = 0x0013
+	stunAttrRealm              = 0x0014
+	stunAttrNonce              = 0x0015
+	stunAttrXorRelayedAddress  = 0x0016
+	stunAttrRequestedTransport = 0x0019
+	stunAttrXorMappedAddress   = 0x0020
+)
+
+// stunMessage is a STUN message (RFC 5389), just enough of it to talk TURN
+// (RFC 5766).
+type stunMessage struct {
+	typ   uint16
+	txId  []byte
+	attrs []stunAttr
+}
+
+type stunAttr struct {
+	typ   uint16
+	value []byte
+}
+
+// newSTUNMessage creates a STUN message of the given type with a random
+// transaction id.
+func newSTUNMessage(typ uint16) *stunMessage {
+	txId := make([]byte, 12)
+	rand.Read(txId)
+	return &stunMessage{typ: typ, txId: txId}
+}
+
+// reply creates a STUN message of the given type with the same transaction id
+// as m.
+func (m *stunMessage) reply(typ uint16) *stunMessage {
+	return &stunMessage{typ: typ, txId: m.txId}
+}
+
+func (m *stunMessage) add(typ uint16, value []byte) *stunMessage {
+	m.attrs = append(m.attrs, stunAttr{typ, value})
+	return m
+}
+
+func (m *stunMessage) addUint32(typ uint16, value uint32) *stunMessage {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	return m.add(typ, b)
+}
+
+func (m *stunMessage) addAddr(typ uint16, addr *net.UDPAddr) *stunMessage {
+	return m.add(typ, xorAddr(addr, m.txId))
+}
+
+// addError adds an ERROR-CODE attribute with the given code and reason.
+func (m *stunMessage) addError(code int, reason string) *stunMessage {
+	return m.add(stunAttrErrorCode, append([]byte{0, 0, byte(code / 100), byte(code % 100)}, reason...))
+}
+
+// withTxId copies m with the given transaction id, re-encoding its XOR'ed
+// address attributes to match.
+func (m *stunMessage) withTxId(txId []byte) *stunMessage {
+	c := &stunMessage{typ: m.typ, txId: txId}
+	for _, attr := range m.attrs {
+		switch attr.typ {
+		case stunAttrXorPeerAddress, stunAttrXorRelayedAddress, stunAttrXorMappedAddress:
+			if addr := unxorAddr(attr.value, m.txId); addr != nil {
+				c.addAddr(attr.typ, addr)
+				continue
+			}
+		}
+		c.add(attr.typ, attr.value)
+	}
+	return c
+}
+
+// get returns the value of the first attribute of the given type, or nil.
+func (m *stunMessage) get(typ uint16) []byte {
+	for _, attr := range m.attrs {
+		if attr.typ == typ {
+			return attr.value
+		}
+	}
+	return nil
+}
+
+func (m *stunMessage) getUint32(typ uint16) (uint32, bool) {
+	value := m.get(typ)
+	if len(value) < 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value), true
+}
+
+// getAddrs returns the values of all XOR'ed address attributes of the given
+// type.
+func (m *stunMessage) getAddrs(typ uint16) []*net.UDPAddr {
+	var addrs []*net.UDPAddr
+	for _, attr := range m.attrs {
+		if attr.typ == typ {
+			if addr := unxorAddr(attr.value, m.txId); addr != nil {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+func (m *stunMessage) getAddr(typ uint16) *net.UDPAddr {
+	addrs := m.getAddrs(typ)
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// errorCode returns the code from the message's ERROR-CODE attribute, or 0.
+func (m *stunMessage) errorCode() int {
+	value := m.get(stunAttrErrorCode)
+	if len(value) < 4 {
+		return 0
+	}
+	return int(value[2]&0x07)*100 + int(value[3])
+}
+
+// isSuccess indicates whether m is a success response.
+func (m *stunMessage) isSuccess() bool {
+	return m.typ&0x0110 == 0x0100
+}
+
+// encode encodes the message, adding a MESSAGE-INTEGRITY attribute if key is
+// not nil.
+func (m *stunMessage) encode(key []byte) []byte {
+	b := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(b, m.typ)
+	binary.BigEndian.PutUint32(b[4:], stunMagicCookie)
+	copy(b[8:], m.txId)
+	for _, attr := range m.attrs {
+		b = appendAttr(b, attr.typ, attr.value)
+	}
+	if key != nil {
+		// The integrity covers the header with a length that includes the
+		// MESSAGE-INTEGRITY attribute itself
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)-stunHeaderSize+24))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(b)
+		b = appendAttr(b, stunAttrMessageIntegrity, mac.Sum(nil))
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-stunHeaderSize))
+	return b
+}
+
+func appendAttr(b []byte, typ uint16, value []byte) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header, typ)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(value)))
+	b = append(b, header...)
+	b = append(b, value...)
+	// Attributes are padded to a multiple of 4 bytes
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// isSTUN indicates whether b looks like a STUN message, as opposed to TURN
+// ChannelData.
+func isSTUN(b []byte) bool {
+	return len(b) >= stunHeaderSize && b[0]&0xC0 == 0 && binary.BigEndian.Uint32(b[4:]) == stunMagicCookie
+}
+
+// parseSTUN parses a STUN message.
+func parseSTUN(b []byte) (*stunMessage, error) {
+	if !isSTUN(b) {
+		return nil, fmt.Errorf("Not a STUN message")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if len(b) < stunHeaderSize+length {
+		return nil, fmt.Errorf("Truncated STUN message")
+	}
+	m := &stunMessage{
+		typ:  binary.BigEndian.Uint16(b),
+		txId: append([]byte{}, b[8:stunHeaderSize]...),
+	}
+	attrs := b[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs)
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+attrLen {
+			return nil, fmt.Errorf("Truncated STUN attribute %#04x", typ)
+		}
+		m.attrs = append(m.attrs, stunAttr{typ, append([]byte{}, attrs[4:4+attrLen]...)})
+		padded := 4 + (attrLen+3)&^3
+		if padded > len(attrs) {
+			break
+		}
+		attrs = attrs[padded:]
+	}
+	return m, nil
+}
+
+// longTermKey derives the key for STUN's long-term credential mechanism.
+func longTermKey(username string, realm string, password string) []byte {
+	key := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return key[:]
+}
+
+// xorAddr encodes addr as the value of an XOR'ed address attribute.
+func xorAddr(addr *net.UDPAddr, txId []byte) []byte {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+	b := make([]byte, 4+len(ip))
+	b[1] = family
+	binary.BigEndian.PutUint16(b[2:], uint16(addr.Port)^(stunMagicCookie>>16))
+	xorIP(b[4:], ip, txId)
+	return b
+}
+
+// unxorAddr decodes the value of an XOR'ed address attribute, returning nil
+// if it's invalid.
+func unxorAddr(value []byte, txId []byte) *net.UDPAddr {
+	if len(value) != 8 && len(value) != 20 {
+		return nil
+	}
+	ip := make(net.IP, len(value)-4)
+	xorIP(ip, value[4:], txId)
+	port := binary.BigEndian.Uint16(value[2:]) ^ (stunMagicCookie >> 16)
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+// xorIP XORs ip with the magic cookie followed by the transaction id into dst.
+func xorIP(dst []byte, ip []byte, txId []byte) {
+	xor := make([]byte, 16)
+	binary.BigEndian.PutUint32(xor, stunMagicCookie)
+	copy(xor[4:], txId)
+	for i := range ip {
+		dst[i] = ip[i] ^ xor[i]
+	}
+}
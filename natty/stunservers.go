@@ -0,0 +1,27 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// checkSTUNServers makes sure that the STUN servers set with WithSTUNServers
+// are all [stun:]host:port.
+func checkSTUNServers(servers []string) error {
+	for _, server := range servers {
+		host, port, err := net.SplitHostPort(strings.TrimPrefix(server, "stun:"))
+		if err != nil {
+			return fmt.Errorf("Invalid STUN server %q, should be [stun:]host:port: %s", server, err)
+		}
+		if host == "" {
+			return fmt.Errorf("Invalid STUN server %q, host is missing", server)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("Invalid STUN server %q, port should be between 1 and 65535", server)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package natty
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestCheckSTUNServers(t *testing.T) {
+	assert.NoError(t, checkSTUNServers(nil))
+	assert.NoError(t, checkSTUNServers(DefaultSTUNServers))
+	assert.NoError(t, checkSTUNServers([]string{"stun.internal:3478", "192.168.1.1:3478", "[2001:db8::1]:3478"}))
+	for _, bad := range []string{"stun.internal", ":3478", "stun.internal:", "stun.internal:stun", "stun.internal:70000", "2001:db8::1:3478"} {
+		assert.Error(t, checkSTUNServers([]string{bad}), bad)
+	}
+
+	tr := newTraversal(0, []Option{WithSTUNServers([]string{"stun.internal"})})
+	err := tr.initCommand(nil)
+	if assert.Error(t, err, "Malformed STUN server should fail the Traversal") {
+		assert.Contains(t, err.Error(), "stun.internal")
+	}
+}
+
+func TestSTUNServersPassedToNatty(t *testing.T) {
+	binary, remove := sleepingNatty(t)
+	defer remove()
+	tr := newTraversal(0, []Option{WithBinary(binary), WithSTUNServers([]string{"stun.internal:3478", "192.168.1.1:3478"})})
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.Contains(t, strings.Join(tr.cmd.Args, " "), "-stuns stun.internal:3478,192.168.1.1:3478", "natty takes STUN servers as -stuns")
+	}
+}
@@ -0,0 +1,146 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// TransportUDP only traverses over UDP. This is the default.
+	TransportUDP = Transport(iota)
+
+	// TransportFallbackTCP gathers TCP candidates (RFC 6544) besides UDP ones,
+	// but prefers direct UDP pairs, so that TCP is only used when no UDP pair
+	// works, for example on networks that block outbound UDP. TCP pairs are
+	// established with simultaneous open where both sides are behind NATs.
+	TransportFallbackTCP
+
+	// TransportPreferTCP gathers both TCP and UDP candidates and prefers pairs
+	// over TCP, falling back to UDP if no TCP pair works. Check
+	// FiveTuple.Proto to find out which one won.
+	TransportPreferTCP
+
+	// TransportTCP only traverses over TCP, for networks that block UDP.
+	TransportTCP
+)
+
+// Transport determines which transport protocol(s) a Traversal uses.
+type Transport int
+
+func (tr Transport) String() string {
+	switch tr {
+	case TransportUDP:
+		return "udp"
+	case TransportFallbackTCP:
+		return "fallback-tcp"
+	case TransportPreferTCP:
+		return "prefer-tcp"
+	case TransportTCP:
+		return "tcp"
+	}
+	return fmt.Sprintf("Transport(%d)", int(tr))
+}
+
+// ParseTransport parses a Transport from "udp" (or ""), "fallback-tcp",
+// "prefer-tcp" or "tcp".
+func ParseTransport(s string) (Transport, error) {
+	switch s {
+	case "", "udp":
+		return TransportUDP, nil
+	case "fallback-tcp":
+		return TransportFallbackTCP, nil
+	case "prefer-tcp":
+		return TransportPreferTCP, nil
+	case "tcp":
+		return TransportTCP, nil
+	}
+	return TransportUDP, fmt.Errorf("Unknown transport %s, should be udp, fallback-tcp, prefer-tcp or tcp", s)
+}
+
+// CheckTransport returns an error that unwraps to ErrUnsupportedOption if
+// Traversals given WithTransport(transport) would fail because the natty
+// executable that they run (see SetBinaryPath) doesn't accept -transport, as is
+// the case with the embedded natty. Programs can call it while parsing their
+// flags, rather than finding out from the first traversal.
+func CheckTransport(transport Transport) error {
+	if transport == TransportUDP {
+		return nil
+	}
+	return newTraversal(0, nil).requireFlag("WithTransport", "transport")
+}
+
+// checkTransport makes sure that natty's FiveTuple uses a protocol allowed by
+// the Traversal's Transport.
+func (t *Traversal) checkTransport(ft *FiveTuple) error {
+	switch {
+	case ft.Proto == UDP && t.transport != TransportTCP:
+		return nil
+	case ft.Proto == TCP && t.transport != TransportUDP:
+		return nil
+	}
+	return fmt.Errorf("Got %s FiveTuple, but transport is %s", ft.Proto, t.transport)
+}
+
+// checkTransportOptions makes sure that the Traversal's Transport can be used
+// with its other options.
+func (t *Traversal) checkTransportOptions() error {
+	if t.transport != TransportTCP {
+		return nil
+	}
+	// Both only supply UDP candidates
+	if t.turnAllocation != nil {
+		return fmt.Errorf("Unable to use a TurnAllocation with transport %s", t.transport)
+	}
+	if t.turnServer != nil {
+		return fmt.Errorf("Unable to use a TURN server with transport %s", t.transport)
+	}
+	if t.mappingKeeper != nil {
+		return fmt.Errorf("Unable to use a MappingKeeper with transport %s", t.transport)
+	}
+	return nil
+}
+
+// DialTCP waits for the FiveTuple and opens a TCP connection from its local
+// to its remote address, bound to the device per WithBindToDevice. It's meant
+// for the offer side, once the answer side has called ListenTCP, which the
+// application typically learns through its signaling channel. The local
+// address is reused, since natty's own connection on it may still be lingering.
+func (t *Traversal) DialTCP() (*net.TCPConn, error) {
+	local, remote, err := t.tcpAddrs()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.sockets.dialTCP("tcp", local, remote)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial TCP from %s to %s: %s", local, remote, err)
+	}
+	err = t.MarkTCPConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenTCP waits for the FiveTuple and listens for the peer's DialTCP on its
+// local address, for the answer side. Connections that it accepts aren't
+// marked per WithDSCP, use Traversal.MarkTCPConn for that.
+func (t *Traversal) ListenTCP() (*net.TCPListener, error) {
+	local, _, err := t.tcpAddrs()
+	if err != nil {
+		return nil, err
+	}
+	l, err := t.sockets.listenTCP("tcp", local)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for TCP on %s: %s", local, err)
+	}
+	return l, nil
+}
+
+func (t *Traversal) tcpAddrs() (local *net.TCPAddr, remote *net.TCPAddr, err error) {
+	ft, err := t.FiveTuple()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ft.TCPAddrs()
+}
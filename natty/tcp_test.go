@@ -0,0 +1,116 @@
+package natty
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestTransport(t *testing.T) {
+	for _, tr := range []Transport{TransportUDP, TransportFallbackTCP, TransportPreferTCP, TransportTCP} {
+		parsed, err := ParseTransport(tr.String())
+		assert.NoError(t, err)
+		assert.Equal(t, tr, parsed)
+	}
+	parsed, err := ParseTransport("")
+	assert.NoError(t, err)
+	assert.Equal(t, TransportUDP, parsed, "Empty should mean the default")
+	_, err = ParseTransport("sctp")
+	assert.Error(t, err)
+
+	udp := &FiveTuple{Proto: UDP, Local: "127.0.0.1:1000", Remote: "127.0.0.1:1001"}
+	tcp := &FiveTuple{Proto: TCP, Local: "127.0.0.1:1000", Remote: "127.0.0.1:1001"}
+	assert.NoError(t, newTraversal(0, nil).checkTransport(udp))
+	assert.Error(t, newTraversal(0, nil).checkTransport(tcp), "UDP only by default")
+	fallback := newTraversal(0, []Option{WithTransport(TransportFallbackTCP)})
+	assert.NoError(t, fallback.checkTransport(udp))
+	assert.NoError(t, fallback.checkTransport(tcp), "Should fall back to TCP")
+	prefer := newTraversal(0, []Option{WithTransport(TransportPreferTCP)})
+	assert.NoError(t, prefer.checkTransport(udp), "Should fall back to UDP")
+	assert.NoError(t, prefer.checkTransport(tcp))
+	tcpOnly := newTraversal(0, []Option{WithTransport(TransportTCP)})
+	assert.Error(t, tcpOnly.checkTransport(udp))
+	assert.NoError(t, tcpOnly.checkTransport(tcp))
+
+	tcpOnly.turnAllocation = &TurnAllocation{}
+	assert.Error(t, tcpOnly.checkTransportOptions(), "TURN only relays UDP")
+	prefer.turnAllocation = &TurnAllocation{}
+	assert.NoError(t, prefer.checkTransportOptions())
+
+	binary, remove := sleepingNatty(t)
+	defer remove()
+	tr := newTraversal(0, []Option{WithBinary(binary), WithTransport(TransportPreferTCP)})
+	if assert.NoError(t, tr.initCommand(nil)) {
+		assert.Contains(t, strings.Join(tr.cmd.Args, " "), "-transport prefer-tcp")
+	}
+	binary, remove = scriptedNatty(t, "exec sleep 30", "offer")
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(binary), WithTransport(TransportPreferTCP)})
+	assert.True(t, errors.Is(tr.initCommand(nil), ErrUnsupportedOption), "natty that doesn't accept -transport should fail the Traversal")
+
+	SetBinaryPath(binary)
+	assert.True(t, errors.Is(CheckTransport(TransportPreferTCP), ErrUnsupportedOption), "CheckTransport should agree with the Traversal")
+	assert.NoError(t, CheckTransport(TransportUDP), "UDP doesn't need -transport")
+	SetBinaryPath("")
+
+	_, _, err = udp.TCPAddrs()
+	assert.Error(t, err)
+	local, remote, err := tcp.TCPAddrs()
+	if assert.NoError(t, err) {
+		assert.Equal(t, tcp.Local, local.String())
+		assert.Equal(t, tcp.Remote, remote.String())
+	}
+}
+
+func TestDialListenTCP(t *testing.T) {
+	offerAddr, answerAddr := freeTCPAddr(t), freeTCPAddr(t)
+	offer := newTraversal(0, []Option{WithTransport(TransportTCP)})
+	offer.setResult(&FiveTuple{Proto: TCP, Local: offerAddr, Remote: answerAddr}, nil)
+	answer := newTraversal(0, []Option{WithTransport(TransportTCP)})
+	answer.setResult(&FiveTuple{Proto: TCP, Local: answerAddr, Remote: offerAddr}, nil)
+
+	l, err := answer.ListenTCP()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	conn, err := offer.DialTCP()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, offerAddr, conn.LocalAddr().String(), "Should dial from the FiveTuple's local address")
+
+	accepted, err := l.AcceptTCP()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer accepted.Close()
+	assert.Equal(t, offerAddr, accepted.RemoteAddr().String())
+	conn.Write([]byte(MessageText))
+	accepted.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, len(MessageText))
+	_, err = io.ReadFull(accepted, b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, MessageText, string(b))
+	}
+
+	udp := newTraversal(0, nil)
+	udp.setResult(&FiveTuple{Proto: UDP, Local: offerAddr, Remote: answerAddr}, nil)
+	_, err = udp.DialTCP()
+	assert.Error(t, err, "Shouldn't dial TCP on a UDP FiveTuple")
+}
+
+func freeTCPAddr(t *testing.T) string {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
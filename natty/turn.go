@@ -0,0 +1,731 @@
+package natty
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	turnAllocateRequest         = 0x0003
+	turnRefreshRequest          = 0x0004
+	turnCreatePermissionRequest = 0x0008
+	turnChannelBindRequest      = 0x0009
+	turnSendIndication          = 0x0016
+	turnDataIndication          = 0x0017
+
+	// turnTransportUDP is the REQUESTED-TRANSPORT for UDP relays.
+	turnTransportUDP = 17 << 24
+
+	// turnDefaultLifetime is how long allocations last if the TURN server
+	// doesn't say.
+	turnDefaultLifetime = 10 * time.Minute
+
+	turnFirstChannel = 0x4000
+	turnLastChannel  = 0x7FFF
+)
+
+var (
+	// turnRequestTimeout is how long to wait for the TURN server to respond to
+	// a request, including retransmissions.
+	turnRequestTimeout = 5 * time.Second
+
+	// turnRetransmitInterval is how frequently to retransmit requests to the
+	// TURN server until it responds.
+	turnRetransmitInterval = 500 * time.Millisecond
+)
+
+// TurnCredentials are the long-term credentials for a TURN server.
+type TurnCredentials struct {
+	Username string
+	Password string
+}
+
+// TurnAllocation is a relay allocated on a TURN server once and shared by
+// every Traversal that's passed it with WithTurnAllocation. Each of those
+// Traversals creates its own permissions and channels on the allocation, so
+// relaying several streams through the same server costs one allocation
+// rather than one per stream. The allocation is refreshed until it's closed.
+// Traversals can only use it with a natty that accepts -turn, which the
+// embedded one doesn't (see WithTurnAllocation).
+type TurnAllocation struct {
+	conn        net.Conn                // connected to the TURN server
+	stream      bool                    // whether conn is TCP or TLS rather than UDP
+	creds       TurnCredentials         // credentials for the TURN server
+	key         []byte                  // long-term key for MESSAGE-INTEGRITY
+	realm       string                  // realm from the TURN server
+	nonce       string                  // current nonce from the TURN server
+	relayed     *net.UDPAddr            // address of the relay on the TURN server
+	mapped      *net.UDPAddr            // our address as seen by the TURN server
+	lifetime    time.Duration           // how long the allocation lasts unless refreshed
+	pending     map[string]chan []byte  // responses by transaction id
+	bindings    []*turnBinding          // the bindings using this allocation
+	channels    map[uint16]*turnChannel // channels bound on the TURN server
+	nextChannel uint16                  // next channel number to try
+	mutex       sync.Mutex              // synchronizes access to the above
+	closedCh    chan struct{}           // closed once Close() has been called
+	closeOnce   sync.Once               // makes sure that closedCh is only closed once
+}
+
+// turnChannel is a channel bound on the TURN server on behalf of a binding.
+type turnChannel struct {
+	binding *turnBinding
+	number  uint16 // the channel number that natty uses with the binding
+	peer    string // the peer to which the channel is bound
+}
+
+// NewTurnAllocation allocates a relay on the given TURN server
+// ([turn:]host:port) using the given credentials.
+func NewTurnAllocation(server string, creds TurnCredentials) (*TurnAllocation, error) {
+	conn, err := dialTurn(server, "udp", 0, sockets{})
+	if err != nil {
+		return nil, err
+	}
+	return newTurnAllocation(server, conn, creds)
+}
+
+// dialTurn connects to the given TURN server ([turn:|turns:]host:port) over
+// the given transport (udp, tcp or tls) from the given local port, or an
+// ephemeral one if it's 0.
+func dialTurn(server string, transport string, localPort int, s sockets) (net.Conn, error) {
+	address := strings.TrimPrefix(strings.TrimPrefix(server, "turn:"), "turns:")
+	d := &net.Dialer{Timeout: turnRequestTimeout}
+	if s.device != "" {
+		d.Control = s.control
+	}
+	var conn net.Conn
+	var err error
+	switch transport {
+	case "udp":
+		addr, resolveErr := net.ResolveUDPAddr("udp", address)
+		if resolveErr != nil {
+			return nil, fmt.Errorf("Unable to resolve TURN server %s: %s", server, resolveErr)
+		}
+		if localPort != 0 {
+			d.LocalAddr = &net.UDPAddr{Port: localPort}
+		}
+		conn, err = d.Dial("udp", addr.String())
+	case "tcp", "tls":
+		if localPort != 0 {
+			d.LocalAddr = &net.TCPAddr{Port: localPort}
+		}
+		if transport == "tcp" {
+			conn, err = d.Dial("tcp", address)
+		} else {
+			host, _, _ := net.SplitHostPort(address)
+			conn, err = tls.DialWithDialer(d, "tcp", address, &tls.Config{ServerName: host})
+		}
+	default:
+		return nil, fmt.Errorf("Unknown TURN transport %s, should be udp, tcp or tls", transport)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial TURN server %s: %s", server, err)
+	}
+	return conn, nil
+}
+
+// newTurnAllocation allocates a relay over conn, which is connected to the
+// given TURN server.
+func newTurnAllocation(server string, conn net.Conn, creds TurnCredentials) (*TurnAllocation, error) {
+	_, isUDP := conn.(*net.UDPConn)
+	a := &TurnAllocation{
+		conn:        conn,
+		stream:      !isUDP,
+		creds:       creds,
+		pending:     make(map[string]chan []byte),
+		channels:    make(map[uint16]*turnChannel),
+		nextChannel: turnFirstChannel,
+		closedCh:    make(chan struct{}),
+	}
+	go a.read()
+
+	err := a.allocate()
+	if err != nil {
+		a.closeOnce.Do(func() { close(a.closedCh) })
+		conn.Close()
+		return nil, fmt.Errorf("Unable to allocate relay on %s: %s", server, err)
+	}
+	log.Tracef("Allocated relay %s on %s for %s", a.relayed, server, a.lifetime)
+	go a.keepRefreshed()
+	return a, nil
+}
+
+// Relayed returns the address of the relay on the TURN server, which peers
+// see as the address of our relay candidates.
+func (a *TurnAllocation) Relayed() net.Addr {
+	return a.relayed
+}
+
+// Close releases the allocation. Traversals that are still using it lose
+// their relay candidates.
+func (a *TurnAllocation) Close() error {
+	closed := false
+	a.closeOnce.Do(func() {
+		closed = true
+		close(a.closedCh)
+	})
+	if !closed {
+		return nil
+	}
+	_, err := a.request(newSTUNMessage(turnRefreshRequest).addUint32(stunAttrLifetime, 0))
+	if err != nil {
+		log.Tracef("Unable to release relay %s: %s", a.relayed, err)
+	}
+	return a.conn.Close()
+}
+
+func (a *TurnAllocation) isClosed() bool {
+	select {
+	case <-a.closedCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// allocate requests the allocation, learning the realm and nonce from the
+// server's challenge.
+func (a *TurnAllocation) allocate() error {
+	resp, err := a.exchange(newSTUNMessage(turnAllocateRequest).addUint32(stunAttrRequestedTransport, turnTransportUDP), nil)
+	if err != nil {
+		return err
+	}
+	if resp.errorCode() != 401 {
+		return fmt.Errorf("Expected the TURN server to ask for credentials, got error %d", resp.errorCode())
+	}
+	a.mutex.Lock()
+	a.realm = string(resp.get(stunAttrRealm))
+	a.nonce = string(resp.get(stunAttrNonce))
+	a.key = longTermKey(a.creds.Username, a.realm, a.creds.Password)
+	a.mutex.Unlock()
+
+	resp, err = a.request(newSTUNMessage(turnAllocateRequest).addUint32(stunAttrRequestedTransport, turnTransportUDP))
+	if err != nil {
+		return err
+	}
+	a.relayed = resp.getAddr(stunAttrXorRelayedAddress)
+	a.mapped = resp.getAddr(stunAttrXorMappedAddress)
+	if a.relayed == nil || a.mapped == nil {
+		return fmt.Errorf("TURN server didn't say where the relay is")
+	}
+	lifetime, _ := resp.getUint32(stunAttrLifetime)
+	a.lifetime = time.Duration(lifetime) * time.Second
+	if a.lifetime == 0 {
+		a.lifetime = turnDefaultLifetime
+	}
+	return nil
+}
+
+// keepRefreshed refreshes the allocation halfway through its lifetime until
+// it's closed.
+func (a *TurnAllocation) keepRefreshed() {
+	for {
+		select {
+		case <-a.closedCh:
+			return
+		case <-time.After(a.lifetime / 2):
+		}
+		_, err := a.request(newSTUNMessage(turnRefreshRequest).addUint32(stunAttrLifetime, uint32(a.lifetime/time.Second)))
+		if err != nil && !a.isClosed() {
+			log.Errorf("Unable to refresh relay %s: %s", a.relayed, err)
+		}
+	}
+}
+
+// request sends an authenticated request to the TURN server and waits for a
+// successful response, retrying once with a new nonce if the server says that
+// ours is stale.
+func (a *TurnAllocation) request(m *stunMessage) (*stunMessage, error) {
+	for attempt := 0; ; attempt++ {
+		a.mutex.Lock()
+		signed := m.withTxId(newSTUNMessage(m.typ).txId)
+		signed.add(stunAttrUsername, []byte(a.creds.Username))
+		signed.add(stunAttrRealm, []byte(a.realm))
+		signed.add(stunAttrNonce, []byte(a.nonce))
+		key := a.key
+		a.mutex.Unlock()
+
+		resp, err := a.exchange(signed, key)
+		if err != nil {
+			return nil, err
+		}
+		if resp.isSuccess() {
+			return resp, nil
+		}
+		if resp.errorCode() == 438 && attempt == 0 {
+			a.mutex.Lock()
+			a.nonce = string(resp.get(stunAttrNonce))
+			a.mutex.Unlock()
+			continue
+		}
+		return nil, fmt.Errorf("TURN server responded with error %d", resp.errorCode())
+	}
+}
+
+// exchange sends m to the TURN server, retransmitting it until the server
+// responds or turnRequestTimeout elapses.
+func (a *TurnAllocation) exchange(m *stunMessage, key []byte) (*stunMessage, error) {
+	respCh := make(chan []byte, 1)
+	a.mutex.Lock()
+	a.pending[string(m.txId)] = respCh
+	a.mutex.Unlock()
+	defer func() {
+		a.mutex.Lock()
+		delete(a.pending, string(m.txId))
+		a.mutex.Unlock()
+	}()
+
+	b := m.encode(key)
+	timeout := time.After(turnRequestTimeout)
+	for {
+		err := a.send(b)
+		if err != nil {
+			return nil, err
+		}
+		var retransmit <-chan time.Time
+		if !a.stream {
+			// TCP and TLS take care of retransmission themselves
+			retransmit = time.After(turnRetransmitInterval)
+		}
+		select {
+		case resp := <-respCh:
+			return parseSTUN(resp)
+		case <-retransmit:
+		case <-timeout:
+			return nil, fmt.Errorf("TURN server didn't respond within %s", turnRequestTimeout)
+		}
+	}
+}
+
+// send sends msg, a STUN message or ChannelData, to the TURN server. Over TCP
+// and TLS, ChannelData is padded to a multiple of 4 bytes.
+func (a *TurnAllocation) send(msg []byte) error {
+	if a.stream && !isSTUN(msg) {
+		if pad := len(msg) % 4; pad != 0 {
+			msg = append(msg, make([]byte, 4-pad)...)
+		}
+	}
+	_, err := a.conn.Write(msg)
+	return err
+}
+
+// read reads from the TURN server until the allocation is closed, passing
+// responses to whoever's waiting for them and relayed data to the binding
+// that it's for.
+func (a *TurnAllocation) read() {
+	b := make([]byte, 65536)
+	var r *bufio.Reader
+	if a.stream {
+		r = bufio.NewReader(a.conn)
+	}
+	for {
+		var msg []byte
+		var err error
+		if a.stream {
+			msg, err = readTurnFrame(r)
+		} else {
+			var n int
+			n, err = a.conn.Read(b)
+			msg = append([]byte{}, b[:n]...)
+		}
+		if err != nil {
+			if !a.isClosed() {
+				log.Errorf("Unable to read from TURN server: %s", err)
+			}
+			return
+		}
+		if !isSTUN(msg) {
+			a.receiveChannelData(msg)
+			continue
+		}
+		if msg[0]&0x01 != 0 {
+			// Success or error response
+			a.mutex.Lock()
+			respCh := a.pending[string(msg[8:stunHeaderSize])]
+			a.mutex.Unlock()
+			if respCh != nil {
+				select {
+				case respCh <- msg:
+				default:
+				}
+			}
+			continue
+		}
+		if binary.BigEndian.Uint16(msg) == turnDataIndication {
+			a.receiveDataIndication(msg)
+		}
+	}
+}
+
+// readTurnFrame reads a STUN message or ChannelData from a TCP or TLS
+// connection to a TURN server, which frames them by their lengths, dropping
+// ChannelData's padding.
+func readTurnFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	padded := (length + 3) &^ 3
+	if header[0]&0xC0 == 0 {
+		// A STUN message, whose length excludes its header
+		length += stunHeaderSize - len(header)
+		padded = length
+	}
+	msg := make([]byte, len(header)+padded)
+	copy(msg, header)
+	_, err = io.ReadFull(r, msg[len(header):])
+	if err != nil {
+		return nil, err
+	}
+	return msg[:len(header)+length], nil
+}
+
+// receiveChannelData passes ChannelData to the binding that bound the
+// channel, renumbered to the binding's channel number.
+func (a *TurnAllocation) receiveChannelData(msg []byte) {
+	if len(msg) < 4 {
+		return
+	}
+	a.mutex.Lock()
+	ch := a.channels[binary.BigEndian.Uint16(msg)]
+	a.mutex.Unlock()
+	if ch == nil {
+		return
+	}
+	binary.BigEndian.PutUint16(msg, ch.number)
+	ch.binding.toNatty(msg)
+}
+
+// receiveDataIndication passes a Data indication to the most recent binding
+// that created a permission for the peer from which it came.
+func (a *TurnAllocation) receiveDataIndication(msg []byte) {
+	m, err := parseSTUN(msg)
+	if err != nil {
+		return
+	}
+	peer := m.getAddr(stunAttrXorPeerAddress)
+	if peer == nil {
+		return
+	}
+	a.mutex.Lock()
+	var binding *turnBinding
+	for i := len(a.bindings) - 1; i >= 0 && binding == nil; i-- {
+		if a.bindings[i].permits(peer.IP) {
+			binding = a.bindings[i]
+		}
+	}
+	a.mutex.Unlock()
+	if binding != nil {
+		binding.toNatty(msg)
+	}
+}
+
+// bindChannel binds a channel on the TURN server to the given peer on behalf of
+// the given binding, which knows the channel by the given number.
+func (a *TurnAllocation) bindChannel(binding *turnBinding, number uint16, peer *net.UDPAddr) error {
+	a.mutex.Lock()
+	var serverNumber uint16
+	for n, ch := range a.channels {
+		if ch.binding == binding && ch.number == number {
+			// Refreshing an existing binding
+			serverNumber = n
+		}
+	}
+	for tries := 0; serverNumber == 0 && tries <= turnLastChannel-turnFirstChannel; tries++ {
+		if a.channels[a.nextChannel] == nil {
+			serverNumber = a.nextChannel
+		}
+		a.nextChannel++
+		if a.nextChannel > turnLastChannel {
+			a.nextChannel = turnFirstChannel
+		}
+	}
+	if serverNumber == 0 {
+		a.mutex.Unlock()
+		return fmt.Errorf("No channels left on relay %s", a.relayed)
+	}
+	a.channels[serverNumber] = &turnChannel{binding, number, peer.String()}
+	a.mutex.Unlock()
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, serverNumber)
+	m := newSTUNMessage(turnChannelBindRequest).add(stunAttrChannelNumber, b)
+	m.addAddr(stunAttrXorPeerAddress, peer)
+	_, err := a.request(m)
+	if err != nil {
+		a.mutex.Lock()
+		delete(a.channels, serverNumber)
+		a.mutex.Unlock()
+	}
+	return err
+}
+
+// serverChannel returns the number that the TURN server knows the given
+// binding's channel by, or 0 if it isn't bound.
+func (a *TurnAllocation) serverChannel(binding *turnBinding, number uint16) uint16 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for n, ch := range a.channels {
+		if ch.binding == binding && ch.number == number {
+			return n
+		}
+	}
+	return 0
+}
+
+// turnBinding lets a single natty process use a shared TurnAllocation. natty
+// talks TURN to the binding, on a local port, as if it were the TURN server.
+// The binding answers Allocate and Refresh requests itself with the shared
+// relay, forwards permissions and channels to the real TURN server and relays
+// data between natty and the TURN server.
+type turnBinding struct {
+	alloc       *TurnAllocation
+	conn        *net.UDPConn    // the socket with which natty talks to us
+	nattyAddr   *net.UDPAddr    // where natty talks to us from
+	permissions map[string]bool // peer IPs for which natty created permissions
+	mutex       sync.Mutex      // synchronizes access to nattyAddr and permissions
+	closeOnce   sync.Once
+}
+
+// bind creates a binding through which a natty process can use the
+// allocation.
+func (a *TurnAllocation) bind() (*turnBinding, error) {
+	if a.isClosed() {
+		return nil, fmt.Errorf("TURN allocation %s is closed", a.relayed)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for natty's TURN requests: %s", err)
+	}
+	b := &turnBinding{
+		alloc:       a,
+		conn:        conn,
+		permissions: make(map[string]bool),
+	}
+	a.mutex.Lock()
+	a.bindings = append(a.bindings, b)
+	a.mutex.Unlock()
+	go b.serve()
+	return b, nil
+}
+
+// addr is the address that natty should use as its TURN server.
+func (b *turnBinding) addr() string {
+	return b.conn.LocalAddr().String()
+}
+
+func (b *turnBinding) close() {
+	b.closeOnce.Do(func() {
+		a := b.alloc
+		a.mutex.Lock()
+		for i, other := range a.bindings {
+			if other == b {
+				a.bindings = append(a.bindings[:i], a.bindings[i+1:]...)
+				break
+			}
+		}
+		for n, ch := range a.channels {
+			if ch.binding == b {
+				delete(a.channels, n)
+			}
+		}
+		a.mutex.Unlock()
+		b.conn.Close()
+	})
+}
+
+// permits indicates whether natty created a permission for the given peer IP.
+func (b *turnBinding) permits(ip net.IP) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.permissions[ip.String()]
+}
+
+// toNatty passes a message from the TURN server to natty.
+func (b *turnBinding) toNatty(msg []byte) {
+	b.mutex.Lock()
+	to := b.nattyAddr
+	b.mutex.Unlock()
+	if to != nil {
+		b.conn.WriteToUDP(msg, to)
+	}
+}
+
+// serve handles natty's TURN traffic until the binding is closed.
+func (b *turnBinding) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		b.mutex.Lock()
+		b.nattyAddr = from
+		b.mutex.Unlock()
+		msg := append([]byte{}, buf[:n]...)
+		if !isSTUN(msg) {
+			b.sendChannelData(msg)
+			continue
+		}
+		m, err := parseSTUN(msg)
+		if err != nil {
+			continue
+		}
+		switch m.typ {
+		case turnSendIndication:
+			// Indications aren't authenticated, so they pass through as is
+			b.alloc.send(msg)
+		case turnAllocateRequest:
+			b.respond(m.reply(turnAllocateRequest|0x0100).
+				addAddr(stunAttrXorRelayedAddress, b.alloc.relayed).
+				addAddr(stunAttrXorMappedAddress, b.alloc.mapped).
+				addUint32(stunAttrLifetime, uint32(b.alloc.lifetime/time.Second)))
+		case turnRefreshRequest:
+			// The shared allocation is refreshed for as long as it's open
+			lifetime, ok := m.getUint32(stunAttrLifetime)
+			if !ok {
+				lifetime = uint32(b.alloc.lifetime / time.Second)
+			}
+			b.respond(m.reply(turnRefreshRequest|0x0100).addUint32(stunAttrLifetime, lifetime))
+		case turnCreatePermissionRequest:
+			go b.createPermission(m)
+		case turnChannelBindRequest:
+			go b.bindChannel(m)
+		default:
+			log.Tracef("Ignoring unexpected TURN message %#04x from natty", m.typ)
+		}
+	}
+}
+
+func (b *turnBinding) respond(m *stunMessage) {
+	b.toNatty(m.encode(nil))
+}
+
+func (b *turnBinding) respondWithError(req *stunMessage, err error) {
+	b.respond(req.reply(req.typ|0x0110).addError(500, err.Error()))
+}
+
+// createPermission creates the permissions that natty asked for on the shared
+// allocation.
+func (b *turnBinding) createPermission(req *stunMessage) {
+	peers := req.getAddrs(stunAttrXorPeerAddress)
+	m := newSTUNMessage(turnCreatePermissionRequest)
+	for _, peer := range peers {
+		m.addAddr(stunAttrXorPeerAddress, peer)
+	}
+	_, err := b.alloc.request(m)
+	if err != nil {
+		b.respondWithError(req, err)
+		return
+	}
+	b.mutex.Lock()
+	for _, peer := range peers {
+		b.permissions[peer.IP.String()] = true
+	}
+	b.mutex.Unlock()
+	b.respond(req.reply(turnCreatePermissionRequest | 0x0100))
+}
+
+// bindChannel binds the channel that natty asked for on the shared allocation,
+// under a number that's unique within the allocation.
+func (b *turnBinding) bindChannel(req *stunMessage) {
+	number := req.get(stunAttrChannelNumber)
+	peer := req.getAddr(stunAttrXorPeerAddress)
+	if len(number) < 2 || peer == nil {
+		b.respond(req.reply(req.typ|0x0110).addError(400, "Bad Request"))
+		return
+	}
+	err := b.alloc.bindChannel(b, binary.BigEndian.Uint16(number), peer)
+	if err != nil {
+		b.respondWithError(req, err)
+		return
+	}
+	b.mutex.Lock()
+	b.permissions[peer.IP.String()] = true
+	b.mutex.Unlock()
+	b.respond(req.reply(turnChannelBindRequest | 0x0100))
+}
+
+// sendChannelData passes ChannelData from natty to the TURN server, renumbered
+// to the allocation's channel number.
+func (b *turnBinding) sendChannelData(msg []byte) {
+	if len(msg) < 4 {
+		return
+	}
+	number := b.alloc.serverChannel(b, binary.BigEndian.Uint16(msg))
+	if number == 0 {
+		return
+	}
+	binary.BigEndian.PutUint16(msg, number)
+	b.alloc.send(msg)
+}
+
+// turnServer is a TURN server on which a Traversal allocates a relay of its
+// own, per WithTURNServer.
+type turnServer struct {
+	addr      string
+	creds     TurnCredentials
+	transport string
+}
+
+// parseTURNURI splits a TURN URI (RFC 7065) into the server's host:port and
+// the transport over which to talk to it, for WithTURN. Transports that we
+// don't support, like DTLS, are left for allocateTurn to reject.
+func parseTURNURI(uri string) (addr string, transport string) {
+	transport, port := "udp", "3478"
+	secure := strings.HasPrefix(uri, "turns:")
+	if secure {
+		transport, port = "tls", "5349"
+	}
+	addr = strings.TrimPrefix(strings.TrimPrefix(uri, "turn:"), "turns:")
+	if i := strings.Index(addr, "?"); i >= 0 {
+		query := addr[i+1:]
+		addr = addr[:i]
+		if strings.HasPrefix(query, "transport=") {
+			transport = strings.TrimPrefix(query, "transport=")
+			switch {
+			case secure && transport == "tcp":
+				transport = "tls"
+			case secure && transport == "udp":
+				transport = "dtls"
+			}
+		}
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return addr, transport
+}
+
+// allocateTurn allocates the Traversal's own relay on the TURN server set
+// with WithTURNServer. If the server can't be reached or refuses to allocate
+// a relay, the Traversal goes ahead without relay candidates.
+func (t *Traversal) allocateTurn() error {
+	if t.turnAllocation != nil {
+		return fmt.Errorf("Unable to use both a TURN server and a TurnAllocation")
+	}
+	s := t.turnServer
+	switch s.transport {
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("Unknown TURN transport %s, should be udp, tcp or tls", s.transport)
+	}
+	conn, err := dialTurn(s.addr, s.transport, t.relayLocalPort, t.sockets)
+	if err == nil {
+		t.turnAllocation, err = newTurnAllocation(s.addr, conn, s.creds)
+	}
+	if err != nil {
+		t.log().Errorf("%s, continuing without a relay", err)
+		return nil
+	}
+	t.turnAllocOwned = true
+	return nil
+}
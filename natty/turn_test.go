@@ -0,0 +1,424 @@
+package natty
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestTurnAllocation(t *testing.T) {
+	server := startFakeTURN(t)
+	defer server.close()
+
+	_, err := NewTurnAllocation(server.addr(), TurnCredentials{"user", "wrong"})
+	assert.Error(t, err, "Wrong password shouldn't allocate")
+
+	alloc, err := NewTurnAllocation("turn:"+server.addr(), TurnCredentials{"user", "pass"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, server.relay.LocalAddr().String(), alloc.Relayed().String())
+	assert.NoError(t, alloc.Close())
+	assert.Equal(t, []string{"allocate", "refresh 0"}, server.requests())
+}
+
+func TestTurnBindingsShareAllocation(t *testing.T) {
+	server := startFakeTURN(t)
+	defer server.close()
+	alloc, err := NewTurnAllocation(server.addr(), TurnCredentials{"user", "pass"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer alloc.Close()
+
+	peer1, peer2 := listenLoopback(t), listenLoopback(t)
+	defer peer1.Close()
+	defer peer2.Close()
+	natty1, natty2 := newFakeNatty(t, alloc), newFakeNatty(t, alloc)
+	defer natty1.close()
+	defer natty2.close()
+
+	// Each natty thinks it allocated the relay itself
+	for _, n := range []*fakeNatty{natty1, natty2} {
+		resp := n.request(newSTUNMessage(turnAllocateRequest))
+		assert.True(t, resp.isSuccess(), "Allocate should succeed")
+		assert.Equal(t, alloc.Relayed().String(), resp.getAddr(stunAttrXorRelayedAddress).String())
+	}
+
+	// natty1 uses a permission and indications
+	m := newSTUNMessage(turnCreatePermissionRequest).addAddr(stunAttrXorPeerAddress, udpAddr(peer1))
+	assert.True(t, natty1.request(m).isSuccess(), "CreatePermission should succeed")
+	m = newSTUNMessage(turnSendIndication).addAddr(stunAttrXorPeerAddress, udpAddr(peer1)).add(stunAttrData, []byte("hello 1"))
+	natty1.send(m.encode(nil))
+	assert.Equal(t, "hello 1", readFrom(t, peer1))
+	peer1.WriteToUDP([]byte("reply 1"), udpAddr(server.relay))
+	data, err := parseSTUN(natty1.read())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "reply 1", string(data.get(stunAttrData)))
+	}
+
+	// Both nattys use the same channel number, which has to be mapped to
+	// different channels on the server
+	for _, bind := range []struct {
+		n    *fakeNatty
+		peer *net.UDPConn
+	}{{natty1, peer1}, {natty2, peer2}} {
+		m = newSTUNMessage(turnChannelBindRequest).add(stunAttrChannelNumber, []byte{0x40, 0x00, 0, 0}).addAddr(stunAttrXorPeerAddress, udpAddr(bind.peer))
+		assert.True(t, bind.n.request(m).isSuccess(), "ChannelBind should succeed")
+	}
+	natty2.send(append([]byte{0x40, 0x00, 0, 7}, "hello 2"...))
+	assert.Equal(t, "hello 2", readFrom(t, peer2))
+	peer2.WriteToUDP([]byte("reply 2"), udpAddr(server.relay))
+	assert.Equal(t, append([]byte{0x40, 0x00, 0, 7}, "reply 2"...), natty2.read())
+
+	assert.Equal(t, []string{
+		"allocate",
+		"permission 127.0.0.1",
+		"channel 0x4000",
+		"channel 0x4001",
+	}, server.requests(), "All nattys should share one allocation")
+}
+
+func TestTurnAllocationOverTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	channelData := make(chan []byte, 1)
+	go serveFakeTURNOverTCP(l, channelData)
+
+	conn, err := dialTurn("turn:"+l.Addr().String(), "tcp", 0, sockets{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	alloc, err := newTurnAllocation(l.Addr().String(), conn, TurnCredentials{"user", "pass"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer alloc.Close()
+	assert.Equal(t, "127.0.0.1:3478", alloc.Relayed().String())
+
+	// ChannelData is padded on the wire, and the padding dropped when read
+	assert.NoError(t, alloc.send([]byte{0x40, 0x00, 0, 5, 'h', 'e', 'l', 'l', 'o'}))
+	select {
+	case msg := <-channelData:
+		assert.Equal(t, "hello", string(msg[4:]))
+	case <-time.After(2 * time.Second):
+		t.Fatal("TURN server didn't get ChannelData")
+	}
+
+	_, err = dialTurn(l.Addr().String(), "sctp", 0, sockets{})
+	assert.Error(t, err, "Unknown transport shouldn't dial")
+}
+
+// serveFakeTURNOverTCP accepts a single connection and allocates a relay to it
+// like fakeTURN does, passing any ChannelData that it gets to channelData.
+func serveFakeTURNOverTCP(l net.Listener, channelData chan<- []byte) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		msg, err := readTurnFrame(conn)
+		if err != nil {
+			return
+		}
+		if !isSTUN(msg) {
+			channelData <- msg
+			continue
+		}
+		m, _ := parseSTUN(msg)
+		var resp *stunMessage
+		switch {
+		case !(&fakeTURN{}).authentic(m):
+			resp = m.reply(m.typ|0x0110).addError(401, "Unauthorized").add(stunAttrRealm, []byte("test")).add(stunAttrNonce, []byte("nonce"))
+		case m.typ == turnAllocateRequest:
+			resp = m.reply(m.typ|0x0100).addAddr(stunAttrXorRelayedAddress, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3478}).addAddr(stunAttrXorMappedAddress, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000})
+		default:
+			resp = m.reply(m.typ | 0x0100)
+		}
+		conn.Write(resp.encode(longTermKey("user", "test", "pass")))
+	}
+}
+
+func TestWithTURNServer(t *testing.T) {
+	executable, remove := sleepingNatty(t)
+	defer remove()
+	tr := newTraversal(0, []Option{WithBinary(executable), WithTURNServer("127.0.0.1:3478", "user", "pass", "sctp")})
+	assert.Error(t, tr.initCommand(nil), "Unknown transport should fail the Traversal")
+
+	tr = newTraversal(0, []Option{WithBinary(executable), WithTURNServer("127.0.0.1:3478", "user", "pass", "udp"), WithTransport(TransportTCP)})
+	assert.Error(t, tr.initCommand(nil), "TURN server should need UDP")
+
+	server := startFakeTURN(t)
+	defer server.close()
+	tr = newTraversal(0, []Option{WithBinary(executable), WithTURNServer("turn:"+server.addr(), "user", "pass", "udp")})
+	if !assert.NoError(t, tr.initCommand(nil)) {
+		return
+	}
+	assert.Equal(t, server.relay.LocalAddr().String(), tr.turnAllocation.Relayed().String())
+	assert.Contains(t, strings.Join(tr.cmd.Args, " "), "-turn "+tr.turnBinding.addr())
+	assert.NoError(t, tr.Close())
+	assert.Equal(t, []string{"allocate", "refresh 0"}, server.requests(), "Closing the Traversal should release its relay")
+
+	tr = newTraversal(0, []Option{WithBinary(executable), WithTURNServer(server.addr(), "user", "wrong", "udp")})
+	assert.NoError(t, tr.initCommand(nil), "Traversal should go ahead without a relay")
+	assert.Nil(t, tr.turnAllocation)
+
+	executable, remove = scriptedNatty(t, "exec sleep 30", "offer")
+	defer remove()
+	tr = newTraversal(0, []Option{WithBinary(executable), WithTURNServer(server.addr(), "user", "pass", "udp")})
+	assert.True(t, errors.Is(tr.initCommand(nil), ErrUnsupportedOption), "natty that doesn't accept -turn should fail the Traversal")
+	assert.Nil(t, tr.turnAllocation, "Nothing should be allocated for natty that can't use it")
+}
+
+func TestWithTURN(t *testing.T) {
+	for uri, expected := range map[string][2]string{
+		"turn:turn.example.com":                    {"turn.example.com:3478", "udp"},
+		"turn:turn.example.com:3479":               {"turn.example.com:3479", "udp"},
+		"turn:turn.example.com?transport=tcp":      {"turn.example.com:3478", "tcp"},
+		"turns:turn.example.com":                   {"turn.example.com:5349", "tls"},
+		"turns:turn.example.com:443?transport=tcp": {"turn.example.com:443", "tls"},
+		"turns:turn.example.com?transport=udp":     {"turn.example.com:5349", "dtls"},
+		"turn:[2001:db8::1]":                       {"[2001:db8::1]:3478", "udp"},
+		"turn:[2001:db8::1]:3479":                  {"[2001:db8::1]:3479", "udp"},
+	} {
+		addr, transport := parseTURNURI(uri)
+		assert.Equal(t, expected[0], addr, "Wrong address for %s", uri)
+		assert.Equal(t, expected[1], transport, "Wrong transport for %s", uri)
+	}
+
+	executable, remove := sleepingNatty(t)
+	defer remove()
+	tr := newTraversal(0, []Option{WithBinary(executable), WithTURN("turns:127.0.0.1:3478?transport=udp", "user", "pass")})
+	assert.Error(t, tr.initCommand(nil), "DTLS isn't supported")
+
+	server := startFakeTURN(t)
+	defer server.close()
+	tr = newTraversal(0, []Option{WithBinary(executable), WithTURN("turn:"+server.addr()+"?transport=udp", "user", "pass")})
+	if !assert.NoError(t, tr.initCommand(nil)) {
+		return
+	}
+	defer tr.Close()
+
+	// natty picks a pair with our relay candidate
+	relayed := tr.turnAllocation.Relayed().(*net.UDPAddr)
+	candidate := fmt.Sprintf(`{"candidate":"candidate:3 1 udp 41885439 %s %d typ relay raddr 192.168.1.160 rport 55285 generation 0","sdpMid":"data","sdpMLineIndex":0}`, relayed.IP, relayed.Port)
+	tr.statsTracker.track([]byte(candidate), true)
+	ft := &FiveTuple{Proto: "udp", Local: relayed.String(), Remote: "198.51.100.8:60530"}
+	ft.Relayed = tr.statsTracker.relayed(ft)
+	assert.True(t, ft.Relayed, "FiveTuple using the TURN relay should be relayed")
+	local, remote, err := ft.UDPAddrs()
+	if assert.NoError(t, err) {
+		assert.Equal(t, relayed.String(), local.String())
+		assert.Equal(t, "198.51.100.8:60530", remote.String())
+	}
+}
+
+func TestStunMessageWithTxId(t *testing.T) {
+	peer := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}
+	m := newSTUNMessage(turnCreatePermissionRequest).addAddr(stunAttrXorPeerAddress, peer)
+	c := m.withTxId(newSTUNMessage(turnCreatePermissionRequest).txId)
+	parsed, err := parseSTUN(c.encode(nil))
+	if assert.NoError(t, err) {
+		assert.Equal(t, peer.String(), parsed.getAddr(stunAttrXorPeerAddress).String())
+	}
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	return conn
+}
+
+func udpAddr(conn *net.UDPConn) *net.UDPAddr {
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func readFrom(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+	b := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFromUDP(b)
+	if err != nil {
+		t.Fatalf("Unable to read: %s", err)
+	}
+	return string(b[:n])
+}
+
+// fakeNatty talks TURN to a turnBinding (or mappingBinding) the way that natty
+// would.
+type fakeNatty struct {
+	t       *testing.T
+	conn    *net.UDPConn
+	binding interface {
+		addr() string
+		close()
+	}
+}
+
+func newFakeNatty(t *testing.T, alloc *TurnAllocation) *fakeNatty {
+	binding, err := alloc.bind()
+	if err != nil {
+		t.Fatalf("Unable to bind: %s", err)
+	}
+	return &fakeNatty{t, listenLoopback(t), binding}
+}
+
+func (n *fakeNatty) send(b []byte) {
+	addr, _ := net.ResolveUDPAddr("udp", n.binding.addr())
+	n.conn.WriteToUDP(b, addr)
+}
+
+func (n *fakeNatty) read() []byte {
+	n.t.Helper()
+	return []byte(readFrom(n.t, n.conn))
+}
+
+func (n *fakeNatty) request(m *stunMessage) *stunMessage {
+	n.t.Helper()
+	n.send(m.encode(nil))
+	resp, err := parseSTUN(n.read())
+	if err != nil {
+		n.t.Fatalf("Unable to parse response: %s", err)
+	}
+	return resp
+}
+
+func (n *fakeNatty) close() {
+	n.binding.close()
+	n.conn.Close()
+}
+
+// fakeTURN is a TURN server with a single user "user" whose password is
+// "pass", and a single relay.
+type fakeTURN struct {
+	conn     *net.UDPConn
+	relay    *net.UDPConn
+	client   *net.UDPAddr
+	channels map[uint16]string
+	log      []string
+	mutex    sync.Mutex
+}
+
+func startFakeTURN(t *testing.T) *fakeTURN {
+	s := &fakeTURN{conn: listenLoopback(t), relay: listenLoopback(t), channels: make(map[uint16]string)}
+	go s.serve()
+	go s.serveRelay()
+	return s
+}
+
+func (s *fakeTURN) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *fakeTURN) close() {
+	s.conn.Close()
+	s.relay.Close()
+}
+
+func (s *fakeTURN) requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.log...)
+}
+
+func (s *fakeTURN) serve() {
+	b := make([]byte, 1500)
+	for {
+		n, from, err := s.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		msg := append([]byte{}, b[:n]...)
+		s.mutex.Lock()
+		s.client = from
+		if !isSTUN(msg) {
+			if peer := s.channels[binary.BigEndian.Uint16(msg)]; peer != "" {
+				addr, _ := net.ResolveUDPAddr("udp", peer)
+				s.relay.WriteToUDP(msg[4:], addr)
+			}
+			s.mutex.Unlock()
+			continue
+		}
+		m, _ := parseSTUN(msg)
+		if m.typ == turnSendIndication {
+			s.relay.WriteToUDP(m.get(stunAttrData), m.getAddr(stunAttrXorPeerAddress))
+			s.mutex.Unlock()
+			continue
+		}
+		if !s.authentic(m) {
+			s.mutex.Unlock()
+			resp := m.reply(m.typ|0x0110).addError(401, "Unauthorized").add(stunAttrRealm, []byte("test")).add(stunAttrNonce, []byte("nonce"))
+			s.conn.WriteToUDP(resp.encode(nil), from)
+			continue
+		}
+		resp := m.reply(m.typ | 0x0100)
+		switch m.typ {
+		case turnAllocateRequest:
+			s.log = append(s.log, "allocate")
+			resp.addAddr(stunAttrXorRelayedAddress, udpAddr(s.relay)).addAddr(stunAttrXorMappedAddress, from).addUint32(stunAttrLifetime, 600)
+		case turnRefreshRequest:
+			lifetime, _ := m.getUint32(stunAttrLifetime)
+			s.log = append(s.log, fmt.Sprintf("refresh %d", lifetime))
+		case turnCreatePermissionRequest:
+			for _, peer := range m.getAddrs(stunAttrXorPeerAddress) {
+				s.log = append(s.log, "permission "+peer.IP.String())
+			}
+		case turnChannelBindRequest:
+			number := binary.BigEndian.Uint16(m.get(stunAttrChannelNumber))
+			s.log = append(s.log, fmt.Sprintf("channel %#x", number))
+			s.channels[number] = m.getAddr(stunAttrXorPeerAddress).String()
+		}
+		s.mutex.Unlock()
+		s.conn.WriteToUDP(resp.encode(longTermKey("user", "test", "pass")), from)
+	}
+}
+
+// authentic checks m's MESSAGE-INTEGRITY by re-encoding it.
+func (s *fakeTURN) authentic(m *stunMessage) bool {
+	integrity := m.get(stunAttrMessageIntegrity)
+	if integrity == nil || string(m.get(stunAttrUsername)) != "user" {
+		return false
+	}
+	unsigned := &stunMessage{typ: m.typ, txId: m.txId, attrs: m.attrs[:len(m.attrs)-1]}
+	expected := unsigned.encode(longTermKey("user", "test", "pass"))
+	return bytes.Equal(expected[len(expected)-20:], integrity)
+}
+
+// serveRelay relays what peers send to the client, over a channel if one's
+// bound and as a Data indication otherwise.
+func (s *fakeTURN) serveRelay() {
+	b := make([]byte, 1500)
+	for {
+		n, from, err := s.relay.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		var msg []byte
+		for number, peer := range s.channels {
+			if peer == from.String() {
+				msg = append([]byte{byte(number >> 8), byte(number), 0, byte(n)}, b[:n]...)
+			}
+		}
+		if msg == nil {
+			msg = newSTUNMessage(turnDataIndication).addAddr(stunAttrXorPeerAddress, from).add(stunAttrData, b[:n]).encode(nil)
+		}
+		client := s.client
+		s.mutex.Unlock()
+		s.conn.WriteToUDP(msg, client)
+	}
+}
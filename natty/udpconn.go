@@ -0,0 +1,158 @@
+package natty
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	// ConnectedSocket is a socket connected to the FiveTuple's remote address,
+	// so the kernel drops packets from anywhere else. Use it when the peer only
+	// ever talks to us from the punched address, which is the common case.
+	ConnectedSocket = SocketMode(iota)
+
+	// UnconnectedSocket is a socket bound to the FiveTuple's local address
+	// without being connected, so that it can also receive from addresses other
+	// than the punched one (see FilteredConn.Allow), for example a port the peer
+	// rebinds to. Both ends can use it, so that they share the same code.
+	UnconnectedSocket
+)
+
+// SocketMode determines how DialUDP and ListenUDP set up their socket.
+type SocketMode int
+
+func (m SocketMode) String() string {
+	switch m {
+	case ConnectedSocket:
+		return "connected"
+	case UnconnectedSocket:
+		return "unconnected"
+	}
+	return fmt.Sprintf("SocketMode(%d)", int(m))
+}
+
+// DialUDP waits for the FiveTuple and opens a UDP socket on it, marked per
+// WithDSCP and bound to the device per WithBindToDevice. With ConnectedSocket,
+// the socket is a *net.UDPConn connected to the remote address. With
+// UnconnectedSocket, it's a *FilteredConn that only reads from the remote
+// address. It's meant for the offer side and takes the same modes as
+// ListenUDP, so that both sides can use the same kind of socket.
+func (t *Traversal) DialUDP(mode SocketMode) (net.Conn, error) {
+	return t.openUDP(mode)
+}
+
+// ListenUDP is like DialUDP, for the answer side.
+func (t *Traversal) ListenUDP(mode SocketMode) (net.Conn, error) {
+	return t.openUDP(mode)
+}
+
+func (t *Traversal) openUDP(mode SocketMode) (net.Conn, error) {
+	ft, err := t.FiveTuple()
+	if err != nil {
+		return nil, err
+	}
+	if ft.Proto != UDP {
+		return nil, fmt.Errorf("Unable to open UDP socket on %s FiveTuple", ft.Proto)
+	}
+	local, remote, err := ft.UDPAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var udpConn *net.UDPConn
+	switch mode {
+	case ConnectedSocket:
+		udpConn, err = t.sockets.dialUDP("udp", local, remote)
+	case UnconnectedSocket:
+		udpConn, err = t.sockets.listenUDP("udp", local)
+	default:
+		return nil, fmt.Errorf("Unknown socket mode %s", mode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s socket from %s to %s: %s", mode, local, remote, err)
+	}
+	err = t.MarkConn(udpConn)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	if mode == ConnectedSocket {
+		t.keepAlives.opened(udpConn, nil)
+		return udpConn, nil
+	}
+	t.keepAlives.opened(udpConn, remote)
+	return NewFilteredConn(udpConn, remote), nil
+}
+
+// FilteredConn wraps an unconnected UDP socket to behave like one connected
+// to a remote address: Write sends to the remote address and reads only
+// return packets from it or from addresses that were allowed with Allow.
+// Packets from anywhere else are dropped. WriteTo can still send anywhere.
+type FilteredConn struct {
+	*net.UDPConn
+	remote  *net.UDPAddr
+	allowed map[string]bool
+	mutex   sync.RWMutex
+}
+
+// NewFilteredConn wraps conn so that it only talks to remote.
+func NewFilteredConn(conn *net.UDPConn, remote *net.UDPAddr) *FilteredConn {
+	return &FilteredConn{
+		UDPConn: conn,
+		remote:  remote,
+		allowed: map[string]bool{remote.String(): true},
+	}
+}
+
+// Allow also accepts packets from addr, for example a port that the peer
+// rebound to.
+func (c *FilteredConn) Allow(addr *net.UDPAddr) {
+	c.mutex.Lock()
+	c.allowed[addr.String()] = true
+	c.mutex.Unlock()
+}
+
+func (c *FilteredConn) isAllowed(addr *net.UDPAddr) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.allowed[addr.String()]
+}
+
+// ReadFromUDP reads the next packet from an allowed address.
+func (c *FilteredConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, addr, err := c.UDPConn.ReadFromUDP(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if c.isAllowed(addr) {
+			return n, addr, nil
+		}
+		log.Tracef("Dropping packet from %s, expecting %s", addr, c.remote)
+	}
+}
+
+// ReadFrom is like ReadFromUDP.
+func (c *FilteredConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.ReadFromUDP(b)
+	if addr == nil {
+		return n, nil, err
+	}
+	return n, addr, err
+}
+
+// Read is like ReadFromUDP, without the address.
+func (c *FilteredConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFromUDP(b)
+	return n, err
+}
+
+// Write sends b to the remote address.
+func (c *FilteredConn) Write(b []byte) (int, error) {
+	return c.UDPConn.WriteToUDP(b, c.remote)
+}
+
+// RemoteAddr returns the remote address.
+func (c *FilteredConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,110 @@
+package natty
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestUDPSocketModes(t *testing.T) {
+	for _, offerMode := range []SocketMode{ConnectedSocket, UnconnectedSocket} {
+		for _, offerFirst := range []bool{true, false} {
+			offerer, answerer := localTraversalPair(t)
+			offerConn, err := offerer.DialUDP(offerMode)
+			if !assert.NoError(t, err, offerMode.String()) {
+				return
+			}
+			answerConn, err := answerer.ListenUDP(UnconnectedSocket)
+			if !assert.NoError(t, err) {
+				offerConn.Close()
+				return
+			}
+			if offerFirst {
+				assertExchange(t, offerConn, answerConn)
+				assertExchange(t, answerConn, offerConn)
+			} else {
+				assertExchange(t, answerConn, offerConn)
+				assertExchange(t, offerConn, answerConn)
+			}
+			offerConn.Close()
+			answerConn.Close()
+		}
+	}
+}
+
+func TestFilteredConnAllow(t *testing.T) {
+	offerer, answerer := localTraversalPair(t)
+	conn, err := offerer.DialUDP(UnconnectedSocket)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	fc := conn.(*FilteredConn)
+
+	// The peer rebinds to another port, while a stranger sends to us too
+	rebound, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rebound.Close()
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stranger.Close()
+	local := fc.LocalAddr().(*net.UDPAddr)
+	fc.Allow(rebound.LocalAddr().(*net.UDPAddr))
+	_, err = stranger.WriteToUDP([]byte("stranger"), local)
+	assert.NoError(t, err)
+	_, err = rebound.WriteToUDP([]byte("allowed"), local)
+	assert.NoError(t, err)
+
+	b := make([]byte, 100)
+	fc.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := fc.ReadFromUDP(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "allowed", string(b[:n]), "Packet from stranger should have been dropped")
+		assert.Equal(t, rebound.LocalAddr().String(), addr.String())
+	}
+	fc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = fc.Read(b)
+	assert.Error(t, err, "Nothing else should have been read")
+
+	_, err = answerer.DialUDP(SocketMode(5))
+	assert.Error(t, err, "Unknown mode should fail")
+}
+
+// localTraversalPair returns two Traversals whose FiveTuples connect free
+// ports on the loopback interface to each other.
+func localTraversalPair(t *testing.T) (*Traversal, *Traversal) {
+	a, b := freeLocalAddr(t), freeLocalAddr(t)
+	offerer, answerer := newTraversal(0, nil), newTraversal(0, nil)
+	offerer.fiveTupleOut = &FiveTuple{Proto: UDP, Local: a, Remote: b}
+	answerer.fiveTupleOut = &FiveTuple{Proto: UDP, Local: b, Remote: a}
+	return offerer, answerer
+}
+
+func freeLocalAddr(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to find free port: %s", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+// assertExchange sends a packet from one conn to the other.
+func assertExchange(t *testing.T, from net.Conn, to net.Conn) {
+	_, err := from.Write([]byte("hello"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, 100)
+	to.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := to.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello", string(b[:n]))
+	}
+}
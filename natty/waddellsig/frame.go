@@ -0,0 +1,68 @@
+package waddellsig
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// MaxPurposeLength is the longest purpose a Frame can carry.
+	MaxPurposeLength = 255
+
+	frameHeaderLength = 6
+	flagAnswer        = 1
+)
+
+// SessionID identifies one traversal between two peers. The offering side
+// picks a new one for each traversal it starts, so a peer that reconnects
+// shows up with a different SessionID.
+type SessionID uint32
+
+// Frame is a natty signaling message as it's carried in the body of a waddell
+// message. It's laid out as a flags byte, the SessionID (4 bytes, big endian),
+// the length of the purpose (1 byte), the purpose and finally the message
+// itself. A Frame with an empty Msg just opens or touches its session.
+type Frame struct {
+	Session SessionID
+	// Purpose distinguishes traversals between the same pair of peers that
+	// are meant to live side by side, for example one for control traffic
+	// and one for bulk data.
+	Purpose string
+	// Answer is set on frames sent by the answering side.
+	Answer bool
+	Msg    []byte
+}
+
+// Encode encodes the Frame into a new message body.
+func (f *Frame) Encode() ([]byte, error) {
+	if len(f.Purpose) > MaxPurposeLength {
+		return nil, fmt.Errorf("Purpose is %d bytes long, can't be more than %d", len(f.Purpose), MaxPurposeLength)
+	}
+	b := make([]byte, frameHeaderLength+len(f.Purpose)+len(f.Msg))
+	if f.Answer {
+		b[0] = flagAnswer
+	}
+	binary.BigEndian.PutUint32(b[1:], uint32(f.Session))
+	b[5] = byte(len(f.Purpose))
+	n := frameHeaderLength + copy(b[frameHeaderLength:], f.Purpose)
+	copy(b[n:], f.Msg)
+	return b, nil
+}
+
+// Decode decodes a Frame from a message body. The Frame's Msg refers to body
+// without copying it.
+func Decode(body []byte) (*Frame, error) {
+	if len(body) < frameHeaderLength {
+		return nil, fmt.Errorf("Frame of %d bytes is too short", len(body))
+	}
+	purposeEnd := frameHeaderLength + int(body[5])
+	if len(body) < purposeEnd {
+		return nil, fmt.Errorf("Frame of %d bytes is too short for its purpose", len(body))
+	}
+	return &Frame{
+		Session: SessionID(binary.BigEndian.Uint32(body[1:])),
+		Purpose: string(body[frameHeaderLength:purposeEnd]),
+		Answer:  body[0]&flagAnswer != 0,
+		Msg:     body[purposeEnd:],
+	}, nil
+}
@@ -0,0 +1,711 @@
+// Package waddellsig answers natty traversals signaled over waddell and owns
+// their lifecycle on the answering side.
+package waddellsig
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/go-natty/natty"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/waddell"
+)
+
+const (
+	// DefaultTimeout is how long each answered traversal gets to connect if
+	// Config.Timeout isn't set.
+	DefaultTimeout = 30 * time.Second
+
+	// DefaultIdleTimeout is how long a session may go without signaling or
+	// traffic before it expires if Config.IdleTimeout isn't set.
+	DefaultIdleTimeout = 2 * time.Minute
+
+	// retiredIDs is how many superseded SessionIDs we remember per peer and
+	// purpose, so that late messages for them don't start new sessions.
+	retiredIDs = 8
+)
+
+var (
+	log = golog.LoggerFor("natty.waddellsig")
+
+	// ErrSuperseded ends a session when its peer starts a new one for the
+	// same purpose.
+	ErrSuperseded = errors.New("Superseded by a newer session")
+
+	// ErrPeerDisconnected ends the sessions of a peer that disconnected from
+	// waddell.
+	ErrPeerDisconnected = errors.New("Peer disconnected")
+
+	// ErrIdle ends a session that's been idle for longer than IdleTimeout.
+	ErrIdle = errors.New("Session idle")
+
+	// ErrClosed ends sessions that were closed, or whose SessionManager was.
+	ErrClosed = errors.New("Session closed")
+)
+
+// PeerInfo describes a peer offering a new session.
+type PeerInfo struct {
+	Peer    waddell.PeerId
+	Purpose string
+	Session SessionID
+}
+
+// AcceptFunc decides whether to answer a new session, given the peer and the
+// first message that it sent for the session. Returning false or an error
+// refuses the session, with the error's message as the reason given to the
+// peer. Returning a *natty.PeerError gives the peer its code as well, for
+// example natty.PeerBusy when shedding load.
+type AcceptFunc func(peer PeerInfo, firstMessage []byte) (bool, error)
+
+// Config configures a SessionManager.
+type Config struct {
+	// Options are applied to every answered Traversal.
+	Options []natty.Option
+
+	// Timeout limits how long each traversal gets to connect, defaulting to
+	// DefaultTimeout.
+	Timeout time.Duration
+
+	// IdleTimeout is how long a session may go without signaling from its
+	// peer or traffic on its conn before it expires, defaulting to
+	// DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	// Accept, if set, is consulted before answering a new session, for
+	// example to check the peer against an allow-list or to shed load. It runs
+	// on its own goroutine, so it may block briefly without holding up other
+	// sessions. Messages for the session are held until it returns. Refused
+	// sessions get a refusal (see natty.PeerErrorMsg), which fails the peer's
+	// traversal right away with a *natty.PeerError. If Accept panics, the
+	// session is refused with natty.PeerInternalError.
+	Accept AcceptFunc
+
+	// OnUp, if set, is called when a session has connected.
+	OnUp func(s *Session)
+
+	// OnDown, if set, is called once for every session when it ends, whether
+	// or not it came up, with the reason that it ended.
+	OnDown func(s *Session, err error)
+}
+
+// Counters count what a SessionManager has done with its sessions.
+type Counters struct {
+	// Active is the number of sessions currently open.
+	Active int
+	// Started is the number of sessions that were started.
+	Started int64
+	// Up is the number of sessions that connected.
+	Up int64
+	// Failed is the number of sessions whose traversal failed.
+	Failed int64
+	// Rejected is the number of sessions that Config.Accept refused.
+	Rejected int64
+	// Superseded, Expired and Disconnected are the numbers of sessions that
+	// ended with ErrSuperseded, ErrIdle and ErrPeerDisconnected respectively.
+	Superseded   int64
+	Expired      int64
+	Disconnected int64
+}
+
+type sessionKey struct {
+	peer    waddell.PeerId
+	purpose string
+}
+
+type retired struct {
+	ids []SessionID
+	at  time.Time
+}
+
+// pendingSession is a new session waiting for Config.Accept.
+type pendingSession struct {
+	key      sessionKey
+	info     PeerInfo
+	msgs     [][]byte // held until accepted, the first one included
+	accepted bool
+	err      error
+}
+
+// SessionManager answers the traversals that peers offer over waddell and
+// owns them until they end. It keeps at most one session per peer and
+// purpose: when a peer shows up with a new SessionID, for example because it
+// reconnected, the new session supersedes the old one, which is closed.
+// Sessions that go idle expire, and the application reports peers that
+// disconnected from waddell with PeerDisconnected, which closes all of their
+// sessions. Connected sessions are detached from their Traversals and can be
+// looked up by peer and purpose.
+type SessionManager struct {
+	out    chan<- *waddell.MessageOut
+	config Config
+
+	mutex    sync.Mutex
+	sessions map[sessionKey]*Session
+	retired  map[sessionKey]*retired
+	counters Counters
+	closed   bool
+	closedCh chan struct{}
+
+	// Only receive touches gated
+	gated     map[sessionKey]*pendingSession
+	decisions chan *pendingSession
+
+	notifyMutex sync.Mutex
+	pending     []func()
+	notifying   bool
+}
+
+// NewSessionManager starts a SessionManager that reads signaling from in,
+// usually a waddell Client's In for some topic, and writes replies to out,
+// that Client's Out for the same topic. It stops reading once in is closed
+// or the SessionManager is.
+func NewSessionManager(in <-chan *waddell.MessageIn, out chan<- *waddell.MessageOut, config *Config) *SessionManager {
+	m := &SessionManager{
+		out:      out,
+		sessions: make(map[sessionKey]*Session),
+		retired:  make(map[sessionKey]*retired),
+		closedCh: make(chan struct{}),
+
+		gated:     make(map[sessionKey]*pendingSession),
+		decisions: make(chan *pendingSession),
+	}
+	if config != nil {
+		m.config = *config
+	}
+	if m.config.Timeout <= 0 {
+		m.config.Timeout = DefaultTimeout
+	}
+	if m.config.IdleTimeout <= 0 {
+		m.config.IdleTimeout = DefaultIdleTimeout
+	}
+	go m.receive(in)
+	go m.expire()
+	return m
+}
+
+// Lookup returns the connected session of the given peer for the given
+// purpose, if there is one.
+func (m *SessionManager) Lookup(peer waddell.PeerId, purpose string) (*Session, bool) {
+	m.mutex.Lock()
+	s := m.sessions[sessionKey{peer, purpose}]
+	m.mutex.Unlock()
+	if s == nil || s.Conn() == nil {
+		return nil, false
+	}
+	return s, true
+}
+
+// Sessions returns the open sessions of the given peer, connected or not.
+func (m *SessionManager) Sessions(peer waddell.PeerId) []*Session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var sessions []*Session
+	for key, s := range m.sessions {
+		if key.peer == peer {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// PeerDisconnected closes all sessions of the given peer, which waddell
+// reported as disconnected.
+func (m *SessionManager) PeerDisconnected(peer waddell.PeerId) {
+	for _, s := range m.Sessions(peer) {
+		s.end(ErrPeerDisconnected)
+	}
+}
+
+// Counters returns a snapshot of the SessionManager's counters.
+func (m *SessionManager) Counters() Counters {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	c := m.counters
+	c.Active = len(m.sessions)
+	return c
+}
+
+// Close stops the SessionManager and closes all of its sessions.
+func (m *SessionManager) Close() error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.closedCh)
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mutex.Unlock()
+
+	for _, s := range sessions {
+		s.end(ErrClosed)
+	}
+	return nil
+}
+
+func (m *SessionManager) receive(in <-chan *waddell.MessageIn) {
+	for {
+		select {
+		case wm, ok := <-in:
+			if !ok {
+				return
+			}
+			m.handle(wm)
+		case p := <-m.decisions:
+			m.decided(p)
+		case <-m.closedCh:
+			return
+		}
+	}
+}
+
+func (m *SessionManager) handle(wm *waddell.MessageIn) {
+	f, err := Decode(wm.Body)
+	if err != nil {
+		log.Debugf("Dropping message from %s: %s", wm.From, err)
+		return
+	}
+	if f.Answer {
+		log.Debugf("Dropping answer from %s, we only answer", wm.From)
+		return
+	}
+	key := sessionKey{wm.From, f.Purpose}
+	if m.config.Accept != nil && !m.isOpen(key, f.Session) {
+		m.gate(key, f)
+		return
+	}
+	s := m.session(key, f.Session)
+	if s == nil {
+		return
+	}
+	s.deliver(f.Msg)
+}
+
+// isOpen tells whether the session with the given key and id is open.
+func (m *SessionManager) isOpen(key sessionKey, id SessionID) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.sessions[key]
+	return s != nil && s.id == id
+}
+
+// gate holds the messages of a new session while Config.Accept decides
+// whether to answer it. A newer session from the same peer for the same
+// purpose replaces one that's still pending.
+func (m *SessionManager) gate(key sessionKey, f *Frame) {
+	msg := append([]byte(nil), f.Msg...)
+	p := m.gated[key]
+	if p != nil && p.info.Session == f.Session {
+		p.msgs = append(p.msgs, msg)
+		return
+	}
+	m.mutex.Lock()
+	stale := m.isRetired(key, f.Session)
+	m.mutex.Unlock()
+	if stale {
+		log.Tracef("Dropping message for superseded or refused session %d of %s", f.Session, key.peer)
+		return
+	}
+	p = &pendingSession{
+		key:  key,
+		info: PeerInfo{Peer: key.peer, Purpose: key.purpose, Session: f.Session},
+		msgs: [][]byte{msg},
+	}
+	m.gated[key] = p
+	go m.decide(p, msg)
+}
+
+// decide consults Config.Accept about p, given its first message, and passes
+// the decision back to receive.
+func (m *SessionManager) decide(p *pendingSession, first []byte) {
+	p.accepted, p.err = m.accept(p.info, first)
+	select {
+	case m.decisions <- p:
+	case <-m.closedCh:
+	}
+}
+
+func (m *SessionManager) accept(info PeerInfo, first []byte) (accepted bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Accept panicked for session %d of %s: %v", info.Session, info.Peer, r)
+			accepted, err = false, &natty.PeerError{Code: natty.PeerInternalError}
+		}
+	}()
+	return m.config.Accept(info, first)
+}
+
+// decided starts or refuses a session that Config.Accept decided about,
+// unless a newer one superseded it in the meantime.
+func (m *SessionManager) decided(p *pendingSession) {
+	if m.gated[p.key] != p {
+		return
+	}
+	delete(m.gated, p.key)
+	if p.accepted && p.err == nil {
+		s := m.session(p.key, p.info.Session)
+		if s == nil {
+			return
+		}
+		for _, msg := range p.msgs {
+			s.deliver(msg)
+		}
+		return
+	}
+
+	code, reason := natty.PeerRejected, ""
+	if peerErr, ok := p.err.(*natty.PeerError); ok {
+		code, reason = peerErr.Code, peerErr.Reason
+	} else if p.err != nil {
+		reason = p.err.Error()
+	}
+	m.mutex.Lock()
+	m.retire(p.key, p.info.Session)
+	m.counters.Rejected++
+	m.mutex.Unlock()
+	log.Debugf("Refusing session %d of %s for %q: %s", p.info.Session, p.info.Peer, p.info.Purpose, reason)
+	f := &Frame{Session: p.info.Session, Purpose: p.info.Purpose, Answer: true, Msg: natty.PeerErrorMsg(code, reason)}
+	body, _ := f.Encode()
+	go func() {
+		select {
+		case m.out <- waddell.Message(p.info.Peer, body):
+		case <-m.closedCh:
+		}
+	}()
+}
+
+// session returns the session with the given key and id, starting it if
+// necessary. Only receive starts sessions, so whatever we find for key can
+// only go away while we start a new one.
+func (m *SessionManager) session(key sessionKey, id SessionID) *Session {
+	m.mutex.Lock()
+	s := m.sessions[key]
+	if s != nil && s.id == id {
+		m.mutex.Unlock()
+		return s
+	}
+	stale := m.isRetired(key, id)
+	m.mutex.Unlock()
+	if stale {
+		log.Tracef("Dropping message for superseded session %d of %s", id, key.peer)
+		return nil
+	}
+
+	t := natty.Answer(m.config.Timeout, m.config.Options...)
+	s = &Session{
+		m:       m,
+		peer:    key.peer,
+		purpose: key.purpose,
+		id:      id,
+		t:       t,
+	}
+	s.touch()
+
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		t.Close()
+		return nil
+	}
+	old := m.sessions[key]
+	if old != nil {
+		m.retire(key, old.id)
+	}
+	m.sessions[key] = s
+	m.counters.Started++
+	m.mutex.Unlock()
+
+	if old != nil {
+		log.Debugf("Session %d of %s for %q supersedes session %d", id, key.peer, key.purpose, old.id)
+		old.end(ErrSuperseded)
+	}
+	go s.sendMessages()
+	go s.connect()
+	return s
+}
+
+func (m *SessionManager) isRetired(key sessionKey, id SessionID) bool {
+	r := m.retired[key]
+	if r == nil {
+		return false
+	}
+	for _, retiredID := range r.ids {
+		if retiredID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *SessionManager) retire(key sessionKey, id SessionID) {
+	r := m.retired[key]
+	if r == nil {
+		r = &retired{}
+		m.retired[key] = r
+	}
+	if len(r.ids) == retiredIDs {
+		r.ids = r.ids[1:]
+	}
+	r.ids = append(r.ids, id)
+	r.at = time.Now()
+}
+
+// expire periodically ends idle sessions and forgets old superseded ids.
+func (m *SessionManager) expire() {
+	ticker := time.NewTicker(m.config.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.closedCh:
+			return
+		}
+		now := time.Now()
+		var idle []*Session
+		m.mutex.Lock()
+		for _, s := range m.sessions {
+			if now.Sub(s.lastActive()) > m.config.IdleTimeout {
+				idle = append(idle, s)
+			}
+		}
+		for key, r := range m.retired {
+			if now.Sub(r.at) > m.config.IdleTimeout {
+				delete(m.retired, key)
+			}
+		}
+		m.mutex.Unlock()
+		for _, s := range idle {
+			s.end(ErrIdle)
+		}
+	}
+}
+
+// notify calls fn on a separate goroutine after any callbacks that were
+// queued before it, so callbacks are delivered in order and are free to call
+// back into the SessionManager.
+func (m *SessionManager) notify(fn func()) {
+	if fn == nil {
+		return
+	}
+	m.notifyMutex.Lock()
+	defer m.notifyMutex.Unlock()
+	m.pending = append(m.pending, fn)
+	if !m.notifying {
+		m.notifying = true
+		go m.deliver()
+	}
+}
+
+func (m *SessionManager) deliver() {
+	for {
+		m.notifyMutex.Lock()
+		if len(m.pending) == 0 {
+			m.notifying = false
+			m.notifyMutex.Unlock()
+			return
+		}
+		fn := m.pending[0]
+		m.pending = m.pending[1:]
+		m.notifyMutex.Unlock()
+		fn()
+	}
+}
+
+// Session is a traversal answered for a peer, and once it has connected, the
+// conn detached from it.
+type Session struct {
+	m       *SessionManager
+	peer    waddell.PeerId
+	purpose string
+	id      SessionID
+	t       *natty.Traversal
+	active  int64 // when we last saw signaling or traffic, in unix nanos
+
+	mutex   sync.Mutex
+	ft      *natty.FiveTuple
+	conn    net.Conn
+	cleanup func()
+	ended   bool
+	endOnce sync.Once
+}
+
+// Peer returns the peer that offered the session.
+func (s *Session) Peer() waddell.PeerId {
+	return s.peer
+}
+
+// Purpose returns the purpose of the session.
+func (s *Session) Purpose() string {
+	return s.purpose
+}
+
+// ID returns the SessionID that the peer picked for the session.
+func (s *Session) ID() SessionID {
+	return s.id
+}
+
+// Traversal returns the Traversal answering the session.
+func (s *Session) Traversal() *natty.Traversal {
+	return s.t
+}
+
+// FiveTuple returns the FiveTuple of the session, or nil if it hasn't
+// connected (yet).
+func (s *Session) FiveTuple() *natty.FiveTuple {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ft
+}
+
+// Conn returns the conn detached from the session's Traversal, or nil if it
+// hasn't connected (yet). Traffic on the conn keeps the session from going
+// idle. The SessionManager closes the conn when the session ends.
+func (s *Session) Conn() net.Conn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn
+}
+
+// Close ends the session with ErrClosed.
+func (s *Session) Close() error {
+	s.end(ErrClosed)
+	return nil
+}
+
+func (s *Session) touch() {
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+}
+
+func (s *Session) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.active))
+}
+
+// deliver passes a message from the peer to the session's Traversal, if it's
+// not empty.
+func (s *Session) deliver(msg []byte) {
+	s.touch()
+	if len(msg) > 0 {
+		s.t.MsgIn(string(msg))
+	}
+}
+
+// sendMessages passes the Traversal's messages to the peer until it's done.
+func (s *Session) sendMessages() {
+	for {
+		msg, done := s.t.NextMsgOutBytes()
+		if done {
+			return
+		}
+		f := &Frame{Session: s.id, Purpose: s.purpose, Answer: true, Msg: msg}
+		body, _ := f.Encode() // the purpose came from a decoded Frame, so it fits
+		natty.ReleaseMsg(msg)
+		select {
+		case s.m.out <- waddell.Message(s.peer, body):
+		case <-s.m.closedCh:
+			return
+		}
+	}
+}
+
+// connect waits for the traversal and detaches its conn.
+func (s *Session) connect() {
+	ft, err := s.t.FiveTuple()
+	if err != nil {
+		s.end(err)
+		return
+	}
+	conn, cleanup, err := s.t.Detach()
+	if err != nil {
+		s.end(err)
+		return
+	}
+	s.t.Close()
+
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		cleanup()
+		return
+	}
+	s.ft = ft
+	s.conn = &activityConn{conn, s}
+	s.cleanup = cleanup
+	s.touch()
+	s.m.notify(s.onUp())
+	s.mutex.Unlock()
+
+	s.m.mutex.Lock()
+	s.m.counters.Up++
+	s.m.mutex.Unlock()
+	log.Debugf("Session %d of %s for %q is up on %s", s.id, s.peer, s.purpose, ft)
+}
+
+func (s *Session) end(err error) {
+	s.endOnce.Do(func() {
+		m := s.m
+		m.mutex.Lock()
+		key := sessionKey{s.peer, s.purpose}
+		if m.sessions[key] == s {
+			delete(m.sessions, key)
+		}
+		switch err {
+		case ErrSuperseded:
+			m.counters.Superseded++
+		case ErrIdle:
+			m.counters.Expired++
+		case ErrPeerDisconnected:
+			m.counters.Disconnected++
+		case ErrClosed:
+		default:
+			m.counters.Failed++
+		}
+		m.mutex.Unlock()
+
+		s.t.Close()
+		s.mutex.Lock()
+		s.ended = true
+		cleanup := s.cleanup
+		if m.config.OnDown != nil {
+			m.notify(func() { m.config.OnDown(s, err) })
+		}
+		s.mutex.Unlock()
+		if cleanup != nil {
+			cleanup()
+		}
+		log.Debugf("Session %d of %s for %q ended: %s", s.id, s.peer, s.purpose, err)
+	})
+}
+
+func (s *Session) onUp() func() {
+	if s.m.config.OnUp == nil {
+		return nil
+	}
+	return func() { s.m.config.OnUp(s) }
+}
+
+// activityConn keeps its session from going idle while there's traffic.
+type activityConn struct {
+	net.Conn
+	s *Session
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.s.touch()
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.s.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,218 @@
+package waddellsig
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getlantern/go-natty/natty"
+	"github.com/getlantern/testify/assert"
+	"github.com/getlantern/waddell"
+)
+
+type down struct {
+	s   *Session
+	err error
+}
+
+// TestSuperseded simulates a peer that reconnects and offers again with a new
+// SessionID while its first traversal is still pending.
+func TestSuperseded(t *testing.T) {
+	in := make(chan *waddell.MessageIn, 10)
+	downs := make(chan *down, 10)
+	m := NewSessionManager(in, make(chan *waddell.MessageOut, 100), &Config{
+		OnDown: func(s *Session, err error) { downs <- &down{s, err} },
+	})
+	defer m.Close()
+	peer, _ := waddell.PeerIdFromString("peer")
+
+	in <- frame(t, peer, 1, "data")
+	first := waitForSession(t, m, peer, 1)
+	if first == nil {
+		return
+	}
+
+	// The peer reconnects
+	in <- frame(t, peer, 2, "data")
+	select {
+	case d := <-downs:
+		assert.Equal(t, first, d.s, "The first session should have ended")
+		assert.Equal(t, ErrSuperseded, d.err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("First session wasn't superseded")
+	}
+	_, err := first.Traversal().FiveTuple()
+	assert.Error(t, err, "Superseded traversal should have been closed")
+	second := waitForSession(t, m, peer, 2)
+	if second == nil {
+		return
+	}
+
+	// A late message for the first session doesn't bring it back, and other
+	// purposes are independent
+	in <- frame(t, peer, 1, "data")
+	in <- frame(t, peer, 1, "control")
+	waitForSession(t, m, peer, 1)
+	c := m.Counters()
+	assert.Equal(t, 2, c.Active)
+	assert.Equal(t, int64(3), c.Started)
+	assert.Equal(t, int64(1), c.Superseded)
+	_, ok := m.Lookup(peer, "data")
+	assert.False(t, ok, "Unconnected session shouldn't be looked up")
+
+	m.PeerDisconnected(peer)
+	for i := 0; i < 2; i++ {
+		select {
+		case d := <-downs:
+			assert.Equal(t, ErrPeerDisconnected, d.err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Sessions of disconnected peer didn't end")
+		}
+	}
+	c = m.Counters()
+	assert.Equal(t, 0, c.Active)
+	assert.Equal(t, int64(2), c.Disconnected)
+	assert.Empty(t, m.Sessions(peer))
+}
+
+func TestIdle(t *testing.T) {
+	in := make(chan *waddell.MessageIn, 10)
+	downs := make(chan *down, 10)
+	m := NewSessionManager(in, make(chan *waddell.MessageOut, 100), &Config{
+		IdleTimeout: 100 * time.Millisecond,
+		OnDown:      func(s *Session, err error) { downs <- &down{s, err} },
+	})
+	defer m.Close()
+	peer, _ := waddell.PeerIdFromString("peer")
+
+	in <- frame(t, peer, 1, "")
+	select {
+	case d := <-downs:
+		assert.Equal(t, ErrIdle, d.err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle session didn't expire")
+	}
+	c := m.Counters()
+	assert.Equal(t, 0, c.Active)
+	assert.Equal(t, int64(1), c.Expired)
+}
+
+func TestFrame(t *testing.T) {
+	f := &Frame{Session: 1<<32 - 1, Purpose: "data", Answer: true, Msg: []byte("hello")}
+	b, err := f.Encode()
+	if !assert.NoError(t, err) {
+		return
+	}
+	decoded, err := Decode(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, f, decoded)
+	}
+	_, err = Decode(b[:7])
+	assert.Error(t, err, "Truncated purpose should fail to decode")
+}
+
+func frame(t *testing.T, peer waddell.PeerId, id SessionID, purpose string) *waddell.MessageIn {
+	b, err := (&Frame{Session: id, Purpose: purpose}).Encode()
+	assert.NoError(t, err)
+	return &waddell.MessageIn{From: peer, Body: b}
+}
+
+func waitForSession(t *testing.T, m *SessionManager, peer waddell.PeerId, id SessionID) *Session {
+	for i := 0; i < 100; i++ {
+		for _, s := range m.Sessions(peer) {
+			if s.ID() == id {
+				return s
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("No session %d", id)
+	return nil
+}
+
+func TestAccept(t *testing.T) {
+	in := make(chan *waddell.MessageIn, 10)
+	out := make(chan *waddell.MessageOut, 100)
+	calls := make(chan PeerInfo, 10)
+	blocked := make(chan struct{})
+	m := NewSessionManager(in, out, &Config{
+		Accept: func(peer PeerInfo, first []byte) (bool, error) {
+			calls <- peer
+			switch peer.Purpose {
+			case "slow":
+				<-blocked
+			case "panic":
+				panic("Oops")
+			case "quota":
+				return false, fmt.Errorf("Over quota")
+			}
+			assert.Equal(t, "hello", string(first))
+			return true, nil
+		},
+	})
+	defer m.Close()
+	defer close(blocked)
+	peer, _ := waddell.PeerIdFromString("peer")
+
+	// A slow decision doesn't hold up others
+	in <- frameWithMsg(t, peer, 1, "slow", "hello")
+	in <- frameWithMsg(t, peer, 1, "data", "hello")
+	in <- frameWithMsg(t, peer, 1, "data", "more")
+	for i := 0; i < 2; i++ {
+		select {
+		case <-calls:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Accept wasn't consulted")
+		}
+	}
+	waitForSession(t, m, peer, 1)
+	assert.Equal(t, int64(1), m.Counters().Started, "Only the accepted session should have started")
+
+	// Refusals reach the peer with their reason
+	in <- frameWithMsg(t, peer, 2, "quota", "hello")
+	refusal := nextFrame(t, out, "quota")
+	if refusal != nil {
+		assert.True(t, refusal.Answer)
+		assert.Equal(t, SessionID(2), refusal.Session)
+		assert.Equal(t, string(natty.PeerErrorMsg(natty.PeerRejected, "Over quota")), string(refusal.Msg))
+	}
+	<-calls
+	in <- frameWithMsg(t, peer, 2, "quota", "again")
+
+	// Panics are contained
+	in <- frameWithMsg(t, peer, 3, "panic", "hello")
+	refusal = nextFrame(t, out, "panic")
+	if refusal != nil {
+		assert.Equal(t, string(natty.PeerErrorMsg(natty.PeerInternalError, "")), string(refusal.Msg))
+	}
+	<-calls
+	assert.Equal(t, int64(2), m.Counters().Rejected)
+	select {
+	case peer := <-calls:
+		t.Errorf("Refused session shouldn't be reconsidered: %v", peer)
+	default:
+	}
+}
+
+func frameWithMsg(t *testing.T, peer waddell.PeerId, id SessionID, purpose string, msg string) *waddell.MessageIn {
+	b, err := (&Frame{Session: id, Purpose: purpose, Msg: []byte(msg)}).Encode()
+	assert.NoError(t, err)
+	return &waddell.MessageIn{From: peer, Body: b}
+}
+
+// nextFrame returns the next frame sent for the given purpose.
+func nextFrame(t *testing.T, out <-chan *waddell.MessageOut, purpose string) *Frame {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case wm := <-out:
+			f, err := Decode(wm.Body[0])
+			if assert.NoError(t, err) && f.Purpose == purpose {
+				return f
+			}
+		case <-timeout:
+			t.Errorf("Nothing sent for %q", purpose)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package natty
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Text sends signaling messages as natty's JSON text.
+	Text = WireFormat(iota)
+
+	// Binary packs signaling messages into a compact binary encoding, which is
+	// useful for bandwidth-constrained signaling channels.
+	Binary
+
+	// V1 pins a Traversal to version 1 of the wire format, which is exactly
+	// what Text was when versions were introduced, for interoperating with
+	// peers that predate them. A V1 Traversal never advertises a version and
+	// ignores the advertisements of its peer, so it keeps speaking V1 even if
+	// Text changes in the future.
+	V1
+
+	// Negotiated, the default, emits V1 text until the peer advertises that
+	// it supports a newer version and then upgrades to the newest version
+	// that both sides support. Peers that don't advertise a version (like V1
+	// ones) are only ever sent V1.
+	Negotiated
+)
+
+const (
+	// Versions of the wire format. V2 adds version advertisements and emits
+	// everything in the Binary encoding.
+	wireV1 = 1
+	wireV2 = 2
+
+	// currentWireVersion is the newest version that we support
+	currentWireVersion = wireV2
+)
+
+const (
+	// wireVersionBinary is the first byte of every binary-encoded message.
+	// Text messages are JSON and always start with '{', so this byte is what
+	// allows a Traversal to accept messages in either format.
+	wireVersionBinary = byte(0x01)
+
+	// kinds of binary-encoded messages
+	kindCompressedJSON = byte(0x00)
+	kindCandidate      = byte(0x01)
+	kindTagged         = byte(0x02)
+	kindVersion        = byte(0x03)
+	kindPeerError      = byte(0x04)
+
+	candidateFlagTCP   = byte(0x01)
+	candidateFlagRAddr = byte(0x02)
+
+	// taggedTextPrefix is how tagged text messages start
+	taggedTextPrefix = `{"from":`
+)
+
+var (
+	candidateTypes = []string{"host", "srflx", "prflx", "relay"}
+)
+
+// WireFormat determines how a Traversal encodes the messages that it emits via
+// NextMsgOut().
+type WireFormat int
+
+// candidateMsg is the JSON structure that natty uses for ICE candidates.
+type candidateMsg struct {
+	Candidate     string `json:"candidate"`
+	SdpMid        string `json:"sdpMid"`
+	SdpMLineIndex int    `json:"sdpMLineIndex"`
+}
+
+// taggedMsg is the envelope in which Traversals with a session tag send their
+// messages as text.
+type taggedMsg struct {
+	From    string          `json:"from"`
+	Session string          `json:"session"`
+	Msg     json.RawMessage `json:"msg"`
+}
+
+// encodeMsg encodes the given message from natty in the given WireFormat.
+// Messages that are already binary (like version advertisements) are left
+// alone.
+func encodeMsg(msg string, format WireFormat) string {
+	if format != Binary || (len(msg) > 0 && msg[0] == wireVersionBinary) {
+		return msg
+	}
+	encoded, err := encodeCandidate(msg)
+	if err != nil {
+		log.Tracef("Not encoding as candidate: %s", err)
+		encoded, err = encodeCompressedJSON(msg)
+		if err != nil {
+			log.Tracef("Unable to encode message, sending as text: %s", err)
+			return msg
+		}
+	}
+	return string(encoded)
+}
+
+// decodeMsg decodes a message from the peer into natty's text format. Messages
+// in either format are accepted.
+func decodeMsg(msg string) (string, error) {
+	if len(msg) == 0 || msg[0] != wireVersionBinary {
+		return msg, nil
+	}
+	if len(msg) < 2 {
+		return "", fmt.Errorf("Binary message too short")
+	}
+	body := []byte(msg[2:])
+	switch msg[1] {
+	case kindCompressedJSON:
+		decoded, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(body)))
+		if err != nil {
+			return "", fmt.Errorf("Unable to decompress message: %s", err)
+		}
+		return string(decoded), nil
+	case kindCandidate:
+		return decodeCandidate(body)
+	case kindVersion, kindPeerError:
+		// Not meant for natty, the Traversal handles it
+		return msg, nil
+	}
+	return "", fmt.Errorf("Unknown binary message kind %d", msg[1])
+}
+
+// versionMsg is the advertisement of the newest wire format version that a
+// Traversal supports. Peers that predate versions fail to decode it and drop
+// it, which is what makes it safe to send to anyone.
+func versionMsg(version int) []byte {
+	buf := bytes.NewBuffer(append(getMsgBuf(), wireVersionBinary, kindVersion))
+	putUvarint(buf, uint64(version))
+	return buf.Bytes()
+}
+
+// parseVersionMsg returns the version advertised by msg if it's a version
+// advertisement.
+func parseVersionMsg(msg []byte) (version int, ok bool) {
+	if len(msg) < 3 || msg[0] != wireVersionBinary || msg[1] != kindVersion {
+		return 0, false
+	}
+	v, n := binary.Uvarint(msg[2:])
+	if n <= 0 {
+		return 0, false
+	}
+	return int(v), true
+}
+
+// tagMsg wraps msg, already encoded in the given WireFormat, in an envelope
+// saying that it's from a Traversal with the given role and session tag.
+func tagMsg(msg string, format WireFormat, from string, session string) string {
+	if format != Binary {
+		b, err := json.Marshal(&taggedMsg{From: from, Session: session, Msg: json.RawMessage(msg)})
+		if err == nil {
+			return string(b)
+		}
+		log.Tracef("Unable to tag message, sending as binary: %s", err)
+		msg = encodeMsg(msg, Binary)
+	}
+	buf := bytes.NewBuffer([]byte{wireVersionBinary, kindTagged, byte(indexOf(roles, from))})
+	putString(buf, session)
+	buf.WriteString(msg)
+	return buf.String()
+}
+
+// untagMsg unwraps a message from tagMsg, returning the role and session tag
+// of the Traversal from which it came. Untagged messages are returned as is,
+// with an empty role and session.
+func untagMsg(msg string) (inner string, from string, session string, err error) {
+	if len(msg) >= 2 && msg[0] == wireVersionBinary && msg[1] == kindTagged {
+		r := bytes.NewReader([]byte(msg[2:]))
+		role, err := r.ReadByte()
+		if err != nil {
+			return "", "", "", err
+		}
+		if int(role) >= len(roles) {
+			return "", "", "", fmt.Errorf("Unknown role %d", role)
+		}
+		session, err := getString(r)
+		if err != nil {
+			return "", "", "", err
+		}
+		return msg[len(msg)-r.Len():], roles[role], session, nil
+	}
+	if strings.HasPrefix(msg, taggedTextPrefix) {
+		tagged := &taggedMsg{}
+		err := json.Unmarshal([]byte(msg), tagged)
+		if err != nil {
+			return "", "", "", fmt.Errorf("Unable to parse tagged message: %s", err)
+		}
+		return string(tagged.Msg), tagged.From, tagged.Session, nil
+	}
+	return msg, "", "", nil
+}
+
+// untagAndDecodeMsg untags and decodes msg like untagMsg and decodeMsg do,
+// returning the result in msg's buffer. Untagged text messages, by far the
+// most common, are returned as is.
+func untagAndDecodeMsg(msg []byte) (decoded []byte, from string, session string, err error) {
+	if (len(msg) == 0 || msg[0] != wireVersionBinary) && !bytes.HasPrefix(msg, []byte(taggedTextPrefix)) {
+		return msg, "", "", nil
+	}
+	inner, from, session, err := untagMsg(string(msg))
+	if err != nil {
+		return nil, "", "", err
+	}
+	decodedString, err := decodeMsg(inner)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return append(msg[:0], decodedString...), from, session, nil
+}
+
+func encodeCompressedJSON(msg string) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{wireVersionBinary, kindCompressedJSON})
+	w, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write([]byte(msg))
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeCandidate packs a candidate message into a tight binary structure. It
+// returns an error for anything that isn't a candidate or that includes
+// attributes it doesn't know how to pack, in which case the caller falls back
+// to compressed JSON.
+func encodeCandidate(msg string) ([]byte, error) {
+	fields := make(map[string]interface{})
+	err := json.Unmarshal([]byte(msg), &fields)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("Unexpected fields for candidate")
+	}
+	cm := &candidateMsg{}
+	err = json.Unmarshal([]byte(msg), cm)
+	if err != nil {
+		return nil, err
+	}
+	if cm.Candidate == "" {
+		return nil, fmt.Errorf("Not a candidate")
+	}
+
+	parts := strings.Fields(strings.TrimPrefix(cm.Candidate, "candidate:"))
+	if len(parts) != 10 && len(parts) != 14 {
+		return nil, fmt.Errorf("Unexpected candidate attributes")
+	}
+	if parts[6] != "typ" || parts[len(parts)-2] != "generation" {
+		return nil, fmt.Errorf("Unexpected candidate attributes")
+	}
+
+	var flags byte
+	switch strings.ToLower(parts[2]) {
+	case "udp":
+	case "tcp":
+		flags |= candidateFlagTCP
+	default:
+		return nil, fmt.Errorf("Unknown transport %s", parts[2])
+	}
+	if len(parts) == 14 {
+		if parts[8] != "raddr" || parts[10] != "rport" {
+			return nil, fmt.Errorf("Unexpected candidate attributes")
+		}
+		flags |= candidateFlagRAddr
+	}
+
+	buf := bytes.NewBuffer([]byte{wireVersionBinary, kindCandidate, flags})
+	putString(buf, parts[0])
+	component, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte(byte(component))
+	priority, err := strconv.ParseUint(parts[3], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	binary.Write(buf, binary.BigEndian, uint32(priority))
+	err = putIPPort(buf, parts[4], parts[5])
+	if err != nil {
+		return nil, err
+	}
+	typ := indexOf(candidateTypes, parts[7])
+	if typ < 0 {
+		return nil, fmt.Errorf("Unknown candidate type %s", parts[7])
+	}
+	buf.WriteByte(byte(typ))
+	if flags&candidateFlagRAddr != 0 {
+		err = putIPPort(buf, parts[9], parts[11])
+		if err != nil {
+			return nil, err
+		}
+	}
+	generation, err := strconv.ParseUint(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	putUvarint(buf, generation)
+	putString(buf, cm.SdpMid)
+	putUvarint(buf, uint64(cm.SdpMLineIndex))
+
+	// Make sure that we can faithfully reproduce the candidate
+	decoded, err := decodeCandidate(buf.Bytes()[2:])
+	if err != nil {
+		return nil, err
+	}
+	dcm := &candidateMsg{}
+	err = json.Unmarshal([]byte(decoded), dcm)
+	if err != nil || *dcm != *cm {
+		return nil, fmt.Errorf("Candidate doesn't survive round trip")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeCandidate(body []byte) (string, error) {
+	r := bytes.NewReader(body)
+	flags, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	foundation, err := getString(r)
+	if err != nil {
+		return "", err
+	}
+	component, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	var priority uint32
+	err = binary.Read(r, binary.BigEndian, &priority)
+	if err != nil {
+		return "", err
+	}
+	ip, port, err := getIPPort(r)
+	if err != nil {
+		return "", err
+	}
+	typ, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if int(typ) >= len(candidateTypes) {
+		return "", fmt.Errorf("Unknown candidate type %d", typ)
+	}
+	transport := "udp"
+	if flags&candidateFlagTCP != 0 {
+		transport = "tcp"
+	}
+	candidate := fmt.Sprintf("candidate:%s %d %s %d %s %d typ %s", foundation, component, transport, priority, ip, port, candidateTypes[typ])
+	if flags&candidateFlagRAddr != 0 {
+		rip, rport, err := getIPPort(r)
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s raddr %s rport %d", candidate, rip, rport)
+	}
+	generation, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	candidate = fmt.Sprintf("%s generation %d", candidate, generation)
+	sdpMid, err := getString(r)
+	if err != nil {
+		return "", err
+	}
+	sdpMLineIndex, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(&candidateMsg{
+		Candidate:     candidate,
+		SdpMid:        sdpMid,
+		SdpMLineIndex: int(sdpMLineIndex),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	buf.Write(b[:binary.PutUvarint(b, v)])
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	putUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func getString(r *bytes.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if l > uint64(r.Len()) {
+		return "", fmt.Errorf("String length %d exceeds message", l)
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+func putIPPort(buf *bytes.Buffer, ipString string, portString string) error {
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		return fmt.Errorf("Unable to parse IP %s", ipString)
+	}
+	if ip4 := ip.To4(); ip4 != nil && !strings.Contains(ipString, ":") {
+		ip = ip4
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return err
+	}
+	buf.WriteByte(byte(len(ip)))
+	buf.Write(ip)
+	return binary.Write(buf, binary.BigEndian, uint16(port))
+}
+
+func getIPPort(r *bytes.Reader) (net.IP, uint16, error) {
+	l, err := r.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+	if l != net.IPv4len && l != net.IPv6len {
+		return nil, 0, fmt.Errorf("Bad IP length %d", l)
+	}
+	ip := make(net.IP, l)
+	_, err = io.ReadFull(r, ip)
+	if err != nil {
+		return nil, 0, err
+	}
+	var port uint16
+	err = binary.Read(r, binary.BigEndian, &port)
+	return ip, port, err
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,148 @@
+package natty
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/getlantern/testify/assert"
+)
+
+const (
+	testCandidate      = `{"candidate":"candidate:3098575963 1 udp 2122260223 192.168.1.160 55285 typ host generation 0","sdpMid":"data","sdpMLineIndex":0}`
+	testRelayCandidate = `{"candidate":"candidate:1234 1 udp 41885439 2001:db8::1 3478 typ relay raddr 203.0.113.7 rport 60530 generation 1","sdpMid":"data","sdpMLineIndex":1}`
+	testOddCandidate   = `{"candidate":"candidate:1 1 tcp 1518280447 192.168.1.160 9 typ host tcptype active generation 0","sdpMid":"data","sdpMLineIndex":0}`
+	testSDP            = `{"type":"offer","sdp":"v=0\r\no=- 4611731400430051336 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=msid-semantic: WMS\r\nm=application 1 DTLS/SCTP 5000\r\nc=IN IP4 0.0.0.0\r\na=ice-ufrag:abcd\r\na=ice-pwd:abcdefghijklmnopqrstuvwx\r\na=mid:data\r\n"}`
+)
+
+func TestWireFormat(t *testing.T) {
+	for _, msg := range []string{testCandidate, testRelayCandidate, testOddCandidate, testSDP} {
+		assert.Equal(t, msg, encodeMsg(msg, Text), "Text format should leave message alone")
+
+		encoded := encodeMsg(msg, Binary)
+		assert.Equal(t, wireVersionBinary, encoded[0], "Binary message should start with version byte")
+		assert.True(t, len(encoded) < len(msg), "Binary message should be smaller")
+
+		decoded, err := decodeMsg(encoded)
+		if assert.NoError(t, err, "Should be able to decode binary message") {
+			assertSameJSON(t, msg, decoded)
+		}
+
+		decoded, err = decodeMsg(msg)
+		assert.NoError(t, err, "Should be able to decode text message")
+		assert.Equal(t, msg, decoded, "Text message should pass through unchanged")
+	}
+
+	encoded := encodeMsg(testCandidate, Binary)
+	assert.Equal(t, kindCandidate, encoded[1], "Candidate should be packed")
+	encoded = encodeMsg(testOddCandidate, Binary)
+	assert.Equal(t, kindCompressedJSON, encoded[1], "Candidate with unknown attributes should fall back to compressed JSON")
+
+	_, err := decodeMsg(string([]byte{wireVersionBinary, kindCandidate, 0, 100}))
+	assert.Error(t, err, "Truncated binary message should fail to decode")
+}
+
+func assertSameJSON(t *testing.T, expected string, actual string) {
+	var e, a interface{}
+	assert.NoError(t, json.Unmarshal([]byte(expected), &e))
+	assert.NoError(t, json.Unmarshal([]byte(actual), &a))
+	assert.Equal(t, e, a, "JSON should match")
+}
+
+// TestWireV1Golden checks V1 against transcripts captured from the release
+// that introduced versions, which V1 must reproduce forever.
+func TestWireV1Golden(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/wire_v1.json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var golden struct {
+		Emitted []struct {
+			Session  string `json:"session"`
+			Offering bool   `json:"offering"`
+			Natty    string `json:"natty"`
+			Wire     string `json:"wire"`
+		} `json:"emitted"`
+		Accepted []struct {
+			Wire    []byte `json:"wire"`
+			Natty   string `json:"natty"`
+			From    string `json:"from"`
+			Session string `json:"session"`
+		} `json:"accepted"`
+	}
+	if !assert.NoError(t, json.Unmarshal(b, &golden)) {
+		return
+	}
+
+	for _, e := range golden.Emitted {
+		tr := newTraversal(0, []Option{WithWireFormat(V1), WithSessionTag(e.Session)})
+		tr.offering = e.Offering
+		tr.initChannels()
+		// A V1 Traversal ignores the peer's advertisement
+		assert.NoError(t, tr.TryMsgInBytes(versionMsg(currentWireVersion)))
+		tr.emitMsg(append(getMsgBuf(), e.Natty...))
+		assert.Equal(t, e.Wire, string(<-tr.msgOutCh))
+	}
+	for _, a := range golden.Accepted {
+		decoded, from, session, err := untagAndDecodeMsg(append(getMsgBuf(), a.Wire...))
+		if assert.NoError(t, err) {
+			assert.Equal(t, a.Natty, string(decoded))
+			assert.Equal(t, a.From, from)
+			assert.Equal(t, a.Session, session)
+		}
+	}
+}
+
+func TestWireNegotiation(t *testing.T) {
+	tr := newTraversal(0, nil)
+	tr.initChannels()
+	tr.emitMsg(append(getMsgBuf(), testCandidate...))
+	assert.Equal(t, testCandidate, string(<-tr.msgOutCh), "Should emit V1 until the peer advertises a version")
+
+	assert.NoError(t, tr.TryMsgInBytes(versionMsg(currentWireVersion)))
+	tr.emitMsg(append(getMsgBuf(), testCandidate...))
+	assert.Equal(t, encodeMsg(testCandidate, Binary), string(<-tr.msgOutCh), "Should upgrade once the peer advertises V2")
+
+	version, ok := parseVersionMsg(versionMsg(wireV1))
+	assert.True(t, ok)
+	assert.Equal(t, wireV1, version)
+	_, ok = parseVersionMsg([]byte(encodeMsg(testCandidate, Binary)))
+	assert.False(t, ok, "Candidate isn't a version advertisement")
+}
+
+// TestWireV1WithNegotiatedPeer traverses between a V1 offerer and a default
+// answerer, which must only ever send V1 to it.
+func TestWireV1WithNegotiatedPeer(t *testing.T) {
+	offer := Offer(15*time.Second, WithWireFormat(V1))
+	defer offer.Close()
+	answer := Answer(15 * time.Second)
+	defer answer.Close()
+
+	go func() {
+		for {
+			msg, done := offer.NextMsgOut()
+			if done {
+				return
+			}
+			assert.NotEqual(t, wireVersionBinary, msg[0], "V1 peer shouldn't emit binary")
+			answer.MsgIn(msg)
+		}
+	}()
+	go func() {
+		for {
+			msg, done := answer.NextMsgOut()
+			if done {
+				return
+			}
+			_, isVersion := parseVersionMsg([]byte(msg))
+			assert.True(t, isVersion || msg[0] != wireVersionBinary, "Negotiating peer should only send V1 to V1 peer")
+			offer.MsgIn(msg)
+		}
+	}()
+
+	_, err := offer.FiveTuple()
+	assert.NoError(t, err, "V1 offerer should connect")
+	_, err = answer.FiveTuple()
+	assert.NoError(t, err, "Negotiating answerer should connect")
+}